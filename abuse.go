@@ -0,0 +1,513 @@
+// abuse.go
+// Flags accounts whose usage looks scripted (volume, failures, rejected prompts, the same
+// prompt over and over) for review, optionally throttling them until an admin clears it
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	abuseAnalyzeLockKey = "abuse:analyze:lock"
+	abuseThrottledKey   = "abuse:throttled" // set of user IDs, mirrored from user_flags
+
+	flagReview    = "review"
+	flagThrottled = "throttled"
+
+	actorAnalyzer = "analyzer"
+)
+
+var abuseAnalyzeInterval = getEnvDuration("ABUSE_ANALYZE_INTERVAL", 5*time.Minute)
+
+// AbuseThresholds configures the analyzer; it's stored in abuse_thresholds and reloaded
+// every interval, so PUT /admin/abuse/thresholds takes effect on every instance
+type AbuseThresholds struct {
+	WindowHours int `json:"window_hours"` // rolling window for everything but requests/hour
+	// Failure and identical-prompt ratios need this many requests in the window to count
+	MinRequests        int     `json:"min_requests"`
+	MaxRequestsPerHour int     `json:"max_requests_per_hour"`
+	MaxFailureRate     float64 `json:"max_failure_rate"`
+	MaxRejections      int     `json:"max_rejections"`
+	MaxIdenticalRatio  float64 `json:"max_identical_prompt_ratio"`
+	AutoThrottle       bool    `json:"auto_throttle"`
+	ThrottleRateLimit  int     `json:"throttle_rate_limit"` // publishes per rate window while throttled
+	ClearedGraceHours  int     `json:"cleared_grace_hours"` // a cleared user isn't re-flagged for this long
+}
+
+func defaultAbuseThresholds() AbuseThresholds {
+	return AbuseThresholds{
+		WindowHours:        getEnvInt("ABUSE_WINDOW_HOURS", 24),
+		MinRequests:        getEnvInt("ABUSE_MIN_REQUESTS", 20),
+		MaxRequestsPerHour: getEnvInt("ABUSE_MAX_REQUESTS_PER_HOUR", 200),
+		MaxFailureRate:     getEnvFloat("ABUSE_MAX_FAILURE_RATE", 0.5),
+		MaxRejections:      getEnvInt("ABUSE_MAX_REJECTIONS", 20),
+		MaxIdenticalRatio:  getEnvFloat("ABUSE_MAX_IDENTICAL_PROMPT_RATIO", 0.8),
+		AutoThrottle:       getEnvBool("ABUSE_AUTO_THROTTLE", false),
+		ThrottleRateLimit:  getEnvInt("ABUSE_THROTTLE_RATE_LIMIT", 2),
+		ClearedGraceHours:  getEnvInt("ABUSE_CLEARED_GRACE_HOURS", 24),
+	}
+}
+
+func (t AbuseThresholds) validate() error {
+	switch {
+	case t.WindowHours < 1 || t.WindowHours > 24*7:
+		return fmt.Errorf("window_hours must be between 1 and %d", 24*7)
+	case t.MinRequests < 1:
+		return fmt.Errorf("min_requests must be at least 1")
+	case t.MaxFailureRate <= 0 || t.MaxFailureRate > 1, t.MaxIdenticalRatio <= 0 || t.MaxIdenticalRatio > 1:
+		return fmt.Errorf("ratios must be in (0, 1]")
+	case t.MaxRequestsPerHour < 1, t.MaxRejections < 1, t.ThrottleRateLimit < 1:
+		return fmt.Errorf("max_requests_per_hour, max_rejections and throttle_rate_limit must be at least 1")
+	case t.ClearedGraceHours < 0:
+		return fmt.Errorf("cleared_grace_hours must not be negative")
+	}
+	return nil
+}
+
+var currentAbuseThresholds atomic.Pointer[AbuseThresholds]
+
+func init() {
+	t := defaultAbuseThresholds()
+	currentAbuseThresholds.Store(&t)
+}
+
+// loadAbuseThresholds swaps in the stored thresholds, keeping the current ones if the
+// row is missing or invalid
+func loadAbuseThresholds(ctx context.Context) error {
+	var raw []byte
+	err := db.QueryRowContext(ctx, `SELECT config FROM abuse_thresholds WHERE id = 1`).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t := defaultAbuseThresholds()
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return err
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	currentAbuseThresholds.Store(&t)
+	return nil
+}
+
+// Signals are kept in hourly Redis buckets that expire after the longest window
+func abuseBucket(t time.Time) string { return strconv.FormatInt(t.Unix()/3600, 10) }
+
+func abuseKeys(prefix, userID string, hours int) []string {
+	keys := make([]string, hours)
+	now := time.Now()
+	for i := range keys {
+		keys[i] = prefix + userID + ":" + abuseBucket(now.Add(-time.Duration(i)*time.Hour))
+	}
+	return keys
+}
+
+const abuseBucketTTL = 8 * 24 * time.Hour
+
+// recordPromptRejection counts a prompt refused by validation
+func recordPromptRejection(ctx context.Context, userID string) {
+	bucket := abuseBucket(time.Now())
+	pipe := rdb.Pipeline()
+	pipe.Incr(ctx, "abuse:rejections:"+userID+":"+bucket)
+	pipe.Expire(ctx, "abuse:rejections:"+userID+":"+bucket, abuseBucketTTL)
+	// Users with nothing but rejections have no rows for the analyzer to find
+	pipe.SAdd(ctx, "abuse:rejecting:"+bucket, userID)
+	pipe.Expire(ctx, "abuse:rejecting:"+bucket, abuseBucketTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Failed to record prompt rejection for %s: %v", userID, err)
+	}
+}
+
+// recordRejectedPrompt is recordPromptRejection for the requesting user
+func recordRejectedPrompt(c *gin.Context) {
+	if user, ok := c.Get("currentUser"); ok {
+		recordPromptRejection(c.Request.Context(), user.(*repository.User).ID.String())
+	}
+}
+
+// recordPromptSignal counts an accepted prompt; only a hash of it reaches Redis
+func recordPromptSignal(ctx context.Context, userID, prompt string) {
+	sum := sha256.Sum256([]byte(prompt))
+	bucket := abuseBucket(time.Now())
+	pipe := rdb.Pipeline()
+	pipe.PFAdd(ctx, "abuse:prompts:"+userID+":"+bucket, hex.EncodeToString(sum[:16]))
+	pipe.Expire(ctx, "abuse:prompts:"+userID+":"+bucket, abuseBucketTTL)
+	pipe.Incr(ctx, "abuse:prompt_count:"+userID+":"+bucket)
+	pipe.Expire(ctx, "abuse:prompt_count:"+userID+":"+bucket, abuseBucketTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Failed to record prompt signal for %s: %v", userID, err)
+	}
+}
+
+// AbuseSignals is what the analyzer measured for one user
+type AbuseSignals struct {
+	Requests             int      `json:"requests"` // in the window
+	RequestsLastHour     int      `json:"requests_last_hour"`
+	FailureRate          float64  `json:"failure_rate"`
+	Rejections           int      `json:"rejections"`
+	IdenticalPromptRatio float64  `json:"identical_prompt_ratio"`
+	Triggered            []string `json:"triggered"`
+}
+
+func sumCounters(ctx context.Context, keys []string) int {
+	vals, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return 0
+	}
+	total := 0
+	for _, v := range vals {
+		if s, ok := v.(string); ok {
+			n, _ := strconv.Atoi(s)
+			total += n
+		}
+	}
+	return total
+}
+
+// evaluate fills in the Redis-backed signals and the thresholds s crosses
+func (s *AbuseSignals) evaluate(ctx context.Context, userID string, t AbuseThresholds) {
+	s.Rejections = sumCounters(ctx, abuseKeys("abuse:rejections:", userID, t.WindowHours))
+	if prompts := sumCounters(ctx, abuseKeys("abuse:prompt_count:", userID, t.WindowHours)); prompts > 0 {
+		if distinct, err := rdb.PFCount(ctx, abuseKeys("abuse:prompts:", userID, t.WindowHours)...).Result(); err == nil {
+			s.IdenticalPromptRatio = max(0, 1-float64(distinct)/float64(prompts))
+		}
+	}
+
+	if s.RequestsLastHour > t.MaxRequestsPerHour {
+		s.Triggered = append(s.Triggered, fmt.Sprintf("requests_last_hour %d > %d", s.RequestsLastHour, t.MaxRequestsPerHour))
+	}
+	if s.Rejections > t.MaxRejections {
+		s.Triggered = append(s.Triggered, fmt.Sprintf("rejections %d > %d", s.Rejections, t.MaxRejections))
+	}
+	if s.Requests >= t.MinRequests {
+		if s.FailureRate > t.MaxFailureRate {
+			s.Triggered = append(s.Triggered, fmt.Sprintf("failure_rate %.2f > %.2f", s.FailureRate, t.MaxFailureRate))
+		}
+		if s.IdenticalPromptRatio > t.MaxIdenticalRatio {
+			s.Triggered = append(s.Triggered, fmt.Sprintf("identical_prompt_ratio %.2f > %.2f", s.IdenticalPromptRatio, t.MaxIdenticalRatio))
+		}
+	}
+}
+
+// collectSignals gathers the database signals for every user active in the window
+func collectSignals(ctx context.Context, t AbuseThresholds) (map[string]*AbuseSignals, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id, count(*), count(*) FILTER (WHERE created_at > now() - interval '1 hour'),
+		       count(*) FILTER (WHERE status = 'failed')
+		FROM generated_content
+		WHERE created_at > now() - $1 * interval '1 hour' AND content_type IN ('image', 'video')
+		GROUP BY user_id`, t.WindowHours)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signals := map[string]*AbuseSignals{}
+	for rows.Next() {
+		var userID string
+		var s AbuseSignals
+		var failed int
+		if err := rows.Scan(&userID, &s.Requests, &s.RequestsLastHour, &failed); err != nil {
+			return nil, err
+		}
+		s.FailureRate = float64(failed) / float64(max(s.Requests, 1))
+		signals[userID] = &s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := 0; i < t.WindowHours; i++ {
+		ids, _ := rdb.SMembers(ctx, "abuse:rejecting:"+abuseBucket(now.Add(-time.Duration(i)*time.Hour))).Result()
+		for _, id := range ids {
+			if signals[id] == nil {
+				signals[id] = &AbuseSignals{}
+			}
+		}
+	}
+	return signals, nil
+}
+
+// auditAbuse records an action on a user's flag (or on the thresholds, with no user);
+// every automatic action goes through here
+func auditAbuse(ctx context.Context, userID, action, actor string, detail interface{}) {
+	data, _ := json.Marshal(detail)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO abuse_audit (user_id, action, actor, detail) VALUES (nullif($1, '')::uuid, $2, $3, $4)`,
+		userID, action, actor, data); err != nil {
+		log.Printf("⚠️ Failed to audit %s on user %s: %v", action, userID, err)
+	}
+}
+
+// flagUser puts userID under review (throttled if configured), unless already flagged or
+// cleared within the grace period. flagged reports a new flag
+func flagUser(ctx context.Context, userID string, s *AbuseSignals, t AbuseThresholds) (flagged bool, err error) {
+	state := flagReview
+	if t.AutoThrottle {
+		state = flagThrottled
+	}
+	signals, _ := json.Marshal(s)
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO user_flags (user_id, state, signals, flagged_at, flagged_by)
+		VALUES ($1, $2, $3, now(), $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET state = EXCLUDED.state, signals = EXCLUDED.signals, flagged_at = now(), flagged_by = EXCLUDED.flagged_by,
+		    cleared_at = NULL, cleared_by = NULL
+		WHERE user_flags.state = 'cleared' AND user_flags.cleared_at < now() - $5 * interval '1 hour'`,
+		userID, state, signals, actorAnalyzer, t.ClearedGraceHours)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	auditAbuse(ctx, userID, state, actorAnalyzer, s)
+	if state == flagThrottled {
+		rdb.SAdd(ctx, abuseThrottledKey, userID)
+	}
+	return true, nil
+}
+
+// syncThrottled rebuilds the Redis mirror of throttled users from the database
+func syncThrottled(ctx context.Context) error {
+	ids, err := queryKeys(ctx, `SELECT user_id::text FROM user_flags WHERE state = 'throttled'`)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, abuseThrottledKey)
+	if len(ids) > 0 {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		pipe.SAdd(ctx, abuseThrottledKey, members...)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// abuseThrottled reports whether userID is held to the punitive rate; Redis errors let them through
+func abuseThrottled(ctx context.Context, userID string) bool {
+	ok, err := rdb.SIsMember(ctx, abuseThrottledKey, userID).Result()
+	return err == nil && ok
+}
+
+// throttledAdmission narrows policy for a throttled user
+func throttledAdmission(ctx context.Context, userID string, policy admissionPolicy) admissionPolicy {
+	if !abuseThrottled(ctx, userID) {
+		return policy
+	}
+	policy.WindowLimit = min(policy.WindowLimit, currentAbuseThresholds.Load().ThrottleRateLimit)
+	policy.Mode = admissionReject
+	return policy
+}
+
+// startAbuseAnalyzer reloads the thresholds on every instance, and on one instance at a
+// time measures every active user and flags those over them
+func startAbuseAnalyzer() {
+	ticker := time.NewTicker(abuseAnalyzeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("abuse_analyzer", nil, func() {
+			ctx := context.Background()
+			if err := loadAbuseThresholds(ctx); err != nil {
+				log.Printf("⚠️ Failed to reload abuse thresholds, keeping the current ones: %v", err)
+			}
+			ok, err := rdb.SetNX(ctx, abuseAnalyzeLockKey, "1", abuseAnalyzeInterval).Result()
+			if err != nil || !ok {
+				return
+			}
+			defer rdb.Del(ctx, abuseAnalyzeLockKey)
+
+			t := *currentAbuseThresholds.Load()
+			signals, err := collectSignals(ctx, t)
+			if err != nil {
+				log.Printf("❌ Failed to collect abuse signals: %v", err)
+				return
+			}
+			flagged := 0
+			for userID, s := range signals {
+				s.evaluate(ctx, userID, t)
+				if len(s.Triggered) == 0 {
+					continue
+				}
+				if ok, err := flagUser(ctx, userID, s, t); err != nil {
+					log.Printf("❌ Failed to flag user %s: %v", userID, err)
+				} else if ok {
+					flagged++
+					log.Printf("🚩 Flagged user %s: %v", userID, s.Triggered)
+				}
+			}
+			if flagged > 0 {
+				log.Printf("🚩 Flagged %d users out of %d active", flagged, len(signals))
+			}
+			if err := syncThrottled(ctx); err != nil {
+				log.Printf("⚠️ Failed to sync throttled users: %v", err)
+			}
+		})
+	}
+}
+
+// UserFlag is a user's current review state
+type UserFlag struct {
+	UserID    string          `json:"user_id"`
+	State     string          `json:"state"` // review, throttled or cleared
+	Signals   json.RawMessage `json:"signals"`
+	FlaggedAt time.Time       `json:"flagged_at"`
+	FlaggedBy string          `json:"flagged_by"`
+	ClearedAt *time.Time      `json:"cleared_at,omitempty"`
+	ClearedBy string          `json:"cleared_by,omitempty"`
+}
+
+const userFlagColumns = `user_id, state, signals, flagged_at, flagged_by, cleared_at, coalesce(cleared_by, '')`
+
+func scanUserFlag(row rowScanner) (UserFlag, error) {
+	var f UserFlag
+	err := row.Scan(&f.UserID, &f.State, &f.Signals, &f.FlaggedAt, &f.FlaggedBy, &f.ClearedAt, &f.ClearedBy)
+	return f, err
+}
+
+// listFlagsHandler handles GET /admin/abuse/flags: users currently under review or throttled
+func listFlagsHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+userFlagColumns+` FROM user_flags WHERE state <> 'cleared' ORDER BY flagged_at DESC`)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load flags")
+		return
+	}
+	defer rows.Close()
+	flags := []UserFlag{}
+	for rows.Next() {
+		f, err := scanUserFlag(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to load flags")
+			return
+		}
+		flags = append(flags, f)
+	}
+	c.JSON(http.StatusOK, gin.H{"flags": flags, "thresholds": currentAbuseThresholds.Load()})
+}
+
+// getUserFlagsHandler handles GET /admin/users/:id/flags with the audit trail
+func getUserFlagsHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		respondError(c, codeNotFound, "User not found")
+		return
+	}
+	flag, err := scanUserFlag(db.QueryRowContext(ctx, `SELECT `+userFlagColumns+` FROM user_flags WHERE user_id = $1`, userID))
+	if err != nil && err != sql.ErrNoRows {
+		respondError(c, codeInternal, "Failed to load flags")
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT action, actor, detail, created_at FROM abuse_audit WHERE user_id = $1 ORDER BY id DESC LIMIT 100`, userID)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load flags")
+		return
+	}
+	defer rows.Close()
+	history := []gin.H{}
+	for rows.Next() {
+		var action, actor string
+		var detail json.RawMessage
+		var at time.Time
+		if err := rows.Scan(&action, &actor, &detail, &at); err != nil {
+			respondError(c, codeInternal, "Failed to load flags")
+			return
+		}
+		history = append(history, gin.H{"action": action, "actor": actor, "detail": detail, "at": at})
+	}
+
+	resp := gin.H{"user_id": userID, "history": history}
+	if flag.UserID != "" {
+		resp["flag"] = flag
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// clearUserFlagsHandler handles DELETE /admin/users/:id/flags, lifting any throttle. The
+// row stays as cleared so the grace period and the audit trail survive
+func clearUserFlagsHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	userID := c.Param("id")
+
+	if _, err := uuid.Parse(userID); err != nil {
+		respondError(c, codeNotFound, "User is not flagged")
+		return
+	}
+
+	var previous string
+	err := db.QueryRowContext(ctx, `
+		WITH old AS (SELECT state FROM user_flags WHERE user_id = $1 AND state <> 'cleared' FOR UPDATE)
+		UPDATE user_flags SET state = 'cleared', cleared_at = now(), cleared_by = $2
+		FROM old WHERE user_flags.user_id = $1
+		RETURNING old.state`, userID, admin.ID.String()).Scan(&previous)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "User is not flagged")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to clear flags on user %s: %v", userID, err)
+		respondError(c, codeInternal, "Failed to clear flags")
+		return
+	}
+	rdb.SRem(ctx, abuseThrottledKey, userID)
+	auditAbuse(ctx, userID, "cleared", admin.ID.String(), gin.H{"previous_state": previous})
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "state": "cleared", "previous_state": previous})
+}
+
+// getAbuseThresholdsHandler handles GET /admin/abuse/thresholds
+func getAbuseThresholdsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, currentAbuseThresholds.Load())
+}
+
+// putAbuseThresholdsHandler handles PUT /admin/abuse/thresholds with a full AbuseThresholds
+func putAbuseThresholdsHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	t := defaultAbuseThresholds()
+	if err := c.ShouldBindJSON(&t); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if err := t.validate(); err != nil {
+		respondError(c, codeValidationFailed, err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	data, _ := json.Marshal(t)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO abuse_thresholds (id, config, updated_by, updated_at) VALUES (1, $1, $2, now())
+		ON CONFLICT (id) DO UPDATE SET config = EXCLUDED.config, updated_by = EXCLUDED.updated_by, updated_at = now()`,
+		data, admin.ID.String()); err != nil {
+		log.Printf("❌ Failed to save abuse thresholds: %v", err)
+		respondError(c, codeInternal, "Failed to save thresholds")
+		return
+	}
+	currentAbuseThresholds.Store(&t)
+	auditAbuse(ctx, "", "thresholds_updated", admin.ID.String(), t)
+	c.JSON(http.StatusOK, t)
+}
@@ -0,0 +1,281 @@
+// accounts.go
+// Disabling and deleting accounts, and what the completion path does for requests whose
+// owner went either way while they were in flight. Both cancel the owner's requests no
+// worker has started, with a refund, through the versioned writes of
+// generation_state.go, so a completion landing at the same moment either wins or finds
+// the row cancelled. Work already running still completes: for a disabled owner the
+// result is stored and nothing is notified; for a deleted one the result object is
+// removed, the request cancelled and refunded, and only account_audit records it
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Account states
+const (
+	accountActive   = "active"
+	accountDisabled = "disabled"
+	accountDeleted  = "deleted" // final; the row stays for the ledger and the audit trail
+)
+
+var accountStateCacheTTL = getEnvDuration("ACCOUNT_STATE_CACHE_TTL", 10*time.Second)
+
+// Statuses a disable or delete cancels: nothing has run for them yet
+var unstartedStatuses = []string{"deferred", generationPendingModeration, "queued"}
+
+type cachedAccountState struct {
+	state   string
+	tenant  string
+	expires time.Time
+}
+
+var accountStateCache sync.Map // user ID -> cachedAccountState
+
+// accountState is userID's state, cached for ACCOUNT_STATE_CACHE_TTL. Users without a
+// row (header auth in development) are active
+func accountState(ctx context.Context, userID string) string {
+	state, _ := accountInfo(ctx, userID)
+	return state
+}
+
+// userTenant is userID's tenant from the same cache; users without a row are the
+// default tenant's, and a failed lookup is empty
+func userTenant(ctx context.Context, userID string) string {
+	_, tenant := accountInfo(ctx, userID)
+	return tenant
+}
+
+func accountInfo(ctx context.Context, userID string) (state, tenant string) {
+	if v, ok := accountStateCache.Load(userID); ok && clock.Now().Before(v.(cachedAccountState).expires) {
+		return v.(cachedAccountState).state, v.(cachedAccountState).tenant
+	}
+	state, tenant = accountActive, defaultTenantID
+	if err := db.QueryRowContext(ctx, `SELECT status, tenant_id FROM users WHERE id = $1`, userID).Scan(&state, &tenant); err != nil && err != sql.ErrNoRows {
+		// Don't lock everyone out over a failed lookup, but don't guess a tenant either
+		return accountActive, ""
+	}
+	accountStateCache.Store(userID, cachedAccountState{state: state, tenant: tenant, expires: clock.Now().Add(accountStateCacheTTL)})
+	return state, tenant
+}
+
+// requireActiveAccount refuses requests from disabled and deleted accounts, and from
+// users of another tenant than the host's, who don't exist as far as it's concerned
+func requireActiveAccount(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	state, tenant := accountInfo(c.Request.Context(), user.ID.String())
+	switch {
+	case tenant == "":
+		respondError(c, codeUnavailable, "Authentication is temporarily unavailable, please try again shortly")
+		return
+	case tenant != currentTenant(c).ID:
+		respondCrossTenant(c, "account", "Not found")
+		return
+	case state != accountActive:
+		respondError(c, codeForbidden, "This account is disabled")
+		return
+	}
+	c.Next()
+}
+
+// auditAccount records an account action, or a completion handled because of one
+func auditAccount(ctx context.Context, userID, action, actor, requestID string, detail interface{}) {
+	data, _ := json.Marshal(detail)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO account_audit (user_id, action, actor, request_id, detail)
+		VALUES ($1, $2, $3, nullif($4, ''), $5)`, userID, action, actor, requestID, data); err != nil {
+		log.Printf("⚠️ Failed to audit %s on account %s: %v", action, userID, err)
+	}
+}
+
+// completionAccountState reads the owner's state fresh from the row, not the cache: the
+// point is to catch a change made since the request was published. Lookup failures
+// count as active, and the completion's own writes report the error
+func completionAccountState(ctx context.Context, requestID string) (userID, state string) {
+	err := db.QueryRowContext(ctx, `
+		SELECT g.user_id, coalesce(u.status, 'active')
+		FROM generated_content g LEFT JOIN users u ON u.id = g.user_id
+		WHERE g.request_id = $1`, requestID).Scan(&userID, &state)
+	if err != nil {
+		return "", accountActive
+	}
+	return userID, state
+}
+
+// discardDeletedCompletion takes a completion for a deleted account: the request is
+// cancelled and refunded unless the account's cancel got there first (the refund is
+// idempotent either way), the result object is removed, and the audit trail is all
+// that's left of it
+func discardDeletedCompletion(ctx context.Context, userID string, completion ImageGenerationCompletion) error {
+	cancelled, err := transitionGeneration(ctx, completion.RequestID, generationWrite{
+		Writer: "account", To: "cancelled", From: []string{"queued", "processing"},
+		Set: "completed_at = now(), error = 'account deleted'", Refund: "account_deleted",
+	})
+	if err != nil {
+		return err
+	}
+	listenerActivity.dbUpdated()
+	if cancelled {
+		releaseAdmission(ctx, userID, completion.RequestID)
+	}
+	removeCompletionObject(ctx, completion)
+	rdb.Del(ctx, progressKey(completion.RequestID))
+	auditAccount(ctx, userID, "completion_discarded", "listener", completion.RequestID,
+		gin.H{"status": completion.Status, "s3_key": completion.S3Key, "cancelled": cancelled})
+	log.Printf("🗑️ Discarded %s completion %s of a deleted account", completion.Status, completion.RequestID)
+	return nil
+}
+
+// removeCompletionObject deletes a completion's result, renditions included, that no
+// row will reference; the orphan sweep gets anything this misses
+func removeCompletionObject(ctx context.Context, completion ImageGenerationCompletion) {
+	if completion.Status != "completed" || completion.S3Key == "" {
+		return
+	}
+	keys := []string{completion.S3Key}
+	for _, r := range completion.Renditions {
+		keys = append(keys, r.S3Key)
+	}
+	for _, key := range keys {
+		if err := storage.Delete(ctx, key); err != nil {
+			log.Printf("⚠️ Failed to remove result %s of request %s: %v", key, completion.RequestID, err)
+		}
+	}
+}
+
+// generationCancelled reports whether the row ended up cancelled, e.g. by an account's
+// cancel that beat the completion
+func generationCancelled(ctx context.Context, requestID string) bool {
+	var status string
+	db.QueryRowContext(ctx, `SELECT status FROM generated_content WHERE request_id = $1`, requestID).Scan(&status)
+	return status == "cancelled"
+}
+
+// cancelAccountRequests cancels and refunds userID's requests that haven't started.
+// Each is a versioned transition, so one that a completion (or the scheduler) moves on
+// meanwhile is left to that writer
+func cancelAccountRequests(ctx context.Context, userID, state string) (int, error) {
+	ids, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content WHERE user_id = $1 AND status = ANY($2)`,
+		userID, pq.Array(unstartedStatuses))
+	if err != nil {
+		return 0, err
+	}
+	cancelled := 0
+	for _, id := range ids {
+		ok, err := transitionGeneration(ctx, id, generationWrite{
+			Writer: "account", To: "cancelled", From: unstartedStatuses,
+			Set: "completed_at = now(), deferred_until = NULL, error = $4", Args: []interface{}{"account " + state},
+			Refund: "account_" + state,
+		})
+		if err != nil {
+			log.Printf("❌ Failed to cancel request %s of account %s: %v", id, userID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		cancelled++
+		releaseAdmission(ctx, userID, id)
+	}
+	return cancelled, nil
+}
+
+// setAccountState moves userID to state and cancels its unstarted requests. The state
+// changes first, so a completion arriving during the cancel already sees it
+func setAccountState(c *gin.Context, state string) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		respondError(c, codeNotFound, "User not found")
+		return
+	}
+
+	var previous string
+	err := db.QueryRowContext(ctx, `
+		WITH old AS (SELECT status FROM users WHERE id = $1 FOR UPDATE)
+		UPDATE users SET status = $2, status_changed_at = now()
+		FROM old WHERE users.id = $1 AND old.status <> 'deleted'
+		RETURNING old.status`, userID, state).Scan(&previous)
+	if err == sql.ErrNoRows {
+		var exists bool
+		db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+		if exists {
+			respondError(c, codeConflict, "Account is deleted")
+			return
+		}
+		respondError(c, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to set account %s %s: %v", userID, state, err)
+		respondError(c, codeInternal, "Failed to update account")
+		return
+	}
+	accountStateCache.Delete(userID)
+	auditAccount(ctx, userID, state, admin.ID.String(), "", gin.H{"previous_status": previous})
+
+	cancelled := 0
+	if state != accountActive {
+		if cancelled, err = cancelAccountRequests(ctx, userID, state); err != nil {
+			// The state change stands; running it again retries the cancel
+			log.Printf("❌ Failed to cancel requests of account %s: %v", userID, err)
+			respondError(c, codeInternal, "Failed to cancel the account's requests")
+			return
+		}
+	}
+	log.Printf("👤 Account %s is now %s (was %s), %d requests cancelled", userID, state, previous, cancelled)
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "status": state, "previous_status": previous, "cancelled": cancelled})
+}
+
+// adminUserHandler handles GET /admin/users/:id: the account, and the clients (platform
+// and app version) its recent requests came from
+func adminUserHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		respondError(c, codeNotFound, "User not found")
+		return
+	}
+	var status, plan string
+	var credits int
+	err := db.QueryRowContext(ctx, `SELECT status, plan, credits FROM users WHERE id = $1`, userID).Scan(&status, &plan, &credits)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load account %s: %v", userID, err)
+		respondError(c, codeInternal, "Failed to load account")
+		return
+	}
+	clients, err := recentUserClients(ctx, userID)
+	if err != nil {
+		log.Printf("❌ Failed to load the clients of %s: %v", userID, err)
+		respondError(c, codeInternal, "Failed to load account")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "status": status, "plan": plan, "credits": credits,
+		"recent_clients": clients})
+}
+
+// disableAccountHandler handles POST /admin/users/:id/disable
+func disableAccountHandler(c *gin.Context) { setAccountState(c, accountDisabled) }
+
+// enableAccountHandler handles POST /admin/users/:id/enable
+func enableAccountHandler(c *gin.Context) { setAccountState(c, accountActive) }
+
+// deleteAccountHandler handles DELETE /admin/users/:id
+func deleteAccountHandler(c *gin.Context) { setAccountState(c, accountDeleted) }
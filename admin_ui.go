@@ -0,0 +1,421 @@
+// admin_ui.go
+// Operators' status page at /admin/ui: queue depths, worker heartbeats, recent failures,
+// the dead-letter queue, background-job locks and the latest audit events, each failed
+// request linking to its event history. Plain html/template (embedded from admin_ui/)
+// and a little vanilla JS. Every section comes from the function behind a JSON endpoint
+// (/admin/queue, /admin/workers, /admin/overview, /admin/generations/:id/events), so the
+// page can't tell a different story than the API. It reloads its content when the event
+// hub reports a completion or failure on any user's request, and every minute regardless,
+// since heartbeats and dead letters raise no events. A section that fails to load is
+// reported on the page instead of failing it: the page is most needed when things break
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+//go:embed admin_ui/*.html
+var adminUIFiles embed.FS
+
+const (
+	overviewFailures    = 20
+	overviewAuditEvents = 50
+)
+
+var adminUITemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return clock.Now().Sub(t).Round(time.Second).String() + " ago"
+	},
+	"seconds": func(s float64) string {
+		return (time.Duration(s) * time.Second).String()
+	},
+	"percent": func(f float64) string {
+		return strconv.FormatFloat(f*100, 'f', -1, 64) + "%"
+	},
+	"deref": func(f *float64) float64 { return *f },
+}).ParseFS(adminUIFiles, "admin_ui/*.html"))
+
+// RecentFailure is a failed or timed-out request of /admin/overview
+type RecentFailure struct {
+	RequestID string    `json:"request_id"`
+	UserID    string    `json:"user_id"`
+	Model     string    `json:"model"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error"`
+	WorkerID  string    `json:"worker_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// JobLock is the Redis key a background job takes so that one instance runs it. Only
+// leases name their holder; the other locks just say a run was taken within their TTL
+type JobLock struct {
+	Job              string  `json:"job"`
+	Key              string  `json:"key"`
+	Held             bool    `json:"held"`
+	Holder           string  `json:"holder,omitempty"`
+	ThisInstance     bool    `json:"this_instance"`
+	ExpiresInSeconds float64 `json:"expires_in_seconds,omitempty"`
+}
+
+type jobLockKey struct {
+	job, key string
+	lease    bool // the value is the holder's instanceID
+}
+
+// jobLocks are the fixed lock keys; backfills add one per running backfill
+var jobLocks = []jobLockKey{
+	{"queue_history", queueHistoryLeaderKey, true},
+	{"analytics", analyticsLeaderKey, true},
+	{"abuse_analyzer", abuseAnalyzeLockKey, false},
+	{"retention", retentionLockKey, false},
+	{"trash_purge", trashPurgeLockKey, false},
+	{"upload_cleanup", uploadCleanupLockKey, false},
+	{"orphan_sweep", orphanSweepLockKey, false},
+	{"storage_reconciliation", storageReconcileKey, false},
+}
+
+// AuditEvent is one entry of any of the audit tables
+type AuditEvent struct {
+	Source  string    `json:"source"`  // account, org, abuse, dead_letter, service_mode, worker or broadcast
+	Subject string    `json:"subject"` // what was acted on
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	Detail  string    `json:"detail,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Overview is GET /admin/overview and the status page
+type Overview struct {
+	GeneratedAt        time.Time        `json:"generated_at"`
+	Instance           string           `json:"instance"`
+	Mode               *serviceState    `json:"mode"`
+	Queues             []ModelQueue     `json:"queues"`
+	Listener           ListenerLag      `json:"listener"`
+	SLO                SLOStatus        `json:"slo"`
+	Workers            []*WorkerSummary `json:"workers"`
+	Failures           []RecentFailure  `json:"recent_failures"`
+	DeadLetters        []DLQDepth       `json:"dead_letters"`
+	DeadLettersPending int64            `json:"dead_letters_pending"`
+	Jobs               []JobLock        `json:"jobs"`
+	Audit              []AuditEvent     `json:"audit"`
+	Errors             []string         `json:"errors,omitempty"` // sections that failed to load
+}
+
+// buildOverview gathers every section, noting the ones that fail rather than giving up
+func buildOverview(ctx context.Context) *Overview {
+	o := &Overview{
+		GeneratedAt: clock.Now(),
+		Instance:    instanceID,
+		Mode:        currentServiceState.Load(),
+		Listener:    listenerLagSnapshot(),
+		SLO:         currentSLO(),
+	}
+	failed := func(section string, err error) {
+		log.Printf("❌ Failed to load %s for the overview: %v", section, err)
+		o.Errors = append(o.Errors, section)
+	}
+
+	var err error
+	if o.Queues, err = modelQueues(ctx); err != nil {
+		failed("queues", err)
+	}
+	if o.Workers, err = workerSummaries(ctx); err != nil {
+		failed("workers", err)
+	}
+	if o.Failures, err = recentFailures(ctx, overviewFailures); err != nil {
+		failed("recent failures", err)
+	}
+	if o.DeadLetters, err = pendingDeadLetters(ctx); err != nil {
+		failed("dead letters", err)
+	}
+	for _, d := range o.DeadLetters {
+		o.DeadLettersPending += d.Pending
+	}
+	if o.Jobs, err = jobLockStates(ctx); err != nil {
+		failed("background jobs", err)
+	}
+	if o.Audit, err = recentAuditEvents(ctx, overviewAuditEvents); err != nil {
+		failed("audit events", err)
+	}
+	return o
+}
+
+// recentFailures is the latest failed and timed-out requests, newest first
+func recentFailures(ctx context.Context, limit int) ([]RecentFailure, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT request_id, user_id::text, model, status, coalesce(nullif(worker_error, ''), error), coalesce(worker_id, ''),
+		       coalesce(completed_at, updated_at)
+		FROM generated_content WHERE status IN ('failed', 'timed_out')
+		ORDER BY updated_at DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []RecentFailure{}
+	for rows.Next() {
+		var f RecentFailure
+		if err := rows.Scan(&f.RequestID, &f.UserID, &f.Model, &f.Status, &f.Error, &f.WorkerID, &f.At); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// jobLockStates reads each lock's holder and remaining TTL
+func jobLockStates(ctx context.Context) ([]JobLock, error) {
+	keys := append([]jobLockKey{}, jobLocks...)
+	iter := rdb.Scan(ctx, 0, backfillLockPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, jobLockKey{"backfill:" + strings.TrimPrefix(iter.Val(), backfillLockPrefix), iter.Val(), false})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	pipe := rdb.Pipeline()
+	values := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, k := range keys {
+		values[i] = pipe.Get(ctx, k.key)
+		ttls[i] = pipe.PTTL(ctx, k.key)
+	}
+	pipe.Exec(ctx) // a missing key fails its GET; other errors show up on the commands
+
+	list := make([]JobLock, 0, len(keys))
+	for i, k := range keys {
+		l := JobLock{Job: k.job, Key: k.key}
+		value, err := values[i].Result()
+		switch {
+		case err == nil:
+			l.Held = true
+			if k.lease {
+				l.Holder, l.ThisInstance = value, value == instanceID
+			}
+			if ttl := ttls[i].Val(); ttl > 0 {
+				l.ExpiresInSeconds = ttl.Seconds()
+			}
+		case err != redis.Nil:
+			return nil, err
+		}
+		list = append(list, l)
+	}
+	return list, nil
+}
+
+// recentAuditEvents merges the latest entries of every audit table, newest first
+func recentAuditEvents(ctx context.Context, limit int) ([]AuditEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT * FROM (
+			(SELECT 'account', user_id::text, action, actor, coalesce(nullif(detail::text, '{}'), ''), created_at
+			 FROM account_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'org', org_id::text, action, actor, coalesce(nullif(detail::text, '{}'), ''), created_at
+			 FROM org_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'abuse', coalesce(user_id::text, ''), action, actor, coalesce(nullif(detail::text, '{}'), ''), created_at
+			 FROM abuse_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'dead_letter', dead_letter_id::text, action, actor, coalesce(detail::text, ''), created_at
+			 FROM dead_letter_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'service_mode', source, state, actor, concat_ws(': ', nullif(reasons, ''), message), created_at
+			 FROM service_mode_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'worker', worker_id, action, actor, reason, created_at
+			 FROM worker_drain_audit ORDER BY id DESC LIMIT $1)
+			UNION ALL
+			(SELECT 'broadcast', broadcast_id::text, action, actor, '', created_at
+			 FROM broadcast_audit ORDER BY id DESC LIMIT $1)
+		) AS audit ORDER BY created_at DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.Source, &e.Subject, &e.Action, &e.Actor, &e.Detail, &e.At); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// GenerationEvent is one entry of a request's event history
+type GenerationEvent struct {
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// GenerationHistory is GET /admin/generations/:id/events: the row's milestones, its
+// credit entries, dead letters and account actions in time order. Prompts stay out of it
+type GenerationHistory struct {
+	RequestID string            `json:"request_id"`
+	UserID    string            `json:"user_id"`
+	Model     string            `json:"model"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	WorkerID  string            `json:"worker_id,omitempty"`
+	Events    []GenerationEvent `json:"events"`
+}
+
+// generationHistory assembles requestID's history; sql.ErrNoRows when there is no request
+func generationHistory(ctx context.Context, requestID string) (*GenerationHistory, error) {
+	h := GenerationHistory{RequestID: requestID, Events: []GenerationEvent{}}
+	var contentType string
+	var created time.Time
+	var deferred, deadline, completed, lateResult, trashed sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT user_id::text, model, content_type, status, coalesce(nullif(worker_error, ''), error), coalesce(worker_id, ''), created_at,
+		       deferred_until, deadline, completed_at, late_result_at, trashed_at
+		FROM generated_content WHERE request_id = $1`, requestID).
+		Scan(&h.UserID, &h.Model, &contentType, &h.Status, &h.Error, &h.WorkerID, &created,
+			&deferred, &deadline, &completed, &lateResult, &trashed)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(at time.Time, kind, detail string) {
+		h.Events = append(h.Events, GenerationEvent{At: at, Kind: kind, Detail: detail})
+	}
+	add(created, "created", contentType+" on "+h.Model)
+	for _, t := range []struct {
+		at           sql.NullTime
+		kind, detail string
+	}{
+		{deferred, "deferred_until", ""},
+		{deadline, "deadline", ""},
+		{completed, "finished", strings.TrimSpace(h.Status + " " + h.Error)},
+		{lateResult, "late_result", ""},
+		{trashed, "trashed", ""},
+	} {
+		if t.at.Valid {
+			add(t.at.Time, t.kind, t.detail)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT created_at, 'credits', reason || ' ' || CASE WHEN delta > 0 THEN '+' ELSE '' END || delta FROM credit_ledger WHERE request_id = $1
+		UNION ALL
+		SELECT created_at, 'dead_letter', channel || ' ' || error_class || ': ' || error FROM dead_letters WHERE request_id = $1
+		UNION ALL
+		SELECT created_at, 'account_' || action, actor FROM account_audit WHERE request_id = $1`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e GenerationEvent
+		if err := rows.Scan(&e.At, &e.Kind, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.Detail = strings.TrimSpace(e.Detail)
+		h.Events = append(h.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(h.Events, func(i, j int) bool { return h.Events[i].At.Before(h.Events[j].At) })
+	return &h, nil
+}
+
+// adminOverviewHandler handles GET /admin/overview
+func adminOverviewHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, buildOverview(c.Request.Context()))
+}
+
+// generationEventsHandler handles GET /admin/generations/:id/events
+func generationEventsHandler(c *gin.Context) {
+	h, err := generationHistory(c.Request.Context(), c.Param("id"))
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load history of %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load history")
+		return
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+func renderAdminUI(c *gin.Context, name string, data interface{}) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	if err := adminUITemplates.ExecuteTemplate(c.Writer, name, data); err != nil {
+		log.Printf("❌ Failed to render %s: %v", name, err)
+	}
+}
+
+// adminUIHandler handles GET /admin/ui
+func adminUIHandler(c *gin.Context) {
+	renderAdminUI(c, "status.html", buildOverview(c.Request.Context()))
+}
+
+// adminUIRequestHandler handles GET /admin/ui/requests/:id
+func adminUIRequestHandler(c *gin.Context) {
+	h, err := generationHistory(c.Request.Context(), c.Param("id"))
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load history of %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load history")
+		return
+	}
+	renderAdminUI(c, "request.html", h)
+}
+
+// adminUIEventsHandler handles GET /admin/ui/events, the page's cue to reload: every
+// user's completions and failures, reduced to their type and request ID
+func adminUIEventsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	filter, _ := newEventFilter([]string{eventCompleted, eventFailed, eventLateResult}, nil)
+	sub := realtime.subscribeEveryone(user.ID.String(), credentialKey(c), filter)
+	defer realtime.unsubscribe(sub)
+
+	heartbeat := time.NewTicker(realtimeHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-sub.events:
+			c.SSEvent(e.Type, gin.H{"request_id": e.RequestID})
+			sub.sent.Add(1)
+			return true
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+			return true
+		case <-sub.revoked:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,262 @@
+// admission.go
+// Rolling-window rate limiting with an optional defer mode instead of hard 429s, per
+// request kind (see buckets.go)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var deferredPollInterval = getEnvDuration("DEFERRED_POLL_INTERVAL", 10*time.Second)
+
+var admissionDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_admission_decisions_total",
+	Help: "Request admission decisions, by outcome (admitted, deferred, rejected) and bucket (the request_type).",
+}, []string{"outcome", "bucket"})
+
+// admitScript atomically trims the window and records the publish if there's room
+var admitScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', tonumber(ARGV[1]) - tonumber(ARGV[2]))
+if redis.call('ZCARD', KEYS[1]) < tonumber(ARGV[3]) then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+
+// What a request found full when it wasn't admitted
+const (
+	exhaustedRate     = "rate"
+	exhaustedInFlight = "in_flight"
+)
+
+// rateLimitKey is userID's window for one request kind
+func rateLimitKey(userID, kind string) string {
+	return "ratelimit:" + kind + ":" + userID
+}
+
+// admissionDecision is the outcome of tryAdmit
+type admissionDecision struct {
+	Admitted  bool
+	Mode      string
+	Bucket    string    // the request kind whose limits applied
+	Exhausted string    // exhaustedRate or exhaustedInFlight when not admitted
+	ETA       time.Time // when a deferred request is expected to publish
+}
+
+// tryAdmit records requestID in the user's window for kind if both the kind's rate and
+// in-flight limits allow it. Requests deferred before it go first: while any wait, it isn't
+// admitted, so a deferred request only goes out in its submission order
+func tryAdmit(ctx context.Context, userID, kind, requestID string) (admissionDecision, error) {
+	policy := throttledAdmission(ctx, userID, userPlanLimits(ctx, userID).bucket(kind))
+	decision := admissionDecision{Mode: policy.Mode, Bucket: kind, Exhausted: exhaustedInFlight}
+
+	// A request not stored yet is behind every deferred one
+	var inFlight, ahead int
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*) FILTER (WHERE g.status IN ('queued', 'processing')),
+		       count(*) FILTER (WHERE g.status = 'deferred' AND g.request_id <> $3 AND NOT EXISTS (
+		           SELECT 1 FROM generated_content me
+		           WHERE me.request_id = $3 AND (me.created_at, me.request_id) < (g.created_at, g.request_id)))
+		FROM generated_content g
+		WHERE g.user_id = $1 AND g.content_type = $2 AND g.status IN ('queued', 'processing', 'deferred')`,
+		userID, kind, requestID).Scan(&inFlight, &ahead)
+	if err != nil {
+		return decision, err
+	}
+
+	if inFlight < policy.MaxInFlight && ahead > 0 {
+		decision.Exhausted = exhaustedRate
+	} else if inFlight < policy.MaxInFlight {
+		now := clock.Now().UnixMilli()
+		ok, err := admitScript.Run(ctx, rdb, []string{rateLimitKey(userID, kind)},
+			now, rateLimitWindow.Milliseconds(), policy.WindowLimit, requestID).Int()
+		if err != nil {
+			return decision, err
+		}
+		if ok == 1 {
+			decision.Admitted, decision.Exhausted = true, ""
+			return decision, nil
+		}
+		decision.Exhausted = exhaustedRate
+	}
+
+	decision.ETA, err = estimateAdmission(ctx, userID, kind, policy)
+	return decision, err
+}
+
+// estimateAdmission works out when the next free slot opens, accounting for requests
+// already deferred ahead of this one. It's honest rather than optimistic: it assumes
+// nothing else frees up early.
+func estimateAdmission(ctx context.Context, userID, kind string, policy admissionPolicy) (time.Time, error) {
+	var ahead int
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*) FROM generated_content
+		WHERE user_id = $1 AND content_type = $2 AND status = 'deferred'`, userID, kind).Scan(&ahead)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	entries, err := rdb.ZRangeWithScores(ctx, rateLimitKey(userID, kind), 0, -1).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	slot := len(entries) - policy.WindowLimit + ahead
+	if slot < 0 {
+		// Rate window has room; we're waiting on in-flight jobs, so poll soon
+		return clock.Now().Add(deferredPollInterval), nil
+	}
+	windows := slot / max(policy.WindowLimit, 1)
+	idx := slot % max(policy.WindowLimit, 1)
+	if idx >= len(entries) {
+		return clock.Now().Add(time.Duration(windows+1) * rateLimitWindow), nil
+	}
+	freedAt := time.UnixMilli(int64(entries[idx].Score)).Add(rateLimitWindow)
+	return freedAt.Add(time.Duration(windows) * rateLimitWindow), nil
+}
+
+// startDeferredScheduler publishes deferred requests once their user's window frees up
+func startDeferredScheduler() {
+	ticker := time.NewTicker(deferredPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("deferred_scheduler", nil, func() {
+			publishDueDeferred(context.Background())
+		})
+	}
+}
+
+// publishDueDeferred publishes deferred requests in submission order. It tries the oldest
+// of each user's deferred requests of each kind once its ETA is due, and after publishing
+// one, the next in line straight away
+func publishDueDeferred(ctx context.Context) {
+	heads, err := loadDeferred(ctx, `
+		SELECT `+queuedColumns+` FROM (
+			SELECT DISTINCT ON (user_id, content_type) * FROM generated_content
+			WHERE status = 'deferred'
+			ORDER BY user_id, content_type, created_at, request_id) head
+		WHERE deferred_until <= $1
+		ORDER BY created_at LIMIT 100`, clock.Now())
+	if err != nil {
+		log.Printf("❌ Failed to load deferred requests: %v", err)
+		return
+	}
+	for _, d := range heads {
+		for {
+			if !publishDeferred(ctx, d) {
+				break
+			}
+			next, err := loadDeferred(ctx, `
+				SELECT `+queuedColumns+` FROM generated_content
+				WHERE status = 'deferred' AND user_id = $1 AND content_type = $2
+				ORDER BY created_at, request_id LIMIT 1`, d.UserID, d.ContentType)
+			if err != nil {
+				log.Printf("❌ Failed to load the next deferred request after %s: %v", d.RequestID, err)
+				break
+			}
+			if len(next) == 0 || next[0].RequestID == d.RequestID {
+				break
+			}
+			d = next[0]
+		}
+	}
+}
+
+func loadDeferred(ctx context.Context, query string, args ...interface{}) ([]newGeneration, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var due []newGeneration
+	for rows.Next() {
+		d, err := scanQueuedGeneration(rows)
+		if err != nil {
+			log.Printf("❌ Failed to load deferred request %s: %v", d.RequestID, err)
+			continue
+		}
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// publishDeferred admits and publishes one deferred request. It reports whether the
+// request left the line, so the next one may be tried
+func publishDeferred(ctx context.Context, d newGeneration) bool {
+	// A model retired while the request waited runs on its replacement, or not at all
+	sub, ok := retiredModelSubstitution(d.Model, clock.Now())
+	if !ok {
+		if _, err := transitionGeneration(ctx, d.RequestID, generationWrite{
+			Writer: "scheduler", To: "failed", From: []string{"deferred"},
+			Set:  "completed_at = now(), deferred_until = NULL, error = $4",
+			Args: []interface{}{"This model has been retired"}, Refund: "model_retired",
+		}); err != nil {
+			log.Printf("❌ Failed to fail deferred request %s on retired model %s: %v", d.RequestID, d.Model, err)
+			return false
+		}
+		return true
+	}
+
+	decision, err := tryAdmit(ctx, d.UserID, d.ContentType, d.RequestID)
+	if err != nil {
+		log.Printf("❌ Admission check failed for deferred request %s: %v", d.RequestID, err)
+		return false
+	}
+	if !decision.Admitted {
+		db.ExecContext(ctx, `UPDATE generated_content SET deferred_until = $1 WHERE request_id = $2 AND status = 'deferred'`,
+			decision.ETA, d.RequestID)
+		return false
+	}
+
+	// Claim the row so a concurrent cancel or another instance can't also publish it
+	claim := generationWrite{Writer: "scheduler", To: "queued", From: []string{"deferred"}, Set: "deferred_until = NULL"}
+	sub.apply(&claim)
+	claimed, err := transitionGeneration(ctx, d.RequestID, claim)
+	if err != nil {
+		log.Printf("❌ Failed to claim deferred request %s: %v", d.RequestID, err)
+		return false
+	}
+	if !claimed {
+		// Cancelled meanwhile, or taken by another instance
+		releaseAdmission(ctx, d.UserID, d.RequestID)
+		return true
+	}
+	if sub != nil {
+		log.Printf("🪦 Deferred request %s moved from retired %s to %s", d.RequestID, sub.From, sub.To)
+		d.Model = sub.To
+	}
+
+	if err := publishGenerationRequest(d.channel(), d.request()); err != nil {
+		log.Printf("❌ Failed to publish deferred request %s, re-deferring: %v", d.RequestID, err)
+		releaseAdmission(ctx, d.UserID, d.RequestID)
+		transitionGeneration(ctx, d.RequestID, generationWrite{
+			Writer: "scheduler", To: "deferred", From: []string{"queued"}, Set: "deferred_until = $4",
+			Args: []interface{}{clock.Now()},
+		})
+		return false
+	}
+	log.Printf("⏩ Published deferred request %s", d.RequestID)
+	return true
+}
+
+// cancelDeferredGeneration cancels a request that hasn't been published yet
+func cancelDeferredGeneration(ctx context.Context, requestID, userID string) (bool, error) {
+	ok, err := transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "cancel", To: "cancelled", From: []string{"deferred", generationPendingModeration}, UserID: userID,
+		Set: "completed_at = now(), deferred_until = NULL", Refund: "cancelled",
+	})
+	if err != nil {
+		return false, fmt.Errorf("cancel %s: %w", requestID, err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,282 @@
+// analytics.go
+// Daily generation rollups. The daily_stats backfill rolls each UTC day of generated_content
+// into daily_generation_stats, per tenant, model and owner's plan: counts by status,
+// credits, GPU seconds and a histogram of generation times that p95 is read from, plus the
+// day's active users. A day is rolled up once all of it is 48 hours old, and the leader
+// resumes the job from the last day it did once a night after ANALYTICS_HOUR. Tenant-wide
+// stats read rollups for the days that have them and raw rows for the rest. With
+// RAW_PRUNE_AFTER_MONTHS set, the same job prunes rolled-up rows of that age: metadata
+// stays, prompts, the embedding and the worker's error go. Plans are the users' plans at
+// rollup time
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	analyticsJobName   = "daily_stats"
+	analyticsLeaderKey = "analytics:leader"
+	// Rows this recent may still change status, so their days aren't rolled up yet
+	analyticsRawWindow = 48 * time.Hour
+)
+
+var (
+	analyticsHour = getEnvInt("ANALYTICS_HOUR", 3)
+
+	// 0 keeps raw rows whole
+	rawPruneAfterMonths = getEnvInt("RAW_PRUNE_AFTER_MONTHS", 0)
+	rawPruneBatchSize   = getEnvInt("RAW_PRUNE_BATCH_SIZE", 1000)
+	// Per day rolled up, so a first prune of a long history drains over several nights
+	rawPruneMaxRows = getEnvInt("RAW_PRUNE_MAX_ROWS", 100000)
+)
+
+// analyticsBucketBounds are the generation time buckets' bounds in seconds. Bucket i holds
+// times from bound i-1 up to bound i; the last one holds everything above the highest bound.
+// Changing them means rolling everything up again (restart: true)
+var analyticsBucketBounds = []float64{1, 2, 3, 5, 7.5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600, 1200, 1800, 3600}
+
+// analyticsBoundary is the first day that isn't entirely analyticsRawWindow old at now
+func analyticsBoundary(now time.Time) time.Time {
+	return now.UTC().Add(-analyticsRawWindow).Truncate(24 * time.Hour)
+}
+
+// rollUpDay rewrites day's rollups. Rows are grouped by the plan their owner has now
+func rollUpDay(ctx context.Context, day time.Time) error {
+	key := day.Format(costDayLayout)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"daily_generation_stats", "daily_active_users"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE day = $1::date`, key); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		WITH day_rows AS (
+			SELECT g.tenant_id, coalesce(g.model, '') AS model, coalesce(u.plan, '') AS plan,
+			       coalesce(g.status, '') AS status, g.credits_charged, g.gpu_seconds,
+			       CASE WHEN g.status = 'completed' THEN g.generation_time_seconds END AS seconds
+			FROM generated_content g
+			LEFT JOIN users u ON u.id = g.user_id
+			WHERE g.created_at >= $2 AND g.created_at < $3 AND g.user_id::text <> $4
+		), statuses AS (
+			SELECT tenant_id, model, plan, jsonb_object_agg(status, n) AS counts
+			FROM (SELECT tenant_id, model, plan, status, count(*) AS n FROM day_rows GROUP BY 1, 2, 3, 4) s
+			GROUP BY 1, 2, 3
+		), buckets AS (
+			SELECT k.tenant_id, k.model, k.plan, array_agg(coalesce(c.n, 0) ORDER BY b.i) AS counts
+			FROM (SELECT DISTINCT tenant_id, model, plan FROM day_rows) k
+			CROSS JOIN generate_series(0, cardinality($5::float8[])) AS b(i)
+			LEFT JOIN (
+				SELECT tenant_id, model, plan, width_bucket(seconds, $5::float8[]) AS i, count(*) AS n
+				FROM day_rows WHERE seconds IS NOT NULL GROUP BY 1, 2, 3, 4
+			) c ON (c.tenant_id, c.model, c.plan, c.i) = (k.tenant_id, k.model, k.plan, b.i)
+			GROUP BY 1, 2, 3
+		)
+		INSERT INTO daily_generation_stats (day, tenant_id, model, plan, total, status_counts, credits_charged,
+		                                    gpu_seconds, timed_count, generation_seconds_sum, generation_seconds_buckets)
+		SELECT $1::date, t.tenant_id, t.model, t.plan, t.total, s.counts, t.credits, t.gpu, t.timed, t.seconds, b.counts
+		FROM (
+			SELECT tenant_id, model, plan, count(*) AS total, coalesce(sum(credits_charged), 0) AS credits,
+			       coalesce(sum(gpu_seconds), 0) AS gpu, count(seconds) AS timed, coalesce(sum(seconds), 0) AS seconds
+			FROM day_rows GROUP BY 1, 2, 3
+		) t
+		JOIN statuses s USING (tenant_id, model, plan)
+		JOIN buckets b USING (tenant_id, model, plan)`,
+		key, day, day.AddDate(0, 0, 1), canaryUserID, pq.Array(analyticsBucketBounds))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO daily_active_users (day, tenant_id, user_id)
+		SELECT DISTINCT $1::date, tenant_id, user_id FROM generated_content
+		WHERE created_at >= $2 AND created_at < $3 AND user_id::text <> $4`,
+		key, day, day.AddDate(0, 0, 1), canaryUserID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO daily_generation_rollups (day) VALUES ($1::date)
+		ON CONFLICT (day) DO UPDATE SET rolled_at = now()`, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pruneRawRows clears the heavy columns of finished rows created before cutoff, a batch at
+// a time and at most rawPruneMaxRows per call
+func pruneRawRows(ctx context.Context, cutoff time.Time) (int64, error) {
+	var pruned int64
+	for pruned < int64(rawPruneMaxRows) {
+		res, err := db.ExecContext(ctx, `
+			UPDATE generated_content
+			SET prompt = '', original_prompt = '', prompt_embedding = NULL, worker_error = NULL, pruned_at = now()
+			WHERE request_id IN (
+				SELECT request_id FROM generated_content
+				WHERE created_at < $1 AND pruned_at IS NULL
+				  AND status IN ('completed', 'failed', 'timed_out', 'expired')
+				ORDER BY created_at LIMIT $2
+				FOR UPDATE SKIP LOCKED)`, cutoff, min(rawPruneBatchSize, rawPruneMaxRows-int(pruned)))
+		if err != nil {
+			return pruned, err
+		}
+		n, _ := res.RowsAffected()
+		pruned += n
+		if n == 0 {
+			break
+		}
+		// A long prune outlasts the runner's lock, which it only renews between batches
+		rdb.Expire(ctx, backfillLockPrefix+analyticsJobName, 2*backfillPollInterval)
+	}
+	return pruned, nil
+}
+
+// processAnalyticsDay rolls up a day, then prunes what has aged past RAW_PRUNE_AFTER_MONTHS
+// up to the end of that day, so only rolled-up rows are pruned
+func processAnalyticsDay(ctx context.Context, key string) error {
+	day, err := time.Parse(costDayLayout, key)
+	if err != nil {
+		return err
+	}
+	if err := rollUpDay(ctx, day); err != nil {
+		return fmt.Errorf("roll up: %w", err)
+	}
+	if rawPruneAfterMonths <= 0 {
+		return nil
+	}
+	cutoff := clock.Now().UTC().AddDate(0, -rawPruneAfterMonths, 0)
+	if end := day.AddDate(0, 0, 1); end.Before(cutoff) {
+		cutoff = end
+	}
+	n, err := pruneRawRows(ctx, cutoff)
+	if err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	if n > 0 {
+		log.Printf("✂️ Pruned %d raw rows created before %s", n, cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// startAnalyticsScheduler starts the daily_stats run once a day after ANALYTICS_HOUR on
+// the leader. The per-day Redis key keeps lease handovers from starting it twice. An
+// operator's pause holds until they start it again
+func startAnalyticsScheduler() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		runWithRecovery("analytics_scheduler", nil, func() {
+			ctx := context.Background()
+			now := clock.Now().UTC()
+			if !holdLease(ctx, analyticsLeaderKey, 2*time.Hour) || now.Hour() < analyticsHour {
+				return
+			}
+			run, err := loadBackfillRun(ctx, analyticsJobName)
+			if err != nil {
+				log.Printf("❌ Failed to load the %s backfill: %v", analyticsJobName, err)
+				return
+			}
+			if run.Status == "running" || run.Status == "paused" {
+				return
+			}
+			startedKey := "analytics:started:" + now.Truncate(24*time.Hour).Format(costDayLayout)
+			ok, err := rdb.SetNX(ctx, startedKey, "1", 48*time.Hour).Result()
+			if err != nil || !ok {
+				return
+			}
+			if err := startBackfillRun(ctx, backfillJobs[analyticsJobName], 2, 0, false); err != nil {
+				log.Printf("❌ Failed to start the %s backfill: %v", analyticsJobName, err)
+				rdb.Del(ctx, startedKey)
+				return
+			}
+			log.Printf("📊 Started the %s backfill", analyticsJobName)
+		})
+	}
+}
+
+// rollupLine is the first day from since on that tenant-wide stats read raw: the first one
+// without a rollup, or the analytics boundary
+func rollupLine(ctx context.Context, since time.Time) (time.Time, error) {
+	boundary := analyticsBoundary(clock.Now())
+	if !since.Before(boundary) {
+		return since, nil
+	}
+	var line sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT to_char(min(d), 'YYYY-MM-DD')
+		FROM generate_series($1::date, $2::date - 1, interval '1 day') AS d
+		WHERE NOT EXISTS (SELECT 1 FROM daily_generation_rollups r WHERE r.day = d::date)`,
+		since.Format(costDayLayout), boundary.Format(costDayLayout)).Scan(&line)
+	if err != nil || !line.Valid {
+		return boundary, err
+	}
+	return time.Parse(costDayLayout, line.String)
+}
+
+// bucketQuantile estimates quantile q from bucket counts, interpolating within its bucket
+func bucketQuantile(counts []int64, q float64) float64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range counts {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = analyticsBucketBounds[i-1]
+		}
+		if i >= len(analyticsBucketBounds) {
+			return lower
+		}
+		return lower + (analyticsBucketBounds[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return analyticsBucketBounds[len(analyticsBucketBounds)-1]
+}
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        analyticsJobName,
+		Description: "Roll generations up into daily_generation_stats, one UTC day per key, and prune aged raw rows",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			return queryKeys(ctx, `
+				SELECT to_char(d, 'YYYY-MM-DD') FROM generate_series(
+					coalesce(nullif($1, '')::date + 1,
+					         (SELECT min(created_at AT TIME ZONE 'UTC')::date FROM generated_content)),
+					$2::date - 1, interval '1 day') AS d
+				ORDER BY d LIMIT $3`, cursor, analyticsBoundary(clock.Now()).Format(costDayLayout), limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			var n int64
+			err := db.QueryRowContext(ctx, `
+				SELECT count(*) FROM generate_series(
+					(SELECT min(created_at AT TIME ZONE 'UTC')::date FROM generated_content),
+					$1::date - 1, interval '1 day') AS d
+				WHERE NOT EXISTS (SELECT 1 FROM daily_generation_rollups r WHERE r.day = d::date)`,
+				analyticsBoundary(clock.Now()).Format(costDayLayout)).Scan(&n)
+			return n, err
+		},
+		Process:    processAnalyticsDay,
+		Continuous: true,
+	})
+}
@@ -0,0 +1,157 @@
+// api_versions.go
+// Public API versions. The same routes and handlers are served under /v1, /v2 and, until
+// API_UNVERSIONED_SUNSET, without a prefix. /v1 is frozen at the shapes the shipped
+// mobile release reads: its bodies are the golden ones in testdata/contracts/responses,
+// and unversioned paths answer exactly as /v1 does, with a Sunset header. /v2 differs only
+// where a response mapper here says so: errors are the typed envelope, wrapped as
+// {"error": {...}}, where /v1 keeps {"error": "<message>"}; GET /generations/:id adds its
+// timings; and generations list their servable renditions, each with its own link.
+// Handlers stay version-blind; the mappers run where the error body, timings and
+// generation links are built. Health, readiness and the internal worker routes aren't
+// versioned, and answer as /v1 does
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	apiV1          = "v1"
+	apiV2          = "v2"
+	apiUnversioned = "unversioned" // served as v1
+)
+
+var (
+	// When unversioned paths go away, announced on every response to them
+	apiUnversionedSunset = sunsetFromEnv("API_UNVERSIONED_SUNSET", "2027-06-30")
+
+	apiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_api_requests_total",
+		Help: "Public API requests, by version (v1, v2, unversioned).",
+	}, []string{"version"})
+)
+
+type apiVersionKey struct{}
+
+func sunsetFromEnv(name, fallback string) time.Time {
+	at, err := time.Parse("2006-01-02", getEnv(name, fallback))
+	if err != nil {
+		log.Printf("⚠️ %s is not a YYYY-MM-DD date, using %s: %v", name, fallback, err)
+		at, _ = time.Parse("2006-01-02", fallback)
+	}
+	return at
+}
+
+// registerVersionedRoutes serves routes under each version prefix and unversioned
+func registerVersionedRoutes(r *gin.Engine, routes func(g *gin.RouterGroup)) {
+	routes(r.Group("/", apiVersionMiddleware(apiUnversioned)))
+	routes(r.Group("/"+apiV1, apiVersionMiddleware(apiV1)))
+	routes(r.Group("/"+apiV2, apiVersionMiddleware(apiV2)))
+}
+
+// apiVersionMiddleware records the request's version in its context, where helpers that
+// only get the context find it too
+func apiVersionMiddleware(version string) gin.HandlerFunc {
+	sunset := apiUnversionedSunset.UTC().Format(http.TimeFormat)
+	return func(c *gin.Context) {
+		apiRequests.WithLabelValues(version).Inc()
+		if version == apiUnversioned {
+			c.Header("Sunset", sunset)
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), apiVersionKey{}, version))
+		c.Next()
+	}
+}
+
+// apiVersion is the request's response version, v1 outside the versioned routes
+func apiVersion(c *gin.Context) string {
+	return apiVersionOf(c.Request.Context())
+}
+
+func apiVersionOf(ctx context.Context) string {
+	if v, _ := ctx.Value(apiVersionKey{}).(string); v == apiV2 {
+		return v
+	}
+	return apiV1
+}
+
+// unversionedRoute strips the version prefix from a route template
+func unversionedRoute(route string) string {
+	for _, v := range []string{apiV1, apiV2} {
+		if rest, ok := strings.CutPrefix(route, "/"+v+"/"); ok {
+			return "/" + rest
+		}
+	}
+	return route
+}
+
+// ErrorEnvelopeV2 is the error body of /v2
+type ErrorEnvelopeV2 struct {
+	Error ErrorEnvelope `json:"error"`
+}
+
+// ErrorBodyV1 is the error body of /v1: the message alone, as before the envelope
+type ErrorBodyV1 struct {
+	Error string `json:"error"`
+}
+
+// errorBody maps the envelope to version's error body
+func errorBody(version string, e ErrorEnvelope) interface{} {
+	if version == apiV2 {
+		return ErrorEnvelopeV2{Error: e}
+	}
+	return ErrorBodyV1{Error: e.Message}
+}
+
+// withTimings adds a generation's timeline for /v2 (generation_timings.go)
+func withTimings(c *gin.Context, g *Generation, admin bool) {
+	if apiVersion(c) != apiV2 {
+		return
+	}
+	var err error
+	if g.Timings, err = generationTimings(c.Request.Context(), g.RequestID, admin); err != nil {
+		log.Printf("⚠️ Failed to load timings of %s: %v", g.RequestID, err)
+	}
+}
+
+// RenditionLink is one servable copy of a generation as /v2 lists it. The original is
+// only served by the download endpoint, so it isn't listed
+type RenditionLink struct {
+	Kind   string `json:"kind"`
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+}
+
+// withRenditionLinks lists a completed generation's renditions for /v2, presigned for ttl
+func withRenditionLinks(ctx context.Context, g *Generation, ttl time.Duration) {
+	if apiVersionOf(ctx) != apiV2 {
+		return
+	}
+	for _, kind := range []string{renditionWeb, renditionThumbnail} {
+		r, ok := g.rendition(kind)
+		if kind == renditionThumbnail {
+			r, ok = g.thumbnail()
+		}
+		if !ok || r.S3Key == "" {
+			continue
+		}
+		url, err := storage.PresignGet(ctx, r.S3Key, ttl)
+		if err != nil {
+			log.Printf("⚠️ Failed to presign %s: %v", r.S3Key, err)
+			continue
+		}
+		g.RenditionLinks = append(g.RenditionLinks, RenditionLink{Kind: r.Kind, URL: url, Width: r.Width,
+			Height: r.Height, Bytes: r.Bytes})
+	}
+}
@@ -0,0 +1,154 @@
+// apierrors.go
+// Error envelope returned by every handler, and the registry of stable error codes.
+// Messages are localized for the request's Accept-Language (see i18n.go); codes never are
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes are part of the API contract: add new ones, never rename
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeRequestTooLarge     = "request_too_large"
+	codeValidationFailed    = "validation_failed"
+	codePromptTooLong       = "prompt_too_long"
+	codePromptInvalid       = "prompt_invalid"
+	codeMessageTooLarge     = "message_too_large"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeNotOwner            = "not_owner"
+	codeNotMember           = "not_member"
+	codeAdminRequired       = "admin_required"
+	codeNotFound            = "not_found"
+	codeInvalidCursor       = "invalid_cursor"
+	codeConflict            = "conflict"
+	codeLinkExpired         = "link_expired"
+	codeInsufficientCredits = "insufficient_credits"
+	codeStorageFull         = "storage_quota_exceeded"
+	codeSeatLimit           = "seat_limit_reached"
+	codeUploadOverQuota     = "upload_over_quota"
+	codeInputRejected       = "input_rejected"
+	codeResolutionOverPlan  = "resolution_over_plan"
+	codeRateLimited         = "rate_limited"
+	codeQueueFull           = "queue_full"
+	codeModelUnavailable    = "model_unavailable"
+	codeModelBlocked        = "model_blocked"
+	codeModelRetired        = "model_retired"
+	codeUpstreamFailed      = "upstream_failed"
+	codeUnavailable         = "service_unavailable"
+	codeInternal            = "internal_error"
+)
+
+// errorCodeStatus maps each code to the one HTTP status it is always returned with
+var errorCodeStatus = map[string]int{
+	codeInvalidRequest:      http.StatusBadRequest,
+	codeRequestTooLarge:     http.StatusRequestEntityTooLarge,
+	codeValidationFailed:    http.StatusUnprocessableEntity,
+	codePromptTooLong:       http.StatusRequestEntityTooLarge,
+	codePromptInvalid:       http.StatusUnprocessableEntity,
+	codeMessageTooLarge:     http.StatusRequestEntityTooLarge,
+	codeUnauthorized:        http.StatusUnauthorized,
+	codeForbidden:           http.StatusForbidden,
+	codeNotOwner:            http.StatusForbidden,
+	codeNotMember:           http.StatusForbidden,
+	codeAdminRequired:       http.StatusForbidden,
+	codeNotFound:            http.StatusNotFound,
+	codeInvalidCursor:       http.StatusBadRequest,
+	codeConflict:            http.StatusConflict,
+	codeLinkExpired:         http.StatusGone,
+	codeInsufficientCredits: http.StatusPaymentRequired,
+	codeStorageFull:         http.StatusPaymentRequired,
+	codeSeatLimit:           http.StatusPaymentRequired,
+	codeUploadOverQuota:     http.StatusRequestEntityTooLarge,
+	codeInputRejected:       http.StatusUnprocessableEntity,
+	codeResolutionOverPlan:  http.StatusUnprocessableEntity,
+	codeRateLimited:         http.StatusTooManyRequests,
+	codeQueueFull:           http.StatusServiceUnavailable,
+	codeModelUnavailable:    http.StatusServiceUnavailable,
+	codeModelBlocked:        http.StatusTooManyRequests,
+	codeModelRetired:        http.StatusGone,
+	codeUpstreamFailed:      http.StatusBadGateway,
+	codeUnavailable:         http.StatusServiceUnavailable,
+	codeInternal:            http.StatusInternalServerError,
+}
+
+// typedErrorCodes maps internal sentinel errors to codes; their messages are safe to show
+var typedErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrPromptTooLarge, codePromptTooLong},
+	{ErrPromptInvalid, codePromptInvalid},
+	{ErrMessageTooLarge, codeMessageTooLarge},
+	{ErrInsufficientCredits, codeInsufficientCredits},
+	{errConversationNotFound, codeNotFound},
+	{errSecretsDisabled, codeUnavailable},
+	{sql.ErrNoRows, codeNotFound},
+}
+
+// ErrorEnvelope is the body of every error response, wrapped on /v2 (api_versions.go). RequestID is the X-Request-ID
+// correlation ID users can quote to support
+type ErrorEnvelope struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// errorCodeFor returns the code for a typed error, or ok=false for unexpected ones
+func errorCodeFor(err error) (code string, ok bool) {
+	for _, t := range typedErrorCodes {
+		if errors.Is(err, t.err) {
+			return t.code, true
+		}
+	}
+	return "", false
+}
+
+// respondError aborts with the envelope for code
+func respondError(c *gin.Context, code, message string) {
+	respondErrorDetails(c, code, message, nil)
+}
+
+// respondErrorDetails is respondError with structured details (e.g. the offending field)
+func respondErrorDetails(c *gin.Context, code, message string, details interface{}) {
+	locale := requestLocale(c)
+	params, _ := details.(gin.H)
+	respondEnvelope(c, locale, code, localizeMessage(locale, "error", message, params), details)
+}
+
+func respondEnvelope(c *gin.Context, locale, code, message string, details interface{}) {
+	status, ok := errorCodeStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	c.Header("Content-Language", locale)
+	c.AbortWithStatusJSON(status, errorBody(apiVersion(c), ErrorEnvelope{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: c.GetString("requestID"),
+	}))
+}
+
+// respondTypedError shows typed errors as-is and anything else as an internal error
+// with fallback as the message, so internals never leak
+func respondTypedError(c *gin.Context, err error, fallback string) {
+	if code, ok := errorCodeFor(err); ok {
+		respondError(c, code, err.Error())
+		return
+	}
+	respondError(c, codeInternal, fallback)
+}
+
+// fieldError reports a validation problem with one request field; the field name stays as sent
+func fieldError(c *gin.Context, code, field, message string) {
+	locale := requestLocale(c)
+	respondEnvelope(c, locale, code, field+": "+localizeMessage(locale, "error", message, nil), gin.H{"field": field})
+}
@@ -0,0 +1,200 @@
+// auth.go
+// Request authentication. An Authenticator resolves a request to its user from one kind
+// of credential: our short-lived access tokens (auth_tokens.go) and the provider's bearer
+// JWTs for the mobile apps (auth_jwt.go), session cookies for the web (auth_sessions.go),
+// and X-User-ID in development. authMiddleware tries them in
+// order and the first to succeed sets "currentUser", plus "authCredential" for handlers
+// that act on the credential itself (logout). A request none of them accepts gets the
+// same 401 envelope whatever went wrong, with only the reason (missing, invalid,
+// expired, revoked) in the details so clients know whether refreshing helps. The
+// reasons are told apart in logs and in mobart_auth_attempts_total. Handlers read the
+// user from the context, never the credentials
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Authenticator resolves a request to a user from one kind of credential. It returns
+// errNoCredential when the request doesn't carry that kind, so the next one can try
+type Authenticator interface {
+	Name() string
+	Authenticate(c *gin.Context) (*repository.User, *authCredential, error)
+}
+
+// authCredential is what a request authenticated with
+type authCredential struct {
+	Method    string    // the authenticator's name
+	ID        string    // the JWT's jti, the access token's family or the session ID; empty when there is none
+	ExpiresAt time.Time // zero when it doesn't expire
+}
+
+// Why an authenticator turned a request down; anything else is an internal error
+var (
+	errNoCredential      = errors.New("no credential")
+	errCredentialInvalid = errors.New("credential invalid")
+	errCredentialExpired = errors.New("credential expired")
+	errCredentialRevoked = errors.New("credential revoked")
+
+	errCredentialNotRevocable = errors.New("credential can't be revoked")
+)
+
+var (
+	authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_auth_attempts_total",
+		Help: "Authentication attempts, by authenticator and result (ok, invalid, expired, revoked, error); requests without its credential aren't counted.",
+	}, []string{"authenticator", "result"})
+	authRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_auth_rejections_total",
+		Help: "Requests refused a 401, by reason (missing, invalid, expired, revoked).",
+	}, []string{"reason"})
+)
+
+// authResult is the metric label and 401 reason for an authenticator's error
+func authResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, errNoCredential):
+		return "missing"
+	case errors.Is(err, errCredentialInvalid):
+		return "invalid"
+	case errors.Is(err, errCredentialExpired):
+		return "expired"
+	case errors.Is(err, errCredentialRevoked):
+		return "revoked"
+	}
+	return "error"
+}
+
+// authenticators is the chain authMiddleware runs, in order
+var authenticators = defaultAuthenticators()
+
+// authMiddleware sets "currentUser" from the first authenticator that accepts the request
+var authMiddleware gin.HandlerFunc = authenticate
+
+var trustUserIDHeader = getEnvBool("AUTH_TRUST_USER_ID_HEADER", !jwtConfigured())
+
+func defaultAuthenticators() []Authenticator {
+	chain := []Authenticator{accessTokenAuthenticator{}}
+	if jwtConfigured() {
+		chain = append(chain, jwtAuth)
+	}
+	chain = append(chain, sessionAuthenticator{})
+	if trustUserIDHeader {
+		log.Println("⚠️ AUTH_TRUST_USER_ID_HEADER is on; any request can claim a user with X-User-ID")
+		chain = append(chain, headerAuthenticator{})
+	}
+	return chain
+}
+
+func authenticate(c *gin.Context) {
+	reason := "missing"
+	for _, a := range authenticators {
+		user, cred, err := a.Authenticate(c)
+		if errors.Is(err, errNoCredential) {
+			continue
+		}
+		result := authResult(err)
+		authAttempts.WithLabelValues(a.Name(), result).Inc()
+		if err == nil {
+			c.Set("currentUser", user)
+			c.Set("authCredential", cred)
+			c.Next()
+			return
+		}
+		if result == "error" {
+			log.Printf("❌ %s authentication failed on request %s: %v", a.Name(), c.GetString("requestID"), err)
+			respondError(c, codeUnavailable, "Authentication is temporarily unavailable, please try again shortly")
+			return
+		}
+		log.Printf("🔒 %s credential rejected (%s) on request %s: %v", a.Name(), result, c.GetString("requestID"), err)
+		// The first credential the request carried decides the reason
+		if reason == "missing" {
+			reason = result
+		}
+	}
+	respondUnauthorized(c, reason)
+}
+
+// respondUnauthorized is the 401 for a request refused for reason
+func respondUnauthorized(c *gin.Context, reason string) {
+	authRejections.WithLabelValues(reason).Inc()
+	c.Header("WWW-Authenticate", `Bearer realm="mobart"`)
+	respondErrorDetails(c, codeUnauthorized, "Unauthorized", gin.H{"reason": reason})
+}
+
+// credentialKey names the credential a request authenticated with, so connections opened
+// with it can be closed when it's revoked
+func credentialKey(c *gin.Context) string {
+	cred, ok := c.Get("authCredential")
+	if !ok {
+		return ""
+	}
+	return cred.(*authCredential).Method + ":" + cred.(*authCredential).ID
+}
+
+// headerAuthenticator is a development stand-in that trusts X-User-ID
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Name() string { return "header" }
+
+func (headerAuthenticator) Authenticate(c *gin.Context) (*repository.User, *authCredential, error) {
+	raw := c.GetHeader("X-User-ID")
+	if raw == "" {
+		return nil, nil, errNoCredential
+	}
+	id, err := uuid.Parse(raw)
+	if err != nil {
+		return nil, nil, errCredentialInvalid
+	}
+	return &repository.User{ID: id}, &authCredential{Method: "header"}, nil
+}
+
+// revokeCredential ends the credential userID's request authenticated with, or returns
+// errCredentialNotRevocable
+func revokeCredential(ctx context.Context, userID string, cred *authCredential) error {
+	switch cred.Method {
+	case "access":
+		return revokeFamily(ctx, userID, cred.ID, "logout")
+	case "jwt":
+		return revokeJWT(ctx, cred.ID, cred.ExpiresAt)
+	case "session":
+		return revokeSession(ctx, cred.ID)
+	}
+	return errCredentialNotRevocable
+}
+
+// logoutHandler handles POST /auth/logout, revoking the token or session used for it;
+// with an access token that is the device's whole token family
+func logoutHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	cred := c.MustGet("authCredential").(*authCredential)
+	err := revokeCredential(c.Request.Context(), user.ID.String(), cred)
+	if errors.Is(err, errCredentialNotRevocable) {
+		respondError(c, codeConflict, "This credential can't be revoked")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to revoke %s credential of %s: %v", cred.Method, user.ID, err)
+		respondError(c, codeInternal, "Failed to log out")
+		return
+	}
+	if cred.Method == "session" {
+		clearSessionCookie(c)
+	}
+	if cred.Method != "access" { // revokeFamily already did
+		disconnectCredential(c.Request.Context(), user.ID.String(), credentialKey(c))
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,345 @@
+// auth_jwt.go
+// Bearer JWTs from the identity provider, for the mobile apps. Tokens are RS256 or ES256,
+// signed by a key in the provider's JWKS, which is fetched from AUTH_JWKS_URL every
+// AUTH_JWKS_REFRESH and again (at most once a minute) when a token names a key we
+// don't have, so key rotation needs no deploy. AUTH_JWKS can pin the set inline instead.
+// The issuer and audience must match AUTH_JWT_ISSUER and AUTH_JWT_AUDIENCE, sub is the
+// user ID, and exp and nbf are checked with AUTH_JWT_LEEWAY for clock skew. A jti
+// revoked by logout stays refused in Redis until the token would have expired anyway, and
+// logging out everywhere refuses every token issued before it. The apps only sign in
+// with these, trading them for our short-lived access tokens (auth_tokens.go)
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	jwtIssuer      = getEnv("AUTH_JWT_ISSUER", "")
+	jwtAudience    = getEnv("AUTH_JWT_AUDIENCE", "")
+	jwtLeeway      = getEnvDuration("AUTH_JWT_LEEWAY", 30*time.Second)
+	jwksURL        = getEnv("AUTH_JWKS_URL", "")
+	jwksInline     = getEnv("AUTH_JWKS", "")
+	jwksRefresh    = getEnvDuration("AUTH_JWKS_REFRESH", 15*time.Minute)
+	jwksHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	jwtAuth = &jwtAuthenticator{}
+)
+
+const jwksRefetchInterval = time.Minute // on an unknown kid
+
+// jwtConfigured reports whether bearer tokens can be checked at all
+func jwtConfigured() bool {
+	return jwtIssuer != "" && jwtAudience != "" && (jwksURL != "" || jwksInline != "")
+}
+
+// jwtAuthenticator checks bearer tokens against the current key set
+type jwtAuthenticator struct {
+	keys atomic.Pointer[map[string]crypto.PublicKey] // by kid
+
+	mu          sync.Mutex // serializes fetches
+	lastFetched time.Time
+}
+
+func (*jwtAuthenticator) Name() string { return "jwt" }
+
+func (a *jwtAuthenticator) Authenticate(c *gin.Context) (*repository.User, *authCredential, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, nil, errNoCredential
+	}
+	ctx := c.Request.Context()
+	claims, err := parseJWT(token, func(kid string) crypto.PublicKey { return a.key(ctx, kid) })
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := claims.check(jwtIssuer, jwtAudience, clock.Now()); err != nil {
+		return nil, nil, err
+	}
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: sub is not a user ID", errCredentialInvalid)
+	}
+	if claims.ID != "" {
+		revoked, err := rdb.Exists(ctx, revokedJTIKey(claims.ID)).Result()
+		if err != nil {
+			return nil, nil, fmt.Errorf("check revocation: %w", err)
+		}
+		if revoked > 0 {
+			return nil, nil, errCredentialRevoked
+		}
+	}
+	// Logging out everywhere also retires the provider's tokens issued before it
+	if err := checkLogoutAll(ctx, id.String(), claims.IssuedAt); err != nil {
+		return nil, nil, err
+	}
+	return &repository.User{ID: id}, &authCredential{Method: "jwt", ID: claims.ID, ExpiresAt: claims.expiry()}, nil
+}
+
+// jwtClaims are the registered claims we check, and the ones of our own access tokens
+type jwtClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub"`
+	Audience  audienceClaim `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf,omitempty"`
+	IssuedAt  int64         `json:"iat"`
+	ID        string        `json:"jti,omitempty"`
+
+	Family string `json:"fam,omitempty"` // access tokens: the refresh token family (auth_tokens.go)
+}
+
+func (cl jwtClaims) expiry() time.Time { return time.Unix(cl.ExpiresAt, 0) }
+
+// audienceClaim is aud, which may be one string or a list
+type audienceClaim []string
+
+func (a *audienceClaim) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audienceClaim{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// jwtHeader is the part of a JWT header we read
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtKeyID is the kid a token names, "" when it isn't a readable JWT
+func jwtKeyID(token string) string {
+	var header jwtHeader
+	enc, _, _ := strings.Cut(token, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return ""
+	}
+	return header.Kid
+}
+
+// parseJWT checks the signature against keyFor's key for the token's kid and reads the
+// claims; see check for the rest
+func parseJWT(token string, keyFor func(kid string) crypto.PublicKey) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: not a JWT", errCredentialInvalid)
+	}
+	var header jwtHeader
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return claims, fmt.Errorf("%w: unreadable header", errCredentialInvalid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("%w: unreadable signature", errCredentialInvalid)
+	}
+	key := keyFor(header.Kid)
+	if key == nil {
+		return claims, fmt.Errorf("%w: unknown key %q", errCredentialInvalid, header.Kid)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	// The key decides the algorithm; a header can't talk us into another (or "none")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return claims, fmt.Errorf("%w: bad signature", errCredentialInvalid)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return claims, fmt.Errorf("%w: bad signature", errCredentialInvalid)
+		}
+	default:
+		return claims, fmt.Errorf("%w: unsupported key", errCredentialInvalid)
+	}
+
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return claims, fmt.Errorf("%w: unreadable claims", errCredentialInvalid)
+	}
+	return claims, nil
+}
+
+// check holds signed claims to the issuer, audience and validity window
+func (cl jwtClaims) check(issuer, audience string, now time.Time) error {
+	if cl.Issuer != issuer {
+		return fmt.Errorf("%w: issuer %q", errCredentialInvalid, cl.Issuer)
+	}
+	if !containsString(cl.Audience, audience) {
+		return fmt.Errorf("%w: audience %q", errCredentialInvalid, cl.Audience)
+	}
+	if cl.ExpiresAt == 0 {
+		return fmt.Errorf("%w: no exp", errCredentialInvalid)
+	}
+	if !now.Before(cl.expiry().Add(jwtLeeway)) {
+		return fmt.Errorf("%w: at %s", errCredentialExpired, cl.expiry().UTC().Format(time.RFC3339))
+	}
+	if cl.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(cl.NotBefore, 0)) {
+		return fmt.Errorf("%w: not valid before %d", errCredentialInvalid, cl.NotBefore)
+	}
+	return nil
+}
+
+// key returns the key for kid, refetching the set once when it's unknown
+func (a *jwtAuthenticator) key(ctx context.Context, kid string) crypto.PublicKey {
+	if keys := a.keys.Load(); keys != nil {
+		if k, ok := (*keys)[kid]; ok {
+			return k
+		}
+	}
+	if jwksURL == "" && a.keys.Load() != nil {
+		return nil
+	}
+	if err := a.refresh(ctx, false); err != nil {
+		log.Printf("⚠️ Failed to refetch JWKS for key %q: %v", kid, err)
+	}
+	if keys := a.keys.Load(); keys != nil {
+		return (*keys)[kid]
+	}
+	return nil
+}
+
+// refresh loads the key set; unless forced, not more than once per jwksRefetchInterval
+func (a *jwtAuthenticator) refresh(ctx context.Context, force bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !force && time.Since(a.lastFetched) < jwksRefetchInterval {
+		return nil
+	}
+	a.lastFetched = time.Now()
+
+	data := []byte(jwksInline)
+	if jwksURL != "" {
+		fetchCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, jwksURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := jwksHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("JWKS returned %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return err
+		}
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	a.keys.Store(&keys)
+	return nil
+}
+
+// parseJWKS reads the RSA and P-256 signing keys of a JWKS; others are skipped
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+	b64 := func(s string) *big.Int {
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(raw) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(raw)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, e := b64(k.N), b64(k.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, y := b64(k.X), b64(k.Y)
+			if x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// startJWKSRefresher keeps the key set current; it returns at once without bearer tokens
+func startJWKSRefresher() {
+	if !jwtConfigured() {
+		return
+	}
+	if err := jwtAuth.refresh(context.Background(), true); err != nil {
+		log.Printf("⚠️ Failed to load JWKS, bearer tokens are refused until it loads: %v", err)
+	}
+	ticker := time.NewTicker(jwksRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		runWithRecovery("jwks_refresh", nil, func() {
+			if err := jwtAuth.refresh(context.Background(), true); err != nil {
+				log.Printf("⚠️ Failed to refresh JWKS, keeping the current keys: %v", err)
+			}
+		})
+	}
+}
+
+func revokedJTIKey(jti string) string { return "auth:revoked_jti:" + jti }
+
+// revokeJWT refuses a token's jti until it expires anyway
+func revokeJWT(ctx context.Context, jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errCredentialNotRevocable
+	}
+	ttl := time.Until(expiresAt) + jwtLeeway
+	if ttl <= 0 {
+		return nil
+	}
+	return rdb.Set(ctx, revokedJTIKey(jti), 1, ttl).Err()
+}
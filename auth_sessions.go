@@ -0,0 +1,178 @@
+// auth_sessions.go
+// Opaque session cookies for the web app. The cookie holds a random token; Redis holds
+// the session under a hash of it, so a Redis dump can't be replayed as cookies. Sessions
+// last AUTH_SESSION_TTL. The record outlives that by a day, and a revoked session is
+// overwritten with a tombstone, so an expired or revoked cookie is reported as such
+// rather than as unknown
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var (
+	sessionCookieName = getEnv("AUTH_SESSION_COOKIE", "mobart_session")
+	sessionTTL        = getEnvDuration("AUTH_SESSION_TTL", 30*24*time.Hour)
+	sessionCookieHost = getEnv("AUTH_SESSION_COOKIE_DOMAIN", "")
+)
+
+// How long expired and revoked sessions are still told apart from unknown ones
+const sessionTombstoneTTL = 24 * time.Hour
+
+// sessionRecord is what Redis keeps per session
+type sessionRecord struct {
+	UserID    string     `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// sessionID is the name a token is stored and logged under
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+func sessionKey(id string) string { return "session:" + id }
+
+// userSessionsKey is the set of userID's session IDs, for logging out everywhere
+func userSessionsKey(userID string) string { return "user_sessions:" + userID }
+
+// sessionAuthenticator accepts the session cookie
+type sessionAuthenticator struct{}
+
+func (sessionAuthenticator) Name() string { return "session" }
+
+func (sessionAuthenticator) Authenticate(c *gin.Context) (*repository.User, *authCredential, error) {
+	token, err := c.Cookie(sessionCookieName)
+	if err != nil || token == "" {
+		return nil, nil, errNoCredential
+	}
+	id := sessionID(token)
+	raw, err := rdb.Get(c.Request.Context(), sessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil, fmt.Errorf("%w: unknown session %s", errCredentialInvalid, id)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("load session: %w", err)
+	}
+	var s sessionRecord
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, nil, fmt.Errorf("%w: unreadable session %s", errCredentialInvalid, id)
+	}
+	switch {
+	case s.RevokedAt != nil:
+		return nil, nil, fmt.Errorf("%w: session %s", errCredentialRevoked, id)
+	case !clock.Now().Before(s.ExpiresAt):
+		return nil, nil, fmt.Errorf("%w: session %s", errCredentialExpired, id)
+	}
+	userID, err := uuid.Parse(s.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: session %s", errCredentialInvalid, id)
+	}
+	return &repository.User{ID: userID}, &authCredential{Method: "session", ID: id, ExpiresAt: s.ExpiresAt}, nil
+}
+
+// createSession starts a session for userID and sets its cookie on the response
+func createSession(c *gin.Context, userID string) (sessionRecord, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return sessionRecord{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := clock.Now()
+	s := sessionRecord{UserID: userID, CreatedAt: now, ExpiresAt: now.Add(sessionTTL)}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return s, err
+	}
+	id, ctx := sessionID(token), c.Request.Context()
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, sessionKey(id), data, sessionTTL+sessionTombstoneTTL)
+	pipe.SAdd(ctx, userSessionsKey(userID), id)
+	pipe.Expire(ctx, userSessionsKey(userID), sessionTTL+sessionTombstoneTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return s, err
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookieName, token, int(sessionTTL.Seconds()), "/", sessionCookieHost, true, true)
+	return s, nil
+}
+
+// revokeSession replaces a session with its tombstone
+func revokeSession(ctx context.Context, id string) error {
+	key := sessionKey(id)
+	raw, err := rdb.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s sessionRecord
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	now := clock.Now()
+	s.RevokedAt = &now
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, key, data, sessionTombstoneTTL).Err()
+}
+
+// revokeUserSessions revokes every session of userID
+func revokeUserSessions(ctx context.Context, userID string) error {
+	ids, err := rdb.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		if err := revokeSession(ctx, id); err != nil {
+			return err
+		}
+		members[i] = id
+	}
+	return rdb.SRem(ctx, userSessionsKey(userID), members...).Err()
+}
+
+func clearSessionCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookieName, "", -1, "/", sessionCookieHost, true, true)
+}
+
+// createSessionHandler handles POST /auth/session: the web app trades the bearer token it
+// signed in with for a session cookie
+func createSessionHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	if cred := c.MustGet("authCredential").(*authCredential); cred.Method != "jwt" {
+		respondError(c, codeConflict, "Sign in with a bearer token to start a session")
+		return
+	}
+	s, err := createSession(c, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to create a session for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to create session")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"user_id": s.UserID, "expires_at": s.ExpiresAt})
+}
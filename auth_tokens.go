@@ -0,0 +1,471 @@
+// auth_tokens.go
+// Our own short-lived access tokens with rotating refresh tokens, traded for the provider's
+// JWT at POST /auth/token and revoked per device family or all at once
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	accessTokenTTL    = getEnvDuration("AUTH_ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL   = getEnvDuration("AUTH_REFRESH_TOKEN_TTL", 60*24*time.Hour)
+	accessTokenIssuer = getEnv("AUTH_ACCESS_TOKEN_ISSUER", "mobart")
+	// How long logging out everywhere refuses the provider's earlier tokens: their lifetime
+	jwtMaxLifetime = getEnvDuration("AUTH_JWT_MAX_LIFETIME", 30*24*time.Hour)
+
+	accessKey   *ecdsa.PrivateKey
+	accessKeyID string
+
+	refreshTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_refresh_tokens_total",
+		Help: "Refresh token exchanges, by result (issued, rotated, invalid, expired, revoked, reused, error).",
+	}, []string{"result"})
+
+	errRefreshReused = errors.New("refresh token reused")
+)
+
+// authRevocationsChannel tells every instance to close a user's live connections
+const authRevocationsChannel = "auth_revocations"
+
+func init() {
+	raw := getEnv("AUTH_ACCESS_TOKEN_KEY", "")
+	if raw == "" {
+		// Tokens still work, but only on the instance and process that issued them
+		log.Println("⚠️ AUTH_ACCESS_TOKEN_KEY not set; access tokens won't survive a restart or work across instances")
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		setAccessKey(key)
+		return
+	}
+	key, err := parseAccessKey(raw)
+	if err != nil {
+		log.Fatalf("❌ Invalid AUTH_ACCESS_TOKEN_KEY: %v", err)
+	}
+	setAccessKey(key)
+}
+
+// parseAccessKey reads a PEM P-256 private key, SEC 1 or PKCS #8
+func parseAccessKey(raw string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		return nil, errors.New("not PEM")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, checkAccessCurve(key)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an EC key")
+	}
+	return key, checkAccessCurve(key)
+}
+
+func checkAccessCurve(key *ecdsa.PrivateKey) error {
+	if key.Curve != elliptic.P256() {
+		return errors.New("must be a P-256 key")
+	}
+	return nil
+}
+
+// setAccessKey signs access tokens with key, under a kid derived from its public half so
+// the provider's kids and ours never collide
+func setAccessKey(key *ecdsa.PrivateKey) {
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(pub)
+	accessKey, accessKeyID = key, accessTokenIssuer+"-"+hex.EncodeToString(sum[:8])
+}
+
+// signAccessToken issues userID an access token of family
+func signAccessToken(userID, family string, now time.Time) (string, time.Time, error) {
+	expires := now.Add(accessTokenTTL)
+	header, err := json.Marshal(jwtHeader{Alg: "ES256", Kid: accessKeyID})
+	if err != nil {
+		return "", expires, err
+	}
+	claims, err := json.Marshal(jwtClaims{Issuer: accessTokenIssuer, Subject: userID, Audience: audienceClaim{accessTokenIssuer},
+		ExpiresAt: expires.Unix(), IssuedAt: now.Unix(), Family: family})
+	if err != nil {
+		return "", expires, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, accessKey, digest[:])
+	if err != nil {
+		return "", expires, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), expires, nil
+}
+
+func revokedFamilyKey(family string) string { return "auth:revoked_family:" + family }
+func logoutAllKey(userID string) string     { return "auth:logout_all:" + userID }
+
+// checkLogoutAll refuses a token issued (at unix seconds) before its user last logged out
+// everywhere
+func checkLogoutAll(ctx context.Context, userID string, issuedAt int64) error {
+	raw, err := rdb.Get(ctx, logoutAllKey(userID)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("check logout: %w", err)
+	}
+	if cutoff, _ := strconv.ParseInt(raw, 10, 64); issuedAt <= cutoff {
+		return fmt.Errorf("%w: issued before logging out everywhere", errCredentialRevoked)
+	}
+	return nil
+}
+
+// accessTokenAuthenticator accepts our access tokens, leaving other bearer tokens to the
+// provider's authenticator
+type accessTokenAuthenticator struct{}
+
+func (accessTokenAuthenticator) Name() string { return "access" }
+
+func (accessTokenAuthenticator) Authenticate(c *gin.Context) (*repository.User, *authCredential, error) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" || jwtKeyID(token) != accessKeyID {
+		return nil, nil, errNoCredential
+	}
+	claims, err := parseJWT(token, func(string) crypto.PublicKey { return &accessKey.PublicKey })
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := claims.check(accessTokenIssuer, accessTokenIssuer, clock.Now()); err != nil {
+		return nil, nil, err
+	}
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil || claims.Family == "" {
+		return nil, nil, fmt.Errorf("%w: malformed access token", errCredentialInvalid)
+	}
+	revoked, err := rdb.Exists(c.Request.Context(), revokedFamilyKey(claims.Family)).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("check revocation: %w", err)
+	}
+	if revoked > 0 {
+		return nil, nil, fmt.Errorf("%w: family %s", errCredentialRevoked, claims.Family)
+	}
+	return &repository.User{ID: id}, &authCredential{Method: "access", ID: claims.Family, ExpiresAt: claims.expiry()}, nil
+}
+
+// refreshTokenHash is what a refresh token is stored and looked up as
+func refreshTokenHash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// newRefreshToken stores a fresh refresh token of family in tx
+func newRefreshToken(ctx context.Context, tx *sql.Tx, family string, now time.Time) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	expires := now.Add(refreshTokenTTL)
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (family_id, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4)`,
+		family, refreshTokenHash(token), now, expires)
+	return token, expires, err
+}
+
+// TokenPairResponse is the body of POST /auth/token and POST /auth/refresh
+type TokenPairResponse struct {
+	AccessToken           string    `json:"access_token"`
+	AccessTokenExpiresAt  time.Time `json:"access_token_expires_at"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	TokenType             string    `json:"token_type"`
+}
+
+// tokenPair finishes tx with a new refresh token of family and signs its access token
+func tokenPair(ctx context.Context, tx *sql.Tx, userID, family string) (TokenPairResponse, error) {
+	now := clock.Now()
+	refresh, refreshExpires, err := newRefreshToken(ctx, tx, family, now)
+	if err != nil {
+		return TokenPairResponse{}, err
+	}
+	access, accessExpires, err := signAccessToken(userID, family, now)
+	if err != nil {
+		return TokenPairResponse{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return TokenPairResponse{}, err
+	}
+	return TokenPairResponse{AccessToken: access, AccessTokenExpiresAt: accessExpires,
+		RefreshToken: refresh, RefreshTokenExpiresAt: refreshExpires, TokenType: "Bearer"}, nil
+}
+
+// denyFamilies puts families on the access path's denylist and closes their connections
+func denyFamilies(ctx context.Context, userID string, families []string) error {
+	if len(families) == 0 {
+		return nil
+	}
+	pipe := rdb.Pipeline()
+	for _, f := range families {
+		pipe.Set(ctx, revokedFamilyKey(f), "1", accessTokenTTL+jwtLeeway)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	for _, f := range families {
+		disconnectCredential(ctx, userID, "access:"+f)
+	}
+	return nil
+}
+
+// revokeFamilies revokes userID's live families matching where (on $2 onwards) and denies them
+func revokeFamilies(ctx context.Context, userID, reason, where string, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE refresh_families SET revoked_at = now(), revoke_reason = $1
+		WHERE user_id = $2 AND revoked_at IS NULL AND `+where+` RETURNING id`,
+		append([]interface{}{reason, userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	var families []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		families = append(families, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return denyFamilies(ctx, userID, families)
+}
+
+// revokeFamily ends one device's family, as on logout
+func revokeFamily(ctx context.Context, userID, family, reason string) error {
+	return revokeFamilies(ctx, userID, reason, "id = $3", family)
+}
+
+// issueTokensHandler handles POST /auth/token {"device_id": ...}: the app trades the
+// provider's token it signed in with for a pair, replacing the device's earlier family
+func issueTokensHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	if cred := c.MustGet("authCredential").(*authCredential); cred.Method != "jwt" {
+		respondError(c, codeConflict, "Sign in with the identity provider's token to get refresh tokens")
+		return
+	}
+	var req struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.DeviceID) == "" || len(req.DeviceID) > 128 {
+		fieldError(c, codeValidationFailed, "device_id", "is required and must be at most 128 characters")
+		return
+	}
+	ctx := c.Request.Context()
+	userID := user.ID.String()
+	if err := revokeFamilies(ctx, userID, "replaced", "device_id = $3", req.DeviceID); err != nil {
+		log.Printf("❌ Failed to replace the token family of %s on %s: %v", user.ID, req.DeviceID, err)
+		refreshTokens.WithLabelValues("error").Inc()
+		respondError(c, codeInternal, "Failed to issue tokens")
+		return
+	}
+	pair, err := func() (TokenPairResponse, error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return TokenPairResponse{}, err
+		}
+		defer tx.Rollback()
+		var family string
+		if err := tx.QueryRowContext(ctx, `
+			INSERT INTO refresh_families (user_id, device_id) VALUES ($1, $2) RETURNING id`,
+			userID, req.DeviceID).Scan(&family); err != nil {
+			return TokenPairResponse{}, err
+		}
+		return tokenPair(ctx, tx, userID, family)
+	}()
+	if err != nil {
+		log.Printf("❌ Failed to issue tokens to %s on %s: %v", user.ID, req.DeviceID, err)
+		refreshTokens.WithLabelValues("error").Inc()
+		respondError(c, codeInternal, "Failed to issue tokens")
+		return
+	}
+	refreshTokens.WithLabelValues("issued").Inc()
+	c.JSON(http.StatusCreated, pair)
+}
+
+// rotateRefreshToken spends token and returns the next pair of its family
+func rotateRefreshToken(ctx context.Context, token string) (TokenPairResponse, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return TokenPairResponse{}, err
+	}
+	defer tx.Rollback()
+	var tokenID, family, userID string
+	var expires time.Time
+	var used, revoked sql.NullTime
+	err = tx.QueryRowContext(ctx, `
+		SELECT t.id, t.family_id, f.user_id, t.expires_at, t.used_at, f.revoked_at
+		FROM refresh_tokens t JOIN refresh_families f ON f.id = t.family_id
+		WHERE t.token_hash = $1 FOR UPDATE`, refreshTokenHash(token)).
+		Scan(&tokenID, &family, &userID, &expires, &used, &revoked)
+	if err == sql.ErrNoRows {
+		return TokenPairResponse{}, errCredentialInvalid
+	}
+	if err != nil {
+		return TokenPairResponse{}, err
+	}
+	switch {
+	case revoked.Valid:
+		return TokenPairResponse{}, fmt.Errorf("%w: family %s", errCredentialRevoked, family)
+	case used.Valid:
+		tx.Rollback()
+		log.Printf("🚨 Refresh token of family %s (user %s) reused, revoking the family", family, userID)
+		if err := revokeFamily(ctx, userID, family, "reused"); err != nil {
+			return TokenPairResponse{}, err
+		}
+		return TokenPairResponse{}, errRefreshReused
+	case !clock.Now().Before(expires):
+		return TokenPairResponse{}, errCredentialExpired
+	}
+	if accountState(ctx, userID) != accountActive {
+		return TokenPairResponse{}, fmt.Errorf("%w: account not active", errCredentialRevoked)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = now() WHERE id = $1`, tokenID); err != nil {
+		return TokenPairResponse{}, err
+	}
+	return tokenPair(ctx, tx, userID, family)
+}
+
+// refreshTokensHandler handles POST /auth/refresh {"refresh_token": ...}; the refresh
+// token is the credential
+func refreshTokensHandler(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		fieldError(c, codeValidationFailed, "refresh_token", "is required")
+		return
+	}
+	pair, err := rotateRefreshToken(c.Request.Context(), req.RefreshToken)
+	if err == nil {
+		refreshTokens.WithLabelValues("rotated").Inc()
+		c.JSON(http.StatusOK, pair)
+		return
+	}
+	if errors.Is(err, errRefreshReused) {
+		refreshTokens.WithLabelValues("reused").Inc()
+		respondUnauthorized(c, "revoked")
+		return
+	}
+	result := authResult(err)
+	refreshTokens.WithLabelValues(result).Inc()
+	if result == "error" {
+		log.Printf("❌ Failed to refresh tokens on request %s: %v", c.GetString("requestID"), err)
+		respondError(c, codeUnavailable, "Authentication is temporarily unavailable, please try again shortly")
+		return
+	}
+	log.Printf("🔒 Refresh token rejected (%s) on request %s: %v", result, c.GetString("requestID"), err)
+	respondUnauthorized(c, result)
+}
+
+// logoutAll revokes every family and session of userID, refuses the provider's tokens
+// issued until now and closes the user's connections
+func logoutAll(ctx context.Context, userID string) error {
+	if err := revokeFamilies(ctx, userID, "logout_all", "TRUE"); err != nil {
+		return err
+	}
+	if err := revokeUserSessions(ctx, userID); err != nil {
+		return err
+	}
+	if err := rdb.Set(ctx, logoutAllKey(userID), clock.Now().Unix(), jwtMaxLifetime).Err(); err != nil {
+		return err
+	}
+	disconnectCredential(ctx, userID, "")
+	return nil
+}
+
+// logoutAllHandler handles POST /auth/logout-all
+func logoutAllHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	if err := logoutAll(c.Request.Context(), user.ID.String()); err != nil {
+		log.Printf("❌ Failed to log %s out everywhere: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to log out")
+		return
+	}
+	log.Printf("🔒 %s logged out everywhere", user.ID)
+	clearSessionCookie(c)
+	c.Status(http.StatusNoContent)
+}
+
+// authRevocation is one disconnect request between instances; an empty credential is all
+// of the user's connections
+type authRevocation struct {
+	UserID     string `json:"user_id"`
+	Credential string `json:"credential,omitempty"`
+}
+
+// disconnectCredential closes the connections opened with credential (see credentialKey)
+// on every instance
+func disconnectCredential(ctx context.Context, userID, credential string) {
+	data, err := json.Marshal(authRevocation{UserID: userID, Credential: credential})
+	if err != nil {
+		return
+	}
+	if err := rdb.Publish(ctx, authRevocationsChannel, data).Err(); err != nil {
+		log.Printf("⚠️ Failed to broadcast the revocation for %s, closing only local connections: %v", userID, err)
+		realtime.disconnect(userID, credential)
+	}
+}
+
+// startAuthRevocationListener closes this instance's connections of revoked credentials
+func startAuthRevocationListener() {
+	ctx := context.Background()
+	pubsub := rdb.Subscribe(ctx, authRevocationsChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		panic(err)
+	}
+	for msg := range pubsub.Channel() {
+		redisMessageReceived(msg.Channel)
+		var r authRevocation
+		if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+			log.Printf("⚠️ Bad auth revocation: %v", err)
+			continue
+		}
+		realtime.disconnect(r.UserID, r.Credential)
+	}
+}
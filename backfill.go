@@ -0,0 +1,397 @@
+// backfill.go
+// One-off jobs over large tables: keyset iteration with a stored cursor, so restarts
+// resume, plus per-job concurrency and rate limits and the /admin/backfills API
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const backfillLockPrefix = "backfill:lock:"
+
+var (
+	backfillPollInterval = getEnvDuration("BACKFILL_POLL_INTERVAL", 15*time.Second)
+	backfillBatchSize    = getEnvInt("BACKFILL_BATCH_SIZE", 100)
+	backfillMaxWorkers   = 32
+)
+
+var errBackfillPanic = errors.New("panic while processing row")
+
+// BackfillJob processes rows one key at a time. Process must be idempotent: after a
+// crash the last, uncommitted batch runs again
+type BackfillJob struct {
+	Name        string
+	Description string
+	// Next returns up to limit keys after cursor in ascending order; "" is the start
+	Next func(ctx context.Context, cursor string, limit int) ([]string, error)
+	// Count estimates the rows left, for progress and ETA
+	Count   func(ctx context.Context) (int64, error)
+	Process func(ctx context.Context, key string) error
+	// Continuous jobs keep finding new keys, so a completed run resumes from its cursor
+	// rather than starting over
+	Continuous bool
+}
+
+var (
+	backfillJobs = map[string]*BackfillJob{}
+
+	// backfillActive tracks jobs running on this instance
+	backfillActive sync.Map
+)
+
+func registerBackfill(j *BackfillJob) {
+	backfillJobs[j.Name] = j
+}
+
+// queryKeys runs a single-column key query for Next implementations
+func queryKeys(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// BackfillRun is the stored state and progress of a job
+type BackfillRun struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Status        string     `json:"status"` // idle, running, paused, completed
+	Cursor        string     `json:"cursor"`
+	Processed     int64      `json:"processed"`
+	Errors        int64      `json:"errors"`
+	Total         int64      `json:"total"`
+	Concurrency   int        `json:"concurrency"`
+	RatePerSecond float64    `json:"rate_per_second"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	ETA           *time.Time `json:"eta,omitempty"`
+
+	// Throughput since the last start/resume, for the ETA
+	segmentStartedAt *time.Time
+	segmentProcessed int64
+}
+
+func loadBackfillRun(ctx context.Context, name string) (*BackfillRun, error) {
+	r := BackfillRun{Name: name, Status: "idle"}
+	if j, ok := backfillJobs[name]; ok {
+		r.Description = j.Description
+	}
+	err := db.QueryRowContext(ctx, `
+		SELECT status, cursor, processed, errors, total, concurrency, rate_per_second,
+		       started_at, completed_at, segment_started_at, segment_processed
+		FROM backfill_runs WHERE name = $1`, name).
+		Scan(&r.Status, &r.Cursor, &r.Processed, &r.Errors, &r.Total, &r.Concurrency, &r.RatePerSecond,
+			&r.StartedAt, &r.CompletedAt, &r.segmentStartedAt, &r.segmentProcessed)
+	if err == sql.ErrNoRows {
+		return &r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Status == "running" && r.segmentStartedAt != nil {
+		done := r.Processed + r.Errors - r.segmentProcessed
+		elapsed := time.Since(*r.segmentStartedAt)
+		if done > 0 && r.Total > r.Processed+r.Errors {
+			remaining := time.Duration(float64(elapsed) / float64(done) * float64(r.Total-r.Processed-r.Errors))
+			eta := time.Now().Add(remaining)
+			r.ETA = &eta
+		}
+	}
+	return &r, nil
+}
+
+// startBackfillRunner picks up running jobs; a Redis lock, renewed while the job runs,
+// keeps each on one instance
+func startBackfillRunner() {
+	ticker := time.NewTicker(backfillPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("backfill_runner", nil, func() {
+			ctx := backgroundStorage(context.Background())
+			names, err := queryKeys(ctx, `SELECT name FROM backfill_runs WHERE status = 'running'`)
+			if err != nil {
+				log.Printf("❌ Failed to load backfills: %v", err)
+				return
+			}
+			for _, name := range names {
+				job, ok := backfillJobs[name]
+				if !ok {
+					continue
+				}
+				if _, running := backfillActive.Load(name); running {
+					continue
+				}
+				jobCtx, release, ok := acquireJobLock(context.Background(), backfillLockPrefix+name, 2*backfillPollInterval)
+				if !ok {
+					continue
+				}
+				backfillActive.Store(name, true)
+				go func(job *BackfillJob) {
+					defer backfillActive.Delete(job.Name)
+					defer release()
+					runWithRecovery("backfill", map[string]string{"job": job.Name}, func() {
+						runBackfill(jobCtx, job)
+					})
+				}(job)
+			}
+		})
+	}
+}
+
+// runBackfill works batch by batch until the job is paused or runs out of rows
+func runBackfill(ctx context.Context, job *BackfillJob) {
+	log.Printf("🔁 Backfill %s running", job.Name)
+	for {
+		run, err := loadBackfillRun(ctx, job.Name)
+		if err != nil {
+			log.Printf("❌ Backfill %s: failed to load state: %v", job.Name, err)
+			return
+		}
+		if run.Status != "running" {
+			log.Printf("⏸️ Backfill %s stopped (%s)", job.Name, run.Status)
+			return
+		}
+
+		keys, err := job.Next(ctx, run.Cursor, backfillBatchSize)
+		if err != nil {
+			log.Printf("❌ Backfill %s: failed to load batch: %v", job.Name, err)
+			return
+		}
+		if len(keys) == 0 {
+			db.ExecContext(ctx, `
+				UPDATE backfill_runs SET status = 'completed', completed_at = now(), updated_at = now()
+				WHERE name = $1 AND status = 'running'`, job.Name)
+			log.Printf("✅ Backfill %s completed", job.Name)
+			return
+		}
+
+		failed := processBackfillBatch(ctx, job, keys, run.Concurrency, run.RatePerSecond)
+		if ctx.Err() != nil {
+			// The lock went mid-batch; whoever holds it now runs the batch again
+			log.Printf("⏸️ Backfill %s stopped: lost its lock", job.Name)
+			return
+		}
+		_, err = db.ExecContext(ctx, `
+			UPDATE backfill_runs
+			SET cursor = $2, processed = processed + $3, errors = errors + $4, updated_at = now()
+			WHERE name = $1`, job.Name, keys[len(keys)-1], len(keys)-failed, failed)
+		if err != nil {
+			log.Printf("❌ Backfill %s: failed to save cursor: %v", job.Name, err)
+			return
+		}
+	}
+}
+
+// processBackfillBatch runs Process over keys, recording and skipping row errors
+func processBackfillBatch(ctx context.Context, job *BackfillJob, keys []string, concurrency int, rate float64) (failed int) {
+	concurrency = min(max(concurrency, 1), backfillMaxWorkers)
+	var throttle <-chan time.Time
+	if rate > 0 {
+		t := time.NewTicker(max(time.Duration(float64(time.Second)/rate), time.Microsecond))
+		defer t.Stop()
+		throttle = t.C
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, key := range keys {
+		if throttle != nil {
+			<-throttle
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var err error
+			if runWithRecovery("backfill_row", map[string]string{"job": job.Name}, func() {
+				err = job.Process(ctx, key)
+			}) {
+				err = errBackfillPanic
+			}
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			db.ExecContext(ctx, `INSERT INTO backfill_errors (name, row_key, error) VALUES ($1, $2, $3)`,
+				job.Name, key, err.Error())
+		}(key)
+	}
+	wg.Wait()
+	return failed
+}
+
+// listBackfillsHandler handles GET /admin/backfills
+func listBackfillsHandler(c *gin.Context) {
+	runs := []*BackfillRun{}
+	for name := range backfillJobs {
+		r, err := loadBackfillRun(c.Request.Context(), name)
+		if err != nil {
+			log.Printf("❌ Failed to load backfill %s: %v", name, err)
+			respondError(c, codeInternal, "Failed to load backfills")
+			return
+		}
+		runs = append(runs, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"backfills": runs})
+}
+
+// getBackfillHandler handles GET /admin/backfills/:name, with the most recent row errors
+func getBackfillHandler(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := backfillJobs[name]; !ok {
+		respondError(c, codeNotFound, "Backfill not found")
+		return
+	}
+	run, err := loadBackfillRun(c.Request.Context(), name)
+	if err != nil {
+		log.Printf("❌ Failed to load backfill %s: %v", name, err)
+		respondError(c, codeInternal, "Failed to load backfill")
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT row_key, error, created_at FROM backfill_errors
+		WHERE name = $1 ORDER BY id DESC LIMIT 50`, name)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load backfill")
+		return
+	}
+	defer rows.Close()
+
+	type rowError struct {
+		Key       string    `json:"key"`
+		Error     string    `json:"error"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	recent := []rowError{}
+	for rows.Next() {
+		var e rowError
+		if err := rows.Scan(&e.Key, &e.Error, &e.CreatedAt); err != nil {
+			respondError(c, codeInternal, "Failed to load backfill")
+			return
+		}
+		recent = append(recent, e)
+	}
+	c.JSON(http.StatusOK, gin.H{"backfill": run, "recent_errors": recent})
+}
+
+// startBackfillHandler handles POST /admin/backfills/:name/start. Paused jobs resume from
+// their cursor; completed ones (or restart: true) start over, unless the job is continuous
+func startBackfillHandler(c *gin.Context) {
+	name := c.Param("name")
+	job, ok := backfillJobs[name]
+	if !ok {
+		respondError(c, codeNotFound, "Backfill not found")
+		return
+	}
+	body := struct {
+		Concurrency   int     `json:"concurrency"`
+		RatePerSecond float64 `json:"rate_per_second"`
+		Restart       bool    `json:"restart"`
+	}{Concurrency: 4, RatePerSecond: 50}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, codeInvalidRequest, "Invalid JSON format")
+			return
+		}
+	}
+	if body.Concurrency < 1 || body.Concurrency > backfillMaxWorkers {
+		fieldError(c, codeValidationFailed, "concurrency", "must be between 1 and 32")
+		return
+	}
+	if body.RatePerSecond < 0 {
+		fieldError(c, codeValidationFailed, "rate_per_second", "must not be negative (0 is unlimited)")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := startBackfillRun(ctx, job, body.Concurrency, body.RatePerSecond, body.Restart); err != nil {
+		log.Printf("❌ Failed to start backfill %s: %v", name, err)
+		respondError(c, codeInternal, "Failed to start backfill")
+		return
+	}
+	run, err := loadBackfillRun(ctx, name)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load backfill")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"backfill": run})
+}
+
+// startBackfillRun marks job running for the runner to pick up
+func startBackfillRun(ctx context.Context, job *BackfillJob, concurrency int, rate float64, restart bool) error {
+	remaining, err := job.Count(ctx)
+	if err != nil {
+		return fmt.Errorf("count rows: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO backfill_runs (name, status, total, concurrency, rate_per_second, started_at,
+		                           segment_started_at, updated_at)
+		VALUES ($1, 'running', $2, $3, $4, now(), now(), now())
+		ON CONFLICT (name) DO UPDATE SET
+			status = 'running',
+			concurrency = EXCLUDED.concurrency,
+			rate_per_second = EXCLUDED.rate_per_second,
+			cursor = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN '' ELSE backfill_runs.cursor END,
+			processed = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN 0 ELSE backfill_runs.processed END,
+			errors = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN 0 ELSE backfill_runs.errors END,
+			started_at = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN now() ELSE backfill_runs.started_at END,
+			total = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN $2
+			             ELSE backfill_runs.processed + backfill_runs.errors + $2 END,
+			segment_processed = CASE WHEN $5 OR (backfill_runs.status = 'completed' AND NOT $6) THEN 0
+			                         ELSE backfill_runs.processed + backfill_runs.errors END,
+			segment_started_at = now(),
+			completed_at = NULL,
+			updated_at = now()`,
+		job.Name, remaining, concurrency, rate, restart, job.Continuous)
+	return err
+}
+
+// pauseBackfillHandler handles POST /admin/backfills/:name/pause; the runner stops after its current batch
+func pauseBackfillHandler(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := backfillJobs[name]; !ok {
+		respondError(c, codeNotFound, "Backfill not found")
+		return
+	}
+	res, err := db.ExecContext(c.Request.Context(), `
+		UPDATE backfill_runs SET status = 'paused', updated_at = now()
+		WHERE name = $1 AND status = 'running'`, name)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to pause backfill")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeConflict, "Backfill is not running")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "status": "paused"})
+}
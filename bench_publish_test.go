@@ -0,0 +1,88 @@
+// bench_publish_test.go
+// Time and allocations per request on the publish path. BenchmarkPublish is
+// PublishImageGenerationRequest on its own; BenchmarkGenerationHandler is POST /generations
+// through the router, seeding a fresh user per request (outside the timer) so admission
+// always lets it through. Both swap brokerPublish for one that drops messages; everything
+// else talks to the configured Redis and Postgres, so point DATABASE_URL at a scratch
+// database. Compare allocs/op against a run on the previous build:
+//
+//	go test -run NONE -bench 'Publish|GenerationHandler' -benchmem .
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const benchPrompt = "A lighthouse on a cliff at dusk, waves breaking below, oil painting"
+
+// withDroppingBroker swaps in a broker that drops messages and silences logging, which at
+// benchmark rates is the loudest thing measured. It skips without Redis and Postgres
+func withDroppingBroker(b *testing.B) {
+	b.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		b.Skipf("needs a scratch database: %v", err)
+	}
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		b.Skipf("needs Redis: %v", err)
+	}
+
+	published := brokerPublish
+	brokerPublish = func(ctx context.Context, channel string, payload []byte) (int64, error) { return 1, nil }
+	logOutput, logger := log.Writer(), slog.Default()
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	gin.SetMode(gin.ReleaseMode)
+	b.Cleanup(func() {
+		brokerPublish = published
+		log.SetOutput(logOutput)
+		slog.SetDefault(logger)
+	})
+}
+
+func BenchmarkPublish(b *testing.B) {
+	withDroppingBroker(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := PublishImageGenerationRequest("bench-user", benchPrompt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGenerationHandler(b *testing.B) {
+	withDroppingBroker(b)
+	router := setupRouter()
+	body := []byte(`{"request_type":"image","text":"` + benchPrompt + `"}`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		userID := newID()
+		if _, err := db.Exec(`INSERT INTO users (id, plan, credits) VALUES ($1, 'pro', 1000)`, userID); err != nil {
+			b.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/generations", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User-ID", userID)
+		w := httptest.NewRecorder()
+		b.StartTimer()
+
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			b.Fatalf("POST /generations: %d %s", w.Code, w.Body.String())
+		}
+	}
+}
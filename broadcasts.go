@@ -0,0 +1,317 @@
+// broadcasts.go
+// Admin announcements to connected clients: POST /admin/broadcast fans a system event out
+// through the realtime hubs and stores it, so clients connecting while it is live get it on
+// connect too. Broadcasts can be revoked, which retracts them from open connections, and
+// every creation and revocation lands in broadcast_audit. An admin's broadcasts reach their
+// own tenant's users, and its plans are that tenant's; those of background jobs (the SLO
+// monitor) reach every tenant
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	maxBroadcastLength = 500
+	broadcastRateKey   = "ratelimit:broadcasts"
+)
+
+var (
+	// At most BROADCAST_RATE_LIMIT broadcasts per BROADCAST_RATE_WINDOW, across all admins
+	broadcastRateLimit  = getEnvInt("BROADCAST_RATE_LIMIT", 5)
+	broadcastRateWindow = getEnvDuration("BROADCAST_RATE_WINDOW", 10*time.Minute)
+	// New connections read live broadcasts through a cache this fresh
+	broadcastCacheTTL = getEnvDuration("BROADCAST_CACHE_TTL", 5*time.Second)
+)
+
+var broadcastSeverities = []string{"info", "warning", "critical"}
+
+// Broadcast is one announcement, as stored and as listed
+type Broadcast struct {
+	ID        string     `json:"id"`
+	Message   string     `json:"message"`
+	Severity  string     `json:"severity"`
+	Plans     []string   `json:"plans,omitempty"`  // empty reaches everyone
+	Tenant    string     `json:"tenant,omitempty"` // empty reaches every tenant
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy string     `json:"revoked_by,omitempty"`
+}
+
+func (b *Broadcast) live(now time.Time) bool {
+	return b.RevokedAt == nil && (b.ExpiresAt == nil || b.ExpiresAt.After(now))
+}
+
+// event is the announcement as clients receive it
+func (b *Broadcast) event() Event {
+	return Event{Type: eventAnnouncement, Plans: b.Plans, Tenant: b.Tenant, Data: gin.H{
+		"id": b.ID, "message": b.Message, "severity": b.Severity, "expires_at": b.ExpiresAt,
+	}}
+}
+
+const broadcastColumns = `id, message, severity, plans, created_by, created_at, expires_at, revoked_at,
+	       coalesce(revoked_by, ''), coalesce(tenant_id, '')`
+
+func scanBroadcast(row rowScanner) (*Broadcast, error) {
+	var b Broadcast
+	err := row.Scan(&b.ID, &b.Message, &b.Severity, pq.Array(&b.Plans), &b.CreatedBy, &b.CreatedAt, &b.ExpiresAt,
+		&b.RevokedAt, &b.RevokedBy, &b.Tenant)
+	return &b, err
+}
+
+// liveBroadcasts caches the live announcements for replay on connect, which reconnect
+// storms during an incident would otherwise turn into a query each
+var liveBroadcasts struct {
+	sync.Mutex
+	list    []*Broadcast
+	expires time.Time
+}
+
+func loadLiveBroadcasts(ctx context.Context) ([]*Broadcast, error) {
+	liveBroadcasts.Lock()
+	defer liveBroadcasts.Unlock()
+	if time.Now().Before(liveBroadcasts.expires) {
+		return liveBroadcasts.list, nil
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+broadcastColumns+` FROM broadcasts
+		WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at LIMIT 20`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*Broadcast
+	for rows.Next() {
+		b, err := scanBroadcast(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	liveBroadcasts.list, liveBroadcasts.expires = list, time.Now().Add(broadcastCacheTTL)
+	return list, nil
+}
+
+// forgetLiveBroadcasts makes this instance's next connect reload; others catch up within the TTL
+func forgetLiveBroadcasts() {
+	liveBroadcasts.Lock()
+	liveBroadcasts.expires = time.Time{}
+	liveBroadcasts.Unlock()
+}
+
+// replayBroadcasts hands a new connection the announcements still live
+func replayBroadcasts(ctx context.Context, sub *subscriber) {
+	list, err := loadLiveBroadcasts(ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to load live broadcasts: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, b := range list {
+		if b.live(now) {
+			e := b.event()
+			e.Timestamp = b.CreatedAt.Unix()
+			sub.offer(e)
+		}
+	}
+}
+
+func auditBroadcast(ctx context.Context, id, action, actor string) {
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO broadcast_audit (broadcast_id, action, actor) VALUES ($1, $2, $3)`, id, action, actor); err != nil {
+		log.Printf("⚠️ Failed to audit %s of broadcast %s: %v", action, id, err)
+	}
+}
+
+// broadcastRequest is the body of POST /admin/broadcast
+type broadcastRequest struct {
+	Message   string     `json:"message"`
+	Severity  string     `json:"severity"` // default info
+	ExpiresAt *time.Time `json:"expires_at"`
+	Plans     []string   `json:"plans"`
+}
+
+func (r *broadcastRequest) validate(tenantID string) (field, msg string) {
+	r.Message = strings.TrimSpace(r.Message)
+	if r.Message == "" {
+		return "message", "is required"
+	}
+	if utf8.RuneCountInString(r.Message) > maxBroadcastLength {
+		return "message", "must be at most 500 characters"
+	}
+	if r.Severity == "" {
+		r.Severity = "info"
+	}
+	if !containsString(broadcastSeverities, r.Severity) {
+		return "severity", "must be info, warning or critical"
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()) {
+		return "expires_at", "must be in the future"
+	}
+	if r.Plans == nil {
+		r.Plans = []string{} // NOT NULL; a nil array binds as NULL
+	}
+	plans := tenantPlans(tenantID)
+	for _, p := range r.Plans {
+		if _, ok := plans[p]; !ok {
+			return "plans", "unknown plan " + p
+		}
+	}
+	return "", ""
+}
+
+// createBroadcastHandler handles POST /admin/broadcast {"message", "severity", "expires_at", "plans"}
+func createBroadcastHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	tenant := currentTenant(c)
+
+	var req broadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if field, msg := req.validate(tenant.ID); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+
+	id := newID()
+	now := time.Now()
+	ok, err := admitScript.Run(ctx, rdb, []string{tenant.key(broadcastRateKey)},
+		now.UnixMilli(), broadcastRateWindow.Milliseconds(), broadcastRateLimit, id).Int()
+	if err != nil {
+		log.Printf("❌ Broadcast rate check failed: %v", err)
+		respondError(c, codeInternal, "Failed to broadcast")
+		return
+	}
+	if ok != 1 {
+		respondErrorDetails(c, codeRateLimited, "Too many broadcasts; revoke or wait before sending another",
+			gin.H{"limit": broadcastRateLimit, "window_seconds": int(broadcastRateWindow.Seconds())})
+		return
+	}
+
+	b, err := storeBroadcast(ctx, id, tenant.ID, req.Message, req.Severity, req.Plans, admin.ID.String(), req.ExpiresAt)
+	if err != nil {
+		log.Printf("❌ Failed to store broadcast: %v", err)
+		respondError(c, codeInternal, "Failed to broadcast")
+		return
+	}
+	c.JSON(http.StatusCreated, b)
+}
+
+// sendBroadcast announces message to every tenant on behalf of a background job, outside
+// the admin rate limit; createdBy names the job
+func sendBroadcast(ctx context.Context, message, severity string, plans []string, createdBy string, expiresAt *time.Time) (*Broadcast, error) {
+	return storeBroadcast(ctx, newID(), "", message, severity, plans, createdBy, expiresAt)
+}
+
+// storeBroadcast stores, audits and fans out a broadcast to tenantID, or to every tenant
+// when it's empty
+func storeBroadcast(ctx context.Context, id, tenantID, message, severity string, plans []string, createdBy string, expiresAt *time.Time) (*Broadcast, error) {
+	b, err := scanBroadcast(db.QueryRowContext(ctx, `
+		INSERT INTO broadcasts (id, message, severity, plans, created_by, expires_at, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, nullif($7, ''))
+		RETURNING `+broadcastColumns, id, message, severity, pq.Array(plans), createdBy, expiresAt, tenantID))
+	if err != nil {
+		return nil, err
+	}
+	auditBroadcast(ctx, b.ID, "created", createdBy)
+	forgetLiveBroadcasts()
+	broadcastEvent(ctx, b.event())
+
+	log.Printf("📢 Broadcast %s (%s) by %s: %s", b.ID, b.Severity, createdBy, b.Message)
+	return b, nil
+}
+
+// listBroadcastsHandler handles GET /admin/broadcasts?status=live|all, newest first: those
+// reaching the admin's tenant
+func listBroadcastsHandler(c *gin.Context) {
+	status := c.DefaultQuery("status", "live")
+	if status != "live" && status != "all" {
+		fieldError(c, codeValidationFailed, "status", "must be live or all")
+		return
+	}
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+broadcastColumns+` FROM broadcasts
+		WHERE ($1 = 'all' OR (revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())))
+		  AND (tenant_id IS NULL OR tenant_id = $2)
+		ORDER BY created_at DESC LIMIT 200`, status, currentTenant(c).ID)
+	if err != nil {
+		log.Printf("❌ Failed to list broadcasts: %v", err)
+		respondError(c, codeInternal, "Failed to list broadcasts")
+		return
+	}
+	defer rows.Close()
+
+	list := []*Broadcast{}
+	for rows.Next() {
+		b, err := scanBroadcast(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list broadcasts")
+			return
+		}
+		list = append(list, b)
+	}
+	c.JSON(http.StatusOK, gin.H{"broadcasts": list})
+}
+
+// revokeBroadcastHandler handles POST /admin/broadcasts/:id/revoke and retracts the
+// announcement from every open connection it reached. Admins revoke their tenant's
+// broadcasts; those sent to every tenant are the default tenant's
+func revokeBroadcastHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	tenant := currentTenant(c)
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		respondError(c, codeNotFound, "Broadcast not found")
+		return
+	}
+
+	b, err := scanBroadcast(db.QueryRowContext(ctx, `
+		UPDATE broadcasts SET revoked_at = now(), revoked_by = $2
+		WHERE id = $1 AND revoked_at IS NULL AND coalesce(tenant_id, 'default') = $3
+		RETURNING `+broadcastColumns, id, admin.ID.String(), tenant.ID))
+	if err == sql.ErrNoRows {
+		var exists bool
+		db.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM broadcasts WHERE id = $1 AND coalesce(tenant_id, 'default') = $2)`,
+			id, tenant.ID).Scan(&exists)
+		if !exists {
+			respondError(c, codeNotFound, "Broadcast not found")
+			return
+		}
+		respondError(c, codeConflict, "Broadcast is already revoked")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to revoke broadcast %s: %v", id, err)
+		respondError(c, codeInternal, "Failed to revoke broadcast")
+		return
+	}
+	auditBroadcast(ctx, b.ID, "revoked", admin.ID.String())
+	forgetLiveBroadcasts()
+	broadcastEvent(ctx, Event{Type: eventRetraction, Plans: b.Plans, Tenant: b.Tenant, Data: gin.H{"id": b.ID}})
+
+	log.Printf("📢 Broadcast %s revoked by %s", b.ID, admin.ID)
+	c.JSON(http.StatusOK, b)
+}
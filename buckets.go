@@ -0,0 +1,270 @@
+// buckets.go
+// Per-kind request buckets. Every request_type draws on its own rolling window
+// (ratelimit:<kind>:<user>), its own in-flight cap and its own price, so a user who has
+// used up their images can still chat. A bucket's limits come from the plan's kinds entry
+// for the type, then the kind's registered Limits, then the plan's rate_limit and
+// max_in_flight. Queued kinds count their queued and processing rows; synchronous ones
+// hold a Redis counter for as long as the request runs, lapsing after SYNC_IN_FLIGHT_TTL
+// should an instance die mid-request. Credits are one balance, but each kind has its own
+// price and a 402 or 429 names the bucket it came from. GET /usage reports every bucket
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+var syncInFlightTTL = getEnvDuration("SYNC_IN_FLIGHT_TTL", 5*time.Minute)
+
+// KindLimits sets one request_type's bucket; zero fields fall back to the next source
+type KindLimits struct {
+	RateLimit   int `json:"rate_limit,omitempty"`    // requests allowed per rateLimitWindow
+	MaxInFlight int `json:"max_in_flight,omitempty"` // running at once
+}
+
+func inFlightKey(userID, kind string) string {
+	return "inflight:" + kind + ":" + userID
+}
+
+// admitSyncScript takes an in-flight slot and a window slot together, or neither. It
+// returns 1 when admitted, 0 when the window is full and -1 when the in-flight cap is
+var admitSyncScript = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[2]) or '0') >= tonumber(ARGV[5]) then
+	return -1
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', tonumber(ARGV[1]) - tonumber(ARGV[2]))
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[6])
+return 1`)
+
+// releaseSyncScript gives an in-flight slot back without going below zero
+var releaseSyncScript = redis.NewScript(`
+if redis.call('DECR', KEYS[1]) <= 0 then
+	redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// bucket is the admission policy for one of the plan's request kinds
+func (l PlanLimits) bucket(kind string) admissionPolicy {
+	policy := l.admission()
+	k := generationKinds[kind]
+	for _, limits := range []KindLimits{kindDefaults(k), l.Kinds[kind]} {
+		if limits.RateLimit > 0 {
+			policy.WindowLimit = limits.RateLimit
+		}
+		if limits.MaxInFlight > 0 {
+			policy.MaxInFlight = limits.MaxInFlight
+		}
+	}
+	if k != nil && !k.queued() {
+		// A synchronous reply can't wait for its slot
+		policy.Mode = admissionReject
+	}
+	return policy
+}
+
+func kindDefaults(k *GenerationKind) KindLimits {
+	if k == nil {
+		return KindLimits{}
+	}
+	return k.Limits
+}
+
+// releaseAdmission takes requests back out of userID's windows, whichever kind they were
+func releaseAdmission(ctx context.Context, userID string, requestIDs ...string) {
+	members := make([]interface{}, len(requestIDs))
+	for i, id := range requestIDs {
+		members[i] = id
+	}
+	pipe := rdb.Pipeline()
+	for name := range generationKinds {
+		pipe.ZRem(ctx, rateLimitKey(userID, name), members...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Failed to release admission of %v for %s: %v", requestIDs, userID, err)
+	}
+}
+
+// admissionDetails are the details of a 429 for a request the bucket had no room for
+func admissionDetails(d admissionDecision) gin.H {
+	details := gin.H{"bucket": d.Bucket, "exhausted": d.Exhausted}
+	if !d.ETA.IsZero() {
+		details["retry_at"] = d.ETA
+	}
+	return details
+}
+
+// respondChargeError is respondTypedError for a failed charge, naming the bucket whose
+// price couldn't be paid
+func respondChargeError(c *gin.Context, err error, bucket string, credits int, fallback string) {
+	if errors.Is(err, ErrInsufficientCredits) {
+		respondErrorDetails(c, codeInsufficientCredits, err.Error(), gin.H{"bucket": bucket, "credits": credits})
+		return
+	}
+	respondTypedError(c, err, fallback)
+}
+
+// admitSynchronous holds a slot in a synchronous kind's bucket for one request and
+// charges its price. release gives the in-flight slot back once the request is answered
+// and refunds the charge if nothing was stored; ok=false means the response was written
+func admitSynchronous(c *gin.Context, userID string, kind *GenerationKind, requestID string) (release func(), ok bool) {
+	ctx := c.Request.Context()
+	policy := throttledAdmission(ctx, userID, userPlanLimits(ctx, userID).bucket(kind.Name))
+	now := clock.Now()
+	admitted, err := admitSyncScript.Run(ctx, rdb, []string{rateLimitKey(userID, kind.Name), inFlightKey(userID, kind.Name)},
+		now.UnixMilli(), rateLimitWindow.Milliseconds(), policy.WindowLimit, requestID, policy.MaxInFlight,
+		syncInFlightTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("❌ Admission check failed for %s request %s: %v", kind.Name, requestID, err)
+		respondError(c, codeInternal, "Failed to check rate limits")
+		return nil, false
+	}
+	if admitted != 1 {
+		decision := admissionDecision{Mode: policy.Mode, Bucket: kind.Name, Exhausted: exhaustedInFlight}
+		if admitted == 0 {
+			decision.Exhausted = exhaustedRate
+			decision.ETA = windowFreesAt(ctx, userID, kind.Name, now)
+		}
+		admissionDecisions.WithLabelValues("rejected", kind.Name).Inc()
+		respondErrorDetails(c, codeRateLimited, "Rate limit exceeded", admissionDetails(decision))
+		return nil, false
+	}
+	admissionDecisions.WithLabelValues("admitted", kind.Name).Inc()
+
+	price := 0
+	if kind.BaseCredits != nil {
+		price = kind.BaseCredits()
+	}
+	credits := price // left to settle on release
+	release = func() {
+		// The request's own context may be gone by now
+		ctx := context.WithoutCancel(ctx)
+		if err := releaseSyncScript.Run(ctx, rdb, []string{inFlightKey(userID, kind.Name)}).Err(); err != nil {
+			log.Printf("⚠️ Failed to release the %s slot of %s: %v", kind.Name, userID, err)
+		}
+		if credits > 0 {
+			settleSynchronousCharge(ctx, userID, requestID, credits)
+		}
+	}
+	if err := chargeCredits(ctx, userID, "", requestID, price); err != nil {
+		credits = 0
+		release()
+		releaseAdmission(ctx, userID, requestID)
+		respondChargeError(c, err, kind.Name, price, "Failed to check rate limits")
+		return nil, false
+	}
+	return release, true
+}
+
+// settleSynchronousCharge records a synchronous request's charge on its stored row, so it
+// refunds like any other, or refunds it straight away when no row was stored
+func settleSynchronousCharge(ctx context.Context, userID, requestID string, credits int) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET credits_charged = $2 WHERE request_id = $1 AND user_id = $3`,
+		requestID, credits, userID)
+	if err != nil {
+		log.Printf("❌ Failed to record the %d credits charged for %s: %v", credits, requestID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return
+	}
+	if err := refundUnstored(ctx, userID, "", requestID, credits, "not_stored"); err != nil {
+		log.Printf("❌ Failed to refund %d credits for unstored request %s: %v", credits, requestID, err)
+		errorReporter.Report(err, map[string]string{"where": "sync_refund", "request_id": requestID})
+	}
+}
+
+// windowFreesAt is when the oldest request in userID's window for kind drops out of it
+func windowFreesAt(ctx context.Context, userID, kind string, now time.Time) time.Time {
+	oldest, err := rdb.ZRangeByScoreWithScores(ctx, rateLimitKey(userID, kind), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(now.Add(-rateLimitWindow).UnixMilli(), 10), Max: "+inf", Count: 1}).Result()
+	if err != nil || len(oldest) == 0 {
+		return now.Add(rateLimitWindow)
+	}
+	return time.UnixMilli(int64(oldest[0].Score)).Add(rateLimitWindow)
+}
+
+// BucketUsage is one request kind's bucket in GET /usage
+type BucketUsage struct {
+	Bucket        string     `json:"bucket"`
+	RateLimit     int        `json:"rate_limit"`
+	Used          int64      `json:"used"` // in the current window
+	WindowSeconds int64      `json:"window_seconds"`
+	FreesAt       *time.Time `json:"frees_at,omitempty"` // when the oldest counted request drops out
+	MaxInFlight   int        `json:"max_in_flight"`
+	InFlight      int64      `json:"in_flight"`
+	Credits       int        `json:"credits"` // a default request's price on the plan
+	AdmissionMode string     `json:"admission_mode"`
+}
+
+// userBuckets reports each of userID's buckets, by kind
+func userBuckets(ctx context.Context, userID string) ([]BucketUsage, error) {
+	limits := userPlanLimits(ctx, userID)
+	now := clock.Now()
+	cutoff := now.Add(-rateLimitWindow).UnixMilli()
+
+	queued := map[string]int64{}
+	rows, err := db.QueryContext(ctx, `
+		SELECT content_type, count(*) FROM generated_content
+		WHERE user_id = $1 AND status IN ('queued', 'processing') GROUP BY content_type`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var kind string
+		var n int64
+		if err := rows.Scan(&kind, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		queued[kind] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]BucketUsage, 0, len(generationKinds))
+	for _, name := range supportedKinds() {
+		k := generationKinds[name]
+		policy := throttledAdmission(ctx, userID, limits.bucket(name))
+		b := BucketUsage{Bucket: name, RateLimit: policy.WindowLimit, WindowSeconds: int64(rateLimitWindow / time.Second),
+			MaxInFlight: policy.MaxInFlight, InFlight: queued[name], AdmissionMode: policy.Mode}
+		key := rateLimitKey(userID, name)
+		if b.Used, err = rdb.ZCount(ctx, key, "("+strconv.FormatInt(cutoff, 10), "+inf").Result(); err != nil {
+			return nil, err
+		}
+		if b.Used > 0 {
+			freesAt := windowFreesAt(ctx, userID, name, now)
+			b.FreesAt = &freesAt
+		}
+		if !k.queued() {
+			n, err := rdb.Get(ctx, inFlightKey(userID, name)).Int64()
+			if err != nil && err != redis.Nil {
+				return nil, err
+			}
+			b.InFlight = n
+		}
+		switch {
+		case limits.ModelCredits[k.DefaultModel] > 0:
+			b.Credits = limits.ModelCredits[k.DefaultModel]
+		case k.BaseCredits != nil:
+			b.Credits = k.BaseCredits()
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,523 @@
+// budgets.go
+// Budget alerts. A user, and an organization's owners for its pool, can set a monthly credit
+// budget and thresholds to be warned at: a percentage of that budget or a credit amount.
+// Spend is what was charged in the period net of refunds, and the period is the calendar
+// month in UTC. Every charge re-evaluates its payer's thresholds once it commits, and a
+// threshold that spend has reached alerts once per period: the budget_alerts row is the
+// dedupe, so a refund that takes spend back under a threshold doesn't make it alert again
+// when the next charge crosses it. Alerts go through the notification pipeline as status
+// "budget", to the user or to every owner of the org
+//
+// test_budgets.py checks the evaluation around the month boundary and across refunds
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	maxBudgetThresholds = 10
+	budgetPeriodLayout  = "2006-01-02"
+)
+
+var budgetAlertsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_budget_alerts_total",
+	Help: "Budget thresholds crossed and alerted, by scope (user, org).",
+}, []string{"scope"})
+
+// budgetScope is whose budget: a user's own spend, or an organization's pool when OrgID is set
+type budgetScope struct {
+	UserID string // for an org, who is acting on it
+	OrgID  string
+}
+
+func (s budgetScope) label() string {
+	if s.OrgID != "" {
+		return "org"
+	}
+	return "user"
+}
+
+func (s budgetScope) String() string {
+	if s.OrgID != "" {
+		return "org " + s.OrgID
+	}
+	return "user " + s.UserID
+}
+
+// owns is the condition on user_id and org_id selecting the scope's rows, with its ID as $n
+func (s budgetScope) owns(n int) (string, string) {
+	p := "$" + strconv.Itoa(n)
+	if s.OrgID != "" {
+		return "org_id = " + p, s.OrgID
+	}
+	return "org_id IS NULL AND user_id = " + p, s.UserID
+}
+
+// budgetPeriod is the UTC calendar month holding t
+func budgetPeriod(t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// BudgetThreshold is one alert level; exactly one of Percent and Credits is set
+type BudgetThreshold struct {
+	ID        string     `json:"id"`
+	Percent   *int       `json:"percent,omitempty"` // of the monthly budget
+	Credits   *int       `json:"credits,omitempty"`
+	AtCredits *int       `json:"at_credits"` // the spend it alerts at; null for a percentage without a budget
+	Crossed   bool       `json:"crossed"`
+	AlertedAt *time.Time `json:"alerted_at,omitempty"` // in the current period
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// at is the spend t alerts at, false for a percentage without a budget. Percentages round
+// up, so 80% of 5 credits alerts at 4
+func (t BudgetThreshold) at(monthly *int) (int, bool) {
+	if t.Credits != nil {
+		return *t.Credits, true
+	}
+	if t.Percent == nil || monthly == nil {
+		return 0, false
+	}
+	return (*monthly**t.Percent + 99) / 100, true
+}
+
+// BudgetStatus is what the budget endpoints answer with, and the budget part of GET /usage
+type BudgetStatus struct {
+	OrgID          string            `json:"org_id,omitempty"`
+	PeriodStart    time.Time         `json:"period_start"`
+	PeriodEnd      time.Time         `json:"period_end"`
+	MonthlyCredits *int              `json:"monthly_credits"` // null without a budget; credit thresholds still apply
+	Spent          int               `json:"spent"`
+	Remaining      *int              `json:"remaining,omitempty"` // of the budget; negative once over it
+	Thresholds     []BudgetThreshold `json:"thresholds"`
+}
+
+// evaluate works out each threshold's level and whether spend has reached it
+func (b *BudgetStatus) evaluate() {
+	b.Remaining = nil
+	if b.MonthlyCredits != nil {
+		remaining := *b.MonthlyCredits - b.Spent
+		b.Remaining = &remaining
+	}
+	for i := range b.Thresholds {
+		t := &b.Thresholds[i]
+		t.AtCredits, t.Crossed = nil, false
+		if at, ok := t.at(b.MonthlyCredits); ok {
+			t.AtCredits, t.Crossed = &at, b.Spent >= at
+		}
+	}
+}
+
+// due is the thresholds crossed that haven't alerted this period
+func (b *BudgetStatus) due() []BudgetThreshold {
+	var due []BudgetThreshold
+	for _, t := range b.Thresholds {
+		if t.Crossed && t.AlertedAt == nil {
+			due = append(due, t)
+		}
+	}
+	return due
+}
+
+// alert is what a notification about t says
+func (b *BudgetStatus) alert(t BudgetThreshold) *BudgetAlert {
+	return &BudgetAlert{ThresholdID: t.ID, OrgID: b.OrgID, PeriodStart: b.PeriodStart, Spent: b.Spent,
+		AtCredits: *t.AtCredits, Percent: t.Percent, MonthlyCredits: b.MonthlyCredits}
+}
+
+// BudgetAlert is the budget part of a "budget" notification
+type BudgetAlert struct {
+	ThresholdID    string    `json:"threshold_id"`
+	OrgID          string    `json:"org_id,omitempty"`
+	PeriodStart    time.Time `json:"period_start"`
+	Spent          int       `json:"spent"`
+	AtCredits      int       `json:"at_credits"`
+	Percent        *int      `json:"percent,omitempty"`
+	MonthlyCredits *int      `json:"monthly_credits,omitempty"`
+}
+
+// dedupeKey stands in for the request ID in the alert's delivery keys
+func (a *BudgetAlert) dedupeKey() string {
+	return "budget:" + a.ThresholdID + ":" + a.PeriodStart.Format(budgetPeriodLayout)
+}
+
+// summary is the line notifiers show under the title, in locale
+func (a *BudgetAlert) summary(locale string) string {
+	params := map[string]interface{}{"spent": a.Spent, "at": a.AtCredits}
+	if a.MonthlyCredits != nil {
+		params["budget"] = *a.MonthlyCredits
+		return translate(locale, "notification", "{spent} of {budget} monthly credits used, past the alert at {at}", params)
+	}
+	return translate(locale, "notification", "{spent} credits used this month, past the alert at {at}", params)
+}
+
+// loadBudgetStatus is the scope's budget, spend and thresholds for the period holding now
+func loadBudgetStatus(ctx context.Context, s budgetScope, now time.Time) (*BudgetStatus, error) {
+	start, end := budgetPeriod(now)
+	b := &BudgetStatus{OrgID: s.OrgID, PeriodStart: start, PeriodEnd: end, Thresholds: []BudgetThreshold{}}
+	owns, id := s.owns(1)
+	err := db.QueryRowContext(ctx, `SELECT monthly_credits FROM credit_budgets WHERE `+owns, id).
+		Scan(&b.MonthlyCredits)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	// Charges and their refunds, so a refund lowers spend in the month it's made. Referral
+	// grants and other top-ups aren't spend
+	err = db.QueryRowContext(ctx, `
+		SELECT greatest(coalesce(-sum(delta), 0), 0) FROM credit_ledger
+		WHERE `+owns+` AND created_at >= $2 AND created_at < $3
+		  AND (delta < 0 OR reason LIKE 'refund:%')`, id, start, end).Scan(&b.Spent)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.percent, t.credits, a.created_at, t.created_at
+		FROM budget_thresholds t
+		LEFT JOIN budget_alerts a ON a.threshold_id = t.id AND a.period_start = $2::date
+		WHERE `+owns+`
+		ORDER BY t.created_at, t.id`, id, start.Format(budgetPeriodLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t BudgetThreshold
+		if err := rows.Scan(&t.ID, &t.Percent, &t.Credits, &t.AlertedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		b.Thresholds = append(b.Thresholds, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	b.evaluate()
+	return b, nil
+}
+
+// recordBudgetAlerts marks the thresholds due at now as alerted for the period and returns
+// the ones this call marked. Of two evaluations racing after concurrent charges, only the
+// one whose insert lands alerts
+func recordBudgetAlerts(ctx context.Context, s budgetScope, now time.Time) (*BudgetStatus, []BudgetThreshold, error) {
+	b, err := loadBudgetStatus(ctx, s, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	var marked []BudgetThreshold
+	for _, t := range b.due() {
+		var at time.Time
+		err := db.QueryRowContext(ctx, `
+			INSERT INTO budget_alerts (threshold_id, period_start, spent) VALUES ($1, $2::date, $3)
+			ON CONFLICT DO NOTHING
+			RETURNING created_at`, t.ID, b.PeriodStart.Format(budgetPeriodLayout), b.Spent).Scan(&at)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		t.AlertedAt = &at
+		marked = append(marked, t)
+	}
+	return b, marked, nil
+}
+
+// checkBudgetThresholds runs after a charge commits, alerting on the thresholds of whoever
+// paid (the org pool when orgID is set) that spend has now reached
+func checkBudgetThresholds(ctx context.Context, userID, orgID string) {
+	s := budgetScope{UserID: userID, OrgID: orgID}
+	owns, id := s.owns(1)
+	var has bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM budget_thresholds WHERE `+owns+`)`, id).
+		Scan(&has); err != nil || !has {
+		if err != nil {
+			log.Printf("❌ Failed to check budget thresholds of %s: %v", s, err)
+		}
+		return
+	}
+	b, marked, err := recordBudgetAlerts(ctx, s, clock.Now())
+	if err != nil {
+		log.Printf("❌ Failed to check budget thresholds of %s: %v", s, err)
+		return
+	}
+	if len(marked) == 0 {
+		return
+	}
+
+	recipients := []string{userID}
+	if orgID != "" {
+		if recipients, err = orgOwners(ctx, orgID); err != nil {
+			log.Printf("❌ Failed to load owners of org %s for a budget alert: %v", orgID, err)
+			return
+		}
+	}
+	for _, t := range marked {
+		budgetAlertsSent.WithLabelValues(s.label()).Inc()
+		log.Printf("💸 Budget threshold %s of %s reached: %d credits spent, alert at %d", t.ID, s, b.Spent, *t.AtCredits)
+		for _, r := range recipients {
+			fanOutNotification(ctx, db, Notification{UserID: r, Status: "budget", Budget: b.alert(t)}, "")
+		}
+	}
+}
+
+// orgOwners lists the active owners of orgID
+func orgOwners(ctx context.Context, orgID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id FROM organization_members
+		WHERE org_id = $1 AND role = $2 AND removed_at IS NULL`, orgID, orgRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var owners []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		owners = append(owners, id)
+	}
+	return owners, rows.Err()
+}
+
+// budgetScopeFor is the budget a request manages: under /orgs/:id it's the org's, for its
+// owners only; otherwise the caller's own
+func budgetScopeFor(c *gin.Context) (budgetScope, bool) {
+	user := c.MustGet("currentUser").(*repository.User)
+	s := budgetScope{UserID: user.ID.String()}
+	if c.Param("id") == "" {
+		return s, true
+	}
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return s, false
+	}
+	s.OrgID = c.Param("id")
+	return s, true
+}
+
+// respondBudgetStatus answers with the scope's current status
+func respondBudgetStatus(c *gin.Context, status int, s budgetScope) {
+	b, err := loadBudgetStatus(c.Request.Context(), s, clock.Now())
+	if err != nil {
+		log.Printf("❌ Failed to load budget of %s: %v", s, err)
+		respondError(c, codeInternal, "Failed to load budget")
+		return
+	}
+	c.JSON(status, b)
+}
+
+// getBudgetHandler handles GET /budget and GET /orgs/:id/budget
+func getBudgetHandler(c *gin.Context) {
+	s, ok := budgetScopeFor(c)
+	if !ok {
+		return
+	}
+	respondBudgetStatus(c, http.StatusOK, s)
+}
+
+// putBudgetHandler handles PUT /budget and PUT /orgs/:id/budget. "monthly_credits": null
+// removes the budget; percentage thresholds then stay quiet until one is set again. Alerts
+// already sent this period stand when the budget changes
+func putBudgetHandler(c *gin.Context) {
+	s, ok := budgetScopeFor(c)
+	if !ok {
+		return
+	}
+	var body struct {
+		MonthlyCredits *int `json:"monthly_credits"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if body.MonthlyCredits != nil && *body.MonthlyCredits <= 0 {
+		fieldError(c, codeValidationFailed, "monthly_credits", "must be a positive number of credits")
+		return
+	}
+
+	ctx := c.Request.Context()
+	owns, id := s.owns(1)
+	var err error
+	switch {
+	case body.MonthlyCredits == nil:
+		_, err = db.ExecContext(ctx, `DELETE FROM credit_budgets WHERE `+owns, id)
+	case s.OrgID != "":
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO credit_budgets (user_id, org_id, monthly_credits) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id) WHERE org_id IS NOT NULL
+			DO UPDATE SET user_id = EXCLUDED.user_id, monthly_credits = EXCLUDED.monthly_credits, updated_at = now()`,
+			s.UserID, s.OrgID, *body.MonthlyCredits)
+	default:
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO credit_budgets (user_id, monthly_credits) VALUES ($1, $2)
+			ON CONFLICT (user_id) WHERE org_id IS NULL
+			DO UPDATE SET monthly_credits = EXCLUDED.monthly_credits, updated_at = now()`,
+			s.UserID, *body.MonthlyCredits)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to save budget of %s: %v", s, err)
+		respondError(c, codeInternal, "Failed to save budget")
+		return
+	}
+	respondBudgetStatus(c, http.StatusOK, s)
+}
+
+// budgetThresholdRequest is the body of POST and PATCH on thresholds
+type budgetThresholdRequest struct {
+	Percent *int `json:"percent"`
+	Credits *int `json:"credits"`
+}
+
+func (r budgetThresholdRequest) validate() (field, msg string) {
+	switch {
+	case r.Percent == nil && r.Credits == nil:
+		return "percent", "is required unless credits is set"
+	case r.Percent != nil && r.Credits != nil:
+		return "credits", "can't be combined with percent"
+	case r.Percent != nil && (*r.Percent < 1 || *r.Percent > 100):
+		return "percent", "must be between 1 and 100"
+	case r.Credits != nil && *r.Credits <= 0:
+		return "credits", "must be a positive number of credits"
+	}
+	return "", ""
+}
+
+func bindBudgetThreshold(c *gin.Context) (budgetThresholdRequest, bool) {
+	var body budgetThresholdRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return body, false
+	}
+	if field, msg := body.validate(); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return body, false
+	}
+	return body, true
+}
+
+// createBudgetThresholdHandler handles POST /budget/thresholds and its /orgs/:id twin. A
+// threshold added below what's already spent alerts on the next charge
+func createBudgetThresholdHandler(c *gin.Context) {
+	s, ok := budgetScopeFor(c)
+	if !ok {
+		return
+	}
+	body, ok := bindBudgetThreshold(c)
+	if !ok {
+		return
+	}
+	owns, scopeID := s.owns(5)
+	var id string
+	err := db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO budget_thresholds (user_id, org_id, percent, credits)
+		SELECT $1, nullif($2, '')::uuid, $3, $4
+		WHERE (SELECT count(*) FROM budget_thresholds WHERE `+owns+`) < $6
+		RETURNING id`, s.UserID, s.OrgID, body.Percent, body.Credits, scopeID, maxBudgetThresholds).Scan(&id)
+	if err == sql.ErrNoRows {
+		respondErrorDetails(c, codeConflict, "You can have at most {max} budget thresholds", gin.H{"max": maxBudgetThresholds})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to save budget threshold of %s: %v", s, err)
+		respondError(c, codeInternal, "Failed to save budget threshold")
+		return
+	}
+	respondBudgetStatus(c, http.StatusCreated, s)
+}
+
+// budgetThresholdParam is :threshold_id, answering 404 when it isn't an ID
+func budgetThresholdParam(c *gin.Context) (string, bool) {
+	id, err := uuid.Parse(c.Param("threshold_id"))
+	if err != nil {
+		respondError(c, codeNotFound, "Budget threshold not found")
+		return "", false
+	}
+	return id.String(), true
+}
+
+// patchBudgetThresholdHandler handles PATCH /budget/thresholds/:threshold_id and its
+// /orgs/:id twin, replacing the level. A changed threshold counts as a new one, so its
+// alert for this period is cleared
+func patchBudgetThresholdHandler(c *gin.Context) {
+	s, ok := budgetScopeFor(c)
+	if !ok {
+		return
+	}
+	thresholdID, ok := budgetThresholdParam(c)
+	if !ok {
+		return
+	}
+	body, ok := bindBudgetThreshold(c)
+	if !ok {
+		return
+	}
+	owns, id := s.owns(1)
+	err := db.QueryRowContext(c.Request.Context(), `
+		WITH t AS (
+			UPDATE budget_thresholds SET percent = $3, credits = $4
+			WHERE id = $2 AND `+owns+`
+			RETURNING id
+		), cleared AS (
+			DELETE FROM budget_alerts WHERE threshold_id IN (SELECT id FROM t)
+		)
+		SELECT id FROM t`, id, thresholdID, body.Percent, body.Credits).Scan(new(string))
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Budget threshold not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to update budget threshold %s: %v", thresholdID, err)
+		respondError(c, codeInternal, "Failed to save budget threshold")
+		return
+	}
+	respondBudgetStatus(c, http.StatusOK, s)
+}
+
+// deleteBudgetThresholdHandler handles DELETE /budget/thresholds/:threshold_id and its
+// /orgs/:id twin
+func deleteBudgetThresholdHandler(c *gin.Context) {
+	s, ok := budgetScopeFor(c)
+	if !ok {
+		return
+	}
+	thresholdID, ok := budgetThresholdParam(c)
+	if !ok {
+		return
+	}
+	owns, id := s.owns(1)
+	res, err := db.ExecContext(c.Request.Context(), `DELETE FROM budget_thresholds WHERE id = $2 AND `+owns, id, thresholdID)
+	if err != nil {
+		log.Printf("❌ Failed to delete budget threshold %s: %v", thresholdID, err)
+		respondError(c, codeInternal, "Failed to delete budget threshold")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "Budget threshold not found")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// userBudgetStatus is the caller's own budget for GET /usage, nil when it can't be loaded
+func userBudgetStatus(ctx context.Context, userID string) *BudgetStatus {
+	b, err := loadBudgetStatus(ctx, budgetScope{UserID: userID}, clock.Now())
+	if err != nil {
+		log.Printf("⚠️ Failed to load budget of user %s for usage: %v", userID, err)
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,91 @@
+// caching.go
+// Conditional GETs for the read endpoints. Generation detail is validated against the
+// row's version and updated_at, the first gallery page against a weak tag over the
+// user's rows, and downloaded assets are immutable because their keys never change
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetCacheControl lets clients keep downloads for good: a key names fixed bytes
+const assetCacheControl = "private, max-age=31536000, immutable"
+
+// urlEpoch changes every half of ttl. Responses embed presigned URLs, so it is part of
+// their tags: a client answered 304 always holds URLs with at least ttl/2 left
+func urlEpoch(ttl time.Duration) int64 {
+	return time.Now().UnixNano() / int64(max(ttl/2, time.Second))
+}
+
+func hashTag(weak bool, parts ...interface{}) string {
+	sum := sha1.Sum([]byte(fmt.Sprint(parts...)))
+	tag := `"` + hex.EncodeToString(sum[:10]) + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// generationETag covers everything a detail response shows: the row (version and
+// updated_at move on every write, renditions included), progress from Redis, the
+// requested size and the URL epoch
+func generationETag(g *Generation, size string) string {
+	progress := -1.0
+	if g.Progress != nil {
+		progress = *g.Progress
+	}
+	return hashTag(false, g.RequestID, "|", g.Version, "|", g.UpdatedAt.UnixNano(), "|", progress, "|", size,
+		"|", g.Error, "|", urlEpoch(urlTTL(g.ContentType)))
+}
+
+// galleryETag is the weak tag of the first page of GET /generations: it moves whenever
+// any of the user's rows is written, added or purged. "" while a row is in flight, since
+// progress changes without a write
+func galleryETag(ctx context.Context, userID, status, batchID string, tags []string, limit int, size, locale string) (string, error) {
+	var latest time.Time
+	var count, inFlight int64
+	err := db.QueryRowContext(ctx, `
+		SELECT coalesce(max(updated_at), 'epoch'), count(*),
+		       count(*) FILTER (WHERE status IN ('queued', 'processing'))
+		FROM generated_content WHERE user_id = $1`, userID).Scan(&latest, &count, &inFlight)
+	if err != nil || inFlight > 0 {
+		return "", err
+	}
+	return hashTag(true, userID, "|", latest.UnixNano(), "|", count, "|", status, "|", strings.Join(tags, ","), "|", batchID, "|", limit,
+		"|", size, "|", locale, "|", urlEpoch(imageURLTTL)), nil
+}
+
+// notModified sets etag (with revalidate-every-time caching) and answers 304 when the
+// request's If-None-Match already names it. Weak comparison, as GET allows
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+// canary.go
+// Synthetic canary generations. Every CANARY_INTERVAL the leader instance submits a tiny
+// image request as CANARY_USER_ID through the real router (auth, admission, charging,
+// publishing), waits up to CANARY_TIMEOUT for the worker's completion to come back
+// through the listener, and then purges the row and its objects and restores the canary
+// user's credits, so nothing of it outlives the run. Results go to mobart_canary_* and,
+// via Redis, to GET /admin/queue on every instance. CANARY_FAILURE_THRESHOLD failures in
+// a row are reported. The canary sits out degraded mode and maintenance, its user is a
+// dedicated one that no real user's credits pay for, and it's left out of generation stats
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	canaryLeaderKey   = "canary:leader"
+	canaryResultKey   = "canary:last"
+	canaryFailuresKey = "canary:consecutive_failures"
+	canaryFamily      = "canary" // the access token family the canary authenticates with
+)
+
+var (
+	canaryUserID           = getEnv("CANARY_USER_ID", "") // empty disables the canary
+	canaryInterval         = getEnvDuration("CANARY_INTERVAL", 5*time.Minute)
+	canaryTimeout          = getEnvDuration("CANARY_TIMEOUT", 2*time.Minute)
+	canaryFailureThreshold = getEnvInt("CANARY_FAILURE_THRESHOLD", 3)
+	canaryPrompt           = getEnv("CANARY_PROMPT", "a plain red square")
+	canaryModel            = getEnv("CANARY_MODEL", "") // the image default when empty
+	canaryCredits          = getEnvInt("CANARY_CREDITS", 1000)
+
+	canaryRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_canary_runs_total",
+		Help: "Canary generations, by result (completed, failed, timed_out, rejected, skipped).",
+	}, []string{"result"})
+	canaryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mobart_canary_latency_seconds",
+		Help:    "Submission to completion of successful canary generations.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+	})
+	canaryLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_canary_last_success_timestamp_seconds",
+		Help: "When the last canary generation completed.",
+	})
+	canaryConsecutiveFailures = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_canary_consecutive_failures",
+		Help: "Canary runs failed in a row, as of the leader's last run.",
+	})
+
+	canaryRouterOnce sync.Once
+	canaryRouter     *gin.Engine
+)
+
+func canaryEnabled() bool {
+	return canaryUserID != ""
+}
+
+// isCanaryUser reports whether userID is the canary's, whose rows aren't real usage
+func isCanaryUser(userID string) bool {
+	return canaryEnabled() && userID == canaryUserID
+}
+
+// CanaryResult is the latest run, shown on GET /admin/queue
+type CanaryResult struct {
+	Result              string    `json:"result"`
+	RequestID           string    `json:"request_id,omitempty"`
+	LatencySeconds      float64   `json:"latency_seconds,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	At                  time.Time `json:"at"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+// startCanary runs the canary on whichever instance holds the leader lease
+func startCanary() {
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO users (id, plan, credits) VALUES ($1, 'pro', $2) ON CONFLICT (id) DO NOTHING`,
+		canaryUserID, canaryCredits); err != nil {
+		panic(fmt.Errorf("create canary user: %w", err))
+	}
+	ticker := time.NewTicker(canaryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("canary", nil, func() {
+			// Held past the run, so a slow one isn't started again elsewhere
+			if holdLease(ctx, canaryLeaderKey, canaryInterval+canaryTimeout) {
+				recordCanary(ctx, runCanary(ctx))
+			}
+		})
+	}
+}
+
+// runCanary submits one canary generation and waits for it
+func runCanary(ctx context.Context) CanaryResult {
+	r := CanaryResult{At: clock.Now().UTC()}
+	if serviceDegraded() {
+		r.Result = "skipped"
+		return r
+	}
+	// Subscribed before submitting, so the completion can't slip past
+	filter, _ := newEventFilter([]string{eventCompleted, eventFailed}, nil)
+	sub := realtime.subscribe(canaryUserID, defaultTenantID, "", canaryFamily, filter)
+	defer realtime.unsubscribe(sub)
+
+	started := time.Now()
+	requestID, err := submitCanary()
+	if err != nil {
+		r.Result, r.Error = "rejected", err.Error()
+		return r
+	}
+	r.RequestID = requestID
+	defer cleanUpCanary(ctx, requestID)
+
+	timeout := time.NewTimer(canaryTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case e := <-sub.events:
+			if e.RequestID != requestID {
+				continue
+			}
+			if e.Type == eventFailed {
+				r.Result, r.Error = "failed", fmt.Sprint(e.Data)
+				return r
+			}
+			r.Result, r.LatencySeconds = "completed", time.Since(started).Seconds()
+			return r
+		case <-timeout.C:
+			r.Result, r.Error = "timed_out", "no completion within "+canaryTimeout.String()
+			return r
+		}
+	}
+}
+
+// submitCanary posts the canary request through the router, authenticated like an app
+func submitCanary() (string, error) {
+	canaryRouterOnce.Do(func() { canaryRouter = setupRouter() })
+	token, _, err := signAccessToken(canaryUserID, canaryFamily, clock.Now())
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(RequestPayload{Text: canaryPrompt, RequestType: "image", Model: canaryModel,
+		Resolution: 64, Steps: 1, NumImages: 1, Notify: "none", MaxWaitSeconds: int(canaryTimeout.Seconds())})
+	if err != nil {
+		return "", err
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/generations", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mobart-canary")
+	w := httptest.NewRecorder()
+	canaryRouter.ServeHTTP(w, req)
+
+	var resp QueuedGenerationResponse
+	if w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		return "", fmt.Errorf("POST /generations: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Status != "queued" {
+		return resp.GenerationRequestID, errors.New("queued as " + resp.Status)
+	}
+	return resp.GenerationRequestID, nil
+}
+
+// cleanUpCanary purges the canary's row and objects and puts its credits back
+func cleanUpCanary(ctx context.Context, requestID string) {
+	ctx = backgroundStorage(ctx)
+	if err := purgeGeneration(ctx, requestID); err != nil {
+		log.Printf("⚠️ Failed to purge canary generation %s: %v", requestID, err)
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM credit_ledger WHERE request_id = $1`, requestID); err != nil {
+		log.Printf("⚠️ Failed to drop the canary's ledger entries for %s: %v", requestID, err)
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE users SET credits = $2 WHERE id = $1`, canaryUserID, canaryCredits); err != nil {
+		log.Printf("⚠️ Failed to restore the canary's credits: %v", err)
+	}
+	releaseAdmission(ctx, canaryUserID, requestID)
+}
+
+// recordCanary publishes a run's result and reports a streak of failures
+func recordCanary(ctx context.Context, r CanaryResult) {
+	canaryRuns.WithLabelValues(r.Result).Inc()
+	switch r.Result {
+	case "skipped":
+		log.Println("⏸️ Canary skipped: the service is degraded")
+		return
+	case "completed":
+		canaryLatency.Observe(r.LatencySeconds)
+		canaryLastSuccess.Set(float64(r.At.Unix()))
+		rdb.Del(ctx, canaryFailuresKey)
+	default:
+		n, err := rdb.Incr(ctx, canaryFailuresKey).Result()
+		if err != nil {
+			log.Printf("⚠️ Failed to count canary failures: %v", err)
+		}
+		r.ConsecutiveFailures = int(n)
+		log.Printf("❌ Canary %s (%s), %d in a row: %s", r.Result, r.RequestID, n, r.Error)
+		if int(n) >= canaryFailureThreshold {
+			errorReporter.Report(fmt.Errorf("canary generation %s: %s", r.Result, r.Error), map[string]string{
+				"where": "canary", "request_id": r.RequestID, "consecutive_failures": strconv.FormatInt(n, 10)})
+		}
+	}
+	canaryConsecutiveFailures.Set(float64(r.ConsecutiveFailures))
+	if data, err := json.Marshal(r); err == nil {
+		rdb.Set(ctx, canaryResultKey, data, 0)
+	}
+}
+
+// lastCanaryResult is the latest run, nil before the first or with the canary off
+func lastCanaryResult(ctx context.Context) *CanaryResult {
+	if !canaryEnabled() {
+		return nil
+	}
+	data, err := rdb.Get(ctx, canaryResultKey).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("⚠️ Failed to load the canary result: %v", err)
+		}
+		return nil
+	}
+	var r CanaryResult
+	if json.Unmarshal(data, &r) != nil {
+		return nil
+	}
+	return &r
+}
@@ -0,0 +1,293 @@
+// capacity.go
+// Per-model GPU capacity aggregated from worker heartbeats, used for availability,
+// queue ETAs and refusing requests for models with no live workers
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	workerHeartbeatChannel = "worker_heartbeats"
+	workerModelsKey        = "worker:models"
+
+	availabilityAvailable   = "available"
+	availabilityDegraded    = "degraded"
+	availabilityUnavailable = "unavailable"
+)
+
+var (
+	workerHeartbeatInterval = getEnvDuration("WORKER_HEARTBEAT_INTERVAL", 10*time.Second)
+	// Used for ETAs until a model has completions to average
+	defaultGenerationSeconds = getEnvFloat("DEFAULT_GENERATION_SECONDS", 30)
+	// maxQueueDepth caps a model's queued and processing work; 0 leaves it unbounded
+	maxQueueDepth = getEnvInt("MAX_QUEUE_DEPTH", 0)
+)
+
+// WorkerHeartbeat is what a worker publishes every WORKER_HEARTBEAT_INTERVAL
+type WorkerHeartbeat struct {
+	WorkerID      string `json:"worker_id"`
+	Model         string `json:"model"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	CurrentLoad   int    `json:"current_load"`
+	Draining      bool   `json:"draining,omitempty"` // the worker has stopped pulling new jobs
+	ReceivedAt    int64  `json:"received_at"`        // set by us, unix millis
+	// RequestIDs are the jobs the worker is running, whose leases the heartbeat renews
+	RequestIDs []string `json:"request_ids,omitempty"`
+}
+
+// ModelCapacity is the live aggregate for one model
+type ModelCapacity struct {
+	Model         string `json:"model"`
+	Availability  string `json:"availability"`
+	Workers       int    `json:"workers"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	CurrentLoad   int    `json:"current_load"`
+}
+
+func workerCapacityKey(model string) string {
+	return "worker:capacity:" + model
+}
+
+// startHeartbeatListener records each worker's latest report under its model
+func startHeartbeatListener() {
+	ctx := context.Background()
+	if err := syncDrainedWorkers(ctx); err != nil {
+		log.Printf("⚠️ Failed to sync drained workers: %v", err)
+	}
+	pubsub := rdb.Subscribe(ctx, workerHeartbeatChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		panic(err)
+	}
+
+	for msg := range pubsub.Channel() {
+		redisMessageReceived(msg.Channel)
+		var hb WorkerHeartbeat
+		if err := decodeWorkerMessage("heartbeat", []byte(msg.Payload), &hb); err != nil || hb.WorkerID == "" || hb.Model == "" {
+			log.Printf("⚠️ Ignoring malformed heartbeat: %s", msg.Payload)
+			continue
+		}
+		hb.ReceivedAt = time.Now().UnixMilli()
+		data, _ := json.Marshal(hb)
+
+		pipe := rdb.TxPipeline()
+		pipe.SAdd(ctx, workerModelsKey, hb.Model)
+		pipe.HSet(ctx, workerCapacityKey(hb.Model), hb.WorkerID, data)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("❌ Failed to record heartbeat from %s: %v", hb.WorkerID, err)
+		}
+		noteHeartbeat(ctx, hb)
+	}
+}
+
+// modelCapacity aggregates fresh reports, aging out workers silent for two intervals.
+// Drained workers aren't counted: they may still be finishing jobs but take no new ones
+func modelCapacity(ctx context.Context, model string) (ModelCapacity, error) {
+	mc := ModelCapacity{Model: model, Availability: availabilityUnavailable}
+	reports, err := rdb.HGetAll(ctx, workerCapacityKey(model)).Result()
+	if err != nil {
+		return mc, err
+	}
+	drained, err := drainedWorkers(ctx)
+	if err != nil {
+		return mc, err
+	}
+
+	staleBefore := time.Now().Add(-2 * workerHeartbeatInterval).UnixMilli()
+	var stale []string
+	for workerID, raw := range reports {
+		var hb WorkerHeartbeat
+		if json.Unmarshal([]byte(raw), &hb) != nil || hb.ReceivedAt < staleBefore {
+			stale = append(stale, workerID)
+			continue
+		}
+		if drained[workerID] || hb.Draining {
+			continue
+		}
+		mc.Workers++
+		mc.MaxConcurrent += hb.MaxConcurrent
+		mc.CurrentLoad += hb.CurrentLoad
+	}
+	if len(stale) > 0 {
+		rdb.HDel(ctx, workerCapacityKey(model), stale...)
+	}
+
+	switch {
+	case mc.Workers == 0 || mc.MaxConcurrent == 0:
+		mc.Availability = availabilityUnavailable
+	case mc.CurrentLoad >= mc.MaxConcurrent:
+		mc.Availability = availabilityDegraded // accepting, but new work waits
+	default:
+		mc.Availability = availabilityAvailable
+	}
+	return mc, nil
+}
+
+// allModelCapacity covers every model that has ever reported
+func allModelCapacity(ctx context.Context) ([]ModelCapacity, error) {
+	models, err := rdb.SMembers(ctx, workerModelsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(models)
+	list := []ModelCapacity{}
+	for _, m := range models {
+		mc, err := modelCapacity(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, mc)
+	}
+	return list, nil
+}
+
+// modelRefused is the circuit breaker: models that have reported before but have no
+// live capacity now refuse new work. Models that never reported (workers without
+// heartbeats) are let through
+func modelRefused(ctx context.Context, model string) bool {
+	known, err := rdb.SIsMember(ctx, workerModelsKey, model).Result()
+	if err != nil || !known {
+		return false
+	}
+	mc, err := modelCapacity(ctx, model)
+	if err != nil {
+		return false
+	}
+	return mc.Availability == availabilityUnavailable
+}
+
+// queueDepth counts work waiting on or running for a model
+func queueDepth(ctx context.Context, model string) (queued int, err error) {
+	err = db.QueryRowContext(ctx, `
+		SELECT count(*) FROM generated_content
+		WHERE model = $1 AND status IN ('queued', 'processing')`, model).Scan(&queued)
+	return queued, err
+}
+
+// modelQueueFull reports whether the model already has maxQueueDepth requests waiting on
+// or running for it. A failed count lets the request through
+func modelQueueFull(ctx context.Context, model string) bool {
+	if maxQueueDepth <= 0 {
+		return false
+	}
+	queued, err := queueDepth(ctx, model)
+	return err == nil && queued >= maxQueueDepth
+}
+
+// averageGenerationSeconds is the model's mean over the last day
+func averageGenerationSeconds(ctx context.Context, model string) float64 {
+	var avg *float64
+	db.QueryRowContext(ctx, `
+		SELECT avg(generation_time_seconds) FROM generated_content
+		WHERE model = $1 AND status = 'completed' AND completed_at > now() - interval '1 day'`, model).Scan(&avg)
+	if avg == nil || *avg <= 0 {
+		return defaultGenerationSeconds
+	}
+	return *avg
+}
+
+// completionETA estimates when a request entering the queue now will be done: the work
+// ahead of it drains in rounds of the model's live concurrency
+func completionETA(ctx context.Context, model string) (time.Time, error) {
+	ahead, err := queueDepth(ctx, model)
+	if err != nil {
+		return time.Time{}, err
+	}
+	slots := 1
+	if mc, err := modelCapacity(ctx, model); err == nil && mc.MaxConcurrent > 0 {
+		slots = mc.MaxConcurrent
+	}
+	rounds := math.Ceil(float64(ahead+1) / float64(slots))
+	return clock.Now().Add(time.Duration(rounds * averageGenerationSeconds(ctx, model) * float64(time.Second))), nil
+}
+
+// listModelsHandler handles GET /models
+func listModelsHandler(c *gin.Context) {
+	list, err := allModelCapacity(c.Request.Context())
+	if err != nil {
+		log.Printf("❌ Failed to load model capacity: %v", err)
+		respondError(c, codeInternal, "Failed to load models")
+		return
+	}
+	models := make([]gin.H, 0, len(list))
+	now := clock.Now()
+	for _, mc := range list {
+		m := gin.H{"model": mc.Model, "availability": mc.Availability}
+		// Lifecycle, so clients can warn before the sunset (model_lifecycle.go)
+		l := modelLifecycleFor(mc.Model)
+		m["lifecycle"] = l.stateLabel(now)
+		if l.SunsetAt != nil {
+			m["sunset_at"] = l.SunsetAt
+		}
+		if l.Replacement != "" {
+			m["replacement"] = l.Replacement
+		}
+		models = append(models, m)
+	}
+	// Image resolution caps for the caller's plan and every other of their tenant, so
+	// clients can grey out sizes before submitting (resolution_caps.go)
+	user := c.MustGet("currentUser").(*repository.User)
+	byPlan := gin.H{}
+	for _, l := range allPlanLimits(currentTenant(c).ID) {
+		byPlan[l.Plan] = maxResolutionFor(l)
+	}
+	limits := userPlanLimits(c.Request.Context(), user.ID.String())
+	c.JSON(http.StatusOK, gin.H{"models": models, "plan": limits.Plan, "max_resolution": maxResolutionFor(limits),
+		"max_resolution_by_plan": byPlan})
+}
+
+// ModelQueue is one model of /admin/queue and of the status page
+type ModelQueue struct {
+	ModelCapacity
+	Queued int       `json:"queued"`
+	ETA    time.Time `json:"eta"` // for a request queued now
+}
+
+// modelQueues is every model's capacity with its queue depth and ETA
+func modelQueues(ctx context.Context) ([]ModelQueue, error) {
+	list, err := allModelCapacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]ModelQueue, 0, len(list))
+	for _, mc := range list {
+		q := ModelQueue{ModelCapacity: mc}
+		if q.Queued, err = queueDepth(ctx, mc.Model); err != nil {
+			return nil, err
+		}
+		if q.ETA, err = completionETA(ctx, mc.Model); err != nil {
+			return nil, err
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// adminQueueHandler handles GET /admin/queue with full capacity and depth per model, the
+// running jobs and their leases, the listener's lag and the latest canary run
+func adminQueueHandler(c *gin.Context) {
+	queues, err := modelQueues(c.Request.Context())
+	if err != nil {
+		log.Printf("❌ Failed to load queue: %v", err)
+		respondError(c, codeInternal, "Failed to load queue")
+		return
+	}
+	running, err := runningJobs(c.Request.Context())
+	if err != nil {
+		log.Printf("❌ Failed to load running jobs: %v", err)
+		respondError(c, codeInternal, "Failed to load queue")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": queues, "running": running, "listener": listenerLagSnapshot(),
+		"canary": lastCanaryResult(c.Request.Context())})
+}
@@ -0,0 +1,498 @@
+// challenges.go
+// Daily challenges: admins post a theme for a date, each user enters one of their own
+// completed generations made since the challenge started, and anyone can browse the
+// entries. Entering is a single INSERT ... SELECT that checks ownership, status and timing
+// and is guarded by the one-entry-per-user key, so concurrent requests can't both get in.
+// Each user has one vote per challenge. An entry whose generation is trashed, expires or is
+// deleted drops out of the list and its votes stop counting; an entrant can also withdraw.
+// Challenges are per tenant, one per date in each
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxChallengeTheme = 200
+	challengeDate     = "2006-01-02"
+
+	// What keeps an entry on the page; depends on generated_content being in scope
+	challengeEntryVisible = `generated_content.status = 'completed' AND generated_content.trashed_at IS NULL
+		  AND generated_content.expired_at IS NULL`
+)
+
+// Challenge is one day's theme; entries count from StartsAt and close at EndsAt
+type Challenge struct {
+	ID        string    `json:"id"`
+	Theme     string    `json:"theme"`
+	Date      string    `json:"date"` // YYYY-MM-DD
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Open reports whether entries are accepted at now
+func (ch *Challenge) Open(now time.Time) bool {
+	return !now.Before(ch.StartsAt) && now.Before(ch.EndsAt)
+}
+
+// ChallengeEntry is one entry on GET /challenges/:id/entries
+type ChallengeEntry struct {
+	Generation *Generation `json:"generation"`
+	EnteredAt  time.Time   `json:"entered_at"`
+	Votes      *int        `json:"votes,omitempty"` // with ?votes=true
+}
+
+const challengeColumns = `id, theme, to_char(challenge_date, 'YYYY-MM-DD'), starts_at, ends_at, created_at, updated_at`
+
+func scanChallenge(row rowScanner) (*Challenge, error) {
+	var ch Challenge
+	err := row.Scan(&ch.ID, &ch.Theme, &ch.Date, &ch.StartsAt, &ch.EndsAt, &ch.CreatedAt, &ch.UpdatedAt)
+	return &ch, err
+}
+
+// loadChallenge reads tenantID's challenge id; upcoming challenges are sql.ErrNoRows
+// unless admin, so themes aren't out before their day
+func loadChallenge(ctx context.Context, tenantID, id string, admin bool) (*Challenge, error) {
+	ch, err := scanChallenge(db.QueryRowContext(ctx, `
+		SELECT `+challengeColumns+` FROM challenges WHERE id::text = $1 AND tenant_id = $2`, id, tenantID))
+	if err == nil && !admin && clock.Now().Before(ch.StartsAt) {
+		return nil, sql.ErrNoRows
+	}
+	return ch, err
+}
+
+// challengeBody is the JSON of POST /admin/challenges and PATCH /admin/challenges/:id.
+// starts_at defaults to midnight UTC of date and ends_at to a day later
+type challengeBody struct {
+	Theme    *string    `json:"theme"`
+	Date     *string    `json:"date"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+// apply merges body into ch, recomputing the window from a new date unless it is given
+func (body challengeBody) apply(ch *Challenge) (field, msg string) {
+	if body.Theme != nil {
+		ch.Theme = strings.TrimSpace(*body.Theme)
+	}
+	if body.Date != nil {
+		day, err := time.Parse(challengeDate, *body.Date)
+		if err != nil {
+			return "date", "must be YYYY-MM-DD"
+		}
+		ch.Date = *body.Date
+		ch.StartsAt, ch.EndsAt = day, day.Add(24*time.Hour)
+	}
+	if body.StartsAt != nil {
+		ch.StartsAt = *body.StartsAt
+	}
+	if body.EndsAt != nil {
+		ch.EndsAt = *body.EndsAt
+	}
+	switch {
+	case ch.Theme == "" || utf8.RuneCountInString(ch.Theme) > maxChallengeTheme:
+		return "theme", fmt.Sprintf("must be 1 to %d characters", maxChallengeTheme)
+	case ch.Date == "":
+		return "date", "is required"
+	case !ch.EndsAt.After(ch.StartsAt):
+		return "ends_at", "must be after starts_at"
+	}
+	return "", ""
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// createChallengeHandler handles POST /admin/challenges
+func createChallengeHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	var body challengeBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.Theme == nil || body.Date == nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	var ch Challenge
+	if field, msg := body.apply(&ch); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	created, err := scanChallenge(db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO challenges (id, theme, challenge_date, starts_at, ends_at, created_by, tenant_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+challengeColumns, newID(), ch.Theme, ch.Date, ch.StartsAt, ch.EndsAt, admin.ID.String(),
+		currentTenant(c).ID))
+	if isUniqueViolation(err) {
+		respondError(c, codeConflict, "A challenge already exists for that date")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to create challenge: %v", err)
+		respondError(c, codeInternal, "Failed to create challenge")
+		return
+	}
+	log.Printf("🏆 Challenge %s for %s by %s: %s", created.ID, created.Date, admin.ID, created.Theme)
+	c.JSON(http.StatusCreated, created)
+}
+
+// updateChallengeHandler handles PATCH /admin/challenges/:id. Entries already in stay even
+// if the new window wouldn't have taken them
+func updateChallengeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ch, err := loadChallenge(ctx, currentTenant(c).ID, c.Param("id"), true)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load challenge")
+		return
+	}
+	var body challengeBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if field, msg := body.apply(ch); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	updated, err := scanChallenge(db.QueryRowContext(ctx, `
+		UPDATE challenges SET theme = $2, challenge_date = $3, starts_at = $4, ends_at = $5, updated_at = now()
+		WHERE id = $1
+		RETURNING `+challengeColumns, ch.ID, ch.Theme, ch.Date, ch.StartsAt, ch.EndsAt))
+	if isUniqueViolation(err) {
+		respondError(c, codeConflict, "A challenge already exists for that date")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to update challenge %s: %v", ch.ID, err)
+		respondError(c, codeInternal, "Failed to update challenge")
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// deleteChallengeHandler handles DELETE /admin/challenges/:id, taking entries and votes
+// with it; the generations themselves are untouched
+func deleteChallengeHandler(c *gin.Context) {
+	res, err := db.ExecContext(c.Request.Context(), `DELETE FROM challenges WHERE id::text = $1 AND tenant_id = $2`,
+		c.Param("id"), currentTenant(c).ID)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to delete challenge")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// challengesKeyset pages the challenge lists by start time, newest first
+var challengesKeyset = keyset{Scope: "challenges", Columns: []string{"starts_at", "id::text"}, Desc: true, Before: true}
+
+// listChallenges answers GET /challenges (started ones, newest first by start time) and
+// GET /admin/challenges, which includes upcoming ones
+func listChallenges(c *gin.Context, admin bool) {
+	filter := currentTenant(c).ID + "|" + strconv.FormatBool(admin)
+	keys, limit, ok := cursorParams(c, challengesKeyset, filter)
+	if !ok {
+		return
+	}
+	after, keyArgs := challengesKeyset.where(keys, 4)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+challengeColumns+` FROM challenges
+		WHERE ($1 OR starts_at <= now()) AND tenant_id = $3 AND `+after+`
+		ORDER BY `+challengesKeyset.orderBy()+` LIMIT $2`,
+		append([]interface{}{admin, limit, currentTenant(c).ID}, keyArgs...)...)
+	if err != nil {
+		log.Printf("❌ Failed to list challenges: %v", err)
+		respondError(c, codeInternal, "Failed to list challenges")
+		return
+	}
+	defer rows.Close()
+
+	list := []*Challenge{}
+	for rows.Next() {
+		ch, err := scanChallenge(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list challenges")
+			return
+		}
+		list = append(list, ch)
+	}
+	resp := gin.H{"challenges": list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp["next_cursor"] = challengesKeyset.encode(filter, last.StartsAt, last.ID)
+		resp["next_before"] = last.StartsAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// listChallengesHandler handles GET /challenges
+func listChallengesHandler(c *gin.Context) { listChallenges(c, false) }
+
+// adminListChallengesHandler handles GET /admin/challenges
+func adminListChallengesHandler(c *gin.Context) { listChallenges(c, true) }
+
+// getChallengeHandler handles GET /challenges/:id
+func getChallengeHandler(c *gin.Context) {
+	ch, err := loadChallenge(c.Request.Context(), currentTenant(c).ID, c.Param("id"), false)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load challenge")
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// enterChallengeHandler handles POST /challenges/:id/enter with {"request_id": "..."}
+func enterChallengeHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	var body struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.RequestID == "" {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	ch, err := loadChallenge(ctx, currentTenant(c).ID, c.Param("id"), false)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load challenge")
+		return
+	}
+
+	// Every rule is in the statement, so the checks below only explain a refusal
+	var enteredAt time.Time
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO challenge_entries (challenge_id, user_id, request_id)
+		SELECT c.id, $2, generated_content.request_id
+		FROM challenges c, generated_content
+		WHERE c.id = $1 AND now() >= c.starts_at AND now() < c.ends_at
+		  AND generated_content.request_id = $3 AND generated_content.user_id = $2
+		  AND generated_content.created_at >= c.starts_at AND `+challengeEntryVisible+`
+		ON CONFLICT DO NOTHING
+		RETURNING entered_at`, ch.ID, user.ID.String(), body.RequestID).Scan(&enteredAt)
+	if err == nil {
+		log.Printf("🏆 %s entered %s in challenge %s", user.ID, body.RequestID, ch.ID)
+		c.JSON(http.StatusCreated, gin.H{"challenge_id": ch.ID, "request_id": body.RequestID, "entered_at": enteredAt})
+		return
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("❌ Failed to enter %s in challenge %s: %v", body.RequestID, ch.ID, err)
+		respondError(c, codeInternal, "Failed to enter challenge")
+		return
+	}
+
+	if !ch.Open(clock.Now()) {
+		respondError(c, codeConflict, "Challenge is closed")
+		return
+	}
+	var ownerID, status string
+	var createdAt time.Time
+	var trashedAt, expiredAt *time.Time
+	err = db.QueryRowContext(ctx, `
+		SELECT user_id::text, status, created_at, trashed_at, expired_at FROM generated_content WHERE request_id = $1`,
+		body.RequestID).Scan(&ownerID, &status, &createdAt, &trashedAt, &expiredAt)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && ownerID != user.ID.String()):
+		fieldError(c, codeNotFound, "request_id", "generation not found")
+	case err != nil:
+		respondError(c, codeInternal, "Failed to enter challenge")
+	case status != "completed" || trashedAt != nil || expiredAt != nil:
+		fieldError(c, codeValidationFailed, "request_id", "only completed generations can be entered")
+	case createdAt.Before(ch.StartsAt):
+		fieldError(c, codeValidationFailed, "request_id", "generation was created before the challenge started")
+	default:
+		respondError(c, codeConflict, "You have already entered this challenge")
+	}
+}
+
+// withdrawChallengeEntryHandler handles DELETE /challenges/:id/entry, taking the caller's
+// entry and the votes it got off the page
+func withdrawChallengeEntryHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	// The caller's entries are all in their own tenant's challenges
+	res, err := db.ExecContext(c.Request.Context(), `
+		DELETE FROM challenge_entries WHERE challenge_id::text = $1 AND user_id = $2`,
+		c.Param("id"), user.ID.String())
+	if err != nil {
+		respondError(c, codeInternal, "Failed to withdraw entry")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "No entry in this challenge")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// challengeEntriesKeyset pages a challenge's entries, newest first
+var challengeEntriesKeyset = keyset{Scope: "challenge_entries", Columns: []string{"e.entered_at", "e.entry_request_id"},
+	Desc: true, Before: true}
+
+// challengeEntriesHandler handles GET /challenges/:id/entries?votes=true, newest entries
+// first, paged by cursor (or ?before= an entered_at)
+func challengeEntriesHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	ch, err := loadChallenge(ctx, currentTenant(c).ID, c.Param("id"), false)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load entries")
+		return
+	}
+	size, ok := sizeParam(c, renditionThumbnail)
+	if !ok {
+		return
+	}
+	filter := ch.ID
+	keys, limit, ok := cursorParams(c, challengeEntriesKeyset, filter)
+	if !ok {
+		return
+	}
+	withVotes := c.Query("votes") == "true"
+
+	votesColumn := `0`
+	if withVotes {
+		votesColumn = `(SELECT count(*) FROM challenge_votes v
+		                WHERE v.challenge_id = $1 AND v.request_id = generated_content.request_id)`
+	}
+	after, keyArgs := challengeEntriesKeyset.where(keys, 3)
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+generationColumns+`, e.entered_at, `+votesColumn+`
+		FROM generated_content
+		JOIN (SELECT request_id AS entry_request_id, entered_at FROM challenge_entries WHERE challenge_id = $1) e
+		  ON e.entry_request_id = generated_content.request_id
+		WHERE `+after+` AND `+challengeEntryVisible+`
+		ORDER BY `+challengeEntriesKeyset.orderBy()+` LIMIT $2`, append([]interface{}{ch.ID, limit}, keyArgs...)...)
+	if err != nil {
+		log.Printf("❌ Failed to load entries of challenge %s: %v", ch.ID, err)
+		respondError(c, codeInternal, "Failed to load entries")
+		return
+	}
+	defer rows.Close()
+
+	list := []ChallengeEntry{}
+	for rows.Next() {
+		var e ChallengeEntry
+		var votes int
+		g, err := scanGeneration(challengeEntryRow{rows, &e.EnteredAt, &votes})
+		if err != nil {
+			respondError(c, codeInternal, "Failed to load entries")
+			return
+		}
+		g.Tags = nil // private to the owner
+		withGenerationURLs(ctx, g, size)
+		e.Generation = g
+		if withVotes {
+			e.Votes = &votes
+		}
+		list = append(list, e)
+	}
+	resp := gin.H{"entries": list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp["next_cursor"] = challengeEntriesKeyset.encode(filter, last.EnteredAt, last.Generation.RequestID)
+		resp["next_before"] = last.EnteredAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// challengeEntryRow lets scanGeneration read a row with entered_at and votes trailing
+type challengeEntryRow struct {
+	row       rowScanner
+	enteredAt *time.Time
+	votes     *int
+}
+
+func (r challengeEntryRow) Scan(dest ...interface{}) error {
+	return r.row.Scan(append(dest, r.enteredAt, r.votes)...)
+}
+
+// voteChallengeHandler handles POST /challenges/:id/vote with {"request_id": "..."}: one
+// vote per user per challenge, for someone else's entry still on the page
+func voteChallengeHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	var body struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.RequestID == "" {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	ch, err := loadChallenge(ctx, currentTenant(c).ID, c.Param("id"), false)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Challenge not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to save vote")
+		return
+	}
+
+	var entrant string
+	err = db.QueryRowContext(ctx, `
+		SELECT e.user_id::text FROM challenge_entries e
+		JOIN generated_content ON generated_content.request_id = e.request_id
+		WHERE e.challenge_id = $1 AND e.request_id = $2 AND `+challengeEntryVisible,
+		ch.ID, body.RequestID).Scan(&entrant)
+	if err == sql.ErrNoRows {
+		fieldError(c, codeNotFound, "request_id", "entry not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to save vote")
+		return
+	}
+	if entrant == user.ID.String() {
+		respondError(c, codeForbidden, "You can't vote for your own entry")
+		return
+	}
+
+	var votedAt time.Time
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO challenge_votes (challenge_id, user_id, request_id) VALUES ($1, $2, $3)
+		ON CONFLICT (challenge_id, user_id) DO NOTHING
+		RETURNING voted_at`, ch.ID, user.ID.String(), body.RequestID).Scan(&votedAt)
+	if err == sql.ErrNoRows {
+		respondError(c, codeConflict, "You have already voted in this challenge")
+		return
+	}
+	if err != nil {
+		// The entry can be withdrawn between the check and the insert
+		log.Printf("❌ Failed to save vote in challenge %s: %v", ch.ID, err)
+		respondError(c, codeInternal, "Failed to save vote")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"challenge_id": ch.ID, "request_id": body.RequestID, "voted_at": votedAt})
+}
@@ -0,0 +1,109 @@
+//go:build chaos
+
+// chaos.go
+// Fault injection for the completion pipeline, only in binaries built with -tags chaos and
+// only when MOBART_CHAOS is set, e.g.
+//
+//	MOBART_CHAOS="drop=0.05,duplicate=0.1,delay=0.2,delay_max=5s,corrupt=0.02,redis_kill=0.01"
+//
+// Production builds get the no-ops in chaos_off.go instead
+
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaosConfig holds the per-message probability of each fault
+type chaosConfig struct {
+	Drop, Duplicate, Delay, Corrupt, RedisKill float64
+	DelayMax                                   time.Duration
+}
+
+var chaos = parseChaosConfig(os.Getenv("MOBART_CHAOS"))
+
+func parseChaosConfig(spec string) *chaosConfig {
+	if spec == "" {
+		return nil
+	}
+	cfg := &chaosConfig{DelayMax: 5 * time.Second}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		if k == "delay_max" {
+			if d, err := time.ParseDuration(v); err == nil {
+				cfg.DelayMax = d
+			}
+			continue
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("MOBART_CHAOS: bad probability for %s: %q", k, v)
+		}
+		switch k {
+		case "drop":
+			cfg.Drop = p
+		case "duplicate":
+			cfg.Duplicate = p
+		case "delay":
+			cfg.Delay = p
+		case "corrupt":
+			cfg.Corrupt = p
+		case "redis_kill":
+			cfg.RedisKill = p
+		default:
+			log.Fatalf("MOBART_CHAOS: unknown fault %q", k)
+		}
+	}
+	log.Printf("🐒 Chaos injection enabled: %+v", *cfg)
+	return cfg
+}
+
+func (c *chaosConfig) roll(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+// chaosDeliverCompletion hands payload to deliver, possibly dropped, duplicated, delayed
+// (which also reorders it against later messages) or truncated into invalid JSON
+func chaosDeliverCompletion(payload string, deliver func(string)) {
+	if chaos == nil {
+		deliver(payload)
+		return
+	}
+	switch {
+	case chaos.roll(chaos.Drop):
+		log.Printf("🐒 chaos: dropping completion")
+		return
+	case chaos.roll(chaos.Corrupt):
+		log.Printf("🐒 chaos: corrupting completion")
+		payload = payload[:len(payload)/2]
+	}
+	copies := 1
+	if chaos.roll(chaos.Duplicate) {
+		log.Printf("🐒 chaos: duplicating completion")
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		if chaos.roll(chaos.Delay) && chaos.DelayMax > 0 {
+			delay := time.Duration(rand.Int63n(int64(chaos.DelayMax)))
+			log.Printf("🐒 chaos: delaying completion by %s", delay)
+			time.AfterFunc(delay, func() { deliver(payload) })
+			continue
+		}
+		deliver(payload)
+	}
+}
+
+// chaosMaybeKillRedis closes the subscription as if the connection dropped, so the
+// listener exits and its supervisor restarts it (replaying the archive)
+func chaosMaybeKillRedis(conn io.Closer) {
+	if chaos != nil && chaos.roll(chaos.RedisKill) {
+		log.Printf("🐒 chaos: killing the Redis subscription")
+		conn.Close()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !chaos
+
+// chaos_off.go
+// Production stand-ins for the fault injection hooks in chaos.go
+
+package main
+
+import "io"
+
+func chaosDeliverCompletion(payload string, deliver func(string)) { deliver(payload) }
+
+func chaosMaybeKillRedis(io.Closer) {}
@@ -0,0 +1,179 @@
+// clients.go
+// Which app release a request came from. Clients may send X-Client-Platform ("ios",
+// "android", "web") and X-Client-Version ("4.12.0"). Values that are missing or don't fit
+// the patterns are recorded as unknown rather than refused. Both are stored on generation
+// rows and logged with every request. Only the platform becomes a metric label, and only
+// the CLIENT_PLATFORMS ones (anything else is "other"), since versions are unbounded.
+// GET /admin/stats breaks success rates down by platform and lists the busiest versions,
+// and GET /admin/users/:id shows the clients behind a user's recent requests
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const clientUnknown = "unknown"
+
+var (
+	clientPlatforms = strings.Split(getEnv("CLIENT_PLATFORMS", "ios,android,web"), ",")
+
+	clientPlatformPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	clientVersionPattern  = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,31}$`)
+
+	clientRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_client_requests_total",
+		Help: "HTTP requests, by client platform (unknown without a valid X-Client-Platform, other outside CLIENT_PLATFORMS) and status class (2xx, 4xx, 5xx).",
+	}, []string{"platform", "status_class"})
+)
+
+// clientInfo is the client a request says it came from
+type clientInfo struct {
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+}
+
+// requestClient reads the client headers once per request
+func requestClient(c *gin.Context) clientInfo {
+	if v, ok := c.Get("client"); ok {
+		return v.(clientInfo)
+	}
+	ci := clientInfo{Platform: clientUnknown, Version: clientUnknown}
+	if p := strings.ToLower(strings.TrimSpace(c.GetHeader("X-Client-Platform"))); clientPlatformPattern.MatchString(p) {
+		ci.Platform = p
+	}
+	if v := strings.TrimSpace(c.GetHeader("X-Client-Version")); clientVersionPattern.MatchString(v) {
+		ci.Version = v
+	}
+	c.Set("client", ci)
+	return ci
+}
+
+// metricPlatform is the platform as a bounded metric label
+func (ci clientInfo) metricPlatform() string {
+	if ci.Platform == clientUnknown || containsString(clientPlatforms, ci.Platform) {
+		return ci.Platform
+	}
+	return "other"
+}
+
+// countClientRequest counts a finished request against its client's platform
+func countClientRequest(c *gin.Context, status int) {
+	clientRequests.WithLabelValues(requestClient(c).metricPlatform(), strconv.Itoa(status/100)+"xx").Inc()
+}
+
+// recordGenerationClient stamps a row written without newGeneration (text replies)
+func recordGenerationClient(ctx context.Context, requestID string, ci clientInfo) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET client_platform = $2, client_version = $3 WHERE request_id = $1`,
+		requestID, ci.Platform, ci.Version)
+	return err
+}
+
+// PlatformStats is one platform's outcomes in GET /admin/stats
+type PlatformStats struct {
+	Platform    string  `json:"platform"`
+	Total       int64   `json:"total"`
+	Completed   int64   `json:"completed"`
+	Failed      int64   `json:"failed"`
+	SuccessRate float64 `json:"success_rate"` // of finished requests
+}
+
+// ClientVersionStats is one release's volume in GET /admin/stats
+type ClientVersionStats struct {
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	Total    int64  `json:"total"`
+	Failed   int64  `json:"failed"`
+}
+
+// topClientVersions is how many releases GET /admin/stats lists
+const topClientVersions = 10
+
+// queryClientStats breaks the stats window down by platform and by the busiest versions,
+// leaving out the canary
+func queryClientStats(ctx context.Context, tenantID string) ([]PlatformStats, []ClientVersionStats, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT client_platform, count(*),
+		       count(*) FILTER (WHERE status = 'completed'),
+		       count(*) FILTER (WHERE status = 'failed')
+		FROM generated_content
+		WHERE created_at > now() - make_interval(days => $1) AND user_id::text <> $2 AND tenant_id = $3
+		GROUP BY client_platform ORDER BY count(*) DESC, client_platform`, statsWindowDays, canaryUserID, tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+	platforms := []PlatformStats{}
+	for rows.Next() {
+		var p PlatformStats
+		if err := rows.Scan(&p.Platform, &p.Total, &p.Completed, &p.Failed); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if finished := p.Completed + p.Failed; finished > 0 {
+			p.SuccessRate = float64(p.Completed) / float64(finished)
+		}
+		platforms = append(platforms, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT client_platform, client_version, count(*), count(*) FILTER (WHERE status = 'failed')
+		FROM generated_content
+		WHERE created_at > now() - make_interval(days => $1) AND user_id::text <> $2 AND tenant_id = $4
+		GROUP BY client_platform, client_version ORDER BY count(*) DESC, client_platform, client_version
+		LIMIT $3`, statsWindowDays, canaryUserID, topClientVersions, tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	versions := []ClientVersionStats{}
+	for rows.Next() {
+		var v ClientVersionStats
+		if err := rows.Scan(&v.Platform, &v.Version, &v.Total, &v.Failed); err != nil {
+			return nil, nil, err
+		}
+		versions = append(versions, v)
+	}
+	return platforms, versions, rows.Err()
+}
+
+// UserClient is one client behind a user's recent requests
+type UserClient struct {
+	clientInfo
+	Requests int64     `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// recentUserClients groups userID's last 100 requests by client, most recently seen first
+func recentUserClients(ctx context.Context, userID string) ([]UserClient, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT client_platform, client_version, count(*), max(created_at)
+		FROM (SELECT client_platform, client_version, created_at FROM generated_content
+		      WHERE user_id = $1 ORDER BY created_at DESC LIMIT 100) recent
+		GROUP BY client_platform, client_version ORDER BY max(created_at) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []UserClient{}
+	for rows.Next() {
+		var uc UserClient
+		if err := rows.Scan(&uc.Platform, &uc.Version, &uc.Requests, &uc.LastSeen); err != nil {
+			return nil, err
+		}
+		clients = append(clients, uc)
+	}
+	return clients, rows.Err()
+}
@@ -0,0 +1,40 @@
+// clock.go
+// Where time-dependent code gets the time and new IDs from. The sweeper, scheduler,
+// admission and ETA code read clock instead of calling time.Now(), and request IDs come
+// from idGen, so a test can swap in the fakes from ./clocktest and step through
+// deadlines, windows and scheduled runs without sleeping. Tickers still run on real
+// time: a fake clock decides what is due, not when the loops wake up
+
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator hands out new IDs
+type IDGenerator interface {
+	NewID() uuid.UUID
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+type randomIDs struct{}
+
+func (randomIDs) NewID() uuid.UUID { return uuid.New() }
+
+var (
+	clock Clock       = systemClock{}
+	idGen IDGenerator = randomIDs{}
+)
+
+// newID is idGen's next ID as a string, the form most callers store
+func newID() string { return idGen.NewID().String() }
@@ -0,0 +1,458 @@
+// Command fakeworker stands in for the Python GPU worker (src/worker.py) so the backend can
+// be exercised end to end on a laptop. It answers generation requests after a simulated
+// duration with a processing ack, progress, a placeholder image and a completion (or a
+// failure at -failure-rate), heartbeats every model it serves with the jobs it's running,
+// and obeys drain/resume and abandon. With -rate it also publishes synthetic requests, as
+// a load generator for the listener and DB path.
+//
+//	go run ./cmd/fakeworker -storage local -duration 2s
+//	go run ./cmd/fakeworker -rate 50 -concurrency 64 -duration 0 -upload=false
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+)
+
+// Placeholders stay small; the backend never looks past the header for sizing
+const maxPlaceholderSide = 1024
+
+var (
+	redisAddr         = flag.String("redis", env("REDIS_ADDR", "localhost:6379"), "Redis address")
+	channels          = flag.String("channels", "image_generation_requests,video_generation_requests,image_generation_requests_low", "request channels to answer; video_* channels get video completions")
+	completionChannel = flag.String("completion-channel", env("COMPLETION_CHANNEL", "image_generation_complete"), "channel completions are published on")
+	heartbeatChannel  = flag.String("heartbeat-channel", env("WORKER_HEARTBEAT_CHANNEL", "worker_heartbeats"), "channel heartbeats are published on")
+	controlChannel    = flag.String("control-channel", env("WORKER_CONTROL_CHANNEL", "worker_control"), "channel drain/resume commands arrive on")
+	workerID          = flag.String("worker-id", env("WORKER_ID", "fakeworker-"+hostname()), "worker_id reported in every message")
+	models            = flag.String("models", "stable-image-ultra,animatediff", "models to heartbeat; requests for other models are answered anyway")
+	concurrency       = flag.Int("concurrency", 4, "jobs run at once, reported as max_concurrent")
+	duration          = flag.Duration("duration", 3*time.Second, "simulated generation time per job")
+	jitter            = flag.Float64("jitter", 0.3, "random spread of -duration, as a fraction")
+	progressSteps     = flag.Int("progress-steps", 4, "progress messages per job (0 for none)")
+	failureRate       = flag.Float64("failure-rate", 0, "fraction of jobs answered with a failure")
+	failureCode       = flag.String("failure-code", "unknown", "error_code of -failure-rate failures, e.g. oom to exercise automatic retries")
+	heartbeatEvery    = flag.Duration("heartbeat-interval", 10*time.Second, "heartbeat period; match the backend's WORKER_HEARTBEAT_INTERVAL")
+	storageKind       = flag.String("storage", "s3", "where placeholders go: s3 (S3_BUCKET_NAME, AWS_* env, AWS_ENDPOINT_URL for MinIO) or local")
+	localDir          = flag.String("local-dir", "fakeworker-assets", "directory for -storage local")
+	upload            = flag.Bool("upload", true, "upload placeholders; off, completions name keys that don't exist")
+	archiveMaxLen     = flag.Int64("archive-maxlen", 10000, "approximate cap of the completion archive stream")
+	compressOver      = flag.Int("compress-over", 0, "gzip-wrap completions larger than this many bytes, like MESSAGE_COMPRESSION (0 never)")
+	schemaVersion     = flag.Int("schema-version", 1, "object field names in completions: 1 s3_key/s3_url like the Python worker, 2 both, 3 object_key/object_url (see MESSAGE_SCHEMA_VERSION)")
+
+	rate        = flag.Float64("rate", 0, "publish this many synthetic requests per second on the first channel")
+	loadFor     = flag.Duration("load-for", time.Minute, "how long -rate publishes for")
+	databaseURL = flag.String("database-url", env("DATABASE_URL", ""), "with -rate, insert a queued row per synthetic request so completions take the full DB path")
+	loadUser    = flag.String("load-user", "", "user_id of synthetic requests (must exist when rows are inserted)")
+)
+
+// isVideoChannel reports a video_* channel, a partner tenant's "<id>:video_*" included
+func isVideoChannel(channel string) bool {
+	if _, base, ok := strings.Cut(channel, ":"); ok {
+		channel = base
+	}
+	return strings.HasPrefix(channel, "video_")
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+// worker is the running fake
+type worker struct {
+	rdb    *redis.Client
+	store  placeholderStore
+	slots  chan struct{}
+	jobs   sync.WaitGroup
+	load   atomic.Int64
+	drain  atomic.Bool
+	pubsub *redis.PubSub
+	// running maps each job's request_id to its cancel, for abandon
+	running sync.Map
+
+	published, completed, failed atomic.Int64
+}
+
+func main() {
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := &worker{
+		rdb:   redis.NewClient(&redis.Options{Addr: *redisAddr}),
+		slots: make(chan struct{}, max(*concurrency, 1)),
+	}
+	if err := w.rdb.Ping(ctx).Err(); err != nil {
+		log.Fatalf("❌ Redis at %s: %v", *redisAddr, err)
+	}
+	if *upload {
+		store, err := newPlaceholderStore(ctx)
+		if err != nil {
+			log.Fatalf("❌ Storage: %v", err)
+		}
+		w.store = store
+	}
+
+	requestChannels := strings.Split(*channels, ",")
+	w.pubsub = w.rdb.Subscribe(ctx, append([]string{*controlChannel}, requestChannels...)...)
+	defer w.pubsub.Close()
+	log.Printf("🤖 Fake worker %s answering %s (%s ± %.0f%%, %.0f%% failures)",
+		*workerID, *channels, *duration, *jitter*100, *failureRate*100)
+
+	go w.heartbeats(ctx)
+	go w.report(ctx)
+	if *rate > 0 {
+		go w.generateLoad(ctx, requestChannels[0])
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("👋 Shutting down; waiting for running jobs")
+			w.jobs.Wait()
+			return
+		case msg, ok := <-w.pubsub.Channel():
+			if !ok {
+				return
+			}
+			if msg.Channel == *controlChannel {
+				w.handleControl(ctx, msg.Payload, requestChannels)
+				continue
+			}
+			var r request
+			if err := json.Unmarshal(unwrap([]byte(msg.Payload)), &r); err != nil || r.RequestID == "" {
+				log.Printf("⚠️ Ignoring malformed request on %s: %v", msg.Channel, err)
+				continue
+			}
+			w.slots <- struct{}{} // backpressure, like a worker at its concurrency
+			w.jobs.Add(1)
+			go func(video bool) {
+				defer func() { <-w.slots; w.jobs.Done() }()
+				jobCtx, cancel := context.WithCancel(ctx)
+				w.running.Store(r.RequestID, cancel)
+				defer func() { w.running.Delete(r.RequestID); cancel() }()
+				w.run(jobCtx, r, video)
+			}(isVideoChannel(msg.Channel))
+		}
+	}
+}
+
+// handleControl drains by unsubscribing from the request channels, as src/worker.py does
+func (w *worker) handleControl(ctx context.Context, payload string, requestChannels []string) {
+	var c control
+	if json.Unmarshal([]byte(payload), &c) != nil || c.WorkerID != *workerID {
+		return
+	}
+	switch {
+	case c.Action == "drain" && !w.drain.Load():
+		w.drain.Store(true)
+		w.pubsub.Unsubscribe(ctx, requestChannels...)
+		log.Printf("🚰 Draining (%s)", c.Reason)
+	case c.Action == "resume" && w.drain.Load():
+		w.drain.Store(false)
+		w.pubsub.Subscribe(ctx, requestChannels...)
+		log.Println("▶️ Resumed")
+	case c.Action == "abandon":
+		if cancel, ok := w.running.Load(c.RequestID); ok {
+			cancel.(context.CancelFunc)()
+			log.Printf("🪦 Abandoned %s (%s)", c.RequestID, c.Reason)
+		}
+	}
+	w.heartbeat(ctx)
+}
+
+// run answers one request: progress, then a placeholder and a completion, or a failure
+func (w *worker) run(ctx context.Context, r request, video bool) {
+	w.load.Add(1)
+	defer w.load.Add(-1)
+
+	if r.Deadline != nil && r.Deadline.Before(time.Now()) {
+		log.Printf("⌛ Skipping %s: deadline passed", r.RequestID)
+		return
+	}
+	w.publish(ctx, processingMessage(r, *workerID))
+	start := time.Now()
+	total := time.Duration(float64(*duration) * (1 + *jitter*(2*rand.Float64()-1)))
+	steps := max(*progressSteps, 0)
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(total / time.Duration(steps+1)):
+		}
+		w.publish(ctx, progressMessage(r, *workerID, float64(100*i/(steps+1))))
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(total - time.Since(start)):
+	}
+
+	if rand.Float64() < *failureRate {
+		w.failed.Add(1)
+		w.publish(ctx, failedMessage(r, *workerID, "simulated failure", *failureCode))
+		return
+	}
+
+	key := fmt.Sprintf("%sgenerated/%s/%s.png", r.StoragePrefix, r.UserID, r.RequestID)
+	posterKey := ""
+	if video {
+		posterKey = key
+		key = fmt.Sprintf("%sgenerated/%s/%s.mp4", r.StoragePrefix, r.UserID, r.RequestID)
+	}
+	url := ""
+	if w.store != nil {
+		var err error
+		if url, err = w.uploadPlaceholder(ctx, r, key, posterKey); err != nil {
+			w.failed.Add(1)
+			w.publish(ctx, failedMessage(r, *workerID, "upload failed: "+err.Error(), "unknown"))
+			return
+		}
+	}
+	w.completed.Add(1)
+	w.publish(ctx, completedMessage(r, *workerID, key, url, posterKey, time.Since(start).Seconds()))
+}
+
+// uploadPlaceholder stores a PNG for the image (or poster), and for video the same bytes
+// under the .mp4 key: enough for downloads to stream, not a playable file
+func (w *worker) uploadPlaceholder(ctx context.Context, r request, key, posterKey string) (string, error) {
+	side := r.Resolution
+	if side <= 0 {
+		side = 512
+	}
+	if r.MaxSide > 0 {
+		side = min(side, r.MaxSide)
+	}
+	data := placeholderPNG(r.RequestID, min(side, maxPlaceholderSide))
+	if posterKey != "" {
+		if _, err := w.store.Put(ctx, posterKey, data, "image/png"); err != nil {
+			return "", err
+		}
+		return w.store.Put(ctx, key, data, "video/mp4")
+	}
+	return w.store.Put(ctx, key, data, "image/png")
+}
+
+// publish archives the completion first, so the live message can carry its stream ID
+func (w *worker) publish(ctx context.Context, c completion) {
+	data, _ := json.Marshal(c)
+	id, err := w.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: *completionChannel + ":archive", MaxLen: *archiveMaxLen, Approx: true,
+		Values: map[string]interface{}{"payload": string(wrap(data))},
+	}).Result()
+	if err == nil {
+		c.ArchiveID = id
+		data, _ = json.Marshal(c)
+	} else {
+		log.Printf("⚠️ Failed to archive completion, publishing anyway: %v", err)
+	}
+	if err := w.rdb.Publish(ctx, *completionChannel, wrap(data)).Err(); err != nil {
+		log.Printf("❌ Failed to publish %s for %s: %v", c.Status, c.RequestID, err)
+	}
+}
+
+func (w *worker) heartbeats(ctx context.Context) {
+	ticker := time.NewTicker(*heartbeatEvery)
+	defer ticker.Stop()
+	for {
+		w.heartbeat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *worker) heartbeat(ctx context.Context) {
+	var running []string
+	w.running.Range(func(id, _ interface{}) bool {
+		running = append(running, id.(string))
+		return true
+	})
+	sort.Strings(running)
+	for _, model := range strings.Split(*models, ",") {
+		data, _ := json.Marshal(heartbeat{WorkerID: *workerID, Model: model, MaxConcurrent: *concurrency,
+			CurrentLoad: int(w.load.Load()), Draining: w.drain.Load(), RequestIDs: running})
+		w.rdb.Publish(ctx, *heartbeatChannel, data)
+	}
+}
+
+// report logs throughput every 10s, which is what -rate runs are read by
+func (w *worker) report(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		done := w.completed.Load() + w.failed.Load()
+		log.Printf("📊 published %d, completed %d, failed %d, running %d, %.1f answers/s",
+			w.published.Load(), w.completed.Load(), w.failed.Load(), w.load.Load(), float64(done-last)/10)
+		last = done
+	}
+}
+
+// generateLoad publishes synthetic requests at -rate for -load-for. With a database the
+// row is inserted first, as POST /generations would, so each completion is a real
+// versioned update rather than a lookup of a missing row
+func (w *worker) generateLoad(ctx context.Context, channel string) {
+	var pg *sql.DB
+	if *databaseURL != "" {
+		if *loadUser == "" {
+			log.Fatal("❌ -load-user is required to insert rows")
+		}
+		var err error
+		if pg, err = sql.Open("postgres", *databaseURL); err != nil {
+			log.Fatalf("❌ Database: %v", err)
+		}
+		defer pg.Close()
+	}
+	userID := *loadUser
+	if userID == "" {
+		userID = uuid.New().String()
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	stopAt := time.After(*loadFor)
+	log.Printf("🚀 Publishing %.1f requests/s on %s for %s", *rate, channel, *loadFor)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopAt:
+			log.Printf("🏁 Load run finished after %d requests", w.published.Load())
+			return
+		case <-ticker.C:
+		}
+		r := request{RequestID: uuid.New().String(), UserID: userID, Prompt: "fakeworker load test",
+			Model: strings.Split(*models, ",")[0]}
+		if pg != nil {
+			_, err := pg.ExecContext(ctx, `
+				INSERT INTO generated_content
+					(request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+				VALUES ($1, $2, now(), 'image', '', $3, $3, $4, 'queued')`, r.RequestID, r.UserID, r.Prompt, r.Model)
+			if err != nil {
+				log.Printf("❌ Failed to insert load row: %v", err)
+				continue
+			}
+		}
+		data, _ := json.Marshal(r)
+		if err := w.rdb.Publish(ctx, channel, data).Err(); err == nil {
+			w.published.Add(1)
+		}
+	}
+}
+
+// placeholderPNG is a gradient tinted by the request ID, so different requests are
+// visibly different in a gallery
+func placeholderPNG(requestID string, side int) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	seed := h.Sum32()
+	tint := color.RGBA{R: uint8(seed), G: uint8(seed >> 8), B: uint8(seed >> 16), A: 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8((int(tint.R) + x*255/side) / 2),
+				G: uint8((int(tint.G) + y*255/side) / 2),
+				B: tint.B, A: 255,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// placeholderStore is where placeholders go; Put returns the URL reported as s3_url
+type placeholderStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) (url string, err error)
+}
+
+func newPlaceholderStore(ctx context.Context) (placeholderStore, error) {
+	switch *storageKind {
+	case "local":
+		return localStore{dir: *localDir}, nil
+	case "s3":
+		region := env("AWS_REGION", "us-west-2")
+		cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{client: s3.NewFromConfig(cfg), bucket: env("S3_BUCKET_NAME", "mobiarty-assets"), region: region}, nil
+	}
+	return nil, fmt.Errorf("unknown -storage %q", *storageKind)
+}
+
+type localStore struct{ dir string }
+
+func (s localStore) Put(_ context.Context, key string, data []byte, _ string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(path)
+	return "file://" + abs, nil
+}
+
+type s3Store struct {
+	client         *s3.Client
+	bucket, region string
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key), nil
+}
@@ -0,0 +1,135 @@
+// messages.go
+// The worker side of the message contract, mirroring src/messages.py. messages_test.go
+// compares these against testdata/contracts so the fake can't drift from the real worker
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// request is what the backend publishes; only the fields the fake acts on
+type request struct {
+	RequestID  string     `json:"request_id"`
+	UserID     string     `json:"user_id"`
+	Prompt     string     `json:"prompt"`
+	Model      string     `json:"model"`
+	Resolution int        `json:"resolution"`
+	MaxSide    int        `json:"max_side"`
+	Deadline   *time.Time `json:"deadline"`
+	// StoragePrefix is the tenant's, for a partner tenant's requests
+	StoragePrefix string `json:"storage_prefix"`
+	// LeaseToken is echoed on every message about the job, so stale results are fenced
+	LeaseToken int64 `json:"lease_token"`
+}
+
+type completion struct {
+	RequestID             string  `json:"request_id"`
+	UserID                string  `json:"user_id"`
+	Status                string  `json:"status"`
+	S3Key                 string  `json:"s3_key,omitempty"`
+	S3URL                 string  `json:"s3_url,omitempty"`
+	ObjectKey             string  `json:"object_key,omitempty"`
+	ObjectURL             string  `json:"object_url,omitempty"`
+	PosterKey             string  `json:"poster_key,omitempty"`
+	Progress              float64 `json:"progress,omitempty"`
+	GenerationTimeSeconds float64 `json:"generation_time_seconds,omitempty"`
+	GPUSeconds            float64 `json:"gpu_seconds,omitempty"`
+	Error                 string  `json:"error,omitempty"`
+	ErrorCode             string  `json:"error_code,omitempty"`
+	StartedAt             string  `json:"started_at,omitempty"`
+	LeaseToken            int64   `json:"lease_token,omitempty"`
+	WorkerID              string  `json:"worker_id"`
+	Timestamp             string  `json:"timestamp"`
+	ArchiveID             string  `json:"archive_id,omitempty"`
+}
+
+type heartbeat struct {
+	WorkerID      string `json:"worker_id"`
+	Model         string `json:"model"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	CurrentLoad   int    `json:"current_load"`
+	Draining      bool   `json:"draining,omitempty"`
+	// RequestIDs are the running jobs, so each heartbeat renews their leases
+	RequestIDs []string `json:"request_ids,omitempty"`
+}
+
+type control struct {
+	WorkerID  string `json:"worker_id"`
+	Action    string `json:"action"` // "drain", "resume" or "abandon"
+	RequestID string `json:"request_id"`
+	Reason    string `json:"reason"`
+}
+
+// envelope is the backend's wrapper for compressed messages (compression.go)
+type envelope struct {
+	Encoding string `json:"encoding"`
+	Data     []byte `json:"data"`
+}
+
+// unwrap returns the JSON inside a gzip envelope, or data when it isn't one
+func unwrap(data []byte) []byte {
+	var e envelope
+	if json.Unmarshal(data, &e) != nil || e.Encoding != "gzip" {
+		return data
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(e.Data))
+	if err != nil {
+		return data
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return data
+	}
+	return raw
+}
+
+// wrap gzips data into an envelope when it is over -compress-over
+func wrap(data []byte) []byte {
+	if *compressOver <= 0 || len(data) <= *compressOver {
+		return data
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	wrapped, _ := json.Marshal(envelope{Encoding: "gzip", Data: buf.Bytes()})
+	return wrapped
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// completedMessage names the object under the field names -schema-version picks
+func completedMessage(r request, workerID, key, url, posterKey string, seconds float64) completion {
+	c := completion{RequestID: r.RequestID, UserID: r.UserID, Status: "completed", PosterKey: posterKey,
+		GenerationTimeSeconds: seconds, GPUSeconds: seconds, LeaseToken: r.LeaseToken, WorkerID: workerID, Timestamp: now()}
+	if *schemaVersion < 3 {
+		c.S3Key, c.S3URL = key, url
+	}
+	if *schemaVersion > 1 {
+		c.ObjectKey, c.ObjectURL = key, url
+	}
+	return c
+}
+
+func failedMessage(r request, workerID, reason, code string) completion {
+	return completion{RequestID: r.RequestID, UserID: r.UserID, Status: "failed", Error: reason, ErrorCode: code,
+		LeaseToken: r.LeaseToken, WorkerID: workerID, Timestamp: now()}
+}
+
+// processingMessage is the pick-up ack, which starts the job's lease
+func processingMessage(r request, workerID string) completion {
+	return completion{RequestID: r.RequestID, UserID: r.UserID, Status: "processing", StartedAt: now(),
+		LeaseToken: r.LeaseToken, WorkerID: workerID, Timestamp: now()}
+}
+
+func progressMessage(r request, workerID string, percent float64) completion {
+	return completion{RequestID: r.RequestID, UserID: r.UserID, Status: "progress", Progress: percent,
+		LeaseToken: r.LeaseToken, WorkerID: workerID, Timestamp: now()}
+}
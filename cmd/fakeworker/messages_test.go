@@ -0,0 +1,57 @@
+// messages_test.go
+// Each message the fake publishes must carry exactly the keys of its golden copy in
+// testdata/contracts
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Image completions carry no poster_key, so it's dropped before comparing, the way the
+// real worker never sends it for images. The goldens have the real worker's field names,
+// so a -schema-version ahead of it fails
+func TestMessagesMatchContracts(t *testing.T) {
+	r := request{RequestID: "r", UserID: "u", LeaseToken: 7}
+	samples := map[string]interface{}{
+		"completion_completed":  completedMessage(r, "w", "k", "https://x/k", "", 1.5),
+		"completion_failed":     failedMessage(r, "w", "boom", "input_url_expired"),
+		"completion_progress":   progressMessage(r, "w", 40),
+		"completion_processing": processingMessage(r, "w"),
+		"worker_heartbeat": heartbeat{WorkerID: "w", Model: "m", MaxConcurrent: 1, CurrentLoad: 1, Draining: true,
+			RequestIDs: []string{"r"}},
+	}
+	for name, msg := range samples {
+		fixture, err := os.ReadFile(filepath.Join("..", "..", "testdata", "contracts", name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := keysOf(fixture)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data, _ := json.Marshal(msg)
+		got, _ := keysOf(data)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: fake worker sends %v, contract has %v", name, got, want)
+		}
+	}
+}
+
+func keysOf(data []byte) ([]string, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
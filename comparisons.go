@@ -0,0 +1,374 @@
+// comparisons.go
+// A/B generations: one prompt sent to two models with the same seed, shown side by side
+// and voted on, with the votes rolled up into per-pair win rates
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Vote values; a and b refer to the models in the order they were requested
+const (
+	voteA   = "a"
+	voteB   = "b"
+	voteTie = "tie"
+)
+
+// comparePayload is the body of POST /generations/compare: the image fields of
+// RequestPayload plus the two models
+type comparePayload struct {
+	RequestPayload
+	Models []string `json:"models"`
+}
+
+// Comparison is GET /comparisons/:id
+type Comparison struct {
+	ID        string      `json:"id"`
+	Status    string      `json:"status"` // pending, completed, partial (one side failed) or failed
+	ModelA    string      `json:"model_a"`
+	ModelB    string      `json:"model_b"`
+	Seed      int64       `json:"seed"`
+	A         *Generation `json:"a"`
+	B         *Generation `json:"b"`
+	Vote      string      `json:"vote,omitempty"`
+	VotedAt   *time.Time  `json:"voted_at,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+
+	requestA, requestB string
+}
+
+// comparisonStatus combines the two sides; partial means exactly one side produced an image
+func comparisonStatus(a, b string) string {
+	inFlight := func(s string) bool {
+		return s == "queued" || s == "processing" || s == "deferred" || s == generationPendingModeration
+	}
+	switch {
+	case inFlight(a) || inFlight(b):
+		return "pending"
+	case a == "completed" && b == "completed":
+		return "completed"
+	case a == "completed" || b == "completed":
+		return "partial"
+	}
+	return "failed"
+}
+
+// compareGenerationsHandler handles POST /generations/compare. Both requests are charged
+// together and admitted together, so a comparison is never left half-queued by limits
+func compareGenerationsHandler(c *gin.Context) {
+	var body comparePayload
+	if err := c.ShouldBindJSON(&body); err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, codeRequestTooLarge, "Request body too large")
+			return
+		}
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	text, err := sanitizePrompt(body.Text)
+	if err != nil {
+		recordRejectedPrompt(c)
+		code, _ := errorCodeFor(err)
+		fieldError(c, code, "text", err.Error())
+		return
+	}
+	req := body.RequestPayload
+	req.Text, req.RequestType = text, "image"
+	// One notify mode for both sides
+	var ok bool
+	if req.Notify, ok = notifyMode(req.Notify); !ok {
+		fieldError(c, codeValidationFailed, "notify", "must be all, failures_only or none")
+		return
+	}
+	if len(body.Models) != 2 || body.Models[0] == body.Models[1] {
+		fieldError(c, codeValidationFailed, "models", "must name two different models")
+		return
+	}
+	if req.MaxWaitSeconds != 0 {
+		fieldError(c, codeValidationFailed, "max_wait_seconds", "is not supported for comparisons")
+		return
+	}
+
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	limits := userPlanLimits(ctx, user.ID.String())
+
+	var specs [2]generationSpec
+	var quotes [2]Quote
+	var requested [2]int
+	for i, model := range body.Models {
+		req.Model = model
+		if specs[i], err = generationSpecFor("image", req); err != nil {
+			respondError(c, codeValidationFailed, err.Error())
+			return
+		}
+		if requested[i], ok = enforceResolutionCap(c, &specs[i], limits, req.AutoDownscale); !ok {
+			return
+		}
+		if quotes[i] = quoteGeneration(ctx, specs[i], limits); len(quotes[i].Problems) > 0 {
+			respondErrorDetails(c, codeForbidden, quotes[i].Problems[0],
+				gin.H{"model": model, "plan": limits.Plan, "problems": quotes[i].Problems})
+			return
+		}
+		if refuseRetiredModel(c, model) {
+			return
+		}
+		if modelRefused(ctx, model) {
+			respondError(c, codeModelUnavailable, "Image generation with "+model+" is temporarily unavailable")
+			return
+		}
+	}
+	if !checkGenerationRequest(c, user.ID.String(), req, specs[0]) {
+		return
+	}
+
+	ids := [2]string{newID(), newID()}
+	for i, id := range ids {
+		decision, err := tryAdmit(ctx, user.ID.String(), specs[0].Kind, id)
+		if err == nil && decision.Admitted {
+			continue
+		}
+		for _, admitted := range ids[:i] {
+			releaseAdmission(ctx, user.ID.String(), admitted)
+		}
+		if err != nil {
+			log.Printf("❌ Admission check failed: %v", err)
+			respondError(c, codeInternal, "Failed to queue comparison")
+			return
+		}
+		admissionDecisions.WithLabelValues("rejected", decision.Bucket).Inc()
+		respondErrorDetails(c, codeRateLimited, "A comparison needs room for two generations", admissionDetails(decision))
+		return
+	}
+	unadmit := func() {
+		releaseAdmission(ctx, user.ID.String(), ids[0], ids[1])
+	}
+
+	held := inputAwaitingModeration(ctx, req.InputKey)
+	comparisonID := newID()
+	seed := rand.Int63n(1 << 32)
+	prompt := processPrompt(ctx, user.ID.String(), req.Text)
+	var rows [2]newGeneration
+	for i := range rows {
+		rows[i] = newGeneration{
+			RequestID:           ids[i],
+			UserID:              user.ID.String(),
+			Tenant:              currentTenant(c).ID,
+			OriginalPrompt:      req.Text,
+			Prompt:              prompt,
+			Model:               specs[i].Model,
+			ContentType:         "image",
+			Status:              "queued",
+			OrgID:               req.OrgID,
+			Credits:             quotes[i].Credits,
+			Resolution:          quotes[i].Resolution,
+			RequestedResolution: requested[i],
+			Steps:               quotes[i].Steps,
+			NumImages:           quotes[i].NumImages,
+			Seed:                seed,
+			Comparison:          comparisonID,
+			MaxSide:             limits.MaxImageSide,
+			InputKey:            req.InputKey,
+			Notify:              req.Notify,
+			Client:              requestClient(c),
+		}
+		if held {
+			rows[i].Status = generationPendingModeration
+		}
+	}
+
+	if err := chargeCreditsBatch(ctx, user.ID.String(), req.OrgID, []creditCharge{
+		{RequestID: ids[0], Amount: rows[0].Credits}, {RequestID: ids[1], Amount: rows[1].Credits},
+	}); err != nil {
+		unadmit()
+		respondChargeError(c, err, specs[0].Kind, rows[0].Credits+rows[1].Credits, "Failed to queue comparison")
+		return
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO comparisons (id, user_id, model_a, model_b, request_a, request_b, seed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		comparisonID, user.ID.String(), specs[0].Model, specs[1].Model, ids[0], ids[1], seed)
+	if err != nil {
+		log.Printf("❌ Failed to store comparison: %v", err)
+		respondError(c, codeInternal, "Failed to queue comparison")
+		return
+	}
+
+	recordPromptSignal(ctx, user.ID.String(), req.Text)
+
+	// From here each side lives or fails on its own, which is what partial is for
+	sides := make([]ComparisonSideResponse, 0, 2)
+	for i, row := range rows {
+		side := ComparisonSideResponse{Model: row.Model, GenerationRequestID: row.RequestID, Credits: row.Credits, Status: row.Status,
+			Deprecation: acceptModelRequest(c, row.Model)}
+		err := createGeneration(ctx, row)
+		if err == nil && !held {
+			err = publishGenerationRequest(row.channel(), row.request())
+			if err != nil {
+				markGenerationFailed(ctx, row.RequestID, row.UserID, "publish failed: "+err.Error())
+			}
+		}
+		if err != nil {
+			log.Printf("❌ Failed to queue side %d of comparison %s: %v", i, comparisonID, err)
+			side.Status = "failed"
+		} else {
+			admissionDecisions.WithLabelValues("admitted", row.ContentType).Inc()
+		}
+		sides = append(sides, side)
+	}
+
+	c.JSON(http.StatusAccepted, QueuedComparisonResponse{
+		Type:         "comparison",
+		ComparisonID: comparisonID,
+		Seed:         seed,
+		Credits:      rows[0].Credits + rows[1].Credits,
+		Generations:  sides,
+		Message:      "Comparison queued. Check GET /comparisons/" + comparisonID + " for both results.",
+	})
+}
+
+// loadComparison reads userID's comparison with both sides
+func loadComparison(c *gin.Context, id, userID string) (*Comparison, error) {
+	ctx := c.Request.Context()
+	cmp := &Comparison{ID: id}
+	var vote sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT model_a, model_b, request_a, request_b, seed, vote, voted_at, created_at
+		FROM comparisons WHERE id = $1 AND user_id = $2`, id, userID).Scan(
+		&cmp.ModelA, &cmp.ModelB, &cmp.requestA, &cmp.requestB, &cmp.Seed, &vote, &cmp.VotedAt, &cmp.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	cmp.Vote = vote.String
+
+	// A side whose row was never created (or has been purged) counts as failed
+	statuses := [2]string{"failed", "failed"}
+	for i, requestID := range []string{cmp.requestA, cmp.requestB} {
+		g, err := getGeneration(ctx, requestID, userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		withGenerationURLs(ctx, g, renditionWeb)
+		statuses[i] = g.Status
+		if i == 0 {
+			cmp.A = g
+		} else {
+			cmp.B = g
+		}
+	}
+	cmp.Status = comparisonStatus(statuses[0], statuses[1])
+	return cmp, nil
+}
+
+// getComparisonHandler handles GET /comparisons/:id
+func getComparisonHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	cmp, err := loadComparison(c, c.Param("id"), user.ID.String())
+	if err != nil {
+		respondTypedError(c, err, "Failed to load comparison")
+		return
+	}
+	c.JSON(http.StatusOK, cmp)
+}
+
+// voteComparisonHandler handles POST /comparisons/:id/vote with {"winner": "a"|"b"|"tie"};
+// the winner may also be given by model name. Voting again replaces the vote
+func voteComparisonHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Winner string `json:"winner"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	cmp, err := loadComparison(c, c.Param("id"), user.ID.String())
+	if err != nil {
+		respondTypedError(c, err, "Failed to save vote")
+		return
+	}
+	vote := body.Winner
+	switch vote {
+	case cmp.ModelA:
+		vote = voteA
+	case cmp.ModelB:
+		vote = voteB
+	case voteA, voteB, voteTie:
+	default:
+		fieldError(c, codeValidationFailed, "winner", "must be a, b, tie or one of the two models")
+		return
+	}
+	if cmp.Status != "completed" {
+		respondErrorDetails(c, codeConflict, "Both results must be complete before voting", gin.H{"status": cmp.Status})
+		return
+	}
+
+	err = db.QueryRowContext(c.Request.Context(), `
+		UPDATE comparisons SET vote = $1, voted_at = now() WHERE id = $2 RETURNING voted_at`,
+		vote, cmp.ID).Scan(&cmp.VotedAt)
+	if err != nil {
+		log.Printf("❌ Failed to save vote on comparison %s: %v", cmp.ID, err)
+		respondError(c, codeInternal, "Failed to save vote")
+		return
+	}
+	cmp.Vote = vote
+	c.JSON(http.StatusOK, cmp)
+}
+
+// adminComparisonsHandler handles GET /admin/comparisons: votes per model pair, whichever
+// side each model was on
+func adminComparisonsHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), `
+		WITH votes AS (
+			SELECT least(model_a, model_b) AS m1, greatest(model_a, model_b) AS m2,
+			       CASE vote WHEN 'a' THEN model_a WHEN 'b' THEN model_b END AS winner
+			FROM comparisons WHERE vote IS NOT NULL
+		)
+		SELECT m1, m2, count(*), count(*) FILTER (WHERE winner = m1), count(*) FILTER (WHERE winner = m2),
+		       count(*) FILTER (WHERE winner IS NULL)
+		FROM votes GROUP BY m1, m2 ORDER BY count(*) DESC, m1, m2`)
+	if err != nil {
+		log.Printf("❌ Failed to load comparison votes: %v", err)
+		respondError(c, codeInternal, "Failed to load comparisons")
+		return
+	}
+	defer rows.Close()
+
+	type pairReport struct {
+		ModelA   string  `json:"model_a"`
+		ModelB   string  `json:"model_b"`
+		Votes    int     `json:"votes"`
+		WinsA    int     `json:"wins_a"`
+		WinsB    int     `json:"wins_b"`
+		Ties     int     `json:"ties"`
+		WinRateA float64 `json:"win_rate_a"` // of all votes, ties included
+		WinRateB float64 `json:"win_rate_b"`
+	}
+	pairs := []pairReport{}
+	for rows.Next() {
+		var p pairReport
+		if err := rows.Scan(&p.ModelA, &p.ModelB, &p.Votes, &p.WinsA, &p.WinsB, &p.Ties); err != nil {
+			respondError(c, codeInternal, "Failed to load comparisons")
+			return
+		}
+		p.WinRateA = float64(p.WinsA) / float64(p.Votes)
+		p.WinRateB = float64(p.WinsB) / float64(p.Votes)
+		pairs = append(pairs, p)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(c, codeInternal, "Failed to load comparisons")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pairs": pairs})
+}
@@ -0,0 +1,161 @@
+// completion_archive.go
+// Replay of completions published while the listener was down, from the capped
+// archive stream the Python app XADDs to alongside each pub/sub publish. Each tenant's
+// workers have their own stream, with its own offset
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	completionArchiveStream    = "image_generation_complete:archive"
+	completionArchiveOffsetKey = "image_generation_complete:archive:offset"
+	completionArchiveBatch     = 100
+)
+
+// advanceOffsetScript only ever moves the stored offset forward, so a slow
+// instance can't rewind it and cause a second replay of applied entries
+var advanceOffsetScript = redis.NewScript(`
+local function parse(id)
+	local ms, seq = string.match(id, '^(%d+)-(%d+)$')
+	return tonumber(ms), tonumber(seq)
+end
+local cur = redis.call('GET', KEYS[1])
+if cur then
+	local cms, cseq = parse(cur)
+	local nms, nseq = parse(ARGV[1])
+	if nms < cms or (nms == cms and nseq <= cseq) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1`)
+
+func commitArchiveOffset(ctx context.Context, tenantID, id string) {
+	if err := advanceOffsetScript.Run(ctx, rdb, []string{tenantKey(tenantID, completionArchiveOffsetKey)}, id).Err(); err != nil {
+		log.Printf("⚠️ Failed to persist archive offset %s of tenant %s: %v", id, tenantID, err)
+	}
+}
+
+// replayCompletionArchive replays every tenant's archive
+func replayCompletionArchive(ctx context.Context) error {
+	for _, t := range allTenants() {
+		if err := replayTenantArchive(ctx, t.ID); err != nil {
+			return fmt.Errorf("tenant %s: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
+// replayTenantArchive applies every archived completion after the stored offset,
+// one at a time and in order, committing the offset after each apply. A crash between
+// apply and commit re-applies that one entry on the next start, which the completion
+// updates tolerate.
+func replayTenantArchive(ctx context.Context, tenantID string) error {
+	stream := tenantKey(tenantID, completionArchiveStream)
+	offset, err := rdb.Get(ctx, tenantKey(tenantID, completionArchiveOffsetKey)).Result()
+	if err == redis.Nil {
+		// First start with the archive: begin from now rather than replaying the whole cap
+		last, err := rdb.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil || len(last) == 0 {
+			return err
+		}
+		commitArchiveOffset(ctx, tenantID, last[0].ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for {
+		entries, err := rdb.XRangeN(ctx, stream, "("+offset, "+", completionArchiveBatch).Result()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			payload, _ := e.Values["payload"].(string)
+			var completion ImageGenerationCompletion
+			if err := decodeWorkerMessage("completion", []byte(payload), &completion); err != nil {
+				log.Printf("❌ Skipping unparseable archive entry %s: %v", e.ID, err)
+				deadLetter(ctx, tenantKey(tenantID, completionChannel), payload, decodeErrorClass(err), "", err)
+			} else {
+				completion.Tenant = tenantID
+				applyCompletion("archive_replay", completion)
+			}
+			commitArchiveOffset(ctx, tenantID, e.ID)
+			offset = e.ID
+			replayed++
+		}
+		if len(entries) < completionArchiveBatch {
+			break
+		}
+	}
+
+	if replayed > 0 {
+		log.Printf("⏪ Replayed %d archived completions of tenant %s", replayed, tenantID)
+	}
+	return nil
+}
+
+// archiveTracker commits live offsets only across a contiguous run of finished
+// entries, since the worker pool can finish them out of order
+type archiveTracker struct {
+	tenantID string
+	mu       sync.Mutex
+	pending  []string
+	done     map[string]bool
+}
+
+// liveArchives has a tracker per tenant, the streams' entry IDs being unrelated
+var liveArchives = newArchiveTrackers()
+
+func newArchiveTrackers() map[string]*archiveTracker {
+	trackers := map[string]*archiveTracker{}
+	for _, t := range allTenants() {
+		trackers[t.ID] = &archiveTracker{tenantID: t.ID, done: make(map[string]bool)}
+	}
+	return trackers
+}
+
+// liveArchive is the tracker of the stream a completion came from
+func liveArchive(tenantID string) *archiveTracker {
+	return liveArchives[tenantOrDefault(tenantID)]
+}
+
+// track registers an entry in arrival order; call before handing it to a worker
+func (t *archiveTracker) track(id string) {
+	if t == nil || id == "" {
+		return
+	}
+	t.mu.Lock()
+	t.pending = append(t.pending, id)
+	t.mu.Unlock()
+}
+
+// finish marks an entry applied and commits the highest contiguous offset
+func (t *archiveTracker) finish(ctx context.Context, id string) {
+	if t == nil || id == "" {
+		return
+	}
+	t.mu.Lock()
+	t.done[id] = true
+	commit := ""
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		commit = t.pending[0]
+		delete(t.done, commit)
+		t.pending = t.pending[1:]
+	}
+	t.mu.Unlock()
+
+	if commit != "" {
+		commitArchiveOffset(ctx, t.tenantID, commit)
+	}
+}
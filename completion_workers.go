@@ -0,0 +1,248 @@
+// completion_workers.go
+// Worker pool that applies completion messages off the listener goroutine
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+var completionQueue = make(chan ImageGenerationCompletion, getEnvInt("COMPLETION_QUEUE_SIZE", 256))
+
+// startCompletionWorkers launches n goroutines draining completionQueue
+func startCompletionWorkers(n int) {
+	log.Printf("👷 Starting %d completion workers", n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for completion := range completionQueue {
+				applyCompletion("completion_worker", completion)
+				liveArchive(completion.Tenant).finish(context.Background(), completion.ArchiveID)
+			}
+		}()
+	}
+}
+
+// countCompletion counts a completion once, however many attempts applying it takes
+func countCompletion(completion ImageGenerationCompletion) {
+	completionsReceived.WithLabelValues(completion.Status).Inc()
+	if completion.Status != "progress" && completion.Status != "processing" {
+		requestFlow.add(0, 1)
+	}
+}
+
+// handleCompletion applies a single completion message to the database. An error means
+// the message wasn't applied and should be retried or dead-lettered (see dlq.go). It may
+// run any number of times for one message: each side effect fires once, on whichever run
+// gets to it first (see processed_effects.go), and fx reports what this run did
+func handleCompletion(completion ImageGenerationCompletion) (fx *completionEffects, err error) {
+	fx = newCompletionEffects(completion.RequestID)
+	return fx, applyCompletionEffects(completion, fx)
+}
+
+func applyCompletionEffects(completion ImageGenerationCompletion, fx *completionEffects) error {
+	ctx := context.Background()
+	// A tenant's workers only ever report on its own rows and objects
+	if completionCrossesTenant(ctx, completion) {
+		return nil
+	}
+	if completion.Status == "progress" {
+		handleProgress(completion)
+		return nil
+	}
+	if completion.Status == "processing" {
+		return handleProcessingAck(completion)
+	}
+	// The lease holder's result wins over one from a worker that lost the job to it
+	if leaseFences(ctx, completion.RequestID, completion.WorkerID, completion.LeaseToken) {
+		return nil
+	}
+
+	if err := recordWorkerUsage(ctx, completion.RequestID, completion.WorkerID, completion.GPUSeconds); err != nil {
+		log.Printf("⚠️ Failed to record usage for request %s: %v", completion.RequestID, err)
+	}
+	// Everything below acts for the row's owner, whatever user the message names. The
+	// owner may also have been disabled or deleted since the request was published
+	ownerID, owner := completionAccountState(ctx, completion.RequestID)
+	if ownerID == "" {
+		var err error
+		if ownerID, err = requestOwner(ctx, completion.RequestID); err != nil {
+			return err
+		}
+		if ownerID == "" {
+			log.Printf("🔁 Ignoring %s completion for unknown request %s", completion.Status, completion.RequestID)
+			return nil
+		}
+	}
+	noteCompletionOwner(completion, ownerID)
+	if owner == accountDeleted {
+		return discardDeletedCompletion(ctx, ownerID, completion)
+	}
+
+	switch completion.Status {
+	case "completed":
+		// Update your database with the S3 URL
+		applied, contentType, err := UpdateGeneratedContentWithImage(fx, completion.RequestID, ownerID, completion.S3Key, completion.S3URL, completion.GenerationTimeSeconds)
+		if err != nil {
+			log.Printf("❌ Failed to update database: %v", err)
+			return err
+		}
+		listenerActivity.dbUpdated()
+		late := false
+		if !applied {
+			// A disable's cancel won the race; nothing will reference the result
+			if owner != accountActive && generationCancelled(ctx, completion.RequestID) {
+				removeCompletionObject(ctx, completion)
+				log.Printf("🔁 Ignoring completion for cancelled request %s", completion.RequestID)
+				return nil
+			}
+			// An earlier run stored the result; finish whatever effects it didn't get to
+			var status string
+			if contentType, status, late, err = recordedResult(ctx, completion.RequestID); err != nil {
+				return err
+			}
+			if status != "completed" && !late {
+				log.Printf("🔁 Ignoring repeated completion for request %s", completion.RequestID)
+				return nil
+			}
+			fx.note(effectResult, false)
+			log.Printf("🔁 Repeated completion for request %s, finishing its effects", completion.RequestID)
+		}
+		if k, ok := generationKind(contentType); ok && k.ApplyCompleted != nil {
+			fx.run(ctx, effectDetails, func(*sql.Tx) error { return k.ApplyCompleted(ctx, completion) })
+		}
+		rdb.Del(ctx, progressKey(completion.RequestID))
+		releaseLease(ctx, completion.RequestID)
+		resetFailureStreaks(ctx, completion.RequestID, ownerID)
+		fx.run(ctx, effectSLO, func(*sql.Tx) error { recordSLOCompletion(ctx, completion.RequestID); return nil })
+		log.Printf("✅ Updated database for request %s", completion.RequestID)
+		fx.run(ctx, effectEmbedding, func(tx *sql.Tx) error { return enqueueEmbedding(ctx, tx, completion.RequestID) })
+		invalidatePromptSuggestions(ctx, ownerID)
+
+		// Watermark/metadata never blocks or fails the generation itself
+		fx.run(ctx, effectPostprocess, func(*sql.Tx) error {
+			runPostprocess(ctx, completion.RequestID, completion.S3Key)
+			return nil
+		})
+		recordGenerationStorage(ctx, completion.RequestID)
+
+		if owner == accountDisabled {
+			log.Printf("🔕 Stored result %s of a disabled account without notifying", completion.RequestID)
+			return nil
+		}
+		// Past its deadline the request was already refunded and reported as timed out;
+		// the result waits for its owner to claim it
+		if late || generationLate(ctx, completion.RequestID) {
+			log.Printf("⌛ Stored late result for request %s", completion.RequestID)
+			fx.run(ctx, effectLateEvent, func(*sql.Tx) error {
+				publishLocalEvent(inAppEvent(ctx, Event{Type: eventLateResult, RequestID: completion.RequestID, UserID: ownerID}))
+				return nil
+			})
+			fx.run(ctx, effectLateNotification, func(tx *sql.Tx) error { notifyLateResult(ctx, tx, completion.RequestID); return nil })
+			return nil
+		}
+		fx.run(ctx, effectEvent, func(*sql.Tx) error {
+			publishLocalEvent(inAppEvent(ctx, Event{Type: eventCompleted, RequestID: completion.RequestID, UserID: ownerID}))
+			return nil
+		})
+		fx.run(ctx, effectNotification, func(tx *sql.Tx) error { notifyCompletion(ctx, tx, completion.RequestID); return nil })
+		fx.run(ctx, effectReferral, func(*sql.Tx) error { qualifyReferral(ctx, completion.RequestID); return nil })
+	case "failed":
+		// Transient failures and lapsed input URLs are worth another try, unless the
+		// owner's requests keep failing anyway (see failure_storms.go). A replayed failure
+		// doesn't send the request round again
+		code := classifyWorkerError(completion.ErrorCode, completion.Error)
+		if retry := workerErrors[code].Retry; retry != retryNever && !failureStormActive(ctx, ownerID, "") {
+			sent, err := retryFailure(ctx, fx, completion, retry, code)
+			if err != nil || sent {
+				return err
+			}
+		}
+		// Handle failure
+		log.Printf("❌ Generation failed for request %s (%s): %s", completion.RequestID, code, completion.Error)
+		applied, err := markWorkerFailure(ctx, fx, completion.RequestID, ownerID, code, completion.Error)
+		if err != nil {
+			log.Printf("❌ Failed to mark request %s as failed: %v", completion.RequestID, err)
+			return err
+		}
+		listenerActivity.dbUpdated()
+		releaseLease(ctx, completion.RequestID)
+		if !applied {
+			_, status, _, err := recordedResult(ctx, completion.RequestID)
+			if err != nil {
+				return err
+			}
+			if status != "failed" {
+				log.Printf("🔁 Ignoring failure for finished request %s", completion.RequestID)
+				return nil
+			}
+			fx.note(effectResult, false)
+			log.Printf("🔁 Repeated failure for request %s, finishing its effects", completion.RequestID)
+		}
+		fx.run(ctx, effectFailureStats, func(*sql.Tx) error {
+			recordGenerationFailure(ctx, completion.RequestID, ownerID)
+			recordSLOFailure()
+			return nil
+		})
+		if owner == accountDisabled {
+			return nil
+		}
+		data := map[string]interface{}{"error": workerErrorMessage(code), "error_code": code}
+		if model, err := generationModel(ctx, completion.RequestID); err == nil &&
+			failureStormActive(ctx, ownerID, model) {
+			data["hint"] = failureStormHint
+		}
+		fx.run(ctx, effectEvent, func(*sql.Tx) error {
+			publishLocalEvent(inAppEvent(ctx, Event{Type: eventFailed, RequestID: completion.RequestID,
+				UserID: ownerID, Data: data}))
+			return nil
+		})
+		fx.run(ctx, effectNotification, func(tx *sql.Tx) error { notifyCompletion(ctx, tx, completion.RequestID); return nil })
+	}
+	return nil
+}
+
+// retryFailure sends a failed request round again, once per failure message: a replay of
+// a failure that was retried stops here too. sent is false when the failure stands
+func retryFailure(ctx context.Context, fx *completionEffects, completion ImageGenerationCompletion, retry, code string) (sent bool, err error) {
+	effect := effectRetry + ":" + completion.Timestamp
+	claimed, err := claimEffect(ctx, db, completion.RequestID, effect)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		fx.note(effect, false)
+		return true, nil
+	}
+	if retry == retryFreshInput && republishExpiredInput(ctx, completion.RequestID) ||
+		retry == retryTransient && republishAfterWorkerError(ctx, completion.RequestID, code) {
+		fx.note(effect, true)
+		return true, nil
+	}
+	_, err = db.ExecContext(ctx, `DELETE FROM processed_effects WHERE request_id = $1 AND effect_type = $2`,
+		completion.RequestID, effect)
+	return false, err
+}
+
+// handleProgress records a progress report, renews the worker's lease and tells the
+// request's owner. Progress is best effort: when the owner can't be looked up the event
+// is skipped, since an event without a user would go to everyone
+func handleProgress(completion ImageGenerationCompletion) {
+	ctx := context.Background()
+	recordProgress(ctx, completion.RequestID, completion.Progress)
+	if workerLeases && completion.WorkerID != "" {
+		if _, err := renewLease(ctx, completion.RequestID, completion.WorkerID); err != nil {
+			log.Printf("⚠️ Failed to renew worker %s's lease on %s: %v", completion.WorkerID, completion.RequestID, err)
+		}
+	}
+	ownerID, err := requestOwner(ctx, completion.RequestID)
+	if err != nil {
+		log.Printf("⚠️ Failed to look up the owner of %s for its progress: %v", completion.RequestID, err)
+	}
+	if ownerID == "" {
+		return
+	}
+	publishLocalEvent(Event{Type: eventProgress, RequestID: completion.RequestID, UserID: ownerID,
+		Data: map[string]interface{}{"progress": completion.Progress}})
+}
@@ -0,0 +1,100 @@
+// compression.go
+// Optional gzip for large Redis messages. A payload over the threshold goes out as
+// {"encoding":"gzip","data":"<base64>"}; incoming messages in that wrapper are unpacked
+// before decoding, and plain JSON is passed through, so workers can adopt it one at a time
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const encodingGzip = "gzip"
+
+var (
+	// Outgoing only: off by default until every worker reads the wrapper. Incoming
+	// wrappers are always accepted
+	messageCompression          = getEnvBool("MESSAGE_COMPRESSION", false)
+	messageCompressionThreshold = getEnvInt("MESSAGE_COMPRESSION_THRESHOLD", 16*1024) // bytes of JSON
+	// Cap on an unpacked message, so a small wrapper can't inflate without bound
+	maxDecompressedBytes = getEnvInt("MAX_DECOMPRESSED_MESSAGE_BYTES", 8<<20)
+
+	compressedMessageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_compressed_message_bytes_total",
+		Help: "Bytes of gzip-wrapped Redis messages, by direction (in, out) and size (raw, compressed).",
+	}, []string{"direction", "size"})
+	compressedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_compressed_messages_total",
+		Help: "Gzip-wrapped Redis messages, by direction (in, out).",
+	}, []string{"direction"})
+)
+
+// errCorruptCompressed marks a wrapper that didn't unpack; such completions are dead
+// lettered as dlqDecompress rather than dlqDecode
+var errCorruptCompressed = errors.New("corrupt compressed message")
+
+// messageEnvelope is the wrapper around a compressed payload; Data is base64 in JSON
+type messageEnvelope struct {
+	Encoding string `json:"encoding"`
+	Data     []byte `json:"data"`
+}
+
+// compressMessage wraps data when compression is on and data is over the threshold.
+// Payloads gzip doesn't shrink go out as they are
+func compressMessage(data []byte) []byte {
+	if !messageCompression || len(data) <= messageCompressionThreshold {
+		return data
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if zw.Close() != nil {
+		return data
+	}
+	wrapped, err := json.Marshal(messageEnvelope{Encoding: encodingGzip, Data: buf.Bytes()})
+	if err != nil || len(wrapped) >= len(data) {
+		return data
+	}
+	compressedMessages.WithLabelValues("out").Inc()
+	compressedMessageBytes.WithLabelValues("out", "raw").Add(float64(len(data)))
+	compressedMessageBytes.WithLabelValues("out", "compressed").Add(float64(len(wrapped)))
+	return wrapped
+}
+
+// decompressMessage returns the JSON inside a wrapper, or data itself when it isn't one.
+// Errors wrap errCorruptCompressed
+func decompressMessage(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(`"encoding"`)) {
+		return data, nil
+	}
+	var env messageEnvelope
+	if json.Unmarshal(data, &env) != nil || env.Encoding == "" {
+		return data, nil // not a wrapper; the caller's decode reports bad JSON
+	}
+	if env.Encoding != encodingGzip {
+		return nil, fmt.Errorf("%w: unknown encoding %q", errCorruptCompressed, env.Encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(env.Data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptCompressed, err)
+	}
+	raw, err := io.ReadAll(io.LimitReader(zr, int64(maxDecompressedBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptCompressed, err)
+	}
+	if len(raw) > maxDecompressedBytes {
+		return nil, fmt.Errorf("%w: over %d bytes unpacked", errCorruptCompressed, maxDecompressedBytes)
+	}
+	compressedMessages.WithLabelValues("in").Inc()
+	compressedMessageBytes.WithLabelValues("in", "raw").Add(float64(len(raw)))
+	compressedMessageBytes.WithLabelValues("in", "compressed").Add(float64(len(data)))
+	return raw, nil
+}
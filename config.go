@@ -0,0 +1,50 @@
+// config.go
+// Environment-based settings for the Go side of the integration, mirroring src/config.py
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnv returns the value of key or fallback when it is unset
+func getEnv(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvInt parses key as an int, falling back on missing or invalid values
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// getEnvFloat parses key as a float64, falling back on missing or invalid values
+func getEnvFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// getEnvBool parses key as a bool, falling back on missing or invalid values
+func getEnvBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// getEnvDuration parses key as a time.Duration ("30s", "10m"), falling back on missing or invalid values
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,114 @@
+// contracts.go
+// The JSON contract with the Python worker: decoding that notices fields we don't know
+// (a renamed key otherwise decodes as a silent zero). contracts_test.go checks our structs
+// against the golden messages in testdata/contracts
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// STRICT_WORKER_DECODE=false turns the unknown-field accounting off
+var strictWorkerDecode = getEnvBool("STRICT_WORKER_DECODE", true)
+
+var workerUnknownFields = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_worker_unknown_fields_total",
+	Help: "Worker messages carrying a field our structs don't map, by message kind and field.",
+}, []string{"message", "field"})
+
+// Field names come from the worker, so only the first few distinct ones get their own label
+const maxUnknownFieldLabels = 50
+
+var (
+	unknownFieldsMu   sync.Mutex
+	unknownFieldsSeen = map[string]bool{}
+	jsonFieldsCache   sync.Map // reflect.Type -> map[string]bool
+)
+
+// jsonFields is the set of top-level JSON keys t decodes
+func jsonFields(t reflect.Type) map[string]bool {
+	if v, ok := jsonFieldsCache.Load(t); ok {
+		return v.(map[string]bool)
+	}
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = true
+	}
+	jsonFieldsCache.Store(t, fields)
+	return fields
+}
+
+// unknownFields lists the keys of a JSON object that v's struct type has no field for
+func unknownFields(data []byte, v interface{}) []string {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(data, &keys) != nil {
+		return nil
+	}
+	known := jsonFields(reflect.TypeOf(v).Elem())
+	var unknown []string
+	for k := range keys {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// decodeWorkerMessage unpacks a compressed message (see compression.go) and unmarshals it
+// as usual; in strict mode it also counts and logs (once per field) any key the struct
+// would silently drop. Completions also have their use of renamed fields counted
+// (field_renames.go)
+func decodeWorkerMessage(kind string, data []byte, v interface{}) error {
+	data, err := decompressMessage(data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	if c, ok := v.(*ImageGenerationCompletion); ok {
+		noteFieldNames(kind, c)
+	}
+	if !strictWorkerDecode {
+		return nil
+	}
+	for _, field := range unknownFields(data, v) {
+		unknownFieldsMu.Lock()
+		seen := unknownFieldsSeen[kind+"."+field]
+		label := field
+		if !seen && len(unknownFieldsSeen) < maxUnknownFieldLabels {
+			unknownFieldsSeen[kind+"."+field] = true
+		} else if !seen {
+			label = "other"
+		}
+		unknownFieldsMu.Unlock()
+
+		workerUnknownFields.WithLabelValues(kind, label).Inc()
+		if !seen {
+			log.Printf("⚠️ %s message has unknown field %q (check the worker's JSON keys): %s", kind, field,
+				redactPromptFields(string(data)))
+		}
+	}
+	return nil
+}
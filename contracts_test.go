@@ -0,0 +1,259 @@
+// contracts_test.go
+// Our structs against the golden worker messages in testdata/contracts, and the API's
+// response shapes (responses.go) against the golden bodies in testdata/contracts/responses,
+// so a renamed field fails until its fixture is updated on purpose
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const contractsDir = "testdata/contracts"
+
+// contractFixtures maps each golden file to the struct it must decode into
+var contractFixtures = map[string]func() interface{}{
+	"completion_completed.json":  func() interface{} { return &ImageGenerationCompletion{} },
+	"completion_renamed.json":    func() interface{} { return &ImageGenerationCompletion{} },
+	"completion_failed.json":     func() interface{} { return &ImageGenerationCompletion{} },
+	"completion_progress.json":   func() interface{} { return &ImageGenerationCompletion{} },
+	"completion_processing.json": func() interface{} { return &ImageGenerationCompletion{} },
+	"worker_heartbeat.json":      func() interface{} { return &WorkerHeartbeat{} },
+	"generation_request.json":    func() interface{} { return &ImageGenerationRequest{} },
+}
+
+// checkFixture decodes a golden message and requires every key in it to be known and
+// to land as a non-zero value
+func checkFixture(data []byte, v interface{}) []string {
+	var problems []string
+	for _, f := range unknownFields(data, v) {
+		problems = append(problems, fmt.Sprintf("unknown field %q", f))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return append(problems, err.Error())
+	}
+	var keys map[string]json.RawMessage
+	json.Unmarshal(data, &keys)
+
+	rv := reflect.ValueOf(v).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		name, _, _ := strings.Cut(rv.Type().Field(i).Tag.Get("json"), ",")
+		if _, ok := keys[name]; ok && rv.Field(i).IsZero() {
+			problems = append(problems, fmt.Sprintf("%s decoded as zero", name))
+		}
+	}
+	return problems
+}
+
+// checkPublishedRoundTrip marshals what a fully populated row publishes and requires it to
+// decode back unchanged, with exactly the keys of the golden request. Every key the request
+// struct can carry must be in the golden file too, so a new field fails until it's added
+func checkPublishedRoundTrip(golden []byte) []string {
+	deadline := time.Date(2025, 8, 10, 19, 30, 0, 0, time.UTC)
+	expires := deadline.Add(-time.Minute)
+	g := newGeneration{
+		RequestID: "req", UserID: "user", Tenant: "partner", Prompt: "prompt", Model: "model",
+		DurationSeconds: 2, FPS: 8, Resolution: 1024, Steps: 30, NumImages: 2, Seed: 42, Comparison: "cmp",
+		Deadline: &deadline, MaxSide: 2048, InputKey: "uploads/user/in.png",
+	}
+	sent := g.request()
+	// Filled in by publishGenerationRequest (signInputURL, issueLeaseToken)
+	sent.InputURL, sent.InputURLExpiresAt, sent.LeaseToken = "https://example.com/in.png", &expires, 7
+	data, err := json.Marshal(sent)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	var got ImageGenerationRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		return []string{err.Error()}
+	}
+	want := sent
+	want.InputKey = "" // never leaves the backend
+	if !reflect.DeepEqual(want, got) {
+		problems = append(problems, fmt.Sprintf("round trip changed the request: %+v -> %+v", want, got))
+	}
+
+	var sentKeys, goldenKeys map[string]json.RawMessage
+	json.Unmarshal(data, &sentKeys)
+	json.Unmarshal(golden, &goldenKeys)
+	for k := range sentKeys {
+		if _, ok := goldenKeys[k]; !ok {
+			problems = append(problems, fmt.Sprintf("we publish %q but generation_request.json lacks it", k))
+		}
+	}
+	for k := range goldenKeys {
+		if _, ok := sentKeys[k]; !ok {
+			problems = append(problems, fmt.Sprintf("generation_request.json has %q but we never publish it", k))
+		}
+	}
+	for k := range jsonFields(reflect.TypeOf(sent)) {
+		if _, ok := goldenKeys[k]; !ok && sentKeys[k] == nil {
+			problems = append(problems, fmt.Sprintf("requests can carry %q but generation_request.json lacks it", k))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// responseFixtures are sample bodies of the API's response shapes; each must marshal to
+// exactly its golden file in the responses directory
+func responseFixtures() map[string]interface{} {
+	at := time.Date(2025, 8, 10, 19, 30, 0, 0, time.UTC)
+	eta := at.Add(2 * time.Minute)
+	completed := at.Add(40 * time.Second)
+	generation := &Generation{
+		RequestID: "3f6c1b9e-8d2a-4c41-9a57-1b2c3d4e5f60", Status: "completed", ContentType: "image",
+		OriginalPrompt: "ein Leuchtturm in der Dämmerung", Prompt: "a lighthouse at dusk, pixel art", Model: "sdxl",
+		ContentURL: "generated/3f6c1b9e-8d2a-4c41-9a57-1b2c3d4e5f60.png", CreatedAt: at, CompletedAt: &completed,
+		Tags: []string{"sprites"}, Notify: notifyAll, UpdatedAt: completed,
+		URL: "https://cdn.example.com/generated/3f6c1b9e.png?sig=abc", ThumbnailURL: "https://cdn.example.com/thumbs/3f6c1b9e.webp?sig=abc",
+		Size: "web", Width: 1024, Height: 1024,
+	}
+	// /v2 adds the rendition links and, on GET /generations/:id, the timeline as a regular
+	// user sees it (api_versions.go), and wraps errors
+	published, pickedUp := at.Add(time.Second), at.Add(3*time.Second)
+	queueWait, generationSeconds := 3.0, 37.0
+	v2 := *generation
+	v2.Timings = &GenerationTimings{
+		CreatedAt: at, PublishedAt: &published, PickedUpAt: &pickedUp, CompletedAt: &completed,
+		QueueWaitSeconds: &queueWait, GenerationSeconds: &generationSeconds,
+	}
+	v2.RenditionLinks = []RenditionLink{
+		{Kind: renditionWeb, URL: v2.URL, Width: 1024, Height: 1024, Bytes: 183402},
+		{Kind: renditionThumbnail, URL: v2.ThumbnailURL, Width: 256, Height: 256, Bytes: 9120},
+	}
+	v2Listed := *generation
+	v2Listed.RenditionLinks = v2.RenditionLinks
+	notFound := ErrorEnvelope{Code: codeNotFound, Message: "Generation not found", RequestID: "b7e1c2d3-4f5a-4b6c-9d8e-7f6a5b4c3d2e"}
+	return map[string]interface{}{
+		"error.json":         errorBody(apiV1, notFound),
+		"v2/error.json":      errorBody(apiV2, notFound),
+		"v2/generation.json": &v2,
+		"v2/generation_list.json": GenerationListResponse{
+			Generations: []*Generation{&v2Listed}, NextCursor: "AWTd1R4Kq0kGAnQYc6vG8dnrAHNkM2Y2YzFiOWUt",
+			NextBefore: at.Format(time.RFC3339Nano),
+		},
+		"generation.json": generation,
+		"generation_queued.json": QueuedGenerationResponse{
+			Type: "image", Status: "queued", GenerationRequestID: generation.RequestID, Credits: 4,
+			EstimatedSeconds: 12.5, ETA: &eta, Message: "Image generation queued. You'll receive a notification when complete.",
+			Resolution: 1024, RequestedResolution: 2048,
+		},
+		"generation_deferred.json": QueuedGenerationResponse{
+			Type: "video", Status: "deferred", GenerationRequestID: generation.RequestID, Credits: 20, ETA: &eta,
+			Message: "You're over your current limit, so this generation will start automatically around the ETA.",
+		},
+		"generation_text.json": CompletedTextResponse{
+			Type: "text", Status: "completed", GenerationRequestID: generation.RequestID,
+			Data: "A lighthouse stands on the cliff.", ConversationID: "7d1e2f3a-4b5c-4d6e-8f90-a1b2c3d4e5f6",
+		},
+		"comparison_queued.json": QueuedComparisonResponse{
+			Type: "comparison", ComparisonID: "9b8a7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d", Seed: 1234567, Credits: 8,
+			Generations: []ComparisonSideResponse{
+				{Model: "sdxl", GenerationRequestID: generation.RequestID, Credits: 4, Status: "queued"},
+				{Model: "stable-image-ultra", GenerationRequestID: "5a4b3c2d-1e0f-4a9b-8c7d-6e5f4a3b2c1d", Credits: 4, Status: "failed"},
+			},
+			Message: "Comparison queued. Check GET /comparisons/9b8a7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d for both results.",
+		},
+		"generation_claimed.json": GenerationStatusResponse{RequestID: generation.RequestID, Status: "completed", CreditsCharged: 4},
+		"generation_trashed.json": TrashStateResponse{RequestID: generation.RequestID, Trashed: true, PurgeAfter: &eta},
+		"generation_list.json": GenerationListResponse{
+			Generations: []*Generation{generation}, NextCursor: "AWTd1R4Kq0kGAnQYc6vG8dnrAHNkM2Y2YzFiOWUt",
+			NextBefore: at.Format(time.RFC3339Nano),
+		},
+		"generations_similar.json": SimilarGenerationsResponse{
+			Generations: []SimilarGeneration{{Generation: generation, Similarity: 0.93}},
+		},
+	}
+}
+
+// diffJSON describes where got and want, both decoded JSON, differ
+func diffJSON(path string, got, want interface{}) []string {
+	gotMap, gotIsMap := got.(map[string]interface{})
+	wantMap, wantIsMap := want.(map[string]interface{})
+	if gotIsMap && wantIsMap {
+		var problems []string
+		for k, v := range gotMap {
+			if w, ok := wantMap[k]; !ok {
+				problems = append(problems, fmt.Sprintf("%s%s is sent but not in the golden body", path, k))
+			} else {
+				problems = append(problems, diffJSON(path+k+".", v, w)...)
+			}
+		}
+		for k := range wantMap {
+			if _, ok := gotMap[k]; !ok {
+				problems = append(problems, fmt.Sprintf("%s%s is in the golden body but never sent", path, k))
+			}
+		}
+		sort.Strings(problems)
+		return problems
+	}
+	gotList, gotIsList := got.([]interface{})
+	wantList, wantIsList := want.([]interface{})
+	if gotIsList && wantIsList && len(gotList) == len(wantList) {
+		var problems []string
+		for i := range gotList {
+			problems = append(problems, diffJSON(fmt.Sprintf("%s%d.", path, i), gotList[i], wantList[i])...)
+		}
+		return problems
+	}
+	if !reflect.DeepEqual(got, want) {
+		return []string{fmt.Sprintf("%s is %v, the golden body has %v", strings.TrimSuffix(path, "."), got, want)}
+	}
+	return nil
+}
+
+// checkResponseShape marshals a sample response and compares it with its golden body
+func checkResponseShape(golden []byte, sample interface{}) []string {
+	data, err := json.Marshal(sample)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var got, want interface{}
+	json.Unmarshal(data, &got)
+	if err := json.Unmarshal(golden, &want); err != nil {
+		return []string{err.Error()}
+	}
+	return diffJSON("", got, want)
+}
+
+func TestWorkerMessageContracts(t *testing.T) {
+	for name, newValue := range contractFixtures {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(contractsDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems := checkFixture(data, newValue())
+			if name == "generation_request.json" {
+				problems = append(problems, checkPublishedRoundTrip(data)...)
+			}
+			for _, p := range problems {
+				t.Error(p)
+			}
+		})
+	}
+}
+
+func TestResponseShapes(t *testing.T) {
+	for name, sample := range responseFixtures() {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join(contractsDir, "responses", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range checkResponseShape(data, sample) {
+				t.Error(p)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// conversations.go
+// Conversation history for text requests, so follow-ups can refer to earlier turns
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	conversationTitleMaxRunes = 80
+
+	// textGenerationChannel carries text requests, history and all, to text workers
+	textGenerationChannel = "text_generation_requests"
+)
+
+var (
+	conversationMaxTurns    = getEnvInt("CONVERSATION_MAX_TURNS", 20)
+	conversationTokenBudget = getEnvInt("CONVERSATION_TOKEN_BUDGET", 3000)
+)
+
+var errConversationNotFound = errors.New("conversation not found")
+
+// ChatMessage is one turn of a conversation
+type ChatMessage struct {
+	Role    string `json:"role"` // "user" or "assistant"
+	Content string `json:"content"`
+}
+
+// TextGenerationRequest is what the text generator receives, history included
+type TextGenerationRequest struct {
+	RequestID      string        `json:"request_id"`
+	UserID         string        `json:"user_id"`
+	ConversationID string        `json:"conversation_id"`
+	Messages       []ChatMessage `json:"messages"`
+}
+
+// Conversation is the list view of a conversations row
+type Conversation struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// estimateTokens is a rough chars/4 heuristic; good enough for budgeting history
+func estimateTokens(s string) int {
+	return len(s)/4 + 1
+}
+
+// ensureConversation returns conversationID if the user owns it, or creates a new one when empty
+func ensureConversation(ctx context.Context, userID, conversationID, firstPrompt string) (string, error) {
+	if conversationID == "" {
+		title := []rune(firstPrompt)
+		if len(title) > conversationTitleMaxRunes {
+			title = title[:conversationTitleMaxRunes]
+		}
+		sealed, err := encryptPrompt(string(title))
+		if err != nil {
+			return "", err
+		}
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO conversations (user_id, title) VALUES ($1, $2) RETURNING id`,
+			userID, sealed).Scan(&conversationID)
+		return conversationID, err
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM conversations WHERE id::text = $1 AND user_id = $2)`,
+		conversationID, userID).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errConversationNotFound
+	}
+	return conversationID, nil
+}
+
+// conversationHistory loads up to conversationMaxTurns recent turns that fit the token budget, oldest first
+func conversationHistory(ctx context.Context, conversationID string, reserved int) ([]ChatMessage, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT role, content FROM conversation_messages
+		WHERE conversation_id = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2`, conversationID, conversationMaxTurns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budget := conversationTokenBudget - reserved
+	var newestFirst []ChatMessage
+	for rows.Next() {
+		var m ChatMessage
+		if err := rows.Scan(&m.Role, &m.Content); err != nil {
+			return nil, err
+		}
+		if err := decryptPrompts(&m.Content); err != nil {
+			return nil, err
+		}
+		if budget -= estimateTokens(m.Content); budget < 0 {
+			break
+		}
+		newestFirst = append(newestFirst, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	history := make([]ChatMessage, 0, len(newestFirst))
+	for i := len(newestFirst) - 1; i >= 0; i-- {
+		history = append(history, newestFirst[i])
+	}
+	return history, nil
+}
+
+// appendConversationTurns stores the user prompt and the reply for requestID
+func appendConversationTurns(ctx context.Context, conversationID, requestID string, turns ...ChatMessage) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range turns {
+		content, err := encryptPrompt(t.Content)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO conversation_messages (conversation_id, request_id, role, content)
+			VALUES ($1, $2, $3, $4)`, conversationID, requestID, t.Role, content); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE conversations SET updated_at = now() WHERE id = $1`, conversationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// conversationsKeyset pages GET /conversations, most recently active first
+var conversationsKeyset = keyset{Scope: "conversations", Columns: []string{"updated_at", "id::text"}, Desc: true, Before: true}
+
+// conversationMessagesKeyset pages GET /conversations/:id/messages, newest first. The
+// turns of one exchange share a created_at, so the id breaks the tie
+var conversationMessagesKeyset = keyset{Scope: "conversation_messages", Columns: []string{"created_at", "id"}, Desc: true,
+	Before: true, BeforeTie: int64(0)}
+
+// listConversationsHandler handles GET /conversations
+func listConversationsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	filter := user.ID.String()
+	keys, limit, ok := cursorParams(c, conversationsKeyset, filter)
+	if !ok {
+		return
+	}
+
+	after, keyArgs := conversationsKeyset.where(keys, 3)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT id, title, created_at, updated_at FROM conversations
+		WHERE user_id = $1 AND `+after+`
+		ORDER BY `+conversationsKeyset.orderBy()+` LIMIT $2`,
+		append([]interface{}{user.ID.String(), limit}, keyArgs...)...)
+	if err != nil {
+		log.Printf("❌ Failed to list conversations: %v", err)
+		respondError(c, codeInternal, "Failed to list conversations")
+		return
+	}
+	defer rows.Close()
+
+	list := []Conversation{}
+	for rows.Next() {
+		var conv Conversation
+		if err := rows.Scan(&conv.ID, &conv.Title, &conv.CreatedAt, &conv.UpdatedAt); err != nil {
+			respondError(c, codeInternal, "Failed to list conversations")
+			return
+		}
+		if err := decryptPrompts(&conv.Title); err != nil {
+			log.Printf("❌ Failed to decrypt the title of conversation %s: %v", conv.ID, err)
+			respondError(c, codeInternal, "Failed to list conversations")
+			return
+		}
+		list = append(list, conv)
+	}
+
+	resp := gin.H{"conversations": list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp["next_cursor"] = conversationsKeyset.encode(filter, last.UpdatedAt, last.ID)
+		resp["next_before"] = last.UpdatedAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// listConversationMessagesHandler handles GET /conversations/:id/messages, newest first
+func listConversationMessagesHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	filter := user.ID.String() + "|" + c.Param("id")
+	keys, limit, ok := cursorParams(c, conversationMessagesKeyset, filter)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if _, err := ensureConversation(ctx, user.ID.String(), c.Param("id"), ""); err != nil {
+		if err == errConversationNotFound {
+			respondError(c, codeNotFound, "Conversation not found")
+			return
+		}
+		respondError(c, codeInternal, "Failed to load conversation")
+		return
+	}
+
+	after, keyArgs := conversationMessagesKeyset.where(keys, 3)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, role, content, coalesce(request_id, ''), created_at FROM conversation_messages
+		WHERE conversation_id = $1 AND `+after+`
+		ORDER BY `+conversationMessagesKeyset.orderBy()+` LIMIT $2`,
+		append([]interface{}{c.Param("id"), limit}, keyArgs...)...)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load messages")
+		return
+	}
+	defer rows.Close()
+
+	type message struct {
+		ChatMessage
+		RequestID string    `json:"request_id,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		id        int64
+	}
+	list := []message{}
+	for rows.Next() {
+		var m message
+		if err := rows.Scan(&m.id, &m.Role, &m.Content, &m.RequestID, &m.CreatedAt); err != nil {
+			respondError(c, codeInternal, "Failed to load messages")
+			return
+		}
+		if err := decryptPrompts(&m.Content); err != nil {
+			log.Printf("❌ Failed to decrypt conversation message %d: %v", m.id, err)
+			respondError(c, codeInternal, "Failed to load messages")
+			return
+		}
+		list = append(list, m)
+	}
+
+	resp := gin.H{"messages": list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp["next_cursor"] = conversationMessagesKeyset.encode(filter, last.CreatedAt, last.id)
+		resp["next_before"] = last.CreatedAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// deleteConversationHandler handles DELETE /conversations/:id, removing its turns as well
+func deleteConversationHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to delete conversation")
+		return
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM conversations WHERE id::text = $1 AND user_id = $2 RETURNING id`,
+		c.Param("id"), user.ID.String()).Scan(&id)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Conversation not found")
+		return
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM conversation_messages WHERE conversation_id = $1`, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to delete conversation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to delete conversation")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// publishTextGenerationRequest sends req to the tenant's text workers, the conversation so
+// far in its messages array
+func publishTextGenerationRequest(ctx context.Context, tenantID string, req TextGenerationRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, len(data), maxMessageBytes)
+	}
+	if _, err := brokerPublish(ctx, tenantKey(tenantID, textGenerationChannel), data); err != nil {
+		return err
+	}
+	log.Printf("📤 Published text generation request: %s (%d messages)", req.RequestID, len(req.Messages))
+	return nil
+}
+
+// generateText stands in for the text model; like the real one it gets the whole history
+func generateText(req TextGenerationRequest) string {
+	return req.Messages[len(req.Messages)-1].Content + "+haha"
+}
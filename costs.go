@@ -0,0 +1,221 @@
+// costs.go
+// GPU cost accounting from worker-reported usage, materialized nightly into a daily
+// summary that /admin/costs reads for margin reporting
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const costDayLayout = "2006-01-02"
+
+var (
+	gpuHourCostUSD = getEnvFloat("GPU_HOUR_COST_USD", 2.0)
+	creditValueUSD = getEnvFloat("CREDIT_VALUE_USD", 0.01)
+	// Hour (UTC) after which the previous day is materialized
+	costMaterializeHour = getEnvInt("COST_MATERIALIZE_HOUR", 2)
+	// Days rewritten on each run, so completions that land late are still counted
+	costRestateDays = getEnvInt("COST_RESTATE_DAYS", 3)
+)
+
+// CostSummary is one row of /admin/costs; Day, Model and Plan are empty when not grouped by
+type CostSummary struct {
+	Day            string  `json:"day,omitempty"`
+	Model          string  `json:"model,omitempty"`
+	Plan           string  `json:"plan,omitempty"`
+	Generations    int64   `json:"generations"`
+	GPUSeconds     float64 `json:"gpu_seconds"`
+	CostUSD        float64 `json:"cost_usd"`
+	CreditsCharged int64   `json:"credits_charged"` // net of refunds
+	RevenueUSD     float64 `json:"revenue_usd"`
+	MarginUSD      float64 `json:"margin_usd"`
+}
+
+// recordWorkerUsage stores what the worker reported spending on a request
+func recordWorkerUsage(ctx context.Context, requestID, workerID string, gpuSeconds float64) error {
+	if workerID == "" && gpuSeconds <= 0 {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET worker_id = nullif($1, ''), gpu_seconds = $2
+		WHERE request_id = $3`, workerID, gpuSeconds, requestID)
+	return err
+}
+
+// materializeCosts rewrites the summary rows for the given UTC days. Cost is priced at
+// the current GPU_HOUR_COST_USD and plans are the users' plans at materialization time
+func materializeCosts(ctx context.Context, from, to time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM generation_cost_daily WHERE day >= $1 AND day < $2`, from, to); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO generation_cost_daily (day, model, plan, generations, gpu_seconds, cost_usd, credits_charged)
+		SELECT date_trunc('day', g.created_at AT TIME ZONE 'UTC')::date, g.model, coalesce(u.plan, ''),
+		       count(*), coalesce(sum(g.gpu_seconds), 0), coalesce(sum(g.gpu_seconds), 0) / 3600 * $3,
+		       coalesce(sum(g.credits_charged), 0) - coalesce(sum(r.refunded), 0)
+		FROM generated_content g
+		LEFT JOIN users u ON u.id = g.user_id
+		LEFT JOIN (
+			SELECT request_id, sum(delta) AS refunded FROM credit_ledger
+			WHERE (delta > 0 AND reason LIKE 'refund:%') OR reason = 'late_claim' GROUP BY request_id
+		) r ON r.request_id = g.request_id
+		WHERE g.created_at >= $1 AND g.created_at < $2
+		  AND g.status IN ('completed', 'failed', 'timed_out', 'expired')
+		GROUP BY 1, 2, 3`, from, to, gpuHourCostUSD)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startCostMaterializer runs materializeCosts once a day after COST_MATERIALIZE_HOUR.
+// The per-day Redis key keeps it to one instance, and is dropped on failure so the next
+// hourly tick retries
+func startCostMaterializer() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		runWithRecovery("cost_materializer", nil, func() {
+			now := time.Now().UTC()
+			if now.Hour() < costMaterializeHour {
+				return
+			}
+			ctx := context.Background()
+			today := now.Truncate(24 * time.Hour)
+			lockKey := "costs:materialized:" + today.Format(costDayLayout)
+			ok, err := rdb.SetNX(ctx, lockKey, "1", 48*time.Hour).Result()
+			if err != nil || !ok {
+				return
+			}
+			from := today.AddDate(0, 0, -max(costRestateDays, 1))
+			if err := materializeCosts(ctx, from, today); err != nil {
+				log.Printf("❌ Failed to materialize costs: %v", err)
+				rdb.Del(ctx, lockKey)
+				return
+			}
+			log.Printf("💰 Materialized costs for %s to %s", from.Format(costDayLayout), today.Format(costDayLayout))
+		})
+	}
+}
+
+// costGroupColumns whitelists the group_by values of /admin/costs
+var costGroupColumns = map[string]string{
+	"day":   "to_char(day, 'YYYY-MM-DD')",
+	"model": "model",
+	"plan":  "plan",
+}
+
+// adminCostsHandler handles GET /admin/costs?from=&to=&group_by=day,model,plan&format=csv.
+// from/to are inclusive UTC days, defaulting to the last 30
+func adminCostsHandler(c *gin.Context) {
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -30)
+	for param, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(costDayLayout, v)
+			if err != nil {
+				fieldError(c, codeInvalidRequest, param, "must be a date like 2006-01-02")
+				return
+			}
+			*dst = t
+		}
+	}
+	if to.Before(from) {
+		fieldError(c, codeValidationFailed, "to", "must not be before from")
+		return
+	}
+
+	grouped := map[string]bool{}
+	for _, g := range strings.Split(c.DefaultQuery("group_by", "day,model,plan"), ",") {
+		g = strings.TrimSpace(g)
+		if _, ok := costGroupColumns[g]; !ok {
+			fieldError(c, codeInvalidRequest, "group_by", "must be a list of day, model and plan")
+			return
+		}
+		grouped[g] = true
+	}
+	selects := make([]string, 0, 3)
+	for _, name := range []string{"day", "model", "plan"} {
+		if grouped[name] {
+			selects = append(selects, costGroupColumns[name])
+		} else {
+			selects = append(selects, "''")
+		}
+	}
+	cols := strings.Join(selects, ", ")
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+cols+`, sum(generations), sum(gpu_seconds), sum(cost_usd), sum(credits_charged)
+		FROM generation_cost_daily
+		WHERE day >= $1 AND day <= $2
+		GROUP BY `+cols+` ORDER BY 1, 2, 3`, from, to)
+	if err != nil {
+		log.Printf("❌ Failed to load costs: %v", err)
+		respondError(c, codeInternal, "Failed to load costs")
+		return
+	}
+	defer rows.Close()
+
+	summary := []CostSummary{}
+	for rows.Next() {
+		var s CostSummary
+		if err := rows.Scan(&s.Day, &s.Model, &s.Plan, &s.Generations, &s.GPUSeconds, &s.CostUSD, &s.CreditsCharged); err != nil {
+			respondError(c, codeInternal, "Failed to load costs")
+			return
+		}
+		s.RevenueUSD = float64(s.CreditsCharged) * creditValueUSD
+		s.MarginUSD = s.RevenueUSD - s.CostUSD
+		summary = append(summary, s)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(c, codeInternal, "Failed to load costs")
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeCostsCSV(c, from, to, summary)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"from":              from.Format(costDayLayout),
+		"to":                to.Format(costDayLayout),
+		"gpu_hour_cost_usd": gpuHourCostUSD,
+		"credit_value_usd":  creditValueUSD,
+		"summary":           summary,
+	})
+}
+
+func writeCostsCSV(c *gin.Context, from, to time.Time, summary []CostSummary) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="costs-%s-%s.csv"`,
+		from.Format(costDayLayout), to.Format(costDayLayout)))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"day", "model", "plan", "generations", "gpu_seconds", "cost_usd",
+		"credits_charged", "revenue_usd", "margin_usd"})
+	money := func(v float64) string { return strconv.FormatFloat(v, 'f', 4, 64) }
+	for _, s := range summary {
+		w.Write([]string{s.Day, s.Model, s.Plan, strconv.FormatInt(s.Generations, 10),
+			strconv.FormatFloat(s.GPUSeconds, 'f', 1, 64), money(s.CostUSD),
+			strconv.FormatInt(s.CreditsCharged, 10), money(s.RevenueUSD), money(s.MarginUSD)})
+	}
+	w.Flush()
+}
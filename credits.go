@@ -0,0 +1,226 @@
+// credits.go
+// Credit balances (personal or organization pool) and the ledger recording every change
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ErrInsufficientCredits = errors.New("insufficient credits")
+
+var creditRefunds = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_credit_refunds_total",
+	Help: "Refund attempts, by reason and result (refunded, already_refunded, not_charged).",
+}, []string{"reason", "result"})
+
+// creditCharge is one request's share of a chargeCreditsBatch
+type creditCharge struct {
+	RequestID string
+	Amount    int
+	Reason    string // ledger reason; "generation" when empty
+}
+
+// chargeCredits debits amount for requestID from the org pool when orgID is set,
+// otherwise from the user, and records the debit in credit_ledger
+func chargeCredits(ctx context.Context, userID, orgID, requestID string, amount int) error {
+	return chargeCreditsBatch(ctx, userID, orgID, []creditCharge{{RequestID: requestID, Amount: amount}})
+}
+
+// chargeCreditsBatch debits several requests all-or-nothing, with a ledger entry per
+// request so each can be refunded on its own
+func chargeCreditsBatch(ctx context.Context, userID, orgID string, charges []creditCharge) error {
+	amount := 0
+	for _, ch := range charges {
+		amount += max(ch.Amount, 0)
+	}
+	if amount <= 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	if orgID != "" {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE organizations SET credits = credits - $1 WHERE id = $2 AND credits >= $1
+			RETURNING credits`, amount, orgID).Scan(&balance)
+	} else {
+		err = tx.QueryRowContext(ctx, `
+			UPDATE users SET credits = credits - $1 WHERE id = $2 AND credits >= $1
+			RETURNING credits`, amount, userID).Scan(&balance)
+	}
+	if err == sql.ErrNoRows {
+		return ErrInsufficientCredits
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range charges {
+		if ch.Amount <= 0 {
+			continue
+		}
+		reason := ch.Reason
+		if reason == "" {
+			reason = "generation"
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO credit_ledger (user_id, org_id, request_id, delta, reason)
+			VALUES ($1, nullif($2, '')::uuid, $3, $4, $5)`, userID, orgID, ch.RequestID, -ch.Amount, reason)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	broadcastEvent(ctx, Event{Type: eventCredits, RequestID: charges[0].RequestID, UserID: userID,
+		Data: map[string]interface{}{"delta": -amount, "balance": balance, "org_id": orgID}})
+	go checkBudgetThresholds(context.WithoutCancel(ctx), userID, orgID)
+	return nil
+}
+
+// creditRefund is a refund written in a transaction, announced once that commits
+type creditRefund struct {
+	requestID, userID, orgID, reason string
+	amount                           int
+}
+
+func (r *creditRefund) announce(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	creditRefunds.WithLabelValues(r.reason, "refunded").Inc()
+	broadcastEvent(ctx, Event{Type: eventCredits, RequestID: r.requestID, UserID: r.userID,
+		Data: map[string]interface{}{"delta": r.amount, "org_id": r.orgID, "reason": r.reason}})
+}
+
+// refundForRequest returns what was charged for requestID to wherever it came from, with a
+// "refund:<reason>" ledger entry. Every path that gives credits back for a request ends
+// here. It's idempotent: a request that was never charged, or whose charge is already
+// refunded, is logged and left alone. Paths that also change the status refund through
+// generationWrite.Refund instead, so both commit together
+func refundForRequest(ctx context.Context, requestID, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refund, err := refundInTx(ctx, tx, requestID, reason)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	refund.announce(ctx)
+	return nil
+}
+
+// refundUnstored returns a charge for a request that never got a row, which is what
+// refundForRequest would read it from, to the org it came from or else the user. Like it,
+// it refunds each request at most once
+func refundUnstored(ctx context.Context, userID, orgID, requestID string, amount int, reason string) error {
+	if amount <= 0 {
+		return nil
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO credit_ledger (user_id, org_id, request_id, delta, reason, refund_key)
+		VALUES ($1, nullif($2, '')::uuid, $3, $4, $5, $6)
+		ON CONFLICT (refund_key) DO NOTHING
+		RETURNING id`, userID, orgID, requestID, amount, "refund:"+reason, requestID+":1").Scan(new(int64))
+	if err == sql.ErrNoRows {
+		creditRefunds.WithLabelValues(reason, "already_refunded").Inc()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if orgID != "" {
+		_, err = tx.ExecContext(ctx, `UPDATE organizations SET credits = credits + $1 WHERE id = $2`, amount, orgID)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET credits = credits + $1 WHERE id = $2`, amount, userID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	(&creditRefund{requestID: requestID, userID: userID, orgID: orgID, reason: reason, amount: amount}).announce(ctx)
+	return nil
+}
+
+// refundInTx writes requestID's refund in tx, returning nil when there is nothing to
+// refund. Each charge can be refunded once: the original one, plus one more per late claim
+// (see deadlines.go). The ledger's unique refund_key, <request>:<charge>, holds that even
+// against a writer that skipped the row lock
+func refundInTx(ctx context.Context, tx *sql.Tx, requestID, reason string) (*creditRefund, error) {
+	r := &creditRefund{requestID: requestID, reason: reason}
+	err := tx.QueryRowContext(ctx, `
+		SELECT user_id, coalesce(org_id::text, ''), credits_charged FROM generated_content
+		WHERE request_id = $1 FOR UPDATE`, requestID).Scan(&r.userID, &r.orgID, &r.amount)
+	if err == sql.ErrNoRows || (err == nil && r.amount <= 0) {
+		creditRefunds.WithLabelValues(reason, "not_charged").Inc()
+		log.Printf("💳 Not refunding request %s (%s): nothing was charged", requestID, reason)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var charge, refunds int
+	err = tx.QueryRowContext(ctx, `
+		SELECT 1 + count(*) FILTER (WHERE reason = 'late_claim'),
+		       count(*) FILTER (WHERE delta > 0 AND reason LIKE 'refund:%')
+		FROM credit_ledger WHERE request_id = $1`, requestID).Scan(&charge, &refunds)
+	if err != nil {
+		return nil, err
+	}
+	if refunds < charge {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO credit_ledger (user_id, org_id, request_id, delta, reason, refund_key)
+			VALUES ($1, nullif($2, '')::uuid, $3, $4, $5, $6)
+			ON CONFLICT (refund_key) DO NOTHING
+			RETURNING id`, r.userID, r.orgID, requestID, r.amount, "refund:"+reason,
+			requestID+":"+strconv.Itoa(charge)).Scan(new(int64))
+	}
+	if refunds >= charge || err == sql.ErrNoRows {
+		creditRefunds.WithLabelValues(reason, "already_refunded").Inc()
+		log.Printf("💳 Not refunding request %s (%s): already refunded", requestID, reason)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.orgID != "" {
+		_, err = tx.ExecContext(ctx, `UPDATE organizations SET credits = credits + $1 WHERE id = $2`, r.amount, r.orgID)
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE users SET credits = credits + $1 WHERE id = $2`, r.amount, r.userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
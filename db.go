@@ -0,0 +1,22 @@
+// db.go
+// Postgres connection used by the integration code for generated_content updates
+
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/lib/pq"
+)
+
+var db *sql.DB
+
+func init() {
+	var err error
+	db, err = sql.Open("postgres", getEnv("DATABASE_URL", "postgres://localhost:5432/mobiarty?sslmode=disable"))
+	if err != nil {
+		log.Fatalf("❌ Failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(getEnvInt("DB_MAX_OPEN_CONNS", 20))
+}
@@ -0,0 +1,201 @@
+// db_retry.go
+// Retries of completions whose database write hit a transient failure, e.g. a Postgres
+// failover. The worker retries briefly in place; past that the completion moves to a
+// retry buffer in Redis, which every instance drains with capped exponential backoff
+// until COMPLETION_RETRY_BUDGET runs out and it is dead-lettered as db_unavailable.
+// Constraint and data errors are dead-lettered at once, since a retry can't fix them
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Database error classes
+const (
+	dbErrTransient  = "transient"  // connection loss, failover, serialization failure, deadlock
+	dbErrConstraint = "constraint" // constraint violation or bad data
+	dbErrOther      = "other"
+)
+
+const completionRetryKey = "completion:retry"
+
+var (
+	// Attempts in the worker before handing off to the buffer, 100ms apart and doubling
+	completionInlineRetries = getEnvInt("COMPLETION_DB_RETRIES", 3)
+	completionRetryBudget   = getEnvDuration("COMPLETION_RETRY_BUDGET", 5*time.Minute)
+	completionRetryMaxDelay = getEnvDuration("COMPLETION_RETRY_MAX_BACKOFF", 30*time.Second)
+	completionRetryPoll     = getEnvDuration("COMPLETION_RETRY_POLL_INTERVAL", time.Second)
+
+	completionDBRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_completion_db_retries_total",
+		Help: "Completions whose database write failed, by outcome (recovered, buffered, exhausted, constraint).",
+	}, []string{"outcome"})
+	completionRetryDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_completion_retry_buffer_depth",
+		Help: "Completions waiting in the Redis retry buffer.",
+	})
+)
+
+// dbErrorClass classifies an error from a database call
+func dbErrorClass(err error) string {
+	if errors.Is(err, errTransitionContended) {
+		return dbErrTransient
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57": // connection, transaction rollback, resources, operator intervention
+			return dbErrTransient
+		case "22", "23": // data exception, integrity constraint violation
+			return dbErrConstraint
+		}
+		if pqErr.Code == "25006" { // read_only_sql_transaction: a demoted primary mid-failover
+			return dbErrTransient
+		}
+		return dbErrOther
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.As(err, &netErr) {
+		return dbErrTransient
+	}
+	return dbErrOther
+}
+
+// completionErrorClass is the dead-letter class for a completion that failed with err
+func completionErrorClass(err error) string {
+	var mismatch *ownerMismatchError
+	if errors.As(err, &mismatch) {
+		return dlqOwnerMismatch
+	}
+	if dbErrorClass(err) == dbErrConstraint {
+		completionDBRetries.WithLabelValues("constraint").Inc()
+		return dlqConstraint
+	}
+	return dlqApply
+}
+
+// retryCompletionInline reapplies completion while its error stays transient, for up to
+// COMPLETION_DB_RETRIES more attempts. It returns the last error, nil once applied
+func retryCompletionInline(where string, completion ImageGenerationCompletion, err error) (panicked bool, _ error) {
+	delay := 100 * time.Millisecond
+	for i := 0; i < completionInlineRetries && err != nil && dbErrorClass(err) == dbErrTransient; i++ {
+		time.Sleep(delay)
+		delay *= 2
+		if panicked, err = runCompletion(where, completion); panicked {
+			return true, err
+		}
+		if err == nil {
+			completionDBRetries.WithLabelValues("recovered").Inc()
+		}
+	}
+	return false, err
+}
+
+// bufferedCompletion is a completion in the retry buffer
+type bufferedCompletion struct {
+	Completion    ImageGenerationCompletion `json:"completion"`
+	Attempts      int                       `json:"attempts"`
+	FirstFailedAt time.Time                 `json:"first_failed_at"`
+	LastError     string                    `json:"last_error"`
+}
+
+func (b bufferedCompletion) delay() time.Duration {
+	d := time.Second << min(b.Attempts, 16)
+	if d > completionRetryMaxDelay {
+		return completionRetryMaxDelay
+	}
+	return d
+}
+
+// bufferCompletionRetry schedules b's next attempt. false means Redis couldn't take it
+func bufferCompletionRetry(ctx context.Context, b bufferedCompletion) bool {
+	member, err := json.Marshal(b)
+	if err == nil {
+		err = rdb.ZAdd(ctx, completionRetryKey, &redis.Z{
+			Score: float64(time.Now().Add(b.delay()).UnixMilli()), Member: member,
+		}).Err()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to buffer completion %s for retry: %v", b.Completion.RequestID, err)
+		return false
+	}
+	return true
+}
+
+// startCompletionRetryLoop reapplies buffered completions as they come due
+func startCompletionRetryLoop() {
+	ticker := time.NewTicker(completionRetryPoll)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("completion_retry", nil, func() {
+			retryBufferedCompletions(context.Background())
+		})
+	}
+}
+
+// retryBufferedCompletions takes due entries one by one; ZREM decides which instance
+// gets each, so an entry is retried once per due time however many instances poll
+func retryBufferedCompletions(ctx context.Context) {
+	due, err := rdb.ZRangeByScore(ctx, completionRetryKey, &redis.ZRangeBy{
+		Min: "-inf", Max: strconv.FormatInt(time.Now().UnixMilli(), 10), Count: 100,
+	}).Result()
+	if err != nil {
+		return
+	}
+	for _, member := range due {
+		if n, err := rdb.ZRem(ctx, completionRetryKey, member).Result(); err != nil || n == 0 {
+			continue
+		}
+		var b bufferedCompletion
+		if err := json.Unmarshal([]byte(member), &b); err != nil {
+			log.Printf("❌ Dropping unreadable retry buffer entry: %v", err)
+			continue
+		}
+		retryBufferedCompletion(ctx, b)
+	}
+	if n, err := rdb.ZCard(ctx, completionRetryKey).Result(); err == nil {
+		completionRetryDepth.Set(float64(n))
+	}
+}
+
+func retryBufferedCompletion(ctx context.Context, b bufferedCompletion) {
+	panicked, err := runCompletion("completion_retry", b.Completion)
+	switch {
+	case panicked:
+		deadLetterCompletion(ctx, b.Completion, dlqPanic, errors.New("handler panicked"))
+	case err == nil:
+		completionDBRetries.WithLabelValues("recovered").Inc()
+		log.Printf("🔁 Applied completion %s after %d buffered retries", b.Completion.RequestID, b.Attempts)
+	case dbErrorClass(err) != dbErrTransient:
+		deadLetterCompletion(ctx, b.Completion, completionErrorClass(err), err)
+	case time.Since(b.FirstFailedAt) >= completionRetryBudget:
+		completionDBRetries.WithLabelValues("exhausted").Inc()
+		deadLetterCompletion(ctx, b.Completion, dlqDBUnavailable,
+			errors.New("gave up after "+strconv.Itoa(b.Attempts+1)+" retries: "+err.Error()))
+	default:
+		b.Attempts++
+		b.LastError = err.Error()
+		if !bufferCompletionRetry(ctx, b) {
+			deadLetterCompletion(ctx, b.Completion, dlqDBUnavailable, err)
+		}
+	}
+}
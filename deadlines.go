@@ -0,0 +1,229 @@
+// deadlines.go
+// Request deadlines (max_wait_seconds): the sweeper times out rows nobody is waiting for
+// any more and refunds them. A completion that still arrives is attached as a late result:
+// the row stays timed out and refunded until its owner claims it, paying again
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const maxWaitSecondsLimit = 24 * 60 * 60
+
+var deadlineSweepInterval = getEnvDuration("DEADLINE_SWEEP_INTERVAL", 15*time.Second)
+
+var (
+	lateCompletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_late_completions_total",
+		Help: "Completions that arrived after their request timed out, by content type.",
+	}, []string{"content_type"})
+	// sum / count is the average lateness; compare with DEADLINE_SWEEP_INTERVAL and max_wait_seconds
+	lateCompletionLateness = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mobart_late_completion_lateness_seconds",
+		Help:    "How long after its deadline a late completion arrived.",
+		Buckets: []float64{5, 15, 30, 60, 120, 300, 600, 1800, 3600, 4 * 3600},
+	})
+	lateClaims = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_late_results_claimed_total",
+		Help: "Late results claimed by their owner.",
+	})
+)
+
+// startDeadlineSweeper times out rows past their deadline on every tick
+func startDeadlineSweeper() {
+	ticker := time.NewTicker(deadlineSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("deadline_sweeper", nil, func() {
+			sweepDeadlines(context.Background())
+		})
+	}
+}
+
+// sweepDeadlines times out rows past their deadline by clock. A row whose deadline is
+// exactly now still has its moment, and if the clock steps back rows already timed out
+// stay that way. Each claim is a versioned transition, so concurrent instances (or a
+// completion landing at the same moment) never time out or refund the same row twice
+func sweepDeadlines(ctx context.Context) {
+	now := clock.Now()
+	ids, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content
+		WHERE deadline < $1 AND status IN ('queued', 'processing', 'deferred', 'pending_moderation')`, now)
+	if err != nil {
+		log.Printf("❌ Failed to sweep deadlines: %v", err)
+		return
+	}
+	type expired struct{ requestID, userID string }
+	var list []expired
+	for _, id := range ids {
+		e := expired{requestID: id}
+		claimed, err := transitionGeneration(ctx, id, generationWrite{
+			Writer: "sweeper", To: "timed_out", From: []string{"queued", "processing", "deferred", generationPendingModeration},
+			Set:       "error = 'deadline exceeded', completed_at = $4, deferred_until = NULL",
+			Args:      []interface{}{now},
+			Returning: "user_id",
+			Scan:      func(row rowScanner) error { return row.Scan(&e.userID) },
+			Refund:    "timed_out",
+		})
+		if err != nil {
+			log.Printf("❌ Failed to time out request %s: %v", id, err)
+			continue
+		}
+		if claimed {
+			list = append(list, e)
+		}
+	}
+
+	for _, e := range list {
+		releaseAdmission(ctx, e.userID, e.requestID)
+		broadcastEvent(ctx, Event{Type: eventFailed, RequestID: e.requestID, UserID: e.userID,
+			Data: map[string]interface{}{"error": "deadline exceeded"}})
+		log.Printf("⌛ Request %s passed its deadline", e.requestID)
+	}
+}
+
+// attachLateResult stores a completion for a timed-out row without changing its status,
+// so the failure and refund the user already saw stand. applied is false when the row
+// isn't timed out or already has a late result (a repeat). With userID, a row belonging
+// to someone else fails with an ownerMismatchError
+func attachLateResult(ctx context.Context, fx *completionEffects, requestID, userID, s3Key string, generationSeconds float64) (applied bool, contentType string, err error) {
+	var lateness float64
+	var claimed bool
+	err = db.QueryRowContext(ctx, `
+		WITH attached AS (
+			UPDATE generated_content
+			SET content_url = $2, generation_time_seconds = $3, late_result = true, late_result_at = now()
+			WHERE request_id = $1 AND status = 'timed_out' AND NOT late_result AND late_result_at IS NULL
+			  AND ($4 = '' OR user_id::text = $4)
+			RETURNING request_id, content_type, extract(epoch FROM now() - coalesce(deadline, completed_at, now())) AS lateness
+		), claimed AS (
+			INSERT INTO processed_effects (request_id, effect_type) SELECT request_id, $5 FROM attached
+			ON CONFLICT (request_id, effect_type) DO NOTHING
+			RETURNING 1
+		)
+		SELECT content_type, lateness, EXISTS (SELECT 1 FROM claimed) FROM attached`,
+		requestID, s3Key, generationSeconds, userID, effectResult).Scan(&contentType, &lateness, &claimed)
+	if err == sql.ErrNoRows {
+		if userID == "" {
+			return false, "", nil
+		}
+		return false, "", verifyRequestOwner(ctx, db, requestID, userID)
+	}
+	if err != nil {
+		return false, "", err
+	}
+	fx.note(effectResult, claimed)
+	lateCompletions.WithLabelValues(contentType).Inc()
+	lateCompletionLateness.Observe(max(lateness, 0))
+	return true, contentType, nil
+}
+
+// generationLate reports whether a stored completion is a late result awaiting a claim
+func generationLate(ctx context.Context, requestID string) bool {
+	var late bool
+	db.QueryRowContext(ctx, `
+		SELECT late_result AND status = 'timed_out' FROM generated_content WHERE request_id = $1`,
+		requestID).Scan(&late)
+	return late
+}
+
+// notifyLateResult tells the owner a late result can be claimed. There's no preview: the
+// result is only theirs once claimed
+func notifyLateResult(ctx context.Context, q execer, requestID string) {
+	n, orgID, err := loadNotification(ctx, requestID)
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s for notification: %v", requestID, err)
+		return
+	}
+	n.Status, n.Error = "late_result", ""
+	fanOutNotification(ctx, q, n, orgID)
+}
+
+// claimLateResultHandler handles POST /generations/:id/claim-late: the owner takes a late
+// result, is charged the request's credits again and the row becomes completed
+func claimLateResultHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	requestID := c.Param("id")
+
+	var status string
+	var pending bool
+	err := db.QueryRowContext(ctx, `
+		SELECT status, late_result FROM generated_content
+		WHERE request_id = $1 AND user_id = $2 AND trashed_at IS NULL`, requestID, user.ID.String()).Scan(&status, &pending)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to claim late result")
+		return
+	}
+	if status != "timed_out" || !pending {
+		respondError(c, codeConflict, "Generation has no late result to claim")
+		return
+	}
+
+	// Taking the flag first makes the claim single-use: a concurrent claim finds it gone
+	var orgID string
+	var credits int
+	err = db.QueryRowContext(ctx, `
+		UPDATE generated_content SET late_result = false
+		WHERE request_id = $1 AND status = 'timed_out' AND late_result
+		RETURNING coalesce(org_id::text, ''), credits_charged`, requestID).Scan(&orgID, &credits)
+	if err == sql.ErrNoRows {
+		respondError(c, codeConflict, "Late result already claimed")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to claim late result %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to claim late result")
+		return
+	}
+	release := func() {
+		db.ExecContext(context.Background(), `
+			UPDATE generated_content SET late_result = true WHERE request_id = $1 AND status = 'timed_out'`, requestID)
+	}
+
+	err = chargeCreditsBatch(ctx, user.ID.String(), orgID, []creditCharge{{RequestID: requestID, Amount: credits, Reason: "late_claim"}})
+	if err != nil {
+		release()
+		if err != ErrInsufficientCredits {
+			log.Printf("❌ Failed to charge late claim %s: %v", requestID, err)
+		}
+		respondTypedError(c, err, "Failed to claim late result")
+		return
+	}
+
+	applied, err := transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "late_claim", To: "completed", From: []string{"timed_out"},
+		Set: "late = true, error = '', completed_at = late_result_at",
+	})
+	if err != nil || !applied {
+		// Only an admin requeue can move a timed-out row meanwhile; give the charge back
+		log.Printf("❌ Late claim %s could not complete the row (err: %v); refunding", requestID, err)
+		if err := refundForRequest(context.Background(), requestID, "late_claim_failed"); err != nil {
+			log.Printf("❌ Failed to refund late claim %s: %v", requestID, err)
+		}
+		release()
+		respondError(c, codeConflict, "Generation changed while claiming; try again")
+		return
+	}
+
+	lateClaims.Inc()
+	invalidatePromptSuggestions(ctx, user.ID.String())
+	log.Printf("⌛ Late result %s claimed for %d credits", requestID, credits)
+	broadcastEvent(ctx, Event{Type: eventCompleted, RequestID: requestID, UserID: user.ID.String()})
+	c.JSON(http.StatusOK, GenerationStatusResponse{RequestID: requestID, Status: "completed", CreditsCharged: credits})
+}
@@ -0,0 +1,203 @@
+// deeplinks.go
+// Signed deep links in completion pushes and emails. The token names one generation and
+// its owner and expires after DEEPLINK_TTL; the app trades it at POST /deeplink/resolve
+// for the generation and a fresh URL. The token is the only credential that route checks,
+// so it works while the app's session is still being refreshed. Trashing the generation
+// revokes every link to it through generated_content.deep_links_revoked_at
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const deepLinkVersion = "v1"
+
+var (
+	deepLinkTTL = getEnvDuration("DEEPLINK_TTL", 24*time.Hour)
+	// Where email links point; the token is appended
+	deepLinkBaseURL = getEnv("DEEPLINK_BASE_URL", "mobart://generation?token=")
+
+	deepLinkKey []byte
+
+	deepLinksIssued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_deeplinks_issued_total",
+		Help: "Deep links attached to notifications, by channel kind.",
+	}, []string{"kind"})
+	deepLinkResolves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_deeplink_resolves_total",
+		Help: "POST /deeplink/resolve calls, by result (ok, invalid, expired, revoked, disabled_account, error).",
+	}, []string{"result"})
+)
+
+var (
+	errDeepLinkInvalid = errors.New("invalid deep link")
+	errDeepLinkExpired = errors.New("deep link expired")
+)
+
+func init() {
+	raw := getEnv("DEEPLINK_SIGNING_KEY", "")
+	if raw == "" {
+		log.Println("⚠️ DEEPLINK_SIGNING_KEY not set; notifications go out without deep links")
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) < 32 {
+		log.Fatalf("❌ Invalid DEEPLINK_SIGNING_KEY: must be at least 32 bytes, base64 encoded")
+	}
+	deepLinkKey = key
+}
+
+// deepLinkClaims is what a token carries
+type deepLinkClaims struct {
+	RequestID string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+func deepLinkSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, deepLinkKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signDeepLink returns "<payload>.<signature>", both base64url, or "" when signing is off
+func signDeepLink(requestID, userID string, now time.Time) string {
+	if deepLinkKey == nil {
+		return ""
+	}
+	payload := strings.Join([]string{deepLinkVersion, requestID, userID,
+		strconv.FormatInt(now.Add(deepLinkTTL).Unix(), 10)}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(deepLinkSignature(payload))
+}
+
+// parseDeepLink checks the signature, then the expiry
+func parseDeepLink(token string, now time.Time) (deepLinkClaims, error) {
+	var claims deepLinkClaims
+	if deepLinkKey == nil {
+		return claims, errDeepLinkInvalid
+	}
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errDeepLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return claims, errDeepLinkInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, deepLinkSignature(string(payload))) {
+		return claims, errDeepLinkInvalid
+	}
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 4 || parts[0] != deepLinkVersion {
+		return claims, errDeepLinkInvalid
+	}
+	exp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return claims, errDeepLinkInvalid
+	}
+	claims = deepLinkClaims{RequestID: parts[1], UserID: parts[2], ExpiresAt: time.Unix(exp, 0)}
+	if !now.Before(claims.ExpiresAt) {
+		return claims, errDeepLinkExpired
+	}
+	return claims, nil
+}
+
+// deepLinkChannel reports whether a channel kind opens the app, and so gets a deep link
+func deepLinkChannel(kind string) bool {
+	return kind == "fcm" || kind == "email"
+}
+
+// revokeDeepLinks invalidates every link issued for requestID so far. Restoring the
+// generation from the trash doesn't bring them back
+func revokeDeepLinks(ctx context.Context, requestID string) {
+	if _, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET deep_links_revoked_at = now()
+		WHERE request_id = $1 AND deep_links_revoked_at IS NULL`, requestID); err != nil {
+		log.Printf("⚠️ Failed to revoke deep links for %s: %v", requestID, err)
+	}
+}
+
+// DeepLinkResponse is what POST /deeplink/resolve returns
+type DeepLinkResponse struct {
+	Generation    *Generation `json:"generation"`
+	LinkExpiresAt time.Time   `json:"link_expires_at"`
+}
+
+// resolveDeepLinkHandler handles POST /deeplink/resolve with {"token"}[?size=]. Revoked
+// links and links to rows that are gone both answer link_expired, so they can't be
+// used to learn whether a generation still exists
+func resolveDeepLinkHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	size, ok := sizeParam(c, renditionWeb)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	claims, err := parseDeepLink(req.Token, clock.Now())
+	if errors.Is(err, errDeepLinkExpired) {
+		deepLinkResolves.WithLabelValues("expired").Inc()
+		respondError(c, codeLinkExpired, "This link has expired")
+		return
+	}
+	if err != nil {
+		deepLinkResolves.WithLabelValues("invalid").Inc()
+		respondError(c, codeUnauthorized, "Invalid link")
+		return
+	}
+
+	state, tenant := accountInfo(ctx, claims.UserID)
+	if tenant != "" && tenant != currentTenant(c).ID {
+		// Signed for another tenant's app: to this one the link doesn't exist
+		deepLinkResolves.WithLabelValues("invalid").Inc()
+		respondCrossTenant(c, "deep_link", "Invalid link")
+		return
+	}
+	if state != accountActive {
+		deepLinkResolves.WithLabelValues("disabled_account").Inc()
+		respondError(c, codeForbidden, "This account is disabled")
+		return
+	}
+	g, err := scanGeneration(db.QueryRowContext(ctx, `
+		SELECT `+generationColumns+`
+		FROM generated_content
+		WHERE request_id = $1 AND user_id = $2 AND trashed_at IS NULL AND deep_links_revoked_at IS NULL`,
+		claims.RequestID, claims.UserID))
+	if err == sql.ErrNoRows {
+		deepLinkResolves.WithLabelValues("revoked").Inc()
+		respondError(c, codeLinkExpired, "This link has expired")
+		return
+	}
+	if err != nil {
+		deepLinkResolves.WithLabelValues("error").Inc()
+		log.Printf("❌ Failed to resolve deep link for %s: %v", claims.RequestID, err)
+		respondError(c, codeInternal, "Failed to load generation")
+		return
+	}
+	withGenerationURLs(ctx, g, size)
+	deepLinkResolves.WithLabelValues("ok").Inc()
+	c.JSON(http.StatusOK, DeepLinkResponse{Generation: g, LinkExpiresAt: claims.ExpiresAt})
+}
@@ -0,0 +1,318 @@
+// degraded.go
+// Read-only mode for when Redis or the GPU fleet is down but the database is not: reads
+// keep working, broker-backed writes get a 503 with the maintenance message
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Service mode overrides set through PUT /admin/mode
+const (
+	modeAuto     = "auto"     // follow the health checks
+	modeDegraded = "degraded" // forced read-only
+	modeNormal   = "normal"   // ignore failing checks
+
+	sourceManual = "manual"
+)
+
+var (
+	degradedCheckInterval = getEnvDuration("DEGRADED_CHECK_INTERVAL", 5*time.Second)
+	// Consecutive checks that must agree before the automatic mode flips either way
+	degradedThreshold = getEnvInt("DEGRADED_THRESHOLD", 3)
+	degradedMessage   = getEnv("DEGRADED_MESSAGE", "Image generation is temporarily unavailable; existing generations can still be viewed")
+
+	degradedModeGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_degraded_mode",
+		Help: "1 while the API is read-only, 0 otherwise.",
+	})
+	degradedTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_degraded_transitions_total",
+		Help: "Service mode transitions, by new state (degraded, normal) and source (auto, manual).",
+	}, []string{"state", "source"})
+)
+
+// serviceState is the effective mode, swapped atomically so requests never lock
+type serviceState struct {
+	Degraded bool      `json:"degraded"`
+	Source   string    `json:"source"`            // "auto" or "manual"
+	Reasons  []string  `json:"reasons,omitempty"` // failing checks, in auto mode
+	Message  string    `json:"message,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+var currentServiceState atomic.Pointer[serviceState]
+
+func init() {
+	currentServiceState.Store(&serviceState{Source: modeAuto, Since: time.Now()})
+}
+
+// serviceDegraded reports whether broker-backed writes are refused right now
+func serviceDegraded() bool {
+	return currentServiceState.Load().Degraded
+}
+
+// healthChecks probes the dependencies; a nil entry is healthy
+type healthChecks struct {
+	Database error
+	Schema   error // the database is behind the binary's migrations (migrations.go)
+	Redis    error
+	GPU      error
+}
+
+var errNoLiveWorkers = errors.New("no model has live workers")
+
+func runHealthChecks(ctx context.Context) healthChecks {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var h healthChecks
+	if h.Database = db.PingContext(ctx); h.Database == nil {
+		h.Schema = checkSchemaVersion(ctx)
+	}
+	if h.Redis = rdb.Ping(ctx).Err(); h.Redis != nil {
+		return h // capacity lives in Redis, so the fleet can't be checked either
+	}
+	list, err := allModelCapacity(ctx)
+	if err != nil {
+		h.GPU = err
+		return h
+	}
+	// Only a fleet that has reported and then gone quiet counts as down
+	if len(list) > 0 {
+		h.GPU = errNoLiveWorkers
+		for _, mc := range list {
+			if mc.Availability != availabilityUnavailable {
+				h.GPU = nil
+				break
+			}
+		}
+	}
+	return h
+}
+
+// reasons lists the checks that make the API read-only; the database being down is not
+// one of them, since reads can't be served then either
+func (h healthChecks) reasons() []string {
+	var r []string
+	if h.Redis != nil {
+		r = append(r, "redis_unavailable")
+	}
+	if h.GPU != nil {
+		r = append(r, "gpu_unavailable")
+	}
+	return r
+}
+
+func (h healthChecks) report() gin.H {
+	status := func(err error) string {
+		if err != nil {
+			return "down: " + err.Error()
+		}
+		return "ok"
+	}
+	return gin.H{"database": status(h.Database), "schema": status(h.Schema), "redis": status(h.Redis), "gpu": status(h.GPU)}
+}
+
+// loadModeOverride reads the manual override shared by all instances
+func loadModeOverride(ctx context.Context) (mode, message string, err error) {
+	err = db.QueryRowContext(ctx, `SELECT mode, coalesce(message, '') FROM service_mode WHERE id = 1`).
+		Scan(&mode, &message)
+	if err == sql.ErrNoRows {
+		return modeAuto, "", nil
+	}
+	return mode, message, err
+}
+
+// startDegradedMonitor re-evaluates the mode every DEGRADED_CHECK_INTERVAL
+func startDegradedMonitor() {
+	ticker := time.NewTicker(degradedCheckInterval)
+	defer ticker.Stop()
+
+	failing, passing := 0, 0
+	for ; true; <-ticker.C {
+		runWithRecovery("degraded_monitor", nil, func() {
+			ctx := context.Background()
+			h := runHealthChecks(ctx)
+			if len(h.reasons()) > 0 {
+				failing, passing = failing+1, 0
+			} else {
+				failing, passing = 0, passing+1
+			}
+
+			mode, message, err := loadModeOverride(ctx)
+			if err != nil {
+				log.Printf("⚠️ Failed to load service mode override, keeping the current mode: %v", err)
+				return
+			}
+
+			prev := currentServiceState.Load()
+			next := &serviceState{Source: sourceManual, Message: message, Degraded: mode == modeDegraded}
+			if mode == modeAuto {
+				next.Source = modeAuto
+				next.Reasons = h.reasons()
+				switch {
+				case failing >= degradedThreshold:
+					next.Degraded = true
+				case passing >= degradedThreshold:
+					next.Degraded = false
+				default:
+					next.Degraded = prev.Degraded // not enough agreement yet to flip
+				}
+			}
+			if next.Degraded && next.Message == "" {
+				next.Message = degradedMessage
+			}
+			setServiceState(ctx, prev, next, "system")
+		})
+	}
+}
+
+// setServiceState publishes next, logging and auditing real transitions
+func setServiceState(ctx context.Context, prev, next *serviceState, actor string) {
+	next.Since = prev.Since
+	changed := prev.Degraded != next.Degraded || prev.Source != next.Source
+	if changed {
+		next.Since = time.Now()
+	}
+	currentServiceState.Store(next)
+	if next.Degraded {
+		degradedModeGauge.Set(1)
+	} else {
+		degradedModeGauge.Set(0)
+	}
+	if !changed {
+		return
+	}
+
+	state := modeNormal
+	if next.Degraded {
+		state = modeDegraded
+	}
+	degradedTransitions.WithLabelValues(state, next.Source).Inc()
+	log.Printf("🚧 Service mode is now %s (%s, by %s) %s", state, next.Source, actor, strings.Join(next.Reasons, ","))
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO service_mode_audit (state, source, reasons, message, actor)
+		VALUES ($1, $2, $3, $4, $5)`, state, next.Source, strings.Join(next.Reasons, ","), next.Message, actor)
+	if err != nil {
+		log.Printf("⚠️ Failed to audit service mode change: %v", err)
+	}
+}
+
+// requiresBroker refuses the route while the API is read-only
+func requiresBroker(c *gin.Context) {
+	s := currentServiceState.Load()
+	if !s.Degraded {
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", "30")
+	respondErrorDetails(c, codeUnavailable, s.Message, gin.H{"mode": modeDegraded, "reasons": s.Reasons})
+}
+
+// healthHandler handles GET /healthz; degraded is still 200 since reads are served
+func healthHandler(c *gin.Context) {
+	h := runHealthChecks(c.Request.Context())
+	s := currentServiceState.Load()
+	status, code := "ok", http.StatusOK
+	switch {
+	case h.Database != nil, h.Schema != nil:
+		status, code = "down", http.StatusServiceUnavailable
+	case s.Degraded:
+		status = "degraded"
+	}
+	c.JSON(code, gin.H{"status": status, "mode": s, "checks": h.report()})
+}
+
+// statusHandler handles GET /status, the public view of the service mode
+func statusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, currentServiceState.Load())
+}
+
+// getModeHandler handles GET /admin/mode with the override and recent transitions
+func getModeHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	mode, message, err := loadModeOverride(ctx)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load service mode")
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT state, source, reasons, coalesce(message, ''), actor, created_at
+		FROM service_mode_audit ORDER BY id DESC LIMIT 50`)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load service mode")
+		return
+	}
+	defer rows.Close()
+
+	history := []gin.H{}
+	for rows.Next() {
+		var state, source, reasons, msg, actor string
+		var at time.Time
+		if err := rows.Scan(&state, &source, &reasons, &msg, &actor, &at); err != nil {
+			respondError(c, codeInternal, "Failed to load service mode")
+			return
+		}
+		history = append(history, gin.H{"state": state, "source": source, "reasons": reasons,
+			"message": msg, "actor": actor, "at": at})
+	}
+	c.JSON(http.StatusOK, gin.H{"mode": mode, "message": message, "state": currentServiceState.Load(),
+		"history": history})
+}
+
+// setModeHandler handles PUT /admin/mode {"mode": "auto"|"degraded"|"normal", "message": ""}
+func setModeHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Mode    string `json:"mode"`
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	switch body.Mode {
+	case modeAuto, modeDegraded, modeNormal:
+	default:
+		fieldError(c, codeValidationFailed, "mode", "must be auto, degraded or normal")
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO service_mode (id, mode, message, updated_by, updated_at)
+		VALUES (1, $1, nullif($2, ''), $3, now())
+		ON CONFLICT (id) DO UPDATE
+		SET mode = EXCLUDED.mode, message = EXCLUDED.message, updated_by = EXCLUDED.updated_by, updated_at = now()`,
+		body.Mode, body.Message, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to set service mode: %v", err)
+		respondError(c, codeInternal, "Failed to set service mode")
+		return
+	}
+
+	// Apply here right away; other instances pick it up on their next check
+	prev := currentServiceState.Load()
+	next := &serviceState{Source: sourceManual, Degraded: body.Mode == modeDegraded, Message: body.Message}
+	if body.Mode == modeAuto {
+		next = &serviceState{Source: modeAuto, Degraded: prev.Degraded, Reasons: prev.Reasons, Message: prev.Message}
+	}
+	if next.Degraded && next.Message == "" {
+		next.Message = degradedMessage
+	}
+	setServiceState(ctx, prev, next, user.ID.String())
+	c.JSON(http.StatusOK, gin.H{"mode": body.Mode, "state": currentServiceState.Load()})
+}
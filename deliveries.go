@@ -0,0 +1,390 @@
+// deliveries.go
+// Persistent notification delivery queue: rows in notification_deliveries are claimed by
+// a polling worker, retried with backoff and dead-lettered after NOTIFY_MAX_ATTEMPTS
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	deliveryPending    = "pending"
+	deliveryDelivering = "delivering"
+	deliveryDelivered  = "delivered"
+	deliveryDead       = "dead"
+	deliveryHeld       = "held"     // waiting out the owner's quiet hours or a batch window
+	deliveryDigested   = "digested" // released as part of a digest or batch delivery
+)
+
+var (
+	deliveryPollInterval = getEnvDuration("NOTIFY_POLL_INTERVAL", 500*time.Millisecond)
+	deliveryBatchSize    = getEnvInt("NOTIFY_BATCH_SIZE", 200)
+	deliveryConcurrency  = getEnvInt("NOTIFY_WORKERS", 32)
+	// A claimed row whose worker died is picked up again after this long
+	deliveryClaimTimeout = getEnvDuration("NOTIFY_CLAIM_TIMEOUT", time.Minute)
+	deliveryRetention    = getEnvDuration("NOTIFY_DELIVERED_RETENTION", 7*24*time.Hour)
+
+	// Slack and Discord both allow roughly one message per second per webhook
+	webhookMinInterval = getEnvDuration("NOTIFY_MIN_INTERVAL", time.Second)
+	webhookLastSent    sync.Map // target -> time.Time
+)
+
+// Delivery is a queued notification; the target is stored encrypted and never returned
+type Delivery struct {
+	ID            int64        `json:"id"`
+	TargetType    string       `json:"target_type"`
+	Payload       Notification `json:"payload"`
+	Attempts      int          `json:"attempts"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+	Status        string       `json:"status"`
+	LastError     string       `json:"last_error,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+
+	target string
+}
+
+// heldDelivery holds a delivery until the end of quiet hours or a batch window; the zero
+// value sends it now. Held deliveries sharing a digestKey are released as one digest
+type heldDelivery struct {
+	until     time.Time
+	digestKey string
+	// join takes the release time of deliveries still held under digestKey, when there are
+	// any, over until (see notification_batches.go)
+	join bool
+}
+
+// enqueueDelivery persists a notification for the delivery worker. A repeated dedupeKey
+// is ignored, so a completion applied twice still notifies once. q is db, or the
+// transaction claiming the notification (see processed_effects.go). The payload's event_id
+// is fixed here, so every attempt at the delivery sends the same one
+func enqueueDelivery(ctx context.Context, q execer, targetType, target, dedupeKey string, n Notification, held heldDelivery) error {
+	enc, err := encryptSecret(target)
+	if err != nil {
+		return err
+	}
+	if n.EventID == "" {
+		n.EventID = newID()
+	}
+	payload, err := marshalDeliveryPayload(n)
+	if err != nil {
+		return err
+	}
+	status, due := deliveryPending, time.Now()
+	if !held.until.IsZero() {
+		status, due = deliveryHeld, held.until
+	}
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO notification_deliveries (target_type, target_enc, payload, dedupe_key, status, next_attempt_at, digest_key)
+		VALUES ($1, $2, $3, $4, $5, coalesce((
+			SELECT min(next_attempt_at) FROM notification_deliveries
+			WHERE $8 AND status = 'held' AND digest_key = $7 AND next_attempt_at > $9), $6), nullif($7, ''))
+		ON CONFLICT (dedupe_key) DO NOTHING`, targetType, enc, payload, dedupeKey, status, due, held.digestKey,
+		held.join, clock.Now())
+	return err
+}
+
+// marshalDeliveryPayload is the stored form of n: its prompts, batched and digested
+// ones included, are encrypted like generated_content's (prompt_encryption.go)
+func marshalDeliveryPayload(n Notification) ([]byte, error) {
+	if err := mapNotificationPrompts(&n, encryptPrompt); err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
+
+// unmarshalDeliveryPayload reads a payload stored by marshalDeliveryPayload
+func unmarshalDeliveryPayload(payload []byte, n *Notification) error {
+	if err := json.Unmarshal(payload, n); err != nil {
+		return err
+	}
+	return mapNotificationPrompts(n, decryptPrompt)
+}
+
+// mapNotificationPrompts replaces every prompt in n with f's result. Batch and digest
+// items are copied first, since n may share them with the caller
+func mapNotificationPrompts(n *Notification, f func(string) (string, error)) error {
+	var err error
+	if n.Prompt, err = f(n.Prompt); err != nil {
+		return err
+	}
+	for _, items := range []*[]Notification{&n.Batch, &n.Digest} {
+		if len(*items) == 0 {
+			continue
+		}
+		*items = append([]Notification(nil), *items...)
+		for i := range *items {
+			if err := mapNotificationPrompts(&(*items)[i], f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const deliveryColumns = `id, target_type, target_enc, payload, attempts, next_attempt_at, status,
+		       coalesce(last_error, ''), created_at`
+
+func scanDelivery(row rowScanner) (*Delivery, string, error) {
+	var d Delivery
+	var enc string
+	var payload []byte
+	err := row.Scan(&d.ID, &d.TargetType, &enc, &payload, &d.Attempts, &d.NextAttemptAt, &d.Status,
+		&d.LastError, &d.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := unmarshalDeliveryPayload(payload, &d.Payload); err != nil {
+		return nil, "", err
+	}
+	return &d, enc, nil
+}
+
+// claimDeliveries marks a batch of due rows as in flight. SKIP LOCKED lets every
+// instance poll at once without handing out the same row twice. An ordered row waits
+// until the earlier sequences of its order key are out (webhook_events.go)
+func claimDeliveries(ctx context.Context, limit int) ([]*Delivery, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE notification_deliveries SET status = 'delivering', claimed_until = now() + $2 * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM notification_deliveries d
+			WHERE ((d.status = 'pending' AND d.next_attempt_at <= now())
+			       OR (d.status = 'delivering' AND d.claimed_until < now()))
+			  AND (d.order_key IS NULL OR NOT EXISTS (
+				SELECT 1 FROM notification_deliveries e
+				WHERE e.order_key = d.order_key AND e.sequence < d.sequence
+				  AND e.status IN ('pending', 'delivering', 'held')))
+			ORDER BY d.next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING `+deliveryColumns, limit, deliveryClaimTimeout.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Delivery
+	for rows.Next() {
+		d, enc, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		if d.target, err = decryptSecret(enc); err != nil {
+			log.Printf("⚠️ Dead-lettering delivery %d with unreadable target: %v", d.ID, err)
+			finishDelivery(ctx, d, deliveryDead, err)
+			continue
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// startDeliveryWorker polls for due deliveries and sends up to NOTIFY_WORKERS at once. It
+// claims no more than there are free workers, so nothing claimed sits waiting for one
+// while its claim runs out and another instance sends it too
+func startDeliveryWorker() {
+	sem := make(chan struct{}, max(deliveryConcurrency, 1))
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	for range ticker.C {
+		runWithRecovery("delivery_worker", nil, func() {
+			ctx := context.Background()
+			releaseHeldDeliveries(ctx)
+			for {
+				// Only this loop takes slots, so they stay free until the batch is started
+				limit := min(deliveryBatchSize, cap(sem)-len(sem))
+				if limit == 0 {
+					break
+				}
+				batch, err := claimDeliveries(ctx, limit)
+				if err != nil {
+					log.Printf("❌ Failed to claim deliveries: %v", err)
+					return
+				}
+				for _, d := range batch {
+					d := d
+					sem <- struct{}{}
+					go func() {
+						defer func() { <-sem }()
+						runWithRecovery("delivery", map[string]string{"request_id": d.Payload.RequestID}, func() {
+							deliver(ctx, d)
+						})
+					}()
+				}
+				// A full batch means there's a backlog; keep draining without waiting a tick
+				if len(batch) < limit {
+					break
+				}
+			}
+			if time.Since(lastPrune) > time.Hour {
+				lastPrune = time.Now()
+				pruneDeliveries(ctx)
+			}
+		})
+	}
+}
+
+func deliver(ctx context.Context, d *Delivery) {
+	notifier, ok := notifiers[d.TargetType]
+	if !ok {
+		finishDelivery(ctx, d, deliveryDead, errors.New("unknown target type "+d.TargetType))
+		return
+	}
+
+	// Too soon for this webhook: push it back without spending an attempt
+	if last, ok := webhookLastSent.Load(d.target); ok {
+		if wait := webhookMinInterval - time.Since(last.(time.Time)); wait > 0 {
+			rescheduleDelivery(ctx, d, wait, nil)
+			return
+		}
+	}
+	webhookLastSent.Store(d.target, time.Now())
+
+	sendCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	err := notifier.Send(sendCtx, d.target, d.Payload)
+	cancel()
+	if err == nil {
+		notificationDeliveries.WithLabelValues(d.TargetType, "ok").Inc()
+		finishDelivery(ctx, d, deliveryDelivered, nil)
+		return
+	}
+
+	d.Attempts++
+	if d.Attempts >= notifyMaxAttempts || errors.Is(err, errNotifierUnconfigured) {
+		log.Printf("❌ Dead-lettering %s notification for %s after %d attempts: %v",
+			d.TargetType, d.Payload.RequestID, d.Attempts, err)
+		notificationDeliveries.WithLabelValues(d.TargetType, "failed").Inc()
+		finishDelivery(ctx, d, deliveryDead, err)
+		return
+	}
+
+	// Honor the advised delay when rate limited, otherwise back off exponentially with jitter
+	delay := time.Duration(1<<d.Attempts)*time.Second + time.Duration(rand.Intn(1000))*time.Millisecond
+	result := "retry"
+	var ra *retryAfterError
+	if errors.As(err, &ra) {
+		delay, result = ra.delay, "rate_limited"
+	}
+	notificationDeliveries.WithLabelValues(d.TargetType, result).Inc()
+	log.Printf("⚠️ %s notification for %s failed (%v), retrying in %s", d.TargetType, d.Payload.RequestID, err, delay)
+	rescheduleDelivery(ctx, d, delay, err)
+}
+
+func rescheduleDelivery(ctx context.Context, d *Delivery, delay time.Duration, cause error) {
+	var lastErr *string
+	if cause != nil {
+		msg := cause.Error()
+		lastErr = &msg
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE notification_deliveries
+		SET status = 'pending', attempts = $2, last_error = coalesce($3, last_error),
+		    next_attempt_at = now() + $4 * interval '1 millisecond', claimed_until = NULL
+		WHERE id = $1`, d.ID, d.Attempts, lastErr, delay.Milliseconds())
+	if err != nil {
+		log.Printf("❌ Failed to reschedule delivery %d: %v", d.ID, err)
+	}
+}
+
+func finishDelivery(ctx context.Context, d *Delivery, status string, cause error) {
+	var lastErr *string
+	if cause != nil {
+		msg := cause.Error()
+		lastErr = &msg
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE notification_deliveries
+		SET status = $2, attempts = $3, last_error = coalesce($4, last_error), claimed_until = NULL,
+		    finished_at = now()
+		WHERE id = $1`, d.ID, status, d.Attempts, lastErr)
+	if err != nil {
+		log.Printf("❌ Failed to record delivery %d as %s: %v", d.ID, status, err)
+	}
+}
+
+// pruneDeliveries drops delivered rows past NOTIFY_DELIVERED_RETENTION, and the webhook
+// event stages of requests quiet for as long; dead letters stay until an admin retries them
+func pruneDeliveries(ctx context.Context) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM webhook_event_stages WHERE updated_at < $1`,
+		time.Now().Add(-deliveryRetention)); err != nil {
+		log.Printf("❌ Failed to prune webhook event stages: %v", err)
+	}
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM notification_deliveries WHERE status = 'delivered' AND finished_at < $1`,
+		time.Now().Add(-deliveryRetention))
+	if err != nil {
+		log.Printf("❌ Failed to prune deliveries: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 Pruned %d delivered notifications", n)
+	}
+}
+
+// listDeliveriesHandler handles GET /admin/deliveries?status=dead&limit=
+func listDeliveriesHandler(c *gin.Context) {
+	status := c.DefaultQuery("status", deliveryDead)
+	switch status {
+	case deliveryPending, deliveryDelivering, deliveryDelivered, deliveryDead, deliveryHeld, deliveryDigested:
+	default:
+		fieldError(c, codeInvalidRequest, "status", "must be pending, delivering, delivered, dead, held or digested")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+deliveryColumns+` FROM notification_deliveries
+		WHERE status = $1 ORDER BY id DESC LIMIT $2`, status, limit)
+	if err != nil {
+		log.Printf("❌ Failed to list deliveries: %v", err)
+		respondError(c, codeInternal, "Failed to list deliveries")
+		return
+	}
+	defer rows.Close()
+
+	list := []*Delivery{}
+	for rows.Next() {
+		d, _, err := scanDelivery(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list deliveries")
+			return
+		}
+		list = append(list, d)
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": list})
+}
+
+// retryDeliveryHandler handles POST /admin/deliveries/:id/retry, giving a dead letter a
+// fresh set of attempts
+func retryDeliveryHandler(c *gin.Context) {
+	d, _, err := scanDelivery(db.QueryRowContext(c.Request.Context(), `
+		UPDATE notification_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = now(), finished_at = NULL
+		WHERE id = $1 AND status = 'dead'
+		RETURNING `+deliveryColumns, c.Param("id")))
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Dead-lettered delivery not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to retry delivery %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to retry delivery")
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
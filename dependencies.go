@@ -0,0 +1,253 @@
+// dependencies.go
+// Dependency checks. Before anything else starts, the backend checks everything it
+// depends on at once (Postgres and its schema, Redis, object storage, the broker
+// channels) and prints one report of what passed and what didn't, exiting if a required
+// dependency failed, so a mistyped address shows up at boot rather than as a 500 later.
+// Optional integrations (Sentry, FCM) that fail are reported and switched off instead.
+// `--skip-checks` starts without them, for local hacking. GET /readyz runs the same checks
+// on every probe
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var startupCheckTimeout = getEnvDuration("STARTUP_CHECK_TIMEOUT", 5*time.Second)
+
+// dependencyCheck checks one dependency. check returns a short detail on success;
+// disable switches off an optional one that failed
+type dependencyCheck struct {
+	name     string
+	required bool
+	check    func(ctx context.Context) (string, error)
+	disable  func()
+}
+
+// DependencyResult is one check's outcome, as reported at boot and on GET /readyz
+type DependencyResult struct {
+	Name      string  `json:"name"`
+	Required  bool    `json:"required"`
+	OK        bool    `json:"ok"`
+	Skipped   bool    `json:"skipped,omitempty"` // optional and not configured
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+}
+
+var errNotConfigured = errors.New("not configured")
+
+func dependencyChecks() []dependencyCheck {
+	return []dependencyCheck{
+		{name: "database", required: true, check: checkDatabase},
+		{name: "redis", required: true, check: checkRedis},
+		{name: "storage", required: true, check: checkStorage},
+		{name: "broker", required: true, check: checkBroker},
+		{name: "sentry", check: checkSentry, disable: disableSentry},
+		{name: "fcm", check: checkFCM, disable: func() { fcmDisabled = true }},
+	}
+}
+
+// runDependencyChecks runs every check concurrently, each within startupCheckTimeout
+func runDependencyChecks(ctx context.Context) []DependencyResult {
+	checks := dependencyChecks()
+	results := make([]DependencyResult, len(checks))
+	var wg sync.WaitGroup
+	for i, dc := range checks {
+		wg.Add(1)
+		go func(i int, dc dependencyCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, startupCheckTimeout)
+			defer cancel()
+			started := time.Now()
+			detail, err := dc.check(ctx)
+			r := DependencyResult{Name: dc.name, Required: dc.required, OK: err == nil, Detail: detail,
+				ElapsedMS: float64(time.Since(started).Microseconds()) / 1000}
+			switch {
+			case errors.Is(err, errNotConfigured):
+				r.OK, r.Skipped = true, true
+			case err != nil:
+				r.Error = err.Error()
+			}
+			results[i] = r
+		}(i, dc)
+	}
+	wg.Wait()
+	return results
+}
+
+// failedRequired names the required dependencies that failed
+func failedRequired(results []DependencyResult) []string {
+	var failed []string
+	for _, r := range results {
+		if r.Required && !r.OK {
+			failed = append(failed, r.Name)
+		}
+	}
+	return failed
+}
+
+// runStartupChecks is the startup phase: it reports every dependency, disables optional
+// ones that failed and exits if a required one did
+func runStartupChecks() {
+	if containsString(os.Args[1:], "--skip-checks") {
+		log.Println("⚠️ --skip-checks: starting without checking dependencies")
+		return
+	}
+	checks := dependencyChecks()
+	results := runDependencyChecks(context.Background())
+
+	attrs := make([]any, 0, len(results))
+	for i, r := range results {
+		group := []any{slog.Bool("ok", r.OK), slog.Bool("required", r.Required), slog.Float64("elapsed_ms", r.ElapsedMS)}
+		if r.Skipped {
+			group = append(group, slog.Bool("skipped", true))
+		}
+		if r.Detail != "" {
+			group = append(group, slog.String("detail", r.Detail))
+		}
+		if r.Error != "" {
+			group = append(group, slog.String("error", r.Error))
+			if !r.Required && checks[i].disable != nil {
+				checks[i].disable()
+				group = append(group, slog.Bool("disabled", true))
+			}
+		}
+		attrs = append(attrs, slog.Group(r.Name, group...))
+	}
+	failed := failedRequired(results)
+	level := slog.LevelInfo
+	if len(failed) > 0 {
+		level = slog.LevelError
+	}
+	slog.Log(context.Background(), level, "dependency checks", attrs...)
+
+	if len(failed) > 0 {
+		for _, r := range results {
+			if r.Required && !r.OK {
+				log.Printf("❌ %s: %s", r.Name, r.Error)
+			}
+		}
+		log.Fatalf("❌ Required dependencies failed: %s (start with --skip-checks to ignore)", strings.Join(failed, ", "))
+	}
+	log.Println("✅ Dependencies checked")
+}
+
+// readyHandler handles GET /readyz: 503 while a required dependency fails
+func readyHandler(c *gin.Context) {
+	results := runDependencyChecks(c.Request.Context())
+	status, code := "ready", http.StatusOK
+	if len(failedRequired(results)) > 0 {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"status": status, "checks": results})
+}
+
+// checkDatabase pings Postgres and checks its schema. A schema behind the binary passes
+// when AUTO_MIGRATE is about to bring it up to date
+func checkDatabase(ctx context.Context) (string, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return "", err
+	}
+	current, err := currentSchemaVersion(ctx)
+	if err != nil {
+		return "", fmt.Errorf("read schema version: %w", err)
+	}
+	detail := fmt.Sprintf("schema at %d", current)
+	if want := expectedSchemaVersion(); current < want {
+		if autoMigrateApplies() {
+			return fmt.Sprintf("%s, migrating to %d", detail, want), nil
+		}
+		return "", fmt.Errorf("%w: at %d, expects %d", errSchemaBehind, current, want)
+	}
+	return detail, nil
+}
+
+// checkRedis pings the Redis at REDIS_ADDR
+func checkRedis(ctx context.Context) (string, error) {
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return "", fmt.Errorf("%s: %w", redisAddr, err)
+	}
+	return "at " + redisAddr, nil
+}
+
+// checkStorage lists one object, which needs working credentials and the bucket
+func checkStorage(ctx context.Context) (string, error) {
+	_, _, err := storage.List(ctx, "", "", 1)
+	return "", err
+}
+
+// checkBroker subscribes to the completion channel, which a Redis ACL may deny where a
+// ping passes, and counts the workers subscribed to the image requests
+func checkBroker(ctx context.Context) (string, error) {
+	pubsub := rdb.Subscribe(ctx, completionChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return "", fmt.Errorf("subscribe %s: %w", completionChannel, err)
+	}
+	subs, err := rdb.PubSubNumSub(ctx, imageGenerationChannel).Result()
+	if err != nil {
+		return "", fmt.Errorf("count subscribers of %s: %w", imageGenerationChannel, err)
+	}
+	return fmt.Sprintf("%d subscribed to %s", subs[imageGenerationChannel], imageGenerationChannel), nil
+}
+
+// checkSentry reaches the host in SENTRY_DSN
+func checkSentry(ctx context.Context) (string, error) {
+	dsn := getEnv("SENTRY_DSN", "")
+	if dsn == "" {
+		return "", errNotConfigured
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.Host == "" {
+		return "", errors.New("SENTRY_DSN is not a valid DSN")
+	}
+	return u.Hostname(), dialHost(ctx, u)
+}
+
+// disableSentry falls back to the log reporter
+func disableSentry() {
+	errorReporter = newDedupReporter(logReporter{}, errorReportDedupWindow)
+}
+
+// checkFCM needs both FCM settings once either is set, and reaches the API
+func checkFCM(ctx context.Context) (string, error) {
+	if fcmProjectID == "" && fcmAccessToken == "" {
+		return "", errNotConfigured
+	}
+	if fcmProjectID == "" || fcmAccessToken == "" {
+		return "", errors.New("FCM_PROJECT_ID and FCM_ACCESS_TOKEN must both be set")
+	}
+	u, _ := url.Parse("https://fcm.googleapis.com")
+	return fcmProjectID, dialHost(ctx, u)
+}
+
+// dialHost opens and closes a TCP connection to u's host
+func dialHost(ctx context.Context, u *url.URL) error {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
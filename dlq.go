@@ -0,0 +1,507 @@
+// dlq.go
+// Dead letters for listener messages that couldn't be applied: unparseable payloads,
+// completions whose database write failed and handler panics. Entries are kept for
+// DLQ_RETENTION and capped at DLQ_MAX_ENTRIES; replaying one runs it through the same
+// path the listener uses, so a fix deployed since applies to it
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	completionChannel = "image_generation_complete"
+
+	// Error classes
+	dlqDecode     = "decode"     // the payload didn't parse
+	dlqDecompress = "decompress" // a compressed payload didn't unpack
+	dlqApply      = "apply"      // the handler returned an error
+	dlqPanic      = "panic"      // the handler panicked
+	// A completion's database write hit a constraint or data error (see db_retry.go)
+	dlqConstraint = "constraint"
+	// A completion's database write kept failing transiently for COMPLETION_RETRY_BUDGET
+	dlqDBUnavailable = "db_unavailable"
+	// A completion's row changed owner under it (see ownership.go)
+	dlqOwnerMismatch = "owner_mismatch"
+
+	dlqBulkMax = 5000
+)
+
+var (
+	dlqRetention     = getEnvDuration("DLQ_RETENTION", 14*24*time.Hour)
+	dlqMaxEntries    = getEnvInt("DLQ_MAX_ENTRIES", 100000)
+	dlqPruneInterval = getEnvDuration("DLQ_PRUNE_INTERVAL", 10*time.Minute)
+
+	deadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_dead_letters_total",
+		Help: "Listener messages dead-lettered, by channel and error class.",
+	}, []string{"channel", "error_class"})
+	dlqDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_dlq_depth",
+		Help: "Dead letters neither replayed nor discarded, by channel and error class.",
+	}, []string{"channel", "error_class"})
+	dlqOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_dlq_oldest_age_seconds",
+		Help: "Age of the oldest pending dead letter; 0 when there are none.",
+	})
+	dlqReplays = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_dlq_replays_total",
+		Help: "Dead-letter replays by result (applied, failed).",
+	}, []string{"result"})
+)
+
+// dlqReplayers applies a payload from each channel the way its listener would, keyed by
+// the channel's name without its tenant prefix. Channels without one can be
+// dead-lettered and discarded but not replayed
+var dlqReplayers = map[string]func(tenantID, payload string) (effects *completionEffects, errorClass string, err error){
+	completionChannel: replayCompletion,
+}
+
+// DeadLetter is one dead_letters row
+type DeadLetter struct {
+	ID          int64      `json:"id"`
+	Channel     string     `json:"channel"`
+	ErrorClass  string     `json:"error_class"`
+	Error       string     `json:"error"`
+	RequestID   string     `json:"request_id,omitempty"`
+	Payload     string     `json:"payload"`
+	Replays     int        `json:"replays"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReplayedAt  *time.Time `json:"replayed_at,omitempty"`
+	DiscardedAt *time.Time `json:"discarded_at,omitempty"`
+}
+
+// deadLetter stores a message that couldn't be applied. It never fails the caller: a
+// message that can't even be dead-lettered is logged with its payload
+func deadLetter(ctx context.Context, channel, payload, errorClass, requestID string, cause error) {
+	deadLettered.WithLabelValues(channel, errorClass).Inc()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO dead_letters (channel, error_class, error, request_id, payload)
+		VALUES ($1, $2, $3, nullif($4, ''), $5)`, channel, errorClass, cause.Error(), requestID, payload); err != nil {
+		log.Printf("❌ Failed to dead-letter %s message (%s: %v): %v; payload: %s",
+			channel, errorClass, cause, err, redactPromptFields(payload))
+		return
+	}
+	log.Printf("🪦 Dead-lettered %s message for %q (%s): %v", channel, requestID, errorClass, cause)
+}
+
+// deadLetterCompletion stores a decoded completion that failed to apply
+func deadLetterCompletion(ctx context.Context, completion ImageGenerationCompletion, errorClass string, cause error) {
+	payload, _ := json.Marshal(completion)
+	deadLetter(ctx, tenantKey(completion.Tenant, completionChannel), string(payload), errorClass, completion.RequestID, cause)
+}
+
+// applyCompletion runs handleCompletion under recovery. Transient database failures are
+// retried, first in place and then from the retry buffer; anything else is dead-lettered
+func applyCompletion(where string, completion ImageGenerationCompletion) {
+	countCompletion(completion)
+	ctx := context.Background()
+	panicked, err := runCompletion(where, completion)
+	if !panicked && err != nil {
+		panicked, err = retryCompletionInline(where, completion, err)
+	}
+	switch {
+	case panicked:
+		deadLetterCompletion(ctx, completion, dlqPanic, errors.New("handler panicked"))
+	case err == nil:
+	case dbErrorClass(err) == dbErrTransient:
+		log.Printf("⏳ Database unavailable for completion %s, buffering it for retry: %v", completion.RequestID, err)
+		completionDBRetries.WithLabelValues("buffered").Inc()
+		if !bufferCompletionRetry(ctx, bufferedCompletion{Completion: completion, FirstFailedAt: time.Now(),
+			LastError: err.Error()}) {
+			deadLetterCompletion(ctx, completion, dlqDBUnavailable, err)
+		}
+	default:
+		deadLetterCompletion(ctx, completion, completionErrorClass(err), err)
+	}
+}
+
+// runCompletion is one attempt at handleCompletion, under recovery
+func runCompletion(where string, completion ImageGenerationCompletion) (panicked bool, err error) {
+	_, panicked, err = runCompletionEffects(where, completion)
+	return panicked, err
+}
+
+// runCompletionEffects is runCompletion reporting what the attempt did with each side
+// effect; fx is nil when it panicked
+func runCompletionEffects(where string, completion ImageGenerationCompletion) (fx *completionEffects, panicked bool, err error) {
+	panicked = runWithRecovery(where, map[string]string{"request_id": completion.RequestID}, func() {
+		fx, err = handleCompletion(completion)
+	})
+	if panicked {
+		fx = nil
+	}
+	return fx, panicked, err
+}
+
+// decodeErrorClass tells a corrupt compressed payload from one that isn't JSON
+func decodeErrorClass(err error) string {
+	if errors.Is(err, errCorruptCompressed) {
+		return dlqDecompress
+	}
+	return dlqDecode
+}
+
+// replayCompletion decodes and applies a completion as the listener does, reporting
+// which side effects it applied and which an earlier run already had
+func replayCompletion(tenantID, payload string) (*completionEffects, string, error) {
+	var completion ImageGenerationCompletion
+	if err := decodeWorkerMessage("completion", []byte(payload), &completion); err != nil {
+		return nil, decodeErrorClass(err), err
+	}
+	completion.Tenant = tenantID
+	countCompletion(completion)
+	fx, panicked, err := runCompletionEffects("dlq_replay", completion)
+	if panicked {
+		return nil, dlqPanic, errors.New("handler panicked")
+	} else if err != nil {
+		return fx, completionErrorClass(err), err
+	}
+	return fx, "", nil
+}
+
+// startDLQMaintenance prunes dead letters past retention or over the cap and refreshes
+// the depth metrics. Every instance runs it; the work is idempotent
+func startDLQMaintenance() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for range ticker.C {
+		runWithRecovery("dlq_maintenance", nil, func() {
+			ctx := context.Background()
+			if time.Since(lastPrune) >= dlqPruneInterval {
+				pruneDeadLetters(ctx)
+				lastPrune = time.Now()
+			}
+			refreshDLQMetrics(ctx)
+		})
+	}
+}
+
+func pruneDeadLetters(ctx context.Context) {
+	res, err := db.ExecContext(ctx, `
+		DELETE FROM dead_letters
+		WHERE created_at < $1
+		   OR id <= (SELECT id FROM dead_letters ORDER BY id DESC OFFSET $2 LIMIT 1)`,
+		time.Now().Add(-dlqRetention), dlqMaxEntries)
+	if err != nil {
+		log.Printf("❌ Failed to prune dead letters: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🧹 Pruned %d dead letters", n)
+	}
+}
+
+// DLQDepth is the pending dead letters of one channel and error class
+type DLQDepth struct {
+	Channel          string  `json:"channel"`
+	ErrorClass       string  `json:"error_class"`
+	Pending          int64   `json:"pending"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+// pendingDeadLetters counts what is waiting for a replay or discard, for the metrics and
+// the status page
+func pendingDeadLetters(ctx context.Context) ([]DLQDepth, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT channel, error_class, count(*), extract(epoch FROM now() - min(created_at))
+		FROM dead_letters WHERE replayed_at IS NULL AND discarded_at IS NULL
+		GROUP BY channel, error_class ORDER BY channel, error_class`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []DLQDepth{}
+	for rows.Next() {
+		var d DLQDepth
+		if err := rows.Scan(&d.Channel, &d.ErrorClass, &d.Pending, &d.OldestAgeSeconds); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+func refreshDLQMetrics(ctx context.Context) {
+	list, err := pendingDeadLetters(ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to measure the dead-letter queue: %v", err)
+		return
+	}
+	dlqDepth.Reset()
+	oldest := 0.0
+	for _, d := range list {
+		dlqDepth.WithLabelValues(d.Channel, d.ErrorClass).Set(float64(d.Pending))
+		oldest = max(oldest, d.OldestAgeSeconds)
+	}
+	dlqOldestAge.Set(oldest)
+}
+
+func auditDeadLetter(ctx context.Context, id int64, action, actor string, detail interface{}) {
+	data, _ := json.Marshal(detail)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO dead_letter_audit (dead_letter_id, action, actor, detail) VALUES ($1, $2, $3, $4)`,
+		id, action, actor, data); err != nil {
+		log.Printf("⚠️ Failed to audit %s of dead letter %d: %v", action, id, err)
+	}
+}
+
+const deadLetterColumns = `id, channel, error_class, error, coalesce(request_id, ''), payload, replays, created_at,
+	       replayed_at, discarded_at`
+
+func scanDeadLetter(row rowScanner) (*DeadLetter, error) {
+	var d DeadLetter
+	err := row.Scan(&d.ID, &d.Channel, &d.ErrorClass, &d.Error, &d.RequestID, &d.Payload, &d.Replays, &d.CreatedAt,
+		&d.ReplayedAt, &d.DiscardedAt)
+	return &d, err
+}
+
+// dlqFilter selects dead letters for listing and bulk replay
+type dlqFilter struct {
+	Status     string `json:"status" form:"status"` // pending (default), replayed, discarded or all
+	Channel    string `json:"channel" form:"channel"`
+	ErrorClass string `json:"error_class" form:"error_class"`
+	RequestID  string `json:"request_id" form:"request_id"`
+}
+
+func (f *dlqFilter) validate() (field, msg string) {
+	switch f.Status {
+	case "":
+		f.Status = "pending"
+	case "pending", "replayed", "discarded", "all":
+	default:
+		return "status", "must be pending, replayed, discarded or all"
+	}
+	switch f.ErrorClass {
+	case "", dlqDecode, dlqDecompress, dlqApply, dlqPanic, dlqConstraint, dlqDBUnavailable:
+	default:
+		return "error_class", "must be decode, decompress, apply, panic, constraint or db_unavailable"
+	}
+	return "", ""
+}
+
+// where is the filter's SQL condition; its arguments are $1-$4
+func (f dlqFilter) where() (string, []interface{}) {
+	return `($1 = 'all'
+	         OR ($1 = 'pending' AND replayed_at IS NULL AND discarded_at IS NULL)
+	         OR ($1 = 'replayed' AND replayed_at IS NOT NULL)
+	         OR ($1 = 'discarded' AND discarded_at IS NOT NULL))
+	    AND ($2 = '' OR channel = $2) AND ($3 = '' OR error_class = $3) AND ($4 = '' OR request_id = $4)`,
+		[]interface{}{f.Status, f.Channel, f.ErrorClass, f.RequestID}
+}
+
+// listDLQHandler handles GET /admin/dlq?status=&channel=&error_class=&request_id=&before=&limit=,
+// newest first. before is the next_cursor of the previous page
+func listDLQHandler(c *gin.Context) {
+	var f dlqFilter
+	if err := c.ShouldBindQuery(&f); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid query")
+		return
+	}
+	if field, msg := f.validate(); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+	before, _ := strconv.ParseInt(c.Query("before"), 10, 64)
+
+	cond, args := f.where()
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+deadLetterColumns+` FROM dead_letters
+		WHERE `+cond+` AND ($5 = 0 OR id < $5)
+		ORDER BY id DESC LIMIT $6`, append(args, before, limit)...)
+	if err != nil {
+		log.Printf("❌ Failed to list dead letters: %v", err)
+		respondError(c, codeInternal, "Failed to list dead letters")
+		return
+	}
+	defer rows.Close()
+
+	list := []*DeadLetter{}
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list dead letters")
+			return
+		}
+		list = append(list, d)
+	}
+	resp := gin.H{"entries": list}
+	if len(list) == limit {
+		resp["next_cursor"] = strconv.FormatInt(list[len(list)-1].ID, 10)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// replayDeadLetter applies one pending entry and records the outcome: replayed on
+// success, otherwise the new error stays on the entry for the next attempt. effects says
+// what the replay did with each side effect, skipping those done before it
+func replayDeadLetter(ctx context.Context, d *DeadLetter, actor string) (effects *completionEffects, err error) {
+	tenantID, base := tenantOfChannel(d.Channel)
+	replay, ok := dlqReplayers[base]
+	if !ok {
+		return nil, fmt.Errorf("%s messages can't be replayed", d.Channel)
+	}
+	effects, class, err := replay(tenantID, d.Payload)
+	if err != nil {
+		dlqReplays.WithLabelValues("failed").Inc()
+		db.ExecContext(ctx, `UPDATE dead_letters SET replays = replays + 1, error_class = $2, error = $3 WHERE id = $1`,
+			d.ID, class, err.Error())
+		auditDeadLetter(ctx, d.ID, "replay_failed", actor, gin.H{"error": err.Error(), "effects": effects})
+		return effects, err
+	}
+	dlqReplays.WithLabelValues("applied").Inc()
+	db.ExecContext(ctx, `UPDATE dead_letters SET replays = replays + 1, replayed_at = now() WHERE id = $1`, d.ID)
+	auditDeadLetter(ctx, d.ID, "replayed", actor, gin.H{"effects": effects})
+	return effects, nil
+}
+
+// findPendingDeadLetter loads :id if it is neither replayed nor discarded
+func findPendingDeadLetter(c *gin.Context) (*DeadLetter, bool) {
+	d, err := scanDeadLetter(db.QueryRowContext(c.Request.Context(), `
+		SELECT `+deadLetterColumns+` FROM dead_letters WHERE id::text = $1`, c.Param("id")))
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Dead letter not found")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load dead letter %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load dead letter")
+		return nil, false
+	}
+	if d.ReplayedAt != nil || d.DiscardedAt != nil {
+		respondError(c, codeConflict, "Dead letter was already replayed or discarded")
+		return nil, false
+	}
+	return d, true
+}
+
+// replayDLQHandler handles POST /admin/dlq/:id/replay
+func replayDLQHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	d, ok := findPendingDeadLetter(c)
+	if !ok {
+		return
+	}
+	effects, err := replayDeadLetter(c.Request.Context(), d, admin.ID.String())
+	if err != nil {
+		respondErrorDetails(c, codeUpstreamFailed, "Replay failed", gin.H{"id": d.ID, "error": err.Error(), "effects": effects})
+		return
+	}
+	log.Printf("⏪ Dead letter %d replayed by %s", d.ID, admin.ID)
+	c.JSON(http.StatusOK, gin.H{"id": d.ID, "replayed": true, "effects": effects})
+}
+
+// discardDLQHandler handles POST /admin/dlq/:id/discard {"reason": "..."}; the entry stays
+// until retention removes it
+func discardDLQHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, codeInvalidRequest, "Invalid JSON format")
+			return
+		}
+	}
+	d, ok := findPendingDeadLetter(c)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(c.Request.Context(), `UPDATE dead_letters SET discarded_at = now() WHERE id = $1`, d.ID); err != nil {
+		respondError(c, codeInternal, "Failed to discard dead letter")
+		return
+	}
+	auditDeadLetter(c.Request.Context(), d.ID, "discarded", admin.ID.String(), gin.H{"reason": body.Reason})
+	c.JSON(http.StatusOK, gin.H{"id": d.ID, "discarded": true})
+}
+
+// bulkReplayDLQHandler handles POST /admin/dlq/replay with a filter, oldest first and at
+// most limit entries. dry_run only reports what would be replayed
+func bulkReplayDLQHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	var body struct {
+		dlqFilter
+		Limit  int  `json:"limit"`
+		DryRun bool `json:"dry_run"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if body.Status != "" && body.Status != "pending" {
+		fieldError(c, codeValidationFailed, "status", "only pending entries can be replayed")
+		return
+	}
+	if field, msg := body.validate(); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	if body.Limit < 1 || body.Limit > dlqBulkMax {
+		body.Limit = dlqBulkMax
+	}
+
+	cond, args := body.where()
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+deadLetterColumns+` FROM dead_letters WHERE `+cond+` ORDER BY id LIMIT $5`,
+		append(args, body.Limit)...)
+	if err != nil {
+		log.Printf("❌ Failed to select dead letters for replay: %v", err)
+		respondError(c, codeInternal, "Failed to replay dead letters")
+		return
+	}
+	var entries []*DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			rows.Close()
+			respondError(c, codeInternal, "Failed to replay dead letters")
+			return
+		}
+		entries = append(entries, d)
+	}
+	rows.Close()
+
+	ids := make([]int64, 0, len(entries))
+	for _, d := range entries {
+		ids = append(ids, d.ID)
+	}
+	if body.DryRun {
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "matched": len(entries), "ids": ids})
+		return
+	}
+
+	applied, replayed, failed := 0, []gin.H{}, []gin.H{}
+	for _, d := range entries {
+		effects, err := replayDeadLetter(ctx, d, admin.ID.String())
+		if err != nil {
+			failed = append(failed, gin.H{"id": d.ID, "error": err.Error(), "effects": effects})
+			continue
+		}
+		applied++
+		replayed = append(replayed, gin.H{"id": d.ID, "effects": effects})
+	}
+	log.Printf("⏪ Bulk replay by %s: %d applied, %d failed", admin.ID, applied, len(failed))
+	c.JSON(http.StatusOK, gin.H{"matched": len(entries), "applied": applied, "replayed": replayed, "failed": failed})
+}
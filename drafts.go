@@ -0,0 +1,197 @@
+// drafts.go
+// Prompt drafts the compose screen autosaves, so a long prompt survives the app
+// restarting. A user keeps up to DRAFT_LIMIT named drafts in one Redis hash; each lasts
+// DRAFT_TTL from its last save and none are kept in Postgres. PUT /drafts saves one,
+// GET /drafts lists them newest first for the app to restore on launch, and a generation
+// submitted with draft_id clears its draft once it's accepted. Drafts are bounded in
+// size like any request body, and only ever read or written under the caller's own key
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	draftTTL       = getEnvDuration("DRAFT_TTL", 7*24*time.Hour)
+	draftLimit     = getEnvInt("DRAFT_LIMIT", 5)
+	draftMaxParams = getEnvInt("DRAFT_MAX_PARAMS_BYTES", 4096)
+
+	draftIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+const draftMaxName = 64 // characters
+
+func draftsKey(userID string) string { return "drafts:" + userID }
+
+// saveDraftScript stores a draft unless it would be one too many, and keeps the hash
+// around for the TTL after the latest save
+var saveDraftScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 and redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1`)
+
+// Draft is one saved prompt; Params holds whatever generation parameters the compose
+// screen had set, as a JSON object
+type Draft struct {
+	ID        string          `json:"draft_id"`
+	Name      string          `json:"name,omitempty"`
+	Prompt    string          `json:"prompt"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// validDraftID reports whether a client-chosen draft_id is acceptable; empty is none
+func validDraftID(id string) bool {
+	return id == "" || draftIDPattern.MatchString(id)
+}
+
+// loadDrafts returns userID's live drafts, newest first, dropping expired ones
+func loadDrafts(ctx context.Context, userID string) ([]Draft, error) {
+	raw, err := rdb.HGetAll(ctx, draftsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	drafts := make([]Draft, 0, len(raw))
+	var stale []string
+	cutoff := clock.Now().Add(-draftTTL)
+	for id, data := range raw {
+		var d Draft
+		if json.Unmarshal([]byte(data), &d) != nil || d.UpdatedAt.Before(cutoff) {
+			stale = append(stale, id)
+			continue
+		}
+		drafts = append(drafts, d)
+	}
+	if len(stale) > 0 {
+		if err := rdb.HDel(ctx, draftsKey(userID), stale...).Err(); err != nil {
+			log.Printf("⚠️ Failed to drop expired drafts of %s: %v", userID, err)
+		}
+	}
+	sort.Slice(drafts, func(i, j int) bool { return drafts[i].UpdatedAt.After(drafts[j].UpdatedAt) })
+	return drafts, nil
+}
+
+// clearDraft deletes one of userID's drafts; a missing one is not an error
+func clearDraft(ctx context.Context, userID, draftID string) error {
+	return rdb.HDel(ctx, draftsKey(userID), draftID).Err()
+}
+
+// listDraftsHandler handles GET /drafts
+func listDraftsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	drafts, err := loadDrafts(c.Request.Context(), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load drafts of %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to load drafts")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"drafts": drafts, "limit": draftLimit})
+}
+
+// saveDraftHandler handles PUT /drafts {"draft_id", "name", "prompt", "params"}, replacing
+// the draft with that ID; without one a new draft is started
+func saveDraftHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var d Draft
+	if err := c.ShouldBindJSON(&d); err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, codeRequestTooLarge, "Request body too large")
+			return
+		}
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	switch {
+	case !validDraftID(d.ID):
+		fieldError(c, codeValidationFailed, "draft_id", "must be at most 64 letters, digits, dashes or underscores")
+		return
+	case !utf8.ValidString(d.Name) || utf8.RuneCountInString(d.Name) > draftMaxName:
+		fieldError(c, codeValidationFailed, "name", "must be at most 64 characters")
+		return
+	case !utf8.ValidString(d.Prompt) || utf8.RuneCountInString(d.Prompt) > maxPromptLength:
+		fieldError(c, codeValidationFailed, "prompt", "must be valid text no longer than a prompt")
+		return
+	case len(d.Params) > draftMaxParams:
+		fieldError(c, codeValidationFailed, "params", "too large")
+		return
+	}
+	if len(d.Params) > 0 && string(d.Params) != "null" {
+		var params map[string]interface{}
+		if err := json.Unmarshal(d.Params, &params); err != nil {
+			fieldError(c, codeValidationFailed, "params", "must be an object")
+			return
+		}
+	} else {
+		d.Params = nil
+	}
+	if d.ID == "" {
+		d.ID = newID()
+	}
+	d.UpdatedAt = clock.Now().UTC()
+
+	ctx := c.Request.Context()
+	userID := user.ID.String()
+	// Drops expired drafts first, so they don't count against the limit
+	if _, err := loadDrafts(ctx, userID); err != nil {
+		log.Printf("❌ Failed to load drafts of %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to save draft")
+		return
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to save draft")
+		return
+	}
+	saved, err := saveDraftScript.Run(ctx, rdb, []string{draftsKey(userID)}, d.ID, data, draftLimit, draftTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Printf("❌ Failed to save draft %s of %s: %v", d.ID, user.ID, err)
+		respondError(c, codeInternal, "Failed to save draft")
+		return
+	}
+	if saved == 0 {
+		respondErrorDetails(c, codeConflict, "You already have the most drafts you can keep; delete one first",
+			gin.H{"limit": draftLimit})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// deleteDraftHandler handles DELETE /drafts/:id
+func deleteDraftHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	if !validDraftID(c.Param("id")) {
+		fieldError(c, codeValidationFailed, "draft_id", "must be at most 64 letters, digits, dashes or underscores")
+		return
+	}
+	if err := clearDraft(c.Request.Context(), user.ID.String(), c.Param("id")); err != nil {
+		log.Printf("❌ Failed to delete draft %s of %s: %v", c.Param("id"), user.ID, err)
+		respondError(c, codeInternal, "Failed to delete draft")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// clearSubmittedDraft clears the draft a generation request was composed in, once the
+// request has been accepted
+func clearSubmittedDraft(c *gin.Context, userID, draftID string) {
+	if draftID == "" || c.Writer.Status() >= http.StatusMultipleChoices {
+		return
+	}
+	if err := clearDraft(c.Request.Context(), userID, draftID); err != nil {
+		log.Printf("⚠️ Failed to clear draft %s of %s after submitting it: %v", draftID, userID, err)
+	}
+}
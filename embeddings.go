@@ -0,0 +1,292 @@
+// embeddings.go
+// Prompt embeddings for GET /generations/:id/similar. Completions only enqueue a job;
+// a separate worker embeds and retries, so the embedding service being down never
+// touches the generation path. The "embed_prompts" backfill covers older rows
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	embeddingPollInterval = getEnvDuration("EMBEDDING_POLL_INTERVAL", 5*time.Second)
+	embeddingMaxAttempts  = getEnvInt("EMBEDDING_MAX_ATTEMPTS", 8)
+	embeddingBatchSize    = 20
+
+	errEmbeddingsDisabled = errors.New("embeddings are not configured")
+)
+
+var embeddingResults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_prompt_embeddings_total",
+	Help: "Prompt embedding attempts by result (stored, retry, given_up).",
+}, []string{"result"})
+
+// Embedder turns a prompt into a vector. Vectors from one embedder must be comparable
+// with each other; switching models means clearing prompt_embedding and backfilling
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// embedder is set from EMBEDDING_SERVICE_URL; without it the feature is off
+var embedder Embedder = newEmbedder(getEnv("EMBEDDING_SERVICE_URL", ""))
+
+func newEmbedder(url string) Embedder {
+	if url == "" {
+		return noopEmbedder{}
+	}
+	return &httpEmbedder{url: url, apiKey: getEnv("EMBEDDING_SERVICE_KEY", "")}
+}
+
+// noopEmbedder disables similar generations
+type noopEmbedder struct{}
+
+func (noopEmbedder) Embed(context.Context, string) ([]float32, error) {
+	return nil, errEmbeddingsDisabled
+}
+
+func embeddingsEnabled() bool {
+	_, off := embedder.(noopEmbedder)
+	return !off
+}
+
+// httpEmbedder calls the embedding service: {"input": text} -> {"embedding": [...]}
+type httpEmbedder struct {
+	url, apiKey string
+}
+
+func (e *httpEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	var out struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	if err := postJSON(ctx, e.url, e.apiKey, map[string]string{"input": text}, &out); err != nil {
+		return nil, err
+	}
+	if len(out.Embedding) == 0 {
+		return nil, errors.New("embedding service returned an empty vector")
+	}
+	return out.Embedding, nil
+}
+
+// vectorLiteral formats v as pgvector text input, e.g. "[0.1,0.2]"
+func vectorLiteral(v []float32) string {
+	parts := make([]string, len(v))
+	for i, f := range v {
+		parts[i] = strconv.FormatFloat(float64(f), 'g', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// enqueueEmbedding asks the worker to embed a completed row's prompt, on q. Failing to
+// enqueue only costs the row its similar results until the backfill runs
+func enqueueEmbedding(ctx context.Context, q execer, requestID string) error {
+	if !embeddingsEnabled() {
+		return nil
+	}
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO embedding_jobs (request_id) VALUES ($1) ON CONFLICT (request_id) DO NOTHING`, requestID)
+	return err
+}
+
+// embedGeneration embeds the row's original prompt and stores it; idempotent
+func embedGeneration(ctx context.Context, requestID string) error {
+	var prompt string
+	err := db.QueryRowContext(ctx, `
+		SELECT coalesce(nullif(original_prompt, ''), prompt) FROM generated_content WHERE request_id = $1`,
+		requestID).Scan(&prompt)
+	if err == sql.ErrNoRows {
+		return nil // purged since
+	}
+	if err != nil {
+		return err
+	}
+	if err := decryptPrompts(&prompt); err != nil {
+		return err
+	}
+	vec, err := embedder.Embed(ctx, prompt)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `UPDATE generated_content SET prompt_embedding = $1::vector WHERE request_id = $2`,
+		vectorLiteral(vec), requestID)
+	return err
+}
+
+// startEmbeddingWorker works the embedding queue, backing off per job on failure
+// Only started when embeddings are enabled
+func startEmbeddingWorker() {
+	ticker := time.NewTicker(embeddingPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("embedding_worker", nil, func() {
+			processEmbeddingJobs(context.Background())
+		})
+	}
+}
+
+func processEmbeddingJobs(ctx context.Context) {
+	// SKIP LOCKED plus a lease lets every instance poll without embedding a row twice
+	rows, err := db.QueryContext(ctx, `
+		UPDATE embedding_jobs SET next_attempt_at = now() + interval '5 minutes', attempts = attempts + 1
+		WHERE request_id IN (
+			SELECT request_id FROM embedding_jobs
+			WHERE next_attempt_at <= now() AND attempts < $2
+			ORDER BY next_attempt_at LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING request_id, attempts`, embeddingBatchSize, embeddingMaxAttempts)
+	if err != nil {
+		log.Printf("❌ Failed to claim embedding jobs: %v", err)
+		return
+	}
+	type job struct {
+		requestID string
+		attempts  int
+	}
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.requestID, &j.attempts); err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+	rows.Close()
+
+	for _, j := range jobs {
+		err := embedGeneration(ctx, j.requestID)
+		if err == nil {
+			embeddingResults.WithLabelValues("stored").Inc()
+			db.ExecContext(ctx, `DELETE FROM embedding_jobs WHERE request_id = $1`, j.requestID)
+			continue
+		}
+		if j.attempts >= embeddingMaxAttempts {
+			// Left in the table with its error; the backfill picks the row up again
+			embeddingResults.WithLabelValues("given_up").Inc()
+			log.Printf("⚠️ Giving up embedding the prompt of %s after %d attempts: %v", j.requestID, j.attempts, err)
+		} else {
+			embeddingResults.WithLabelValues("retry").Inc()
+		}
+		delay := min(time.Duration(1<<min(j.attempts, 10))*time.Minute, 6*time.Hour)
+		db.ExecContext(ctx, `
+			UPDATE embedding_jobs SET last_error = $2, next_attempt_at = now() + $3 * interval '1 millisecond'
+			WHERE request_id = $1`, j.requestID, err.Error(), delay.Milliseconds())
+	}
+}
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        "embed_prompts",
+		Description: "Embed the prompts of completed generations for similar-generation search",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			if !embeddingsEnabled() {
+				return nil, nil
+			}
+			return queryKeys(ctx, `
+				SELECT request_id FROM generated_content
+				WHERE request_id > $1 AND status = 'completed' AND prompt_embedding IS NULL AND pruned_at IS NULL
+				ORDER BY request_id LIMIT $2`, cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			var n int64
+			err := db.QueryRowContext(ctx, `
+				SELECT count(*) FROM generated_content
+				WHERE status = 'completed' AND prompt_embedding IS NULL AND pruned_at IS NULL`).Scan(&n)
+			return n, err
+		},
+		Process: func(ctx context.Context, requestID string) error {
+			if err := embedGeneration(ctx, requestID); err != nil {
+				return err
+			}
+			_, err := db.ExecContext(ctx, `DELETE FROM embedding_jobs WHERE request_id = $1`, requestID)
+			return err
+		},
+	})
+}
+
+// similarGenerationsHandler handles GET /generations/:id/similar?limit=, the user's own
+// completed generations nearest to this one's prompt, closest first
+func similarGenerationsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	if !embeddingsEnabled() {
+		respondError(c, codeUnavailable, "Similar generations are not enabled")
+		return
+	}
+	size, ok := sizeParam(c, renditionThumbnail)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > 50 {
+		limit = 10
+	}
+
+	var embedded bool
+	err = db.QueryRowContext(ctx, `
+		SELECT prompt_embedding IS NOT NULL FROM generated_content
+		WHERE request_id = $1 AND user_id = $2 AND trashed_at IS NULL`, c.Param("id"), user.ID.String()).Scan(&embedded)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to find similar generations")
+		return
+	}
+	if !embedded {
+		// Not embedded yet (or it never completed); nothing to compare against
+		c.JSON(http.StatusOK, SimilarGenerationsResponse{Generations: []SimilarGeneration{}, Pending: true})
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+generationColumns+`, 1 - (prompt_embedding <=> target.e)
+		FROM generated_content,
+		     (SELECT prompt_embedding AS e FROM generated_content WHERE request_id = $1) target
+		WHERE user_id = $2 AND request_id <> $1 AND status = 'completed' AND trashed_at IS NULL
+		  AND prompt_embedding IS NOT NULL
+		ORDER BY prompt_embedding <=> target.e LIMIT $3`, c.Param("id"), user.ID.String(), limit)
+	if err != nil {
+		log.Printf("❌ Failed to find generations similar to %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to find similar generations")
+		return
+	}
+	defer rows.Close()
+
+	list := []SimilarGeneration{}
+	for rows.Next() {
+		var s SimilarGeneration
+		var score float64
+		g, err := scanGeneration(scoredRow{rows, &score})
+		if err != nil {
+			respondError(c, codeInternal, "Failed to find similar generations")
+			return
+		}
+		withGenerationURLs(ctx, g, size)
+		s.Generation, s.Similarity = g, score
+		list = append(list, s)
+	}
+	c.JSON(http.StatusOK, SimilarGenerationsResponse{Generations: list})
+}
+
+// scoredRow lets scanGeneration read a row with one extra trailing column
+type scoredRow struct {
+	row   rowScanner
+	score *float64
+}
+
+func (s scoredRow) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.score)...)
+}
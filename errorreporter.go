@@ -0,0 +1,177 @@
+// errorreporter.go
+// Pluggable error reporting (Sentry or log-only) and panic recovery helpers
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// ErrorReporter receives errors and recovered panics worth a human's attention
+type ErrorReporter interface {
+	Report(err error, tags map[string]string)
+	Flush(timeout time.Duration)
+}
+
+var (
+	errorReporter          ErrorReporter
+	errorReportDedupWindow = getEnvDuration("ERROR_REPORT_DEDUP_WINDOW", time.Minute)
+)
+
+func init() {
+	var next ErrorReporter = logReporter{}
+	if dsn := getEnv("SENTRY_DSN", ""); dsn != "" {
+		r, err := newSentryReporter(dsn)
+		if err != nil {
+			log.Printf("⚠️ Sentry disabled, falling back to log reporter: %v", err)
+		} else {
+			next = r
+		}
+	}
+	errorReporter = newDedupReporter(next, errorReportDedupWindow)
+}
+
+// logReporter is the default when no DSN is configured
+type logReporter struct{}
+
+func (logReporter) Report(err error, tags map[string]string) {
+	log.Printf("🚨 %s %v", redactPromptFields(err.Error()), tags)
+}
+
+func (logReporter) Flush(time.Duration) {}
+
+// sentryReporter forwards to Sentry, mapping user_id onto the Sentry user
+type sentryReporter struct{}
+
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: getEnv("APP_ENV", "development"),
+		BeforeSend:  scrubSentryEvent, // see prompt_logging.go
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sentryReporter{}, nil
+}
+
+func (sentryReporter) Report(err error, tags map[string]string) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		for k, v := range tags {
+			scope.SetTag(k, v)
+		}
+		if userID := tags["user_id"]; userID != "" {
+			scope.SetUser(sentry.User{ID: userID})
+		}
+		sentry.CaptureException(err)
+	})
+}
+
+func (sentryReporter) Flush(timeout time.Duration) {
+	sentry.Flush(timeout)
+}
+
+// dedupReporter forwards the first occurrence of an identical error per window
+// and folds the repeats into a "suppressed" count on the next one it lets through
+type dedupReporter struct {
+	next   ErrorReporter
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	lastSent   time.Time
+	suppressed int
+}
+
+func newDedupReporter(next ErrorReporter, window time.Duration) *dedupReporter {
+	return &dedupReporter{next: next, window: window, seen: make(map[string]*dedupEntry)}
+}
+
+func (d *dedupReporter) Report(err error, tags map[string]string) {
+	fingerprint := tags["where"] + "|" + err.Error()
+	now := time.Now()
+
+	d.mu.Lock()
+	e, ok := d.seen[fingerprint]
+	if ok && now.Sub(e.lastSent) < d.window {
+		e.suppressed++
+		d.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if ok {
+		suppressed = e.suppressed
+	}
+	d.seen[fingerprint] = &dedupEntry{lastSent: now}
+	// Forget stale fingerprints so the map doesn't grow forever
+	for k, v := range d.seen {
+		if now.Sub(v.lastSent) > 10*d.window {
+			delete(d.seen, k)
+		}
+	}
+	d.mu.Unlock()
+
+	if suppressed > 0 {
+		merged := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			merged[k] = v
+		}
+		merged["suppressed"] = fmt.Sprint(suppressed)
+		tags = merged
+	}
+	d.next.Report(err, tags)
+}
+
+func (d *dedupReporter) Flush(timeout time.Duration) {
+	d.next.Flush(timeout)
+}
+
+// panicError turns a recovered value into an error carrying the stack
+func panicError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return fmt.Errorf("panic: %w\n%s", err, debug.Stack())
+	}
+	return fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+}
+
+// runWithRecovery calls fn and reports instead of crashing if it panics
+func runWithRecovery(where string, tags map[string]string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			t := map[string]string{"where": where}
+			for k, v := range tags {
+				t[k] = v
+			}
+			log.Printf("💥 Recovered panic in %s: %v", where, r)
+			errorReporter.Report(panicError(r), t)
+		}
+	}()
+	fn()
+	return false
+}
+
+// superviseForever keeps a long-running loop alive, restarting it after a panic or exit
+func superviseForever(where string, fn func()) {
+	backoff := time.Second
+	for {
+		if !runWithRecovery(where, nil, fn) {
+			errorReporter.Report(errors.New(where+" exited"), map[string]string{"where": where})
+		}
+		log.Printf("🔁 Restarting %s in %s", where, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
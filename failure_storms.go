@@ -0,0 +1,200 @@
+// failure_storms.go
+// Safety valve for users whose requests keep failing: consecutive failures are counted in
+// Redis per user and per user+model, and any completion resets both. At
+// FAILURE_STORM_THRESHOLD in a row the input-expired retry stops, failed generations carry
+// a hint, and the user is put under review for the abuse report. In "block" mode the
+// model is also paused for the user for FAILURE_STORM_BLOCK_TTL, shown on GET /usage
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	failureStormWarn  = "warn"
+	failureStormBlock = "block"
+
+	failureStormHint = "Several requests in a row have failed. Try a shorter or simpler prompt, " +
+		"fewer steps, a lower resolution or another model"
+)
+
+var (
+	failureStormThreshold = getEnvInt("FAILURE_STORM_THRESHOLD", 5)
+	failureStormMode      = getEnv("FAILURE_STORM_MODE", failureStormWarn)
+	failureStormBlockTTL  = getEnvDuration("FAILURE_STORM_BLOCK_TTL", time.Hour)
+	// A streak nobody added to for this long is forgotten
+	failureStormStreakTTL = getEnvDuration("FAILURE_STORM_STREAK_TTL", 24*time.Hour)
+
+	failureStorms = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_failure_storms_total",
+		Help: "Users reaching FAILURE_STORM_THRESHOLD consecutive failures, by model and mode (warn or block).",
+	}, []string{"model", "mode"})
+)
+
+func failureStreakKey(userID string) string { return "failstreak:" + userID }
+
+func modelFailureStreakKey(userID, model string) string { return "failstreak:" + userID + ":" + model }
+
+func modelBlockKey(userID, model string) string { return "failstorm:block:" + userID + ":" + model }
+
+// blockedModelsKey is a hash of model -> unix expiry, so GET /usage can list blocks
+func blockedModelsKey(userID string) string { return "failstorm:blocked:" + userID }
+
+// recordGenerationFailure extends the owner's streaks for a failure that was applied, and
+// acts on the one that reaches the threshold. Redis errors drop the count
+func recordGenerationFailure(ctx context.Context, requestID, userID string) {
+	model, err := generationModel(ctx, requestID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load model of %s for its failure streak: %v", requestID, err)
+		return
+	}
+	pipe := rdb.TxPipeline()
+	user := pipe.Incr(ctx, failureStreakKey(userID))
+	pipe.Expire(ctx, failureStreakKey(userID), failureStormStreakTTL)
+	perModel := pipe.Incr(ctx, modelFailureStreakKey(userID, model))
+	pipe.Expire(ctx, modelFailureStreakKey(userID, model), failureStormStreakTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Failed to count failure for %s: %v", userID, err)
+		return
+	}
+
+	// Only the failure that reaches the threshold acts, so a long streak flags once
+	threshold := int64(max(failureStormThreshold, 1))
+	switch {
+	case perModel.Val() == threshold:
+		startFailureStorm(ctx, userID, model, perModel.Val())
+	case user.Val() == threshold:
+		startFailureStorm(ctx, userID, "", user.Val())
+	}
+}
+
+// startFailureStorm flags userID for review and, in block mode, pauses model for them.
+// model is empty when the streak spans models, which never blocks
+func startFailureStorm(ctx context.Context, userID, model string, streak int64) {
+	mode := failureStormMode
+	if model == "" {
+		mode = failureStormWarn
+	}
+	failureStorms.WithLabelValues(model, mode).Inc()
+	log.Printf("🌩️ User %s has %d consecutive failures on %q (%s)", userID, streak, model, mode)
+
+	if mode == failureStormBlock {
+		until := clock.Now().Add(failureStormBlockTTL)
+		pipe := rdb.TxPipeline()
+		pipe.Set(ctx, modelBlockKey(userID, model), until.Unix(), failureStormBlockTTL)
+		pipe.HSet(ctx, blockedModelsKey(userID), model, until.Unix())
+		pipe.Expire(ctx, blockedModelsKey(userID), failureStormBlockTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("⚠️ Failed to block %s for %s: %v", model, userID, err)
+		}
+	}
+
+	where := "across models"
+	if model != "" {
+		where = "on " + model
+	}
+	s := &AbuseSignals{Triggered: []string{fmt.Sprintf("consecutive_failures %d %s", streak, where)}}
+	// A failing user isn't misbehaving, so this never throttles, whatever the analyzer does
+	t := *currentAbuseThresholds.Load()
+	t.AutoThrottle = false
+	if _, err := flagUser(ctx, userID, s, t); err != nil {
+		log.Printf("⚠️ Failed to flag user %s for a failure storm: %v", userID, err)
+	}
+	auditAbuse(ctx, userID, "failure_storm", actorAnalyzer, gin.H{"model": model, "streak": streak, "mode": mode})
+}
+
+func generationModel(ctx context.Context, requestID string) (string, error) {
+	var model string
+	err := db.QueryRowContext(ctx, `SELECT model FROM generated_content WHERE request_id = $1`, requestID).Scan(&model)
+	return model, err
+}
+
+// resetFailureStreaks ends the owner's streaks after a completion. A block already in
+// place runs out on its own
+func resetFailureStreaks(ctx context.Context, requestID, userID string) {
+	model, _ := generationModel(ctx, requestID)
+	keys := []string{failureStreakKey(userID)}
+	if model != "" {
+		keys = append(keys, modelFailureStreakKey(userID, model))
+	}
+	if err := rdb.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("⚠️ Failed to reset failure streaks for %s: %v", userID, err)
+	}
+}
+
+// failureStormActive reports whether userID has failed FAILURE_STORM_THRESHOLD times in a
+// row on model, or overall; automatic retries stop while it does
+func failureStormActive(ctx context.Context, userID, model string) bool {
+	keys := []string{failureStreakKey(userID)}
+	if model != "" {
+		keys = append(keys, modelFailureStreakKey(userID, model))
+	}
+	return maxCounter(ctx, keys) >= failureStormThreshold
+}
+
+// maxCounter is the highest of the integer counters at keys, 0 on Redis errors
+func maxCounter(ctx context.Context, keys []string) int {
+	vals, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return 0
+	}
+	highest := 0
+	for _, v := range vals {
+		if s, ok := v.(string); ok {
+			n, _ := strconv.Atoi(s)
+			highest = max(highest, n)
+		}
+	}
+	return highest
+}
+
+// modelBlockedUntil returns when userID's block on model ends, or ok=false without one.
+// Redis errors let the request through
+func modelBlockedUntil(ctx context.Context, userID, model string) (until time.Time, ok bool) {
+	unix, err := rdb.Get(ctx, modelBlockKey(userID, model)).Int64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+// ModelBlock is a model paused for one user after a failure storm
+type ModelBlock struct {
+	Model string    `json:"model"`
+	Until time.Time `json:"until"`
+	Hint  string    `json:"hint"`
+}
+
+// userModelBlocks lists userID's blocks still in force, for GET /usage
+func userModelBlocks(ctx context.Context, userID string) []ModelBlock {
+	blocks := []ModelBlock{}
+	entries, err := rdb.HGetAll(ctx, blockedModelsKey(userID)).Result()
+	if err != nil {
+		return blocks
+	}
+	now := clock.Now()
+	for model, raw := range entries {
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || !time.Unix(unix, 0).After(now) {
+			continue
+		}
+		blocks = append(blocks, ModelBlock{Model: model, Until: time.Unix(unix, 0), Hint: failureStormHint})
+	}
+	return blocks
+}
+
+// withFailureHint attaches the hint to a failed generation while its owner's streak lasts
+func withFailureHint(ctx context.Context, g *Generation, userID string) {
+	if g.Status == "failed" && failureStormActive(ctx, userID, g.Model) {
+		g.Hint = failureStormHint
+	}
+}
@@ -0,0 +1,225 @@
+// field_renames.go
+// The completion's object fields are being renamed from s3_key/s3_url to object_key/
+// object_url (a rendition's s3_key too), since the store isn't always S3. Decoding takes
+// either name and prefers the new one; a message that only has an old name is counted as
+// legacy. Completions we marshal ourselves (dead letters, the retry buffer) carry the names
+// MESSAGE_SCHEMA_VERSION picks: 1 only the old ones, 2 both, 3 only the new ones. Workers
+// move over the same way, and GET /admin/contracts/compatibility shows what share of
+// recent messages still needs the old names, i.e. when the next step is safe
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	schemaLegacyNames = 1 // s3_key, s3_url
+	schemaDualNames   = 2 // both
+	schemaRenamed     = 3 // object_key, object_url
+
+	fieldNamesKeyPrefix = "contracts:field_names:" // hash per hour of messages and legacy names seen
+	fieldNamesMaxWindow = 7 * 24 * time.Hour
+)
+
+var messageSchemaVersion = schemaVersionFromEnv()
+
+var (
+	workerDeprecatedFields = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_worker_deprecated_fields_total",
+		Help: "Worker messages using a field name that is being renamed, by message kind and old name.",
+	}, []string{"message", "field"})
+
+	workerObjectKeyMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_worker_object_key_messages_total",
+		Help: "Worker messages carrying object keys, by whether they still need the old field names (legacy, current).",
+	}, []string{"names"})
+)
+
+func schemaVersionFromEnv() int {
+	v := getEnvInt("MESSAGE_SCHEMA_VERSION", schemaDualNames)
+	if v < schemaLegacyNames || v > schemaRenamed {
+		log.Printf("⚠️ MESSAGE_SCHEMA_VERSION=%d is not 1, 2 or 3; using %d", v, schemaDualNames)
+		return schemaDualNames
+	}
+	return v
+}
+
+// renamedPair fills both names of a renamed field from whichever was sent, the new one
+// winning, and reports whether only the old one was
+func renamedPair(old, current *string) (legacy bool) {
+	switch {
+	case *current != "":
+		*old = *current
+	case *old != "":
+		*current = *old
+		return true
+	}
+	return false
+}
+
+// namesFor clears the names the schema version doesn't write
+func namesFor(old, current *string) {
+	switch messageSchemaVersion {
+	case schemaLegacyNames:
+		*current = ""
+	case schemaRenamed:
+		*old = ""
+	}
+}
+
+func (r *Rendition) UnmarshalJSON(data []byte) error {
+	type plain Rendition
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+	r.legacyKey = renamedPair(&r.S3Key, &r.ObjectKey)
+	return nil
+}
+
+func (r Rendition) MarshalJSON() ([]byte, error) {
+	type plain Rendition
+	out := plain(r)
+	renamedPair(&out.S3Key, &out.ObjectKey)
+	namesFor(&out.S3Key, &out.ObjectKey)
+	return json.Marshal(out)
+}
+
+func (c *ImageGenerationCompletion) UnmarshalJSON(data []byte) error {
+	type plain ImageGenerationCompletion
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	c.legacyFields = nil
+	if renamedPair(&c.S3Key, &c.ObjectKey) {
+		c.legacyFields = append(c.legacyFields, "s3_key")
+	}
+	if renamedPair(&c.S3URL, &c.ObjectURL) {
+		c.legacyFields = append(c.legacyFields, "s3_url")
+	}
+	for _, r := range c.Renditions {
+		if r.legacyKey {
+			c.legacyFields = append(c.legacyFields, "renditions.s3_key")
+			break
+		}
+	}
+	return nil
+}
+
+func (c ImageGenerationCompletion) MarshalJSON() ([]byte, error) {
+	type plain ImageGenerationCompletion
+	out := plain(c)
+	renamedPair(&out.S3Key, &out.ObjectKey)
+	renamedPair(&out.S3URL, &out.ObjectURL)
+	namesFor(&out.S3Key, &out.ObjectKey)
+	namesFor(&out.S3URL, &out.ObjectURL)
+	return json.Marshal(out)
+}
+
+// carriesObjectKeys reports whether the completion names any stored object, i.e. whether
+// it counts towards the share of messages on the old names
+func (c *ImageGenerationCompletion) carriesObjectKeys() bool {
+	return c.S3Key != "" || c.S3URL != "" || len(c.Renditions) > 0
+}
+
+// noteFieldNames counts a decoded completion's use of the old names, in the metrics and
+// in this hour's bucket for the compatibility report
+func noteFieldNames(kind string, c *ImageGenerationCompletion) {
+	if !c.carriesObjectKeys() {
+		return
+	}
+	names := "current"
+	if len(c.legacyFields) > 0 {
+		names = "legacy"
+	}
+	workerObjectKeyMessages.WithLabelValues(names).Inc()
+	for _, f := range c.legacyFields {
+		workerDeprecatedFields.WithLabelValues(kind, f).Inc()
+	}
+
+	ctx := context.Background()
+	key := fieldNamesKey(clock.Now())
+	pipe := rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, "messages", 1)
+	if len(c.legacyFields) > 0 {
+		pipe.HIncrBy(ctx, key, "legacy", 1)
+	}
+	for _, f := range c.legacyFields {
+		pipe.HIncrBy(ctx, key, "field:"+f, 1)
+	}
+	pipe.Expire(ctx, key, fieldNamesMaxWindow+time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("⚠️ Failed to record completion field names: %v", err)
+	}
+}
+
+func fieldNamesKey(at time.Time) string {
+	return fieldNamesKeyPrefix + strconv.FormatInt(at.Truncate(time.Hour).Unix(), 10)
+}
+
+// fieldCompatibilityHandler reports the share of completions carrying object keys over
+// the window (24h unless ?window= says otherwise, in whole hours) that still relied on the
+// old field names
+func fieldCompatibilityHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	raw := c.DefaultQuery("window", "24h")
+	window, ok := parseHistoryDuration(raw)
+	if !ok || window < time.Hour || window > fieldNamesMaxWindow {
+		fieldError(c, codeInvalidRequest, "window", "must be a duration from 1h up to 7d, like 24h")
+		return
+	}
+
+	now := clock.Now()
+	pipe := rdb.Pipeline()
+	hours := int(window / time.Hour)
+	buckets := make([]*redis.StringStringMapCmd, 0, hours)
+	for i := 0; i < hours; i++ {
+		buckets = append(buckets, pipe.HGetAll(ctx, fieldNamesKey(now.Add(-time.Duration(i)*time.Hour))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		respondError(c, codeInternal, "Failed to read field name counts")
+		return
+	}
+
+	var messages, legacy int64
+	fields := map[string]int64{"s3_key": 0, "s3_url": 0, "renditions.s3_key": 0}
+	for _, b := range buckets {
+		for name, raw := range b.Val() {
+			n, _ := strconv.ParseInt(raw, 10, 64)
+			switch name {
+			case "messages":
+				messages += n
+			case "legacy":
+				legacy += n
+			default:
+				if f, ok := strings.CutPrefix(name, "field:"); ok {
+					fields[f] += n
+				}
+			}
+		}
+	}
+	percent := 0.0
+	if messages > 0 {
+		percent = float64(legacy) * 100 / float64(messages)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"schema_version":   messageSchemaVersion,
+		"window":           raw,
+		"messages":         messages,
+		"legacy_messages":  legacy,
+		"legacy_percent":   percent,
+		"legacy_fields":    fields,
+		"old_names_unused": messages > 0 && legacy == 0,
+	})
+}
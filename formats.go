@@ -0,0 +1,236 @@
+// formats.go
+// Format conversion on download. Originals are stored as PNG; a client that accepts WebP
+// or AVIF (or asks with ?format=) gets a converted copy, encoded once and cached next to
+// the original under a derived key. Any failure serves the original instead
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png" // originals
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webpQuality = getEnvInt("IMAGE_WEBP_QUALITY", 80)
+	avifQuality = getEnvInt("IMAGE_AVIF_QUALITY", 60)
+	jpegQuality = getEnvInt("IMAGE_JPEG_QUALITY", 85)
+
+	// Larger sources are served as stored: decoding is width*height*4 bytes before encoding
+	convertMaxSourceBytes = int64(getEnvInt("IMAGE_CONVERT_MAX_BYTES", 16<<20))
+	convertMaxPixels      = getEnvInt("IMAGE_CONVERT_MAX_PIXELS", 4096*4096)
+	// At most this many conversions decode at once; the rest serve the original
+	convertSlots = make(chan struct{}, max(getEnvInt("IMAGE_CONVERT_CONCURRENCY", 2), 1))
+
+	imageConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_image_conversions_total",
+		Help: "Download format conversions by format and result (cached, converted, too_large, busy, failed).",
+	}, []string{"format", "result"})
+)
+
+// imageFormat is a format the download endpoint can convert to
+type imageFormat struct {
+	Name        string // ?format= value and the derived key's extension
+	ContentType string
+	Quality     int
+	Encode      func(w io.Writer, img image.Image, quality int) error
+}
+
+// convertibleFormats in preference order, for Accept headers that rank them equally
+var convertibleFormats = []*imageFormat{
+	{Name: "avif", ContentType: "image/avif", Quality: avifQuality, Encode: func(w io.Writer, img image.Image, q int) error {
+		return avif.Encode(w, img, avif.Options{Quality: q, QualityAlpha: q, Speed: avif.DefaultSpeed})
+	}},
+	{Name: "webp", ContentType: "image/webp", Quality: webpQuality, Encode: func(w io.Writer, img image.Image, q int) error {
+		return webp.Encode(w, img, webp.Options{Quality: q})
+	}},
+	{Name: "jpeg", ContentType: "image/jpeg", Quality: jpegQuality, Encode: func(w io.Writer, img image.Image, q int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+	}},
+}
+
+func convertibleFormat(name string) (*imageFormat, bool) {
+	for _, f := range convertibleFormats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// convertibleSource reports whether a stored key is an image we may convert
+func convertibleSource(key string) bool {
+	return strings.EqualFold(path.Ext(key), ".png")
+}
+
+// convertedKey is where key's conversion at the current quality is cached. Quality is part
+// of the key so changing it re-encodes rather than serving stale copies
+func convertedKey(key string, f *imageFormat) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + ".q" + strconv.Itoa(f.Quality) + "." + f.Name
+}
+
+// downloadConversion matches keys made by convertedKey
+var downloadConversion = regexp.MustCompile(`\.q[0-9]+\.(avif|webp|jpeg)$`)
+
+// negotiateFormat picks the format to serve for a convertible source: ?format= when given
+// ("original" keeps the stored one), otherwise the Accept header's best convertible type
+// when it ranks at least as high as the original's. nil means the original. ok is false
+// once an invalid ?format= has been answered with a 422
+func negotiateFormat(c *gin.Context) (f *imageFormat, ok bool) {
+	if name := strings.ToLower(c.Query("format")); name != "" {
+		if name == "original" || name == "png" {
+			return nil, true
+		}
+		f, ok := convertibleFormat(name)
+		if !ok {
+			fieldError(c, codeValidationFailed, "format", "must be original, avif, webp or jpeg")
+		}
+		return f, ok
+	}
+
+	accept := c.GetHeader("Accept")
+	if accept == "" {
+		return nil, true
+	}
+	original := 0.0
+	best, bestQ := (*imageFormat)(nil), 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseAcceptPart(part)
+		switch mediaType {
+		case "image/png", "image/*", "*/*":
+			original = max(original, q)
+			continue
+		}
+		for _, f := range convertibleFormats {
+			// jpeg loses alpha; only served when asked for by name
+			if f.ContentType == mediaType && f.Name != "jpeg" && q > bestQ {
+				best, bestQ = f, q
+			}
+		}
+	}
+	if best != nil && bestQ >= original {
+		return best, true
+	}
+	return nil, true
+}
+
+// parseAcceptPart splits "image/webp;q=0.9" into its media type and weight (default 1)
+func parseAcceptPart(part string) (string, float64) {
+	mediaType, params, _ := strings.Cut(part, ";")
+	q := 1.0
+	for _, p := range strings.Split(params, ";") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(mediaType)), q
+}
+
+// servedAsset is what the download endpoint sends
+type servedAsset struct {
+	Key         string // the object actually served, which names the ETag
+	ContentType string
+	Body        io.ReadCloser
+	Size        int64
+}
+
+// convertedAsset returns key in format f, from the cache or by converting now. ok is false
+// whenever the original should be served instead; the reason is counted, not returned
+func convertedAsset(ctx context.Context, key string, f *imageFormat) (asset servedAsset, ok bool) {
+	derived := convertedKey(key, f)
+	if body, size, err := storage.Open(ctx, derived); err == nil {
+		imageConversions.WithLabelValues(f.Name, "cached").Inc()
+		return servedAsset{Key: derived, ContentType: f.ContentType, Body: body, Size: size}, true
+	}
+
+	select {
+	case convertSlots <- struct{}{}:
+		defer func() { <-convertSlots }()
+	default:
+		imageConversions.WithLabelValues(f.Name, "busy").Inc()
+		return servedAsset{}, false
+	}
+
+	data, err := convertImage(ctx, key, f)
+	if err != nil {
+		log.Printf("⚠️ Serving %s unconverted: %v", key, err)
+		return servedAsset{}, false
+	}
+	// A failed cache write only means converting again next time
+	if err := storage.Put(ctx, derived, data, f.ContentType); err != nil {
+		log.Printf("⚠️ Failed to cache %s: %v", derived, err)
+	}
+	imageConversions.WithLabelValues(f.Name, "converted").Inc()
+	return servedAsset{Key: derived, ContentType: f.ContentType, Body: io.NopCloser(bytes.NewReader(data)),
+		Size: int64(len(data))}, true
+}
+
+func convertImage(ctx context.Context, key string, f *imageFormat) ([]byte, error) {
+	body, size, err := storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if size > convertMaxSourceBytes {
+		imageConversions.WithLabelValues(f.Name, "too_large").Inc()
+		return nil, fmt.Errorf("source is %d bytes", size)
+	}
+	src, err := io.ReadAll(io.LimitReader(body, convertMaxSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(src)) > convertMaxSourceBytes {
+		imageConversions.WithLabelValues(f.Name, "too_large").Inc()
+		return nil, fmt.Errorf("source is over %d bytes", convertMaxSourceBytes)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err == nil && cfg.Width*cfg.Height > convertMaxPixels {
+		imageConversions.WithLabelValues(f.Name, "too_large").Inc()
+		return nil, fmt.Errorf("source is %dx%d", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err == nil {
+		var buf bytes.Buffer
+		if err = f.Encode(&buf, img, f.Quality); err == nil {
+			return buf.Bytes(), nil
+		}
+	}
+	imageConversions.WithLabelValues(f.Name, "failed").Inc()
+	return nil, err
+}
+
+// assetETag names the served object. Keys are never rewritten in place (post-processing
+// writes a new "-final" key), so the key identifies the bytes
+func assetETag(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return `"` + hex.EncodeToString(sum[:10]) + `"`
+}
+
+// assetFilename is the download name: the original's base name with the served extension
+func assetFilename(originalKey string, f *imageFormat) string {
+	base := path.Base(originalKey)
+	if f == nil {
+		return base
+	}
+	return strings.TrimSuffix(base, path.Ext(base)) + "." + f.Name
+}
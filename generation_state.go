@@ -0,0 +1,301 @@
+// generation_state.go
+// Status writes on generated_content. Every writer (listener, sweeper, scheduler, cancel,
+// retention, admin requeue) goes through transitionGeneration, which applies a change
+// only to the row version it checked, so the last writer can no longer undo a
+// terminal state it never saw
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Versioned updates retry on a concurrent write this many times before giving up
+const maxTransitionAttempts = 3
+
+// errTransitionContended is returned when every attempt lost to a concurrent write. The
+// write wasn't refused, so callers retry it later rather than treat it as a repeat;
+// dbErrorClass counts it as transient
+var errTransitionContended = errors.New("row kept changing under the write")
+
+// Terminal states are overwritten only by an admin requeue, with one lifecycle exception:
+// retention expires completed rows (and unclaimed late results) once their objects are deleted
+var terminalStates = []string{"completed", "failed", "cancelled", "expired"}
+
+// generationTransitions lists the states each state may move to. processing goes back to
+// queued only when an HTTP claim expires (see job_pull.go)
+var generationTransitions = map[string][]string{
+	"pending_moderation": {"deferred", "failed", "cancelled", "timed_out"}, // see moderation.go
+	"deferred":           {"queued", "cancelled", "timed_out"},
+	"queued":             {"processing", "completed", "failed", "deferred", "timed_out", "cancelled"},
+	"processing":         {"completed", "failed", "timed_out", "queued", "cancelled"},
+	"timed_out":          {"completed", "expired"}, // a claimed late result; an unclaimed one ages out
+	"completed":          {"expired"},
+}
+
+var generationWriteConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_generation_write_conflicts_total",
+	Help: "Status writes refused because the row had already moved on, by writer, intended and actual state.",
+}, []string{"writer", "intended", "actual"})
+
+// generationWrite is one writer's intended status change
+type generationWrite struct {
+	Writer string   // names the writer in the conflict metric and logs
+	To     string   // the new status
+	From   []string // the states this writer acts on; each must also be allowed by the table
+	UserID string   // optional; the row must belong to this user, else it counts as missing
+
+	// Owner, when set, is who the writer believes owns the row: a row belonging to anyone
+	// else fails the write with an ownerMismatchError (see ownership.go)
+	Owner string
+
+	// Where narrows the rows the write applies to, e.g. `dispatch IS NULL`. It is checked
+	// alongside the status and binds no arguments; a row failing it is left alone quietly
+	Where string
+
+	// Set holds extra assignments, with Args bound from $4. Expressions see the row as it
+	// was, so `late = (status = 'timed_out')` reads the old status
+	Set  string
+	Args []interface{}
+
+	// Returning columns are scanned by Scan once the change is applied
+	Returning string
+	Scan      func(row rowScanner) error
+
+	// Replay is an admin requeue: it may move a row out of a terminal state, and forgets
+	// the row's processed effects so the new run's are owed again
+	Replay bool
+
+	// Refund, when set, gives back the request's charge (see refundForRequest) with this
+	// reason, in the same transaction as the change
+	Refund string
+
+	// Effects are claimed in processed_effects (see processed_effects.go) in the same
+	// transaction as the change; Claimed reports which were new
+	Effects []string
+	Claimed func(effect string, claimed bool)
+}
+
+// prefixScanner scans columns selected ahead of a caller's own into prefix
+type prefixScanner struct {
+	row    rowScanner
+	prefix []interface{}
+}
+
+func (p prefixScanner) Scan(dest ...interface{}) error {
+	return p.row.Scan(append(p.prefix, dest...)...)
+}
+
+func (w generationWrite) allows(from string) bool {
+	if w.Replay {
+		return from != w.To
+	}
+	return containsString(w.From, from) && containsString(generationTransitions[from], w.To)
+}
+
+// transitionGeneration applies w to the version of the row it read. When another write
+// lands in between it re-reads and retries while w is still allowed. applied is false
+// when the row is missing, already in w.To (a repeat), or in a state w may not leave;
+// the last is a conflict, counted and logged with the intended and actual state. A write
+// that loses every attempt fails with errTransitionContended.
+// With w.Refund the change and the request's refund commit in one transaction, as do
+// the change and w.Effects
+func transitionGeneration(ctx context.Context, requestID string, w generationWrite) (applied bool, err error) {
+	if w.Refund == "" && len(w.Effects) == 0 && !w.Replay {
+		applied, record, err := applyTransition(ctx, db, requestID, w)
+		if applied {
+			writeStatusRecord(ctx, record)
+		}
+		return applied, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	applied, record, err := applyTransition(ctx, tx, requestID, w)
+	if err != nil || !applied {
+		return false, err
+	}
+	var refund *creditRefund
+	if w.Refund != "" {
+		if refund, err = refundInTx(ctx, tx, requestID, w.Refund); err != nil {
+			return false, err
+		}
+	}
+	if w.Replay {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM processed_effects WHERE request_id = $1`, requestID); err != nil {
+			return false, err
+		}
+	}
+	claimed := make([]bool, len(w.Effects))
+	for i, effect := range w.Effects {
+		if claimed[i], err = claimEffect(ctx, tx, requestID, effect); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	writeStatusRecord(ctx, record)
+	refund.announce(ctx)
+	if w.Claimed != nil {
+		for i, effect := range w.Effects {
+			w.Claimed(effect, claimed[i])
+		}
+	}
+	return true, nil
+}
+
+// applyTransition is transitionGeneration's versioned write, on q
+func applyTransition(ctx context.Context, q rowQuerier, requestID string, w generationWrite) (applied bool, record statusRecord, err error) {
+	returning := w.Returning
+	if returning == "" {
+		returning = "status"
+	}
+	where := "true"
+	if w.Where != "" {
+		where = "(" + w.Where + ")"
+	}
+	for attempt := 0; attempt < maxTransitionAttempts; attempt++ {
+		var status, owner string
+		var version int64
+		var matches bool
+		err := q.QueryRowContext(ctx, `
+			SELECT status, version, coalesce(`+where+`, false), user_id::text FROM generated_content
+			WHERE request_id = $1`, requestID).Scan(&status, &version, &matches, &owner)
+		if err == sql.ErrNoRows || (err == nil && w.UserID != "" && owner != w.UserID) {
+			return false, record, nil
+		}
+		if err != nil {
+			return false, record, err
+		}
+		if w.Owner != "" && owner != w.Owner {
+			mismatch := &ownerMismatchError{RequestID: requestID, Stated: w.Owner, Owner: owner}
+			reportOwnerMismatch("write", mismatch)
+			return false, record, mismatch
+		}
+		if (status == w.To && !w.Replay) || !matches {
+			return false, record, nil
+		}
+		if !w.allows(status) {
+			generationWriteConflicts.WithLabelValues(w.Writer, w.To, status).Inc()
+			log.Printf("⚔️ %s wanted request %s %s, but it is already %s", w.Writer, requestID, w.To, status)
+			return false, record, nil
+		}
+
+		set := "status = $3"
+		if w.To == "queued" {
+			// Back in the queue, the row is up for dispatch again by either path (see job_pull.go)
+			set += ", dispatch = NULL, claimed_by = NULL, claim_expires_at = NULL"
+		}
+		if w.Set != "" {
+			set += ", " + w.Set
+		}
+		args := append([]interface{}{requestID, version, w.To}, w.Args...)
+		// The version holds the owner too: a row that changed hands since the check isn't written
+		record = statusRecord{RequestID: requestID, UserID: owner, Status: w.To}
+		row := prefixScanner{q.QueryRowContext(ctx, `
+			UPDATE generated_content SET `+set+`
+			WHERE request_id = $1 AND version = $2
+			RETURNING coalesce(content_url, ''), coalesce(error, ''), updated_at, version, `+returning, args...),
+			[]interface{}{&record.ContentURL, &record.Error, &record.UpdatedAt, &record.Version}}
+		if w.Scan != nil {
+			err = w.Scan(row)
+		} else {
+			var ignored string
+			err = row.Scan(&ignored)
+		}
+		if err == sql.ErrNoRows {
+			continue // written in between; check again against what is there now
+		}
+		return err == nil, record, err
+	}
+	log.Printf("⚔️ %s gave up moving request %s to %s after %d concurrent writes", w.Writer, requestID, w.To, maxTransitionAttempts)
+	generationWriteConflicts.WithLabelValues(w.Writer, w.To, "contended").Inc()
+	return false, record, fmt.Errorf("%w: %s moving %s to %s", errTransitionContended, w.Writer, requestID, w.To)
+}
+
+// requeueGenerationHandler handles POST /admin/generations/:id/requeue: a finished or
+// timed-out image or video request is published again as-is, without charging anyone
+func requeueGenerationHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	requestID := c.Param("id")
+
+	var status, contentType, model string
+	err := db.QueryRowContext(ctx, `SELECT status, content_type, model FROM generated_content WHERE request_id = $1`,
+		requestID).Scan(&status, &contentType, &model)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to requeue generation")
+		return
+	}
+	if k, ok := generationKind(contentType); !ok || !k.queued() {
+		respondError(c, codeConflict, "Only image and video generations can be requeued")
+		return
+	}
+	if status != "timed_out" && !containsString(terminalStates, status) {
+		respondError(c, codeConflict, "Generation is still in progress")
+		return
+	}
+	sub, ok := retiredModelSubstitution(model, clock.Now())
+	if !ok {
+		respondErrorDetails(c, codeModelRetired, "This model has been retired and has no replacement", gin.H{"model": model})
+		return
+	}
+
+	var g newGeneration
+	w := generationWrite{
+		Writer: "admin_requeue", To: "queued", Replay: true,
+		Set: "error = '', completed_at = NULL, deferred_until = NULL, deadline = NULL, late = false, " +
+			"started_at = NULL, started_by = NULL, stale_requeues = 0",
+		Returning: queuedColumns,
+		Scan: func(row rowScanner) (err error) {
+			g, err = scanQueuedGeneration(row)
+			return err
+		},
+	}
+	sub.apply(&w)
+	applied, err := transitionGeneration(ctx, requestID, w)
+	if errors.Is(err, errTransitionContended) {
+		respondError(c, codeConflict, "Generation changed while requeueing; try again")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to requeue generation %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to requeue generation")
+		return
+	}
+	if !applied {
+		respondError(c, codeConflict, "Generation changed while requeueing; try again")
+		return
+	}
+	if err := publishGenerationRequest(g.channel(), g.request()); err != nil {
+		markGenerationFailed(ctx, requestID, g.UserID, "publish failed: "+err.Error())
+		respondError(c, codeInternal, "Failed to requeue generation")
+		return
+	}
+	resp := gin.H{"request_id": requestID, "status": "queued", "previous_status": status}
+	if sub != nil {
+		log.Printf("🔁 Request %s (was %s) requeued by %s on %s, replacing retired %s", requestID, status, admin.ID, sub.To, sub.From)
+		resp["model_substitution"] = sub
+	} else {
+		log.Printf("🔁 Request %s (was %s) requeued by %s", requestID, status, admin.ID)
+	}
+	c.JSON(http.StatusAccepted, resp)
+}
@@ -0,0 +1,62 @@
+// generation_timings.go
+// The timeline on GET /generations/:id, read from the row's own timestamps so support can
+// see where a slow generation spent its time. A stage that left no timestamp (say, a worker
+// that never sent its processing ack) is null, and so is anything derived from it. Which
+// queue, priority and worker served the request is shown to admins only. The list endpoint
+// leaves timings out
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// GenerationTimings is a generation's timeline. Nulls are stages with no record
+type GenerationTimings struct {
+	CreatedAt         time.Time  `json:"created_at"`
+	PublishedAt       *time.Time `json:"published_at"`
+	PickedUpAt        *time.Time `json:"picked_up_at"`
+	CompletedAt       *time.Time `json:"completed_at"`
+	QueueWaitSeconds  *float64   `json:"queue_wait_seconds"` // created to picked up
+	GenerationSeconds *float64   `json:"generation_seconds"` // picked up to completed
+
+	// Admins only
+	Queue    string `json:"queue,omitempty"`    // redis or http
+	Priority string `json:"priority,omitempty"` // normal or low
+	Worker   string `json:"worker,omitempty"`
+}
+
+// generationTimings loads requestID's timeline, with the serving details when admin
+func generationTimings(ctx context.Context, requestID string, admin bool) (*GenerationTimings, error) {
+	var t GenerationTimings
+	var queue, worker string
+	var lowPriority bool
+	err := db.QueryRowContext(ctx, `
+		SELECT created_at, dispatched_at, started_at, completed_at,
+		       coalesce(dispatch, ''), low_priority, coalesce(started_by, claimed_by, '')
+		FROM generated_content WHERE request_id = $1`, requestID).
+		Scan(&t.CreatedAt, &t.PublishedAt, &t.PickedUpAt, &t.CompletedAt, &queue, &lowPriority, &worker)
+	if err != nil {
+		return nil, err
+	}
+	if t.PickedUpAt != nil {
+		t.QueueWaitSeconds = secondsBetween(t.CreatedAt, *t.PickedUpAt)
+		if t.CompletedAt != nil {
+			t.GenerationSeconds = secondsBetween(*t.PickedUpAt, *t.CompletedAt)
+		}
+	}
+	if admin {
+		t.Queue, t.Worker = queue, worker
+		t.Priority = "normal"
+		if lowPriority {
+			t.Priority = "low"
+		}
+	}
+	return &t, nil
+}
+
+func secondsBetween(from, to time.Time) *float64 {
+	s := max(to.Sub(from).Seconds(), 0)
+	return &s
+}
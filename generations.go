@@ -0,0 +1,377 @@
+// generations.go
+// generated_content rows for image and video requests
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Generation is the status view of a generated_content row
+type Generation struct {
+	RequestID      string     `json:"request_id"`
+	Status         string     `json:"status"`
+	ContentType    string     `json:"content_type"`
+	OriginalPrompt string     `json:"original_prompt"`
+	Prompt         string     `json:"prompt"` // what was actually sent to the worker
+	Model          string     `json:"model"`
+	ContentURL     string     `json:"content_url,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	ErrorCode      string     `json:"error_code,omitempty"` // worker failures only (worker_errors.go)
+	Hint           string     `json:"hint,omitempty"`       // what to change after repeated failures (failure_storms.go)
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	DeferredUntil  *time.Time `json:"deferred_until,omitempty"` // ETA while status is "deferred"
+	OrgID          string     `json:"org_id,omitempty"`
+	Deadline       *time.Time `json:"deadline,omitempty"`
+	Late           bool       `json:"late,omitempty"`        // completed by claiming a late result
+	LateResult     bool       `json:"late_result,omitempty"` // timed out, but a result arrived and can be claimed
+	TrashedAt      *time.Time `json:"trashed_at,omitempty"`
+	Tags           []string   `json:"tags,omitempty"`        // the owner's own; never shown to other org members
+	TemplateID     string     `json:"template_id,omitempty"` // the template the prompt was rendered from
+	Notify         string     `json:"notify"`                // the request's notify mode
+	BatchID        string     `json:"batch_id,omitempty"`    // the client's batch (notification_batches.go)
+	// The model it was submitted with, when a re-run switched to that model's replacement
+	ModelSubstitutedFrom string    `json:"model_substituted_from,omitempty"`
+	UpdatedAt            time.Time `json:"updated_at"`
+	Version              int64     `json:"-"`
+
+	Timings     *GenerationTimings `json:"timings,omitempty"`     // GET /v2/generations/:id only (generation_timings.go)
+	Deprecation *ModelDeprecation  `json:"deprecation,omitempty"` // GET /generations/:id only (model_lifecycle.go)
+
+	// Presigned links, filled in by the handlers
+	URL          string   `json:"url,omitempty"`
+	PosterURL    string   `json:"poster_url,omitempty"` // video thumbnail
+	ThumbnailURL string   `json:"thumbnail_url,omitempty"`
+	Progress     *float64 `json:"progress,omitempty"` // percent, while processing
+	Size         string   `json:"size,omitempty"`     // rendition behind URL
+	Width        int      `json:"width,omitempty"`
+	Height       int      `json:"height,omitempty"`
+	// Every servable rendition with its link, on /v2 only (api_versions.go)
+	RenditionLinks []RenditionLink `json:"renditions,omitempty"`
+
+	PosterKey         string      `json:"-"`
+	ThumbnailKey      string      `json:"-"`
+	Renditions        []Rendition `json:"-"`
+	ProgressMilestone int         `json:"-"` // see progress_milestones.go
+}
+
+const generationColumns = `request_id, status, content_type, coalesce(nullif(original_prompt, ''), prompt), prompt,
+		       model, content_url, error, coalesce(error_code, ''), created_at, completed_at, deferred_until,
+		       coalesce(org_id::text, ''), coalesce(poster_key, ''), coalesce(thumbnail_key, ''), deadline, late,
+		       late_result AND status = 'timed_out', trashed_at, tags, coalesce(template_id::text, ''), notify,
+		       coalesce(batch_id, ''), coalesce(model_substituted_from, ''), updated_at, version, coalesce(progress_milestone, 0), ` + renditionsColumn
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGeneration(row rowScanner) (*Generation, error) {
+	var g Generation
+	var renditions []byte
+	err := row.Scan(&g.RequestID, &g.Status, &g.ContentType, &g.OriginalPrompt, &g.Prompt,
+		&g.Model, &g.ContentURL, &g.Error, &g.ErrorCode, &g.CreatedAt, &g.CompletedAt, &g.DeferredUntil, &g.OrgID,
+		&g.PosterKey, &g.ThumbnailKey, &g.Deadline, &g.Late,
+		&g.LateResult, &g.TrashedAt, pq.Array(&g.Tags), &g.TemplateID, &g.Notify,
+		&g.BatchID, &g.ModelSubstitutedFrom, &g.UpdatedAt, &g.Version, &g.ProgressMilestone, &renditions)
+	if err != nil {
+		return nil, err
+	}
+	g.Renditions = decodeRenditions(renditions)
+	if err := decryptPrompts(&g.OriginalPrompt, &g.Prompt); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// newGeneration is everything needed to insert an image or video row
+type newGeneration struct {
+	RequestID      string
+	UserID         string
+	Tenant         string // the owner's; picks the channels and the storage prefix
+	OriginalPrompt string
+	Prompt         string
+	Model          string
+	ContentType    string     // "image" or "video"
+	Status         string     // "queued", or "deferred" when admission is postponed
+	DeferredUntil  *time.Time // set with status "deferred"
+	OrgID          string     // optional; the row then shows in the org gallery
+	Credits        int
+
+	// Video only
+	DurationSeconds float64
+	FPS             int
+
+	// Image only
+	Resolution          int // what the worker is asked for, after any downscale
+	RequestedResolution int // as submitted; zero for the default
+	Steps               int
+	NumImages           int
+	Seed                int64  // fixed for comparisons so both models start from the same noise
+	Comparison          string // comparison_id linking the two halves of an A/B request
+
+	Deadline *time.Time // from max_wait_seconds; the row times out after it
+	MaxSide  int        // plan's output size cap, kept for deferred publishing
+	InputKey string     // uploaded source image for img2img; published as a signed URL
+
+	TemplateID string // the prompt template OriginalPrompt was rendered from, if any
+
+	Tags        []string // set at creation, e.g. a regression run's tag
+	LowPriority bool     // published on the kind's low-priority channel (see channel)
+	Notify      string   // notify mode; empty is all
+	BatchID     string   // client-chosen batch; its notifications are collapsed
+	Client      clientInfo
+}
+
+// queuedColumns is what publishing a stored row needs; see scanQueuedGeneration
+const queuedColumns = `request_id, user_id, prompt, model, content_type,
+		       coalesce(duration_seconds, 0), coalesce(fps, 0), deadline, coalesce(max_image_side, 0),
+		       coalesce(input_key, ''), coalesce(resolution, 0), coalesce(steps, 0), coalesce(num_images, 0),
+		       coalesce(seed, 0), coalesce(comparison_id::text, ''), low_priority, tenant_id`
+
+// scanQueuedGeneration reads queuedColumns back into a newGeneration for republishing;
+// extra receives any columns selected after them
+func scanQueuedGeneration(row rowScanner, extra ...interface{}) (newGeneration, error) {
+	var g newGeneration
+	dest := []interface{}{&g.RequestID, &g.UserID, &g.Prompt, &g.Model, &g.ContentType,
+		&g.DurationSeconds, &g.FPS, &g.Deadline, &g.MaxSide, &g.InputKey, &g.Resolution, &g.Steps, &g.NumImages,
+		&g.Seed, &g.Comparison, &g.LowPriority, &g.Tenant}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return g, err
+	}
+	return g, decryptPrompts(&g.Prompt)
+}
+
+// channel is where the row is published: its kind's channel, or that channel's "_low"
+// twin, which workers only read when they have nothing else to do, under its tenant
+func (g newGeneration) channel() string {
+	if g.LowPriority {
+		return tenantKey(g.Tenant, generationChannel(g.ContentType)+lowPriorityChannelSuffix)
+	}
+	return tenantKey(g.Tenant, generationChannel(g.ContentType))
+}
+
+// request is the worker message for the row
+func (g newGeneration) request() ImageGenerationRequest {
+	return ImageGenerationRequest{
+		RequestID:       g.RequestID,
+		UserID:          g.UserID,
+		Prompt:          g.Prompt,
+		Model:           g.Model,
+		DurationSeconds: g.DurationSeconds,
+		FPS:             g.FPS,
+		Resolution:      g.Resolution,
+		Steps:           g.Steps,
+		NumImages:       g.NumImages,
+		Seed:            g.Seed,
+		ComparisonID:    g.Comparison,
+		Deadline:        g.Deadline,
+		MaxSide:         g.MaxSide,
+		InputKey:        g.InputKey,
+		StoragePrefix:   tenantStoragePrefix(g.Tenant),
+	}
+}
+
+// createGeneration stores the row before publishing so completions have something to update
+func createGeneration(ctx context.Context, g newGeneration) error {
+	original, err := encryptPrompt(g.OriginalPrompt)
+	if err != nil {
+		return err
+	}
+	prompt, err := encryptPrompt(g.Prompt)
+	if err != nil {
+		return err
+	}
+	createdAt := clock.Now()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO generated_content
+			(request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+			 status, deferred_until, org_id, credits_charged, duration_seconds, fps, deadline, max_image_side,
+			 input_key, resolution, steps, num_images, seed, comparison_id, template_id, tags, low_priority,
+			 requested_resolution, notify, batch_id, client_platform, client_version, tenant_id)
+		VALUES ($1, $2, $3, $4, '', $5, $6, $7, $8, $9, nullif($10, '')::uuid, $11, nullif($12, 0), nullif($13, 0), $14,
+		        nullif($15, 0), nullif($16, ''), nullif($17, 0), nullif($18, 0), nullif($19, 0),
+		        nullif($20, 0), nullif($21, '')::uuid, nullif($22, '')::uuid, coalesce($23::text[], '{}'), $24,
+		        nullif($25, 0), coalesce(nullif($26, ''), 'all'), nullif($27, ''),
+		        coalesce(nullif($28, ''), 'unknown'), coalesce(nullif($29, ''), 'unknown'), coalesce(nullif($30, ''), 'default'))`,
+		g.RequestID, g.UserID, createdAt, g.ContentType, original, prompt, g.Model,
+		g.Status, g.DeferredUntil, g.OrgID, g.Credits, g.DurationSeconds, g.FPS, g.Deadline, g.MaxSide,
+		g.InputKey, g.Resolution, g.Steps, g.NumImages, g.Seed, g.Comparison, g.TemplateID,
+		pq.Array(g.Tags), g.LowPriority, g.RequestedResolution, g.Notify, g.BatchID, g.Client.Platform, g.Client.Version,
+		g.Tenant)
+	if err == nil {
+		writeStatusRecord(ctx, statusRecord{RequestID: g.RequestID, UserID: g.UserID, Status: g.Status,
+			ContentType: g.ContentType, Model: g.Model, CreatedAt: createdAt, UpdatedAt: createdAt})
+	}
+	return err
+}
+
+// getGeneration loads a row owned by userID
+func getGeneration(ctx context.Context, requestID, userID string) (*Generation, error) {
+	return scanGeneration(db.QueryRowContext(ctx, `
+		SELECT `+generationColumns+`
+		FROM generated_content
+		WHERE request_id = $1 AND user_id = $2`, requestID, userID))
+}
+
+// generationsKeyset pages GET /generations newest first
+var generationsKeyset = keyset{Scope: "generations", Columns: []string{"created_at", "request_id"}, Desc: true, Before: true}
+
+// listGenerations returns the user's rows newest first after keys (see cursorParams),
+// optionally filtered by status, batch and to rows carrying every one of tags
+func listGenerations(ctx context.Context, userID, status, batchID string, tags []string, keys []interface{}, limit int) ([]*Generation, error) {
+	after, keyArgs := generationsKeyset.where(keys, 6)
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+generationColumns+`
+		FROM generated_content
+		WHERE user_id = $1 AND ($2 = '' OR status = $2) AND trashed_at IS NULL AND tags @> $4
+		  AND ($5 = '' OR batch_id = $5) AND `+after+`
+		ORDER BY `+generationsKeyset.orderBy()+` LIMIT $3`,
+		append([]interface{}{userID, status, limit, pq.Array(tags), batchID}, keyArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*Generation{}
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, rows.Err()
+}
+
+// listGenerationsHandler handles GET /generations?status=&tag=&batch_id=&before=&limit=; tag repeats
+func listGenerationsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	size, ok := sizeParam(c, renditionThumbnail)
+	if !ok {
+		return
+	}
+	tags, ok := tagParams(c)
+	if !ok {
+		return
+	}
+
+	batchID := c.Query("batch_id")
+	if !validBatchID(batchID) {
+		fieldError(c, codeValidationFailed, "batch_id", "must be at most 64 letters, digits, dashes or underscores")
+		return
+	}
+
+	filter := user.ID.String() + "|" + c.Query("status") + "|" + strings.Join(tags, ",") + "|" + batchID
+	keys, limit, ok := cursorParams(c, generationsKeyset, filter)
+	if !ok {
+		return
+	}
+
+	// Only the first page is tagged; later pages are fetched once while scrolling
+	if firstPage(c) {
+		etag, err := galleryETag(c.Request.Context(), user.ID.String(), c.Query("status"), batchID, tags, limit, size,
+			requestLocale(c))
+		if err != nil {
+			log.Printf("⚠️ Failed to tag gallery for %s: %v", user.ID, err)
+		}
+		if etag != "" && notModified(c, etag) {
+			return
+		}
+	}
+
+	list, err := listGenerations(c.Request.Context(), user.ID.String(), c.Query("status"), batchID, tags, keys, limit)
+	if err != nil {
+		log.Printf("❌ Failed to list generations for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to list generations")
+		return
+	}
+
+	for _, g := range list {
+		withGenerationURLs(c.Request.Context(), g, size)
+		localizeGenerationError(c, g)
+	}
+	resp := GenerationListResponse{Generations: list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp.NextCursor = generationsKeyset.encode(filter, last.CreatedAt, last.RequestID)
+		resp.NextBefore = last.CreatedAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// cancelGenerationHandler handles POST /generations/:id/cancel for deferred requests and
+// ones held for input moderation
+func cancelGenerationHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+
+	ok, err := cancelDeferredGeneration(c.Request.Context(), c.Param("id"), user.ID.String())
+	if errors.Is(err, errTransitionContended) {
+		respondError(c, codeConflict, "Generation changed while cancelling; try again")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to cancel generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to cancel generation")
+		return
+	}
+	if !ok {
+		respondError(c, codeConflict, "Only deferred generations or ones awaiting moderation can be cancelled")
+		return
+	}
+	c.JSON(http.StatusOK, GenerationStatusResponse{RequestID: c.Param("id"), Status: "cancelled"})
+}
+
+// getGenerationStatus handles GET /generations/:id
+func getGenerationStatus(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	size, ok := sizeParam(c, renditionWeb)
+	if !ok {
+		return
+	}
+
+	// A row the read can't see yet, or an older version of it, gives way to the status
+	// record its latest write left in Redis (see status_records.go)
+	g, err := getGeneration(c.Request.Context(), c.Param("id"), user.ID.String())
+	if err == sql.ErrNoRows {
+		if g = recordedGeneration(c.Request.Context(), c.Param("id"), user.ID.String()); g == nil {
+			respondError(c, codeNotFound, "Generation not found")
+			return
+		}
+	} else if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load generation")
+		return
+	} else {
+		overlayStatusRecord(c.Request.Context(), g)
+		withTimings(c, g, isAdmin(c, user))
+	}
+	withGenerationURLs(c.Request.Context(), g, size)
+	withFailureHint(c.Request.Context(), g, user.ID.String())
+	localizeGenerationError(c, g)
+	g.Deprecation = modelDeprecation(requestLocale(c), g.Model)
+	if notModified(c, generationETag(g, size)) {
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+// markGenerationFailed records the worker's error on rows still in flight; applied is
+// false for finished rows (timed out, or a repeated or out-of-order message). The row
+// must belong to userID (see generationWrite.Owner)
+func markGenerationFailed(ctx context.Context, requestID, userID, errMsg string) (applied bool, err error) {
+	return transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "listener", To: "failed", From: []string{"queued", "processing"}, Owner: userID,
+		Set: "completed_at = now(), error = $4", Args: []interface{}{errMsg}, Refund: "failed",
+	})
+}
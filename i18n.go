@@ -0,0 +1,269 @@
+// i18n.go
+// Message catalogs for user-facing text: error envelope messages and notification
+// titles. Code keeps writing English, which is also the catalog key; locales/<lang>.json
+// maps each English message to its translation. A key with {placeholders} also matches
+// messages rendered from it, and the captured values (plus the error's details) are
+// formatted for the locale when filled into the translation. Error codes and status
+// enums are never translated. Whatever has no translation goes out in English and is
+// counted in mobart_missing_translations_total
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// sourceLocale is what the code is written in; it has no catalog
+const sourceLocale = "en"
+
+var missingTranslations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_missing_translations_total",
+	Help: "User-facing messages sent in English for lack of a translation, by locale and kind (error, notification).",
+}, []string{"locale", "kind"})
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// catalog is one locale's translations
+type catalog struct {
+	exact    map[string]string
+	patterns []catalogPattern // keys with placeholders, longest first
+}
+
+type catalogPattern struct {
+	re          *regexp.Regexp
+	names       []string
+	translation string
+}
+
+// catalogs is loaded once at startup; a catalog that doesn't parse is a build mistake, so it panics
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]*catalog {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	all := map[string]*catalog{}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			panic("locales/" + f.Name() + ": " + err.Error())
+		}
+		cat := &catalog{exact: entries}
+		for key, translation := range entries {
+			if !placeholderPattern.MatchString(key) {
+				continue
+			}
+			p := catalogPattern{translation: translation}
+			var re strings.Builder
+			re.WriteString("^")
+			last := 0
+			for _, m := range placeholderPattern.FindAllStringSubmatchIndex(key, -1) {
+				re.WriteString(regexp.QuoteMeta(key[last:m[0]]) + "(.+?)")
+				p.names = append(p.names, key[m[2]:m[3]])
+				last = m[1]
+			}
+			re.WriteString(regexp.QuoteMeta(key[last:]) + "$")
+			p.re = regexp.MustCompile(re.String())
+			cat.patterns = append(cat.patterns, p)
+		}
+		// Longer keys are more specific: "prompt too large: {count} ..." before "{message}"
+		sort.Slice(cat.patterns, func(i, j int) bool {
+			return len(cat.patterns[i].re.String()) > len(cat.patterns[j].re.String())
+		})
+		all[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = cat
+	}
+	return all
+}
+
+// supportedLocale reports whether there is a catalog for locale (or it is the source)
+func supportedLocale(locale string) bool {
+	_, ok := catalogs[locale]
+	return ok || locale == sourceLocale
+}
+
+// supportedLocales lists the locales, for validation messages
+func supportedLocales() []string {
+	list := []string{sourceLocale}
+	for locale := range catalogs {
+		list = append(list, locale)
+	}
+	sort.Strings(list[1:])
+	return list
+}
+
+// negotiateLocale picks the best supported language from an Accept-Language header
+func negotiateLocale(header string) string {
+	best, bestQ := sourceLocale, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, q := strings.TrimSpace(part), 1.0
+		if i := strings.Index(tag, ";"); i >= 0 {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(tag[i+1:]), "q="), 64); err == nil {
+				q = v
+			}
+			tag = tag[:i]
+		}
+		lang := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if q > bestQ && supportedLocale(lang) {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// requestLocale is the locale for the response to c
+func requestLocale(c *gin.Context) string {
+	return negotiateLocale(c.GetHeader("Accept-Language"))
+}
+
+// localizeMessage translates an English message, already rendered, into locale. params
+// (an error's details) can fill placeholders the translation adds
+func localizeMessage(locale, kind, message string, params map[string]interface{}) string {
+	cat := catalogs[locale]
+	if cat == nil {
+		return message
+	}
+	if translation, ok := cat.exact[message]; ok {
+		if filled, ok := fillTranslation(cat, locale, translation, params); ok {
+			return filled
+		}
+	}
+	for _, p := range cat.patterns {
+		m := p.re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		merged := map[string]interface{}{}
+		for k, v := range params {
+			merged[k] = v
+		}
+		for i, name := range p.names {
+			merged[name] = m[i+1]
+		}
+		if filled, ok := fillTranslation(cat, locale, p.translation, merged); ok {
+			return filled
+		}
+	}
+	missingTranslations.WithLabelValues(locale, kind).Inc()
+	return message
+}
+
+// translate renders an English template with params in locale, e.g. for notifications
+func translate(locale, kind, template string, params map[string]interface{}) string {
+	if cat := catalogs[locale]; cat != nil {
+		if translation, ok := cat.exact[template]; ok {
+			if filled, ok := fillTranslation(cat, locale, translation, params); ok {
+				return filled
+			}
+		}
+		missingTranslations.WithLabelValues(locale, kind).Inc()
+	}
+	filled, _ := fillTranslation(nil, sourceLocale, template, params)
+	return filled
+}
+
+// fillTranslation substitutes params into translation; ok is false when one is missing
+func fillTranslation(cat *catalog, locale, translation string, params map[string]interface{}) (string, bool) {
+	ok := true
+	filled := placeholderPattern.ReplaceAllStringFunc(translation, func(ph string) string {
+		v, found := params[ph[1:len(ph)-1]]
+		if !found {
+			ok = false
+			return ph
+		}
+		return formatParam(cat, locale, v)
+	})
+	return filled, ok
+}
+
+// Per-locale layouts; times are shown in UTC, with the zone named
+var (
+	localeTimeLayouts = map[string]string{
+		"en": "Jan 2, 2006 15:04 MST", "de": "02.01.2006 15:04 MST", "fr": "02/01/2006 15:04 MST",
+		"es": "02/01/2006 15:04 MST", "ja": "2006年1月2日 15:04 MST",
+	}
+	localeDateLayouts = map[string]string{
+		"en": "Jan 2", "de": "2.1.", "fr": "2/1", "es": "2/1", "ja": "1月2日",
+	}
+	localeThousands = map[string]string{"en": ",", "de": ".", "fr": " ", "es": ".", "ja": ","}
+)
+
+// localeDate is a time shown as a date only
+type localeDate time.Time
+
+// formatParam formats one placeholder value for locale. Captured strings that look like
+// numbers or RFC 3339 times are formatted as such; other strings with a translation of
+// their own (e.g. "image") are translated
+func formatParam(cat *catalog, locale string, v interface{}) string {
+	switch v := v.(type) {
+	case localeDate:
+		return time.Time(v).UTC().Format(localeDateLayouts[locale])
+	case time.Time:
+		return v.UTC().Format(localeTimeLayouts[locale])
+	case *time.Time:
+		if v != nil {
+			return v.UTC().Format(localeTimeLayouts[locale])
+		}
+		return ""
+	case int:
+		return groupDigits(strconv.Itoa(v), locale)
+	case int64:
+		return groupDigits(strconv.FormatInt(v, 10), locale)
+	case float64:
+		if v == float64(int64(v)) {
+			return groupDigits(strconv.FormatInt(int64(v), 10), locale)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return groupDigits(v, locale)
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t.UTC().Format(localeTimeLayouts[locale])
+		}
+		if cat != nil {
+			if translated, ok := cat.exact[v]; ok {
+				return translated
+			}
+		}
+		return v
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func groupDigits(digits, locale string) string {
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) <= 4 {
+		return sign + digits // 1000 reads better than 1,000 in limits like "1-1000"
+	}
+	var b strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(localeThousands[locale])
+		}
+		b.WriteRune(r)
+	}
+	return sign + b.String()
+}
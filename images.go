@@ -0,0 +1,75 @@
+// images.go
+// The image generation kind: parameters, pricing by pixels and steps, and renditions on completion
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const imageGenerationChannel = "image_generation_requests"
+
+var (
+	defaultImageModel = getEnv("DEFAULT_IMAGE_MODEL", "stable-image-ultra")
+	imageCreditCost   = getEnvInt("IMAGE_CREDIT_COST", 1)
+)
+
+func init() {
+	registerKind(&GenerationKind{
+		Name:         "image",
+		Label:        "Image",
+		Channel:      imageGenerationChannel,
+		DefaultModel: defaultImageModel,
+		Spec:         imageSpec,
+		BaseCredits:  func() int { return imageCreditCost },
+		Cost:         imageCost,
+		ApplyCompleted: func(ctx context.Context, completion ImageGenerationCompletion) error {
+			return storeRenditions(ctx, completion)
+		},
+	})
+}
+
+// imageSpec validates resolution, steps and batch size; steps and batch default when omitted
+func imageSpec(req RequestPayload) (generationSpec, error) {
+	steps, numImages := req.Steps, req.NumImages
+	if steps == 0 {
+		steps = defaultSteps
+	}
+	if numImages == 0 {
+		numImages = 1
+	}
+	switch {
+	case req.Resolution < 0 || (req.Resolution > 0 && req.Resolution < 64) || req.Resolution > maxResolution:
+		return generationSpec{}, errors.New("resolution must be between 64 and " + strconv.Itoa(maxResolution))
+	case steps < 1 || steps > maxSteps:
+		return generationSpec{}, errors.New("steps must be between 1 and " + strconv.Itoa(maxSteps))
+	case numImages < 1 || numImages > maxNumImages:
+		return generationSpec{}, errors.New("num_images must be between 1 and " + strconv.Itoa(maxNumImages))
+	}
+	return generationSpec{Resolution: req.Resolution, Steps: steps, NumImages: numImages}, nil
+}
+
+// imageCost scales by pixels, steps and batch size. An omitted resolution is the default
+// capped at the plan's max_image_side; an explicit one over the cap is a problem rather than
+// clamped, unless auto_downscale clamped it before (resolution_caps.go)
+func imageCost(q *Quote, spec generationSpec, limits PlanLimits) float64 {
+	q.Resolution = spec.Resolution
+	if q.Resolution == 0 {
+		q.Resolution = defaultImageResolution
+		if limits.MaxImageSide > 0 {
+			q.Resolution = min(q.Resolution, limits.MaxImageSide)
+		}
+	}
+	if limits.MaxImageSide > 0 && q.Resolution > limits.MaxImageSide {
+		q.Problems = append(q.Problems, fmt.Sprintf("resolution is over your plan's %dpx limit", limits.MaxImageSide))
+	}
+	if spec.NumImages > limits.MaxBatch {
+		q.Problems = append(q.Problems, fmt.Sprintf("num_images is over your plan's batch limit of %d", limits.MaxBatch))
+	}
+
+	side := float64(q.Resolution) / float64(defaultImageResolution)
+	return side * side * float64(spec.Steps) / float64(defaultSteps) * float64(spec.NumImages)
+}
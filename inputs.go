@@ -0,0 +1,191 @@
+// inputs.go
+// User-uploaded source images for img2img/inpainting. Workers never get bucket access:
+// each request carries a presigned URL scoped to its one input and its deadline
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errorCodeInputExpired is the completion error_code a worker reports when the input URL
+// had expired by the time it fetched it
+const errorCodeInputExpired = "input_url_expired"
+
+var (
+	uploadMaxBytes = getEnvInt("UPLOAD_MAX_BYTES", 10<<20)
+	// How long an input URL lives for requests without a deadline
+	inputURLTTL = getEnvDuration("INPUT_URL_TTL", time.Hour)
+	// S3 refuses presigned URLs valid for longer than a week
+	maxPresignTTL = 7 * 24 * time.Hour
+
+	uploadTypes = map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/webp": ".webp"}
+)
+
+// uploadPrefix is where userID's uploads live, under their tenant's prefix
+func uploadPrefix(tenantID, userID string) string {
+	return tenantStoragePrefix(tenantID) + "uploads/" + userID + "/"
+}
+
+// ownsInput reports whether key is one of userID's uploads
+func ownsInput(tenantID, userID, key string) bool {
+	return strings.HasPrefix(key, uploadPrefix(tenantID, userID)) && !strings.Contains(key, "..")
+}
+
+// signInputURL replaces the request's input key with a GET URL for just that object,
+// expiring at the deadline (or after INPUT_URL_TTL without one)
+func signInputURL(ctx context.Context, request *ImageGenerationRequest) error {
+	if request.InputKey == "" {
+		return nil
+	}
+	ttl := inputURLTTL
+	if request.Deadline != nil {
+		ttl = time.Until(*request.Deadline)
+	}
+	ttl = min(max(ttl, time.Minute), maxPresignTTL)
+
+	url, err := storage.PresignGet(ctx, request.InputKey, ttl)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	request.InputURL, request.InputURLExpiresAt = url, &expires
+	return nil
+}
+
+// republishExpiredInput gives a request whose input URL expired one more try with a
+// fresh URL. It reports false when the request has used its retry or is no longer in
+// flight, so the failure should stand
+func republishExpiredInput(ctx context.Context, requestID string) bool {
+	g, err := scanQueuedGeneration(db.QueryRowContext(ctx, `
+		UPDATE generated_content SET input_retries = input_retries + 1
+		WHERE request_id = $1 AND input_retries < 1 AND input_key IS NOT NULL
+		  AND status IN ('queued', 'processing') AND (deadline IS NULL OR deadline > now())
+		RETURNING `+queuedColumns, requestID))
+	if err != nil {
+		return false
+	}
+	if err := publishGenerationRequest(g.channel(), g.request()); err != nil {
+		log.Printf("❌ Failed to republish request %s with a fresh input URL: %v", requestID, err)
+		return false
+	}
+	log.Printf("🔁 Republished request %s with a fresh input URL", requestID)
+	return true
+}
+
+var errUnsupportedUpload = errors.New("must be a PNG, JPEG or WebP image")
+
+// storeInput checks data is an image we accept, moderates it (see moderation.go) and
+// stores it as one of userID's uploads, under their tenant. moderation is the upload's state: pending in
+// async mode, else the verdict. A refused image fails with *moderationRejection or
+// errModerationUnavailable and isn't stored
+func storeInput(ctx context.Context, userID string, data []byte) (key, contentType, moderation string, err error) {
+	// Trust the bytes, not the client's Content-Type
+	contentType = http.DetectContentType(data)
+	ext, ok := uploadTypes[contentType]
+	if !ok {
+		return "", "", "", errUnsupportedUpload
+	}
+	tenant := userTenant(ctx, userID)
+	if tenant == "" {
+		return "", "", "", errors.New("the uploader's tenant is unavailable")
+	}
+	key = uploadPrefix(tenant, userID) + newID() + ext
+
+	verdict := moderationResult{State: moderationAllowed}
+	switch {
+	case !moderationEnabled():
+		// Allowed, with "none" as the moderator on the record
+	case imageModerationAsync:
+		verdict.State = moderationPending
+	default:
+		verdict = moderateImage(ctx, data, contentType)
+		switch verdict.State {
+		case moderationRejected:
+			recordUpload(ctx, key, userID, contentType, len(data), false, verdict)
+			return "", "", "", &moderationRejection{Category: verdict.Category}
+		case moderationUnavailable:
+			recordUpload(ctx, key, userID, contentType, len(data), false, verdict)
+			return "", "", "", errModerationUnavailable
+		}
+	}
+	if err := storage.Put(ctx, key, data, contentType); err != nil {
+		return "", "", "", err
+	}
+	addUserStorage(ctx, userID, int64(len(data)))
+	recordUpload(ctx, key, userID, contentType, len(data), true, verdict)
+	return key, contentType, verdict.State, nil
+}
+
+// respondRefusedInput answers for an upload moderation refused; false for any other error
+func respondRefusedInput(c *gin.Context, err error) bool {
+	var rejection *moderationRejection
+	switch {
+	case errors.As(err, &rejection):
+		respondErrorDetails(c, codeInputRejected, "Image rejected by moderation",
+			gin.H{"field": "file", "category": rejection.Category})
+	case errors.Is(err, errModerationUnavailable):
+		respondError(c, codeUnavailable, "Image moderation is unavailable, please try again shortly")
+	default:
+		return false
+	}
+	return true
+}
+
+// uploadInputHandler handles POST /uploads, returning the key to pass as input_key in
+// POST /generations. A multipart "file" is stored in one go; a JSON body starts a
+// resumable session instead (see upload_sessions.go)
+func uploadInputHandler(c *gin.Context) {
+	if c.ContentType() != "multipart/form-data" {
+		createUploadSessionHandler(c)
+		return
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, codeRequestTooLarge, "Upload too large")
+			return
+		}
+		fieldError(c, codeInvalidRequest, "file", "a multipart file is required")
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		respondError(c, codeInvalidRequest, "Unreadable upload")
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		respondError(c, codeInvalidRequest, "Unreadable upload")
+		return
+	}
+	if !checkStorageQuota(c, user.ID.String(), codeUploadOverQuota, int64(len(data))) {
+		return
+	}
+
+	key, contentType, moderation, err := storeInput(c.Request.Context(), user.ID.String(), data)
+	if errors.Is(err, errUnsupportedUpload) {
+		fieldError(c, codeValidationFailed, "file", err.Error())
+		return
+	}
+	if respondRefusedInput(c, err) {
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to store upload for %s: %v", user.ID, err)
+		respondError(c, codeUpstreamFailed, "Failed to store upload")
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"key": key, "content_type": contentType, "bytes": len(data), "moderation": moderation})
+}
@@ -5,23 +5,33 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 )
 
-// Redis client setup
-var rdb *redis.Client
+// Redis client setup; REDIS_ADDR is the same variable cmd/fakeworker reads
+var (
+	rdb       *redis.Client
+	redisAddr = getEnv("REDIS_ADDR", "localhost:6379")
+)
 
 func init() {
 	rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
+		Addr:     redisAddr,
 		Password: "", // no password
 		DB:       0,  // default DB
 	})
+	instrumentRedis(rdb)
 }
 
 // Request structure to send to Python app
@@ -29,168 +39,623 @@ type ImageGenerationRequest struct {
 	RequestID string `json:"request_id"`
 	UserID    string `json:"user_id"`
 	Prompt    string `json:"prompt"`
+	Model     string `json:"model,omitempty"`
+
+	// Video only
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	FPS             int     `json:"fps,omitempty"`
+
+	// Image only; the worker's own defaults apply when zero
+	Resolution int `json:"resolution,omitempty"` // longest side in px
+	Steps      int `json:"steps,omitempty"`
+	NumImages  int `json:"num_images,omitempty"`
+	// Seed is set when outputs must be reproducible, e.g. both halves of a comparison
+	Seed         int64  `json:"seed,omitempty"`
+	ComparisonID string `json:"comparison_id,omitempty"`
+
+	// Deadline is when the caller stops caring; workers skip jobs already past it
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// MaxSide caps the longest output side in pixels for the user's plan; zero is uncapped
+	MaxSide int `json:"max_side,omitempty"`
+
+	// InputURL is a presigned GET for the img2img source, valid for exactly that object
+	// until the deadline. The key itself never leaves the backend
+	InputKey          string     `json:"-"`
+	InputURL          string     `json:"input_url,omitempty"`
+	InputURLExpiresAt *time.Time `json:"input_url_expires_at,omitempty"`
+
+	// StoragePrefix goes in front of the result's key, so a tenant's objects stay under
+	// its own prefix (see tenants.go); empty for the default tenant
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+
+	// LeaseToken is the fencing token this dispatch runs under, with WORKER_LEASES. The
+	// worker echoes it on the ack and the result (see leases.go)
+	LeaseToken int64 `json:"lease_token,omitempty"`
 }
 
-// Completion structure received from Python app
+// Completion structure received from Python app. S3Key and S3URL hold the object's key and
+// URL whichever names they were sent under (see field_renames.go)
 type ImageGenerationCompletion struct {
-	RequestID           string  `json:"request_id"`
-	UserID             string  `json:"user_id"`
-	Status             string  `json:"status"` // "completed" or "failed"
-	S3Key              string  `json:"s3_key,omitempty"`
-	S3URL              string  `json:"s3_url,omitempty"`
-	GenerationTimeSeconds float64 `json:"generation_time_seconds,omitempty"`
-	Error              string  `json:"error,omitempty"`
-	Timestamp          string  `json:"timestamp"`
+	RequestID             string     `json:"request_id"`
+	UserID                string     `json:"user_id"`
+	Status                string     `json:"status"` // "completed", "failed", "progress" or "processing"
+	S3Key                 string     `json:"s3_key,omitempty"`
+	S3URL                 string     `json:"s3_url,omitempty"`
+	ObjectKey             string     `json:"object_key,omitempty"`
+	ObjectURL             string     `json:"object_url,omitempty"`
+	PosterKey             string     `json:"poster_key,omitempty"` // video poster frame
+	Progress              float64    `json:"progress,omitempty"`   // 0-100, with status "progress"
+	StartedAt             *time.Time `json:"started_at,omitempty"` // with status "processing"
+	GenerationTimeSeconds float64    `json:"generation_time_seconds,omitempty"`
+	GPUSeconds            float64    `json:"gpu_seconds,omitempty"` // billable GPU time, for cost accounting
+	WorkerID              string     `json:"worker_id,omitempty"`
+	Error                 string     `json:"error,omitempty"`
+	ErrorCode             string     `json:"error_code,omitempty"` // machine-readable failure, e.g. "input_url_expired"
+	Timestamp             string     `json:"timestamp"`
+	ArchiveID             string     `json:"archive_id,omitempty"`  // entry ID in the archive stream
+	LeaseToken            int64      `json:"lease_token,omitempty"` // the request's, echoed back
+	// Tenant is whose channel, stream or internal call the completion came in on, set on
+	// receipt whatever the message says, and kept with it through retries
+	Tenant string `json:"tenant,omitempty"`
+
+	Renditions []Rendition `json:"renditions,omitempty"` // sized copies; S3Key is the original
+
+	legacyFields []string // old names this message relied on, set by decoding
 }
 
-// PublishImageGenerationRequest sends a request to the Python app
+// PublishImageGenerationRequest sends a request to the Python app.
+// Oversized prompts are refused with ErrPromptTooLarge.
 func PublishImageGenerationRequest(userID, prompt string) (string, error) {
-	requestID := uuid.New().String()
-	
-	request := ImageGenerationRequest{
+	requestID := newID()
+	if err := publishImageGenerationRequest(requestID, userID, prompt, defaultImageModel); err != nil {
+		return "", err
+	}
+	return requestID, nil
+}
+
+// publishImageGenerationRequest publishes under a caller-chosen ID, so the row can exist before the worker sees it
+func publishImageGenerationRequest(requestID, userID, prompt, model string) error {
+	return publishGenerationRequest(imageGenerationChannel, ImageGenerationRequest{
 		RequestID: requestID,
 		UserID:    userID,
 		Prompt:    prompt,
+		Model:     model,
+	})
+}
+
+// publishGenerationRequest publishes to the given kind's channel
+func publishGenerationRequest(channel string, request ImageGenerationRequest) error {
+	// Guard here too so CLI and batch callers can't bypass the HTTP validation
+	prompt, err := sanitizePrompt(request.Prompt)
+	if err != nil {
+		return err
+	}
+	request.Prompt = prompt
+	if err := signInputURL(context.Background(), &request); err != nil {
+		return err
 	}
+	request.LeaseToken = issueLeaseToken(context.Background(), request.RequestID)
 
-	jsonData, err := json.Marshal(request)
+	// One encoding, from a pooled buffer, for the size check and the publish
+	m, jsonData, err := encodeMessage(request)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer releaseMessage(m)
+	jsonData = compressMessage(jsonData)
+	if len(jsonData) > maxMessageBytes {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, len(jsonData), maxMessageBytes)
 	}
 
-	err = rdb.Publish(context.Background(), "image_generation_requests", jsonData).Err()
+	// Redis only dispatches rows no HTTP worker has claimed; without a row (CLI callers) it always does
+	ctx := context.Background()
+	reserved, err := reserveForRedis(ctx, request.RequestID)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if !reserved {
+		log.Printf("📥 Request %s is claimed over HTTP; not publishing it", request.RequestID)
+		return nil
 	}
 
-	log.Printf("📤 Published generation request: %s", requestID)
-	return requestID, nil
+	receivers, err := brokerPublish(ctx, channel, jsonData)
+	if err != nil || receivers == 0 {
+		if leaveForPull(ctx, request.RequestID, err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	generationRequestsPublished.Inc()
+	requestFlow.add(1, 0)
+	countPublished(ctx, request.Model)
+
+	log.Printf("📤 Published generation request: %s", request.RequestID)
+	return nil
 }
 
-// StartCompletionListener listens for completion notifications from Python app
+// StartCompletionListener listens for completion notifications from Python app, on
+// every tenant's completion channel, and hands them to the completion workers
 func StartCompletionListener() {
-	pubsub := rdb.Subscribe(context.Background(), "image_generation_complete")
+	ctx := context.Background()
+	var channels []string
+	for _, t := range allTenants() {
+		channels = append(channels, t.key(completionChannel))
+	}
+	pubsub := rdb.Subscribe(ctx, channels...)
 	defer pubsub.Close()
 
+	// Subscribe before replaying so nothing falls into the gap between the two;
+	// anything seen by both paths is applied twice, which is harmless
+	for range channels {
+		if _, err := pubsub.Receive(ctx); err != nil {
+			log.Printf("❌ Failed to subscribe to completions: %v", err)
+			return
+		}
+	}
+	if err := replayCompletionArchive(ctx); err != nil {
+		log.Printf("❌ Failed to replay completion archive: %v", err)
+	}
+
 	log.Println("👂 Listening for image generation completions...")
 
-	for msg := range pubsub.Channel() {
+	deliver := func(channel, payload string) {
 		var completion ImageGenerationCompletion
-		if err := json.Unmarshal([]byte(msg.Payload), &completion); err != nil {
+		if err := decodeWorkerMessage("completion", []byte(payload), &completion); err != nil {
 			log.Printf("❌ Failed to parse completion: %v", err)
-			continue
+			deadLetter(ctx, channel, payload, decodeErrorClass(err), "", err)
+			return
 		}
+		// The channel says whose workers sent it, not the message
+		completion.Tenant, _ = tenantOfChannel(channel)
 
 		log.Printf("📥 Received completion for request %s: %s", completion.RequestID, completion.Status)
-
-		if completion.Status == "completed" {
-			// Update your database with the S3 URL
-			err := UpdateGeneratedContentWithImage(completion.RequestID, completion.S3Key, completion.S3URL)
-			if err != nil {
-				log.Printf("❌ Failed to update database: %v", err)
-			} else {
-				log.Printf("✅ Updated database for request %s", completion.RequestID)
-			}
-		} else if completion.Status == "failed" {
-			// Handle failure
-			log.Printf("❌ Generation failed for request %s: %s", completion.RequestID, completion.Error)
-			// You might want to update the database to mark this request as failed
-		}
+		liveArchive(completion.Tenant).track(completion.ArchiveID)
+		completionQueue <- completion
+	}
+	for msg := range pubsub.Channel() {
+		redisMessageReceived(msg.Channel)
+		listenerActivity.messageReceived()
+		chaosDeliverCompletion(msg.Payload, func(payload string) { deliver(msg.Channel, payload) })
+		chaosMaybeKillRedis(pubsub)
 	}
 }
 
 // UpdateGeneratedContentWithImage updates your database with the generated image
-func UpdateGeneratedContentWithImage(requestID, s3Key, s3URL string) error {
-	// This is where you'd update your generated_content table
-	// Example SQL would be:
-	// UPDATE generated_content 
-	// SET content_url = $1, text_response = $2, content_type = 'image'
-	// WHERE request_id = $3
-
+// The S3 key is stored rather than the URL; signed URLs are generated on demand.
+// applied is false for a repeated completion, which must not undo post-processing;
+// contentType picks the kind whose ApplyCompleted stores the rest. A completion for a
+// timed-out row is attached as a late result instead (see deadlines.go). userID is the
+// request's owner as read from its row; a row belonging to anyone else isn't written and
+// fails with an ownerMismatchError. The write claims the result in fx (see
+// processed_effects.go). One that kept losing to concurrent writes fails with
+// errTransitionContended, for the completion worker to retry, not to ack as a repeat
+func UpdateGeneratedContentWithImage(fx *completionEffects, requestID, userID, s3Key, s3URL string, generationSeconds float64) (applied bool, contentType string, err error) {
 	log.Printf("🔄 Updating database: request_id=%s, s3_key=%s, s3_url=%s", requestID, s3Key, s3URL)
-	
-	// Your database update logic here
-	// For example, using your existing genRepo:
-	// return genRepo.UpdateWithImageURL(requestID, s3Key, s3URL)
-	
-	return nil // placeholder
+	ctx := context.Background()
+
+	if applied, contentType, err = attachLateResult(ctx, fx, requestID, userID, s3Key, generationSeconds); applied || err != nil {
+		return applied, contentType, err
+	}
+	applied, err = transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "listener", To: "completed", From: []string{"queued", "processing"}, Owner: userID,
+		Set:  "content_url = $4, completed_at = now(), generation_time_seconds = $5",
+		Args: []interface{}{s3Key, generationSeconds}, Returning: "content_type",
+		Scan:    func(row rowScanner) error { return row.Scan(&contentType) },
+		Effects: []string{effectResult}, Claimed: fx.note,
+	})
+	if err == nil && !applied {
+		// The sweeper may have timed the row out between the two writes
+		return attachLateResult(ctx, fx, requestID, userID, s3Key, generationSeconds)
+	}
+	return applied, contentType, err
 }
 
 // Modified version of your protected endpoint
 func protectedEndpointWithAsyncGeneration(c *gin.Context) {
-	var req RequestPayload
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+	req, ok := bindGenerationRequest(c)
+	if !ok {
+		return
+	}
+	kind, ok := kindFor(c, req.RequestType)
+	if !ok {
 		return
 	}
 
-	log.Println("Received request:", req.Text, "Type:", req.RequestType)
+	log.Println("Received request:", logPrompt(req.Text), "Type:", kind.Name)
 	user := c.MustGet("currentUser").(*repository.User)
-	reqID := uuid.New()
+	reqID := idGen.NewID()
 
 	// Store the request in database
 	reqRepo.Create(reqID, user.ID, req.RequestType, req.Text)
 
-	requestType := req.RequestType
-	if requestType == "" {
-		requestType = "text"
+	if !kind.queued() {
+		release, ok := admitSynchronous(c, user.ID.String(), kind, reqID.String())
+		if !ok {
+			return
+		}
+		defer release()
+		kind.Handle(c, user, req, reqID)
+		clearSubmittedDraft(c, user.ID.String(), req.DraftID)
+		return
+	}
+	spec, ok := queuedGenerationSpec(c, req)
+	if !ok {
+		return
+	}
+	queueGeneration(c, user, req, spec)
+	clearSubmittedDraft(c, user.ID.String(), req.DraftID)
+}
+
+// bindGenerationRequest parses a POST /generations body, renders its template if it names
+// one, defaults request_type and sanitizes the resulting prompt
+func bindGenerationRequest(c *gin.Context) (RequestPayload, bool) {
+	var req RequestPayload
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, codeRequestTooLarge, "Request body too large")
+			return req, false
+		}
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return req, false
 	}
+	var ok bool
+	if req.Notify, ok = notifyMode(req.Notify); !ok {
+		fieldError(c, codeValidationFailed, "notify", "must be all, failures_only or none")
+		return req, false
+	}
+	if !validBatchID(req.BatchID) {
+		fieldError(c, codeValidationFailed, "batch_id", "must be at most 64 letters, digits, dashes or underscores")
+		return req, false
+	}
+	if !validDraftID(req.DraftID) {
+		fieldError(c, codeValidationFailed, "draft_id", "must be at most 64 letters, digits, dashes or underscores")
+		return req, false
+	}
+	if !applyTemplate(c, &req) {
+		return req, false
+	}
+	// After the template, whose defaults may name the type
+	req.RequestType = requestTypeOrDefault(req.RequestType)
 
-	if requestType == "image" {
-		// Instead of generating immediately, publish to Redis
-		generationRequestID, err := PublishImageGenerationRequest(user.ID.String(), req.Text)
+	text, err := sanitizePrompt(req.Text)
+	if err != nil {
+		recordRejectedPrompt(c)
+		code, _ := errorCodeFor(err)
+		fieldError(c, code, "text", err.Error())
+		return req, false
+	}
+	req.Text = text
+	return req, true
+}
+
+// queuedGenerationSpec validates the image/video parameters of a request
+func queuedGenerationSpec(c *gin.Context, req RequestPayload) (generationSpec, bool) {
+	if req.MaxWaitSeconds < 0 || req.MaxWaitSeconds > maxWaitSecondsLimit {
+		fieldError(c, codeValidationFailed, "max_wait_seconds", "must be between 1 and 86400")
+		return generationSpec{}, false
+	}
+	spec, err := generationSpecFor(req.RequestType, req)
+	if err != nil {
+		respondError(c, codeValidationFailed, err.Error())
+		return generationSpec{}, false
+	}
+	return spec, true
+}
+
+// checkGenerationRequest checks what the user may reference: the org and the input image
+func checkGenerationRequest(c *gin.Context, userID string, req RequestPayload, spec generationSpec) bool {
+	// Org attribution requires an active membership; removed members fall back to an error, not personal credits
+	if req.OrgID != "" {
+		if _, err := uuid.Parse(req.OrgID); err != nil {
+			fieldError(c, codeValidationFailed, "org_id", "must be a UUID")
+			return false
+		}
+		role, err := orgRole(c.Request.Context(), req.OrgID, userID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue image generation"})
+			respondError(c, codeInternal, "Failed to queue "+spec.Kind+" generation")
+			return false
+		}
+		if role == "" {
+			fieldError(c, codeNotMember, "org_id", "you are not a member of this organization")
+			return false
+		}
+	}
+
+	if req.InputKey != "" && (spec.Kind != "image" || !ownsInput(currentTenant(c).ID, userID, req.InputKey)) {
+		fieldError(c, codeValidationFailed, "input_key", "must be one of your uploads, for an image request")
+		return false
+	}
+	if req.InputKey != "" {
+		verdict, err := uploadModeration(c.Request.Context(), req.InputKey)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to queue "+spec.Kind+" generation")
+			return false
+		}
+		if verdict.State != moderationPending && !verdict.usable() {
+			respondErrorDetails(c, codeInputRejected, "Image rejected by moderation",
+				gin.H{"field": "input_key", "category": verdict.rejectionCategory()})
+			return false
+		}
+	}
+	return checkStorageQuota(c, userID, codeStorageFull, 0)
+}
+
+// queueGeneration validates, charges, stores and publishes an image or video request
+func queueGeneration(c *gin.Context, user *repository.User, req RequestPayload, spec generationSpec) {
+	userID := user.ID.String() // formatted once; it's in most calls below
+	if !checkGenerationRequest(c, userID, req, spec) {
+		return
+	}
+
+	limits := userPlanLimits(c.Request.Context(), userID)
+	requestedResolution, ok := enforceResolutionCap(c, &spec, limits, req.AutoDownscale)
+	if !ok {
+		return
+	}
+	quote := quoteGeneration(c.Request.Context(), spec, limits)
+	if len(quote.Problems) > 0 {
+		respondErrorDetails(c, codeForbidden, quote.Problems[0],
+			gin.H{"model": spec.Model, "plan": limits.Plan, "problems": quote.Problems})
+		return
+	}
+
+	if refuseRetiredModel(c, spec.Model) {
+		return
+	}
+	// Refuse up front rather than charge for work no worker can pick up
+	if modelRefused(c.Request.Context(), spec.Model) {
+		respondError(c, codeModelUnavailable, spec.Label+" generation is temporarily unavailable, please try again shortly")
+		return
+	}
+	if modelQueueFull(c.Request.Context(), spec.Model) {
+		c.Header("Retry-After", "30")
+		respondErrorDetails(c, codeQueueFull, spec.Label+" generation is at capacity, please try again shortly",
+			gin.H{"model": spec.Model, "max_queue_depth": maxQueueDepth})
+		return
+	}
+	if until, blocked := modelBlockedUntil(c.Request.Context(), userID, spec.Model); blocked {
+		respondErrorDetails(c, codeModelBlocked, "This model is paused for your account after repeated failures",
+			gin.H{"model": spec.Model, "until": until, "hint": failureStormHint})
+		return
+	}
+
+	// Translation/enhancement is opt-in and always falls back to the original prompt
+	prompt := processPrompt(c.Request.Context(), userID, req.Text)
+
+	generationRequestID := newID()
+	decision, err := tryAdmit(c.Request.Context(), userID, spec.Kind, generationRequestID)
+	if err != nil {
+		log.Printf("❌ Admission check failed: %v", err)
+		respondError(c, codeInternal, "Failed to queue "+spec.Kind+" generation")
+		return
+	}
+	if !decision.Admitted && decision.Mode == admissionReject {
+		admissionDecisions.WithLabelValues("rejected", spec.Kind).Inc()
+		respondErrorDetails(c, codeRateLimited, "Rate limit exceeded", admissionDetails(decision))
+		return
+	}
+
+	var deadline *time.Time
+	if req.MaxWaitSeconds > 0 {
+		d := clock.Now().Add(time.Duration(req.MaxWaitSeconds) * time.Second).UTC().Truncate(time.Second)
+		deadline = &d
+
+		// A deadline we already expect to miss would only burn credits for a refund
+		eta := decision.ETA
+		if decision.Admitted {
+			if eta, err = completionETA(c.Request.Context(), spec.Model); err != nil {
+				eta = time.Time{}
+			}
+		}
+		if eta.After(d) {
+			releaseAdmission(c.Request.Context(), userID, generationRequestID)
+			respondErrorDetails(c, codeValidationFailed, "max_wait_seconds: shorter than the current ETA",
+				gin.H{"field": "max_wait_seconds", "eta": eta})
 			return
 		}
+	}
+
+	deprecation := acceptModelRequest(c, spec.Model)
+
+	// Store the row first so the completion always has something to update
+	row := newGeneration{
+		RequestID:      generationRequestID,
+		UserID:         userID,
+		Tenant:         currentTenant(c).ID,
+		OriginalPrompt: req.Text,
+		Prompt:         prompt,
+		Model:          spec.Model,
+		ContentType:    spec.Kind,
+		Status:         "queued",
+		OrgID:          req.OrgID,
+		Credits:        quote.Credits,
 
-		// Store the generation request ID for tracking
-		// You might want to update your database to store this relationship
+		DurationSeconds:     spec.DurationSeconds,
+		FPS:                 spec.FPS,
+		Resolution:          quote.Resolution,
+		RequestedResolution: requestedResolution,
+		Steps:               quote.Steps,
+		NumImages:           quote.NumImages,
+		Deadline:            deadline,
+		MaxSide:             limits.MaxImageSide,
+		InputKey:            req.InputKey,
+		TemplateID:          req.TemplateID,
+		Notify:              req.Notify,
+		BatchID:             req.BatchID,
+		Client:              requestClient(c),
+	}
+	held := inputAwaitingModeration(c.Request.Context(), req.InputKey)
+	switch {
+	case held:
+		// Admission runs again when the verdict releases it to the deferred scheduler
+		row.Status = generationPendingModeration
+	case !decision.Admitted:
+		row.Status = "deferred"
+		row.DeferredUntil = &decision.ETA
+	}
+	if err := chargeCredits(c.Request.Context(), userID, req.OrgID, generationRequestID, row.Credits); err != nil {
+		releaseAdmission(c.Request.Context(), userID, generationRequestID)
+		respondChargeError(c, err, spec.Kind, row.Credits, "Failed to queue "+spec.Kind+" generation")
+		return
+	}
+	if err := createGeneration(c.Request.Context(), row); err != nil {
+		// Charged but never stored, so nothing else would give the credits or the slot back
+		ctx := context.WithoutCancel(c.Request.Context())
+		if rerr := refundUnstored(ctx, userID, req.OrgID, generationRequestID, row.Credits, "not_stored"); rerr != nil {
+			log.Printf("❌ Failed to refund %d credits for unstored request %s: %v", row.Credits, generationRequestID, rerr)
+			errorReporter.Report(rerr, map[string]string{"where": "queue_refund", "request_id": generationRequestID})
+		}
+		releaseAdmission(ctx, userID, generationRequestID)
+		respondError(c, codeInternal, "Failed to queue "+spec.Kind+" generation")
+		return
+	}
+	recordPromptSignal(c.Request.Context(), userID, req.Text)
 
-		c.JSON(http.StatusAccepted, gin.H{
-			"type": "image",
-			"status": "queued",
-			"generation_request_id": generationRequestID,
-			"message": "Image generation queued. You'll receive a notification when complete."
+	if held {
+		respondJSON(c, http.StatusAccepted, QueuedGenerationResponse{
+			Type:                spec.Kind,
+			Status:              generationPendingModeration,
+			GenerationRequestID: generationRequestID,
+			Credits:             row.Credits,
+			Resolution:          row.Resolution,
+			RequestedResolution: row.RequestedResolution,
+			Message:             "Your input image is still being checked; this generation will start once it's cleared.",
+			Deprecation:         deprecation,
 		})
-	} else {
-		// Handle text processing as before
-		respText := req.Text + "+haha"
-		
-		// Save to database as before
-		if err := genRepo.Create(
-			user.ID,
-			reqID,
-			time.Now(),
-			respText,
-			"text",
-			"",
-			false,
-		); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot save generated content"})
+		return
+	}
+	if !decision.Admitted {
+		// The deferred scheduler publishes it once the user's window frees up
+		admissionDecisions.WithLabelValues("deferred", spec.Kind).Inc()
+		respondJSON(c, http.StatusAccepted, QueuedGenerationResponse{
+			Type:                spec.Kind,
+			Status:              "deferred",
+			GenerationRequestID: generationRequestID,
+			Credits:             row.Credits,
+			ETA:                 &decision.ETA,
+			Resolution:          row.Resolution,
+			RequestedResolution: row.RequestedResolution,
+			Message:             "You're over your current limit, so this generation will start automatically around the ETA.",
+			Deprecation:         deprecation,
+		})
+		return
+	}
+	admissionDecisions.WithLabelValues("admitted", spec.Kind).Inc()
+
+	// Instead of generating immediately, publish to Redis
+	if err := publishGenerationRequest(row.channel(), row.request()); err != nil {
+		markGenerationFailed(c.Request.Context(), generationRequestID, userID, "publish failed: "+err.Error())
+		if errors.Is(err, ErrMessageTooLarge) {
+			respondError(c, codeMessageTooLarge, err.Error())
 			return
 		}
+		respondError(c, codeInternal, "Failed to queue "+spec.Kind+" generation")
+		return
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"type": "text",
-			"data": respText,
-		})
+	resp := QueuedGenerationResponse{
+		Type:                spec.Kind,
+		Status:              "queued",
+		GenerationRequestID: generationRequestID,
+		Credits:             row.Credits,
+		EstimatedSeconds:    quote.EstimatedSeconds,
+		Resolution:          row.Resolution,
+		RequestedResolution: row.RequestedResolution,
+		Message:             spec.Label + " generation queued. You'll receive a notification when complete.",
+		Deprecation:         deprecation,
+	}
+	if eta, err := completionETA(c.Request.Context(), spec.Model); err == nil {
+		resp.ETA = &eta
 	}
+	respondJSON(c, http.StatusAccepted, resp)
 }
 
 func main() {
+	// `mobart migrate [up|down|status]` applies the embedded migrations and exits
+	if len(os.Args) >= 2 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		return
+	}
+
 	log.Println("🚀 Starting Go backend with Redis integration...")
 
-	// Start the completion listener in a goroutine
-	go StartCompletionListener()
+	go startMetricsServer()
+	runStartupChecks()
+	autoMigrateOnStart()
+	if err := loadModelLifecycles(context.Background()); err != nil {
+		log.Printf("⚠️ Failed to load model lifecycles, treating every model as active: %v", err)
+	}
 
-	// Example: publish a test request
-	time.Sleep(2 * time.Second)
-	_, err := PublishImageGenerationRequest("test-user-id", "A fierce dragon with glowing eyes")
-	if err != nil {
-		log.Printf("Failed to publish test request: %v", err)
+	// A bad plan configuration must not start serving; an unreachable database just
+	// means the environment defaults until the next reload
+	if err := loadPlanLimits(context.Background()); errors.Is(err, errInvalidPlanConfig) {
+		log.Fatalf("❌ %v", err)
+	} else if err != nil {
+		log.Printf("⚠️ Failed to load plan limits, using defaults: %v", err)
 	}
 
-	// Keep the program running
-	select {}
+	// Start the completion listener in a goroutine
+	startCompletionWorkers(getEnvInt("COMPLETION_WORKERS", 4))
+	go superviseForever("completion_listener", StartCompletionListener)
+	go superviseForever("postprocess_backfill", startPostprocessBackfill)
+	go superviseForever("deferred_scheduler", startDeferredScheduler)
+	go superviseForever("realtime_relay", startRealtimeRelay)
+	go superviseForever("retention", startRetentionJob)
+	go superviseForever("backfill_runner", startBackfillRunner)
+	go superviseForever("analytics_scheduler", startAnalyticsScheduler)
+	go superviseForever("heartbeat_listener", startHeartbeatListener)
+	go superviseForever("deadline_sweeper", startDeadlineSweeper)
+	go superviseForever("stale_sweeper", startStaleSweeper)
+	go superviseForever("trash_purge", startTrashPurge)
+	go superviseForever("cost_materializer", startCostMaterializer)
+	go superviseForever("delivery_worker", startDeliveryWorker)
+	go superviseForever("degraded_monitor", startDegradedMonitor)
+	go superviseForever("plan_reload_listener", startPlanReloadListener)
+	go superviseForever("model_lifecycle_listener", startModelLifecycleListener)
+	go superviseForever("jwks_refresh", startJWKSRefresher)
+	go superviseForever("auth_revocation_listener", startAuthRevocationListener)
+	go superviseForever("listener_watchdog", startListenerWatchdog)
+	go superviseForever("slo_monitor", startSLOMonitor)
+	go superviseForever("upload_cleanup", startUploadCleanup)
+	go superviseForever("abuse_analyzer", startAbuseAnalyzer)
+	go superviseForever("orphan_sweep", startOrphanSweep)
+	go superviseForever("dlq_maintenance", startDLQMaintenance)
+	go superviseForever("storage_reconciliation", startStorageReconciliation)
+	go superviseForever("claim_sweeper", startClaimSweeper)
+	go superviseForever("completion_retry", startCompletionRetryLoop)
+	go superviseForever("queue_history", startQueueHistorySampler)
+	go superviseForever("progress_flusher", startProgressFlusher)
+	// Also runs with IMAGE_MODERATION_ASYNC off, so uploads left pending still settle
+	if moderationEnabled() {
+		go superviseForever("upload_moderation", startUploadModerationWorker)
+	}
+	if canaryEnabled() {
+		go superviseForever("canary", startCanary)
+	} else {
+		log.Println("ℹ️ CANARY_USER_ID not set; no canary generations")
+	}
+	if embeddingsEnabled() {
+		go superviseForever("embedding_worker", startEmbeddingWorker)
+	} else {
+		log.Println("ℹ️ EMBEDDING_SERVICE_URL not set; similar generations are disabled")
+	}
+
+	go func() {
+		if err := setupRouter().Run(getEnv("HTTP_ADDR", ":8080")); err != nil {
+			log.Fatalf("❌ HTTP server stopped: %v", err)
+		}
+	}()
+
+	// Keep the program running until told to stop, then write what is still buffered
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("🛑 %s received, shutting down", <-stop)
+	if err := flushProgressMilestones(context.Background(), "shutdown"); err != nil {
+		log.Printf("⚠️ Failed to write progress milestones on shutdown: %v", err)
+	}
 }
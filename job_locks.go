@@ -0,0 +1,78 @@
+// job_locks.go
+// Redis locks that keep a background job on one instance while it runs. Each holder
+// writes a token of its own and renews the TTL while it works, so a long pass never
+// outlives its lock, and lets go with a compare-and-delete: a holder whose lock lapsed
+// can't free or extend the lock another instance has taken since
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// renewJobLockScript extends the lock only while it is still the caller's
+var renewJobLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseJobLockScript deletes the lock only while it is still the caller's
+var releaseJobLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// acquireJobLock takes key for ttl and renews it every third of that until release is
+// called. The returned context is cancelled if the lock is lost meanwhile (a renewal
+// found another holder, or Redis was out for longer than ttl), so the job stops instead
+// of running alongside the next holder. ok is false when someone else holds it
+func acquireJobLock(ctx context.Context, key string, ttl time.Duration) (_ context.Context, release func(), ok bool) {
+	token := newID()
+	ok, err := rdb.SetNX(ctx, key, token, ttl).Result()
+	if err != nil || !ok {
+		return ctx, func() {}, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		renewed := time.Now()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			n, err := renewJobLockScript.Run(context.Background(), rdb, []string{key}, token, ttl.Milliseconds()).Int()
+			switch {
+			case err == nil && n == 1:
+				renewed = time.Now()
+				continue
+			case err != nil && time.Since(renewed) < ttl:
+				log.Printf("⚠️ Failed to renew lock %s: %v", key, err)
+				continue
+			}
+			log.Printf("⚠️ Lost lock %s; stopping its job", key)
+			cancel()
+			return
+		}
+	}()
+
+	return ctx, func() {
+		close(stop)
+		<-done
+		cancel()
+		if err := releaseJobLockScript.Run(context.Background(), rdb, []string{key}, token).Err(); err != nil {
+			log.Printf("⚠️ Failed to release lock %s: %v", key, err)
+		}
+	}, true
+}
@@ -0,0 +1,378 @@
+// job_pull.go
+// HTTP pull mode for the Python workers, a fallback for when Redis is unreliable:
+// GET /internal/jobs/next claims the oldest queued request for a model and POST
+// /internal/jobs/:id/complete takes the same completion message the listener would.
+// The claim on the row is authoritative: publishing reserves a row for Redis and a pull
+// claims it for one worker, each only if the other hasn't, so no request goes out twice.
+// A tenant's workers send X-Tenant-ID and only ever see and complete its jobs. A long job
+// keeps its claim with POST /internal/jobs/:id/heartbeat, which also renews its lease
+// (leases.go); with leases, the lease rather than the claim's expiry decides when it lapses
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// Workers authenticate with "Authorization: Bearer <token>"; unset disables pull mode
+	internalAPIToken = getEnv("INTERNAL_API_TOKEN", "")
+	// A claim not completed or extended by progress within this returns to the queue
+	jobClaimTTL           = getEnvDuration("JOB_CLAIM_TTL", 10*time.Minute)
+	jobClaimSweepInterval = getEnvDuration("JOB_CLAIM_SWEEP_INTERVAL", 30*time.Second)
+
+	jobPullClaims = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_job_pull_claims_total",
+		Help: "GET /internal/jobs/next calls, by outcome (claimed, empty).",
+	}, []string{"outcome"})
+	jobClaimsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_job_claims_expired_total",
+		Help: "HTTP claims that expired without a completion and went back to the queue.",
+	})
+	jobPullFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_job_pull_fallbacks_total",
+		Help: "Requests left for HTTP pull instead of Redis, by reason (publish_failed, no_subscribers).",
+	}, []string{"reason"})
+)
+
+// jobPullEnabled reports whether workers can pull, and so whether Redis misses can wait for them
+func jobPullEnabled() bool {
+	return internalAPIToken != ""
+}
+
+// JobClaim is the body of a claim: the Redis request message plus when the claim, and
+// with leases the lease, lapses
+type JobClaim struct {
+	ImageGenerationRequest
+	ClaimExpiresAt time.Time  `json:"claim_expires_at"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// reserveForRedis marks the row dispatched over Redis unless a worker holds it over HTTP.
+// A request without a row is reserved, as there is nothing to claim
+func reserveForRedis(ctx context.Context, requestID string) (bool, error) {
+	var reserved, exists bool
+	err := db.QueryRowContext(ctx, `
+		WITH r AS (
+			UPDATE generated_content SET dispatch = 'redis', dispatched_at = now()
+			WHERE request_id = $1 AND dispatch IS DISTINCT FROM 'http'
+			RETURNING 1
+		)
+		SELECT EXISTS (SELECT 1 FROM r), EXISTS (SELECT 1 FROM generated_content WHERE request_id = $1)`,
+		requestID).Scan(&reserved, &exists)
+	if err != nil {
+		return false, err
+	}
+	return reserved || !exists, nil
+}
+
+// leaveForPull hands a queued row Redis didn't deliver (publishErr, or nobody subscribed)
+// back to the pull queue. false when pull mode is off or the row can't wait there
+func leaveForPull(ctx context.Context, requestID string, publishErr error) bool {
+	if !jobPullEnabled() {
+		return false
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET dispatch = NULL
+		WHERE request_id = $1 AND dispatch = 'redis' AND status = 'queued'`, requestID)
+	if err != nil {
+		log.Printf("❌ Failed to leave request %s for HTTP pull: %v", requestID, err)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false
+	}
+	reason := "no_subscribers"
+	if publishErr != nil {
+		reason = "publish_failed"
+	}
+	jobPullFallbacks.WithLabelValues(reason).Inc()
+	log.Printf("📥 Request %s left for HTTP pull (%s)", requestID, reason)
+	return true
+}
+
+// internalAuth guards /internal with INTERNAL_API_TOKEN
+func internalAuth(c *gin.Context) {
+	if !jobPullEnabled() {
+		respondError(c, codeUnavailable, "Job pull is disabled")
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(internalAPIToken)) != 1 {
+		respondError(c, codeUnauthorized, "Unauthorized")
+		return
+	}
+	// A tenant's workers name it; the host can't, internal calls being cluster-local
+	if !internalTenant(c) {
+		return
+	}
+	c.Next()
+}
+
+// claimNextJob claims the tenant's oldest queued, undispatched request for model,
+// low-priority rows (regression runs) only when no other is waiting. ok is false when there is none. Candidates another instance or the publisher takes first are skipped
+func claimNextJob(ctx context.Context, tenantID, model, workerID string) (claim JobClaim, ok bool, err error) {
+	ids, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content
+		WHERE status = 'queued' AND dispatch IS NULL AND model = $1 AND tenant_id = $2
+		  AND (deadline IS NULL OR deadline > now())
+		ORDER BY low_priority, created_at LIMIT 10`, model, tenantID)
+	if err != nil {
+		return claim, false, err
+	}
+	for _, id := range ids {
+		var g newGeneration
+		applied, err := transitionGeneration(ctx, id, generationWrite{
+			Writer: "http_pull", To: "processing", From: []string{"queued"}, Where: "dispatch IS NULL",
+			Set: "dispatch = 'http', claimed_by = $4, claim_expires_at = now() + $5 * interval '1 second', " +
+				"dispatched_at = now(), started_at = now(), started_by = $4",
+			Args:      []interface{}{workerID, jobClaimTTL.Seconds()},
+			Returning: queuedColumns + ", claim_expires_at",
+			Scan: func(row rowScanner) (err error) {
+				g, err = scanQueuedGeneration(row, &claim.ClaimExpiresAt)
+				return err
+			},
+		})
+		if errors.Is(err, errTransitionContended) {
+			continue // fought over; try the next candidate
+		}
+		if err != nil {
+			return claim, false, err
+		}
+		if !applied {
+			continue
+		}
+		claim.ImageGenerationRequest = g.request()
+		claim.LeaseExpiresAt, claim.LeaseToken = startLease(ctx, id, workerID, 0)
+		notifyWebhookEvent(ctx, id, "processing", 0)
+		if err := signInputURL(ctx, &claim.ImageGenerationRequest); err != nil {
+			return claim, false, fmt.Errorf("sign input for %s: %w", id, err)
+		}
+		return claim, true, nil
+	}
+	return claim, false, nil
+}
+
+// nextJobHandler handles GET /internal/jobs/next?model=&worker_id=: 200 with the claimed
+// request, 204 when nothing is waiting
+func nextJobHandler(c *gin.Context) {
+	model, workerID := c.Query("model"), c.Query("worker_id")
+	if model == "" {
+		fieldError(c, codeValidationFailed, "model", "is required")
+		return
+	}
+	if workerID == "" {
+		fieldError(c, codeValidationFailed, "worker_id", "is required")
+		return
+	}
+
+	claim, ok, err := claimNextJob(c.Request.Context(), currentTenant(c).ID, model, workerID)
+	if err != nil {
+		log.Printf("❌ Failed to claim a %s job for worker %s: %v", model, workerID, err)
+		respondError(c, codeInternal, "Failed to claim a job")
+		return
+	}
+	if !ok {
+		jobPullClaims.WithLabelValues("empty").Inc()
+		c.Status(http.StatusNoContent)
+		return
+	}
+	jobPullClaims.WithLabelValues("claimed").Inc()
+	log.Printf("📤 Worker %s claimed request %s over HTTP until %s", workerID, claim.RequestID,
+		claim.ClaimExpiresAt.Format(time.RFC3339))
+	c.JSON(http.StatusOK, claim)
+}
+
+// completeJobHandler handles POST /internal/jobs/:id/complete with a completion message.
+// Only the worker holding the claim may report; progress extends the claim, and
+// completed or failed goes through the listener's path, dead letters included
+func completeJobHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	requestID := c.Param("id")
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, codeRequestTooLarge, "Request body too large")
+		return
+	}
+	var completion ImageGenerationCompletion
+	if err := decodeWorkerMessage("completion", body, &completion); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid completion: "+err.Error())
+		return
+	}
+	if completion.RequestID == "" {
+		completion.RequestID = requestID
+	}
+	if completion.RequestID != requestID {
+		fieldError(c, codeValidationFailed, "request_id", "does not match the job")
+		return
+	}
+	switch completion.Status {
+	case "completed", "failed", "progress", "processing":
+	default:
+		fieldError(c, codeValidationFailed, "status", "must be completed, failed, progress or processing")
+		return
+	}
+
+	// Another tenant's job doesn't exist for this worker
+	tenant := currentTenant(c)
+	if owner, err := generationTenant(ctx, requestID); err == nil && owner != "" && owner != tenant.ID {
+		respondCrossTenant(c, "job_complete", "Generation not found")
+		return
+	}
+	completion.Tenant = tenant.ID
+
+	// Progress extends the claim in the same write that checks it. A timed-out row still
+	// takes its holder's result, as a late one
+	var userID string
+	err = db.QueryRowContext(ctx, `
+		UPDATE generated_content
+		SET claim_expires_at = CASE WHEN $3 THEN now() + $4 * interval '1 second' ELSE claim_expires_at END
+		WHERE request_id = $1 AND status IN ('processing', 'timed_out') AND dispatch = 'http' AND claimed_by = $2
+		  AND tenant_id = $5
+		RETURNING user_id`, requestID, completion.WorkerID, completion.Status == "progress",
+		jobClaimTTL.Seconds(), tenant.ID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		respondErrorDetails(c, codeConflict, "Worker does not hold a claim on this job",
+			gin.H{"request_id": requestID, "worker_id": completion.WorkerID})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to check the claim on request %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to record completion")
+		return
+	}
+	if completion.UserID == "" {
+		completion.UserID = userID
+	}
+
+	applyCompletion("http_completion", completion)
+	c.JSON(http.StatusOK, gin.H{"request_id": requestID, "status": completion.Status})
+}
+
+// heartbeatJobHandler handles POST /internal/jobs/:id/heartbeat with {"worker_id"}: the
+// claim's holder keeps it another JOB_CLAIM_TTL, and its lease another WORKER_LEASE_TTL.
+// A 409 means the job was taken back and the worker should drop it
+func heartbeatJobHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	requestID := c.Param("id")
+	var body struct {
+		WorkerID string `json:"worker_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if body.WorkerID == "" {
+		fieldError(c, codeValidationFailed, "worker_id", "is required")
+		return
+	}
+	lost := gin.H{"request_id": requestID, "worker_id": body.WorkerID}
+
+	// The lease first: once it's refused, the claim can't be extended past a reclaim
+	resp := gin.H{"request_id": requestID}
+	if workerLeases {
+		outcome, err := renewLease(ctx, requestID, body.WorkerID)
+		if err != nil {
+			log.Printf("❌ Failed to renew the lease on request %s: %v", requestID, err)
+			respondError(c, codeInternal, "Failed to renew the claim")
+			return
+		}
+		if outcome == "lost" || outcome == "expired" {
+			respondErrorDetails(c, codeConflict, "Worker does not hold a claim on this job", lost)
+			return
+		}
+		if outcome == "renewed" {
+			resp["lease_expires_at"] = clock.Now().Add(workerLeaseTTL)
+		}
+	}
+	var expiresAt time.Time
+	err := db.QueryRowContext(ctx, `
+		UPDATE generated_content SET claim_expires_at = now() + $3 * interval '1 second'
+		WHERE request_id = $1 AND status = 'processing' AND dispatch = 'http' AND claimed_by = $2
+		  AND tenant_id = $4
+		RETURNING claim_expires_at`, requestID, body.WorkerID, jobClaimTTL.Seconds(), currentTenant(c).ID).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		respondErrorDetails(c, codeConflict, "Worker does not hold a claim on this job", lost)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to extend the claim on request %s: %v", requestID, err)
+		respondError(c, codeInternal, "Failed to renew the claim")
+		return
+	}
+	resp["claim_expires_at"] = expiresAt
+	c.JSON(http.StatusOK, resp)
+}
+
+// startClaimSweeper returns lapsed HTTP claims to the queue and dispatches them again,
+// over Redis when it has workers. Transitions are versioned, so every instance runs it
+func startClaimSweeper() {
+	ticker := time.NewTicker(jobClaimSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("claim_sweeper", nil, func() {
+			sweepExpiredClaims(context.Background())
+		})
+	}
+}
+
+// sweepExpiredClaims requeues jobs whose claim expired, or with leases, whose lease did:
+// then a claim past its expiry stays with a worker that keeps renewing the lease
+func sweepExpiredClaims(ctx context.Context) {
+	ids, err := lapsedJobs(ctx, "http", `
+		SELECT request_id, claim_expires_at < now() FROM generated_content
+		WHERE status = 'processing' AND dispatch = 'http'
+		  AND (claim_expires_at < now() OR ($1 AND started_at < now() - $2 * interval '1 second'))`,
+		workerLeases, workerLeaseTTL.Seconds())
+	if err != nil {
+		log.Printf("❌ Failed to sweep expired claims: %v", err)
+		return
+	}
+	// A reclaimed lease can't be renewed, so the claim's expiry no longer matters
+	where := "dispatch = 'http'"
+	if !workerLeases {
+		where += " AND claim_expires_at < now()"
+	}
+	for _, id := range ids {
+		var g newGeneration
+		applied, err := transitionGeneration(ctx, id, generationWrite{
+			Writer: "claim_sweeper", To: "queued", From: []string{"processing"},
+			Where:     where,
+			Set:       "started_at = NULL, started_by = NULL",
+			Returning: queuedColumns,
+			Scan: func(row rowScanner) (err error) {
+				g, err = scanQueuedGeneration(row)
+				return err
+			},
+		})
+		if err != nil {
+			log.Printf("❌ Failed to return request %s to the queue: %v", id, err)
+			continue
+		}
+		if !applied {
+			continue
+		}
+		jobClaimsExpired.Inc()
+		rdb.Del(ctx, progressKey(id))
+		log.Printf("⏰ HTTP claim on request %s lapsed; back in the queue", id)
+		if err := publishGenerationRequest(g.channel(), g.request()); err != nil {
+			// Still queued and undispatched unless Redis took it, so a pull picks it up
+			log.Printf("⚠️ Failed to republish request %s after its claim expired: %v", id, err)
+		}
+	}
+}
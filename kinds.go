@@ -0,0 +1,156 @@
+// kinds.go
+// Registry of generation kinds (request_type values). POST /generations, pricing, publishing
+// and the completion listener dispatch through it, so a new kind is one file that builds a
+// GenerationKind and registers it from init(). A request_type that isn't registered is
+// refused with the registered ones listed, never served as some other kind; only an
+// omitted one means text, the original API's default
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// defaultRequestType is what a request without request_type asks for
+const defaultRequestType = "text"
+
+// Spikes mean a client release sends a type we don't know
+var unknownRequestTypes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_unknown_request_types_total",
+	Help: "Requests refused for a request_type that isn't registered, by route (without its version).",
+}, []string{"route"})
+
+// GenerationKind describes one request_type. A queued kind (image, video) sets Channel and
+// Spec and is charged, stored and published by queueGeneration, then finished by a worker's
+// completion. A synchronous kind (text) sets Handle instead and answers in the request
+type GenerationKind struct {
+	Name  string // the request_type, and content_type on stored rows
+	Label string // capitalized, for user-facing messages
+
+	// Handle serves the whole request for a synchronous kind. The request has been bound,
+	// its prompt sanitized and recorded under requestID
+	Handle func(c *gin.Context, user *repository.User, req RequestPayload, requestID uuid.UUID)
+
+	// Channel is where a queued kind's worker reads requests
+	Channel      string
+	DefaultModel string
+
+	// Spec validates the kind's parameters in req, applying its defaults. Model, Kind, Label
+	// and Channel are filled in by the registry
+	Spec func(req RequestPayload) (generationSpec, error)
+
+	// BaseCredits prices one default-sized request when the plan has no model_credits entry.
+	// A synchronous kind may set it to be charged per request
+	BaseCredits func() int
+	// Limits is the kind's own bucket (see buckets.go) where the plan sets none; zero
+	// fields use the plan's rate_limit and max_in_flight
+	Limits KindLimits
+	// Cost sets the quote's kind-specific fields and plan problems and returns the request's
+	// work in units of one default request, which scales both the credits and the runtime
+	Cost func(q *Quote, spec generationSpec, limits PlanLimits) (units float64)
+
+	// ApplyCompleted stores what a completion carries beyond the asset key, after the row
+	// has been marked completed. Optional
+	ApplyCompleted func(ctx context.Context, completion ImageGenerationCompletion) error
+}
+
+func (k *GenerationKind) queued() bool {
+	return k.Handle == nil
+}
+
+var generationKinds = map[string]*GenerationKind{}
+
+// registerKind adds k; call it from init(). An incomplete descriptor panics at startup
+// rather than failing on the first request of that kind
+func registerKind(k *GenerationKind) {
+	switch {
+	case k.Name == "" || k.Label == "":
+		panic("generation kind needs a name and label")
+	case generationKinds[k.Name] != nil:
+		panic("generation kind " + k.Name + " registered twice")
+	case k.Handle == nil && (k.Channel == "" || k.Spec == nil || k.BaseCredits == nil || k.Cost == nil):
+		panic("queued generation kind " + k.Name + " needs a channel, spec, base credits and cost")
+	}
+	generationKinds[k.Name] = k
+}
+
+// generationKind looks up a registered request_type; callers default an omitted one
+// with requestTypeOrDefault first
+func generationKind(name string) (*GenerationKind, bool) {
+	k, ok := generationKinds[name]
+	return k, ok
+}
+
+// requestTypeOrDefault is the request_type a request asked for, defaultRequestType when
+// it named none
+func requestTypeOrDefault(requestType string) string {
+	if requestType == "" {
+		return defaultRequestType
+	}
+	return requestType
+}
+
+// supportedKinds lists the request_type values, for error details
+func supportedKinds() []string {
+	names := make([]string, 0, len(generationKinds))
+	for name := range generationKinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// kindFor is generationKind for a handler: unknown types are a 422 listing the supported ones
+func kindFor(c *gin.Context, requestType string) (*GenerationKind, bool) {
+	k, ok := generationKind(requestType)
+	if !ok {
+		unknownRequestTypes.WithLabelValues(unversionedRoute(c.FullPath())).Inc()
+		log.Printf("⚠️ Unknown request_type %q on %s from %q", requestType, c.FullPath(), c.GetHeader("User-Agent"))
+		respondErrorDetails(c, codeValidationFailed, "request_type: unknown type "+strconv.Quote(requestType)+
+			", must be one of "+strings.Join(supportedKinds(), ", "), gin.H{"field": "request_type", "supported": supportedKinds()})
+	}
+	return k, ok
+}
+
+// generationSpecFor validates a queued request against its kind
+func generationSpecFor(requestType string, req RequestPayload) (generationSpec, error) {
+	k, ok := generationKind(requestType)
+	if !ok || !k.queued() {
+		return generationSpec{}, errors.New("request_type: " + strconv.Quote(requestType) + " is not a queued type")
+	}
+	if req.Model != "" && !containsString(knownModels, req.Model) {
+		return generationSpec{}, errors.New("model: unknown model " + strconv.Quote(req.Model))
+	}
+	spec, err := k.Spec(req)
+	if err != nil {
+		return spec, err
+	}
+	spec.Kind, spec.Label, spec.Channel = k.Name, k.Label, k.Channel
+	spec.Model = modelOr(req.Model, k.DefaultModel)
+	return spec, nil
+}
+
+// generationChannel is the request channel for a stored content_type
+func generationChannel(contentType string) string {
+	if k, ok := generationKinds[contentType]; ok && k.queued() {
+		return k.Channel
+	}
+	return imageGenerationChannel
+}
+
+func modelOr(model, fallback string) string {
+	if model == "" {
+		return fallback
+	}
+	return model
+}
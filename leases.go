@@ -0,0 +1,371 @@
+// leases.go
+// Job leases: a running request stays with its worker while the worker renews its lease,
+// and the dispatch's lease token fences results from earlier dispatches
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results of the lease scripts besides a token
+const (
+	leaseHeld    = 0  // renew: another worker (or nobody) holds it; reclaim: still live
+	leaseExpired = -1 // renew: the holder's lease ran out
+	leaseMissing = -2 // no lease state for the request
+)
+
+// How long a lease's state outlives its expiry, for the admin view and fencing
+const leaseKeepFor = 24 * time.Hour
+
+var (
+	// Off until every deployed worker lists its jobs in heartbeats and echoes lease_token;
+	// src/worker.py and cmd/fakeworker do, so turn it on once any other worker does too
+	workerLeases   = getEnvBool("WORKER_LEASES", false)
+	workerLeaseTTL = getEnvDuration("WORKER_LEASE_TTL", 2*time.Minute)
+
+	leaseRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_job_lease_renewals_total",
+		Help: "Lease renewals from heartbeats and progress, by outcome (renewed, lost, expired, unknown).",
+	}, []string{"outcome"})
+	leasesReclaimed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_job_leases_reclaimed_total",
+		Help: "Lapsed leases the sweepers took back, by dispatch (redis, http).",
+	}, []string{"dispatch"})
+	fencedResults = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_job_lease_fenced_results_total",
+		Help: "Results refused because another worker held the request's lease, or carried a stale token.",
+	})
+)
+
+func leaseKey(requestID string) string {
+	return "lease:" + requestID
+}
+
+// issueLeaseTokenScript takes the next token for a dispatch, before anyone holds it
+var issueLeaseTokenScript = redis.NewScript(`
+local token = redis.call('HINCRBY', KEYS[1], 'token', 1)
+redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[1]))
+return token`)
+
+// grantLeaseScript hands the lease to ARGV[1] under the token its dispatch was issued,
+// ARGV[5], or the next one when that's 0. An ack for a dispatch whose token is no longer
+// the request's gets leaseHeld
+var grantLeaseScript = redis.NewScript(`
+local token = tonumber(ARGV[5])
+if token > 0 then
+	if tonumber(redis.call('HGET', KEYS[1], 'token')) ~= token then
+		return 0
+	end
+else
+	token = redis.call('HINCRBY', KEYS[1], 'token', 1)
+end
+redis.call('HSET', KEYS[1], 'worker', ARGV[1], 'granted_at', ARGV[2], 'renewed_at', ARGV[2],
+	'expires_at', tonumber(ARGV[2]) + tonumber(ARGV[3]), 'reclaimed_at', '')
+redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[3]) + tonumber(ARGV[4]))
+return token`)
+
+// renewLeaseScript extends ARGV[1]'s lease if it still holds it and it hasn't run out,
+// returning its token, else leaseHeld, leaseExpired or leaseMissing. A token issued but
+// not yet granted is no lease
+var renewLeaseScript = redis.NewScript(`
+local l = redis.call('HMGET', KEYS[1], 'worker', 'expires_at', 'token')
+if not l[1] then
+	return -2
+end
+if l[1] ~= ARGV[1] then
+	return 0
+end
+if tonumber(l[2]) < tonumber(ARGV[2]) then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'renewed_at', ARGV[2], 'expires_at', tonumber(ARGV[2]) + tonumber(ARGV[3]))
+redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[3]) + tonumber(ARGV[4]))
+return tonumber(l[3])`)
+
+// reclaimLeaseScript takes a lapsed lease from its holder, returning its token, or
+// leaseHeld while it's live. An already reclaimed lease returns its token again, for a
+// sweep whose row write didn't land
+var reclaimLeaseScript = redis.NewScript(`
+local l = redis.call('HMGET', KEYS[1], 'worker', 'expires_at', 'token')
+if not l[1] then
+	return -2
+end
+if l[1] ~= '' and tonumber(l[2]) >= tonumber(ARGV[1]) then
+	return 0
+end
+if l[1] ~= '' then
+	redis.call('HSET', KEYS[1], 'worker', '', 'reclaimed_at', ARGV[1])
+end
+return tonumber(l[3])`)
+
+// issueLeaseToken takes the fencing token for a dispatch being published, or 0 without
+// leases or on a Redis error, which leaves the grant to take one
+func issueLeaseToken(ctx context.Context, requestID string) int64 {
+	if !workerLeases {
+		return 0
+	}
+	token, err := issueLeaseTokenScript.Run(ctx, rdb, []string{leaseKey(requestID)},
+		(workerLeaseTTL + leaseKeepFor).Milliseconds()).Int64()
+	if err != nil {
+		log.Printf("⚠️ Failed to issue a lease token for %s: %v", requestID, err)
+		return 0
+	}
+	return token
+}
+
+// startLease grants workerID the lease on a request it just started, under the token its
+// dispatch carried (0 to take the next one), returning when it expires and its token. A
+// worker that didn't say who it is gets none, and any lease left from an earlier run is
+// dropped, so the sweepers' fixed thresholds apply
+func startLease(ctx context.Context, requestID, workerID string, token int64) (*time.Time, int64) {
+	if !workerLeases {
+		return nil, 0
+	}
+	if workerID == "" {
+		releaseLease(ctx, requestID)
+		return nil, 0
+	}
+	now := clock.Now()
+	granted, err := grantLeaseScript.Run(ctx, rdb, []string{leaseKey(requestID)}, workerID, now.UnixMilli(),
+		workerLeaseTTL.Milliseconds(), leaseKeepFor.Milliseconds(), token).Int64()
+	if err != nil {
+		log.Printf("⚠️ Failed to grant worker %s the lease on %s: %v", workerID, requestID, err)
+		return nil, 0
+	}
+	if granted == leaseHeld {
+		log.Printf("🚧 Not granting worker %s the lease on %s: token %d is from an earlier dispatch",
+			workerID, requestID, token)
+		return nil, 0
+	}
+	expires := now.Add(workerLeaseTTL)
+	log.Printf("📜 Worker %s holds the lease on %s (token %d) until %s", workerID, requestID, granted,
+		expires.Format(time.RFC3339))
+	return &expires, granted
+}
+
+// renewLease extends workerID's lease on requestID, reporting the outcome it counted;
+// a worker that lost the lease is told to abandon the job
+func renewLease(ctx context.Context, requestID, workerID string) (outcome string, err error) {
+	now := clock.Now()
+	result, err := renewLeaseScript.Run(ctx, rdb, []string{leaseKey(requestID)}, workerID, now.UnixMilli(),
+		workerLeaseTTL.Milliseconds(), leaseKeepFor.Milliseconds()).Int64()
+	if err != nil {
+		return "", err
+	}
+	switch result {
+	case leaseMissing:
+		outcome = "unknown"
+	case leaseHeld:
+		outcome = "lost"
+	case leaseExpired:
+		outcome = "expired"
+	default:
+		outcome = "renewed"
+	}
+	leaseRenewals.WithLabelValues(outcome).Inc()
+	if outcome == "lost" || outcome == "expired" {
+		log.Printf("🪦 Worker %s is still on %s, whose lease it no longer holds (%s); telling it to stop",
+			workerID, requestID, outcome)
+		tellWorkerToAbandon(ctx, workerID, requestID, "lease "+outcome)
+	}
+	return outcome, nil
+}
+
+// renewHeartbeatLeases renews the lease on each job a heartbeat lists
+func renewHeartbeatLeases(ctx context.Context, hb WorkerHeartbeat) {
+	if !workerLeases {
+		return
+	}
+	for _, id := range hb.RequestIDs {
+		if _, err := renewLease(ctx, id, hb.WorkerID); err != nil {
+			log.Printf("⚠️ Failed to renew worker %s's lease on %s: %v", hb.WorkerID, id, err)
+		}
+	}
+}
+
+func tellWorkerToAbandon(ctx context.Context, workerID, requestID, reason string) {
+	data, _ := json.Marshal(WorkerControl{WorkerID: workerID, Action: "abandon", RequestID: requestID,
+		Reason: reason, Timestamp: time.Now().UTC().Format(time.RFC3339)})
+	if err := rdb.Publish(ctx, workerControlChannel, data).Err(); err != nil {
+		log.Printf("⚠️ Failed to tell worker %s to abandon %s: %v", workerID, requestID, err)
+	}
+}
+
+// leaseLapsed decides whether a sweeper may take requestID back from its worker. A live
+// lease keeps the job whatever the row says; a lapsed one is reclaimed here, before the
+// row is written, so no heartbeat can bring it back. Without lease state, fallback (the
+// sweeper's own threshold) decides. A Redis error leaves the job for the next sweep
+func leaseLapsed(ctx context.Context, requestID, dispatch string, fallback bool) bool {
+	if !workerLeases {
+		return fallback
+	}
+	token, err := reclaimLeaseScript.Run(ctx, rdb, []string{leaseKey(requestID)}, clock.Now().UnixMilli()).Int64()
+	switch {
+	case err != nil:
+		log.Printf("⚠️ Failed to check the lease on %s: %v", requestID, err)
+		return false
+	case token == leaseMissing:
+		return fallback
+	case token == leaseHeld:
+		return false
+	}
+	leasesReclaimed.WithLabelValues(dispatch).Inc()
+	log.Printf("📜 Lease %d on %s lapsed; reclaiming the job", token, requestID)
+	return true
+}
+
+// lapsedJobs runs a sweeper's candidate query, which selects request_id and whether the
+// sweeper's own threshold has passed, and keeps the candidates leaseLapsed lets it take
+func lapsedJobs(ctx context.Context, dispatch, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	fallback := map[string]bool{}
+	var ids []string
+	for rows.Next() {
+		var id string
+		var past bool
+		if err := rows.Scan(&id, &past); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		fallback[id] = past
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	lapsed := ids[:0]
+	for _, id := range ids {
+		if leaseLapsed(ctx, id, dispatch, fallback[id]) {
+			lapsed = append(lapsed, id)
+		}
+	}
+	return lapsed, nil
+}
+
+// leaseFences reports a result from workerID while another worker holds requestID's
+// lease, or one whose token (0 if the worker sent none) is from an earlier dispatch.
+// Anonymous results, and those arriving after a reclaim before the job was dispatched
+// again, are let through
+func leaseFences(ctx context.Context, requestID, workerID string, token int64) bool {
+	if !workerLeases || workerID == "" {
+		return false
+	}
+	l, err := rdb.HMGet(ctx, leaseKey(requestID), "worker", "token").Result()
+	if err != nil {
+		return false
+	}
+	holder, _ := l[0].(string)
+	current, _ := l[1].(string)
+	if holder != "" && holder != workerID {
+		fencedResults.Inc()
+		log.Printf("🚧 Refusing worker %s's result for %s: worker %s holds the lease now", workerID, requestID, holder)
+		return true
+	}
+	if token > 0 && current != "" && current != strconv.FormatInt(token, 10) {
+		fencedResults.Inc()
+		log.Printf("🚧 Refusing worker %s's result for %s: its token %d is stale, the lease is on %s",
+			workerID, requestID, token, current)
+		return true
+	}
+	return false
+}
+
+// releaseLease drops a finished request's lease
+func releaseLease(ctx context.Context, requestID string) {
+	if workerLeases {
+		rdb.Del(ctx, leaseKey(requestID))
+	}
+}
+
+// JobLease is a lease as GET /admin/queue shows it
+type JobLease struct {
+	WorkerID    string     `json:"worker_id,omitempty"` // empty once reclaimed
+	Token       int64      `json:"token"`
+	GrantedAt   time.Time  `json:"granted_at"`
+	RenewedAt   time.Time  `json:"renewed_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ReclaimedAt *time.Time `json:"reclaimed_at,omitempty"`
+	Live        bool       `json:"live"`
+}
+
+// RunningJob is a processing request and its lease, if it has one
+type RunningJob struct {
+	RequestID string    `json:"request_id"`
+	Model     string    `json:"model"`
+	Dispatch  string    `json:"dispatch"`
+	StartedBy string    `json:"started_by,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Lease     *JobLease `json:"lease,omitempty"`
+}
+
+// maxRunningJobs caps the jobs GET /admin/queue lists, oldest first
+const maxRunningJobs = 100
+
+// runningJobs lists the longest-running processing requests with their leases
+func runningJobs(ctx context.Context) ([]RunningJob, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT request_id, model, coalesce(dispatch, ''), coalesce(started_by, ''), coalesce(started_at, created_at)
+		FROM generated_content WHERE status = 'processing'
+		ORDER BY started_at NULLS FIRST LIMIT $1`, maxRunningJobs)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []RunningJob{}
+	for rows.Next() {
+		var j RunningJob
+		if err := rows.Scan(&j.RequestID, &j.Model, &j.Dispatch, &j.StartedBy, &j.StartedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || !workerLeases || len(jobs) == 0 {
+		return jobs, err
+	}
+
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(jobs))
+	for i, j := range jobs {
+		cmds[i] = pipe.HGetAll(ctx, leaseKey(j.RequestID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	now := clock.Now()
+	for i := range jobs {
+		if fields := cmds[i].Val(); len(fields) > 0 {
+			jobs[i].Lease = parseLease(fields, now)
+		}
+	}
+	return jobs, nil
+}
+
+func parseLease(fields map[string]string, now time.Time) *JobLease {
+	millis := func(name string) time.Time {
+		ms, _ := strconv.ParseInt(fields[name], 10, 64)
+		return time.UnixMilli(ms).UTC()
+	}
+	l := &JobLease{WorkerID: fields["worker"], GrantedAt: millis("granted_at"), RenewedAt: millis("renewed_at"),
+		ExpiresAt: millis("expires_at")}
+	l.Token, _ = strconv.ParseInt(fields["token"], 10, 64)
+	if fields["reclaimed_at"] != "" {
+		at := millis("reclaimed_at")
+		l.ReclaimedAt = &at
+	}
+	l.Live = l.WorkerID != "" && !now.After(l.ExpiresAt)
+	return l
+}
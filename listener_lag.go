@@ -0,0 +1,251 @@
+// listener_lag.go
+// Liveness signals for the completion listener, and a watchdog that raises the alarm when
+// it is alive but not getting anywhere while work is waiting
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	listenerWatchdogInterval = getEnvDuration("LISTENER_WATCHDOG_INTERVAL", 30*time.Second)
+	// No message (or no applied DB update) for this long with work in flight is a stall
+	listenerStallAfter = getEnvDuration("LISTENER_STALL_AFTER", 5*time.Minute)
+	// Published minus completed over the last 15 minutes beyond this is a stall; 0 disables
+	listenerMaxBacklog = getEnvInt("LISTENER_MAX_BACKLOG", 0)
+	// While a stall lasts the alert is repeated this often
+	listenerAlertRepeat = getEnvDuration("LISTENER_ALERT_REPEAT", 15*time.Minute)
+	listenerAlertReport = getEnvBool("LISTENER_ALERT_REPORT", false)
+
+	// Rolling windows for the published/completed delta
+	backlogWindows = []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour}
+)
+
+var (
+	generationRequestsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_generation_requests_published_total",
+		Help: "Generation requests published to workers by this instance.",
+	})
+
+	listenerBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_listener_backlog",
+		Help: "Requests published minus terminal completions received, over a rolling window.",
+	}, []string{"window"})
+
+	listenerAlerts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_listener_watchdog_alerts_total",
+		Help: "Times the listener watchdog reported a stall.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mobart_listener_last_message_age_seconds",
+		Help: "Seconds since the completion listener last received a message.",
+	}, func() float64 { return listenerActivity.messageAge().Seconds() })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mobart_listener_last_db_update_age_seconds",
+		Help: "Seconds since a completion last changed the database.",
+	}, func() float64 { return listenerActivity.dbUpdateAge().Seconds() })
+)
+
+// activity holds the unix-nano timestamps of the last message and the last applied update.
+// Both start at process start so a fresh instance isn't immediately stalled
+type activity struct {
+	lastMessage, lastDBUpdate atomic.Int64
+}
+
+var listenerActivity = newActivity()
+
+func newActivity() *activity {
+	a := &activity{}
+	now := time.Now().UnixNano()
+	a.lastMessage.Store(now)
+	a.lastDBUpdate.Store(now)
+	return a
+}
+
+func (a *activity) messageReceived() { a.lastMessage.Store(time.Now().UnixNano()) }
+func (a *activity) dbUpdated()       { a.lastDBUpdate.Store(time.Now().UnixNano()) }
+
+func (a *activity) messageAge() time.Duration {
+	return time.Since(time.Unix(0, a.lastMessage.Load()))
+}
+
+func (a *activity) dbUpdateAge() time.Duration {
+	return time.Since(time.Unix(0, a.lastDBUpdate.Load()))
+}
+
+// minuteCounts keeps two per-minute counts for the last hour, on clock
+type minuteCounts struct {
+	mu     sync.Mutex
+	minute int64 // unix minute of counts[head]
+	head   int
+	counts [60][2]int
+}
+
+// advance rotates the ring to the current minute, clearing the minutes skipped; mu held
+func (r *minuteCounts) advance() {
+	m := clock.Now().Unix() / 60
+	if r.minute == 0 {
+		r.minute = m
+	}
+	for steps := min(m-r.minute, int64(len(r.counts))); steps > 0; steps-- {
+		r.head = (r.head + 1) % len(r.counts)
+		r.counts[r.head] = [2]int{}
+	}
+	r.minute = m
+}
+
+func (r *minuteCounts) add(first, second int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance()
+	r.counts[r.head][0] += first
+	r.counts[r.head][1] += second
+}
+
+// sum adds up both counts over the trailing window (whole minutes)
+func (r *minuteCounts) sum(window time.Duration) (first, second int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance()
+	n := min(int(window/time.Minute), len(r.counts))
+	for i := 0; i < n; i++ {
+		c := r.counts[(r.head-i+len(r.counts))%len(r.counts)]
+		first += c[0]
+		second += c[1]
+	}
+	return first, second
+}
+
+// requestFlow counts published, then completed. Publishes are this instance's own while
+// every instance hears every completion, so with several instances compare the fleet's
+// summed published against any one's completed
+var requestFlow = &minuteCounts{}
+
+// ListenerWindow is the flow over one rolling window
+type ListenerWindow struct {
+	Window    string `json:"window"`
+	Published int    `json:"published"`
+	Completed int    `json:"completed"`
+	Backlog   int    `json:"backlog"`
+}
+
+// ListenerLag is the listener's half of GET /admin/queue
+type ListenerLag struct {
+	LastMessageAgeSeconds  float64          `json:"last_message_age_seconds"`
+	LastDBUpdateAgeSeconds float64          `json:"last_db_update_age_seconds"`
+	Windows                []ListenerWindow `json:"windows"`
+	InFlight               int              `json:"in_flight"`
+	Stalled                bool             `json:"stalled"`
+	Reasons                []string         `json:"reasons,omitempty"`
+	Alerts                 int64            `json:"alerts"`
+}
+
+var (
+	watchdogMu    sync.Mutex
+	lastLag       ListenerLag
+	lastAlertedAt time.Time
+	alertCount    atomic.Int64
+)
+
+// listenerLagSnapshot is the latest watchdog check, with the ages brought up to date
+func listenerLagSnapshot() ListenerLag {
+	watchdogMu.Lock()
+	lag := lastLag
+	watchdogMu.Unlock()
+	lag.LastMessageAgeSeconds = listenerActivity.messageAge().Seconds()
+	lag.LastDBUpdateAgeSeconds = listenerActivity.dbUpdateAge().Seconds()
+	lag.Alerts = alertCount.Load()
+	return lag
+}
+
+// inFlightCount is the work workers owe us a completion for
+func inFlightCount(ctx context.Context) (n int, err error) {
+	err = db.QueryRowContext(ctx, `
+		SELECT count(*) FROM generated_content WHERE status IN ('queued', 'processing')`).Scan(&n)
+	return n, err
+}
+
+// checkListener measures the listener against the thresholds; a stall only counts while
+// something is in flight, since an idle listener is silent too
+func checkListener(ctx context.Context) (ListenerLag, error) {
+	lag := ListenerLag{
+		LastMessageAgeSeconds:  listenerActivity.messageAge().Seconds(),
+		LastDBUpdateAgeSeconds: listenerActivity.dbUpdateAge().Seconds(),
+	}
+	for _, w := range backlogWindows {
+		p, c := requestFlow.sum(w)
+		name := w.String()
+		lag.Windows = append(lag.Windows, ListenerWindow{Window: name, Published: p, Completed: c, Backlog: p - c})
+		listenerBacklog.WithLabelValues(name).Set(float64(p - c))
+	}
+
+	var err error
+	if lag.InFlight, err = inFlightCount(ctx); err != nil || lag.InFlight == 0 {
+		return lag, err
+	}
+	if age := listenerActivity.messageAge(); age > listenerStallAfter {
+		lag.Reasons = append(lag.Reasons, fmt.Sprintf("no completion message for %s", age.Round(time.Second)))
+	}
+	if age := listenerActivity.dbUpdateAge(); age > listenerStallAfter {
+		lag.Reasons = append(lag.Reasons, fmt.Sprintf("no completion applied for %s", age.Round(time.Second)))
+	}
+	if listenerMaxBacklog > 0 {
+		if w := lag.Windows[1]; w.Backlog > listenerMaxBacklog {
+			lag.Reasons = append(lag.Reasons, fmt.Sprintf("%d more published than completed in %s", w.Backlog, w.Window))
+		}
+	}
+	lag.Stalled = len(lag.Reasons) > 0
+	return lag, nil
+}
+
+// startListenerWatchdog checks the listener every LISTENER_WATCHDOG_INTERVAL, alerting when
+// a stall starts and every LISTENER_ALERT_REPEAT while it lasts
+func startListenerWatchdog() {
+	ticker := time.NewTicker(listenerWatchdogInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("listener_watchdog", nil, func() {
+			lag, err := checkListener(context.Background())
+			if err != nil {
+				slog.Warn("listener watchdog could not check the queue", "error", err)
+				return
+			}
+
+			watchdogMu.Lock()
+			wasStalled := lastLag.Stalled
+			lastLag = lag
+			alert := lag.Stalled && (!wasStalled || time.Since(lastAlertedAt) >= listenerAlertRepeat)
+			if alert {
+				lastAlertedAt = time.Now()
+			}
+			watchdogMu.Unlock()
+
+			switch {
+			case alert:
+				alertCount.Add(1)
+				listenerAlerts.Inc()
+				slog.Error("completion listener stalled", "reasons", lag.Reasons, "in_flight", lag.InFlight,
+					"last_message_age_seconds", lag.LastMessageAgeSeconds, "last_db_update_age_seconds", lag.LastDBUpdateAgeSeconds)
+				if listenerAlertReport {
+					errorReporter.Report(errors.New("completion listener stalled"), map[string]string{
+						"where": "listener_watchdog", "in_flight": fmt.Sprint(lag.InFlight)})
+				}
+			case wasStalled && !lag.Stalled:
+				slog.Info("completion listener recovered", "in_flight", lag.InFlight)
+			}
+		})
+	}
+}
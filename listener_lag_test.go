@@ -0,0 +1,39 @@
+// listener_lag_test.go
+// The per-minute ring behind the listener's flow and the SLO windows, on a fake clock
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mobart/clocktest"
+)
+
+func TestMinuteCounts(t *testing.T) {
+	c := clocktest.NewClock(time.Date(2025, 8, 10, 19, 30, 0, 0, time.UTC))
+	saved := clock
+	clock = c
+	t.Cleanup(func() { clock = saved })
+
+	var r minuteCounts
+	r.add(3, 1)
+	c.Advance(time.Minute)
+	r.add(1, 1)
+	if a, b := r.sum(time.Minute); a != 1 || b != 1 {
+		t.Errorf("last minute = %d, %d, want 1, 1", a, b)
+	}
+	if a, b := r.sum(5 * time.Minute); a != 4 || b != 2 {
+		t.Errorf("last 5m = %d, %d, want 4, 2", a, b)
+	}
+
+	// Skipped minutes are cleared, and a whole hour idle empties the ring
+	c.Advance(4 * time.Minute)
+	if a, b := r.sum(5 * time.Minute); a != 1 || b != 1 {
+		t.Errorf("last 5m after 4 idle = %d, %d, want 1, 1", a, b)
+	}
+	c.Advance(2 * time.Hour)
+	if a, b := r.sum(time.Hour); a != 0 || b != 0 {
+		t.Errorf("last hour after 2h idle = %d, %d, want 0, 0", a, b)
+	}
+}
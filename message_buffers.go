@@ -0,0 +1,66 @@
+// message_buffers.go
+// Pooled JSON encoding for the generation hot path. A request is encoded once into a
+// pooled buffer, and that one slice serves the size check, compression and the Redis
+// publish; queued responses are written from the same pool instead of gin's
+// json.Marshal copy. Buffers that grew past messageBufferKeep go back to the GC rather
+// than the pool, so one huge prompt doesn't pin its memory. The benchmarks in
+// bench_publish_test.go measure the path
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const messageBufferKeep = 64 << 10
+
+type messageBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var messageBuffers = sync.Pool{New: func() interface{} {
+	m := &messageBuffer{}
+	m.enc = json.NewEncoder(&m.buf)
+	return m
+}}
+
+// encodeMessage encodes v into a pooled buffer; the bytes are valid until releaseMessage.
+// They're what json.Marshal would return: Encode's trailing newline is dropped
+func encodeMessage(v interface{}) (*messageBuffer, []byte, error) {
+	m := messageBuffers.Get().(*messageBuffer)
+	m.buf.Reset()
+	if err := m.enc.Encode(v); err != nil {
+		releaseMessage(m)
+		return nil, nil, err
+	}
+	return m, bytes.TrimSuffix(m.buf.Bytes(), []byte("\n")), nil
+}
+
+func releaseMessage(m *messageBuffer) {
+	if m.buf.Cap() <= messageBufferKeep {
+		messageBuffers.Put(m)
+	}
+}
+
+// brokerPublish sends a request to its channel and returns how many subscribers got it.
+// The payload may be reused once it returns; go-redis has written it by then
+var brokerPublish = func(ctx context.Context, channel string, payload []byte) (int64, error) {
+	return rdb.Publish(ctx, channel, payload).Result()
+}
+
+// respondJSON is c.JSON without the intermediate copy, for the hot path's responses
+func respondJSON(c *gin.Context, status int, v interface{}) {
+	m, body, err := encodeMessage(v)
+	if err != nil {
+		c.JSON(status, v) // gin reports the error the same way it would have
+		return
+	}
+	defer releaseMessage(m)
+	c.Data(status, "application/json; charset=utf-8", body)
+}
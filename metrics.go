@@ -0,0 +1,42 @@
+// metrics.go
+// Prometheus metrics for the generation pipeline
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	completionsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_completions_received_total",
+		Help: "Completion messages received from the Python app, by status.",
+	}, []string{"status"})
+
+	postprocessResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_postprocess_total",
+		Help: "Image post-processing attempts, by result (ok, failed, retried, gave_up).",
+	}, []string{"result"})
+
+	postprocessPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mobart_postprocess_pending",
+		Help: "Generations waiting for a post-processing retry.",
+	})
+)
+
+// startMetricsServer exposes /metrics on METRICS_ADDR
+func startMetricsServer() {
+	addr := getEnv("METRICS_ADDR", ":9090")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("📊 Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("❌ Metrics server stopped: %v", err)
+	}
+}
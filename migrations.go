@@ -0,0 +1,270 @@
+// migrations.go
+// Versioned schema migrations embedded in the binary. migrations/NNNN_name.up.sql files
+// apply in version order, each in its own transaction with its row in schema_migrations,
+// under an advisory lock so instances starting together don't race. Production only moves
+// forward; NNNN_name.down.sql files exist for development and `mobart migrate down` won't
+// run them with APP_ENV=production. AUTO_MIGRATE=true migrates on start, and /healthz
+// reports down while the database is behind the binary
+
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Any constant works as long as nothing else takes the same advisory lock
+const migrationLockID = 727318
+
+var (
+	autoMigrate = getEnvBool("AUTO_MIGRATE", false)
+	// AUTO_MIGRATE alone is ignored in production, where a deploy shouldn't change the schema by surprise
+	autoMigrateInProduction = getEnvBool("AUTO_MIGRATE_IN_PRODUCTION", false)
+)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string // file names in migrationFiles
+	Down    string
+}
+
+// loadMigrations lists the embedded migrations in version order. Every version needs an up
+// file; a missing down file means it can't be rolled back
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		stem, direction, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), ".")
+		num, name, _ := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_name.up.sql or NNNN_name.down.sql", e.Name())
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, name)
+		}
+		file := path.Join("migrations", e.Name())
+		if direction == "up" {
+			m.Up = file
+		} else {
+			m.Down = file
+		}
+	}
+	list := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", m.Version)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// expectedSchemaVersion is the newest embedded migration
+func expectedSchemaVersion() int {
+	list, err := loadMigrations()
+	if err != nil || len(list) == 0 {
+		return 0
+	}
+	return list[len(list)-1].Version
+}
+
+func ensureMigrationsTable(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// currentSchemaVersion is the newest applied migration, 0 before the first
+func currentSchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// withMigrationLock runs fn holding the advisory lock on one connection
+func withMigrationLock(ctx context.Context, fn func() error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	return fn()
+}
+
+// migrateUp applies every migration newer than the database, returning how many ran
+func migrateUp(ctx context.Context) (applied int, err error) {
+	list, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return 0, err
+	}
+	err = withMigrationLock(ctx, func() error {
+		current, err := currentSchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range list {
+			if m.Version <= current {
+				continue
+			}
+			if err := runMigration(ctx, m, m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+				m.Version, m.Name); err != nil {
+				return err
+			}
+			log.Printf("🗄️ Applied migration %04d_%s", m.Version, m.Name)
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// migrateDown rolls back the newest applied migration, for development only
+func migrateDown(ctx context.Context) error {
+	if getEnv("APP_ENV", "development") == "production" {
+		return errors.New("migrations only move forward in production")
+	}
+	list, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(ctx); err != nil {
+		return err
+	}
+	return withMigrationLock(ctx, func() error {
+		current, err := currentSchemaVersion(ctx)
+		if err != nil || current == 0 {
+			return err
+		}
+		for _, m := range list {
+			if m.Version != current {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+			}
+			if err := runMigration(ctx, m, m.Down, `DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+				return err
+			}
+			log.Printf("🗄️ Rolled back migration %04d_%s", m.Version, m.Name)
+			return nil
+		}
+		return fmt.Errorf("applied migration %d isn't in this binary", current)
+	})
+}
+
+// runMigration runs file and the bookkeeping statement in one transaction
+func runMigration(ctx context.Context, m migration, file, bookkeeping string, args ...interface{}) error {
+	body, err := migrationFiles.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, string(body)); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// errSchemaBehind is the health check's error while migrations are pending
+var errSchemaBehind = errors.New("database schema is behind the binary")
+
+// checkSchemaVersion fails while the database lacks migrations this binary expects
+func checkSchemaVersion(ctx context.Context) error {
+	current, err := currentSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if want := expectedSchemaVersion(); current < want {
+		return fmt.Errorf("%w: at %d, expects %d", errSchemaBehind, current, want)
+	}
+	return nil
+}
+
+// runMigrateCommand is `mobart migrate [up|down|status]`
+func runMigrateCommand(args []string) error {
+	ctx := context.Background()
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		n, err := migrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("✅ %d migrations applied, schema at %d", n, expectedSchemaVersion())
+	case "down":
+		return migrateDown(ctx)
+	case "status":
+		if err := ensureMigrationsTable(ctx); err != nil {
+			return err
+		}
+		current, err := currentSchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("🗄️ Database at %d, binary expects %d", current, expectedSchemaVersion())
+	default:
+		return fmt.Errorf("unknown migrate action %q; use up, down or status", action)
+	}
+	return nil
+}
+
+// autoMigrateApplies reports whether this instance migrates on start
+func autoMigrateApplies() bool {
+	return autoMigrate && (getEnv("APP_ENV", "development") != "production" || autoMigrateInProduction)
+}
+
+// autoMigrateOnStart applies pending migrations when AUTO_MIGRATE allows it here
+func autoMigrateOnStart() {
+	if !autoMigrate {
+		return
+	}
+	if !autoMigrateApplies() {
+		log.Println("⚠️ AUTO_MIGRATE is ignored in production without AUTO_MIGRATE_IN_PRODUCTION=true; run `mobart migrate`")
+		return
+	}
+	if _, err := migrateUp(context.Background()); err != nil {
+		log.Fatalf("❌ Failed to migrate: %v", err)
+	}
+}
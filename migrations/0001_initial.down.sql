@@ -0,0 +1,125 @@
+-- migrations/0001_initial.down.sql
+-- Undoes 0001 for development databases; the backend's own users and generated_content
+-- tables stay, without the columns added to them. The vector extension is left installed
+
+DROP TRIGGER IF EXISTS generated_content_version ON generated_content;
+DROP FUNCTION IF EXISTS generated_content_bump_version();
+DROP FUNCTION IF EXISTS generation_renditions_touch() CASCADE;
+
+DROP INDEX IF EXISTS generated_content_started_idx;
+DROP INDEX IF EXISTS generated_content_unacked_idx;
+DROP INDEX IF EXISTS generated_content_failures_idx;
+DROP INDEX IF EXISTS generated_content_live_deadline_idx;
+DROP INDEX IF EXISTS generated_content_held_idx;
+DROP INDEX IF EXISTS generated_content_pull_priority_idx;
+DROP INDEX IF EXISTS generated_content_claims_idx;
+DROP INDEX IF EXISTS generated_content_pull_idx;
+DROP INDEX IF EXISTS generated_content_user_updated_idx;
+DROP INDEX IF EXISTS generated_content_input_key_idx;
+DROP INDEX IF EXISTS generated_content_poster_key_idx;
+DROP INDEX IF EXISTS generated_content_thumbnail_key_idx;
+DROP INDEX IF EXISTS generated_content_content_url_idx;
+DROP INDEX IF EXISTS generated_content_worker_idx;
+DROP INDEX IF EXISTS generated_content_tags_idx;
+DROP INDEX IF EXISTS generated_content_created_idx;
+DROP INDEX IF EXISTS generated_content_trashed_idx;
+DROP INDEX IF EXISTS generated_content_org_created_idx;
+DROP INDEX IF EXISTS generated_content_deferred_idx;
+DROP INDEX IF EXISTS generated_content_user_created_idx;
+DROP INDEX IF EXISTS generated_content_request_id_idx;
+
+DROP TABLE IF EXISTS org_audit CASCADE;
+DROP TABLE IF EXISTS account_audit CASCADE;
+DROP TABLE IF EXISTS queue_history_daily CASCADE;
+DROP TABLE IF EXISTS uploads CASCADE;
+DROP TABLE IF EXISTS referrals CASCADE;
+DROP TABLE IF EXISTS referral_codes CASCADE;
+DROP TABLE IF EXISTS notification_preferences CASCADE;
+DROP TABLE IF EXISTS regression_baselines CASCADE;
+DROP TABLE IF EXISTS regression_run_items CASCADE;
+DROP TABLE IF EXISTS regression_runs CASCADE;
+DROP TABLE IF EXISTS broadcast_audit CASCADE;
+DROP TABLE IF EXISTS broadcasts CASCADE;
+DROP TABLE IF EXISTS storage_usage CASCADE;
+DROP TABLE IF EXISTS dead_letter_audit CASCADE;
+DROP TABLE IF EXISTS dead_letters CASCADE;
+DROP TABLE IF EXISTS prompt_templates CASCADE;
+DROP TABLE IF EXISTS orphan_sweeps CASCADE;
+DROP TABLE IF EXISTS embedding_jobs CASCADE;
+DROP TABLE IF EXISTS worker_drain_audit CASCADE;
+DROP TABLE IF EXISTS worker_drains CASCADE;
+DROP TABLE IF EXISTS abuse_thresholds CASCADE;
+DROP TABLE IF EXISTS abuse_audit CASCADE;
+DROP TABLE IF EXISTS user_flags CASCADE;
+DROP TABLE IF EXISTS comparisons CASCADE;
+DROP TABLE IF EXISTS upload_chunks CASCADE;
+DROP TABLE IF EXISTS upload_sessions CASCADE;
+DROP TABLE IF EXISTS plan_limits CASCADE;
+DROP TABLE IF EXISTS service_mode_audit CASCADE;
+DROP TABLE IF EXISTS service_mode CASCADE;
+DROP TABLE IF EXISTS notification_deliveries CASCADE;
+DROP TABLE IF EXISTS generation_renditions CASCADE;
+DROP TABLE IF EXISTS generation_cost_daily CASCADE;
+DROP TABLE IF EXISTS backfill_errors CASCADE;
+DROP TABLE IF EXISTS backfill_runs CASCADE;
+DROP TABLE IF EXISTS conversation_messages CASCADE;
+DROP TABLE IF EXISTS conversations CASCADE;
+DROP TABLE IF EXISTS notification_channels CASCADE;
+DROP TABLE IF EXISTS credit_ledger CASCADE;
+DROP TABLE IF EXISTS organization_invites CASCADE;
+DROP TABLE IF EXISTS organization_members CASCADE;
+DROP TABLE IF EXISTS organizations CASCADE;
+
+ALTER TABLE generated_content DROP COLUMN IF EXISTS stale_requeues;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS started_by;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS started_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS dispatched_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS deep_links_revoked_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS progress_milestone;
+ALTER TABLE users DROP COLUMN IF EXISTS status_changed_at;
+ALTER TABLE users DROP COLUMN IF EXISTS status;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS low_priority;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS claim_expires_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS claimed_by;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS dispatch;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS stored_bytes;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS template_id;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS late_result_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS late_result;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS prompt_embedding;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS version;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS tags;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS comparison_id;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS seed;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS num_images;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS steps;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS resolution;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS input_retries;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS input_key;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS max_image_side;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS gpu_seconds;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS worker_id;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS trashed_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS late;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS deadline;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS thumbnail_key;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS expired_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS expiry_notified_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS poster_key;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS fps;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS duration_seconds;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS org_id;
+ALTER TABLE users DROP COLUMN IF EXISTS credits;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS deferred_until;
+ALTER TABLE users DROP COLUMN IF EXISTS prompt_processing;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS original_prompt;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS credits_charged;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS generation_time_seconds;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS completed_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS error;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS status;
+ALTER TABLE users DROP COLUMN IF EXISTS plan;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS postprocessed_at;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS model;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS prompt;
@@ -0,0 +1,703 @@
+-- migrations/0001_initial.up.sql
+-- Columns and tables the Go integration expects on top of the backend's existing tables,
+-- as applied by hand before migrations (migrations.go). Every statement is safe to re-run,
+-- so databases set up that way take it as a no-op
+
+-- Image rows are created at publish time so completions have something to update
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS prompt TEXT NOT NULL DEFAULT '';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS model TEXT NOT NULL DEFAULT '';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS postprocessed_at TIMESTAMPTZ;
+CREATE UNIQUE INDEX IF NOT EXISTS generated_content_request_id_idx ON generated_content (request_id);
+
+-- Watermarking is decided by plan
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan TEXT NOT NULL DEFAULT 'free';
+
+-- Lifecycle and accounting for stats; text rows are complete the moment they're written
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT '';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS generation_time_seconds DOUBLE PRECISION;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS credits_charged INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS generated_content_user_created_idx ON generated_content (user_id, created_at);
+
+-- Prompt processing: prompt is what the worker received, original_prompt what the user typed
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS original_prompt TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS prompt_processing BOOLEAN NOT NULL DEFAULT false;
+
+-- Deferred admission: over-limit requests wait here until the scheduler publishes them
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS deferred_until TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS generated_content_deferred_idx ON generated_content (deferred_until) WHERE status = 'deferred';
+
+-- Credits: personal balance, organization pools, and a ledger of every change
+ALTER TABLE users ADD COLUMN IF NOT EXISTS credits INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS organizations (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name       TEXT NOT NULL,
+    owner_id   UUID NOT NULL REFERENCES users (id),
+    credits    INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    org_id     UUID NOT NULL REFERENCES organizations (id),
+    user_id    UUID NOT NULL REFERENCES users (id),
+    role       TEXT NOT NULL CHECK (role IN ('owner', 'member')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    removed_at TIMESTAMPTZ,
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS organization_invites (
+    token       TEXT PRIMARY KEY,
+    org_id      UUID NOT NULL REFERENCES organizations (id),
+    created_by  UUID NOT NULL REFERENCES users (id),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    accepted_by UUID REFERENCES users (id),
+    accepted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS credit_ledger (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    UUID NOT NULL,
+    org_id     UUID,
+    request_id TEXT,
+    delta      INTEGER NOT NULL,
+    reason     TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS credit_ledger_request_idx ON credit_ledger (request_id);
+
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS org_id UUID REFERENCES organizations (id);
+CREATE INDEX IF NOT EXISTS generated_content_org_created_idx ON generated_content (org_id, created_at) WHERE org_id IS NOT NULL;
+
+-- Slack/Discord webhooks, one per kind per owner (a user, or an organization)
+CREATE TABLE IF NOT EXISTS notification_channels (
+    id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id         UUID NOT NULL REFERENCES users (id),
+    org_id          UUID REFERENCES organizations (id),
+    kind            TEXT NOT NULL CHECK (kind IN ('slack', 'discord')),
+    webhook_url_enc TEXT NOT NULL,
+    owner_key       TEXT GENERATED ALWAYS AS (coalesce(org_id::text, user_id::text)) STORED,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (owner_key, kind)
+);
+
+-- Text conversations; turns are deleted along with their conversation
+CREATE TABLE IF NOT EXISTS conversations (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users (id),
+    title      TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS conversations_user_updated_idx ON conversations (user_id, updated_at);
+
+CREATE TABLE IF NOT EXISTS conversation_messages (
+    id              BIGSERIAL PRIMARY KEY,
+    conversation_id UUID NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+    request_id      TEXT,
+    role            TEXT NOT NULL CHECK (role IN ('user', 'assistant')),
+    content         TEXT NOT NULL,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS conversation_messages_conv_created_idx ON conversation_messages (conversation_id, created_at);
+
+-- Video requests: parameters sent to the worker and the poster frame it returns
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS duration_seconds DOUBLE PRECISION;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS fps INTEGER;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS poster_key TEXT;
+
+-- Retention: rows past their plan's retention become status 'expired' with their objects removed
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS expiry_notified_at TIMESTAMPTZ;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS expired_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS generated_content_retention_idx
+    ON generated_content (created_at, request_id) WHERE status = 'completed';
+
+-- Thumbnails, created during post-processing or by the "thumbnails" backfill
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS thumbnail_key TEXT;
+
+-- Backfill jobs: one row of state per registered job, plus the rows that failed
+CREATE TABLE IF NOT EXISTS backfill_runs (
+    name               TEXT PRIMARY KEY,
+    status             TEXT NOT NULL CHECK (status IN ('running', 'paused', 'completed')),
+    cursor             TEXT NOT NULL DEFAULT '',
+    processed          BIGINT NOT NULL DEFAULT 0,
+    errors             BIGINT NOT NULL DEFAULT 0,
+    total              BIGINT NOT NULL DEFAULT 0,
+    concurrency        INTEGER NOT NULL DEFAULT 4,
+    rate_per_second    DOUBLE PRECISION NOT NULL DEFAULT 0,
+    started_at         TIMESTAMPTZ,
+    completed_at       TIMESTAMPTZ,
+    segment_started_at TIMESTAMPTZ,
+    segment_processed  BIGINT NOT NULL DEFAULT 0,
+    updated_at         TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS backfill_errors (
+    id         BIGSERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    row_key    TEXT NOT NULL,
+    error      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS backfill_errors_name_idx ON backfill_errors (name, id);
+
+-- Request deadlines (max_wait_seconds); late marks completions that arrived after a timeout
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS deadline TIMESTAMPTZ;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS late BOOLEAN NOT NULL DEFAULT false;
+
+-- Trash: trashed rows are hidden from lists and purged after TRASH_RETENTION
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS trashed_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS generated_content_trashed_idx ON generated_content (trashed_at) WHERE trashed_at IS NOT NULL;
+
+-- Cost accounting: worker-reported usage, summarized nightly per day, model and plan
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS worker_id TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS gpu_seconds DOUBLE PRECISION;
+CREATE INDEX IF NOT EXISTS generated_content_created_idx ON generated_content (created_at);
+
+CREATE TABLE IF NOT EXISTS generation_cost_daily (
+    day             DATE NOT NULL,
+    model           TEXT NOT NULL,
+    plan            TEXT NOT NULL,
+    generations     BIGINT NOT NULL,
+    gpu_seconds     DOUBLE PRECISION NOT NULL,
+    cost_usd        DOUBLE PRECISION NOT NULL,
+    credits_charged BIGINT NOT NULL,
+    PRIMARY KEY (day, model, plan)
+);
+
+-- Renditions: the worker's sized copies of a generation (original, web, thumbnail)
+CREATE TABLE IF NOT EXISTS generation_renditions (
+    request_id TEXT NOT NULL REFERENCES generated_content (request_id) ON DELETE CASCADE,
+    kind       TEXT NOT NULL,
+    s3_key     TEXT NOT NULL,
+    width      INTEGER,
+    height     INTEGER,
+    bytes      BIGINT,
+    PRIMARY KEY (request_id, kind)
+);
+
+-- Notification delivery queue; targets are encrypted like notification_channels
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id              BIGSERIAL PRIMARY KEY,
+    target_type     TEXT NOT NULL,
+    target_enc      TEXT NOT NULL,
+    payload         JSONB NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    status          TEXT NOT NULL DEFAULT 'pending',
+    claimed_until   TIMESTAMPTZ,
+    last_error      TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at     TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS notification_deliveries_due_idx
+    ON notification_deliveries (next_attempt_at) WHERE status IN ('pending', 'delivering');
+CREATE INDEX IF NOT EXISTS notification_deliveries_status_idx ON notification_deliveries (status, id);
+
+ALTER TABLE notification_channels DROP CONSTRAINT IF EXISTS notification_channels_kind_check;
+ALTER TABLE notification_channels ADD CONSTRAINT notification_channels_kind_check
+    CHECK (kind IN ('slack', 'discord', 'webhook', 'fcm', 'email'));
+
+-- Read-only mode: the manual override (a single row) and every transition
+CREATE TABLE IF NOT EXISTS service_mode (
+    id         INTEGER PRIMARY KEY CHECK (id = 1),
+    mode       TEXT NOT NULL CHECK (mode IN ('auto', 'degraded', 'normal')),
+    message    TEXT,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS service_mode_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    state      TEXT NOT NULL,
+    source     TEXT NOT NULL,
+    reasons    TEXT NOT NULL DEFAULT '',
+    message    TEXT,
+    actor      TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One delivery per generation, status and channel, however often a completion is applied
+ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS dedupe_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS notification_deliveries_dedupe_idx ON notification_deliveries (dedupe_key);
+
+-- Plan limits overriding the environment defaults; reloaded at runtime via /admin/plans
+CREATE TABLE IF NOT EXISTS plan_limits (
+    plan              TEXT PRIMARY KEY,
+    rate_limit        INTEGER NOT NULL,
+    max_in_flight     INTEGER NOT NULL,
+    admission_mode    TEXT NOT NULL,
+    retention_seconds BIGINT NOT NULL DEFAULT 0,
+    max_image_side    INTEGER NOT NULL DEFAULT 0,
+    allowed_models    TEXT[] NOT NULL DEFAULT '{}',
+    watermark         BOOLEAN NOT NULL DEFAULT false,
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS max_image_side INTEGER;
+
+-- img2img inputs: the uploaded source key, and whether an expired input URL was retried
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS input_key TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS input_retries INTEGER NOT NULL DEFAULT 0;
+
+-- Pricing inputs: per-plan batch size and model prices, and what each request asked for
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS max_batch INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS model_credits JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS resolution INTEGER;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS steps INTEGER;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS num_images INTEGER;
+
+-- Resumable uploads: a session per file, and the chunks received so far
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id             UUID PRIMARY KEY,
+    user_id        UUID NOT NULL,
+    expected_bytes BIGINT NOT NULL,
+    sha256         TEXT NOT NULL,
+    received_bytes BIGINT NOT NULL DEFAULT 0,
+    next_chunk     INTEGER NOT NULL DEFAULT 0,
+    status         TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'completed')),
+    input_key      TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at   TIMESTAMPTZ,
+    expires_at     TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS upload_sessions_user_open ON upload_sessions (user_id) WHERE status = 'open';
+CREATE INDEX IF NOT EXISTS upload_sessions_expires ON upload_sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS upload_chunks (
+    session_id UUID NOT NULL REFERENCES upload_sessions (id) ON DELETE CASCADE,
+    n          INTEGER NOT NULL,
+    bytes      INTEGER NOT NULL,
+    sha256     TEXT NOT NULL,
+    PRIMARY KEY (session_id, n)
+);
+
+-- A/B comparisons: two generations with one prompt and seed, and the user's vote
+CREATE TABLE IF NOT EXISTS comparisons (
+    id         UUID PRIMARY KEY,
+    user_id    UUID NOT NULL,
+    model_a    TEXT NOT NULL,
+    model_b    TEXT NOT NULL,
+    request_a  TEXT NOT NULL,
+    request_b  TEXT NOT NULL,
+    seed       BIGINT NOT NULL,
+    vote       TEXT CHECK (vote IN ('a', 'b', 'tie')),
+    voted_at   TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS comparisons_voted ON comparisons (model_a, model_b) WHERE vote IS NOT NULL;
+
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS seed BIGINT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS comparison_id UUID;
+
+-- Abuse review: one flag row per user ever flagged, the trail of every action, and the
+-- analyzer thresholds (a single row)
+CREATE TABLE IF NOT EXISTS user_flags (
+    user_id    UUID PRIMARY KEY,
+    state      TEXT NOT NULL CHECK (state IN ('review', 'throttled', 'cleared')),
+    signals    JSONB NOT NULL DEFAULT '{}',
+    flagged_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    flagged_by TEXT NOT NULL,
+    cleared_at TIMESTAMPTZ,
+    cleared_by TEXT
+);
+
+CREATE TABLE IF NOT EXISTS abuse_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    UUID,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    detail     JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS abuse_audit_user ON abuse_audit (user_id, id);
+
+CREATE TABLE IF NOT EXISTS abuse_thresholds (
+    id         INTEGER PRIMARY KEY CHECK (id = 1),
+    config     JSONB NOT NULL,
+    updated_by TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Freeform per-user tags, filtered with tags @> '{...}'
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS generated_content_tags_idx ON generated_content USING GIN (tags);
+
+-- Worker draining: drained workers take no new jobs and aren't counted as capacity
+CREATE INDEX IF NOT EXISTS generated_content_worker_idx ON generated_content (worker_id, completed_at) WHERE worker_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS worker_drains (
+    worker_id  TEXT PRIMARY KEY,
+    drained_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    drained_by TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS worker_drain_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    worker_id  TEXT NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS worker_drain_audit_worker ON worker_drain_audit (worker_id, id);
+
+-- Optimistic concurrency: status writers update only the version they read (see
+-- generation_state.go). The trigger bumps it on every update, whoever the writer is
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION generated_content_bump_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS generated_content_version ON generated_content;
+CREATE TRIGGER generated_content_version BEFORE UPDATE ON generated_content
+    FOR EACH ROW EXECUTE FUNCTION generated_content_bump_version();
+
+-- Prompt embeddings (pgvector) for GET /generations/:id/similar. The column is left
+-- dimensionless so the embedding model can change; searches are per user, so they scan
+-- that user's rows rather than an ANN index
+CREATE EXTENSION IF NOT EXISTS vector;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS prompt_embedding vector;
+
+-- Embedding retry queue, written on completion and worked by the embedding worker
+CREATE TABLE IF NOT EXISTS embedding_jobs (
+    request_id      TEXT PRIMARY KEY REFERENCES generated_content (request_id) ON DELETE CASCADE,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error      TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS embedding_jobs_due ON embedding_jobs (next_attempt_at);
+
+-- Orphaned object sweeps (orphans.go): one report per run. The key indexes serve its
+-- "is this object referenced" checks
+CREATE TABLE IF NOT EXISTS orphan_sweeps (
+    id              BIGSERIAL PRIMARY KEY,
+    dry_run         BOOLEAN NOT NULL,
+    started_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at     TIMESTAMPTZ,
+    scanned         BIGINT NOT NULL DEFAULT 0,
+    unreferenced    BIGINT NOT NULL DEFAULT 0,
+    deleted         BIGINT NOT NULL DEFAULT 0,
+    failed          BIGINT NOT NULL DEFAULT 0,
+    bytes_reclaimed BIGINT NOT NULL DEFAULT 0,
+    capped          BOOLEAN NOT NULL DEFAULT false,
+    error           TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS generated_content_content_url_idx ON generated_content (content_url);
+CREATE INDEX IF NOT EXISTS generated_content_thumbnail_key_idx ON generated_content (thumbnail_key) WHERE thumbnail_key IS NOT NULL;
+CREATE INDEX IF NOT EXISTS generated_content_poster_key_idx ON generated_content (poster_key) WHERE poster_key IS NOT NULL;
+CREATE INDEX IF NOT EXISTS generated_content_input_key_idx ON generated_content (input_key) WHERE input_key IS NOT NULL;
+CREATE INDEX IF NOT EXISTS generation_renditions_s3_key_idx ON generation_renditions (s3_key);
+
+-- Late results: a completion for a timed-out row is stored but only becomes the user's
+-- (status completed, late) once they claim it with POST /generations/:id/claim-late
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS late_result BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS late_result_at TIMESTAMPTZ;
+
+-- Prompt templates (templates.go); org_id shares one with that organization's members.
+-- Rows rendered from a template keep a reference that is cleared if it is deleted
+CREATE TABLE IF NOT EXISTS prompt_templates (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users (id),
+    org_id     UUID REFERENCES organizations (id),
+    name       TEXT NOT NULL,
+    body       TEXT NOT NULL,
+    defaults   JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS prompt_templates_user_idx ON prompt_templates (user_id);
+CREATE INDEX IF NOT EXISTS prompt_templates_org_idx ON prompt_templates (org_id) WHERE org_id IS NOT NULL;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS template_id UUID REFERENCES prompt_templates (id) ON DELETE SET NULL;
+
+-- Dead letters (dlq.go): listener messages that failed to parse or apply, kept for
+-- DLQ_RETENTION and capped at DLQ_MAX_ENTRIES. Replays and discards are audited
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id           BIGSERIAL PRIMARY KEY,
+    channel      TEXT NOT NULL,
+    error_class  TEXT NOT NULL,
+    error        TEXT NOT NULL DEFAULT '',
+    request_id   TEXT,
+    payload      TEXT NOT NULL,
+    replays      INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    replayed_at  TIMESTAMPTZ,
+    discarded_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS dead_letters_pending ON dead_letters (channel, error_class, id)
+    WHERE replayed_at IS NULL AND discarded_at IS NULL;
+CREATE INDEX IF NOT EXISTS dead_letters_created ON dead_letters (created_at);
+
+CREATE TABLE IF NOT EXISTS dead_letter_audit (
+    id             BIGSERIAL PRIMARY KEY,
+    dead_letter_id BIGINT NOT NULL,
+    action         TEXT NOT NULL,
+    actor          TEXT NOT NULL,
+    detail         JSONB,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS dead_letter_audit_entry ON dead_letter_audit (dead_letter_id, id);
+
+-- Storage accounting (usage.go): bytes held by each row, the per-user total and the
+-- plan's cap (NULL keeps the built-in default)
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS stored_bytes BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS storage_usage (
+    user_id       UUID PRIMARY KEY REFERENCES users (id),
+    bytes         BIGINT NOT NULL DEFAULT 0,
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    reconciled_at TIMESTAMPTZ
+);
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS storage_bytes BIGINT;
+
+-- Conditional GETs (caching.go): updated_at moves with version on every write, and a
+-- rendition change counts as a write to its generation
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS generated_content_user_updated_idx ON generated_content (user_id, updated_at);
+
+CREATE OR REPLACE FUNCTION generated_content_bump_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    NEW.updated_at := now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION generation_renditions_touch() RETURNS trigger AS $$
+BEGIN
+    UPDATE generated_content SET updated_at = now()
+    WHERE request_id = coalesce(NEW.request_id, OLD.request_id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS generation_renditions_touch ON generation_renditions;
+CREATE TRIGGER generation_renditions_touch AFTER INSERT OR UPDATE OR DELETE ON generation_renditions
+    FOR EACH ROW EXECUTE FUNCTION generation_renditions_touch();
+
+-- Dispatch claims (see job_pull.go): 'redis' once published, 'http' while a pulling
+-- worker holds it until claim_expires_at. Rows from before pull mode count as published;
+-- new rows start undispatched
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS dispatch TEXT DEFAULT 'redis'
+    CHECK (dispatch IN ('redis', 'http'));
+ALTER TABLE generated_content ALTER COLUMN dispatch DROP DEFAULT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS claimed_by TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS claim_expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS generated_content_pull_idx ON generated_content (model, created_at)
+    WHERE status = 'queued' AND dispatch IS NULL;
+CREATE INDEX IF NOT EXISTS generated_content_claims_idx ON generated_content (claim_expires_at)
+    WHERE status = 'processing' AND dispatch = 'http';
+
+-- Admin announcements to realtime clients (broadcasts.go). Empty plans reach everyone
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id         UUID PRIMARY KEY,
+    message    TEXT NOT NULL,
+    severity   TEXT NOT NULL CHECK (severity IN ('info', 'warning', 'critical')),
+    plans      TEXT[] NOT NULL DEFAULT '{}',
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    revoked_by TEXT
+);
+CREATE INDEX IF NOT EXISTS broadcasts_live ON broadcasts (created_at) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS broadcast_audit (
+    id           BIGSERIAL PRIMARY KEY,
+    broadcast_id UUID NOT NULL REFERENCES broadcasts (id),
+    action       TEXT NOT NULL,
+    actor        TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Seeded regression runs (regression.go). Their generations go out on the low-priority
+-- channels, and HTTP pulls hand them out only once no other row is waiting
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS low_priority BOOLEAN NOT NULL DEFAULT false;
+DROP INDEX IF EXISTS generated_content_pull_idx;
+CREATE INDEX IF NOT EXISTS generated_content_pull_priority_idx ON generated_content (model, low_priority, created_at)
+    WHERE status = 'queued' AND dispatch IS NULL;
+
+CREATE TABLE IF NOT EXISTS regression_runs (
+    id            UUID PRIMARY KEY,
+    model         TEXT NOT NULL,
+    model_version TEXT NOT NULL,
+    created_by    TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    item_count    INTEGER NOT NULL
+);
+
+-- phash is the result's 64-bit dHash, filled in lazily by GET /admin/regression-runs/:id
+CREATE TABLE IF NOT EXISTS regression_run_items (
+    run_id     UUID NOT NULL REFERENCES regression_runs (id) ON DELETE CASCADE,
+    idx        INTEGER NOT NULL,
+    request_id UUID NOT NULL,
+    prompt     TEXT NOT NULL,
+    seed       BIGINT NOT NULL,
+    resolution INTEGER NOT NULL DEFAULT 0,
+    steps      INTEGER NOT NULL DEFAULT 0,
+    phash      BIGINT,
+    PRIMARY KEY (run_id, idx)
+);
+
+-- One baseline run per model version
+CREATE TABLE IF NOT EXISTS regression_baselines (
+    model         TEXT NOT NULL,
+    model_version TEXT NOT NULL,
+    run_id        UUID NOT NULL REFERENCES regression_runs (id),
+    set_by        TEXT NOT NULL,
+    set_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (model, model_version)
+);
+
+-- Notification preferences (notification_preferences.go): events is the event type ×
+-- channel type matrix, quiet_hours {start, end, timezone, digest} or NULL
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id     UUID PRIMARY KEY REFERENCES users (id),
+    events      JSONB NOT NULL DEFAULT '{}',
+    quiet_hours JSONB,
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Deliveries held for quiet hours wait in status 'held' until next_attempt_at; those
+-- sharing a digest_key are then sent as one digest and marked 'digested'
+ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS digest_key TEXT;
+CREATE INDEX IF NOT EXISTS notification_deliveries_held_idx
+    ON notification_deliveries (next_attempt_at) WHERE status = 'held';
+
+-- Referral program (referrals.go). The hashes are of the device ID and address the code's
+-- owner last viewed it from, for the same-device heuristic
+CREATE TABLE IF NOT EXISTS referral_codes (
+    user_id          UUID PRIMARY KEY REFERENCES users (id),
+    code             TEXT NOT NULL UNIQUE,
+    last_device_hash TEXT,
+    last_ip_hash     TEXT,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One referral per referee; credits are as granted when rewarded
+CREATE TABLE IF NOT EXISTS referrals (
+    id                    UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    referrer_id           UUID NOT NULL REFERENCES users (id),
+    referee_id            UUID NOT NULL UNIQUE REFERENCES users (id),
+    code                  TEXT NOT NULL,
+    state                 TEXT NOT NULL CHECK (state IN ('pending', 'qualified', 'rewarded', 'blocked')),
+    note                  TEXT,
+    qualifying_request_id UUID,
+    referrer_credits      INTEGER NOT NULL DEFAULT 0,
+    referee_credits       INTEGER NOT NULL DEFAULT 0,
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT now(),
+    qualified_at          TIMESTAMPTZ,
+    rewarded_at           TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS referrals_referrer_idx ON referrals (referrer_id, created_at);
+CREATE INDEX IF NOT EXISTS referrals_pending_idx ON referrals (referee_id) WHERE state = 'pending';
+
+-- Language notifications are written in (i18n.go)
+ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'en';
+
+-- Uploaded inputs with their moderation verdict, kept for audit (moderation.go). A row
+-- with stored = false is an image that was refused and never kept
+CREATE TABLE IF NOT EXISTS uploads (
+    key                   TEXT PRIMARY KEY,
+    user_id               UUID NOT NULL,
+    content_type          TEXT NOT NULL,
+    bytes                 BIGINT NOT NULL,
+    stored                BOOLEAN NOT NULL,
+    moderation            TEXT NOT NULL
+        CHECK (moderation IN ('pending', 'allowed', 'rejected', 'unverified', 'unavailable')),
+    category              TEXT,
+    moderator             TEXT NOT NULL,
+    moderation_error      TEXT,
+    moderation_started_at TIMESTAMPTZ,
+    moderated_at          TIMESTAMPTZ,
+    created_at            TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS uploads_user_idx ON uploads (user_id, created_at);
+CREATE INDEX IF NOT EXISTS uploads_pending_idx ON uploads (created_at) WHERE moderation = 'pending';
+CREATE INDEX IF NOT EXISTS generated_content_held_idx ON generated_content (input_key)
+    WHERE status = 'pending_moderation';
+-- The deadline sweep also covers generations held for moderation
+CREATE INDEX IF NOT EXISTS generated_content_live_deadline_idx ON generated_content (deadline)
+    WHERE deadline IS NOT NULL AND status IN ('queued', 'processing', 'deferred', 'pending_moderation');
+DROP INDEX IF EXISTS generated_content_deadline_idx;
+
+-- Daily rollups of the queue history samples (queue_history.go); the last 24h of raw
+-- samples live in Redis
+CREATE TABLE IF NOT EXISTS queue_history_daily (
+    day               DATE NOT NULL,
+    model             TEXT NOT NULL,
+    samples           INTEGER NOT NULL,
+    depth_sum         BIGINT NOT NULL,
+    depth_max         INTEGER NOT NULL,
+    published_samples INTEGER NOT NULL, -- samples with a publish count; the first after a gap has none
+    published         BIGINT NOT NULL,
+    completed         BIGINT NOT NULL,
+    failed            BIGINT NOT NULL,
+    PRIMARY KEY (day, model)
+);
+
+-- Account states (accounts.go). Deleted accounts keep their row for the ledger and audit
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'disabled', 'deleted'));
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS account_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    UUID NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    request_id TEXT,
+    detail     JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS account_audit_user ON account_audit (user_id, id);
+
+-- Last progress milestone (25/50/75/100) a running request reached (progress_milestones.go)
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS progress_milestone SMALLINT;
+
+-- Organization seats, roles and reporting (org_management.go). The plan sets max_seats
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS plan TEXT NOT NULL DEFAULT 'team';
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS max_seats INTEGER;
+CREATE INDEX IF NOT EXISTS credit_ledger_org_created_idx ON credit_ledger (org_id, created_at) WHERE org_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS org_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    org_id     UUID NOT NULL REFERENCES organizations (id),
+    user_id    UUID,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    detail     JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS org_audit_org ON org_audit (org_id, id);
+
+-- One refund per charge (credits.go): refund_key is <request_id>:<charge>, the original
+-- charge being 1 and each late claim adding one
+ALTER TABLE credit_ledger ADD COLUMN IF NOT EXISTS refund_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS credit_ledger_refund_key_idx ON credit_ledger (refund_key);
+
+-- Recent failures on the status page (admin_ui.go)
+CREATE INDEX IF NOT EXISTS generated_content_failures_idx ON generated_content (updated_at)
+    WHERE status IN ('failed', 'timed_out');
+
+-- Set when the generation is trashed; deep links issued before it stop resolving (deeplinks.go)
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS deep_links_revoked_at TIMESTAMPTZ;
+
+-- Worker pick-up acknowledgements and the stale sweeper (processing_acks.go). dispatched_at
+-- is the latest publish (or the HTTP claim), started_at the "processing" ack (or the HTTP
+-- claim). GET /generations/:id shows both in its timings
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS dispatched_at TIMESTAMPTZ;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS started_by TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS stale_requeues INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS generated_content_unacked_idx ON generated_content (dispatched_at)
+    WHERE status = 'queued' AND dispatch = 'redis' AND started_at IS NULL;
+CREATE INDEX IF NOT EXISTS generated_content_started_idx ON generated_content (started_at)
+    WHERE status = 'processing' AND dispatch = 'redis';
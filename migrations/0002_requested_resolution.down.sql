@@ -0,0 +1,2 @@
+-- migrations/0002_requested_resolution.down.sql
+ALTER TABLE generated_content DROP COLUMN IF EXISTS requested_resolution;
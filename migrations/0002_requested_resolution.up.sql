@@ -0,0 +1,4 @@
+-- migrations/0002_requested_resolution.up.sql
+-- The resolution a request asked for, next to the effective one in resolution when
+-- auto_downscale clamped it to the plan's cap (resolution_caps.go)
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS requested_resolution INTEGER;
@@ -0,0 +1,4 @@
+-- migrations/0003_challenges.down.sql
+DROP TABLE IF EXISTS challenge_votes;
+DROP TABLE IF EXISTS challenge_entries;
+DROP TABLE IF EXISTS challenges;
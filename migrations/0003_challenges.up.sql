@@ -0,0 +1,34 @@
+-- migrations/0003_challenges.up.sql
+-- Daily challenges (challenges.go): one themed challenge per date, one entry per user per
+-- challenge, and one vote per user per challenge. Entries and their votes go with the
+-- generation when its row is deleted; trashed or expired ones are filtered out on read
+CREATE TABLE IF NOT EXISTS challenges (
+    id             UUID PRIMARY KEY,
+    theme          TEXT NOT NULL,
+    challenge_date DATE NOT NULL UNIQUE,
+    starts_at      TIMESTAMPTZ NOT NULL,
+    ends_at        TIMESTAMPTZ NOT NULL CHECK (ends_at > starts_at),
+    created_by     TEXT NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS challenge_entries (
+    challenge_id UUID NOT NULL REFERENCES challenges (id) ON DELETE CASCADE,
+    user_id      UUID NOT NULL,
+    request_id   TEXT NOT NULL REFERENCES generated_content (request_id) ON DELETE CASCADE,
+    entered_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (challenge_id, user_id),
+    UNIQUE (challenge_id, request_id)
+);
+CREATE INDEX IF NOT EXISTS challenge_entries_entered_idx ON challenge_entries (challenge_id, entered_at);
+
+CREATE TABLE IF NOT EXISTS challenge_votes (
+    challenge_id UUID NOT NULL,
+    user_id      UUID NOT NULL,
+    request_id   TEXT NOT NULL,
+    voted_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (challenge_id, user_id),
+    FOREIGN KEY (challenge_id, request_id) REFERENCES challenge_entries (challenge_id, request_id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS challenge_votes_entry_idx ON challenge_votes (challenge_id, request_id);
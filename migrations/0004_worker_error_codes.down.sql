@@ -0,0 +1,4 @@
+-- migrations/0004_worker_error_codes.down.sql
+ALTER TABLE generated_content DROP COLUMN IF EXISTS error_retries;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS worker_error;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS error_code;
@@ -0,0 +1,7 @@
+-- migrations/0004_worker_error_codes.up.sql
+-- Classified worker failures (worker_errors.go): error holds the user-facing message,
+-- error_code the reason and worker_error the worker's own text. error_retries counts
+-- automatic republishes after transient failures
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS error_code TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS worker_error TEXT;
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS error_retries INTEGER NOT NULL DEFAULT 0;
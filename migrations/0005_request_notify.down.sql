@@ -0,0 +1,2 @@
+-- migrations/0005_request_notify.down.sql
+ALTER TABLE generated_content DROP COLUMN IF EXISTS notify;
@@ -0,0 +1,5 @@
+-- migrations/0005_request_notify.up.sql
+-- Per-request notification override (the notify field of POST /generations): all follows
+-- the owner's preferences, failures_only and none narrow them for this row's notifications
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS notify TEXT NOT NULL DEFAULT 'all'
+    CHECK (notify IN ('all', 'failures_only', 'none'));
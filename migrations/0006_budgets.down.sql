@@ -0,0 +1,6 @@
+-- migrations/0006_budgets.down.sql
+DROP INDEX IF EXISTS credit_ledger_org_created_idx;
+DROP INDEX IF EXISTS credit_ledger_user_created_idx;
+DROP TABLE IF EXISTS budget_alerts;
+DROP TABLE IF EXISTS budget_thresholds;
+DROP TABLE IF EXISTS credit_budgets;
@@ -0,0 +1,38 @@
+-- migrations/0006_budgets.up.sql
+-- Budget alerts (budgets.go). A budget belongs to a user (org_id NULL) or to an organization's
+-- pool; user_id is who last set it. Thresholds are a percentage of the monthly budget or a
+-- credit amount, and budget_alerts records each one sent, so a threshold alerts at most once
+-- per calendar month (UTC) however often spend crosses it
+CREATE TABLE IF NOT EXISTS credit_budgets (
+    id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id         UUID NOT NULL REFERENCES users (id),
+    org_id          UUID REFERENCES organizations (id),
+    monthly_credits INTEGER NOT NULL CHECK (monthly_credits > 0),
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS credit_budgets_user_idx ON credit_budgets (user_id) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS credit_budgets_org_idx ON credit_budgets (org_id) WHERE org_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS budget_thresholds (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users (id),
+    org_id     UUID REFERENCES organizations (id),
+    percent    INTEGER CHECK (percent BETWEEN 1 AND 100),
+    credits    INTEGER CHECK (credits > 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK ((percent IS NULL) <> (credits IS NULL))
+);
+CREATE INDEX IF NOT EXISTS budget_thresholds_user_idx ON budget_thresholds (user_id) WHERE org_id IS NULL;
+CREATE INDEX IF NOT EXISTS budget_thresholds_org_idx ON budget_thresholds (org_id) WHERE org_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS budget_alerts (
+    threshold_id UUID NOT NULL REFERENCES budget_thresholds (id) ON DELETE CASCADE,
+    period_start DATE NOT NULL,
+    spent        INTEGER NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (threshold_id, period_start)
+);
+
+-- Spend this month, per payer
+CREATE INDEX IF NOT EXISTS credit_ledger_user_created_idx ON credit_ledger (user_id, created_at) WHERE org_id IS NULL;
+CREATE INDEX IF NOT EXISTS credit_ledger_org_created_idx ON credit_ledger (org_id, created_at) WHERE org_id IS NOT NULL;
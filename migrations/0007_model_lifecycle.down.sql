@@ -0,0 +1,4 @@
+-- migrations/0007_model_lifecycle.down.sql
+ALTER TABLE generated_content DROP COLUMN IF EXISTS model_substituted_from;
+DROP TABLE IF EXISTS model_lifecycle_audit;
+DROP TABLE IF EXISTS model_lifecycle;
@@ -0,0 +1,28 @@
+-- migrations/0007_model_lifecycle.up.sql
+-- Model lifecycle (model_lifecycle.go). Models without a row are active. deprecated models
+-- keep working until sunset_at; disabled ones, and deprecated ones past their sunset, are
+-- refused, and stored requests re-run on them switch to the replacement
+CREATE TABLE IF NOT EXISTS model_lifecycle (
+    model       TEXT PRIMARY KEY,
+    state       TEXT NOT NULL CHECK (state IN ('active', 'deprecated', 'disabled')),
+    sunset_at   TIMESTAMPTZ,
+    replacement TEXT,
+    updated_by  TEXT NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (state <> 'deprecated' OR sunset_at IS NOT NULL)
+);
+
+CREATE TABLE IF NOT EXISTS model_lifecycle_audit (
+    id             BIGSERIAL PRIMARY KEY,
+    model          TEXT NOT NULL,
+    previous_state TEXT NOT NULL,
+    state          TEXT NOT NULL,
+    sunset_at      TIMESTAMPTZ,
+    replacement    TEXT,
+    actor          TEXT NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS model_lifecycle_audit_model_idx ON model_lifecycle_audit (model, id);
+
+-- The model a row was submitted with, when a re-run switched it to a replacement
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS model_substituted_from TEXT;
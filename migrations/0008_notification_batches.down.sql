@@ -0,0 +1,4 @@
+-- migrations/0008_notification_batches.down.sql
+DROP INDEX IF EXISTS notification_deliveries_digest_idx;
+DROP INDEX IF EXISTS generated_content_batch_idx;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS batch_id;
@@ -0,0 +1,11 @@
+-- migrations/0008_notification_batches.up.sql
+-- Client-chosen batch of a request (the batch_id field of POST /generations): its
+-- notifications are collapsed into one (notification_batches.go) and
+-- GET /generations?batch_id= lists the batch
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS batch_id TEXT;
+CREATE INDEX IF NOT EXISTS generated_content_batch_idx
+    ON generated_content (user_id, batch_id, created_at DESC) WHERE batch_id IS NOT NULL;
+
+-- Batch windows look up the group a notification joins
+CREATE INDEX IF NOT EXISTS notification_deliveries_digest_idx
+    ON notification_deliveries (digest_key) WHERE status = 'held';
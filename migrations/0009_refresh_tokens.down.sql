@@ -0,0 +1,3 @@
+-- migrations/0009_refresh_tokens.down.sql
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS refresh_families;
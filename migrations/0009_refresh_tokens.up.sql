@@ -0,0 +1,23 @@
+-- migrations/0009_refresh_tokens.up.sql
+-- Rotating refresh tokens (auth_tokens.go). A family is one device's sign-in; each
+-- refresh spends its token and adds the next. Only hashes of the tokens are stored
+CREATE TABLE IF NOT EXISTS refresh_families (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users (id),
+    device_id     TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at    TIMESTAMPTZ,
+    revoke_reason TEXT -- logout, logout_all, replaced, reused
+);
+CREATE UNIQUE INDEX IF NOT EXISTS refresh_families_device_idx
+    ON refresh_families (user_id, device_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    family_id  UUID NOT NULL REFERENCES refresh_families (id) ON DELETE CASCADE,
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id);
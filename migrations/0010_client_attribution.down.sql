@@ -0,0 +1,3 @@
+-- migrations/0010_client_attribution.down.sql
+ALTER TABLE generated_content DROP COLUMN IF EXISTS client_version;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS client_platform;
@@ -0,0 +1,5 @@
+-- migrations/0010_client_attribution.up.sql
+-- The client (X-Client-Platform, X-Client-Version) a request came from; earlier rows
+-- and requests without the headers are 'unknown' (clients.go)
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS client_platform TEXT NOT NULL DEFAULT 'unknown';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS client_version TEXT NOT NULL DEFAULT 'unknown';
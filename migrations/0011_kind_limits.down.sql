@@ -0,0 +1,2 @@
+-- migrations/0011_kind_limits.down.sql
+ALTER TABLE plan_limits DROP COLUMN IF EXISTS kind_limits;
@@ -0,0 +1,4 @@
+-- migrations/0011_kind_limits.up.sql
+-- Per request_type rate and in-flight limits of a plan, e.g. {"text": {"rate_limit": 600}}
+-- (buckets.go)
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS kind_limits JSONB NOT NULL DEFAULT '{}';
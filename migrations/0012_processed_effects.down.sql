@@ -0,0 +1,2 @@
+-- migrations/0012_processed_effects.down.sql
+DROP TABLE IF EXISTS processed_effects;
@@ -0,0 +1,9 @@
+-- migrations/0012_processed_effects.up.sql
+-- Side effects a completion has fired, so replaying it fires none twice
+-- (processed_effects.go). 'result' marks the row's own terminal write
+CREATE TABLE IF NOT EXISTS processed_effects (
+    request_id   TEXT NOT NULL REFERENCES generated_content (request_id) ON DELETE CASCADE,
+    effect_type  TEXT NOT NULL,
+    processed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (request_id, effect_type)
+);
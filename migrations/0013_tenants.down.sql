@@ -0,0 +1,19 @@
+-- migrations/0013_tenants.down.sql
+-- Only safe once nothing but the default tenant is left: the old keys aren't unique
+-- across tenants
+ALTER TABLE broadcasts DROP COLUMN IF EXISTS tenant_id;
+
+ALTER TABLE challenges DROP CONSTRAINT IF EXISTS challenges_tenant_date_key;
+ALTER TABLE challenges ADD CONSTRAINT challenges_challenge_date_key UNIQUE (challenge_date);
+ALTER TABLE challenges DROP COLUMN IF EXISTS tenant_id;
+
+ALTER TABLE plan_limits DROP CONSTRAINT IF EXISTS plan_limits_pkey;
+ALTER TABLE plan_limits ADD PRIMARY KEY (plan);
+ALTER TABLE plan_limits DROP COLUMN IF EXISTS tenant_id;
+
+DROP TRIGGER IF EXISTS generated_content_tenant ON generated_content;
+DROP FUNCTION IF EXISTS generated_content_tenant();
+DROP INDEX IF EXISTS generated_content_tenant_created_idx;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE organizations DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
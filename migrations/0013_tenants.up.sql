@@ -0,0 +1,39 @@
+-- migrations/0013_tenants.up.sql
+-- Tenants (tenants.go). Every user belongs to one, and the rows that are looked up
+-- without an owner (generations by ID, organizations, plans, challenges) carry it too.
+-- Everything before this migration is the default tenant's
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS generated_content_tenant_created_idx ON generated_content (tenant_id, created_at);
+
+-- A row takes its owner's tenant, whichever path inserted it; owners without a users row
+-- keep the one given, the default unless the backend says otherwise
+CREATE OR REPLACE FUNCTION generated_content_tenant() RETURNS trigger AS $$
+DECLARE
+    owner_tenant TEXT;
+BEGIN
+    SELECT tenant_id INTO owner_tenant FROM users WHERE id = NEW.user_id;
+    IF FOUND THEN
+        NEW.tenant_id := owner_tenant;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS generated_content_tenant ON generated_content;
+CREATE TRIGGER generated_content_tenant BEFORE INSERT ON generated_content
+    FOR EACH ROW EXECUTE FUNCTION generated_content_tenant();
+
+-- Each tenant configures its own plans
+ALTER TABLE plan_limits ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE plan_limits DROP CONSTRAINT IF EXISTS plan_limits_pkey;
+ALTER TABLE plan_limits ADD PRIMARY KEY (tenant_id, plan);
+
+-- One challenge per date and tenant
+ALTER TABLE challenges ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE challenges DROP CONSTRAINT IF EXISTS challenges_challenge_date_key;
+ALTER TABLE challenges ADD CONSTRAINT challenges_tenant_date_key UNIQUE (tenant_id, challenge_date);
+
+-- NULL reaches every tenant: the operator's own announcements, e.g. SLO breaches
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS tenant_id TEXT;
@@ -0,0 +1,6 @@
+-- migrations/0014_daily_generation_stats.down.sql
+DROP INDEX IF EXISTS generated_content_unpruned_idx;
+ALTER TABLE generated_content DROP COLUMN IF EXISTS pruned_at;
+DROP TABLE IF EXISTS daily_generation_rollups;
+DROP TABLE IF EXISTS daily_active_users;
+DROP TABLE IF EXISTS daily_generation_stats;
@@ -0,0 +1,36 @@
+-- migrations/0014_daily_generation_stats.up.sql
+-- Daily rollups of generated_content (analytics.go), per tenant, model and the owner's
+-- plan. generation_seconds_buckets counts completed, timed rows per bucket of
+-- analyticsBucketBounds, the last bucket being everything above the highest bound
+CREATE TABLE IF NOT EXISTS daily_generation_stats (
+    day                        DATE NOT NULL,
+    tenant_id                  TEXT NOT NULL,
+    model                      TEXT NOT NULL,
+    plan                       TEXT NOT NULL,
+    total                      BIGINT NOT NULL,
+    status_counts              JSONB NOT NULL DEFAULT '{}',
+    credits_charged            BIGINT NOT NULL DEFAULT 0,
+    gpu_seconds                DOUBLE PRECISION NOT NULL DEFAULT 0,
+    timed_count                BIGINT NOT NULL DEFAULT 0,
+    generation_seconds_sum     DOUBLE PRECISION NOT NULL DEFAULT 0,
+    generation_seconds_buckets BIGINT[] NOT NULL,
+    PRIMARY KEY (day, tenant_id, model, plan)
+);
+
+-- Distinct users are not additive across days, so each day keeps its own
+CREATE TABLE IF NOT EXISTS daily_active_users (
+    day       DATE NOT NULL,
+    tenant_id TEXT NOT NULL,
+    user_id   UUID NOT NULL,
+    PRIMARY KEY (day, tenant_id, user_id)
+);
+
+-- The days whose rows above are complete; stats read raw rows for any other day
+CREATE TABLE IF NOT EXISTS daily_generation_rollups (
+    day       DATE PRIMARY KEY,
+    rolled_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Rows whose prompts, embedding and worker error were dropped by RAW_PRUNE_AFTER_MONTHS
+ALTER TABLE generated_content ADD COLUMN IF NOT EXISTS pruned_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS generated_content_unpruned_idx ON generated_content (created_at) WHERE pruned_at IS NULL;
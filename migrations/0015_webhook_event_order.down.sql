@@ -0,0 +1,6 @@
+-- migrations/0015_webhook_event_order.down.sql
+DROP TABLE IF EXISTS webhook_event_stages;
+DROP SEQUENCE IF EXISTS webhook_event_sequence;
+DROP INDEX IF EXISTS notification_deliveries_order_idx;
+ALTER TABLE notification_deliveries DROP COLUMN IF EXISTS sequence;
+ALTER TABLE notification_deliveries DROP COLUMN IF EXISTS order_key;
@@ -0,0 +1,17 @@
+-- migrations/0015_webhook_event_order.up.sql
+-- Ordered webhook events (webhook_events.go). A delivery's order_key is its endpoint and
+-- request; one isn't claimed while an earlier sequence of its key is still to go out
+ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS order_key TEXT;
+ALTER TABLE notification_deliveries ADD COLUMN IF NOT EXISTS sequence BIGINT;
+CREATE INDEX IF NOT EXISTS notification_deliveries_order_idx
+    ON notification_deliveries (order_key, sequence) WHERE order_key IS NOT NULL;
+
+-- Shared by every endpoint, so a request's events only ever count up
+CREATE SEQUENCE IF NOT EXISTS webhook_event_sequence;
+
+-- The furthest stage queued per order key; events behind it are dropped as stale
+CREATE TABLE IF NOT EXISTS webhook_event_stages (
+    order_key  TEXT PRIMARY KEY,
+    stage      INTEGER NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
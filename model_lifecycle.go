@@ -0,0 +1,348 @@
+// model_lifecycle.go
+// Retiring models. Each known model is active (no model_lifecycle row), deprecated until a
+// sunset date, or disabled. A deprecated model keeps working: every 202 for it and every
+// status of a generation on it carries a deprecation warning with the sunset date and the
+// suggested replacement, plus Deprecation and Sunset headers on the 202. Past the sunset it
+// is treated as disabled, and new requests for it are a 410 model_retired. Stored requests
+// that run again on a retired model (an admin requeue, a deferred request coming due)
+// switch to its replacement and keep the original in model_substituted_from, as a notice
+// on the row. Admins set the state through PUT /admin/models/:model/lifecycle, audited in
+// model_lifecycle_audit, and every instance reloads it like the plans.
+// mobart_model_lifecycle_requests_total shows how traffic moves off a model
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Lifecycle states
+const (
+	modelActive     = "active"
+	modelDeprecated = "deprecated"
+	modelDisabled   = "disabled"
+
+	modelLifecycleReloadChannel = "model_lifecycle_reload"
+)
+
+var modelLifecycleRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_model_lifecycle_requests_total",
+	Help: "Requests by model, lifecycle state (active, deprecated, disabled, or retired past the sunset) and outcome (accepted, rejected, substituted).",
+}, []string{"model", "state", "outcome"})
+
+// ModelLifecycle is one model's state, as stored and as admins see it
+type ModelLifecycle struct {
+	Model       string     `json:"model"`
+	State       string     `json:"state"`
+	SunsetAt    *time.Time `json:"sunset_at,omitempty"`
+	Replacement string     `json:"replacement,omitempty"`
+	UpdatedBy   string     `json:"updated_by,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// retired reports whether requests for the model are refused at now
+func (l ModelLifecycle) retired(now time.Time) bool {
+	return l.State == modelDisabled || (l.State == modelDeprecated && l.SunsetAt != nil && !now.Before(*l.SunsetAt))
+}
+
+// stateLabel is the state for metrics, where a deprecated model past its sunset is "retired"
+func (l ModelLifecycle) stateLabel(now time.Time) string {
+	if l.State == modelDeprecated && l.retired(now) {
+		return "retired"
+	}
+	return l.State
+}
+
+var currentModelLifecycles atomic.Pointer[map[string]ModelLifecycle]
+
+func init() {
+	empty := map[string]ModelLifecycle{}
+	currentModelLifecycles.Store(&empty)
+}
+
+// modelLifecycleFor is model's current state; models without one are active
+func modelLifecycleFor(model string) ModelLifecycle {
+	if l, ok := (*currentModelLifecycles.Load())[model]; ok {
+		return l
+	}
+	return ModelLifecycle{Model: model, State: modelActive}
+}
+
+// loadModelLifecycles swaps in the stored states
+func loadModelLifecycles(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT model, state, sunset_at, coalesce(replacement, ''), updated_by, updated_at FROM model_lifecycle`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	lifecycles := map[string]ModelLifecycle{}
+	for rows.Next() {
+		var l ModelLifecycle
+		if err := rows.Scan(&l.Model, &l.State, &l.SunsetAt, &l.Replacement, &l.UpdatedBy, &l.UpdatedAt); err != nil {
+			return err
+		}
+		lifecycles[l.Model] = l
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	currentModelLifecycles.Store(&lifecycles)
+	return nil
+}
+
+// startModelLifecycleListener reloads whenever any instance changes a model's state
+func startModelLifecycleListener() {
+	ctx := context.Background()
+	pubsub := rdb.Subscribe(ctx, modelLifecycleReloadChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		panic(err)
+	}
+	for range pubsub.Channel() {
+		if err := loadModelLifecycles(ctx); err != nil {
+			log.Printf("❌ Failed to reload model lifecycles, keeping the current ones: %v", err)
+		}
+	}
+}
+
+// ModelDeprecation is the warning on responses about a deprecated model
+type ModelDeprecation struct {
+	Model       string    `json:"model"`
+	SunsetAt    time.Time `json:"sunset_at"`
+	Replacement string    `json:"replacement,omitempty"`
+	Message     string    `json:"message"`
+}
+
+// modelDeprecation is the warning for model in locale, nil unless it's deprecated
+func modelDeprecation(locale, model string) *ModelDeprecation {
+	l := modelLifecycleFor(model)
+	if l.State != modelDeprecated || l.SunsetAt == nil {
+		return nil
+	}
+	d := &ModelDeprecation{Model: model, SunsetAt: *l.SunsetAt, Replacement: l.Replacement}
+	params := map[string]interface{}{"model": model, "date": localeDate(*l.SunsetAt), "replacement": l.Replacement}
+	if l.Replacement != "" {
+		d.Message = translate(locale, "warning", "{model} is deprecated and stops working on {date}. Switch to {replacement}", params)
+	} else {
+		d.Message = translate(locale, "warning", "{model} is deprecated and stops working on {date}", params)
+	}
+	return d
+}
+
+// refuseRetiredModel answers 410 model_retired when model no longer takes requests
+func refuseRetiredModel(c *gin.Context, model string) bool {
+	l := modelLifecycleFor(model)
+	now := clock.Now()
+	if !l.retired(now) {
+		return false
+	}
+	modelLifecycleRequests.WithLabelValues(model, l.stateLabel(now), "rejected").Inc()
+	respondErrorDetails(c, codeModelRetired, "This model has been retired",
+		gin.H{"model": model, "sunset_at": l.SunsetAt, "replacement": l.Replacement})
+	return true
+}
+
+// acceptModelRequest counts a request accepted for model and returns its deprecation
+// warning, also set as Deprecation and Sunset headers (RFC 8594)
+func acceptModelRequest(c *gin.Context, model string) *ModelDeprecation {
+	l := modelLifecycleFor(model)
+	modelLifecycleRequests.WithLabelValues(model, l.stateLabel(clock.Now()), "accepted").Inc()
+	d := modelDeprecation(requestLocale(c), model)
+	if d != nil {
+		c.Header("Deprecation", "true")
+		c.Header("Sunset", d.SunsetAt.UTC().Format(http.TimeFormat))
+	}
+	return d
+}
+
+// ModelSubstitution is a stored request's switch from a retired model to its replacement
+type ModelSubstitution struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// retiredModelSubstitution is the switch for a stored request on model before it runs
+// again: nil while the model works. ok is false for a retired model without a replacement
+func retiredModelSubstitution(model string, now time.Time) (sub *ModelSubstitution, ok bool) {
+	l := modelLifecycleFor(model)
+	if !l.retired(now) {
+		return nil, true
+	}
+	if l.Replacement == "" {
+		modelLifecycleRequests.WithLabelValues(model, l.stateLabel(now), "rejected").Inc()
+		return nil, false
+	}
+	modelLifecycleRequests.WithLabelValues(model, l.stateLabel(now), "substituted").Inc()
+	return &ModelSubstitution{From: model, To: l.Replacement}, true
+}
+
+// apply makes w, a write republishing the row, switch its model too
+func (s *ModelSubstitution) apply(w *generationWrite) {
+	if s == nil {
+		return
+	}
+	if w.Set != "" {
+		w.Set += ", "
+	}
+	w.Set += "model_substituted_from = coalesce(model_substituted_from, model), model = $" + strconv.Itoa(4+len(w.Args))
+	w.Args = append(w.Args, s.To)
+}
+
+// modelLifecycleRequest is the body of PUT /admin/models/:model/lifecycle
+type modelLifecycleRequest struct {
+	State       string     `json:"state"`
+	SunsetAt    *time.Time `json:"sunset_at"`   // required for deprecated
+	Replacement string     `json:"replacement"` // where requests go once the model is retired
+}
+
+func (r *modelLifecycleRequest) validate(model string) (field, msg string) {
+	switch r.State {
+	case modelActive:
+		r.SunsetAt, r.Replacement = nil, ""
+		return "", ""
+	case modelDeprecated:
+		if r.SunsetAt == nil {
+			return "sunset_at", "is required for a deprecated model"
+		}
+	case modelDisabled:
+	default:
+		return "state", "must be active, deprecated or disabled"
+	}
+	if r.Replacement == "" {
+		return "", ""
+	}
+	if r.Replacement == model || !containsString(knownModels, r.Replacement) {
+		return "replacement", "must be another known model"
+	}
+	if modelLifecycleFor(r.Replacement).retired(clock.Now()) {
+		return "replacement", "is retired itself"
+	}
+	return "", ""
+}
+
+// listModelLifecyclesHandler handles GET /admin/models/lifecycle: every known model's state
+func listModelLifecyclesHandler(c *gin.Context) {
+	list := make([]ModelLifecycle, 0, len(knownModels))
+	for _, m := range knownModels {
+		list = append(list, modelLifecycleFor(m))
+	}
+	c.JSON(http.StatusOK, gin.H{"models": list})
+}
+
+// ModelLifecycleChange is one entry of model_lifecycle_audit
+type ModelLifecycleChange struct {
+	PreviousState string     `json:"previous_state"`
+	State         string     `json:"state"`
+	SunsetAt      *time.Time `json:"sunset_at,omitempty"`
+	Replacement   string     `json:"replacement,omitempty"`
+	Actor         string     `json:"actor"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// getModelLifecycleHandler handles GET /admin/models/:model/lifecycle, with the model's
+// last 50 changes
+func getModelLifecycleHandler(c *gin.Context) {
+	model := c.Param("model")
+	if !containsString(knownModels, model) {
+		respondError(c, codeNotFound, "Unknown model")
+		return
+	}
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT previous_state, state, sunset_at, coalesce(replacement, ''), actor, created_at
+		FROM model_lifecycle_audit WHERE model = $1 ORDER BY id DESC LIMIT 50`, model)
+	if err != nil {
+		log.Printf("❌ Failed to load lifecycle history of %s: %v", model, err)
+		respondError(c, codeInternal, "Failed to load model lifecycle")
+		return
+	}
+	defer rows.Close()
+	history := []ModelLifecycleChange{}
+	for rows.Next() {
+		var h ModelLifecycleChange
+		if err := rows.Scan(&h.PreviousState, &h.State, &h.SunsetAt, &h.Replacement, &h.Actor, &h.CreatedAt); err != nil {
+			log.Printf("❌ Failed to load lifecycle history of %s: %v", model, err)
+			respondError(c, codeInternal, "Failed to load model lifecycle")
+			return
+		}
+		history = append(history, h)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("❌ Failed to load lifecycle history of %s: %v", model, err)
+		respondError(c, codeInternal, "Failed to load model lifecycle")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lifecycle": modelLifecycleFor(model), "history": history})
+}
+
+// putModelLifecycleHandler handles PUT /admin/models/:model/lifecycle
+func putModelLifecycleHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	model := c.Param("model")
+	if !containsString(knownModels, model) {
+		respondError(c, codeNotFound, "Unknown model")
+		return
+	}
+	var body modelLifecycleRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if field, msg := body.validate(model); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to save model lifecycle")
+		return
+	}
+	defer tx.Rollback()
+	previous := modelActive
+	err = tx.QueryRowContext(ctx, `SELECT state FROM model_lifecycle WHERE model = $1 FOR UPDATE`, model).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("❌ Failed to load lifecycle of %s: %v", model, err)
+		respondError(c, codeInternal, "Failed to save model lifecycle")
+		return
+	}
+	if _, err = tx.ExecContext(ctx, `
+		INSERT INTO model_lifecycle (model, state, sunset_at, replacement, updated_by)
+		VALUES ($1, $2, $3, nullif($4, ''), $5)
+		ON CONFLICT (model) DO UPDATE SET state = EXCLUDED.state, sunset_at = EXCLUDED.sunset_at,
+		    replacement = EXCLUDED.replacement, updated_by = EXCLUDED.updated_by, updated_at = now()`,
+		model, body.State, body.SunsetAt, body.Replacement, admin.ID.String()); err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO model_lifecycle_audit (model, previous_state, state, sunset_at, replacement, actor)
+			VALUES ($1, $2, $3, $4, nullif($5, ''), $6)`,
+			model, previous, body.State, body.SunsetAt, body.Replacement, admin.ID.String())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to save lifecycle of %s: %v", model, err)
+		respondError(c, codeInternal, "Failed to save model lifecycle")
+		return
+	}
+	log.Printf("🪦 Model %s moved from %s to %s by %s", model, previous, body.State, admin.ID)
+
+	if err := loadModelLifecycles(ctx); err != nil {
+		log.Printf("⚠️ Failed to reload model lifecycles: %v", err)
+	}
+	if err := rdb.Publish(ctx, modelLifecycleReloadChannel, "reload").Err(); err != nil {
+		log.Printf("⚠️ Failed to tell other instances to reload model lifecycles: %v", err)
+	}
+	c.JSON(http.StatusOK, modelLifecycleFor(model))
+}
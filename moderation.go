@@ -0,0 +1,334 @@
+// moderation.go
+// Moderation of uploaded input images, the image counterpart of prompt validation.
+// Every upload goes through imageModerator and leaves a row in uploads with the verdict,
+// for audit. By default the verdict comes before the upload is stored and a rejected
+// image never is. With IMAGE_MODERATION_ASYNC the upload is stored and accepted at once,
+// generations using it wait as pending_moderation, and a worker releases or fails them
+// once the verdict is in. A classifier that errors or times out is handled by
+// IMAGE_MODERATION_FAIL_OPEN: open lets the image through as unverified, closed refuses it
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Upload moderation states
+const (
+	moderationPending     = "pending"
+	moderationAllowed     = "allowed"
+	moderationRejected    = "rejected"
+	moderationUnverified  = "unverified"  // the classifier failed and the policy is fail-open
+	moderationUnavailable = "unavailable" // the classifier failed and the policy is fail-closed
+)
+
+// generationPendingModeration is the status of a generation waiting on its input's verdict
+const generationPendingModeration = "pending_moderation"
+
+var (
+	imageModerationTimeout  = getEnvDuration("IMAGE_MODERATION_TIMEOUT", 5*time.Second)
+	imageModerationFailOpen = getEnvBool("IMAGE_MODERATION_FAIL_OPEN", false)
+	imageModerationAsync    = getEnvBool("IMAGE_MODERATION_ASYNC", false)
+	imageModerationPoll     = getEnvDuration("IMAGE_MODERATION_POLL_INTERVAL", time.Second)
+
+	errModerationUnavailable = errors.New("image moderation is unavailable, please try again shortly")
+
+	uploadModerations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_upload_moderation_total",
+		Help: "Upload moderation verdicts, by state (allowed, rejected, unverified, unavailable).",
+	}, []string{"state"})
+)
+
+// ModerationVerdict is a classifier's answer for one image
+type ModerationVerdict struct {
+	Allowed  bool
+	Category string // why it was refused, e.g. "nudity"; empty when allowed
+}
+
+// ImageModerator classifies an uploaded image. An error means no verdict, which
+// IMAGE_MODERATION_FAIL_OPEN decides
+type ImageModerator interface {
+	Name() string
+	Moderate(ctx context.Context, data []byte, contentType string) (ModerationVerdict, error)
+}
+
+// imageModerator is set from IMAGE_MODERATION_URL; without it every image is allowed
+var imageModerator ImageModerator = newImageModerator(getEnv("IMAGE_MODERATION_URL", ""))
+
+func newImageModerator(url string) ImageModerator {
+	if url == "" {
+		return passThroughModerator{}
+	}
+	return &httpImageModerator{url: url, apiKey: getEnv("IMAGE_MODERATION_KEY", "")}
+}
+
+// passThroughModerator allows everything
+type passThroughModerator struct{}
+
+func (passThroughModerator) Name() string { return "none" }
+
+func (passThroughModerator) Moderate(context.Context, []byte, string) (ModerationVerdict, error) {
+	return ModerationVerdict{Allowed: true}, nil
+}
+
+func moderationEnabled() bool {
+	_, off := imageModerator.(passThroughModerator)
+	return !off
+}
+
+// httpImageModerator calls a classifier:
+// {"image": base64, "content_type"} -> {"allowed": bool, "category": "..."}
+type httpImageModerator struct {
+	url, apiKey string
+}
+
+// moderationHTTPClient leaves the timeout to IMAGE_MODERATION_TIMEOUT on the context
+var moderationHTTPClient = &http.Client{}
+
+func (m *httpImageModerator) Name() string { return "http" }
+
+func (m *httpImageModerator) Moderate(ctx context.Context, data []byte, contentType string) (ModerationVerdict, error) {
+	var out struct {
+		Allowed  *bool  `json:"allowed"`
+		Category string `json:"category"`
+	}
+	body := map[string]string{"image": base64.StdEncoding.EncodeToString(data), "content_type": contentType}
+	if err := postJSONWith(ctx, moderationHTTPClient, m.url, m.apiKey, body, &out); err != nil {
+		return ModerationVerdict{}, err
+	}
+	if out.Allowed == nil {
+		return ModerationVerdict{}, errors.New("moderation service returned no verdict")
+	}
+	return ModerationVerdict{Allowed: *out.Allowed, Category: out.Category}, nil
+}
+
+// moderationResult is a verdict as recorded, with the fail-open/closed policy applied
+type moderationResult struct {
+	State    string
+	Category string
+	Error    string
+}
+
+// usable reports whether a generation may use the image
+func (r moderationResult) usable() bool {
+	return r.State == moderationAllowed || r.State == moderationUnverified
+}
+
+// moderateImage asks imageModerator about data within IMAGE_MODERATION_TIMEOUT
+func moderateImage(ctx context.Context, data []byte, contentType string) moderationResult {
+	ctx, cancel := context.WithTimeout(ctx, imageModerationTimeout)
+	defer cancel()
+
+	var r moderationResult
+	v, err := imageModerator.Moderate(ctx, data, contentType)
+	switch {
+	case err != nil && imageModerationFailOpen:
+		r = moderationResult{State: moderationUnverified, Error: err.Error()}
+	case err != nil:
+		r = moderationResult{State: moderationUnavailable, Error: err.Error()}
+	case !v.Allowed:
+		r = moderationResult{State: moderationRejected, Category: v.Category}
+		if r.Category == "" {
+			r.Category = "unspecified"
+		}
+	default:
+		r = moderationResult{State: moderationAllowed}
+	}
+	if err != nil {
+		log.Printf("⚠️ Image moderation failed (%s): %v", r.State, err)
+	}
+	uploadModerations.WithLabelValues(r.State).Inc()
+	return r
+}
+
+// moderationRejection is storeInput's error for an image the classifier refused
+type moderationRejection struct {
+	Category string
+}
+
+func (e *moderationRejection) Error() string {
+	return "image rejected by moderation: " + e.Category
+}
+
+// recordUpload writes the upload's audit row. stored is false for an image refused
+// before it was stored: the key was never written
+func recordUpload(ctx context.Context, key, userID, contentType string, bytes int, stored bool, r moderationResult) {
+	var moderatedAt interface{}
+	if r.State != moderationPending {
+		moderatedAt = clock.Now()
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO uploads (key, user_id, content_type, bytes, stored, moderation, category, moderator,
+		                     moderation_error, moderated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, nullif($7, ''), $8, nullif($9, ''), $10)`,
+		key, userID, contentType, bytes, stored, r.State, r.Category, imageModerator.Name(), r.Error, moderatedAt); err != nil {
+		log.Printf("⚠️ Failed to record upload %s: %v", key, err)
+	}
+}
+
+// uploadModeration is the recorded verdict for an input key. Uploads from before
+// moderation have no row and count as allowed
+func uploadModeration(ctx context.Context, key string) (moderationResult, error) {
+	var r moderationResult
+	err := db.QueryRowContext(ctx, `
+		SELECT moderation, coalesce(category, '') FROM uploads WHERE key = $1`, key).Scan(&r.State, &r.Category)
+	if err == sql.ErrNoRows {
+		return moderationResult{State: moderationAllowed}, nil
+	}
+	return r, err
+}
+
+// inputAwaitingModeration reports whether a generation using key has to wait for the
+// upload's verdict. checkGenerationRequest has already refused unusable inputs
+func inputAwaitingModeration(ctx context.Context, key string) bool {
+	if key == "" {
+		return false
+	}
+	r, err := uploadModeration(ctx, key)
+	return err == nil && r.State == moderationPending
+}
+
+// rejectionCategory is the category shown for an unusable input
+func (r moderationResult) rejectionCategory() string {
+	if r.State == moderationUnavailable {
+		return "moderation_unavailable"
+	}
+	return r.Category
+}
+
+// startUploadModerationWorker moderates async uploads and settles the generations held
+// on them. Only started with a moderator configured
+func startUploadModerationWorker() {
+	ticker := time.NewTicker(imageModerationPoll)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("upload_moderation", nil, func() {
+			ctx := context.Background()
+			moderatePendingUploads(ctx)
+			settleHeldGenerations(ctx)
+		})
+	}
+}
+
+// moderatePendingUploads classifies pending uploads. Claiming a row stamps it, so other
+// instances skip it; a stamp older than twice the timeout is an instance that died
+// mid-verdict, and the row is taken again
+func moderatePendingUploads(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE uploads SET moderation_started_at = now()
+		WHERE key IN (
+			SELECT key FROM uploads
+			WHERE moderation = 'pending'
+			  AND (moderation_started_at IS NULL OR moderation_started_at < now() - make_interval(secs => $1))
+			ORDER BY created_at LIMIT 10
+			FOR UPDATE SKIP LOCKED)
+		RETURNING key, user_id, content_type, bytes`, 2*imageModerationTimeout.Seconds())
+	if err != nil {
+		log.Printf("❌ Failed to claim uploads for moderation: %v", err)
+		return
+	}
+	type pending struct {
+		key, userID, contentType string
+		bytes                    int64
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.key, &p.userID, &p.contentType, &p.bytes); err == nil {
+			list = append(list, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range list {
+		data, err := storage.Get(ctx, p.key)
+		if err != nil {
+			log.Printf("⚠️ Failed to load upload %s for moderation, will retry: %v", p.key, err)
+			continue
+		}
+		r := moderateImage(ctx, data, p.contentType)
+		if _, err := db.ExecContext(ctx, `
+			UPDATE uploads SET moderation = $2, category = nullif($3, ''), moderation_error = nullif($4, ''),
+			                   moderated_at = $5, stored = $6
+			WHERE key = $1 AND moderation = 'pending'`,
+			p.key, r.State, r.Category, r.Error, clock.Now(), r.usable()); err != nil {
+			log.Printf("❌ Failed to record moderation of %s: %v", p.key, err)
+			continue
+		}
+		if !r.usable() {
+			// Don't keep what we refused; the row stays as the record
+			if err := storage.Delete(ctx, p.key); err != nil {
+				log.Printf("⚠️ Failed to delete refused upload %s: %v", p.key, err)
+			} else {
+				addUserStorage(ctx, p.userID, -p.bytes)
+			}
+			log.Printf("🚫 Upload %s refused by moderation (%s)", p.key, r.rejectionCategory())
+		}
+	}
+}
+
+// settleHeldGenerations moves held generations on once their input has a verdict: a
+// usable image lets them on to the deferred scheduler, which runs admission as for any
+// deferred request; anything else fails them with a refund. Working from the table
+// rather than from each verdict also covers a generation held just as its verdict landed
+func settleHeldGenerations(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT g.request_id, g.user_id, u.moderation, coalesce(u.category, '')
+		FROM generated_content g JOIN uploads u ON u.key = g.input_key
+		WHERE g.status = 'pending_moderation' AND u.moderation <> 'pending'
+		LIMIT 100`)
+	if err != nil {
+		log.Printf("❌ Failed to load generations held for moderation: %v", err)
+		return
+	}
+	type held struct {
+		requestID, userID string
+		verdict           moderationResult
+	}
+	var list []held
+	for rows.Next() {
+		var h held
+		if err := rows.Scan(&h.requestID, &h.userID, &h.verdict.State, &h.verdict.Category); err == nil {
+			list = append(list, h)
+		}
+	}
+	rows.Close()
+
+	for _, h := range list {
+		if h.verdict.usable() {
+			if _, err := transitionGeneration(ctx, h.requestID, generationWrite{
+				Writer: "moderation", To: "deferred", From: []string{generationPendingModeration},
+				Set: "deferred_until = $4", Args: []interface{}{clock.Now()},
+			}); err != nil {
+				log.Printf("❌ Failed to release generation %s after moderation: %v", h.requestID, err)
+			}
+			continue
+		}
+
+		reason := "input image rejected by moderation: " + h.verdict.rejectionCategory()
+		claimed, err := transitionGeneration(ctx, h.requestID, generationWrite{
+			Writer: "moderation", To: "failed", From: []string{generationPendingModeration},
+			Set: "completed_at = now(), error = $4", Args: []interface{}{reason}, Refund: "input_rejected",
+		})
+		if err != nil {
+			log.Printf("❌ Failed to fail generation %s after moderation: %v", h.requestID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		releaseAdmission(ctx, h.userID, h.requestID)
+		broadcastEvent(ctx, Event{Type: eventFailed, RequestID: h.requestID, UserID: h.userID,
+			Data: map[string]interface{}{"error": reason, "category": h.verdict.rejectionCategory()}})
+	}
+}
@@ -0,0 +1,85 @@
+// notification_batches.go
+// Collapsing completion notifications that arrive together. Pushes and emails for
+// completions and failures aren't sent at once: each is held for up to
+// NOTIFY_BATCH_WINDOW in a group keyed by the user, the channel and the request's
+// batch_id (requests without one share a group). The first notification opens the group
+// and fixes its release time, the ones arriving before then join it, and the delivery
+// worker releases it as one "batch" notification ("4 of your images are ready", failures
+// counted in the same message) with a link to the batch view. So no notification is held
+// longer than the window, and a batch finishing across the boundary goes out as two
+// messages. A group of one goes out as the notification itself. Quiet hours take
+// precedence: a notification held for them waits in the digest instead
+
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const batchDigestPrefix = "batch:"
+
+var (
+	notifyBatchWindow = getEnvDuration("NOTIFY_BATCH_WINDOW", 30*time.Second) // 0 sends every notification on its own
+	// Where the batch link points; the batch_id is appended
+	batchLinkBaseURL = getEnv("BATCH_LINK_BASE_URL", "mobart://generations?batch_id=")
+
+	batchIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// validBatchID reports whether a client-chosen batch_id is acceptable; empty is no batch
+func validBatchID(id string) bool {
+	return id == "" || batchIDPattern.MatchString(id)
+}
+
+// batchChannel reports whether a personal channel of this kind gets batched
+func batchChannel(kind string) bool {
+	return kind == "fcm" || kind == "email"
+}
+
+// batchHold is the hold that puts n into its batch group for channelID at now, or the zero
+// value when n is sent on its own
+func batchHold(n Notification, channelID string, now time.Time) heldDelivery {
+	if notifyBatchWindow <= 0 || (n.Status != "completed" && n.Status != "failed") {
+		return heldDelivery{}
+	}
+	return heldDelivery{
+		until:     now.Add(notifyBatchWindow),
+		digestKey: batchDigestPrefix + n.UserID + ":" + channelID + ":" + n.BatchID,
+		join:      true,
+	}
+}
+
+// batchNotification collapses a released group into one; a single one goes out as is
+func batchNotification(items []Notification) Notification {
+	if len(items) == 1 {
+		return items[0]
+	}
+	lines := make([]string, len(items))
+	for i, n := range items {
+		lines[i] = n.Prompt
+		if n.Status == "failed" && n.Error != "" {
+			lines[i] += " (" + n.Error + ")"
+		}
+	}
+	b := Notification{UserID: items[0].UserID, Status: "batch", Prompt: strings.Join(lines, "\n"), Batch: items,
+		Locale: items[0].Locale, BatchID: items[0].BatchID}
+	if b.BatchID != "" {
+		b.BatchLink = batchLinkBaseURL + url.QueryEscape(b.BatchID)
+	}
+	return b
+}
+
+// batchCounts is how many of a batch notification's items completed and failed
+func batchCounts(n Notification) (completed, failed int) {
+	for _, item := range n.Batch {
+		if item.Status == "failed" {
+			failed++
+		} else {
+			completed++
+		}
+	}
+	return completed, failed
+}
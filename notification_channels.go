@@ -0,0 +1,222 @@
+// notification_channels.go
+// Per-user and per-organization notification targets: Slack/Discord/generic webhooks,
+// FCM device tokens and email addresses
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var webhookPrefixes = map[string][]string{
+	"slack":   {"https://hooks.slack.com/"},
+	"discord": {"https://discord.com/api/webhooks/", "https://discordapp.com/api/webhooks/"},
+	"webhook": {"https://"},
+}
+
+// NotificationChannel is a configured target; the target itself is never returned
+type NotificationChannel struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	OrgID     string    `json:"org_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	webhookURL string
+}
+
+// validChannelTarget checks the target suits kind: a webhook URL, an address or a token
+func validChannelTarget(kind, target string) bool {
+	switch kind {
+	case "email":
+		addr, err := mail.ParseAddress(target)
+		return err == nil && addr.Address == target
+	case "fcm":
+		return target != "" && !strings.ContainsAny(target, " \t\r\n")
+	}
+	for _, prefix := range webhookPrefixes[kind] {
+		if strings.HasPrefix(target, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadNotificationChannels returns the user's own channels plus the org's, decrypted
+func loadNotificationChannels(ctx context.Context, userID, orgID string) ([]NotificationChannel, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, kind, coalesce(org_id::text, ''), webhook_url_enc, created_at
+		FROM notification_channels
+		WHERE (user_id = $1 AND org_id IS NULL) OR ($2 <> '' AND org_id::text = $2)`, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []NotificationChannel
+	for rows.Next() {
+		var ch NotificationChannel
+		var enc string
+		if err := rows.Scan(&ch.ID, &ch.Kind, &ch.OrgID, &enc, &ch.CreatedAt); err != nil {
+			return nil, err
+		}
+		if ch.webhookURL, err = decryptSecret(enc); err != nil {
+			log.Printf("⚠️ Skipping notification channel %s: %v", ch.ID, err)
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+// channelOwnerAllowed checks the caller may manage channels for orgID ("" = personal)
+func channelOwnerAllowed(c *gin.Context, orgID string) bool {
+	if orgID == "" {
+		return true
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+	role, err := orgRole(c.Request.Context(), orgID, user.ID.String())
+	return err == nil && role == orgRoleOwner
+}
+
+// upsertNotificationChannelHandler handles PUT /notifications/channels
+func upsertNotificationChannelHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Kind       string `json:"kind"`
+		WebhookURL string `json:"webhook_url"`
+		Target     string `json:"target"` // email address or FCM token; webhook_url for webhooks
+		OrgID      string `json:"org_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if _, ok := notifiers[body.Kind]; !ok {
+		fieldError(c, codeValidationFailed, "kind", "must be slack, discord, webhook, fcm or email")
+		return
+	}
+	field := "webhook_url"
+	if body.Target != "" {
+		field, body.WebhookURL = "target", body.Target
+	}
+	if !validChannelTarget(body.Kind, body.WebhookURL) {
+		fieldError(c, codeValidationFailed, field, "not a valid "+body.Kind+" target")
+		return
+	}
+	if body.Kind == "webhook" {
+		if err := checkWebhookHost(c.Request.Context(), body.WebhookURL); err != nil {
+			fieldError(c, codeValidationFailed, field, "must resolve to a public address")
+			return
+		}
+	}
+	if !channelOwnerAllowed(c, body.OrgID) {
+		respondError(c, codeNotOwner, "Only organization owners can configure org channels")
+		return
+	}
+
+	enc, err := encryptSecret(body.WebhookURL)
+	if err != nil {
+		log.Printf("❌ Failed to encrypt webhook URL: %v", err)
+		respondError(c, codeUnavailable, "Notification channels are not available")
+		return
+	}
+
+	ch := NotificationChannel{Kind: body.Kind, OrgID: body.OrgID}
+	err = db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO notification_channels (user_id, org_id, kind, webhook_url_enc)
+		VALUES ($1, nullif($2, '')::uuid, $3, $4)
+		ON CONFLICT (owner_key, kind) DO UPDATE SET webhook_url_enc = EXCLUDED.webhook_url_enc
+		RETURNING id, created_at`, user.ID.String(), body.OrgID, body.Kind, enc).Scan(&ch.ID, &ch.CreatedAt)
+	if err != nil {
+		log.Printf("❌ Failed to save notification channel: %v", err)
+		respondError(c, codeInternal, "Failed to save notification channel")
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// listNotificationChannelsHandler handles GET /notifications/channels
+func listNotificationChannelsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	if !channelOwnerAllowed(c, c.Query("org_id")) {
+		respondError(c, codeNotOwner, "Only organization owners can view org channels")
+		return
+	}
+	channels, err := loadNotificationChannels(c.Request.Context(), user.ID.String(), c.Query("org_id"))
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load notification channels")
+		return
+	}
+	if channels == nil {
+		channels = []NotificationChannel{}
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels})
+}
+
+// findManageableChannel loads :id if the caller owns it personally or owns its org
+func findManageableChannel(c *gin.Context) (*NotificationChannel, bool) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var ch NotificationChannel
+	var ownerID, enc string
+	err := db.QueryRowContext(c.Request.Context(), `
+		SELECT id, kind, coalesce(org_id::text, ''), user_id, webhook_url_enc, created_at
+		FROM notification_channels WHERE id = $1`, c.Param("id")).
+		Scan(&ch.ID, &ch.Kind, &ch.OrgID, &ownerID, &enc, &ch.CreatedAt)
+	if err == sql.ErrNoRows || (err == nil && ch.OrgID == "" && ownerID != user.ID.String()) ||
+		(err == nil && !channelOwnerAllowed(c, ch.OrgID)) {
+		respondError(c, codeNotFound, "Notification channel not found")
+		return nil, false
+	}
+	if err == nil {
+		ch.webhookURL, err = decryptSecret(enc)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load notification channel %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load notification channel")
+		return nil, false
+	}
+	return &ch, true
+}
+
+// deleteNotificationChannelHandler handles DELETE /notifications/channels/:id
+func deleteNotificationChannelHandler(c *gin.Context) {
+	ch, ok := findManageableChannel(c)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(c.Request.Context(), `DELETE FROM notification_channels WHERE id = $1`, ch.ID); err != nil {
+		respondError(c, codeInternal, "Failed to delete notification channel")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// testNotificationChannelHandler handles POST /notifications/channels/:id/test.
+// It sends synchronously so the user sees whether their webhook actually works.
+func testNotificationChannelHandler(c *gin.Context) {
+	ch, ok := findManageableChannel(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+	locale := requestLocale(c)
+	err := notifiers[ch.Kind].Send(c.Request.Context(), ch.webhookURL, Notification{
+		UserID: user.ID.String(),
+		Status: "test",
+		Prompt: translate(locale, "notification", "If you can read this, completions will show up here.", nil),
+		Locale: locale,
+	})
+	if err != nil {
+		respondError(c, codeUpstreamFailed, "Test delivery failed: "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"delivered": true})
+}
@@ -0,0 +1,444 @@
+// notification_preferences.go
+// Per-user notification preferences: a matrix of event type × channel type, and quiet
+// hours during which everything but in-app events is held by the delivery queue and
+// released, optionally as one digest per channel, once they end
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // timezone validation must not depend on the host's zoneinfo
+
+	"github.com/gin-gonic/gin"
+)
+
+// Matrix settings. urgent is only accepted for failures and sends them through quiet hours
+const (
+	prefOn     = "on"
+	prefOff    = "off"
+	prefUrgent = "urgent"
+)
+
+// Per-request notify modes, the notify field of a submission. all leaves every delivery to
+// the preferences; failures_only and none narrow them for that request, on every channel
+const (
+	notifyAll          = "all"
+	notifyFailuresOnly = "failures_only"
+	notifyNone         = "none"
+)
+
+var (
+	notificationEvents       = []string{"completed", "failed", "late_result", "expiring", "budget"}
+	notificationChannelTypes = []string{"push", "email", "webhook", "in_app"}
+
+	// Fan-out reads preferences through a cache this fresh, instead of a query per event
+	notifyPrefsCacheTTL = getEnvDuration("NOTIFY_PREFS_CACHE_TTL", 30*time.Second)
+)
+
+// notificationChannelType is the preference column a configured channel falls under
+func notificationChannelType(kind string) string {
+	switch kind {
+	case "fcm":
+		return "push"
+	case "email":
+		return "email"
+	}
+	return "webhook" // slack, discord and generic webhooks
+}
+
+// QuietHours is a daily window, in the user's timezone; End before Start spans midnight
+type QuietHours struct {
+	Start    string `json:"start"` // "22:00"
+	End      string `json:"end"`   // "07:30"
+	Timezone string `json:"timezone"`
+	Digest   bool   `json:"digest"` // release what was held as one message per channel
+
+	loc        *time.Location
+	start, end int // minutes after midnight
+}
+
+func (q *QuietHours) parse() (field, msg string) {
+	loc, err := time.LoadLocation(q.Timezone)
+	if q.Timezone == "" || q.Timezone == "Local" || err != nil {
+		return "quiet_hours.timezone", "must be an IANA timezone name such as Europe/Berlin"
+	}
+	minutes := func(s string) (int, bool) {
+		t, err := time.Parse("15:04", s)
+		return t.Hour()*60 + t.Minute(), err == nil
+	}
+	var ok bool
+	if q.start, ok = minutes(q.Start); !ok {
+		return "quiet_hours.start", "must be HH:MM"
+	}
+	if q.end, ok = minutes(q.End); !ok {
+		return "quiet_hours.end", "must be HH:MM"
+	}
+	if q.start == q.end {
+		return "quiet_hours.end", "must differ from start"
+	}
+	q.loc = loc
+	return "", ""
+}
+
+// heldUntil is when the quiet hours around now end, or zero outside them
+func (q *QuietHours) heldUntil(now time.Time) time.Time {
+	if q == nil || q.loc == nil {
+		return time.Time{}
+	}
+	local := now.In(q.loc)
+	m := local.Hour()*60 + local.Minute()
+	quiet := q.start <= m && m < q.end
+	if q.start > q.end {
+		quiet = m >= q.start || m < q.end
+	}
+	if !quiet {
+		return time.Time{}
+	}
+	end := time.Date(local.Year(), local.Month(), local.Day(), q.end/60, q.end%60, 0, 0, q.loc)
+	if !end.After(local) {
+		end = time.Date(local.Year(), local.Month(), local.Day()+1, q.end/60, q.end%60, 0, 0, q.loc)
+	}
+	return end
+}
+
+// NotificationPreferences is what GET/PUT /notifications/preferences exchange. Events
+// missing from the matrix are on, so a user without preferences gets everything
+type NotificationPreferences struct {
+	Events     map[string]map[string]string `json:"events"` // event -> channel type -> on/off/urgent
+	QuietHours *QuietHours                  `json:"quiet_hours"`
+	Locale     string                       `json:"locale"` // notification language; Accept-Language when not sent
+	UpdatedAt  *time.Time                   `json:"updated_at,omitempty"`
+}
+
+// locale is what notifications to the user are written in
+func (p *NotificationPreferences) locale() string {
+	if p == nil || p.Locale == "" {
+		return sourceLocale
+	}
+	return p.Locale
+}
+
+// notifyMode validates a submission's notify field; empty is all
+func notifyMode(mode string) (string, bool) {
+	switch mode {
+	case "":
+		return notifyAll, true
+	case notifyAll, notifyFailuresOnly, notifyNone:
+		return mode, true
+	}
+	return mode, false
+}
+
+// requestNotifyAllows reports whether a request's notify mode lets a notification with
+// status through. Digests and tests aren't about one request and have no mode
+func requestNotifyAllows(mode, status string) bool {
+	switch mode {
+	case notifyNone:
+		return false
+	case notifyFailuresOnly:
+		return status == "failed"
+	}
+	return true
+}
+
+func (p *NotificationPreferences) setting(event, channelType string) string {
+	if p == nil {
+		return prefOn
+	}
+	if s, ok := p.Events[event][channelType]; ok {
+		return s
+	}
+	return prefOn
+}
+
+// holdUntil is when a delivery of event on channelType may go out, or zero for now
+func (p *NotificationPreferences) holdUntil(event, channelType string, now time.Time) time.Time {
+	if p == nil || p.setting(event, channelType) == prefUrgent {
+		return time.Time{}
+	}
+	return p.QuietHours.heldUntil(now)
+}
+
+func (p *NotificationPreferences) validate() (field, msg string) {
+	if p.Events == nil {
+		p.Events = map[string]map[string]string{}
+	}
+	for event, row := range p.Events {
+		if !containsString(notificationEvents, event) {
+			return "events", "unknown event type " + strconv.Quote(event)
+		}
+		for channelType, s := range row {
+			name := "events." + event + "." + channelType
+			if !containsString(notificationChannelTypes, channelType) {
+				return name, "channel type must be push, email, webhook or in_app"
+			}
+			switch {
+			case s == prefUrgent && event != "failed":
+				return name, "only failures can be urgent"
+			case s == prefUrgent && channelType == "in_app":
+				return name, "in-app events are never held, so can't be urgent"
+			case s != prefOn && s != prefOff && s != prefUrgent:
+				return name, "must be on, off or urgent"
+			}
+		}
+	}
+	if !supportedLocale(p.Locale) {
+		return "locale", "must be one of " + strings.Join(supportedLocales(), ", ")
+	}
+	if p.QuietHours != nil {
+		return p.QuietHours.parse()
+	}
+	return "", ""
+}
+
+func loadNotificationPreferences(ctx context.Context, userID string) (*NotificationPreferences, error) {
+	var events, quiet []byte
+	var locale string
+	var updatedAt time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT events, quiet_hours, locale, updated_at FROM notification_preferences WHERE user_id = $1`,
+		userID).Scan(&events, &quiet, &locale, &updatedAt)
+	if err == sql.ErrNoRows {
+		return &NotificationPreferences{Events: map[string]map[string]string{}, Locale: sourceLocale}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &NotificationPreferences{Locale: locale, UpdatedAt: &updatedAt}
+	if err := json.Unmarshal(events, &p.Events); err != nil {
+		return nil, err
+	}
+	if quiet != nil {
+		if err := json.Unmarshal(quiet, &p.QuietHours); err != nil {
+			return nil, err
+		}
+		if field, msg := p.QuietHours.parse(); field != "" {
+			log.Printf("⚠️ Ignoring stored quiet hours of %s: %s %s", userID, field, msg)
+			p.QuietHours = nil
+		}
+	}
+	return p, nil
+}
+
+// notificationPrefsCache holds each user's preferences for NOTIFY_PREFS_CACHE_TTL; a
+// change made on another instance shows up here within that
+var notificationPrefsCache = struct {
+	sync.Mutex
+	entries map[string]cachedNotificationPrefs
+}{entries: map[string]cachedNotificationPrefs{}}
+
+type cachedNotificationPrefs struct {
+	prefs   *NotificationPreferences
+	expires time.Time
+}
+
+// notificationPreferencesFor returns the cached preferences of userID. When they can't be
+// loaded it returns nil, which delivers everything rather than lose notifications
+func notificationPreferencesFor(ctx context.Context, userID string) *NotificationPreferences {
+	now := time.Now()
+	notificationPrefsCache.Lock()
+	entry, ok := notificationPrefsCache.entries[userID]
+	notificationPrefsCache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.prefs
+	}
+
+	prefs, err := loadNotificationPreferences(ctx, userID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load notification preferences of %s: %v", userID, err)
+		return nil
+	}
+	notificationPrefsCache.Lock()
+	defer notificationPrefsCache.Unlock()
+	if len(notificationPrefsCache.entries) > 10000 {
+		for id, e := range notificationPrefsCache.entries {
+			if now.After(e.expires) {
+				delete(notificationPrefsCache.entries, id)
+			}
+		}
+	}
+	notificationPrefsCache.entries[userID] = cachedNotificationPrefs{prefs: prefs, expires: now.Add(notifyPrefsCacheTTL)}
+	return prefs
+}
+
+func forgetNotificationPreferences(userID string) {
+	notificationPrefsCache.Lock()
+	delete(notificationPrefsCache.entries, userID)
+	notificationPrefsCache.Unlock()
+}
+
+// inAppEvent marks e silent when its owner turned in-app alerts for its type off;
+// clients still update their state from it, they just don't alert
+func inAppEvent(ctx context.Context, e Event) Event {
+	if notificationPreferencesFor(ctx, e.UserID).setting(e.Type, "in_app") == prefOff {
+		e.Silent = true
+	}
+	return e
+}
+
+// getNotificationPreferencesHandler handles GET /notifications/preferences
+func getNotificationPreferencesHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	prefs, err := loadNotificationPreferences(c.Request.Context(), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load notification preferences: %v", err)
+		respondError(c, codeInternal, "Failed to load notification preferences")
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+// putNotificationPreferencesHandler handles PUT /notifications/preferences, replacing the
+// matrix and quiet hours; "quiet_hours": null turns quiet hours off
+func putNotificationPreferencesHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var prefs NotificationPreferences
+	if err := c.ShouldBindJSON(&prefs); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if prefs.Locale == "" {
+		prefs.Locale = requestLocale(c)
+	}
+	if field, msg := prefs.validate(); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+
+	events, _ := json.Marshal(prefs.Events)
+	var quiet []byte
+	if prefs.QuietHours != nil {
+		quiet, _ = json.Marshal(prefs.QuietHours)
+	}
+	var updatedAt time.Time
+	err := db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO notification_preferences (user_id, events, quiet_hours, locale) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET events = EXCLUDED.events, quiet_hours = EXCLUDED.quiet_hours,
+		    locale = EXCLUDED.locale, updated_at = now()
+		RETURNING updated_at`, user.ID.String(), events, quiet, prefs.Locale).Scan(&updatedAt)
+	if err != nil {
+		log.Printf("❌ Failed to save notification preferences: %v", err)
+		respondError(c, codeInternal, "Failed to save notification preferences")
+		return
+	}
+	forgetNotificationPreferences(user.ID.String())
+	prefs.UpdatedAt = &updatedAt
+	c.JSON(http.StatusOK, prefs)
+}
+
+// releaseHeldDeliveries makes deliveries whose quiet hours are over due. Rows held for a
+// digest are collapsed into one delivery per channel instead
+func releaseHeldDeliveries(ctx context.Context) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE notification_deliveries SET status = 'pending'
+		WHERE status = 'held' AND digest_key IS NULL AND next_attempt_at <= now()`)
+	if err != nil {
+		log.Printf("❌ Failed to release held deliveries: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("🌅 Released %d deliveries held for quiet hours", n)
+	}
+	if err := releaseDigests(ctx); err != nil {
+		log.Printf("❌ Failed to release notification digests: %v", err)
+	}
+}
+
+type heldDigest struct {
+	targetType, targetEnc, firstID string
+	items                          []Notification
+}
+
+// releaseDigests marks the due digest and batch rows digested and queues one delivery per
+// digest key in their place, in one transaction so nothing is lost or sent twice
+func releaseDigests(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE notification_deliveries SET status = 'digested', finished_at = now()
+		WHERE id IN (
+			SELECT id FROM notification_deliveries
+			WHERE status = 'held' AND digest_key IS NOT NULL AND next_attempt_at <= $1
+			ORDER BY id LIMIT 1000
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, digest_key, target_type, target_enc, payload`, clock.Now())
+	if err != nil {
+		return err
+	}
+	digests := map[string]*heldDigest{}
+	var order []string
+	for rows.Next() {
+		var id, key, targetType, enc string
+		var payload []byte
+		var n Notification
+		if err := rows.Scan(&id, &key, &targetType, &enc, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		if unmarshalDeliveryPayload(payload, &n) != nil {
+			continue
+		}
+		d, ok := digests[key]
+		if !ok {
+			d = &heldDigest{targetType: targetType, targetEnc: enc, firstID: id}
+			digests[key] = d
+			order = append(order, key)
+		}
+		d.items = append(d.items, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range order {
+		d := digests[key]
+		collapse := digestNotification
+		if strings.HasPrefix(key, batchDigestPrefix) {
+			collapse = batchNotification
+		}
+		payload, err := marshalDeliveryPayload(collapse(d.items))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notification_deliveries (target_type, target_enc, payload, dedupe_key)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (dedupe_key) DO NOTHING`,
+			d.targetType, d.targetEnc, payload, "digest:"+key+":"+d.firstID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(order) > 0 {
+		log.Printf("📬 Released %d notification digests and batches", len(order))
+	}
+	return nil
+}
+
+// digestNotification collapses held notifications into one; a single one goes out as is
+func digestNotification(items []Notification) Notification {
+	if len(items) == 1 {
+		return items[0]
+	}
+	lines := make([]string, len(items))
+	for i, n := range items {
+		lines[i] = notificationTitle(n) + ": " + n.Prompt
+	}
+	return Notification{UserID: items[0].UserID, Status: "digest", Prompt: strings.Join(lines, "\n"), Digest: items,
+		Locale: items[0].Locale}
+}
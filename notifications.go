@@ -0,0 +1,422 @@
+// notifications.go
+// Completion notifications and the notifiers that send them to Slack, Discord, generic
+// webhooks, FCM and email; delivery itself goes through the persistent queue in deliveries.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Notification is what a channel gets told about a finished generation
+type Notification struct {
+	RequestID string `json:"request_id"`
+	UserID    string `json:"user_id"`
+	Status    string `json:"status"` // "completed", "failed", "late_result", "expiring", "budget", "batch", "digest" or "test"; webhooks also get "processing" and "progress"
+	Prompt    string `json:"prompt"`
+	ImageURL  string `json:"image_url,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"` // worker failures only (worker_errors.go)
+	DeepLink  string `json:"deep_link,omitempty"`  // signed token for the owner's app, see deeplinks.go
+
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"` // with status "expiring"
+	Budget    *BudgetAlert `json:"budget,omitempty"`     // with status "budget", which has no request (budgets.go)
+
+	BatchID   string         `json:"batch_id,omitempty"`   // the request's batch, see notification_batches.go
+	Batch     []Notification `json:"batch,omitempty"`      // with status "batch": what arrived within the window, oldest first
+	BatchLink string         `json:"batch_link,omitempty"` // with status "batch", to the batch view
+
+	Digest []Notification `json:"digest,omitempty"` // with status "digest": what quiet hours held, oldest first
+	Locale string         `json:"locale,omitempty"` // of the recipient, for the title; English when empty
+
+	// EventID is the same on every redelivery. To a generic webhook, a request's events
+	// are sent one at a time in Sequence order, which only increases (webhook_events.go)
+	EventID  string `json:"event_id,omitempty"`
+	Sequence int64  `json:"sequence,omitempty"`
+	Progress int    `json:"progress,omitempty"` // with status "progress": the milestone reached, 25 to 100
+
+	Notify string `json:"-"` // the request's notify mode; see requestNotifyAllows
+}
+
+// Notifier delivers a notification to one target (e.g. a webhook URL)
+type Notifier interface {
+	Name() string
+	Send(ctx context.Context, target string, n Notification) error
+}
+
+// retryAfterError is returned when the remote asked us to back off
+type retryAfterError struct {
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.delay)
+}
+
+// errNotifierUnconfigured means retrying can't help; such deliveries dead-letter at once
+var errNotifierUnconfigured = errors.New("notifier is not configured")
+
+var notifiers = map[string]Notifier{
+	"slack":   slackNotifier{},
+	"discord": discordNotifier{},
+	"webhook": webhookNotifier{},
+	"fcm":     fcmNotifier{},
+	"email":   emailNotifier{},
+}
+
+var (
+	notifyMaxAttempts = getEnvInt("NOTIFY_MAX_ATTEMPTS", 5)
+	notifyImageURLTTL = getEnvDuration("NOTIFY_IMAGE_URL_TTL", 24*time.Hour)
+	notifyHTTPClient  = newNotifyHTTPClient() // see webhook_targets.go
+
+	notificationsSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_notifications_suppressed_total",
+		Help: "Notifications not sent because of their request's notify mode, by mode and status.",
+	}, []string{"mode", "status"})
+	notificationDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_notification_deliveries_total",
+		Help: "Notification delivery attempts, by channel kind and result (ok, retry, rate_limited, failed).",
+	}, []string{"kind", "result"})
+)
+
+var (
+	fcmProjectID   = getEnv("FCM_PROJECT_ID", "")
+	fcmAccessToken = getEnv("FCM_ACCESS_TOKEN", "") // OAuth token for the FCM HTTP v1 API
+	fcmDisabled    bool                             // by the startup checks, when FCM is unreachable
+
+	smtpAddr     = getEnv("SMTP_ADDR", "") // host:port
+	smtpFrom     = getEnv("SMTP_FROM", "")
+	smtpUsername = getEnv("SMTP_USERNAME", "")
+	smtpPassword = getEnv("SMTP_PASSWORD", "")
+)
+
+// postWebhook posts JSON and turns 429s into retryAfterError
+func postWebhook(ctx context.Context, url string, body interface{}) error {
+	return postWebhookAuth(ctx, url, "", body)
+}
+
+func postWebhookAuth(ctx context.Context, url, bearer string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := notifyHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay := time.Second
+		if secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+			delay = time.Duration(secs * float64(time.Second))
+		}
+		return &retryAfterError{delay: delay}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notificationTitle is the headline every notifier leads with, in the recipient's locale
+func notificationTitle(n Notification) string {
+	t := func(template string, params map[string]interface{}) string {
+		return translate(n.Locale, "notification", template, params)
+	}
+	switch n.Status {
+	case "completed":
+		return t("🎨 Your image is ready", nil)
+	case "failed":
+		return t("❌ Image generation failed", nil)
+	case "late_result":
+		return t("⌛ Your timed-out image finished after all, claim it to keep it", nil)
+	case "expiring":
+		return t("⏳ Your image will be deleted on {date}, download it to keep it",
+			map[string]interface{}{"date": localeDate(*n.ExpiresAt)})
+	case "budget":
+		if n.Budget != nil && n.Budget.OrgID != "" {
+			return t("💸 Your organization reached a budget alert", nil)
+		}
+		return t("💸 You've reached a budget alert", nil)
+	case "batch":
+		completed, failed := batchCounts(n)
+		switch {
+		case failed == 0:
+			return t("🎨 {count} of your images are ready", map[string]interface{}{"count": completed})
+		case completed == 0:
+			return t("❌ {count} of your generations failed", map[string]interface{}{"count": failed})
+		}
+		return t("🎨 {count} of your images are ready, {failed} failed", map[string]interface{}{"count": completed, "failed": failed})
+	case "digest":
+		return t("📬 {count} updates from your quiet hours", map[string]interface{}{"count": len(n.Digest)})
+	default:
+		return t("👋 Test notification from mobart", nil)
+	}
+}
+
+// slackNotifier posts a Block Kit message to an incoming webhook
+type slackNotifier struct{}
+
+func (slackNotifier) Name() string { return "slack" }
+
+func (slackNotifier) Send(ctx context.Context, url string, n Notification) error {
+	blocks := []map[string]interface{}{
+		{"type": "section", "text": map[string]string{
+			"type": "mrkdwn",
+			"text": fmt.Sprintf("*%s*\n>%s", notificationTitle(n), n.Prompt),
+		}},
+	}
+	if n.ImageURL != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "image", "image_url": n.ImageURL, "alt_text": n.Prompt,
+		})
+	}
+	if n.Error != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "context", "elements": []map[string]string{{"type": "mrkdwn", "text": n.Error}},
+		})
+	}
+	return postWebhook(ctx, url, map[string]interface{}{"text": notificationTitle(n), "blocks": blocks})
+}
+
+// discordNotifier posts an embed to a Discord webhook
+type discordNotifier struct{}
+
+func (discordNotifier) Name() string { return "discord" }
+
+func (discordNotifier) Send(ctx context.Context, url string, n Notification) error {
+	embed := map[string]interface{}{
+		"title":       notificationTitle(n),
+		"description": n.Prompt,
+		"footer":      map[string]string{"text": n.RequestID},
+	}
+	if n.ImageURL != "" {
+		embed["image"] = map[string]string{"url": n.ImageURL}
+	}
+	if n.Error != "" {
+		embed["fields"] = []map[string]string{{"name": "Error", "value": n.Error}}
+	}
+	return postWebhook(ctx, url, map[string]interface{}{"embeds": []interface{}{embed}})
+}
+
+// webhookNotifier posts the Notification itself to any HTTPS endpoint
+type webhookNotifier struct{}
+
+func (webhookNotifier) Name() string { return "webhook" }
+
+func (webhookNotifier) Send(ctx context.Context, url string, n Notification) error {
+	n.DeepLink = ""
+	return postWebhook(ctx, url, n)
+}
+
+// fcmNotifier pushes to one device registration token through the FCM HTTP v1 API
+type fcmNotifier struct{}
+
+func (fcmNotifier) Name() string { return "fcm" }
+
+func (fcmNotifier) Send(ctx context.Context, token string, n Notification) error {
+	if fcmProjectID == "" || fcmAccessToken == "" || fcmDisabled {
+		return errNotifierUnconfigured
+	}
+	notification := map[string]string{"title": notificationTitle(n), "body": n.Prompt}
+	if n.ImageURL != "" {
+		notification["image"] = n.ImageURL
+	}
+	data := map[string]string{"request_id": n.RequestID, "status": n.Status}
+	if n.DeepLink != "" {
+		data["deep_link"] = n.DeepLink
+	}
+	if n.BatchLink != "" {
+		data["batch_id"], data["batch_link"] = n.BatchID, n.BatchLink
+	}
+	return postWebhookAuth(ctx, "https://fcm.googleapis.com/v1/projects/"+fcmProjectID+"/messages:send",
+		fcmAccessToken, map[string]interface{}{"message": map[string]interface{}{
+			"token":        token,
+			"notification": notification,
+			"data":         data,
+		}})
+}
+
+// emailNotifier sends a plain-text message over SMTP
+type emailNotifier struct{}
+
+func (emailNotifier) Name() string { return "email" }
+
+func (emailNotifier) Send(ctx context.Context, to string, n Notification) error {
+	if smtpAddr == "" || smtpFrom == "" {
+		return errNotifierUnconfigured
+	}
+	body := n.Prompt
+	if n.ImageURL != "" {
+		body += "\n\n" + n.ImageURL
+	}
+	if n.DeepLink != "" {
+		body += "\n\n" + deepLinkBaseURL + n.DeepLink
+	}
+	if n.BatchLink != "" {
+		body += "\n\n" + n.BatchLink
+	}
+	if n.Error != "" {
+		body += "\n\n" + n.Error
+	}
+	msg := "From: " + smtpFrom + "\r\nTo: " + to + "\r\nSubject: " + mime.QEncoding.Encode("utf-8", notificationTitle(n)) +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + body + "\r\n"
+
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host, _, _ := net.SplitHostPort(smtpAddr)
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+	// net/smtp has no context support; the delivery timeout bounds the caller instead
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, []string{to}, []byte(msg))
+}
+
+// notifyCompletion fans a finished generation out to the owner's (and org's) channels,
+// queueing the deliveries on q
+func notifyCompletion(ctx context.Context, q execer, requestID string) {
+	n, orgID, err := loadNotification(ctx, requestID)
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s for notification: %v", requestID, err)
+		return
+	}
+	// e.g. a failure reported for a row that already timed out
+	if n.Status != "completed" && n.Status != "failed" {
+		return
+	}
+	fanOutNotification(ctx, q, n, orgID)
+}
+
+// notifyExpiring warns that a generation is about to be removed by the retention job
+func notifyExpiring(ctx context.Context, requestID string, expiresAt time.Time) error {
+	n, orgID, err := loadNotification(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	n.Status = "expiring"
+	n.ExpiresAt = &expiresAt
+	fanOutNotification(ctx, db, n, orgID)
+	return nil
+}
+
+// loadNotification builds the notification for a row, presigning its preview
+func loadNotification(ctx context.Context, requestID string) (Notification, string, error) {
+	var n Notification
+	var s3Key, posterKey, orgID string
+	err := db.QueryRowContext(ctx, `
+		SELECT request_id, user_id, status, coalesce(nullif(original_prompt, ''), prompt), content_url, error,
+		       coalesce(error_code, ''), coalesce(org_id::text, ''), coalesce(poster_key, ''), notify, coalesce(batch_id, '')
+		FROM generated_content WHERE request_id = $1`, requestID).
+		Scan(&n.RequestID, &n.UserID, &n.Status, &n.Prompt, &s3Key, &n.Error, &n.ErrorCode, &orgID, &posterKey, &n.Notify,
+			&n.BatchID)
+	if err != nil {
+		return n, "", err
+	}
+	if err := decryptPrompts(&n.Prompt); err != nil {
+		return n, "", err
+	}
+	// Chat previews can't render video, so show the poster frame
+	if posterKey != "" {
+		s3Key = posterKey
+	}
+	if n.Status == "completed" && s3Key != "" {
+		if n.ImageURL, err = storage.PresignGet(ctx, s3Key, notifyImageURLTTL); err != nil {
+			log.Printf("⚠️ Failed to presign image for notification %s: %v", requestID, err)
+		}
+	}
+	return n, orgID, nil
+}
+
+// fanOutNotification queues n for every channel. The request's notify mode comes first;
+// then the owner's preferences decide what their personal channels get and when, and org
+// channels get everything. Deliveries are queued on q
+func fanOutNotification(ctx context.Context, q execer, n Notification, orgID string) {
+	if !requestNotifyAllows(n.Notify, n.Status) {
+		notificationsSuppressed.WithLabelValues(n.Notify, n.Status).Inc()
+		return
+	}
+	channels, err := loadNotificationChannels(ctx, n.UserID, orgID)
+	if err != nil {
+		log.Printf("❌ Failed to load notification channels for %s: %v", n.RequestID, err)
+		return
+	}
+	prefs := notificationPreferencesFor(ctx, n.UserID)
+	n.Locale = prefs.locale()
+	if n.ErrorCode != "" {
+		n.Error = translate(n.Locale, "notification", n.Error, nil)
+	}
+	subject := n.RequestID
+	if n.Budget != nil {
+		n.Prompt, subject = n.Budget.summary(n.Locale), n.Budget.dedupeKey()
+	}
+	now := time.Now()
+	// Org channels reach other members, so only the owner's own push and email carry the link
+	var deepLink string
+	if n.Status == "completed" {
+		deepLink = signDeepLink(n.RequestID, n.UserID, now)
+	}
+	for _, ch := range channels {
+		if webhookOnlyEvent(n.Status) && ch.Kind != "webhook" {
+			continue
+		}
+		var held heldDelivery
+		sent := n
+		orderKey := webhookOrderKey(ch.Kind, ch.ID, n)
+		if ch.OrgID == "" {
+			channelType := notificationChannelType(ch.Kind)
+			if prefs.setting(n.Status, channelType) == prefOff {
+				continue
+			}
+			// Ordered events are held whole, since a digest would lose their order
+			if held.until = prefs.holdUntil(n.Status, channelType, now); !held.until.IsZero() && prefs.QuietHours.Digest && orderKey == "" {
+				held.digestKey = n.UserID + ":" + ch.ID
+			} else if held.until.IsZero() && batchChannel(ch.Kind) {
+				held = batchHold(n, ch.ID, now)
+			}
+			if deepLink != "" && deepLinkChannel(ch.Kind) {
+				sent.DeepLink = deepLink
+			}
+		}
+		event := n.Status
+		if n.Status == "progress" {
+			event += ":" + strconv.Itoa(n.Progress)
+		}
+		key := subject + ":" + event + ":" + ch.ID
+		var err error
+		if orderKey != "" {
+			err = enqueueOrderedDelivery(ctx, q, ch.Kind, ch.webhookURL, key, orderKey, sent, held)
+		} else {
+			err = enqueueDelivery(ctx, q, ch.Kind, ch.webhookURL, key, sent, held)
+		}
+		if err != nil {
+			log.Printf("❌ Failed to queue %s notification for %s: %v", ch.Kind, n.RequestID, err)
+			continue
+		}
+		if sent.DeepLink != "" {
+			deepLinksIssued.WithLabelValues(ch.Kind).Inc()
+		}
+	}
+}
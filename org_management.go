@@ -0,0 +1,332 @@
+// org_management.go
+// What organization owners manage beyond invites: seats, member roles, the audit trail of
+// both, and the usage report. Seats are capped by the org's plan (max_seats) and taken
+// when an invite is accepted; removing a member frees theirs at once. Usage stays with
+// whoever ran it: a removed member's past generations and spend remain in the report under
+// their name and are never moved to anyone else
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	orgUsageMonthLayout = "2006-01"
+	orgUsageMaxMonths   = 24
+)
+
+// OrgSeats is how many of an org's seats are taken; Max 0 is unlimited
+type OrgSeats struct {
+	Used int `json:"used"`
+	Max  int `json:"max"`
+}
+
+func (s OrgSeats) full() bool {
+	return s.Max > 0 && s.Used >= s.Max
+}
+
+// loadOrgSeats counts orgID's active members against its plan. Called in a transaction
+// with lock, it holds the org row so concurrent accepts can't both take the last seat
+func loadOrgSeats(ctx context.Context, q rowQuerier, orgID string, lock bool) (OrgSeats, error) {
+	var s OrgSeats
+	var plan, tenant string
+	query := `SELECT plan, tenant_id FROM organizations WHERE id = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	if err := q.QueryRowContext(ctx, query, orgID).Scan(&plan, &tenant); err != nil {
+		return s, err
+	}
+	s.Max = planLimitsFor(tenant, plan).MaxSeats
+	err := q.QueryRowContext(ctx, `
+		SELECT count(*) FROM organization_members WHERE org_id = $1 AND removed_at IS NULL`, orgID).Scan(&s.Used)
+	return s, err
+}
+
+// auditOrg records an owner's action on the org, or a member joining it
+func auditOrg(ctx context.Context, orgID, userID, action, actor string, detail interface{}) {
+	data, _ := json.Marshal(detail)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO org_audit (org_id, user_id, action, actor, detail) VALUES ($1, nullif($2, '')::uuid, $3, $4, $5)`,
+		orgID, userID, action, actor, data); err != nil {
+		log.Printf("⚠️ Failed to audit %s in org %s: %v", action, orgID, err)
+	}
+}
+
+// OrgMember is one row of GET /orgs/:id/members
+type OrgMember struct {
+	UserID   string    `json:"user_id"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// listMembersHandler handles GET /orgs/:id/members, for any member
+func listMembersHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c); !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	seats, err := loadOrgSeats(ctx, db, c.Param("id"), false)
+	if err != nil {
+		log.Printf("❌ Failed to load seats of org %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load members")
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id, role, created_at FROM organization_members
+		WHERE org_id = $1 AND removed_at IS NULL ORDER BY created_at`, c.Param("id"))
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load members")
+		return
+	}
+	defer rows.Close()
+	members := []OrgMember{}
+	for rows.Next() {
+		var m OrgMember
+		if err := rows.Scan(&m.UserID, &m.Role, &m.JoinedAt); err != nil {
+			respondError(c, codeInternal, "Failed to load members")
+			return
+		}
+		members = append(members, m)
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members, "seats": seats})
+}
+
+// setMemberRoleHandler handles PUT /orgs/:id/members/:user_id {"role"}, owners promoting
+// members or demoting other owners. The org's creator always stays an owner, so there is
+// always one
+func setMemberRoleHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return
+	}
+	owner := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || (body.Role != orgRoleOwner && body.Role != orgRoleMember) {
+		fieldError(c, codeValidationFailed, "role", "must be owner or member")
+		return
+	}
+
+	ctx := c.Request.Context()
+	orgID, userID := c.Param("id"), c.Param("user_id")
+	var previous string
+	err := db.QueryRowContext(ctx, `
+		WITH old AS (
+			SELECT m.role FROM organization_members m JOIN organizations o ON o.id = m.org_id
+			WHERE m.org_id = $1 AND m.user_id::text = $2 AND m.removed_at IS NULL AND o.owner_id::text <> $2
+			FOR UPDATE OF m
+		)
+		UPDATE organization_members SET role = $3
+		FROM old WHERE org_id = $1 AND user_id::text = $2
+		RETURNING old.role`, orgID, userID, body.Role).Scan(&previous)
+	if err == sql.ErrNoRows {
+		var creator bool
+		db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM organizations WHERE id = $1 AND owner_id::text = $2)`,
+			orgID, userID).Scan(&creator)
+		if creator {
+			respondError(c, codeConflict, "The organization's creator is always an owner")
+			return
+		}
+		respondError(c, codeNotFound, "Member not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to change role in org %s: %v", orgID, err)
+		respondError(c, codeInternal, "Failed to change role")
+		return
+	}
+	if previous != body.Role {
+		auditOrg(ctx, orgID, userID, "role_changed", owner.ID.String(), gin.H{"from": previous, "to": body.Role})
+	}
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "user_id": userID, "role": body.Role, "previous_role": previous})
+}
+
+// orgAuditKeyset pages GET /orgs/:id/audit newest first, 100 entries by default as before
+// it was paged
+var orgAuditKeyset = keyset{Scope: "org_audit", Columns: []string{"id"}, Desc: true, DefaultLimit: 100}
+
+// orgAuditHandler handles GET /orgs/:id/audit, newest first, for owners
+func orgAuditHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return
+	}
+	keys, limit, ok := cursorParams(c, orgAuditKeyset, c.Param("id"))
+	if !ok {
+		return
+	}
+	after, keyArgs := orgAuditKeyset.where(keys, 3)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT id, coalesce(user_id::text, ''), action, actor, detail, created_at FROM org_audit
+		WHERE org_id = $1 AND `+after+` ORDER BY `+orgAuditKeyset.orderBy()+` LIMIT $2`,
+		append([]interface{}{c.Param("id"), limit}, keyArgs...)...)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load audit trail")
+		return
+	}
+	defer rows.Close()
+	history := []gin.H{}
+	var lastID int64
+	for rows.Next() {
+		var userID, action, actor string
+		var detail json.RawMessage
+		var at time.Time
+		if err := rows.Scan(&lastID, &userID, &action, &actor, &detail, &at); err != nil {
+			respondError(c, codeInternal, "Failed to load audit trail")
+			return
+		}
+		entry := gin.H{"action": action, "actor": actor, "detail": detail, "at": at}
+		if userID != "" {
+			entry["user_id"] = userID
+		}
+		history = append(history, entry)
+	}
+	resp := gin.H{"org_id": c.Param("id"), "history": history}
+	if len(history) == limit {
+		resp["next_cursor"] = orgAuditKeyset.encode(c.Param("id"), lastID)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// OrgUsageRow is one member's usage in one month. Storage is what that month's
+// generations still hold; Removed marks members who have since left
+type OrgUsageRow struct {
+	Month        string `json:"month"`
+	UserID       string `json:"user_id"`
+	Removed      bool   `json:"removed,omitempty"`
+	Generations  int64  `json:"generations"` // completed
+	CreditsSpent int64  `json:"credits_spent"`
+	StorageBytes int64  `json:"storage_bytes"`
+}
+
+// orgUsageMonths parses from/to (months like 2006-01, inclusive), defaulting to the last six
+func orgUsageMonths(c *gin.Context) (from, to time.Time, ok bool) {
+	now := clock.Now().UTC()
+	to = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	from = to.AddDate(0, -5, 0)
+	for param, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(orgUsageMonthLayout, v)
+			if err != nil {
+				fieldError(c, codeInvalidRequest, param, "must be a month like 2006-01")
+				return from, to, false
+			}
+			*dst = t
+		}
+	}
+	if to.Before(from) {
+		fieldError(c, codeValidationFailed, "to", "must not be before from")
+		return from, to, false
+	}
+	if from.AddDate(0, orgUsageMaxMonths, 0).Before(to.AddDate(0, 1, 0)) {
+		fieldError(c, codeValidationFailed, "from", "at most "+strconv.Itoa(orgUsageMaxMonths)+" months at a time")
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// orgUsageHandler handles GET /orgs/:id/usage?from=&to=&format=csv for owners: completed
+// generations, credits spent (net of refunds) and storage per member per month
+func orgUsageHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return
+	}
+	from, to, ok := orgUsageMonths(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	orgID := c.Param("id")
+
+	rows, err := db.QueryContext(ctx, `
+		WITH gens AS (
+			SELECT user_id::text AS user_id, date_trunc('month', created_at AT TIME ZONE 'UTC') AS month,
+			       count(*) FILTER (WHERE status = 'completed') AS generations,
+			       coalesce(sum(stored_bytes), 0) AS storage_bytes
+			FROM generated_content
+			WHERE org_id = $1 AND created_at >= $2 AND created_at < $3
+			GROUP BY 1, 2
+		), spend AS (
+			SELECT user_id::text AS user_id, date_trunc('month', created_at AT TIME ZONE 'UTC') AS month,
+			       -sum(delta) AS credits
+			FROM credit_ledger
+			WHERE org_id = $1 AND request_id IS NOT NULL AND created_at >= $2 AND created_at < $3
+			GROUP BY 1, 2
+		)
+		SELECT to_char(coalesce(g.month, s.month), 'YYYY-MM'), coalesce(g.user_id, s.user_id),
+		       NOT EXISTS (SELECT 1 FROM organization_members m
+		                   WHERE m.org_id = $1 AND m.user_id::text = coalesce(g.user_id, s.user_id)
+		                     AND m.removed_at IS NULL),
+		       coalesce(g.generations, 0), coalesce(s.credits, 0), coalesce(g.storage_bytes, 0)
+		FROM gens g FULL JOIN spend s ON s.user_id = g.user_id AND s.month = g.month
+		ORDER BY 1, 2`, orgID, from, to.AddDate(0, 1, 0))
+	if err != nil {
+		log.Printf("❌ Failed to load usage of org %s: %v", orgID, err)
+		respondError(c, codeInternal, "Failed to load usage")
+		return
+	}
+	defer rows.Close()
+
+	usage := []OrgUsageRow{}
+	var totals OrgUsageRow
+	for rows.Next() {
+		var r OrgUsageRow
+		if err := rows.Scan(&r.Month, &r.UserID, &r.Removed, &r.Generations, &r.CreditsSpent, &r.StorageBytes); err != nil {
+			respondError(c, codeInternal, "Failed to load usage")
+			return
+		}
+		totals.Generations += r.Generations
+		totals.CreditsSpent += r.CreditsSpent
+		totals.StorageBytes += r.StorageBytes
+		usage = append(usage, r)
+	}
+	if err := rows.Err(); err != nil {
+		respondError(c, codeInternal, "Failed to load usage")
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeOrgUsageCSV(c, orgID, from, to, usage)
+		return
+	}
+	seats, err := loadOrgSeats(ctx, db, orgID, false)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load usage")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"org_id": orgID,
+		"from":   from.Format(orgUsageMonthLayout),
+		"to":     to.Format(orgUsageMonthLayout),
+		"seats":  seats,
+		"usage":  usage,
+		"totals": gin.H{"generations": totals.Generations, "credits_spent": totals.CreditsSpent,
+			"storage_bytes": totals.StorageBytes},
+	})
+}
+
+func writeOrgUsageCSV(c *gin.Context, orgID string, from, to time.Time, usage []OrgUsageRow) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="org-usage-%s-%s-%s.csv"`,
+		orgID, from.Format(orgUsageMonthLayout), to.Format(orgUsageMonthLayout)))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"month", "user_id", "removed", "generations", "credits_spent", "storage_bytes"})
+	for _, r := range usage {
+		w.Write([]string{r.Month, r.UserID, strconv.FormatBool(r.Removed), strconv.FormatInt(r.Generations, 10),
+			strconv.FormatInt(r.CreditsSpent, 10), strconv.FormatInt(r.StorageBytes, 10)})
+	}
+	w.Flush()
+}
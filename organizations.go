@@ -0,0 +1,309 @@
+// organizations.go
+// Organizations with shared credit pools, invitations and a shared gallery; seats, roles
+// and reporting are in org_management.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	orgRoleOwner  = "owner"
+	orgRoleMember = "member"
+)
+
+var orgInviteTTL = getEnvDuration("ORG_INVITE_TTL", 7*24*time.Hour)
+
+// Organization is the API view of an organizations row plus the caller's role
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   string    `json:"owner_id"`
+	Plan      string    `json:"plan"` // sets the seat limit
+	Credits   int       `json:"credits"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// orgRole returns the user's active role in the org, or "" if they aren't a member
+func orgRole(ctx context.Context, orgID, userID string) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, `
+		SELECT role FROM organization_members
+		WHERE org_id = $1 AND user_id = $2 AND removed_at IS NULL`, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireOrgRole loads the caller's role for :id, aborting with 404 when they aren't a member
+// (so org IDs can't be probed) and 403 when the role isn't one of allowed
+func requireOrgRole(c *gin.Context, allowed ...string) (string, bool) {
+	user := c.MustGet("currentUser").(*repository.User)
+	role, err := orgRole(c.Request.Context(), c.Param("id"), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load org membership: %v", err)
+		respondError(c, codeInternal, "Failed to load organization")
+		return "", false
+	}
+	if role == "" {
+		respondError(c, codeNotFound, "Organization not found")
+		return "", false
+	}
+	for _, a := range allowed {
+		if role == a {
+			return role, true
+		}
+	}
+	if len(allowed) == 0 {
+		return role, true
+	}
+	respondError(c, codeNotOwner, "Only organization owners can do that")
+	return "", false
+}
+
+// createOrgHandler handles POST /orgs
+func createOrgHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Name) == "" || len(body.Name) > 100 {
+		fieldError(c, codeValidationFailed, "name", "required, at most 100 characters")
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to create organization")
+		return
+	}
+	defer tx.Rollback()
+
+	org := Organization{Name: strings.TrimSpace(body.Name), OwnerID: user.ID.String(), Role: orgRoleOwner}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO organizations (name, owner_id, tenant_id) VALUES ($1, $2, $3)
+		RETURNING id, plan, credits, created_at`, org.Name, org.OwnerID, currentTenant(c).ID).Scan(&org.ID, &org.Plan, &org.Credits, &org.CreatedAt)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)`, org.ID, org.OwnerID, orgRoleOwner)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to create organization: %v", err)
+		respondError(c, codeInternal, "Failed to create organization")
+		return
+	}
+	c.JSON(http.StatusCreated, org)
+}
+
+// listOrgsHandler handles GET /orgs
+func listOrgsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT o.id, o.name, o.owner_id, o.plan, o.credits, m.role, o.created_at
+		FROM organizations o
+		JOIN organization_members m ON m.org_id = o.id
+		WHERE m.user_id = $1 AND m.removed_at IS NULL
+		ORDER BY o.name`, user.ID.String())
+	if err != nil {
+		respondError(c, codeInternal, "Failed to list organizations")
+		return
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.OwnerID, &o.Plan, &o.Credits, &o.Role, &o.CreatedAt); err != nil {
+			respondError(c, codeInternal, "Failed to list organizations")
+			return
+		}
+		orgs = append(orgs, o)
+	}
+	c.JSON(http.StatusOK, gin.H{"organizations": orgs})
+}
+
+// createInviteHandler handles POST /orgs/:id/invites
+func createInviteHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		respondError(c, codeInternal, "Failed to create invite")
+		return
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(orgInviteTTL)
+
+	_, err := db.ExecContext(c.Request.Context(), `
+		INSERT INTO organization_invites (token, org_id, created_by, expires_at) VALUES ($1, $2, $3, $4)`,
+		token, c.Param("id"), user.ID.String(), expiresAt)
+	if err != nil {
+		log.Printf("❌ Failed to create invite: %v", err)
+		respondError(c, codeInternal, "Failed to create invite")
+		return
+	}
+	auditOrg(c.Request.Context(), c.Param("id"), "", "invite_created", user.ID.String(), gin.H{"expires_at": expiresAt})
+	c.JSON(http.StatusCreated, gin.H{"token": token, "expires_at": expiresAt})
+}
+
+// acceptInviteHandler handles POST /invites/:token/accept. Joining takes a seat; an org
+// that is full refuses, and the invite stays usable once a seat frees up
+func acceptInviteHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to accept invite")
+		return
+	}
+	defer tx.Rollback()
+
+	// Single-use: the invite is claimed by whoever flips accepted_by first. Another
+	// tenant's orgs take no one from this one
+	var orgID string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE organization_invites i SET accepted_by = $1, accepted_at = now()
+		FROM organizations o
+		WHERE i.token = $2 AND i.accepted_by IS NULL AND i.expires_at > now()
+		  AND o.id = i.org_id AND o.tenant_id = $3
+		RETURNING i.org_id`, user.ID.String(), c.Param("token"), currentTenant(c).ID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Invite not found or expired")
+		return
+	}
+	// The org row stays locked until commit, so accepts are counted one at a time
+	var role string
+	var seats OrgSeats
+	joined := false
+	if err == nil {
+		seats, err = loadOrgSeats(ctx, tx, orgID, true)
+	}
+	if err == nil {
+		role, err = orgRole(ctx, orgID, user.ID.String())
+	}
+	if err == nil && role == "" {
+		if seats.full() {
+			respondErrorDetails(c, codeSeatLimit, "This organization has no free seats",
+				gin.H{"used": seats.Used, "max": seats.Max})
+			return
+		}
+		// Re-joining after removal reactivates the old membership
+		role = orgRoleMember
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, user_id) DO UPDATE SET removed_at = NULL, role = EXCLUDED.role, created_at = now()`,
+			orgID, user.ID.String(), role)
+		seats.Used++
+		joined = true
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to accept invite: %v", err)
+		respondError(c, codeInternal, "Failed to accept invite")
+		return
+	}
+	if joined {
+		auditOrg(ctx, orgID, user.ID.String(), "member_joined", user.ID.String(), gin.H{"seats_used": seats.Used})
+	}
+	c.JSON(http.StatusOK, gin.H{"org_id": orgID, "role": role})
+}
+
+// removeMemberHandler handles DELETE /orgs/:id/members/:user_id. Owners must be demoted
+// first. Past generations stay in the gallery and the usage report; only new attribution
+// stops, and the seat is free at once
+func removeMemberHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c, orgRoleOwner); !ok {
+		return
+	}
+	owner := c.MustGet("currentUser").(*repository.User)
+	res, err := db.ExecContext(c.Request.Context(), `
+		UPDATE organization_members SET removed_at = now()
+		WHERE org_id = $1 AND user_id = $2 AND role <> $3 AND removed_at IS NULL`,
+		c.Param("id"), c.Param("user_id"), orgRoleOwner)
+	if err != nil {
+		log.Printf("❌ Failed to remove member: %v", err)
+		respondError(c, codeInternal, "Failed to remove member")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "Member not found")
+		return
+	}
+	auditOrg(c.Request.Context(), c.Param("id"), c.Param("user_id"), "member_removed", owner.ID.String(), gin.H{})
+	c.Status(http.StatusNoContent)
+}
+
+// orgGalleryKeyset pages GET /orgs/:id/generations newest first
+var orgGalleryKeyset = keyset{Scope: "org_gallery", Columns: []string{"created_at", "request_id"}, Desc: true, Before: true}
+
+// orgGalleryHandler handles GET /orgs/:id/generations
+func orgGalleryHandler(c *gin.Context) {
+	if _, ok := requireOrgRole(c); !ok {
+		return
+	}
+	size, ok := sizeParam(c, renditionThumbnail)
+	if !ok {
+		return
+	}
+
+	filter := c.Param("id")
+	keys, limit, ok := cursorParams(c, orgGalleryKeyset, filter)
+	if !ok {
+		return
+	}
+
+	after, keyArgs := orgGalleryKeyset.where(keys, 3)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+generationColumns+`
+		FROM generated_content
+		WHERE org_id = $1 AND status = 'completed' AND trashed_at IS NULL AND `+after+`
+		ORDER BY `+orgGalleryKeyset.orderBy()+` LIMIT $2`, append([]interface{}{c.Param("id"), limit}, keyArgs...)...)
+	if err != nil {
+		log.Printf("❌ Failed to load org gallery: %v", err)
+		respondError(c, codeInternal, "Failed to load gallery")
+		return
+	}
+	defer rows.Close()
+
+	list := []*Generation{}
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to load gallery")
+			return
+		}
+		g.Tags = nil // private to the owner
+		withGenerationURLs(c.Request.Context(), g, size)
+		list = append(list, g)
+	}
+
+	resp := GenerationListResponse{Generations: list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp.NextCursor = orgGalleryKeyset.encode(filter, last.CreatedAt, last.RequestID)
+		resp.NextBefore = last.CreatedAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,298 @@
+// orphans.go
+// Weekly reconciliation of the generations prefix against the database. Objects no row
+// references (a worker crash between upload and completion, a row purged before its
+// completion landed) are deleted once they are old enough that nothing can still be
+// about to claim them. Works on any Storage
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const orphanSweepLockKey = "orphan_sweep:lock"
+
+var (
+	orphanSweepInterval = getEnvDuration("ORPHAN_SWEEP_INTERVAL", 7*24*time.Hour)
+	orphanPrefix        = getEnv("ORPHAN_SWEEP_PREFIX", "generated/")
+	orphanMinAge        = getEnvDuration("ORPHAN_MIN_AGE", 48*time.Hour)
+	// Safety valve: a run that would delete more than this stops there, so a bad query
+	// or a restored-from-backup database can't empty the bucket
+	orphanDeleteCap      = getEnvInt("ORPHAN_DELETE_CAP", 1000)
+	orphanDryRun         = getEnvBool("ORPHAN_SWEEP_DRY_RUN", false)
+	orphanPageSize       = 1000
+	orphanPagesPerSecond = getEnvFloat("ORPHAN_LIST_PAGES_PER_SECOND", 2)
+
+	orphanObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_orphan_objects_total",
+		Help: "Unreferenced objects found by the orphan sweep, by result (deleted, would_delete, failed, capped).",
+	}, []string{"result"})
+)
+
+// OrphanSweepReport is one run's outcome, stored in orphan_sweeps
+type OrphanSweepReport struct {
+	ID             int64      `json:"id"`
+	DryRun         bool       `json:"dry_run"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Scanned        int64      `json:"scanned"`
+	Unreferenced   int64      `json:"unreferenced"`
+	Deleted        int64      `json:"deleted"`
+	Failed         int64      `json:"failed"`
+	BytesReclaimed int64      `json:"bytes_reclaimed"` // would be reclaimed, on a dry run
+	Capped         bool       `json:"capped"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// startOrphanSweep checks hourly whether a sweep is due, so restarts don't keep pushing
+// a weekly run back; the last scheduled-mode report's start time is the schedule
+func startOrphanSweep() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("orphan_sweep", nil, func() {
+			ctx := backgroundStorage(context.Background())
+			var due bool
+			err := db.QueryRowContext(ctx, `
+				SELECT coalesce(max(started_at), 'epoch') < now() - $1 * interval '1 second'
+				FROM orphan_sweeps WHERE dry_run = $2`, int64(orphanSweepInterval/time.Second), orphanDryRun).Scan(&due)
+			if err != nil || !due {
+				return
+			}
+			runOrphanSweepLocked(ctx, orphanDryRun)
+		})
+	}
+}
+
+// runOrphanSweepLocked runs a sweep unless one is already running somewhere; false if it was
+func runOrphanSweepLocked(ctx context.Context, dryRun bool) bool {
+	ok, err := rdb.SetNX(ctx, orphanSweepLockKey, "1", 6*time.Hour).Result()
+	if err != nil || !ok {
+		return false
+	}
+	defer rdb.Del(ctx, orphanSweepLockKey)
+	runOrphanSweep(ctx, dryRun)
+	return true
+}
+
+// runOrphanSweep lists each tenant's prefix page by page and checks each page against the
+// database. Deletes are throttled with the retention job's rate
+func runOrphanSweep(ctx context.Context, dryRun bool) {
+	r := OrphanSweepReport{DryRun: dryRun}
+	err := db.QueryRowContext(ctx, `INSERT INTO orphan_sweeps (dry_run) VALUES ($1) RETURNING id, started_at`,
+		dryRun).Scan(&r.ID, &r.StartedAt)
+	if err != nil {
+		log.Printf("❌ Failed to start orphan sweep: %v", err)
+		return
+	}
+	log.Printf("🧹 Orphan sweep %d started on %q (dry run: %v)", r.ID, orphanSweepPrefixes(), dryRun)
+
+	listThrottle := time.NewTicker(time.Duration(float64(time.Second) / max(orphanPagesPerSecond, 0.1)))
+	defer listThrottle.Stop()
+	deleteThrottle := time.NewTicker(time.Second / time.Duration(max(retentionDeletesPerSecond, 1)))
+	defer deleteThrottle.Stop()
+
+	cutoff := time.Now().Add(-orphanMinAge)
+	// Each tenant's generations sit under its own storage prefix
+prefixes:
+	for _, prefix := range orphanSweepPrefixes() {
+		cursor := ""
+		for {
+			<-listThrottle.C
+			page, next, err := storage.List(ctx, prefix, cursor, orphanPageSize)
+			if err != nil {
+				r.Error = "list " + prefix + ": " + err.Error()
+				break prefixes
+			}
+			r.Scanned += int64(len(page))
+
+			var old []StoredObject
+			for _, o := range page {
+				// Young objects may belong to a request still in flight
+				if o.LastModified.Before(cutoff) {
+					old = append(old, o)
+				}
+			}
+			orphans, err := unreferencedObjects(ctx, old)
+			if err != nil {
+				r.Error = "check: " + err.Error()
+				break prefixes
+			}
+			for _, o := range orphans {
+				r.Unreferenced++
+				if dryRun {
+					orphanObjects.WithLabelValues("would_delete").Inc()
+					r.BytesReclaimed += o.Size
+					continue
+				}
+				if r.Deleted >= int64(orphanDeleteCap) {
+					r.Capped = true
+					orphanObjects.WithLabelValues("capped").Inc()
+					break prefixes
+				}
+				<-deleteThrottle.C
+				if err := storage.Delete(ctx, o.Key); err != nil {
+					log.Printf("⚠️ Failed to delete orphaned object %s: %v", o.Key, err)
+					orphanObjects.WithLabelValues("failed").Inc()
+					r.Failed++
+					continue
+				}
+				orphanObjects.WithLabelValues("deleted").Inc()
+				r.Deleted++
+				r.BytesReclaimed += o.Size
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE orphan_sweeps SET finished_at = now(), scanned = $2, unreferenced = $3, deleted = $4,
+		       failed = $5, bytes_reclaimed = $6, capped = $7, error = $8
+		WHERE id = $1`, r.ID, r.Scanned, r.Unreferenced, r.Deleted, r.Failed, r.BytesReclaimed, r.Capped, r.Error)
+	if err != nil {
+		log.Printf("❌ Failed to record orphan sweep %d: %v", r.ID, err)
+	}
+	if r.Capped {
+		log.Printf("🛑 Orphan sweep %d hit its cap of %d deletions; check the report before raising ORPHAN_DELETE_CAP", r.ID, orphanDeleteCap)
+	}
+	log.Printf("🧹 Orphan sweep %d: scanned %d, unreferenced %d, deleted %d (%d bytes), failed %d %s",
+		r.ID, r.Scanned, r.Unreferenced, r.Deleted, r.BytesReclaimed, r.Failed, r.Error)
+}
+
+// orphanSweepPrefixes is ORPHAN_SWEEP_PREFIX under every tenant's storage prefix
+func orphanSweepPrefixes() []string {
+	prefixes := []string{}
+	for _, t := range allTenants() {
+		prefixes = append(prefixes, tenantStoragePrefix(t.ID)+orphanPrefix)
+	}
+	return prefixes
+}
+
+// unreferencedObjects returns the objects no row points at. A row references its content,
+// the pre-watermark original next to a "-final" copy, its poster, thumbnail, renditions,
+// input and the download conversions of its content and poster; trashed rows still count
+func unreferencedObjects(ctx context.Context, objects []StoredObject) ([]StoredObject, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	referenced, err := queryKeysSet(ctx, `
+		SELECT k FROM unnest($1::text[]) k
+		CROSS JOIN LATERAL (SELECT regexp_replace(k, '\.q[0-9]+\.(avif|webp|jpeg)$', '.png') AS source) conv
+		WHERE EXISTS (SELECT 1 FROM generated_content
+		              WHERE content_url IN (k, regexp_replace(k, '\.png$', '-final.png'), conv.source))
+		   OR EXISTS (SELECT 1 FROM generated_content WHERE thumbnail_key = k)
+		   OR EXISTS (SELECT 1 FROM generated_content WHERE poster_key IN (k, conv.source))
+		   OR EXISTS (SELECT 1 FROM generated_content WHERE input_key = k)
+		   OR EXISTS (SELECT 1 FROM generation_renditions WHERE s3_key = k)`, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	var orphans []StoredObject
+	for _, o := range objects {
+		if !referenced[o.Key] {
+			orphans = append(orphans, o)
+		}
+	}
+	return orphans, nil
+}
+
+func queryKeysSet(ctx context.Context, q string, args ...interface{}) (map[string]bool, error) {
+	keys, err := queryKeys(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set, nil
+}
+
+const orphanSweepColumns = `id, dry_run, started_at, finished_at, scanned, unreferenced, deleted, failed,
+       bytes_reclaimed, capped, error`
+
+func scanOrphanSweep(row rowScanner) (*OrphanSweepReport, error) {
+	var r OrphanSweepReport
+	err := row.Scan(&r.ID, &r.DryRun, &r.StartedAt, &r.FinishedAt, &r.Scanned, &r.Unreferenced, &r.Deleted,
+		&r.Failed, &r.BytesReclaimed, &r.Capped, &r.Error)
+	return &r, err
+}
+
+// lastOrphanSweep is the most recent finished report, for /admin/stats; nil before the first
+func lastOrphanSweep(ctx context.Context) (*OrphanSweepReport, error) {
+	r, err := scanOrphanSweep(db.QueryRowContext(ctx, `
+		SELECT `+orphanSweepColumns+` FROM orphan_sweeps WHERE finished_at IS NOT NULL ORDER BY id DESC LIMIT 1`))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return r, err
+}
+
+// listOrphanSweepsHandler handles GET /admin/orphan-sweeps, the latest reports first
+func listOrphanSweepsHandler(c *gin.Context) {
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+orphanSweepColumns+` FROM orphan_sweeps ORDER BY id DESC LIMIT 20`)
+	if err != nil {
+		log.Printf("❌ Failed to list orphan sweeps: %v", err)
+		respondError(c, codeInternal, "Failed to list orphan sweeps")
+		return
+	}
+	defer rows.Close()
+
+	list := []*OrphanSweepReport{}
+	for rows.Next() {
+		r, err := scanOrphanSweep(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list orphan sweeps")
+			return
+		}
+		list = append(list, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"sweeps": list, "prefixes": orphanSweepPrefixes(), "min_age_hours": orphanMinAge.Hours(),
+		"delete_cap": orphanDeleteCap})
+}
+
+// startOrphanSweepHandler handles POST /admin/orphan-sweeps {"dry_run": true}: an
+// out-of-schedule run in the background. Omitting dry_run uses ORPHAN_SWEEP_DRY_RUN
+func startOrphanSweepHandler(c *gin.Context) {
+	var body struct {
+		DryRun *bool `json:"dry_run"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, codeInvalidRequest, "Invalid JSON format")
+			return
+		}
+	}
+	dryRun := orphanDryRun
+	if body.DryRun != nil {
+		dryRun = *body.DryRun
+	}
+	if n, _ := rdb.Exists(c.Request.Context(), orphanSweepLockKey).Result(); n > 0 {
+		respondError(c, codeConflict, "An orphan sweep is already running")
+		return
+	}
+	go runWithRecovery("orphan_sweep", nil, func() {
+		if !runOrphanSweepLocked(backgroundStorage(context.Background()), dryRun) {
+			log.Println("ℹ️ Orphan sweep already running; manual run skipped")
+		}
+	})
+	c.JSON(http.StatusAccepted, gin.H{"dry_run": dryRun, "status": "started"})
+}
@@ -0,0 +1,141 @@
+// ownership.go
+// A generation row belongs to the user it was created for, and nothing may write it on
+// behalf of anyone else. Writers that know the owner state it (generationWrite.Owner, the
+// text path's checks around genRepo.Create) and a row that turns out to belong to someone
+// else fails the write with an ownerMismatchError, which is counted and reported rather
+// than quietly skipped. Completions take their user from the row, never from the message;
+// a message naming another user is reported as a worker bug. The owner_consistency
+// backfill looks for rows written before these checks whose user disagrees with the
+// other records of the request
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ownerMismatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_owner_mismatches_total",
+	Help: "Requests found attributed to a user other than their owner, by where (write, completion, consistency_check).",
+}, []string{"where"})
+
+// ownerMismatchError means requestID belongs to Owner, not to the Stated user
+type ownerMismatchError struct {
+	RequestID string
+	Stated    string
+	Owner     string
+	Source    string // the record naming Stated, for the consistency check
+}
+
+func (e *ownerMismatchError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("request %s belongs to %s but its %s names %s", e.RequestID, e.Owner, e.Source, e.Stated)
+	}
+	return fmt.Sprintf("request %s belongs to %s, not %s", e.RequestID, e.Owner, e.Stated)
+}
+
+// reportOwnerMismatch logs, counts and reports a mismatch found at where
+func reportOwnerMismatch(where string, err *ownerMismatchError) {
+	log.Printf("🚨 Owner mismatch at %s: %v", where, err)
+	ownerMismatches.WithLabelValues(where).Inc()
+	errorReporter.Report(err, map[string]string{
+		"where": where, "request_id": err.RequestID, "user_id": err.Stated, "owner_id": err.Owner,
+	})
+}
+
+// verifyRequestOwner fails with an ownerMismatchError, reported as found by a write, when
+// requestID has a row that belongs to someone other than userID. A missing row passes:
+// there is nothing to take over
+func verifyRequestOwner(ctx context.Context, q rowQuerier, requestID, userID string) error {
+	var owner string
+	err := q.QueryRowContext(ctx, `SELECT user_id::text FROM generated_content WHERE request_id = $1`, requestID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		mismatch := &ownerMismatchError{RequestID: requestID, Stated: userID, Owner: owner}
+		reportOwnerMismatch("write", mismatch)
+		return mismatch
+	}
+	return nil
+}
+
+// requestOwner is the user requestID belongs to: from its status record when Redis has
+// one, otherwise from the row. "" when there is no such request
+func requestOwner(ctx context.Context, requestID string) (string, error) {
+	if r := readStatusRecord(ctx, requestID); r != nil && r.UserID != "" {
+		return r.UserID, nil
+	}
+	var owner string
+	err := db.QueryRowContext(ctx, `SELECT user_id::text FROM generated_content WHERE request_id = $1`, requestID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return owner, err
+}
+
+// noteCompletionOwner reports a completion whose user_id isn't the request's owner. The
+// message is still applied, for the owner
+func noteCompletionOwner(completion ImageGenerationCompletion, owner string) {
+	if owner != "" && completion.UserID != "" && completion.UserID != owner {
+		reportOwnerMismatch("completion", &ownerMismatchError{
+			RequestID: completion.RequestID, Stated: completion.UserID, Owner: owner, Source: "completion message"})
+	}
+}
+
+// checkRequestOwnership fails for a row whose user differs from the user of its charge,
+// its conversation or the account actions recorded for it
+func checkRequestOwnership(ctx context.Context, requestID string) error {
+	var owner, source, other string
+	err := db.QueryRowContext(ctx, `
+		SELECT g.user_id::text, r.source, r.user_id
+		FROM generated_content g
+		JOIN LATERAL (
+			SELECT 'credit ledger' AS source, l.user_id::text AS user_id FROM credit_ledger l WHERE l.request_id = g.request_id
+			UNION ALL
+			SELECT 'conversation', c.user_id::text FROM conversation_messages m
+			JOIN conversations c ON c.id = m.conversation_id WHERE m.request_id = g.request_id
+			UNION ALL
+			SELECT 'account audit', a.user_id::text FROM account_audit a WHERE a.request_id = g.request_id
+		) r ON r.user_id <> g.user_id::text
+		WHERE g.request_id = $1
+		LIMIT 1`, requestID).Scan(&owner, &source, &other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mismatch := &ownerMismatchError{RequestID: requestID, Stated: other, Owner: owner, Source: source}
+	log.Printf("🚨 Owner mismatch at consistency_check: %v", mismatch)
+	ownerMismatches.WithLabelValues("consistency_check").Inc()
+	return mismatch
+}
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        "owner_consistency",
+		Description: "Report generations whose user differs from the user of their charge, conversation or account actions",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			return queryKeys(ctx, `
+				SELECT request_id FROM generated_content
+				WHERE request_id > $1
+				ORDER BY request_id LIMIT $2`, cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			var n int64
+			err := db.QueryRowContext(ctx, `SELECT count(*) FROM generated_content`).Scan(&n)
+			return n, err
+		},
+		Process: checkRequestOwnership,
+	})
+}
@@ -0,0 +1,51 @@
+// payload.go
+// Request body accepted by the generation endpoint
+
+package main
+
+// RequestPayload is the JSON body of POST /generations
+type RequestPayload struct {
+	Text        string `json:"text"`
+	RequestType string `json:"request_type"`     // a registered kind (kinds.go); omitted is "text"
+	OrgID       string `json:"org_id,omitempty"` // attribute to an organization the user belongs to
+
+	// ConversationID continues an earlier text exchange; omitted starts a new one
+	ConversationID string `json:"conversation_id,omitempty"`
+
+	// Model overrides the default for the request type; it must be one the plan allows
+	Model string `json:"model,omitempty"`
+
+	// Image only, priced against the defaults (see POST /generations/estimate)
+	Resolution int `json:"resolution,omitempty"` // longest side in px
+	Steps      int `json:"steps,omitempty"`
+	NumImages  int `json:"num_images,omitempty"`
+	// AutoDownscale clamps a resolution over the plan's cap to the cap instead of refusing it
+	AutoDownscale bool `json:"auto_downscale,omitempty"`
+
+	// Video only; defaults apply when omitted
+	DurationSeconds float64 `json:"duration_seconds,omitempty"` // at most 4
+	FPS             int     `json:"fps,omitempty"`
+
+	// MaxWaitSeconds gives up on an image/video that isn't done in time (refunding it)
+	MaxWaitSeconds int `json:"max_wait_seconds,omitempty"`
+
+	// InputKey is a source image from POST /uploads, for image requests only
+	InputKey string `json:"input_key,omitempty"`
+
+	// TemplateID renders the prompt from a template (see templates.go) instead of text;
+	// Variables fills its placeholders, and its defaults fill parameters left unset
+	TemplateID string            `json:"template_id,omitempty"`
+	Variables  map[string]string `json:"variables,omitempty"`
+
+	// Notify narrows the request's notifications: "all" (default, as the preferences say),
+	// "failures_only" or "none"
+	Notify string `json:"notify,omitempty"`
+
+	// BatchID groups requests the client submits together, e.g. one per prompt of a batch:
+	// their notifications are collapsed into one, and GET /generations?batch_id= lists them
+	BatchID string `json:"batch_id,omitempty"`
+
+	// DraftID is the saved draft (drafts.go) the prompt was composed in, cleared once the
+	// request is accepted
+	DraftID string `json:"draft_id,omitempty"`
+}
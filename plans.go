@@ -0,0 +1,419 @@
+// plans.go
+// Per-plan limits and feature flags: built-in defaults from the environment, overridden
+// by rows in plan_limits and reloadable at runtime, plus the cached user plan lookup.
+// Each tenant has its own plans: every one starts from the defaults and takes only its
+// own rows, and its admins see and change only those
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	admissionReject = "reject"
+	admissionDefer  = "defer"
+
+	planReloadChannel = "plans_reload"
+)
+
+var (
+	rateLimitWindow = getEnvDuration("RATE_LIMIT_WINDOW", time.Hour)
+	planCacheTTL    = getEnvDuration("PLAN_CACHE_TTL", time.Minute)
+	// Models a plan may list in allowed_models
+	knownModels = strings.Split(getEnv("KNOWN_MODELS", defaultImageModel+","+defaultVideoModel), ",")
+)
+
+var errInvalidPlanConfig = errors.New("invalid plan configuration")
+
+// PlanLimits is everything a plan allows, resolved per request from the user's plan
+type PlanLimits struct {
+	Plan          string `json:"plan"`
+	RateLimit     int    `json:"rate_limit"`    // publishes allowed per rateLimitWindow
+	MaxInFlight   int    `json:"max_in_flight"` // queued/processing at once; deferred requests don't count
+	AdmissionMode string `json:"admission_mode"`
+	// RetentionSeconds is how long images and videos are kept; zero keeps them forever
+	RetentionSeconds int64    `json:"retention_seconds"`
+	MaxImageSide     int      `json:"max_image_side"` // longest output side in px; zero leaves it to the worker
+	AllowedModels    []string `json:"allowed_models"` // empty allows every known model
+	Watermark        bool     `json:"watermark"`
+	MaxBatch         int      `json:"max_batch"` // images per request
+	// ModelCredits prices one image (or default-length video) per model; unlisted models
+	// cost IMAGE_CREDIT_COST / VIDEO_CREDIT_COST
+	ModelCredits map[string]int `json:"model_credits"`
+	// StorageBytes caps what a user may keep stored (see usage.go); zero is unlimited
+	StorageBytes int64 `json:"storage_bytes"`
+	// MaxSeats caps the active members of an organization on this plan (see
+	// org_management.go); zero is unlimited
+	MaxSeats int `json:"max_seats"`
+	// Kinds gives request types their own rate and in-flight limits (see buckets.go)
+	Kinds map[string]KindLimits `json:"kinds,omitempty"`
+}
+
+func (l PlanLimits) retention() time.Duration {
+	return time.Duration(l.RetentionSeconds) * time.Second
+}
+
+// admissionPolicy controls how many requests of one kind a plan may publish per window
+type admissionPolicy struct {
+	WindowLimit int    // publishes allowed per rateLimitWindow
+	MaxInFlight int    // queued/processing at once; deferred requests don't count
+	Mode        string // admissionReject or admissionDefer once over the limit
+}
+
+func (l PlanLimits) admission() admissionPolicy {
+	return admissionPolicy{WindowLimit: l.RateLimit, MaxInFlight: l.MaxInFlight, Mode: l.AdmissionMode}
+}
+
+func (l PlanLimits) allowsModel(model string) bool {
+	if len(l.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range l.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (l PlanLimits) validate() error {
+	bad := func(field, msg string) error {
+		return fmt.Errorf("%w: %s.%s %s", errInvalidPlanConfig, l.Plan, field, msg)
+	}
+	switch {
+	case l.Plan == "":
+		return fmt.Errorf("%w: plan name is empty", errInvalidPlanConfig)
+	case l.RateLimit < 1:
+		return bad("rate_limit", "must be at least 1")
+	case l.MaxInFlight < 1:
+		return bad("max_in_flight", "must be at least 1")
+	case l.AdmissionMode != admissionReject && l.AdmissionMode != admissionDefer:
+		return bad("admission_mode", "must be reject or defer")
+	case l.RetentionSeconds < 0:
+		return bad("retention_seconds", "must not be negative")
+	case l.MaxImageSide < 0 || (l.MaxImageSide > 0 && l.MaxImageSide < 64):
+		return bad("max_image_side", "must be 0 or at least 64")
+	case l.MaxBatch < 1 || l.MaxBatch > maxNumImages:
+		return bad("max_batch", fmt.Sprintf("must be between 1 and %d", maxNumImages))
+	case l.StorageBytes < 0:
+		return bad("storage_bytes", "must not be negative")
+	case l.MaxSeats < 0:
+		return bad("max_seats", "must not be negative")
+	}
+	for m, n := range l.ModelCredits {
+		if !containsString(knownModels, m) {
+			return bad("model_credits", fmt.Sprintf("prices unknown model %q", m))
+		}
+		if n < 0 {
+			return bad("model_credits", fmt.Sprintf("prices %s below zero", m))
+		}
+	}
+	for _, m := range l.AllowedModels {
+		if !containsString(knownModels, m) {
+			return bad("allowed_models", fmt.Sprintf("lists unknown model %q", m))
+		}
+	}
+	for kind, k := range l.Kinds {
+		if _, ok := generationKind(kind); !ok {
+			return bad("kinds", fmt.Sprintf("limits unknown request type %q", kind))
+		}
+		if k.RateLimit < 0 || k.MaxInFlight < 0 {
+			return bad("kinds", fmt.Sprintf("limits %s below zero", kind))
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.TrimSpace(v) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultPlanLimits is the configuration before any plan_limits rows apply
+func defaultPlanLimits() map[string]PlanLimits {
+	watermarked := strings.Split(getEnv("WATERMARK_PLANS", "free"), ",")
+	plan := func(name, prefix string, limit, inFlight int, mode string, retention time.Duration, batch int,
+		storageBytes int64, seats int) PlanLimits {
+		return PlanLimits{
+			Plan:          name,
+			RateLimit:     getEnvInt(prefix+"_RATE_LIMIT", limit),
+			MaxInFlight:   getEnvInt(prefix+"_MAX_IN_FLIGHT", inFlight),
+			AdmissionMode: strings.ToLower(getEnv(prefix+"_ADMISSION_MODE", mode)),
+			Watermark:     containsString(watermarked, name),
+			MaxBatch:      getEnvInt(prefix+"_MAX_BATCH", batch),
+			ModelCredits:  parseModelCredits(getEnv("MODEL_CREDIT_COSTS", "")),
+
+			RetentionSeconds: int64(getEnvDuration(prefix+"_RETENTION", retention) / time.Second),
+			StorageBytes:     int64(getEnvInt(prefix+"_STORAGE_BYTES", int(storageBytes))),
+			MaxSeats:         getEnvInt(prefix+"_MAX_SEATS", seats),
+		}
+	}
+	return map[string]PlanLimits{
+		"free": plan("free", "FREE", 10, 2, admissionDefer, 30*24*time.Hour, 1, 1<<30, 3),
+		"pro":  plan("pro", "PRO", 100, 8, admissionDefer, 0, 4, 100<<30, 10),
+		"team": plan("team", "TEAM", 500, 16, admissionReject, 0, 8, 0, 50),
+	}
+}
+
+// currentPlans is tenant ID -> plan name -> limits
+var currentPlans atomic.Pointer[map[string]map[string]PlanLimits]
+
+func init() {
+	plans := defaultTenantPlans()
+	currentPlans.Store(&plans)
+}
+
+// defaultTenantPlans gives every configured tenant the default plans
+func defaultTenantPlans() map[string]map[string]PlanLimits {
+	plans := map[string]map[string]PlanLimits{}
+	for _, t := range allTenants() {
+		plans[t.ID] = defaultPlanLimits()
+	}
+	return plans
+}
+
+// tenantPlans is the tenant's current plans; don't modify the map
+func tenantPlans(tenantID string) map[string]PlanLimits {
+	plans := *currentPlans.Load()
+	if p, ok := plans[tenantID]; ok {
+		return p
+	}
+	return plans[defaultTenantID]
+}
+
+// validatePlans checks every plan, and that there is a free plan to fall back to
+func validatePlans(plans map[string]PlanLimits) error {
+	if _, ok := plans["free"]; !ok {
+		return fmt.Errorf("%w: a free plan is required", errInvalidPlanConfig)
+	}
+	for _, l := range plans {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPlanLimits overlays each tenant's plan_limits rows on the defaults and swaps the
+// result in. An invalid configuration is rejected as a whole and the previous one kept;
+// rows of tenants no longer configured are ignored
+func loadPlanLimits(ctx context.Context) error {
+	all := defaultTenantPlans()
+	rows, err := db.QueryContext(ctx, `
+		SELECT tenant_id, plan, rate_limit, max_in_flight, admission_mode, retention_seconds, max_image_side,
+		       allowed_models, watermark, max_batch, model_credits, storage_bytes, max_seats, kind_limits
+		FROM plan_limits`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tenantID string
+		var l PlanLimits
+		var credits, kinds []byte
+		var storageBytes, seats sql.NullInt64
+		if err := rows.Scan(&tenantID, &l.Plan, &l.RateLimit, &l.MaxInFlight, &l.AdmissionMode, &l.RetentionSeconds,
+			&l.MaxImageSide, pq.Array(&l.AllowedModels), &l.Watermark, &l.MaxBatch, &credits, &storageBytes,
+			&seats, &kinds); err != nil {
+			return err
+		}
+		plans, ok := all[tenantID]
+		if !ok {
+			continue
+		}
+		// Rows saved before storage caps or seats existed keep the plan's defaults
+		l.StorageBytes, l.MaxSeats = plans[l.Plan].StorageBytes, plans[l.Plan].MaxSeats
+		if storageBytes.Valid {
+			l.StorageBytes = storageBytes.Int64
+		}
+		if seats.Valid {
+			l.MaxSeats = int(seats.Int64)
+		}
+		if err := json.Unmarshal(credits, &l.ModelCredits); err != nil {
+			return fmt.Errorf("%w: %s.model_credits: %v", errInvalidPlanConfig, l.Plan, err)
+		}
+		if err := json.Unmarshal(kinds, &l.Kinds); err != nil {
+			return fmt.Errorf("%w: %s.kinds: %v", errInvalidPlanConfig, l.Plan, err)
+		}
+		plans[l.Plan] = l
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for tenantID, plans := range all {
+		if err := validatePlans(plans); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenantID, err)
+		}
+	}
+	currentPlans.Store(&all)
+	log.Printf("📋 Loaded plan limits for %d tenants", len(all))
+	return nil
+}
+
+// startPlanReloadListener reloads whenever any instance changes the plans
+func startPlanReloadListener() {
+	ctx := context.Background()
+	pubsub := rdb.Subscribe(ctx, planReloadChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		panic(err)
+	}
+	for range pubsub.Channel() {
+		if err := loadPlanLimits(ctx); err != nil {
+			log.Printf("❌ Failed to reload plan limits, keeping the current ones: %v", err)
+		}
+	}
+}
+
+// planLimitsFor returns a tenant's plan, treating unknown plans as its free tier
+func planLimitsFor(tenantID, plan string) PlanLimits {
+	plans := tenantPlans(tenantID)
+	if l, ok := plans[plan]; ok {
+		return l
+	}
+	return plans["free"]
+}
+
+// allPlanLimits lists the tenant's current plans by name
+func allPlanLimits(tenantID string) []PlanLimits {
+	plans := tenantPlans(tenantID)
+	list := make([]PlanLimits, 0, len(plans))
+	for _, l := range plans {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Plan < list[j].Plan })
+	return list
+}
+
+type cachedPlan struct {
+	plan    string
+	tenant  string
+	expires time.Time
+}
+
+var userPlanCache sync.Map // user ID -> cachedPlan
+
+// userPlan returns the user's plan, cached for PLAN_CACHE_TTL and treating lookup
+// failures as free tier
+func userPlan(ctx context.Context, userID string) string {
+	plan, _ := userPlanTenant(ctx, userID)
+	return plan
+}
+
+// userPlanTenant is userPlan with the tenant whose plan it is, the default one when
+// the lookup fails
+func userPlanTenant(ctx context.Context, userID string) (plan, tenant string) {
+	if v, ok := userPlanCache.Load(userID); ok && time.Now().Before(v.(cachedPlan).expires) {
+		return v.(cachedPlan).plan, v.(cachedPlan).tenant
+	}
+	if err := db.QueryRowContext(ctx, `SELECT plan, tenant_id FROM users WHERE id = $1`, userID).Scan(&plan, &tenant); err != nil {
+		return "free", defaultTenantID
+	}
+	userPlanCache.Store(userID, cachedPlan{plan: plan, tenant: tenant, expires: time.Now().Add(planCacheTTL)})
+	return plan, tenant
+}
+
+// userPlanLimits resolves the limits that apply to userID right now
+func userPlanLimits(ctx context.Context, userID string) PlanLimits {
+	plan, tenant := userPlanTenant(ctx, userID)
+	return planLimitsFor(tenant, plan)
+}
+
+// listPlansHandler handles GET /admin/plans: the plans of the admin's tenant
+func listPlansHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"plans": allPlanLimits(currentTenant(c).ID), "known_models": knownModels})
+}
+
+// putPlanHandler handles PUT /admin/plans/:name with a full PlanLimits body. The change is
+// validated against the whole configuration before it's stored
+func putPlanHandler(c *gin.Context) {
+	var l PlanLimits
+	if err := c.ShouldBindJSON(&l); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	l.Plan = c.Param("name")
+	l.AdmissionMode = strings.ToLower(l.AdmissionMode)
+
+	tenant := currentTenant(c)
+	plans := map[string]PlanLimits{}
+	for k, v := range tenantPlans(tenant.ID) {
+		plans[k] = v
+	}
+	plans[l.Plan] = l
+	if err := validatePlans(plans); err != nil {
+		respondError(c, codeValidationFailed, err.Error())
+		return
+	}
+
+	if l.ModelCredits == nil {
+		l.ModelCredits = map[string]int{}
+	}
+	if l.Kinds == nil {
+		l.Kinds = map[string]KindLimits{}
+	}
+	credits, _ := json.Marshal(l.ModelCredits)
+	kinds, _ := json.Marshal(l.Kinds)
+	_, err := db.ExecContext(c.Request.Context(), `
+		INSERT INTO plan_limits (plan, rate_limit, max_in_flight, admission_mode, retention_seconds,
+		                         max_image_side, allowed_models, watermark, max_batch, model_credits, storage_bytes,
+		                         max_seats, kind_limits, tenant_id, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, now())
+		ON CONFLICT (tenant_id, plan) DO UPDATE
+		SET rate_limit = EXCLUDED.rate_limit, max_in_flight = EXCLUDED.max_in_flight,
+		    admission_mode = EXCLUDED.admission_mode, retention_seconds = EXCLUDED.retention_seconds,
+		    max_image_side = EXCLUDED.max_image_side, allowed_models = EXCLUDED.allowed_models,
+		    watermark = EXCLUDED.watermark, max_batch = EXCLUDED.max_batch,
+		    model_credits = EXCLUDED.model_credits, storage_bytes = EXCLUDED.storage_bytes,
+		    max_seats = EXCLUDED.max_seats, kind_limits = EXCLUDED.kind_limits, updated_at = now()`,
+		l.Plan, l.RateLimit, l.MaxInFlight, l.AdmissionMode, l.RetentionSeconds, l.MaxImageSide,
+		pq.Array(l.AllowedModels), l.Watermark, l.MaxBatch, credits, l.StorageBytes, l.MaxSeats, kinds, tenant.ID)
+	if err != nil {
+		log.Printf("❌ Failed to save plan %s of tenant %s: %v", l.Plan, tenant.ID, err)
+		respondError(c, codeInternal, "Failed to save plan")
+		return
+	}
+	reloadPlansEverywhere(c)
+}
+
+// reloadPlansHandler handles POST /admin/plans/reload, e.g. after editing plan_limits by hand
+func reloadPlansHandler(c *gin.Context) {
+	reloadPlansEverywhere(c)
+}
+
+func reloadPlansEverywhere(c *gin.Context) {
+	ctx := c.Request.Context()
+	if err := loadPlanLimits(ctx); err != nil {
+		if errors.Is(err, errInvalidPlanConfig) {
+			respondError(c, codeValidationFailed, err.Error())
+			return
+		}
+		log.Printf("❌ Failed to reload plan limits: %v", err)
+		respondError(c, codeInternal, "Failed to reload plans")
+		return
+	}
+	if err := rdb.Publish(ctx, planReloadChannel, "reload").Err(); err != nil {
+		log.Printf("⚠️ Failed to tell other instances to reload plans: %v", err)
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": allPlanLimits(currentTenant(c).ID)})
+}
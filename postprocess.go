@@ -0,0 +1,356 @@
+// postprocess.go
+// Watermarking and provenance metadata applied to images after completion
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	postprocessPendingKey  = "postprocess:pending"
+	postprocessAttemptsKey = "postprocess:attempts"
+)
+
+var (
+	watermarkText    = getEnv("WATERMARK_TEXT", "mobart")
+	watermarkCorner  = getEnv("WATERMARK_CORNER", "bottom-right") // top-left, top-right, bottom-left, bottom-right
+	watermarkOpacity = getEnvInt("WATERMARK_OPACITY", 160)        // 0-255
+
+	postprocessRetryInterval = getEnvDuration("POSTPROCESS_RETRY_INTERVAL", 10*time.Minute)
+	postprocessMaxAttempts   = getEnvInt("POSTPROCESS_MAX_ATTEMPTS", 5)
+)
+
+var (
+	errNotPNG  = errors.New("not a PNG image")
+	errNotJPEG = errors.New("not a JPEG image")
+)
+
+// generationMeta is what we embed in the image and use to decide on a watermark
+type generationMeta struct {
+	UserID string
+	Prompt string
+	Model  string
+	Plan   string
+	Tenant string
+
+	ContentType string
+}
+
+func loadGenerationMeta(ctx context.Context, requestID string) (*generationMeta, error) {
+	var m generationMeta
+	err := db.QueryRowContext(ctx, `
+		SELECT g.user_id, g.prompt, g.model, u.plan, g.content_type, g.tenant_id
+		FROM generated_content g
+		JOIN users u ON u.id = g.user_id
+		WHERE g.request_id = $1`, requestID).Scan(&m.UserID, &m.Prompt, &m.Model, &m.Plan, &m.ContentType, &m.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptPrompts(&m.Prompt); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// runPostprocess processes a completed image, parking it for the retry job on failure
+func runPostprocess(ctx context.Context, requestID, s3Key string) {
+	if err := postprocessGeneration(ctx, requestID, s3Key); err != nil {
+		log.Printf("⚠️ Post-processing failed for request %s, will retry: %v", requestID, err)
+		postprocessResults.WithLabelValues("failed").Inc()
+		if err := rdb.HSet(ctx, postprocessPendingKey, requestID, s3Key).Err(); err != nil {
+			log.Printf("❌ Failed to schedule post-processing retry for %s: %v", requestID, err)
+		}
+		return
+	}
+	postprocessResults.WithLabelValues("ok").Inc()
+}
+
+// postprocessGeneration downloads the image, watermarks it for the free tier,
+// embeds provenance metadata, re-uploads it and points the row at the new key
+func postprocessGeneration(ctx context.Context, requestID, s3Key string) error {
+	meta, err := loadGenerationMeta(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	// Videos go out as the worker produced them
+	if meta.ContentType != "image" {
+		return nil
+	}
+
+	original, err := storage.Get(ctx, s3Key)
+	if err != nil {
+		return err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+	if planWatermarked(meta.Tenant, meta.Plan) {
+		img = applyWatermark(img, watermarkText)
+		// The worker's smaller copies aren't watermarked; serve the original and our own
+		// thumbnail of it instead. storeRenditions skipped them, unless the plan changed since
+		for _, kind := range []string{renditionWeb, renditionThumbnail} {
+			if err := dropRendition(ctx, requestID, kind); err != nil {
+				return err
+			}
+		}
+	}
+
+	// JPEGs stay JPEGs with an EXIF block; anything else is re-encoded as a PNG, whose
+	// text chunks carry the same fields
+	var buf bytes.Buffer
+	var processed []byte
+	ext, contentType := ".png", "image/png"
+	if format == "jpeg" {
+		ext, contentType = ".jpg", "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return err
+		}
+		processed, err = addJPEGExif(buf.Bytes(), meta.Prompt, meta.Model, requestID)
+	} else {
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		processed, err = addPNGTextChunks(buf.Bytes(), [][2]string{
+			{"Title", meta.Prompt},
+			{"Model", meta.Model},
+			{"RequestID", requestID},
+			{"Software", "mobart"},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	newKey := strings.TrimSuffix(s3Key, path.Ext(s3Key)) + "-final" + ext
+	if err := storage.Put(ctx, newKey, processed, contentType); err != nil {
+		return err
+	}
+	// A missing thumbnail is left to the "thumbnails" backfill rather than failing the image
+	if err := storeThumbnail(ctx, requestID, newKey, img); err != nil {
+		log.Printf("⚠️ Failed to create thumbnail for %s: %v", requestID, err)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE generated_content SET content_url = $1, postprocessed_at = now()
+		WHERE request_id = $2`, newKey, requestID)
+	if err == nil {
+		log.Printf("🖼️ Post-processed request %s -> %s", requestID, newKey)
+	}
+	return err
+}
+
+func planWatermarked(tenantID, plan string) bool {
+	return planLimitsFor(tenantID, plan).Watermark
+}
+
+// applyWatermark draws text into the configured corner with a 1px shadow for contrast
+func applyWatermark(src image.Image, text string) image.Image {
+	b := src.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	face := basicfont.Face7x13
+	const margin = 4
+	width := font.MeasureString(face, text).Ceil()
+	height := face.Metrics().Height.Ceil()
+
+	x, y := b.Max.X-width-margin, b.Max.Y-margin
+	switch watermarkCorner {
+	case "top-left":
+		x, y = b.Min.X+margin, b.Min.Y+height+margin
+	case "top-right":
+		y = b.Min.Y + height + margin
+	case "bottom-left":
+		x = b.Min.X + margin
+	}
+
+	alpha := uint8(watermarkOpacity)
+	for _, layer := range []struct {
+		offset int
+		c      color.Color
+	}{
+		{1, color.NRGBA{0, 0, 0, alpha}},
+		{0, color.NRGBA{255, 255, 255, alpha}},
+	} {
+		d := &font.Drawer{
+			Dst:  dst,
+			Src:  image.NewUniform(layer.c),
+			Face: face,
+			Dot:  fixed.P(x+layer.offset, y+layer.offset),
+		}
+		d.DrawString(text)
+	}
+	return dst
+}
+
+// addPNGTextChunks inserts uncompressed iTXt chunks (UTF-8 safe) right after IHDR
+func addPNGTextChunks(data []byte, entries [][2]string) ([]byte, error) {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.Equal(data[:8], []byte("\x89PNG\r\n\x1a\n")) || string(data[12:16]) != "IHDR" {
+		return nil, errNotPNG
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:ihdrEnd])
+	for _, e := range entries {
+		// keyword \0 compression-flag compression-method language \0 translated-keyword \0 text
+		payload := append([]byte(e[0]), 0, 0, 0, 0, 0)
+		payload = append(payload, e[1]...)
+		writePNGChunk(&out, "iTXt", payload)
+	}
+	out.Write(data[ihdrEnd:])
+	return out.Bytes(), nil
+}
+
+func writePNGChunk(w *bytes.Buffer, chunkType string, payload []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	w.Write(length[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	w.WriteString(chunkType)
+	w.Write(payload)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	w.Write(sum[:])
+}
+
+// exifEntry is one IFD field; data is its value, already encoded little-endian
+type exifEntry struct {
+	tag, kind uint16 // kind is the TIFF field type: 2 ASCII, 4 LONG, 7 UNDEFINED
+	count     uint32
+	data      []byte
+}
+
+func exifASCII(tag uint16, s string) exifEntry {
+	return exifEntry{tag: tag, kind: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+// addJPEGExif inserts an APP1 EXIF block right after SOI: the prompt as ImageDescription,
+// the model as Model and the request in the EXIF UserComment. Text is written as UTF-8,
+// which readers accept in ASCII fields
+func addJPEGExif(data []byte, prompt, model, requestID string) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errNotJPEG
+	}
+	comment := append([]byte("ASCII\x00\x00\x00"), "RequestID: "+requestID...)
+	exifIFD := []exifEntry{{tag: 0x9286, kind: 7, count: uint32(len(comment)), data: comment}}
+	ifd0 := []exifEntry{
+		exifASCII(0x010E, prompt),
+		exifASCII(0x0110, model),
+		exifASCII(0x0131, "mobart"),
+		{tag: 0x8769, kind: 4, count: 1, data: make([]byte, 4)},
+	}
+	// The ExifIFD pointer doesn't change IFD0's size, so lay IFD0 out once to find where
+	// the EXIF IFD starts
+	const ifd0Offset = 8
+	exifOffset := ifd0Offset + uint32(len(encodeIFD(ifd0, ifd0Offset)))
+	binary.LittleEndian.PutUint32(ifd0[3].data, exifOffset)
+
+	tiff := append([]byte("II*\x00\x08\x00\x00\x00"), encodeIFD(ifd0, ifd0Offset)...)
+	tiff = append(tiff, encodeIFD(exifIFD, exifOffset)...)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	if len(segment)+2 > 0xFFFF {
+		return nil, errors.New("EXIF block too large")
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(data[2:])
+	return out.Bytes(), nil
+}
+
+// encodeIFD lays out one IFD at offset within the TIFF block, with the values that don't
+// fit in an entry following it. Entries must be sorted by tag
+func encodeIFD(entries []exifEntry, offset uint32) []byte {
+	le := binary.LittleEndian
+	head := make([]byte, 2+12*len(entries)+4) // the trailing 0 says there's no next IFD
+	le.PutUint16(head, uint16(len(entries)))
+	var values []byte
+	valuesAt := offset + uint32(len(head))
+	for i, e := range entries {
+		field := head[2+12*i:]
+		le.PutUint16(field[0:], e.tag)
+		le.PutUint16(field[2:], e.kind)
+		le.PutUint32(field[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(field[8:12], e.data)
+			continue
+		}
+		le.PutUint32(field[8:], valuesAt+uint32(len(values)))
+		values = append(values, e.data...)
+		if len(values)%2 == 1 {
+			values = append(values, 0) // values start on a word boundary
+		}
+	}
+	return append(head, values...)
+}
+
+// startPostprocessBackfill periodically retries generations whose post-processing failed
+func startPostprocessBackfill() {
+	ticker := time.NewTicker(postprocessRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("postprocess_backfill", nil, func() {
+			retryPendingPostprocess(backgroundStorage(context.Background()))
+		})
+	}
+}
+
+func retryPendingPostprocess(ctx context.Context) {
+	pending, err := rdb.HGetAll(ctx, postprocessPendingKey).Result()
+	if err != nil {
+		log.Printf("❌ Failed to load pending post-processing: %v", err)
+		return
+	}
+	postprocessPending.Set(float64(len(pending)))
+
+	for requestID, s3Key := range pending {
+		attempts, err := rdb.HIncrBy(ctx, postprocessAttemptsKey, requestID, 1).Result()
+		if err != nil {
+			log.Printf("❌ Failed to count post-processing attempt for %s: %v", requestID, err)
+			continue
+		}
+
+		if err := postprocessGeneration(ctx, requestID, s3Key); err != nil {
+			if attempts < int64(postprocessMaxAttempts) {
+				postprocessResults.WithLabelValues("retried").Inc()
+				continue
+			}
+			log.Printf("❌ Giving up post-processing request %s after %d attempts: %v", requestID, attempts, err)
+			postprocessResults.WithLabelValues("gave_up").Inc()
+		} else {
+			postprocessResults.WithLabelValues("ok").Inc()
+			recordGenerationStorage(ctx, requestID)
+		}
+		rdb.HDel(ctx, postprocessPendingKey, requestID)
+		rdb.HDel(ctx, postprocessAttemptsKey, requestID)
+	}
+}
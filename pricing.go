@@ -0,0 +1,142 @@
+// pricing.go
+// The one cost calculator: POST /generations/estimate quotes with it and POST /generations
+// charges with it, so an estimate is always what the same request would be charged
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxResolution = 4096
+	maxSteps      = 150
+	maxNumImages  = 8
+)
+
+var (
+	// A plan's model credits price one image at these settings; other settings scale from here
+	defaultImageResolution = getEnvInt("DEFAULT_IMAGE_RESOLUTION", 1024)
+	defaultSteps           = getEnvInt("DEFAULT_STEPS", 30)
+)
+
+// Quote is the price and expected runtime of a request under the user's plan
+type Quote struct {
+	Model            string  `json:"model"`
+	Resolution       int     `json:"resolution,omitempty"`
+	Steps            int     `json:"steps,omitempty"`
+	NumImages        int     `json:"num_images"`
+	Credits          int     `json:"credits"`
+	EstimatedSeconds float64 `json:"estimated_seconds"` // generation only, not queue wait
+
+	// Problems lists the plan limits the request breaks; it is refused while non-empty
+	Problems []string `json:"problems,omitempty"`
+}
+
+// parseModelCredits reads "model=credits,..." as used by MODEL_CREDIT_COSTS
+func parseModelCredits(spec string) map[string]int {
+	credits := map[string]int{}
+	for _, kv := range strings.Split(spec, ",") {
+		model, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		var n int
+		if !ok || model == "" {
+			continue
+		}
+		if _, err := fmt.Sscan(v, &n); err != nil {
+			log.Printf("⚠️ Ignoring bad MODEL_CREDIT_COSTS entry %q", kv)
+			continue
+		}
+		credits[model] = n
+	}
+	return credits
+}
+
+// baseCredits is the plan's price for one unit of work on the spec's model
+func baseCredits(k *GenerationKind, spec generationSpec, limits PlanLimits) int {
+	if n, ok := limits.ModelCredits[spec.Model]; ok {
+		return n
+	}
+	return k.BaseCredits()
+}
+
+// quoteGeneration prices spec for limits; the kind's Cost decides what a unit of work is
+func quoteGeneration(ctx context.Context, spec generationSpec, limits PlanLimits) Quote {
+	q := Quote{Model: spec.Model, Steps: spec.Steps, NumImages: max(spec.NumImages, 1)}
+	if !limits.allowsModel(spec.Model) {
+		q.Problems = append(q.Problems, spec.Label+" generation with "+spec.Model+" isn't included in your plan")
+	}
+	k, _ := generationKind(spec.Kind)
+	units := k.Cost(&q, spec, limits)
+	if base := baseCredits(k, spec, limits); base > 0 {
+		// Round up, but don't let float noise turn an exact 4 into 5
+		q.Credits = max(int(math.Ceil(float64(base)*units-1e-9)), 1)
+	}
+	q.EstimatedSeconds = math.Round(averageGenerationSeconds(ctx, spec.Model)*units*10) / 10
+	return q
+}
+
+// creditBalance is what the request would be charged against: the org pool or the user's own
+func creditBalance(ctx context.Context, userID, orgID string) (balance int, err error) {
+	if orgID != "" {
+		err = db.QueryRowContext(ctx, `SELECT credits FROM organizations WHERE id = $1`, orgID).Scan(&balance)
+	} else {
+		err = db.QueryRowContext(ctx, `SELECT credits FROM users WHERE id = $1`, userID).Scan(&balance)
+	}
+	return balance, err
+}
+
+// estimateGenerationHandler handles POST /generations/estimate with the POST /generations
+// body. Nothing is charged or queued; limits the request breaks come back as problems
+func estimateGenerationHandler(c *gin.Context) {
+	req, ok := bindGenerationRequest(c)
+	if !ok {
+		return
+	}
+	k, ok := kindFor(c, req.RequestType)
+	if !ok {
+		return
+	}
+	if !k.queued() {
+		fieldError(c, codeValidationFailed, "request_type", "estimates are for queued types, not "+k.Name)
+		return
+	}
+	spec, ok := queuedGenerationSpec(c, req)
+	if !ok {
+		return
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+	if !checkGenerationRequest(c, user.ID.String(), req, spec) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	limits := userPlanLimits(ctx, user.ID.String())
+	// Over the cap without auto_downscale stays a problem in the quote
+	downscaleResolution(&spec, limits, req.AutoDownscale)
+	quote := quoteGeneration(ctx, spec, limits)
+	if modelRefused(ctx, spec.Model) {
+		quote.Problems = append(quote.Problems, spec.Label+" generation is temporarily unavailable")
+	}
+	balance, err := creditBalance(ctx, user.ID.String(), req.OrgID)
+	if err != nil {
+		log.Printf("❌ Failed to load credit balance for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to estimate "+spec.Kind+" generation")
+		return
+	}
+	if balance < quote.Credits {
+		quote.Problems = append(quote.Problems, fmt.Sprintf("needs %d credits, the balance is %d", quote.Credits, balance))
+	}
+
+	resp := gin.H{"quote": quote, "balance": balance, "allowed": len(quote.Problems) == 0}
+	if eta, err := completionETA(ctx, spec.Model); err == nil {
+		resp["eta"] = eta
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,136 @@
+// processed_effects.go
+// Exactly-once side effects for completions. A completion can be applied many times: by
+// the listener, from the retry buffer, from the DLQ or on archive replay. The row's own
+// write is versioned, and each side effect it triggers (refund, notification, in-app
+// event, post-processing, embedding, referral, SLO count, retry) is claimed in
+// processed_effects under (request_id, effect_type) before it fires, in the same
+// transaction as its enqueue when it lands in Postgres. Writing the result claims
+// "result" too, so a later run of the same completion finds the row already done and
+// goes on to whichever effects the earlier run didn't get to, skipping the rest.
+// handleCompletion is therefore safe to run any number of times, and a replay reports
+// which effects it applied and which it skipped
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Effect types. effectResult marks the row's terminal write itself
+const (
+	effectResult           = "result"
+	effectRefund           = "refund"
+	effectDetails          = "details"     // the kind's ApplyCompleted
+	effectPostprocess      = "postprocess" // watermark, provenance and thumbnail
+	effectEmbedding        = "embedding"
+	effectReferral         = "referral"
+	effectSLO              = "slo"
+	effectFailureStats     = "failure_stats" // failure streaks and the SLO
+	effectEvent            = "event"
+	effectNotification     = "notification"
+	effectLateEvent        = "late_event"
+	effectLateNotification = "late_notification"
+	effectRetry            = "retry" // suffixed with the failure's timestamp, since a request may retry more than once
+)
+
+var processedEffects = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_completion_effects_total",
+	Help: "Completion side effects, by effect and outcome (applied, skipped as already done, failed).",
+}, []string{"effect", "outcome"})
+
+// execer is *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// claimEffect records requestID's effect on q, reporting false when it was recorded before
+func claimEffect(ctx context.Context, q execer, requestID, effect string) (bool, error) {
+	res, err := q.ExecContext(ctx, `
+		INSERT INTO processed_effects (request_id, effect_type) VALUES ($1, $2)
+		ON CONFLICT (request_id, effect_type) DO NOTHING`, requestID, effect)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// completionEffects is what one run of handleCompletion did with each side effect
+type completionEffects struct {
+	requestID string
+	Applied   []string `json:"applied"`
+	Skipped   []string `json:"skipped"` // already done by an earlier run
+}
+
+func newCompletionEffects(requestID string) *completionEffects {
+	return &completionEffects{requestID: requestID, Applied: []string{}, Skipped: []string{}}
+}
+
+// note records the outcome of an effect claimed elsewhere, e.g. with the row's write
+func (fx *completionEffects) note(effect string, applied bool) {
+	if applied {
+		processedEffects.WithLabelValues(effect, "applied").Inc()
+		fx.Applied = append(fx.Applied, effect)
+		return
+	}
+	processedEffects.WithLabelValues(effect, "skipped").Inc()
+	fx.Skipped = append(fx.Skipped, effect)
+}
+
+// once fires effect unless an earlier run already did. fn runs inside the transaction
+// that claims it: effects enqueued in Postgres write through tx, so the claim and the
+// enqueue commit together, and an error from fn rolls the claim back for the next run.
+// Effects outside Postgres fire before the commit, so only a commit failing after them
+// can repeat one
+func (fx *completionEffects) once(ctx context.Context, effect string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	claimed, err := claimEffect(ctx, tx, fx.requestID, effect)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		fx.note(effect, false)
+		return nil
+	}
+	if err := fn(tx); err != nil {
+		processedEffects.WithLabelValues(effect, "failed").Inc()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fx.note(effect, true)
+	return nil
+}
+
+// run is once for effects that carry on regardless: a failure is logged, and left
+// unclaimed for the next run of the completion
+func (fx *completionEffects) run(ctx context.Context, effect string, fn func(tx *sql.Tx) error) {
+	if err := fx.once(ctx, effect, fn); err != nil {
+		log.Printf("⚠️ Side effect %s of request %s failed: %v", effect, fx.requestID, err)
+	}
+}
+
+// recordedResult reads back a row whose result an earlier run wrote; status is empty
+// when none did
+func recordedResult(ctx context.Context, requestID string) (contentType, status string, late bool, err error) {
+	err = db.QueryRowContext(ctx, `
+		SELECT g.content_type, g.status, g.late_result AND g.status = 'timed_out'
+		FROM generated_content g
+		JOIN processed_effects e ON e.request_id = g.request_id AND e.effect_type = $2
+		WHERE g.request_id = $1`, requestID, effectResult).Scan(&contentType, &status, &late)
+	if err == sql.ErrNoRows {
+		return "", "", false, nil
+	}
+	return contentType, status, late, err
+}
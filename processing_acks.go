@@ -0,0 +1,172 @@
+// processing_acks.go
+// The worker's "processing" acknowledgement: a message with that status (and started_at)
+// moves the row from queued to processing and records when and by whom it was picked
+// up, which gives the queue-wait metric. A completion that got there first keeps its
+// status, since processing may only follow queued. With acks, the stale sweeper can tell
+// a request no worker picked up (republished, up to STALE_QUEUED_MAX_REQUEUES times)
+// from one whose worker died mid-job (failed and refunded). The ack also starts the
+// worker's lease, and with leases a job is only taken as lost once its lease runs out
+// (see leases.go)
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const staleSweepLockKey = "stale:sweep:lock"
+
+var (
+	// Until every worker sends acks, a queued row without one proves nothing
+	workerProcessingAcks = getEnvBool("WORKER_PROCESSING_ACKS", false)
+
+	staleSweepInterval     = getEnvDuration("STALE_SWEEP_INTERVAL", time.Minute)
+	staleQueuedAfter       = getEnvDuration("STALE_QUEUED_AFTER", 10*time.Minute)
+	staleQueuedMaxRequeues = getEnvInt("STALE_QUEUED_MAX_REQUEUES", 2)
+	staleProcessingAfter   = getEnvDuration("STALE_PROCESSING_AFTER", 30*time.Minute)
+
+	queueWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mobart_queue_wait_seconds",
+		Help:    "Time from a request's creation to a worker acknowledging it, by model.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"model"})
+	staleRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_stale_requests_total",
+		Help: "Requests the stale sweeper acted on, by action (requeued, never_picked_up, worker_lost).",
+	}, []string{"action"})
+)
+
+// handleProcessingAck applies a worker's pick-up acknowledgement. A repeat, or one
+// arriving after the result, is not applied and isn't an error
+func handleProcessingAck(completion ImageGenerationCompletion) error {
+	ctx := context.Background()
+	startedAt := clock.Now()
+	// Trust the worker's clock only as far as it isn't in our future
+	if completion.StartedAt != nil && completion.StartedAt.Before(startedAt) {
+		startedAt = *completion.StartedAt
+	}
+
+	var model string
+	var createdAt time.Time
+	applied, err := transitionGeneration(ctx, completion.RequestID, generationWrite{
+		Writer: "listener", To: "processing", From: []string{"queued"},
+		Set:       "started_at = $4, started_by = nullif($5, '')",
+		Args:      []interface{}{startedAt, completion.WorkerID},
+		Returning: "model, created_at",
+		Scan:      func(row rowScanner) error { return row.Scan(&model, &createdAt) },
+	})
+	if err != nil {
+		log.Printf("❌ Failed to mark request %s as processing: %v", completion.RequestID, err)
+		return err
+	}
+	if !applied {
+		log.Printf("🔁 Ignoring processing ack for request %s, which has moved on", completion.RequestID)
+		return nil
+	}
+	listenerActivity.dbUpdated()
+	startLease(ctx, completion.RequestID, completion.WorkerID, completion.LeaseToken)
+	notifyWebhookEvent(ctx, completion.RequestID, "processing", 0)
+	queueWaitSeconds.WithLabelValues(model).Observe(max(startedAt.Sub(createdAt).Seconds(), 0))
+	log.Printf("⚙️ Worker %s started request %s", completion.WorkerID, completion.RequestID)
+	return nil
+}
+
+// startStaleSweeper acts on Redis-dispatched requests left hanging, on one instance at a time
+func startStaleSweeper() {
+	ticker := time.NewTicker(staleSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("stale_sweeper", nil, func() {
+			ctx := context.Background()
+			ok, err := rdb.SetNX(ctx, staleSweepLockKey, "1", staleSweepInterval).Result()
+			if err != nil || !ok {
+				return
+			}
+			defer rdb.Del(ctx, staleSweepLockKey)
+			if workerProcessingAcks {
+				sweepUnacknowledged(ctx)
+			}
+			sweepLostWorkers(ctx)
+		})
+	}
+}
+
+// sweepUnacknowledged republishes queued requests no worker acknowledged within
+// STALE_QUEUED_AFTER of being dispatched, and fails those that used up their requeues
+func sweepUnacknowledged(ctx context.Context) {
+	ids, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content
+		WHERE status = 'queued' AND dispatch = 'redis' AND started_at IS NULL
+		  AND dispatched_at < now() - $1 * interval '1 second'`, staleQueuedAfter.Seconds())
+	if err != nil {
+		log.Printf("❌ Failed to sweep unacknowledged requests: %v", err)
+		return
+	}
+	for _, id := range ids {
+		g, err := scanQueuedGeneration(db.QueryRowContext(ctx, `
+			UPDATE generated_content SET stale_requeues = stale_requeues + 1
+			WHERE request_id = $1 AND status = 'queued' AND dispatch = 'redis' AND started_at IS NULL
+			  AND stale_requeues < $2
+			RETURNING `+queuedColumns, id, staleQueuedMaxRequeues))
+		if err == nil {
+			staleRequests.WithLabelValues("requeued").Inc()
+			log.Printf("🔁 Request %s was never picked up; publishing it again", id)
+			if err := publishGenerationRequest(g.channel(), g.request()); err != nil {
+				log.Printf("⚠️ Failed to republish unacknowledged request %s: %v", id, err)
+			}
+			continue
+		}
+		failStaleRequest(ctx, id, "queued", "never_picked_up", "no worker picked up the request")
+	}
+}
+
+// sweepLostWorkers fails and refunds requests whose worker acknowledged them and then
+// let its lease run out, or without a lease, went quiet for STALE_PROCESSING_AFTER. HTTP
+// claims have their own expiry (job_pull.go)
+func sweepLostWorkers(ctx context.Context) {
+	after := staleProcessingAfter
+	if workerLeases {
+		after = min(after, workerLeaseTTL)
+	}
+	ids, err := lapsedJobs(ctx, "redis", `
+		SELECT request_id, started_at < now() - $1 * interval '1 second' FROM generated_content
+		WHERE status = 'processing' AND dispatch = 'redis'
+		  AND started_at < now() - $2 * interval '1 second'`, staleProcessingAfter.Seconds(), after.Seconds())
+	if err != nil {
+		log.Printf("❌ Failed to sweep lost workers: %v", err)
+		return
+	}
+	for _, id := range ids {
+		failStaleRequest(ctx, id, "processing", "worker_lost", "the worker stopped responding")
+	}
+}
+
+func failStaleRequest(ctx context.Context, requestID, from, action, reason string) {
+	var userID string
+	applied, err := transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "stale_sweeper", To: "failed", From: []string{from}, Where: "dispatch = 'redis'",
+		Set:       "completed_at = now(), error = $4",
+		Args:      []interface{}{reason},
+		Returning: "user_id",
+		Scan:      func(row rowScanner) error { return row.Scan(&userID) },
+		Refund:    "failed",
+	})
+	if err != nil {
+		log.Printf("❌ Failed to fail stale request %s: %v", requestID, err)
+		return
+	}
+	if !applied {
+		return
+	}
+	staleRequests.WithLabelValues(action).Inc()
+	releaseAdmission(ctx, userID, requestID)
+	broadcastEvent(ctx, Event{Type: eventFailed, RequestID: requestID, UserID: userID,
+		Data: map[string]interface{}{"error": reason}})
+	log.Printf("🪫 Request %s failed: %s", requestID, reason)
+}
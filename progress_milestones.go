@@ -0,0 +1,202 @@
+// progress_milestones.go
+// Durable progress. The live percentage stays in Redis (recordProgress in video.go), but
+// each time a job crosses 25, 50, 75 or 100% the milestone is also written to its row, so
+// a request's progress outlives the key's TTL and shows while Redis is down. Workers report
+// progress several times a second per job, so milestones go through a write-behind buffer:
+// a request's updates coalesce into its highest milestone, and the buffer is written in a
+// single UPDATE once PROGRESS_FLUSH_BATCH requests are waiting or every
+// PROGRESS_FLUSH_INTERVAL, and once more on shutdown. Database writes grow with the number
+// of jobs, not the number of progress events
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	progressFlushBatch    = getEnvInt("PROGRESS_FLUSH_BATCH", 500)
+	progressFlushInterval = getEnvDuration("PROGRESS_FLUSH_INTERVAL", 2*time.Second)
+)
+
+// progressMilestones are the percentages worth a database write
+var progressMilestones = []int{25, 50, 75, 100}
+
+var (
+	progressFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_progress_flushes_total",
+		Help: "Progress milestone buffer flushes, by trigger (size, interval, shutdown) and result.",
+	}, []string{"trigger", "result"})
+
+	progressMilestoneWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_progress_milestone_writes_total",
+		Help: "Rows given a new progress milestone.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mobart_progress_buffer_depth",
+		Help: "Requests with a progress milestone waiting to be written.",
+	}, func() float64 { depth, _ := milestoneBuffer.stats(); return float64(depth) })
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mobart_progress_buffer_oldest_seconds",
+		Help: "Age of the oldest progress milestone waiting to be written.",
+	}, func() float64 { _, age := milestoneBuffer.stats(); return age.Seconds() })
+)
+
+// progressMilestone is the highest milestone percent has reached, 0 for none
+func progressMilestone(percent float64) int {
+	reached := 0
+	for _, m := range progressMilestones {
+		if percent >= float64(m) {
+			reached = m
+		}
+	}
+	return reached
+}
+
+type pendingMilestone struct {
+	milestone int
+	since     time.Time // when the request's first unwritten milestone arrived
+}
+
+type progressBuffer struct {
+	mu      sync.Mutex
+	pending map[string]pendingMilestone
+	full    chan struct{} // nudges the flusher once the batch size is reached
+}
+
+var milestoneBuffer = &progressBuffer{pending: map[string]pendingMilestone{}, full: make(chan struct{}, 1)}
+
+// add queues requestID's milestone, keeping the higher one if it already has one queued
+func (b *progressBuffer) add(requestID string, milestone int, since time.Time) {
+	b.mu.Lock()
+	p, ok := b.pending[requestID]
+	if !ok || since.Before(p.since) {
+		p.since = since
+	}
+	if milestone > p.milestone {
+		p.milestone = milestone
+	}
+	b.pending[requestID] = p
+	full := len(b.pending) >= progressFlushBatch
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take empties the buffer, returning what was in it
+func (b *progressBuffer) take() map[string]pendingMilestone {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch := b.pending
+	b.pending = map[string]pendingMilestone{}
+	return batch
+}
+
+// stats is the buffer's depth and the age of its oldest entry
+func (b *progressBuffer) stats() (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var oldest time.Time
+	for _, p := range b.pending {
+		if oldest.IsZero() || p.since.Before(oldest) {
+			oldest = p.since
+		}
+	}
+	if oldest.IsZero() {
+		return 0, 0
+	}
+	return len(b.pending), clock.Now().Sub(oldest)
+}
+
+// queueProgressMilestone records that requestID went from previous to percent, buffering
+// a write when that crossed a milestone
+func queueProgressMilestone(requestID string, previous, percent float64) {
+	if m := progressMilestone(percent); m > progressMilestone(previous) {
+		milestoneBuffer.add(requestID, m, clock.Now())
+	}
+}
+
+// flushProgressMilestones writes everything buffered in one statement. Rows that finished
+// meanwhile, or already hold a higher milestone, are left alone. A failed flush puts the
+// batch back, where it coalesces with anything newer, for the next flush to retry. Each
+// milestone written is a progress event for the request's webhooks
+func flushProgressMilestones(ctx context.Context, trigger string) error {
+	batch := milestoneBuffer.take()
+	if len(batch) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(batch))
+	milestones := make([]int64, 0, len(batch))
+	for id, p := range batch {
+		ids = append(ids, id)
+		milestones = append(milestones, int64(p.milestone))
+	}
+	rows, err := db.QueryContext(ctx, `
+		UPDATE generated_content g SET progress_milestone = v.milestone
+		FROM unnest($1::text[], $2::int[]) AS v (request_id, milestone)
+		WHERE g.request_id = v.request_id AND g.status IN ('queued', 'processing')
+		  AND coalesce(g.progress_milestone, 0) < v.milestone
+		RETURNING g.request_id, v.milestone`,
+		pq.Array(ids), pq.Array(milestones))
+	if err != nil {
+		for id, p := range batch {
+			milestoneBuffer.add(id, p.milestone, p.since)
+		}
+		progressFlushes.WithLabelValues(trigger, "error").Inc()
+		return err
+	}
+	defer rows.Close()
+	written := map[string]int{}
+	for rows.Next() {
+		var id string
+		var milestone int
+		if err := rows.Scan(&id, &milestone); err != nil {
+			return err
+		}
+		written[id] = milestone
+	}
+	// The writes stand even if reading them back failed, so nothing goes back in the buffer
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	progressMilestoneWrites.Add(float64(len(written)))
+	for id, milestone := range written {
+		notifyWebhookEvent(ctx, id, "progress", milestone)
+	}
+	progressFlushes.WithLabelValues(trigger, "ok").Inc()
+	return nil
+}
+
+// startProgressFlusher flushes the milestone buffer on its interval and whenever it fills
+func startProgressFlusher() {
+	ticker := time.NewTicker(progressFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		trigger := "interval"
+		select {
+		case <-ticker.C:
+		case <-milestoneBuffer.full:
+			trigger = "size"
+		}
+		runWithRecovery("progress_flusher", nil, func() {
+			if err := flushProgressMilestones(context.Background(), trigger); err != nil {
+				log.Printf("⚠️ Failed to write progress milestones: %v", err)
+			}
+		})
+	}
+}
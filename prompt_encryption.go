@@ -0,0 +1,263 @@
+// prompt_encryption.go
+// Application-level encryption of prompts at rest: generated_content's prompt columns,
+// text rows included, and conversation titles and turns. Ciphertext carries its key ID
+// ("enc:<id>:<base64>") so keys can rotate: the first key in PROMPT_ENCRYPTION_KEYS
+// encrypts, all of them decrypt, and the "encrypt_prompts" and "encrypt_conversations"
+// backfills re-encrypt old rows. Plaintext that itself starts with "enc:" is stored as
+// "enc::<plaintext>"; key IDs are never empty, so it can't be taken for ciphertext.
+//
+// Encrypted prompts can't be searched in SQL. Any future prompt search must index a
+// redacted or keyword-extracted copy rather than the prompt itself; deployments
+// without PROMPT_ENCRYPTION_KEYS keep plaintext.
+
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	encryptedPromptPrefix = "enc:"
+	escapedPromptPrefix   = encryptedPromptPrefix + ":" // an empty key ID: plaintext follows
+)
+
+var (
+	promptKeys        = map[string]cipher.AEAD{}
+	promptActiveKeyID string
+
+	errUnknownPromptKey = errors.New("prompt encrypted with an unknown key")
+	errPromptsPlaintext = errors.New("prompt encryption is not configured")
+)
+
+func init() {
+	// "2:base64key,1:base64key" - newest first
+	raw := getEnv("PROMPT_ENCRYPTION_KEYS", "")
+	if raw == "" {
+		return
+	}
+	for i, entry := range strings.Split(raw, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" || strings.Contains(id, ":") {
+			log.Fatalf("❌ PROMPT_ENCRYPTION_KEYS entries must be <id>:<base64 key>")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			log.Fatalf("❌ Invalid prompt encryption key %q: %v", id, err)
+		}
+		promptKeys[id] = aead
+		if i == 0 {
+			promptActiveKeyID = id
+		}
+	}
+	log.Printf("🔐 Prompt encryption enabled (active key %s, %d keys)", promptActiveKeyID, len(promptKeys))
+}
+
+// encryptPrompt only escapes plaintext that looks encrypted when encryption isn't configured
+func encryptPrompt(prompt string) (string, error) {
+	if promptActiveKeyID == "" || prompt == "" {
+		if strings.HasPrefix(prompt, encryptedPromptPrefix) {
+			return escapedPromptPrefix + prompt, nil
+		}
+		return prompt, nil
+	}
+	sealed, err := sealString(promptKeys[promptActiveKeyID], prompt)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPromptPrefix + promptActiveKeyID + ":" + sealed, nil
+}
+
+// decryptPrompt passes plaintext (rows written before encryption) through unchanged
+func decryptPrompt(stored string) (string, error) {
+	if plain, ok := strings.CutPrefix(stored, escapedPromptPrefix); ok {
+		return plain, nil
+	}
+	rest, ok := strings.CutPrefix(stored, encryptedPromptPrefix)
+	if !ok {
+		return stored, nil
+	}
+	id, sealed, _ := strings.Cut(rest, ":")
+	aead, ok := promptKeys[id]
+	if !ok {
+		return "", fmt.Errorf("%w %q", errUnknownPromptKey, id)
+	}
+	return openString(aead, sealed)
+}
+
+// decryptPrompts decrypts several columns in place
+func decryptPrompts(fields ...*string) error {
+	for _, f := range fields {
+		plain, err := decryptPrompt(*f)
+		if err != nil {
+			return err
+		}
+		*f = plain
+	}
+	return nil
+}
+
+// reencryptFields decrypts the columns in place and seals them again under the active key
+func reencryptFields(fields ...*string) error {
+	if err := decryptPrompts(fields...); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		sealed, err := encryptPrompt(*f)
+		if err != nil {
+			return err
+		}
+		*f = sealed
+	}
+	return nil
+}
+
+// reencryptPrompts brings one row's prompts onto the active key
+func reencryptPrompts(ctx context.Context, requestID string) error {
+	if promptActiveKeyID == "" {
+		return errPromptsPlaintext
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prompt, original string
+	err = tx.QueryRowContext(ctx, `
+		SELECT coalesce(prompt, ''), coalesce(original_prompt, '') FROM generated_content
+		WHERE request_id = $1 FOR UPDATE`, requestID).Scan(&prompt, &original)
+	if err != nil {
+		return err
+	}
+	if err := reencryptFields(&prompt, &original); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE generated_content SET prompt = $1, original_prompt = $2
+		WHERE request_id = $3`, prompt, original, requestID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reencryptConversation brings a conversation's title and turns onto the active key
+func reencryptConversation(ctx context.Context, conversationID string) error {
+	if promptActiveKeyID == "" {
+		return errPromptsPlaintext
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var title string
+	err = tx.QueryRowContext(ctx, `SELECT title FROM conversations WHERE id::text = $1 FOR UPDATE`,
+		conversationID).Scan(&title)
+	if err != nil {
+		return err
+	}
+	if err := reencryptFields(&title); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE conversations SET title = $1 WHERE id::text = $2`,
+		title, conversationID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, content FROM conversation_messages WHERE conversation_id::text = $1`,
+		conversationID)
+	if err != nil {
+		return err
+	}
+	type turn struct {
+		id      int64
+		content string
+	}
+	var turns []turn
+	for rows.Next() {
+		var t turn
+		if err := rows.Scan(&t.id, &t.content); err != nil {
+			rows.Close()
+			return err
+		}
+		turns = append(turns, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, t := range turns {
+		if err := reencryptFields(&t.content); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE conversation_messages SET content = $1 WHERE id = $2`,
+			t.content, t.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// $1 is the active key's prefix pattern
+const unencryptedPromptsFilter = `(coalesce(prompt, '') <> '' AND prompt NOT LIKE $1)
+	OR (coalesce(original_prompt, '') <> '' AND original_prompt NOT LIKE $1)`
+
+const unencryptedConversationsFilter = `(c.title <> '' AND c.title NOT LIKE $1)
+	OR EXISTS (SELECT 1 FROM conversation_messages m
+	           WHERE m.conversation_id = c.id AND m.content <> '' AND m.content NOT LIKE $1)`
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        "encrypt_prompts",
+		Description: "Encrypt plaintext prompts and re-encrypt ones under a rotated-out key",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			if promptActiveKeyID == "" {
+				return nil, nil
+			}
+			return queryKeys(ctx, `
+				SELECT request_id FROM generated_content
+				WHERE request_id > $2 AND (`+unencryptedPromptsFilter+`)
+				ORDER BY request_id LIMIT $3`, encryptedPromptPrefix+promptActiveKeyID+":%", cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			if promptActiveKeyID == "" {
+				return 0, nil
+			}
+			var n int64
+			err := db.QueryRowContext(ctx, `SELECT count(*) FROM generated_content WHERE `+unencryptedPromptsFilter,
+				encryptedPromptPrefix+promptActiveKeyID+":%").Scan(&n)
+			return n, err
+		},
+		Process: reencryptPrompts,
+	})
+	registerBackfill(&BackfillJob{
+		Name:        "encrypt_conversations",
+		Description: "Encrypt plaintext conversation titles and turns, and re-encrypt ones under a rotated-out key",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			if promptActiveKeyID == "" {
+				return nil, nil
+			}
+			return queryKeys(ctx, `
+				SELECT c.id::text FROM conversations c
+				WHERE c.id::text > $2 AND (`+unencryptedConversationsFilter+`)
+				ORDER BY c.id::text LIMIT $3`, encryptedPromptPrefix+promptActiveKeyID+":%", cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			if promptActiveKeyID == "" {
+				return 0, nil
+			}
+			var n int64
+			err := db.QueryRowContext(ctx, `SELECT count(*) FROM conversations c WHERE `+unencryptedConversationsFilter,
+				encryptedPromptPrefix+promptActiveKeyID+":%").Scan(&n)
+			return n, err
+		},
+		Process: reencryptConversation,
+	})
+}
@@ -0,0 +1,123 @@
+// prompt_encryption_test.go
+// Round trips through the prompt encryption, and what decrypting costs a list page
+
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// withPromptKeys configures encryption under the given key IDs, newest first, for one test
+func withPromptKeys(tb testing.TB, ids ...string) {
+	tb.Helper()
+	keys, active := promptKeys, promptActiveKeyID
+	tb.Cleanup(func() { promptKeys, promptActiveKeyID = keys, active })
+
+	promptKeys, promptActiveKeyID = map[string]cipher.AEAD{}, ""
+	if len(ids) > 0 {
+		promptActiveKeyID = ids[0]
+	}
+	for _, id := range ids {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			tb.Fatal(err)
+		}
+		aead, err := newAEAD(base64.StdEncoding.EncodeToString(raw))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		promptKeys[id] = aead
+	}
+}
+
+func TestPromptRoundTrip(t *testing.T) {
+	prompts := []string{"", "a red apple", "enc:1:not ciphertext", "enc::already escaped", "enc:"}
+	for _, keys := range [][]string{nil, {"2", "1"}} {
+		withPromptKeys(t, keys...)
+		for _, p := range prompts {
+			stored, err := encryptPrompt(p)
+			if err != nil {
+				t.Fatalf("keys %v: encrypt %q: %v", keys, p, err)
+			}
+			if keys != nil && p != "" && !strings.HasPrefix(stored, "enc:2:") {
+				t.Errorf("keys %v: %q stored as %q, want it sealed under key 2", keys, p, stored)
+			}
+			got, err := decryptPrompt(stored)
+			if err != nil || got != p {
+				t.Errorf("keys %v: %q stored as %q reads back as %q, %v", keys, p, stored, got, err)
+			}
+		}
+	}
+}
+
+func TestPromptRotation(t *testing.T) {
+	withPromptKeys(t, "1")
+	old, err := encryptPrompt("a lighthouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := promptKeys["1"]
+	withPromptKeys(t, "2")
+	promptKeys["1"] = rotated
+
+	field := old
+	if err := reencryptFields(&field); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(field, "enc:2:") {
+		t.Errorf("re-encrypted as %q, want key 2", field)
+	}
+	if got, err := decryptPrompt(field); err != nil || got != "a lighthouse" {
+		t.Errorf("re-encrypted prompt reads back as %q, %v", got, err)
+	}
+
+	delete(promptKeys, "1")
+	if _, err := decryptPrompt(old); !errors.Is(err, errUnknownPromptKey) {
+		t.Errorf("decrypting under a dropped key: %v, want errUnknownPromptKey", err)
+	}
+}
+
+// BenchmarkListPageDecrypt is what scanGeneration adds to a GET /generations page: the
+// original and sent prompt of each row
+func BenchmarkListPageDecrypt(b *testing.B) {
+	for _, size := range []int{20, 100} {
+		for _, encrypted := range []bool{false, true} {
+			keys := []string{}
+			if encrypted {
+				keys = []string{"1"}
+			}
+			withPromptKeys(b, keys...)
+			page := make([][2]string, size)
+			for i := range page {
+				for j, p := range []string{
+					fmt.Sprintf("portrait of an old fisherman %d, black and white photograph", i),
+					fmt.Sprintf("portrait of an old fisherman %d, black and white photograph, 35mm, high detail", i),
+				} {
+					sealed, err := encryptPrompt(p)
+					if err != nil {
+						b.Fatal(err)
+					}
+					page[i][j] = sealed
+				}
+			}
+
+			b.Run(fmt.Sprintf("rows=%d/encrypted=%t", size, encrypted), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					for _, row := range page {
+						original, prompt := row[0], row[1]
+						if err := decryptPrompts(&original, &prompt); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// prompt_logging.go
+// What of a prompt may reach logs and error reports. The log aggregator isn't access
+// controlled the way the database is, so a log line names a prompt by a keyed hash and its
+// length (PROMPT_LOG_MODE=hash, the default). prefix adds the first PROMPT_LOG_PREFIX_CHARS
+// characters. full logs prompts verbatim and is ignored in production. Prompt fields inside
+// logged JSON get the same treatment, and Sentry events are scrubbed before they're sent.
+// Rows, audit tables and events keep full prompts; they're access-controlled
+//
+// Anything that logs user text goes through logPrompt or redactPromptFields
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/getsentry/sentry-go"
+)
+
+const (
+	promptLogHash   = "hash"
+	promptLogPrefix = "prefix"
+	promptLogFull   = "full"
+)
+
+var (
+	promptLogMode        = resolvePromptLogMode(getEnv("PROMPT_LOG_MODE", promptLogHash))
+	promptLogPrefixChars = getEnvInt("PROMPT_LOG_PREFIX_CHARS", 24)
+	// Keys the hash so a short prompt can't be found by hashing guesses. Set it to correlate
+	// hashes across instances; unset, each process draws its own
+	promptLogHashKey = promptHashKey(getEnv("PROMPT_LOG_HASH_KEY", ""))
+
+	// JSON string fields that carry user text in requests, payloads and messages
+	promptJSONField = regexp.MustCompile(`"(prompt|original_prompt|text|content)"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+)
+
+func resolvePromptLogMode(mode string) string {
+	switch mode {
+	case promptLogHash, promptLogPrefix:
+		return mode
+	case promptLogFull:
+		if getEnv("APP_ENV", "development") != "production" {
+			return mode
+		}
+		log.Println("⚠️ PROMPT_LOG_MODE=full is ignored in production; logging prompt hashes")
+	default:
+		log.Printf("⚠️ Unknown PROMPT_LOG_MODE %q; logging prompt hashes", mode)
+	}
+	return promptLogHash
+}
+
+func promptHashKey(key string) []byte {
+	if key != "" {
+		return []byte(key)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// logPrompt is how prompt appears in a log line under PROMPT_LOG_MODE
+func logPrompt(prompt string) string {
+	if promptLogMode == promptLogFull {
+		return fmt.Sprintf("%q", prompt)
+	}
+	mac := hmac.New(sha256.New, promptLogHashKey)
+	mac.Write([]byte(prompt))
+	n := utf8.RuneCountInString(prompt)
+	tag := fmt.Sprintf("prompt:%s (%d chars)", hex.EncodeToString(mac.Sum(nil))[:12], n)
+	if promptLogMode == promptLogPrefix && n > 0 {
+		prefix := []rune(prompt)[:min(n, promptLogPrefixChars)]
+		return fmt.Sprintf("%s %q…", tag, string(prefix))
+	}
+	return tag
+}
+
+// redactPromptFields replaces the values of prompt-carrying JSON fields in s with
+// logPrompt's form, for payloads and messages that are logged whole
+func redactPromptFields(s string) string {
+	if promptLogMode == promptLogFull {
+		return s
+	}
+	return promptJSONField.ReplaceAllStringFunc(s, func(m string) string {
+		parts := promptJSONField.FindStringSubmatch(m)
+		var value string
+		if err := json.Unmarshal([]byte(`"`+parts[2]+`"`), &value); err != nil {
+			value = parts[2]
+		}
+		redacted, _ := json.Marshal(logPrompt(value))
+		return `"` + parts[1] + `":` + string(redacted)
+	})
+}
+
+// scrubSentryEvent is the Sentry BeforeSend hook (sentry-go v0.49.0): prompt fields
+// anywhere in the event's text go out redacted, whatever the mode, since Sentry is never
+// a dev-only sink
+func scrubSentryEvent(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+	scrub := func(s string) string {
+		if promptLogMode == promptLogFull {
+			return promptJSONField.ReplaceAllString(s, `"$1":"[redacted]"`)
+		}
+		return redactPromptFields(s)
+	}
+	event.Message = scrub(event.Message)
+	for i := range event.Exception {
+		event.Exception[i].Value = scrub(event.Exception[i].Value)
+	}
+	for i := range event.Breadcrumbs {
+		event.Breadcrumbs[i].Message = scrub(event.Breadcrumbs[i].Message)
+	}
+	for k, v := range event.Tags {
+		event.Tags[k] = scrub(v)
+	}
+	for _, ctx := range event.Contexts {
+		for k, v := range ctx {
+			if s, ok := v.(string); ok {
+				ctx[k] = scrub(s)
+			}
+		}
+	}
+	if event.Request != nil {
+		event.Request.Data = scrub(event.Request.Data)
+		event.Request.QueryString = ""
+	}
+	return event
+}
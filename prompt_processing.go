@@ -0,0 +1,187 @@
+// prompt_processing.go
+// Optional translation/enhancement of prompts before they are published to the worker
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// PromptProcessor rewrites a prompt; errors make the chain keep the previous prompt
+type PromptProcessor interface {
+	Name() string
+	Process(ctx context.Context, prompt string) (string, error)
+}
+
+var (
+	promptProcessingBudget = getEnvDuration("PROMPT_PROCESSING_BUDGET", 1500*time.Millisecond)
+	promptProcessors       = buildPromptProcessors(getEnv("PROMPT_PROCESSORS", ""))
+
+	promptProcessingResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_prompt_processing_total",
+		Help: "Prompt processor invocations, by processor and result (ok, failed).",
+	}, []string{"processor", "result"})
+)
+
+var promptHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+// buildPromptProcessors turns "translate,enhance" into the ordered chain
+func buildPromptProcessors(spec string) []PromptProcessor {
+	var chain []PromptProcessor
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "translate":
+			chain = append(chain, &translationProcessor{
+				url:    getEnv("TRANSLATE_API_URL", "http://localhost:5000/translate"),
+				apiKey: getEnv("TRANSLATE_API_KEY", ""),
+				target: getEnv("TRANSLATE_TARGET_LANG", "en"),
+			})
+		case "enhance":
+			chain = append(chain, &enhancementProcessor{
+				url:    getEnv("ENHANCE_API_URL", "https://api.openai.com/v1/chat/completions"),
+				apiKey: getEnv("OPENAI_API_KEY", ""),
+				model:  getEnv("ENHANCE_MODEL", "gpt-4o-mini"),
+			})
+		default:
+			log.Printf("⚠️ Unknown prompt processor %q ignored", name)
+		}
+	}
+	return chain
+}
+
+// processPrompt runs the chain for users who opted in, within promptProcessingBudget.
+// It always returns a usable prompt: any failure falls back to the last good value.
+func processPrompt(ctx context.Context, userID, prompt string) string {
+	if len(promptProcessors) == 0 || !userOptedIntoPromptProcessing(ctx, userID) {
+		return prompt
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, promptProcessingBudget)
+	defer cancel()
+
+	current := prompt
+	for _, p := range promptProcessors {
+		out, err := p.Process(ctx, current)
+		if err == nil {
+			// A processor must not push the prompt past the limits the user was held to
+			out, err = sanitizePrompt(out)
+		}
+		if err != nil {
+			log.Printf("⚠️ Prompt processor %s failed, keeping prompt: %v", p.Name(), err)
+			promptProcessingResults.WithLabelValues(p.Name(), "failed").Inc()
+			continue
+		}
+		promptProcessingResults.WithLabelValues(p.Name(), "ok").Inc()
+		current = out
+	}
+	return current
+}
+
+func userOptedIntoPromptProcessing(ctx context.Context, userID string) bool {
+	var optedIn bool
+	err := db.QueryRowContext(ctx, `SELECT prompt_processing FROM users WHERE id = $1`, userID).Scan(&optedIn)
+	if err != nil {
+		log.Printf("⚠️ Failed to load prompt processing preference for %s: %v", userID, err)
+		return false
+	}
+	return optedIn
+}
+
+// postJSON is the shared request/response helper for the processors
+func postJSON(ctx context.Context, url, bearer string, body, out interface{}) error {
+	return postJSONWith(ctx, promptHTTPClient, url, bearer, body, out)
+}
+
+// postJSONWith is postJSON on a caller's client
+func postJSONWith(ctx context.Context, client *http.Client, url, bearer string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// translationProcessor speaks the LibreTranslate API
+type translationProcessor struct {
+	url, apiKey, target string
+}
+
+func (t *translationProcessor) Name() string { return "translate" }
+
+func (t *translationProcessor) Process(ctx context.Context, prompt string) (string, error) {
+	var out struct {
+		TranslatedText string `json:"translatedText"`
+	}
+	err := postJSON(ctx, t.url, "", map[string]string{
+		"q":       prompt,
+		"source":  "auto",
+		"target":  t.target,
+		"format":  "text",
+		"api_key": t.apiKey,
+	}, &out)
+	return out.TranslatedText, err
+}
+
+// enhancementProcessor asks an OpenAI-compatible chat model to tighten the prompt
+type enhancementProcessor struct {
+	url, apiKey, model string
+}
+
+const enhancementInstructions = "Rewrite the user's image prompt for a pixel art game asset generator. " +
+	"Keep the subject and intent, add concrete visual detail, and reply with the prompt only."
+
+func (e *enhancementProcessor) Name() string { return "enhance" }
+
+func (e *enhancementProcessor) Process(ctx context.Context, prompt string) (string, error) {
+	var out struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	err := postJSON(ctx, e.url, e.apiKey, map[string]interface{}{
+		"model":      e.model,
+		"max_tokens": 200,
+		"messages": []map[string]string{
+			{"role": "system", "content": enhancementInstructions},
+			{"role": "user", "content": prompt},
+		},
+	}, &out)
+	if err != nil {
+		return "", err
+	}
+	if len(out.Choices) == 0 {
+		return "", errors.New("enhancer returned no choices")
+	}
+	return strings.TrimSpace(out.Choices[0].Message.Content), nil
+}
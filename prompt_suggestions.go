@@ -0,0 +1,300 @@
+// prompt_suggestions.go
+// GET /prompts/suggest?q= for the prompt box's autocomplete: up to 10 of the user's own
+// prompts that completed, merged with a curated list (PROMPT_SUGGESTIONS_FILE), matched by
+// prefix or by trigrams and ranked by how often and how recently each prompt worked.
+// Prompts may be encrypted at rest (prompt_encryption.go), so nothing is searched in SQL:
+// each user's distinct prompts are collected once into a list cached in Redis, sealed like
+// a prompt, and matched in memory. A completion, a late claim or a trash/restore drops the
+// list and the next keystroke rebuilds it. Only completed, untrashed generations count, so
+// a prompt that was refused or whose input failed moderation never shows up
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	maxPromptSuggestions  = 10
+	maxSuggestQueryLength = 200 // characters
+)
+
+var (
+	promptSuggestHistory  = getEnvInt("PROMPT_SUGGEST_HISTORY", 1000) // most recent generations collected
+	promptSuggestCacheTTL = getEnvDuration("PROMPT_SUGGEST_CACHE_TTL", 24*time.Hour)
+	// A prompt's recency weight halves every PROMPT_SUGGEST_HALF_LIFE since it last completed
+	promptSuggestHalfLife = getEnvDuration("PROMPT_SUGGEST_HALF_LIFE", 30*24*time.Hour)
+	// Share of the query's trigrams a prompt must contain to match on them
+	promptSuggestMinSimilarity = getEnvFloat("PROMPT_SUGGEST_MIN_SIMILARITY", 0.6)
+	// Weight of a curated suggestion; a history prompt used once just now weighs about 1.7
+	promptSuggestCuratedWeight = getEnvFloat("PROMPT_SUGGEST_CURATED_WEIGHT", 0.5)
+
+	// JSON array of strings; unset uses defaultCuratedSuggestions
+	promptSuggestionsFile = getEnv("PROMPT_SUGGESTIONS_FILE", "")
+)
+
+var defaultCuratedSuggestions = []string{
+	"a cozy cabin in a snowy forest at night, warm light in the windows",
+	"a lighthouse on a cliff at sunset, oil painting",
+	"isometric pixel art of a small village",
+	"portrait of an old fisherman, black and white photograph",
+	"a bowl of ramen, top-down photo",
+	"a futuristic city skyline at dusk, cinematic lighting",
+	"watercolor illustration of a fox in a meadow",
+	"a red apple on a white table, studio lighting",
+}
+
+var curatedSuggestions = loadCuratedSuggestions()
+
+var promptSuggestCache = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_prompt_suggest_cache_total",
+	Help: "Prompt suggestion lookups, by whether the user's list was cached (hit, miss, error).",
+}, []string{"result"})
+
+func loadCuratedSuggestions() []string {
+	if promptSuggestionsFile == "" {
+		return defaultCuratedSuggestions
+	}
+	var list []string
+	data, err := os.ReadFile(promptSuggestionsFile)
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to load PROMPT_SUGGESTIONS_FILE %s, using the built-in suggestions: %v", promptSuggestionsFile, err)
+		return defaultCuratedSuggestions
+	}
+	return list
+}
+
+// historyPrompt is one distinct prompt of a user's, as cached
+type historyPrompt struct {
+	Text     string `json:"t"`
+	Uses     int    `json:"n"`  // completed generations with it
+	LastUsed int64  `json:"at"` // unix seconds of the latest
+}
+
+// PromptSuggestion is one entry of GET /prompts/suggest
+type PromptSuggestion struct {
+	Text   string `json:"text"`
+	Source string `json:"source"` // "history" or "curated"
+}
+
+func promptSuggestKey(userID string) string {
+	return "prompt_suggest:" + userID
+}
+
+// invalidatePromptSuggestions drops userID's cached list, for the next lookup to rebuild
+func invalidatePromptSuggestions(ctx context.Context, userID string) {
+	if userID == "" {
+		return
+	}
+	if err := rdb.Del(ctx, promptSuggestKey(userID)).Err(); err != nil {
+		log.Printf("⚠️ Failed to drop prompt suggestions of %s: %v", userID, err)
+	}
+}
+
+// normalizeSuggestion is the form prompts are compared and deduplicated in
+func normalizeSuggestion(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// loadHistoryPrompts collects userID's distinct prompts from their latest completed
+// generations, most recent first
+func loadHistoryPrompts(ctx context.Context, userID string) ([]historyPrompt, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT coalesce(nullif(original_prompt, ''), prompt), created_at
+		FROM generated_content
+		WHERE user_id = $1 AND status = 'completed' AND trashed_at IS NULL AND content_type <> 'text'
+		ORDER BY created_at DESC
+		LIMIT $2`, userID, promptSuggestHistory)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []historyPrompt
+	seen := map[string]int{}
+	for rows.Next() {
+		var stored string
+		var at time.Time
+		if err := rows.Scan(&stored, &at); err != nil {
+			return nil, err
+		}
+		text, err := decryptPrompt(stored)
+		if err != nil || strings.TrimSpace(text) == "" {
+			continue
+		}
+		key := normalizeSuggestion(text)
+		if i, ok := seen[key]; ok {
+			list[i].Uses++
+			continue
+		}
+		seen[key] = len(list)
+		list = append(list, historyPrompt{Text: text, Uses: 1, LastUsed: at.Unix()})
+	}
+	return list, rows.Err()
+}
+
+// historyPrompts is userID's cached list, rebuilt from the database when it isn't cached.
+// Without Redis the list is built for this lookup only
+func historyPrompts(ctx context.Context, userID string) ([]historyPrompt, error) {
+	key := promptSuggestKey(userID)
+	sealed, err := rdb.Get(ctx, key).Result()
+	if err == nil {
+		var list []historyPrompt
+		raw, derr := decryptPrompt(sealed)
+		if derr == nil && json.Unmarshal([]byte(raw), &list) == nil {
+			promptSuggestCache.WithLabelValues("hit").Inc()
+			return list, nil
+		}
+	}
+	cacheable := err == nil || err == redis.Nil
+	if cacheable {
+		promptSuggestCache.WithLabelValues("miss").Inc()
+	} else {
+		promptSuggestCache.WithLabelValues("error").Inc()
+	}
+
+	list, err := loadHistoryPrompts(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		data, _ := json.Marshal(list)
+		if sealed, err := encryptPrompt(string(data)); err == nil {
+			rdb.Set(ctx, key, sealed, promptSuggestCacheTTL)
+		}
+	}
+	return list, nil
+}
+
+// trigrams are the three-rune windows of each word padded with spaces, as in pg_trgm
+func trigrams(s string) map[string]bool {
+	grams := map[string]bool{}
+	for _, word := range strings.Fields(s) {
+		r := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			grams[string(r[i:i+3])] = true
+		}
+	}
+	return grams
+}
+
+// suggestionMatch scores how well prompt (normalized) matches the query: 1 for a prefix,
+// 0.8 when a later word starts with it, less for shared trigrams, 0 for no match
+func suggestionMatch(prompt, query string, queryGrams map[string]bool) float64 {
+	switch {
+	case query == "" || strings.HasPrefix(prompt, query):
+		return 1
+	case strings.Contains(prompt, " "+query):
+		return 0.8
+	case len(queryGrams) == 0:
+		return 0
+	}
+	promptGrams := trigrams(prompt)
+	shared := 0
+	for g := range queryGrams {
+		if promptGrams[g] {
+			shared++
+		}
+	}
+	similarity := float64(shared) / float64(len(queryGrams))
+	if similarity < promptSuggestMinSimilarity {
+		return 0
+	}
+	return 0.6 * similarity
+}
+
+// rankSuggestions merges history and curated prompts matching query, best first. History
+// weighs its uses against the age of the latest; a prompt in both counts as history
+func rankSuggestions(history []historyPrompt, curated []string, query string, now time.Time, limit int) []PromptSuggestion {
+	query = normalizeSuggestion(query)
+	var queryGrams map[string]bool
+	if utf8.RuneCountInString(query) >= 3 {
+		queryGrams = trigrams(query)
+	}
+
+	type scored struct {
+		PromptSuggestion
+		score float64
+	}
+	var matches []scored
+	seen := map[string]bool{query: true} // the query itself suggests nothing
+	for _, h := range history {
+		norm := normalizeSuggestion(h.Text)
+		if seen[norm] {
+			continue
+		}
+		seen[norm] = true
+		if m := suggestionMatch(norm, query, queryGrams); m > 0 {
+			age := now.Sub(time.Unix(h.LastUsed, 0)).Hours() / promptSuggestHalfLife.Hours()
+			weight := (1 + math.Log1p(float64(h.Uses))) * math.Pow(0.5, math.Max(age, 0))
+			matches = append(matches, scored{PromptSuggestion{Text: h.Text, Source: "history"}, m * weight})
+		}
+	}
+	for _, text := range curated {
+		norm := normalizeSuggestion(text)
+		if seen[norm] {
+			continue
+		}
+		seen[norm] = true
+		if m := suggestionMatch(norm, query, queryGrams); m > 0 {
+			matches = append(matches, scored{PromptSuggestion{Text: text, Source: "curated"}, m * promptSuggestCuratedWeight})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	out := make([]PromptSuggestion, 0, limit)
+	for _, m := range matches {
+		if len(out) == limit {
+			break
+		}
+		out = append(out, m.PromptSuggestion)
+	}
+	return out
+}
+
+// suggestPromptsHandler handles GET /prompts/suggest?q=&limit=
+func suggestPromptsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	query := c.Query("q")
+	if utf8.RuneCountInString(query) > maxSuggestQueryLength {
+		fieldError(c, codeValidationFailed, "q", "must be at most 200 characters")
+		return
+	}
+	limit := maxPromptSuggestions
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPromptSuggestions {
+			fieldError(c, codeValidationFailed, "limit", "must be between 1 and 10")
+			return
+		}
+		limit = n
+	}
+
+	history, err := historyPrompts(ctx, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load prompt history of %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to load suggestions")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"suggestions": rankSuggestions(history, curatedSuggestions, query, clock.Now(), limit)})
+}
@@ -0,0 +1,421 @@
+// queue_history.go
+// History behind GET /admin/queue/history. Every QUEUE_HISTORY_INTERVAL the leader instance
+// samples depth and publish, completion and failure counts per model into a Redis ring of
+// the last 24 hours, and adds each sample to a daily rollup in Postgres for longer windows.
+// Intervals nobody sampled (no leader, a restart) stay null instead of being interpolated
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	queueHistoryKey        = "queue:history"
+	queueHistoryLeaderKey  = "queue:history:leader"
+	queuePublishedCountKey = "queue:history:published" // hash of model -> requests published, ever
+	queueHistoryRetention  = 24 * time.Hour
+	queueHistoryMaxPoints  = 2880
+	queueHistoryMaxDays    = 90
+)
+
+var queueHistoryInterval = getEnvDuration("QUEUE_HISTORY_INTERVAL", 30*time.Second)
+
+// instanceID names this process in leases
+var instanceID = newID()
+
+// holdLeaseScript takes the lease when it's free and renews it when it's ours
+var holdLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return 1
+end
+return 0`)
+
+// holdLease reports whether this instance holds (or has just taken) the lease on key.
+// A leader that stops renewing loses it after ttl
+func holdLease(ctx context.Context, key string, ttl time.Duration) bool {
+	ok, err := holdLeaseScript.Run(ctx, rdb, []string{key}, instanceID, ttl.Milliseconds()).Int()
+	return err == nil && ok == 1
+}
+
+// countPublished adds a published request to the model's counter; the sampler diffs it
+func countPublished(ctx context.Context, model string) {
+	rdb.HIncrBy(ctx, queuePublishedCountKey, model, 1)
+}
+
+// queueSample is one tick: per-model depth plus what happened since the previous tick
+type queueSample struct {
+	At        int64                       `json:"t"` // unix seconds, a multiple of the interval
+	Published map[string]int64            `json:"published_total"`
+	Models    map[string]queueModelSample `json:"models"`
+}
+
+type queueModelSample struct {
+	Depth     int    `json:"depth"`
+	Published *int64 `json:"published"` // nil when the previous tick is missing
+	Completed int64  `json:"completed"`
+	Failed    int64  `json:"failed"`
+}
+
+// startQueueHistorySampler samples on whichever instance holds the leader lease
+func startQueueHistorySampler() {
+	ticker := time.NewTicker(queueHistoryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("queue_history", nil, func() {
+			ctx := context.Background()
+			if holdLease(ctx, queueHistoryLeaderKey, 2*queueHistoryInterval) {
+				sampleQueueHistory(ctx)
+			}
+		})
+	}
+}
+
+func sampleQueueHistory(ctx context.Context) {
+	at := clock.Now().Truncate(queueHistoryInterval)
+	since := at.Add(-queueHistoryInterval)
+	// A lease handover can run a tick twice; it's stored and rolled up once
+	if len(queueSamples(ctx, at, at)) > 0 {
+		return
+	}
+	s := queueSample{At: at.Unix(), Models: map[string]queueModelSample{}}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT model,
+		       count(*) FILTER (WHERE status IN ('queued', 'processing')),
+		       count(*) FILTER (WHERE status = 'completed' AND completed_at > $1 AND completed_at <= $2),
+		       count(*) FILTER (WHERE status IN ('failed', 'timed_out') AND completed_at > $1 AND completed_at <= $2)
+		FROM generated_content
+		WHERE status IN ('queued', 'processing') OR (completed_at > $1 AND completed_at <= $2)
+		GROUP BY model`, since, at)
+	if err != nil {
+		log.Printf("❌ Failed to sample queue history: %v", err)
+		return
+	}
+	for rows.Next() {
+		var model string
+		var m queueModelSample
+		if err := rows.Scan(&model, &m.Depth, &m.Completed, &m.Failed); err == nil {
+			s.Models[model] = m
+		}
+	}
+	rows.Close()
+	// Idle models count too, as zeros, so their series don't look like gaps
+	if known, err := rdb.SMembers(ctx, workerModelsKey).Result(); err == nil {
+		for _, model := range known {
+			if _, ok := s.Models[model]; !ok {
+				s.Models[model] = queueModelSample{}
+			}
+		}
+	}
+
+	published, err := rdb.HGetAll(ctx, queuePublishedCountKey).Result()
+	if err != nil {
+		log.Printf("❌ Failed to read publish counters: %v", err)
+		return
+	}
+	s.Published = map[string]int64{}
+	for model, v := range published {
+		s.Published[model], _ = strconv.ParseInt(v, 10, 64)
+	}
+	// Publish counts are differences between ticks, so they need the tick right before
+	if prev := queueSamples(ctx, since, since); len(prev) == 1 {
+		for model, total := range s.Published {
+			m := s.Models[model]
+			delta := max(total-prev[0].Published[model], 0)
+			m.Published = &delta
+			s.Models[model] = m
+		}
+		for model, m := range s.Models {
+			if m.Published == nil {
+				zero := int64(0)
+				m.Published = &zero
+				s.Models[model] = m
+			}
+		}
+	}
+
+	member, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	pipe := rdb.TxPipeline()
+	pipe.ZAdd(ctx, queueHistoryKey, &redis.Z{Score: float64(s.At), Member: member})
+	pipe.ZRemRangeByScore(ctx, queueHistoryKey, "-inf", strconv.FormatInt(at.Add(-queueHistoryRetention).Unix(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("❌ Failed to store queue sample: %v", err)
+		return
+	}
+	rollUpQueueSample(ctx, at, s)
+}
+
+// rollUpQueueSample adds a sample to its day's rollup rows
+func rollUpQueueSample(ctx context.Context, at time.Time, s queueSample) {
+	for model, m := range s.Models {
+		var published interface{}
+		if m.Published != nil {
+			published = *m.Published
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO queue_history_daily (day, model, samples, depth_sum, depth_max, published_samples, published, completed, failed)
+			VALUES ($1, $2, 1, $3, $3, CASE WHEN $4::bigint IS NULL THEN 0 ELSE 1 END, coalesce($4, 0), $5, $6)
+			ON CONFLICT (day, model) DO UPDATE SET
+				samples = queue_history_daily.samples + 1,
+				depth_sum = queue_history_daily.depth_sum + EXCLUDED.depth_sum,
+				depth_max = greatest(queue_history_daily.depth_max, EXCLUDED.depth_max),
+				published_samples = queue_history_daily.published_samples + EXCLUDED.published_samples,
+				published = queue_history_daily.published + EXCLUDED.published,
+				completed = queue_history_daily.completed + EXCLUDED.completed,
+				failed = queue_history_daily.failed + EXCLUDED.failed`,
+			at.UTC().Format("2006-01-02"), model, m.Depth, published, m.Completed, m.Failed); err != nil {
+			log.Printf("❌ Failed to roll up queue sample for %s: %v", model, err)
+		}
+	}
+}
+
+// queueSamples reads the ring between two unix times, inclusive, oldest first
+func queueSamples(ctx context.Context, from, to time.Time) []queueSample {
+	members, err := rdb.ZRangeByScore(ctx, queueHistoryKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10), Max: strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil
+	}
+	list := make([]queueSample, 0, len(members))
+	for _, member := range members {
+		var s queueSample
+		if json.Unmarshal([]byte(member), &s) == nil {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// queueSeries is one model's (or the total's) points, aligned with the timestamps.
+// Rates are per minute; a point with no sample behind it is null
+type queueSeries struct {
+	Depth          []*float64 `json:"depth"`
+	PublishRate    []*float64 `json:"publish_rate"`
+	CompletionRate []*float64 `json:"completion_rate"`
+	FailureRate    []*float64 `json:"failure_rate"`
+}
+
+func newQueueSeries(points int) *queueSeries {
+	return &queueSeries{
+		Depth: make([]*float64, points), PublishRate: make([]*float64, points),
+		CompletionRate: make([]*float64, points), FailureRate: make([]*float64, points),
+	}
+}
+
+// queueBucket accumulates the samples that fall in one point
+type queueBucket struct {
+	samples, publishedSamples    int
+	depth                        float64
+	published, completed, failed int64
+}
+
+func (b *queueBucket) add(m queueModelSample) {
+	b.samples++
+	b.depth += float64(m.Depth)
+	b.completed += m.Completed
+	b.failed += m.Failed
+	if m.Published != nil {
+		b.publishedSamples++
+		b.published += *m.Published
+	}
+}
+
+// set writes the bucket into point i; covered is the time one sample stands for
+func (b *queueBucket) set(s *queueSeries, i int, covered time.Duration) {
+	if b.samples == 0 {
+		return
+	}
+	perMinute := func(n int64, samples int) *float64 {
+		v := float64(n) / (float64(samples) * covered.Minutes())
+		return &v
+	}
+	depth := b.depth / float64(b.samples)
+	s.Depth[i] = &depth
+	s.CompletionRate[i] = perMinute(b.completed, b.samples)
+	s.FailureRate[i] = perMinute(b.failed, b.samples)
+	if b.publishedSamples > 0 {
+		s.PublishRate[i] = perMinute(b.published, b.publishedSamples)
+	}
+}
+
+// parseHistoryDuration accepts Go durations plus whole days, e.g. "7d"
+func parseHistoryDuration(s string) (time.Duration, bool) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err == nil && n > 0
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d > 0
+}
+
+// queueHistoryHandler handles GET /admin/queue/history?window=6h&resolution=5m. Windows up
+// to 24h come from the ring at a resolution of at least QUEUE_HISTORY_INTERVAL (the
+// default keeps it to about 120 points); longer ones, up to 90d, from the daily rollup
+func queueHistoryHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	window, ok := parseHistoryDuration(c.DefaultQuery("window", "6h"))
+	if !ok || window > queueHistoryMaxDays*24*time.Hour {
+		fieldError(c, codeInvalidRequest, "window", "must be a duration up to 90d, like 6h or 7d")
+		return
+	}
+	daily := window > queueHistoryRetention
+
+	var resolution time.Duration
+	switch raw := c.Query("resolution"); {
+	case daily && raw != "" && raw != "1d" && raw != "24h":
+		fieldError(c, codeInvalidRequest, "resolution", "windows over 24h come in days; use 1d or leave it out")
+		return
+	case daily:
+		resolution = 24 * time.Hour
+	case raw == "":
+		resolution = max(window/120, queueHistoryInterval)
+	default:
+		if resolution, ok = parseHistoryDuration(raw); !ok {
+			fieldError(c, codeInvalidRequest, "resolution", "must be a duration like 30s or 5m")
+			return
+		}
+	}
+	// Points line up with samples, so each holds a whole number of them
+	resolution = max(resolution, queueHistoryInterval).Round(queueHistoryInterval)
+	if window/resolution > queueHistoryMaxPoints {
+		fieldError(c, codeInvalidRequest, "resolution", "too fine for the window; at most 2880 points")
+		return
+	}
+
+	now := clock.Now()
+	to := now.Truncate(resolution)
+	if daily {
+		now = now.UTC()
+		to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	points := int(window / resolution)
+	from := to.Add(-time.Duration(points-1) * resolution)
+
+	timestamps := make([]int64, points)
+	for i := range timestamps {
+		timestamps[i] = from.Add(time.Duration(i) * resolution).Unix()
+	}
+	buckets := map[string][]queueBucket{"": make([]queueBucket, points)}
+	bucketsFor := func(model string) []queueBucket {
+		if buckets[model] == nil {
+			buckets[model] = make([]queueBucket, points)
+		}
+		return buckets[model]
+	}
+
+	covered := queueHistoryInterval
+	if daily {
+		if err := loadDailyQueueBuckets(ctx, from, to, bucketsFor); err != nil {
+			log.Printf("❌ Failed to load queue rollups: %v", err)
+			respondError(c, codeInternal, "Failed to load queue history")
+			return
+		}
+	} else {
+		for _, s := range queueSamples(ctx, from, to.Add(resolution-time.Second)) {
+			i := int(time.Unix(s.At, 0).Sub(from) / resolution)
+			if i < 0 || i >= points {
+				continue
+			}
+			var total queueModelSample
+			var published int64
+			complete := true
+			for model, m := range s.Models {
+				bucketsFor(model)[i].add(m)
+				total.Depth += m.Depth
+				total.Completed += m.Completed
+				total.Failed += m.Failed
+				if m.Published == nil {
+					complete = false
+				} else {
+					published += *m.Published
+				}
+			}
+			if complete && len(s.Models) > 0 {
+				total.Published = &published
+			}
+			buckets[""][i].add(total)
+		}
+	}
+
+	models := map[string]*queueSeries{}
+	var total *queueSeries
+	for model, list := range buckets {
+		s := newQueueSeries(points)
+		for i := range list {
+			list[i].set(s, i, covered)
+		}
+		if model == "" {
+			total = s
+		} else {
+			models[model] = s
+		}
+	}
+	source := "samples"
+	if daily {
+		source = "daily"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"window":           window.String(),
+		"resolution":       resolution.String(),
+		"source":           source,
+		"interval_seconds": int(queueHistoryInterval.Seconds()),
+		"timestamps":       timestamps,
+		"total":            total,
+		"models":           models,
+	})
+}
+
+// loadDailyQueueBuckets fills one bucket per day from queue_history_daily. A day's
+// rollup already is the sum of its samples, so it goes in as one sample's worth
+func loadDailyQueueBuckets(ctx context.Context, from, to time.Time, bucketsFor func(string) []queueBucket) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT day, model, samples, depth_sum, published_samples, published, completed, failed
+		FROM queue_history_daily WHERE day BETWEEN $1 AND $2`, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day time.Time
+		var model string
+		var b queueBucket
+		var depthSum int64
+		if err := rows.Scan(&day, &model, &b.samples, &depthSum, &b.publishedSamples, &b.published,
+			&b.completed, &b.failed); err != nil {
+			return err
+		}
+		b.depth = float64(depthSum)
+		i := int(day.Sub(from) / (24 * time.Hour))
+		if i < 0 || i >= len(bucketsFor(model)) {
+			continue
+		}
+		bucketsFor(model)[i] = b
+		t := &bucketsFor("")[i]
+		// Models are sampled together, so the total's sample count is any one model's
+		t.samples = max(t.samples, b.samples)
+		t.publishedSamples = max(t.publishedSamples, b.publishedSamples)
+		t.depth += b.depth
+		t.published += b.published
+		t.completed += b.completed
+		t.failed += b.failed
+	}
+	return rows.Err()
+}
@@ -0,0 +1,451 @@
+// realtime.go
+// Per-user event hub behind the SSE and WebSocket endpoints, with server-side filters
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Realtime event types
+const (
+	eventProgress     = "progress"
+	eventCompleted    = "completed"
+	eventFailed       = "failed"
+	eventCredits      = "credits"
+	eventAnnouncement = "announcement"
+	eventRetraction   = "announcement_retracted" // an admin revoked an announcement (see broadcasts.go)
+	eventLateResult   = "late_result"            // a timed-out request's result arrived and can be claimed
+)
+
+var knownEventTypes = map[string]bool{
+	eventProgress: true, eventCompleted: true, eventFailed: true, eventCredits: true, eventAnnouncement: true,
+	eventRetraction: true, eventLateResult: true,
+}
+
+// realtimeEventsChannel carries events raised on one instance to the hubs of all of them
+const realtimeEventsChannel = "realtime_events"
+
+const maxFilterRequestIDs = 100
+
+var (
+	realtimeBufferSize = getEnvInt("REALTIME_BUFFER_SIZE", 64)
+	realtimeHeartbeat  = getEnvDuration("REALTIME_HEARTBEAT", 25*time.Second)
+)
+
+var (
+	realtimeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_realtime_connections",
+		Help: "Open realtime connections, by transport (sse, ws).",
+	}, []string{"transport"})
+
+	realtimeEventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_realtime_events_sent_total",
+		Help: "Events written to realtime connections, by event type.",
+	}, []string{"type"})
+
+	realtimeEventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_realtime_events_dropped_total",
+		Help: "Events dropped because a connection's buffer was full, by event type.",
+	}, []string{"type"})
+
+	// Per-connection totals, observed when the connection closes
+	realtimeConnectionSent = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mobart_realtime_connection_events_sent",
+		Help:    "Events sent over the lifetime of a realtime connection.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+	realtimeConnectionDropped = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mobart_realtime_connection_events_dropped",
+		Help:    "Events dropped over the lifetime of a realtime connection.",
+		Buckets: []float64{0, 1, 10, 100, 1000},
+	})
+)
+
+// Event is what clients receive; an empty UserID goes to everyone (announcements), or to
+// users on one of Plans when it is set. Tenant, when set, keeps it to that tenant's users
+type Event struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"`
+	UserID    string      `json:"-"`
+	Plans     []string    `json:"-"`
+	Tenant    string      `json:"-"`
+	Data      interface{} `json:"data,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	Silent    bool        `json:"silent,omitempty"` // the user turned in-app alerts for this type off
+}
+
+// wireEvent is Event as relayed between instances, keeping the recipients
+type wireEvent struct {
+	Event
+	UserID string   `json:"user_id,omitempty"`
+	Plans  []string `json:"plans,omitempty"`
+	Tenant string   `json:"tenant,omitempty"`
+}
+
+// eventFilter selects events for one connection. Empty sets match everything; the
+// request_ids set only applies to events that belong to a request
+type eventFilter struct {
+	Types      map[string]bool
+	RequestIDs map[string]bool
+}
+
+func (f *eventFilter) matches(e Event) bool {
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	if len(f.RequestIDs) > 0 && e.RequestID != "" && !f.RequestIDs[e.RequestID] {
+		return false
+	}
+	return true
+}
+
+// MarshalJSON echoes the filter back as lists in subscription acks
+func (f *eventFilter) MarshalJSON() ([]byte, error) {
+	keys := func(m map[string]bool) []string {
+		list := []string{}
+		for k := range m {
+			list = append(list, k)
+		}
+		return list
+	}
+	return json.Marshal(map[string][]string{"types": keys(f.Types), "request_ids": keys(f.RequestIDs)})
+}
+
+func newEventFilter(types, requestIDs []string) (*eventFilter, error) {
+	f := &eventFilter{Types: map[string]bool{}, RequestIDs: map[string]bool{}}
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if !knownEventTypes[t] {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		f.Types[t] = true
+	}
+	for _, id := range requestIDs {
+		if id = strings.TrimSpace(id); id != "" {
+			f.RequestIDs[id] = true
+		}
+	}
+	if len(f.RequestIDs) > maxFilterRequestIDs {
+		return nil, fmt.Errorf("at most %d request_ids per subscription", maxFilterRequestIDs)
+	}
+	return f, nil
+}
+
+// filterFromQuery reads ?types=a,b&request_ids=x,y
+func filterFromQuery(c *gin.Context) (*eventFilter, error) {
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+	return newEventFilter(split(c.Query("types")), split(c.Query("request_ids")))
+}
+
+// subscriber is one connection. The filter is swapped atomically so delivery never
+// sees a half-updated one; writers re-check it so a re-subscribe also applies to
+// events already buffered under the old filter. An operator's feed (everyone) gets
+// every user's events. revoked is closed when the credential the connection was opened
+// with is revoked (auth_tokens.go), and the handler then hangs up
+type subscriber struct {
+	userID     string
+	tenant     string
+	plan       string // as of connecting
+	everyone   bool
+	credential string // see credentialKey
+	filter     atomic.Pointer[eventFilter]
+	events     chan Event
+	revoked    chan struct{}
+	revokeOnce sync.Once
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+}
+
+func (s *subscriber) wants(e Event) bool {
+	return s.filter.Load().matches(e)
+}
+
+// eventHub fans events out to the connections on this instance
+type eventHub struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]struct{}
+}
+
+var realtime = &eventHub{subs: map[*subscriber]struct{}{}}
+
+func (h *eventHub) subscribe(userID, tenant, plan, credential string, f *eventFilter) *subscriber {
+	return h.add(&subscriber{userID: userID, tenant: tenant, plan: plan, credential: credential}, f)
+}
+
+// subscribeEveryone opens an operator's feed of all users' events
+func (h *eventHub) subscribeEveryone(userID, credential string, f *eventFilter) *subscriber {
+	return h.add(&subscriber{userID: userID, everyone: true, credential: credential}, f)
+}
+
+func (h *eventHub) add(s *subscriber, f *eventFilter) *subscriber {
+	s.events = make(chan Event, realtimeBufferSize)
+	s.revoked = make(chan struct{})
+	s.filter.Store(f)
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+	realtimeConnectionSent.Observe(float64(s.sent.Load()))
+	realtimeConnectionDropped.Observe(float64(s.dropped.Load()))
+	if n := s.dropped.Load(); n > 0 {
+		log.Printf("⚠️ Realtime connection for %s dropped %d events (sent %d)", s.userID, n, s.sent.Load())
+	}
+}
+
+// disconnect tells userID's connections opened with credential, or all of them when it's
+// empty, to hang up
+func (h *eventHub) disconnect(userID, credential string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if s.userID == userID && (credential == "" || s.credential == credential) {
+			s.revokeOnce.Do(func() { close(s.revoked) })
+		}
+	}
+}
+
+// publish never blocks: a slow consumer loses events rather than stalling everyone
+func (h *eventHub) publish(e Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.subs {
+		if e.UserID != "" && e.UserID != s.userID && !s.everyone {
+			continue
+		}
+		s.offer(e)
+	}
+}
+
+// offer queues e for s if its filter, tenant and plan want it, dropping it when s is full
+func (s *subscriber) offer(e Event) {
+	if e.Tenant != "" && e.Tenant != s.tenant && !s.everyone {
+		return
+	}
+	if len(e.Plans) > 0 && !containsString(e.Plans, s.plan) && !s.everyone {
+		return
+	}
+	if !s.wants(e) {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		s.dropped.Add(1)
+		realtimeEventsDropped.WithLabelValues(e.Type).Inc()
+	}
+}
+
+// publishLocalEvent is for events every instance raises itself (completions are
+// received by all listeners)
+func publishLocalEvent(e Event) {
+	e.Timestamp = time.Now().Unix()
+	realtime.publish(e)
+}
+
+// broadcastEvent is for events raised on a single instance, relayed via Redis
+func broadcastEvent(ctx context.Context, e Event) {
+	e.Timestamp = time.Now().Unix()
+	data, err := json.Marshal(wireEvent{Event: e, UserID: e.UserID, Plans: e.Plans, Tenant: e.Tenant})
+	if err != nil {
+		return
+	}
+	if err := rdb.Publish(ctx, realtimeEventsChannel, data).Err(); err != nil {
+		log.Printf("⚠️ Failed to broadcast %s event: %v", e.Type, err)
+	}
+}
+
+// startRealtimeRelay feeds broadcast events into this instance's hub
+func startRealtimeRelay() {
+	pubsub := rdb.Subscribe(context.Background(), realtimeEventsChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		panic(err)
+	}
+
+	for msg := range pubsub.Channel() {
+		redisMessageReceived(msg.Channel)
+		var w wireEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &w); err != nil {
+			log.Printf("⚠️ Bad realtime event: %v", err)
+			continue
+		}
+		w.Event.UserID, w.Event.Plans, w.Event.Tenant = w.UserID, w.Plans, w.Tenant
+		realtime.publish(w.Event)
+	}
+}
+
+// eventsSSEHandler handles GET /events?types=&request_ids=
+func eventsSSEHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	sub := realtime.subscribe(user.ID.String(), currentTenant(c).ID, userPlan(c.Request.Context(), user.ID.String()),
+		credentialKey(c), filter)
+	defer realtime.unsubscribe(sub)
+	replayBroadcasts(c.Request.Context(), sub)
+	realtimeConnections.WithLabelValues("sse").Inc()
+	defer realtimeConnections.WithLabelValues("sse").Dec()
+
+	heartbeat := time.NewTicker(realtimeHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-sub.events:
+			c.SSEvent(e.Type, e)
+			sub.sent.Add(1)
+			realtimeEventsSent.WithLabelValues(e.Type).Inc()
+			return true
+		case <-heartbeat.C:
+			io.WriteString(w, ": ping\n\n")
+			return true
+		case <-sub.revoked:
+			c.SSEvent("revoked", gin.H{"reason": "credential revoked"})
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+var wsUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// subscribeMessage re-subscribes an open WebSocket:
+// {"action": "subscribe", "types": [...], "request_ids": [...]}
+type subscribeMessage struct {
+	Action     string   `json:"action"`
+	Types      []string `json:"types"`
+	RequestIDs []string `json:"request_ids"`
+}
+
+// eventsWSHandler handles GET /events/ws?types=&request_ids=
+func eventsWSHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		respondError(c, codeInvalidRequest, err.Error())
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // the upgrader already replied
+	}
+	defer conn.Close()
+
+	sub := realtime.subscribe(user.ID.String(), currentTenant(c).ID, userPlan(c.Request.Context(), user.ID.String()),
+		credentialKey(c), filter)
+	defer realtime.unsubscribe(sub)
+	replayBroadcasts(c.Request.Context(), sub)
+	realtimeConnections.WithLabelValues("ws").Inc()
+	defer realtimeConnections.WithLabelValues("ws").Dec()
+
+	// The reader hands control replies to the writer; gorilla allows one writer at a time
+	replies := make(chan interface{}, 4)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	reply := func(v interface{}) bool {
+		select {
+		case replies <- v:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(16 << 10)
+		for {
+			var msg subscribeMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Action != "subscribe" {
+				if !reply(gin.H{"type": "error", "error": "unknown action"}) {
+					return
+				}
+				continue
+			}
+			f, err := newEventFilter(msg.Types, msg.RequestIDs)
+			if err != nil {
+				if !reply(gin.H{"type": "error", "error": err.Error()}) {
+					return
+				}
+				continue
+			}
+			sub.filter.Store(f)
+			if !reply(gin.H{"type": "subscribed", "filter": f}) {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(realtimeHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case e := <-sub.events:
+			// Buffered before a re-subscribe; honor the filter the client last asked for
+			if !sub.wants(e) {
+				continue
+			}
+			if err = conn.WriteJSON(e); err == nil {
+				sub.sent.Add(1)
+				realtimeEventsSent.WithLabelValues(e.Type).Inc()
+			}
+		case reply := <-replies:
+			err = conn.WriteJSON(reply)
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+		case <-sub.revoked:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "credential revoked"),
+				time.Now().Add(5*time.Second))
+			return
+		case <-done:
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, websocket.ErrCloseSent) {
+				log.Printf("⚠️ Realtime connection for %s closed: %v", user.ID, err)
+			}
+			return
+		}
+	}
+}
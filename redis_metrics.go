@@ -0,0 +1,173 @@
+// redis_metrics.go
+// Redis client metrics, so a slow request can be pinned on Redis or on Postgres: a
+// go-redis hook times every command and pipeline by command family and counts errors by
+// type, and a collector reads the pool's stats at scrape time. instrumentRedis takes any
+// UniversalClient, so it attaches the same way to a single, sentinel or cluster client.
+// Pub/sub messages don't pass through hooks; listeners count them with
+// redisMessageReceived
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	redisCommandSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mobart_redis_command_duration_seconds",
+		Help:    "Redis command round trips, by command family (pipelines count once as pipeline).",
+		Buckets: []float64{0.0002, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"family"})
+	redisCommandErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_redis_command_errors_total",
+		Help: "Failed Redis commands, by command family and error type (timeout, pool_timeout, canceled, connection, server, other).",
+	}, []string{"family", "type"})
+	redisPubSubMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_redis_pubsub_messages_total",
+		Help: "Pub/sub messages received, by channel.",
+	}, []string{"channel"})
+)
+
+type redisStartKey struct{}
+
+// redisMetricsHook implements redis.Hook. It costs a context value and a histogram
+// observation per command
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, redisCommandFamily(cmd.Name()), cmd.Err())
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+func observeRedis(ctx context.Context, family string, err error) {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		redisCommandSeconds.WithLabelValues(family).Observe(time.Since(start).Seconds())
+	}
+	if err != nil && err != redis.Nil {
+		redisCommandErrors.WithLabelValues(family, redisErrorType(err)).Inc()
+	}
+}
+
+// redisCommandFamily keeps the label set small: the commands this backend uses, grouped
+func redisCommandFamily(name string) string {
+	switch name {
+	case "publish":
+		return "publish"
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping":
+		return "subscribe"
+	case "get", "set", "setnx", "setex", "getset", "getdel", "mget", "mset", "del", "unlink",
+		"exists", "incr", "incrby", "decr", "decrby", "expire", "pexpire", "expireat", "ttl", "pttl":
+		return "get_set"
+	case "sadd", "srem", "smembers", "sismember", "scard":
+		return "set"
+	case "eval", "evalsha", "script":
+		return "script"
+	}
+	switch {
+	case strings.HasPrefix(name, "x"):
+		return "stream"
+	case strings.HasPrefix(name, "z"):
+		return "sorted_set"
+	case strings.HasPrefix(name, "h"):
+		return "hash"
+	case strings.HasPrefix(name, "l"), strings.HasPrefix(name, "rpush"), strings.HasPrefix(name, "rpop"),
+		strings.HasPrefix(name, "brpop"), strings.HasPrefix(name, "blpop"):
+		return "list"
+	}
+	return "other"
+}
+
+func redisErrorType(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case err.Error() == "redis: connection pool timeout":
+		return "pool_timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr), errors.Is(err, redis.ErrClosed), errors.Is(err, net.ErrClosed):
+		return "connection"
+	}
+	var serverErr redis.Error
+	if errors.As(err, &serverErr) {
+		return "server"
+	}
+	return "other"
+}
+
+// redisPoolCollector reports PoolStats when scraped, so the pool costs nothing in between
+type redisPoolCollector struct {
+	client redis.UniversalClient
+
+	hits, misses, timeouts, stale *prometheus.Desc
+	conns                         *prometheus.Desc
+}
+
+func newRedisPoolCollector(client redis.UniversalClient) *redisPoolCollector {
+	return &redisPoolCollector{
+		client:   client,
+		hits:     prometheus.NewDesc("mobart_redis_pool_hits_total", "Times a free connection was found in the pool.", nil, nil),
+		misses:   prometheus.NewDesc("mobart_redis_pool_misses_total", "Times a new connection had to be dialed.", nil, nil),
+		timeouts: prometheus.NewDesc("mobart_redis_pool_timeouts_total", "Times a caller gave up waiting for a connection.", nil, nil),
+		stale:    prometheus.NewDesc("mobart_redis_pool_stale_connections_total", "Stale connections removed from the pool.", nil, nil),
+		conns:    prometheus.NewDesc("mobart_redis_pool_connections", "Pool connections, by state (idle, in_use).", []string{"state"}, nil),
+	}
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.stale
+	ch <- c.conns
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.client.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(s.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.stale, prometheus.CounterValue, float64(s.StaleConns))
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(s.IdleConns), "idle")
+	ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(s.TotalConns-s.IdleConns), "in_use")
+}
+
+// instrumentRedis attaches the hook and the pool collector to client
+func instrumentRedis(client redis.UniversalClient) {
+	client.AddHook(redisMetricsHook{})
+	prometheus.MustRegister(newRedisPoolCollector(client))
+}
+
+// redisMessageReceived counts a pub/sub message from channel
+func redisMessageReceived(channel string) {
+	redisPubSubMessages.WithLabelValues(channel).Inc()
+}
@@ -0,0 +1,343 @@
+// referrals.go
+// Referral program: every user has a code, and a new user who redeems one is tracked as a
+// referral (pending → qualified → rewarded). The referee's first completed generation
+// qualifies it, and both sides are then granted credits through credit_ledger, up to
+// REFERRAL_MAX_REWARDS_PER_MONTH rewarded referrals per referrer. Redemptions that look
+// like someone referring themselves are blocked by referralAbuseCheck
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	referralPending   = "pending"
+	referralQualified = "qualified" // qualified but not rewarded: the referrer was over the monthly cap
+	referralRewarded  = "rewarded"
+	referralBlocked   = "blocked" // refused by referralAbuseCheck; never rewarded
+
+	// No 0/O or 1/I, so codes survive being read out loud
+	referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	referralCodeLength   = 8
+)
+
+var (
+	referrerCredits            = getEnvInt("REFERRAL_REFERRER_CREDITS", 20)
+	refereeCredits             = getEnvInt("REFERRAL_REFEREE_CREDITS", 10)
+	referralMaxRewardsPerMonth = getEnvInt("REFERRAL_MAX_REWARDS_PER_MONTH", 10)
+)
+
+// Referral is one redeemed code, as its referrer sees it
+type Referral struct {
+	ID          string     `json:"id"`
+	State       string     `json:"state"`
+	Note        string     `json:"note,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	QualifiedAt *time.Time `json:"qualified_at,omitempty"`
+	RewardedAt  *time.Time `json:"rewarded_at,omitempty"`
+	Credits     int        `json:"credits,omitempty"` // granted to the referrer
+}
+
+// referralRedemption is what referralAbuseCheck judges
+type referralRedemption struct {
+	ReferrerID string
+	RefereeID  string
+	DeviceHash string // of X-Device-ID; empty when the client sent none
+	IPHash     string
+}
+
+// referralAbuseCheck returns why a redemption should be blocked, or "". It is a variable
+// so a device-fingerprinting service can take over from the same-device heuristic
+var referralAbuseCheck = sameDeviceReferral
+
+// sameDeviceReferral blocks a redemption from the device or address the referrer last
+// used to look at their code
+func sameDeviceReferral(ctx context.Context, r referralRedemption) string {
+	var device, ip string
+	err := db.QueryRowContext(ctx, `
+		SELECT coalesce(last_device_hash, ''), coalesce(last_ip_hash, '') FROM referral_codes WHERE user_id = $1`,
+		r.ReferrerID).Scan(&device, &ip)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case r.DeviceHash != "" && r.DeviceHash == device:
+		return "same device as the referrer"
+	case r.IPHash == ip:
+		return "same network address as the referrer"
+	}
+	return ""
+}
+
+func referralFingerprint(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("referral:" + value))
+	return hex.EncodeToString(sum[:12])
+}
+
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+// referralCode returns userID's code, creating it on first use, and remembers the device
+// and address it was asked from for sameDeviceReferral
+func referralCode(c *gin.Context, userID string) (string, error) {
+	ctx := c.Request.Context()
+	device, ip := referralFingerprint(c.GetHeader("X-Device-ID")), referralFingerprint(c.ClientIP())
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO referral_codes (user_id, code, last_device_hash, last_ip_hash)
+			VALUES ($1, $2, nullif($3, ''), $4)
+			ON CONFLICT (user_id) DO UPDATE
+			SET last_device_hash = coalesce(EXCLUDED.last_device_hash, referral_codes.last_device_hash),
+			    last_ip_hash = EXCLUDED.last_ip_hash
+			RETURNING code`, userID, code, device, ip).Scan(&code)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			continue // another user's code; draw again
+		}
+		return code, err
+	}
+	return "", errors.New("no free referral code after 5 attempts")
+}
+
+// getReferralsHandler handles GET /referrals: the caller's code and the referrals it brought in
+func getReferralsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	code, err := referralCode(c, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to create referral code: %v", err)
+		respondError(c, codeInternal, "Failed to load referrals")
+		return
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT id, state, coalesce(note, ''), created_at, qualified_at, rewarded_at, referrer_credits
+		FROM referrals WHERE referrer_id = $1 ORDER BY created_at DESC LIMIT 200`, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to list referrals: %v", err)
+		respondError(c, codeInternal, "Failed to load referrals")
+		return
+	}
+	defer rows.Close()
+	list := []Referral{}
+	earned := 0
+	for rows.Next() {
+		var r Referral
+		if err := rows.Scan(&r.ID, &r.State, &r.Note, &r.CreatedAt, &r.QualifiedAt, &r.RewardedAt, &r.Credits); err != nil {
+			respondError(c, codeInternal, "Failed to load referrals")
+			return
+		}
+		earned += r.Credits
+		list = append(list, r)
+	}
+	c.JSON(http.StatusOK, gin.H{"code": code, "referrals": list, "credits_earned": earned,
+		"referrer_credits": referrerCredits, "referee_credits": refereeCredits})
+}
+
+// lookupReferralCodeHandler handles GET /referrals/codes/:code, e.g. for a signup form.
+// Codes of another tenant's users don't exist here
+func lookupReferralCodeHandler(c *gin.Context) {
+	code := strings.ToUpper(c.Param("code"))
+	var exists bool
+	if err := db.QueryRowContext(c.Request.Context(), `
+		SELECT EXISTS (SELECT 1 FROM referral_codes r JOIN users u ON u.id = r.user_id
+		               WHERE r.code = $1 AND u.tenant_id = $2)`,
+		code, currentTenant(c).ID).Scan(&exists); err != nil {
+		respondError(c, codeInternal, "Failed to look up referral code")
+		return
+	}
+	if !exists {
+		respondError(c, codeNotFound, "Referral code not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": code, "valid": true, "referee_credits": refereeCredits})
+}
+
+// redeemReferralHandler handles POST /referrals/redeem {"code"}. Only an account with no
+// completed generation yet can redeem, and only once
+func redeemReferralHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	code := strings.ToUpper(strings.TrimSpace(body.Code))
+
+	var referrerID string
+	err := db.QueryRowContext(ctx, `
+		SELECT r.user_id FROM referral_codes r JOIN users u ON u.id = r.user_id
+		WHERE r.code = $1 AND u.tenant_id = $2`, code, currentTenant(c).ID).Scan(&referrerID)
+	if err == sql.ErrNoRows {
+		fieldError(c, codeNotFound, "code", "no such referral code")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to redeem referral code")
+		return
+	}
+	if referrerID == user.ID.String() {
+		fieldError(c, codeValidationFailed, "code", "you can't redeem your own code")
+		return
+	}
+	var established bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM generated_content WHERE user_id = $1 AND status = 'completed')`,
+		user.ID.String()).Scan(&established); err != nil {
+		respondError(c, codeInternal, "Failed to redeem referral code")
+		return
+	}
+	if established {
+		respondError(c, codeForbidden, "Referral codes are for new accounts")
+		return
+	}
+
+	state, note := referralPending, ""
+	if reason := referralAbuseCheck(ctx, referralRedemption{ReferrerID: referrerID, RefereeID: user.ID.String(),
+		DeviceHash: referralFingerprint(c.GetHeader("X-Device-ID")), IPHash: referralFingerprint(c.ClientIP())}); reason != "" {
+		state, note = referralBlocked, reason
+		log.Printf("🚫 Blocked referral of %s by %s: %s", user.ID, referrerID, reason)
+	}
+
+	var id string
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO referrals (referrer_id, referee_id, code, state, note) VALUES ($1, $2, $3, $4, nullif($5, ''))
+		ON CONFLICT (referee_id) DO NOTHING
+		RETURNING id`, referrerID, user.ID.String(), code, state, note).Scan(&id)
+	if err == sql.ErrNoRows {
+		respondError(c, codeConflict, "You have already redeemed a referral code")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to store referral: %v", err)
+		respondError(c, codeInternal, "Failed to redeem referral code")
+		return
+	}
+	// A blocked redemption looks like any other to the client
+	c.JSON(http.StatusCreated, gin.H{"id": id, "state": referralPending, "referee_credits": refereeCredits,
+		"message": "Your credits arrive with your first completed generation."})
+}
+
+// qualifyReferral runs for every applied completion: when requestID is its owner's first
+// completed generation and the owner was referred, the referral qualifies and is rewarded
+func qualifyReferral(ctx context.Context, requestID string) {
+	var id string
+	err := db.QueryRowContext(ctx, `
+		UPDATE referrals SET state = 'qualified', qualified_at = now(), qualifying_request_id = $1
+		WHERE state = 'pending'
+		  AND referee_id = (SELECT user_id FROM generated_content WHERE request_id = $1 AND status = 'completed')
+		RETURNING id`, requestID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to check referral qualification for %s: %v", requestID, err)
+		return
+	}
+	if err := rewardReferral(ctx, id); err != nil {
+		log.Printf("❌ Failed to reward referral %s: %v", id, err)
+	}
+}
+
+// rewardReferral grants both sides their credits in one transaction. The referrer's code
+// row is locked so concurrent qualifications can't overshoot the monthly cap
+func rewardReferral(ctx context.Context, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var referrerID, refereeID string
+	err = tx.QueryRowContext(ctx, `
+		SELECT r.referrer_id, r.referee_id FROM referrals r
+		JOIN referral_codes c ON c.user_id = r.referrer_id
+		WHERE r.id = $1 AND r.state = 'qualified'
+		FOR UPDATE OF r, c`, id).Scan(&referrerID, &refereeID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var rewarded int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM referrals
+		WHERE referrer_id = $1 AND state = 'rewarded' AND rewarded_at >= date_trunc('month', now())`,
+		referrerID).Scan(&rewarded); err != nil {
+		return err
+	}
+	if rewarded >= referralMaxRewardsPerMonth {
+		_, err := tx.ExecContext(ctx, `UPDATE referrals SET note = 'monthly referral reward limit reached' WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
+		log.Printf("🎟️ Referral %s qualified, but %s is at the monthly reward limit", id, referrerID)
+		return tx.Commit()
+	}
+
+	ledgerKey := "referral:" + id
+	for _, grant := range []struct {
+		userID, reason string
+		amount         int
+	}{{referrerID, "referral:referrer", referrerCredits}, {refereeID, "referral:referee", refereeCredits}} {
+		if grant.amount <= 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET credits = credits + $1 WHERE id = $2`,
+			grant.amount, grant.userID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO credit_ledger (user_id, request_id, delta, reason) VALUES ($1, $2, $3, $4)`,
+			grant.userID, ledgerKey, grant.amount, grant.reason); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE referrals SET state = 'rewarded', rewarded_at = now(), referrer_credits = $2, referee_credits = $3
+		WHERE id = $1`, id, referrerCredits, refereeCredits); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("🎟️ Referral %s rewarded: %d credits to %s, %d to %s", id, referrerCredits, referrerID, refereeCredits, refereeID)
+	broadcastEvent(ctx, Event{Type: eventCredits, RequestID: ledgerKey, UserID: referrerID,
+		Data: map[string]interface{}{"delta": referrerCredits, "reason": "referral"}})
+	broadcastEvent(ctx, Event{Type: eventCredits, RequestID: ledgerKey, UserID: refereeID,
+		Data: map[string]interface{}{"delta": refereeCredits, "reason": "referral"}})
+	return nil
+}
@@ -0,0 +1,409 @@
+// regression.go
+// Seeded regression runs for model upgrades: POST /admin/regression-runs submits a fixed
+// suite of (prompt, seed, params) items as ordinary generations on the low-priority
+// channel, and GET /admin/regression-runs/:id reports each item, comparing perceptual
+// hashes of the results with a baseline run stored per model version
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"image"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Low-priority twins of the request channels; workers read them only when idle
+const lowPriorityChannelSuffix = "_low"
+
+const (
+	maxRegressionItems = 200
+	// Results hashed per GET; the rest are hashed by the next one
+	regressionHashBatch = 20
+)
+
+var (
+	// JSON array of RegressionItem; unset uses defaultRegressionSuite
+	regressionSuiteFile = getEnv("REGRESSION_SUITE_FILE", "")
+	// Items whose dHash differs from the baseline's in more bits than this are flagged
+	regressionHashThreshold = getEnvInt("REGRESSION_HASH_THRESHOLD", 10)
+)
+
+// RegressionItem is one fixed generation of a suite
+type RegressionItem struct {
+	Prompt     string `json:"prompt"`
+	Seed       int64  `json:"seed"`
+	Resolution int    `json:"resolution,omitempty"`
+	Steps      int    `json:"steps,omitempty"`
+}
+
+var defaultRegressionSuite = []RegressionItem{
+	{Prompt: "a red apple on a white table, studio lighting", Seed: 1},
+	{Prompt: "a lighthouse on a cliff at sunset, oil painting", Seed: 2},
+	{Prompt: "portrait of an old fisherman, black and white photograph", Seed: 3},
+	{Prompt: "isometric pixel art of a small village", Seed: 4},
+	{Prompt: "a bowl of ramen, top-down photo", Seed: 5, Steps: 30},
+}
+
+// regressionSuite is the configured suite, read on each run so the file can change without a restart
+func regressionSuite() ([]RegressionItem, error) {
+	if regressionSuiteFile == "" {
+		return defaultRegressionSuite, nil
+	}
+	data, err := os.ReadFile(regressionSuiteFile)
+	if err != nil {
+		return nil, err
+	}
+	var items []RegressionItem
+	return items, json.Unmarshal(data, &items)
+}
+
+// regressionRunTag marks a run's generations, so they can also be found with ?tag=
+func regressionRunTag(runID string) string {
+	return "regression-" + runID[:8]
+}
+
+// regressionRunRequest is the body of POST /admin/regression-runs. Items default to the suite
+type regressionRunRequest struct {
+	Model        string           `json:"model"`
+	ModelVersion string           `json:"model_version"`
+	Items        []RegressionItem `json:"items"`
+	Notify       string           `json:"notify"` // for every item, as on POST /generations
+}
+
+// createRegressionRunHandler handles POST /admin/regression-runs. Items are charged to
+// nobody and skip admission; they are owned by the admin who started the run
+func createRegressionRunHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	var req regressionRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if req.ModelVersion == "" {
+		fieldError(c, codeValidationFailed, "model_version", "is required")
+		return
+	}
+	var ok bool
+	if req.Notify, ok = notifyMode(req.Notify); !ok {
+		fieldError(c, codeValidationFailed, "notify", "must be all, failures_only or none")
+		return
+	}
+	if req.Items == nil {
+		suite, err := regressionSuite()
+		if err != nil {
+			log.Printf("❌ Failed to read regression suite %s: %v", regressionSuiteFile, err)
+			respondError(c, codeInternal, "Failed to read the regression suite")
+			return
+		}
+		req.Items = suite
+	}
+	if len(req.Items) == 0 || len(req.Items) > maxRegressionItems {
+		fieldError(c, codeValidationFailed, "items", "must hold 1-"+strconv.Itoa(maxRegressionItems)+" items")
+		return
+	}
+
+	// Validate every item before queueing any, so a run is never half submitted
+	specs := make([]generationSpec, len(req.Items))
+	for i, item := range req.Items {
+		prompt, err := sanitizePrompt(item.Prompt)
+		if err != nil {
+			fieldError(c, codeValidationFailed, "items["+strconv.Itoa(i)+"].prompt", err.Error())
+			return
+		}
+		req.Items[i].Prompt = prompt
+		specs[i], err = generationSpecFor("image", RequestPayload{Text: prompt, RequestType: "image",
+			Model: req.Model, Resolution: item.Resolution, Steps: item.Steps})
+		if err != nil {
+			fieldError(c, codeValidationFailed, "items["+strconv.Itoa(i)+"]", err.Error())
+			return
+		}
+	}
+	model := specs[0].Model
+
+	runID := newID()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO regression_runs (id, model, model_version, created_by, item_count) VALUES ($1, $2, $3, $4, $5)`,
+		runID, model, req.ModelVersion, admin.ID.String(), len(req.Items)); err != nil {
+		log.Printf("❌ Failed to store regression run: %v", err)
+		respondError(c, codeInternal, "Failed to start regression run")
+		return
+	}
+
+	failed := 0
+	for i, item := range req.Items {
+		row := newGeneration{
+			RequestID:      newID(),
+			UserID:         admin.ID.String(),
+			Tenant:         currentTenant(c).ID,
+			OriginalPrompt: item.Prompt,
+			Prompt:         item.Prompt,
+			Model:          model,
+			ContentType:    "image",
+			Status:         "queued",
+			Resolution:     specs[i].Resolution,
+			Steps:          specs[i].Steps,
+			Seed:           item.Seed,
+			Tags:           []string{regressionRunTag(runID)},
+			LowPriority:    true,
+			Notify:         req.Notify,
+		}
+		if err := createGeneration(ctx, row); err != nil {
+			log.Printf("❌ Failed to create regression item %d of run %s: %v", i, runID, err)
+			failed++
+			continue
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO regression_run_items (run_id, idx, request_id, prompt, seed, resolution, steps)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			runID, i, row.RequestID, item.Prompt, item.Seed, item.Resolution, item.Steps); err != nil {
+			log.Printf("❌ Failed to store regression item %d of run %s: %v", i, runID, err)
+		}
+		if err := publishGenerationRequest(row.channel(), row.request()); err != nil {
+			markGenerationFailed(ctx, row.RequestID, row.UserID, "publish failed: "+err.Error())
+			failed++
+		}
+	}
+
+	log.Printf("🧪 Regression run %s: %d items for %s %s by %s", runID, len(req.Items), model, req.ModelVersion, admin.ID)
+	c.JSON(http.StatusAccepted, gin.H{"id": runID, "model": model, "model_version": req.ModelVersion,
+		"items": len(req.Items), "failed_to_queue": failed, "tag": regressionRunTag(runID)})
+}
+
+// RegressionItemReport is one item of GET /admin/regression-runs/:id
+type RegressionItemReport struct {
+	Index      int    `json:"index"`
+	Prompt     string `json:"prompt"`
+	Seed       int64  `json:"seed"`
+	Resolution int    `json:"resolution,omitempty"`
+	Steps      int    `json:"steps,omitempty"`
+	RequestID  string `json:"request_id"`
+	Status     string `json:"status"`
+	ResultKey  string `json:"result_key,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Hash         string `json:"hash,omitempty"` // 64-bit dHash, hex
+	BaselineHash string `json:"baseline_hash,omitempty"`
+	Distance     *int   `json:"distance,omitempty"` // differing bits
+	Flagged      bool   `json:"flagged,omitempty"`
+
+	hash, baselineHash sql.NullInt64
+}
+
+// getRegressionRunHandler handles GET /admin/regression-runs/:id?baseline=&threshold=.
+// baseline names the model version to compare with; it defaults to none
+func getRegressionRunHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	runID := c.Param("id")
+	if _, err := uuid.Parse(runID); err != nil {
+		respondError(c, codeNotFound, "Regression run not found")
+		return
+	}
+	threshold := regressionHashThreshold
+	if raw := c.Query("threshold"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 || n > 64 {
+			fieldError(c, codeValidationFailed, "threshold", "must be 0-64 bits")
+			return
+		}
+		threshold = n
+	}
+
+	var model, version string
+	var createdAt time.Time
+	err := db.QueryRowContext(ctx, `SELECT model, model_version, created_at FROM regression_runs WHERE id = $1`,
+		runID).Scan(&model, &version, &createdAt)
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Regression run not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load regression run %s: %v", runID, err)
+		respondError(c, codeInternal, "Failed to load regression run")
+		return
+	}
+
+	var baselineRun string
+	if compareTo := c.Query("baseline"); compareTo != "" {
+		err := db.QueryRowContext(ctx, `
+			SELECT run_id FROM regression_baselines WHERE model = $1 AND model_version = $2`,
+			model, compareTo).Scan(&baselineRun)
+		if err == sql.ErrNoRows {
+			fieldError(c, codeNotFound, "baseline", "no baseline is stored for "+model+" "+compareTo)
+			return
+		}
+		if err != nil {
+			respondError(c, codeInternal, "Failed to load regression run")
+			return
+		}
+	}
+
+	hashRegressionResults(ctx, runID)
+	items, err := regressionItems(ctx, runID, baselineRun)
+	if err != nil {
+		log.Printf("❌ Failed to load items of regression run %s: %v", runID, err)
+		respondError(c, codeInternal, "Failed to load regression run")
+		return
+	}
+
+	summary := map[string]int{}
+	for _, it := range items {
+		summary[it.Status]++
+		if it.hash.Valid {
+			it.Hash = strconv.FormatUint(uint64(it.hash.Int64), 16)
+		}
+		if it.baselineHash.Valid {
+			it.BaselineHash = strconv.FormatUint(uint64(it.baselineHash.Int64), 16)
+		}
+		if it.hash.Valid && it.baselineHash.Valid {
+			d := bits.OnesCount64(uint64(it.hash.Int64 ^ it.baselineHash.Int64))
+			it.Distance, it.Flagged = &d, d > threshold
+			if it.Flagged {
+				summary["flagged"]++
+			}
+		}
+	}
+	resp := gin.H{"id": runID, "model": model, "model_version": version, "created_at": createdAt,
+		"items": items, "summary": summary, "tag": regressionRunTag(runID)}
+	if baselineRun != "" {
+		resp["baseline_run_id"], resp["threshold"] = baselineRun, threshold
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// regressionItems joins each item with its generation and, given a baseline run, the
+// baseline's item for the same prompt, seed and parameters
+func regressionItems(ctx context.Context, runID, baselineRun string) ([]*RegressionItemReport, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.idx, i.prompt, i.seed, i.resolution, i.steps, i.request_id,
+		       coalesce(g.status, 'missing'), coalesce(g.content_url, ''), coalesce(g.error, ''), i.phash, b.phash
+		FROM regression_run_items i
+		LEFT JOIN generated_content g ON g.request_id = i.request_id
+		LEFT JOIN regression_run_items b ON b.run_id::text = $2 AND b.prompt = i.prompt AND b.seed = i.seed
+		     AND b.resolution = i.resolution AND b.steps = i.steps
+		WHERE i.run_id = $1
+		ORDER BY i.idx`, runID, baselineRun)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*RegressionItemReport{}
+	for rows.Next() {
+		var it RegressionItemReport
+		if err := rows.Scan(&it.Index, &it.Prompt, &it.Seed, &it.Resolution, &it.Steps, &it.RequestID,
+			&it.Status, &it.ResultKey, &it.Error, &it.hash, &it.baselineHash); err != nil {
+			return nil, err
+		}
+		if it.Status != "completed" {
+			it.ResultKey = ""
+		}
+		list = append(list, &it)
+	}
+	return list, rows.Err()
+}
+
+// hashRegressionResults stores the dHash of completed items that don't have one yet
+func hashRegressionResults(ctx context.Context, runID string) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.idx, g.content_url FROM regression_run_items i
+		JOIN generated_content g ON g.request_id = i.request_id
+		WHERE i.run_id = $1 AND i.phash IS NULL AND g.status = 'completed' AND g.content_url <> ''
+		ORDER BY i.idx LIMIT $2`, runID, regressionHashBatch)
+	if err != nil {
+		log.Printf("⚠️ Failed to list unhashed items of regression run %s: %v", runID, err)
+		return
+	}
+	type pending struct {
+		idx int
+		key string
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		if rows.Scan(&p.idx, &p.key) == nil {
+			list = append(list, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range list {
+		data, err := storage.Get(ctx, p.key)
+		if err != nil {
+			log.Printf("⚠️ Failed to load %s for hashing: %v", p.key, err)
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			log.Printf("⚠️ Failed to decode %s for hashing: %v", p.key, err)
+			continue
+		}
+		db.ExecContext(ctx, `UPDATE regression_run_items SET phash = $3 WHERE run_id = $1 AND idx = $2`,
+			runID, p.idx, int64(dHash(img)))
+	}
+}
+
+// dHash is the 64-bit difference hash of img: it is scaled to 9x8 grey pixels and each
+// bit says whether a pixel is brighter than its right neighbour
+func dHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	xdraw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// putRegressionBaselineHandler handles PUT /admin/regression-baselines/:version {"run_id"}:
+// the run becomes the baseline of its model at that version
+func putRegressionBaselineHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		RunID string `json:"run_id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if _, err := uuid.Parse(body.RunID); err != nil {
+		fieldError(c, codeValidationFailed, "run_id", "must be a regression run ID")
+		return
+	}
+	version := c.Param("version")
+
+	var model string
+	err := db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO regression_baselines (model, model_version, run_id, set_by)
+		SELECT model, $2, id, $3 FROM regression_runs WHERE id = $1
+		ON CONFLICT (model, model_version) DO UPDATE SET run_id = EXCLUDED.run_id, set_by = EXCLUDED.set_by, set_at = now()
+		RETURNING model`, body.RunID, version, admin.ID.String()).Scan(&model)
+	if err == sql.ErrNoRows {
+		fieldError(c, codeNotFound, "run_id", "no such regression run")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to store regression baseline: %v", err)
+		respondError(c, codeInternal, "Failed to store baseline")
+		return
+	}
+	log.Printf("🧪 Regression run %s is the baseline of %s %s (set by %s)", body.RunID, model, version, admin.ID)
+	c.JSON(http.StatusOK, gin.H{"model": model, "model_version": version, "run_id": body.RunID})
+}
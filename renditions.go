@@ -0,0 +1,173 @@
+// renditions.go
+// Sized copies of a generation reported by the worker (original, web, thumbnail), and
+// picking the one a response should link to
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	renditionOriginal  = "original"
+	renditionWeb       = "web"
+	renditionThumbnail = "thumbnail"
+)
+
+// Rendition is one stored copy of a generation, as listed in a completion
+type Rendition struct {
+	Kind      string `json:"kind"`
+	S3Key     string `json:"s3_key,omitempty"` // the object key under either name (field_renames.go)
+	ObjectKey string `json:"object_key,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+
+	legacyKey bool
+}
+
+// renditionsColumn aggregates a row's renditions into JSON alongside generationColumns
+const renditionsColumn = `coalesce((SELECT json_agg(json_build_object('kind', r.kind, 'object_key', r.s3_key,
+		           'width', r.width, 'height', r.height, 'bytes', r.bytes))
+		       FROM generation_renditions r WHERE r.request_id = generated_content.request_id), '[]')`
+
+func decodeRenditions(raw []byte) []Rendition {
+	var list []Rendition
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil
+	}
+	return list
+}
+
+// storeRenditions records a completion's renditions. Completions from workers that only
+// report s3_key get a single "original" rendition for it. The worker's smaller copies of
+// an image aren't watermarked, so for a watermarked plan they are deleted rather than
+// stored: until post-processing is done there is nothing but the original to serve
+func storeRenditions(ctx context.Context, completion ImageGenerationCompletion) error {
+	list := completion.Renditions
+	if len(list) == 0 {
+		if completion.S3Key == "" {
+			return nil
+		}
+		list = []Rendition{{Kind: renditionOriginal, S3Key: completion.S3Key}}
+	}
+	watermarked, err := renditionsWatermarked(ctx, completion.RequestID)
+	if err != nil {
+		return err
+	}
+	for _, r := range list {
+		if r.Kind == "" || r.S3Key == "" {
+			continue
+		}
+		if watermarked && r.Kind != renditionOriginal {
+			if r.S3Key != completion.S3Key {
+				deleteRenditionObject(ctx, completion.RequestID, r.S3Key)
+			}
+			continue
+		}
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO generation_renditions (request_id, kind, s3_key, width, height, bytes)
+			VALUES ($1, $2, $3, nullif($4, 0), nullif($5, 0), nullif($6, 0))
+			ON CONFLICT (request_id, kind) DO UPDATE
+			SET s3_key = EXCLUDED.s3_key, width = EXCLUDED.width, height = EXCLUDED.height, bytes = EXCLUDED.bytes`,
+			completion.RequestID, r.Kind, r.S3Key, r.Width, r.Height, r.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renditionsWatermarked reports whether the row is an image that post-processing will
+// watermark
+func renditionsWatermarked(ctx context.Context, requestID string) (bool, error) {
+	var contentType, plan, tenant string
+	err := db.QueryRowContext(ctx, `
+		SELECT g.content_type, u.plan, g.tenant_id FROM generated_content g
+		JOIN users u ON u.id = g.user_id
+		WHERE g.request_id = $1`, requestID).Scan(&contentType, &plan, &tenant)
+	if err != nil {
+		return false, err
+	}
+	return contentType == "image" && planWatermarked(tenant, plan), nil
+}
+
+// dropRendition forgets a rendition that should no longer be served and deletes its object
+func dropRendition(ctx context.Context, requestID, kind string) error {
+	var key string
+	err := db.QueryRowContext(ctx, `
+		DELETE FROM generation_renditions WHERE request_id = $1 AND kind = $2 RETURNING s3_key`,
+		requestID, kind).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deleteRenditionObject(ctx, requestID, key)
+	return nil
+}
+
+// deleteRenditionObject removes an object nothing will serve. A failure only leaves it
+// for the orphan sweep (orphans.go), since no row points at it any more
+func deleteRenditionObject(ctx context.Context, requestID, key string) {
+	if err := storage.Delete(ctx, key); err != nil {
+		log.Printf("⚠️ Failed to delete rendition %s of %s: %v", key, requestID, err)
+	}
+}
+
+// pickRendition returns the closest available copy to size, falling back towards the
+// original. The original's key is always content_url, which post-processing may have
+// replaced with the watermarked copy
+func (g *Generation) pickRendition(size string) Rendition {
+	switch size {
+	case renditionThumbnail:
+		if r, ok := g.thumbnail(); ok {
+			return r
+		}
+		fallthrough
+	case renditionWeb:
+		if r, ok := g.rendition(renditionWeb); ok {
+			return r
+		}
+	}
+	original, _ := g.rendition(renditionOriginal)
+	original.Kind, original.S3Key = renditionOriginal, g.ContentURL
+	return original
+}
+
+func (g *Generation) rendition(kind string) (Rendition, bool) {
+	for _, r := range g.Renditions {
+		if r.Kind == kind {
+			return r, true
+		}
+	}
+	return Rendition{}, false
+}
+
+// thumbnail prefers the worker's thumbnail over the one post-processing makes
+func (g *Generation) thumbnail() (Rendition, bool) {
+	if r, ok := g.rendition(renditionThumbnail); ok {
+		return r, true
+	}
+	if g.ThumbnailKey != "" {
+		return Rendition{Kind: renditionThumbnail, S3Key: g.ThumbnailKey}, true
+	}
+	return Rendition{}, false
+}
+
+// sizeParam reads ?size= for status and list endpoints; the original is only served by
+// the download endpoint
+func sizeParam(c *gin.Context, fallback string) (string, bool) {
+	size := c.DefaultQuery("size", fallback)
+	if size != renditionThumbnail && size != renditionWeb {
+		fieldError(c, codeInvalidRequest, "size", "must be thumbnail or web")
+		return "", false
+	}
+	return size, true
+}
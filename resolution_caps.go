@@ -0,0 +1,61 @@
+// resolution_caps.go
+// Per-plan image resolution caps at request time. An explicit resolution over the plan's
+// max_image_side is refused with a 422 naming the cap, unless the request sets
+// auto_downscale, which clamps it to the cap instead. Both the requested and the effective
+// size are stored on the row and returned. Caps come from the current plan configuration,
+// so a reload applies to the next request
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var resolutionCapped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mobart_resolution_capped_total",
+	Help: "Image requests over their plan's resolution cap, by plan and outcome (rejected, downscaled).",
+}, []string{"plan", "outcome"})
+
+// maxResolutionFor is the largest resolution limits accepts
+func maxResolutionFor(limits PlanLimits) int {
+	if limits.MaxImageSide > 0 {
+		return min(limits.MaxImageSide, maxResolution)
+	}
+	return maxResolution
+}
+
+// downscaleResolution clamps spec to the plan's cap when autoDownscale is set. over
+// reports a resolution still over the cap; requested is what the request asked for
+func downscaleResolution(spec *generationSpec, limits PlanLimits, autoDownscale bool) (requested int, over bool) {
+	requested = spec.Resolution
+	if limits.MaxImageSide == 0 || spec.Resolution <= limits.MaxImageSide {
+		return requested, false
+	}
+	if !autoDownscale {
+		return requested, true
+	}
+	spec.Resolution = limits.MaxImageSide
+	return requested, false
+}
+
+// enforceResolutionCap applies the cap to spec for POST /generations and /generations/compare,
+// responding with resolution_over_plan and returning false when it refuses
+func enforceResolutionCap(c *gin.Context, spec *generationSpec, limits PlanLimits, autoDownscale bool) (requested int, ok bool) {
+	requested, over := downscaleResolution(spec, limits, autoDownscale)
+	switch {
+	case over:
+		resolutionCapped.WithLabelValues(limits.Plan, "rejected").Inc()
+		respondErrorDetails(c, codeResolutionOverPlan,
+			fmt.Sprintf("resolution %dpx is over the %s plan's %dpx limit; set auto_downscale to generate at %dpx instead",
+				requested, limits.Plan, limits.MaxImageSide, limits.MaxImageSide),
+			gin.H{"field": "resolution", "requested_resolution": requested, "max_resolution": limits.MaxImageSide, "plan": limits.Plan})
+		return requested, false
+	case requested != spec.Resolution:
+		resolutionCapped.WithLabelValues(limits.Plan, "downscaled").Inc()
+	}
+	return requested, true
+}
@@ -0,0 +1,92 @@
+// responses.go
+// Response bodies of the generation endpoints. Each shape is a struct whose JSON keys are
+// fixed here once, so the image, video and text branches (and the endpoints around them)
+// can't drift apart on field names. A generation being submitted is always identified by
+// generation_request_id; later calls about it by request_id, as in Generation. The golden
+// bodies in testdata/contracts/responses pin every shape (see checkResponseShapes)
+
+package main
+
+import "time"
+
+// QueuedGenerationResponse answers POST /generations for a queued kind: queued, deferred
+// until ETA, or held for input moderation
+type QueuedGenerationResponse struct {
+	Type                string     `json:"type"`
+	Status              string     `json:"status"`
+	GenerationRequestID string     `json:"generation_request_id"`
+	Credits             int        `json:"credits"`
+	EstimatedSeconds    float64    `json:"estimated_seconds,omitempty"` // queued only
+	ETA                 *time.Time `json:"eta,omitempty"`
+	Message             string     `json:"message"`
+
+	// Image only: the size generated, and the one asked for when a resolution was given
+	Resolution          int `json:"resolution,omitempty"`
+	RequestedResolution int `json:"requested_resolution,omitempty"`
+
+	Deprecation *ModelDeprecation `json:"deprecation,omitempty"` // the model is being retired (model_lifecycle.go)
+}
+
+// CompletedTextResponse answers POST /generations for text, which completes in the request
+type CompletedTextResponse struct {
+	Type                string `json:"type"`
+	Status              string `json:"status"`
+	GenerationRequestID string `json:"generation_request_id"`
+	Data                string `json:"data"` // the generated text
+	ConversationID      string `json:"conversation_id"`
+}
+
+// QueuedComparisonResponse answers POST /generations/compare
+type QueuedComparisonResponse struct {
+	Type         string                   `json:"type"`
+	ComparisonID string                   `json:"comparison_id"`
+	Seed         int64                    `json:"seed"`
+	Credits      int                      `json:"credits"`
+	Generations  []ComparisonSideResponse `json:"generations"`
+	Message      string                   `json:"message"`
+}
+
+// ComparisonSideResponse is one side of a queued comparison
+type ComparisonSideResponse struct {
+	Model               string            `json:"model"`
+	GenerationRequestID string            `json:"generation_request_id"`
+	Credits             int               `json:"credits"`
+	Status              string            `json:"status"`
+	Deprecation         *ModelDeprecation `json:"deprecation,omitempty"`
+}
+
+// GenerationStatusResponse answers a call that moves a generation to a new status: a
+// cancel, or a late result's claim (which also says what it charged)
+type GenerationStatusResponse struct {
+	RequestID      string `json:"request_id"`
+	Status         string `json:"status"`
+	CreditsCharged int    `json:"credits_charged,omitempty"`
+}
+
+// TrashStateResponse answers moving a generation into or out of the trash
+type TrashStateResponse struct {
+	RequestID  string     `json:"request_id"`
+	Trashed    bool       `json:"trashed"`
+	PurgeAfter *time.Time `json:"purge_after,omitempty"`
+}
+
+// GenerationListResponse is a page of generations; NextCursor is set when there may be
+// another page. NextBefore is the same position for clients still paging with ?before=
+type GenerationListResponse struct {
+	Generations []*Generation `json:"generations"`
+	NextCursor  string        `json:"next_cursor,omitempty"`
+	NextBefore  string        `json:"next_before,omitempty"`
+}
+
+// SimilarGenerationsResponse answers GET /generations/:id/similar. Pending means the
+// generation isn't embedded yet, so there is nothing to compare against
+type SimilarGenerationsResponse struct {
+	Generations []SimilarGeneration `json:"generations"`
+	Pending     bool                `json:"pending,omitempty"`
+}
+
+// SimilarGeneration is a generation with its similarity to the one asked about
+type SimilarGeneration struct {
+	*Generation
+	Similarity float64 `json:"similarity"` // cosine, 1 is identical
+}
@@ -0,0 +1,225 @@
+// retention.go
+// Expires images and videos past their plan's retention period, removing the objects
+// and marking the rows expired so history keeps the prompt and parameters
+
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	retentionLockKey = "retention:lock"
+	retentionLockTTL = time.Minute // renewed while a pass runs
+)
+
+var (
+	retentionInterval  = getEnvDuration("RETENTION_INTERVAL", time.Hour)
+	retentionWarnAhead = getEnvDuration("RETENTION_WARN_AHEAD", 3*24*time.Hour)
+	retentionBatchSize = getEnvInt("RETENTION_BATCH_SIZE", 200)
+	// Keeps us well below S3's per-prefix request limits alongside normal traffic
+	retentionDeletesPerSecond = getEnvInt("RETENTION_DELETES_PER_SECOND", 20)
+
+	retentionResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_retention_total",
+		Help: "Retention job outcomes per generation, by result (warned, expired, failed).",
+	}, []string{"result"})
+)
+
+// expiringGeneration is a row the retention job acts on
+type expiringGeneration struct {
+	RequestID     string
+	CreatedAt     time.Time
+	ContentURL    string
+	PosterKey     string
+	ThumbnailKey  string
+	Postprocessed bool
+	RenditionKeys []string
+}
+
+// expiringColumns selects an expiringGeneration from generated_content g
+const expiringColumns = `g.request_id, g.created_at, g.content_url, coalesce(g.poster_key, ''),
+		       coalesce(g.thumbnail_key, ''), g.postprocessed_at IS NOT NULL,
+		       array(SELECT r.s3_key FROM generation_renditions r WHERE r.request_id = g.request_id)`
+
+func scanExpiring(row rowScanner) (expiringGeneration, error) {
+	var g expiringGeneration
+	err := row.Scan(&g.RequestID, &g.CreatedAt, &g.ContentURL, &g.PosterKey, &g.ThumbnailKey, &g.Postprocessed,
+		pq.Array(&g.RenditionKeys))
+	return g, err
+}
+
+// objectKeys lists everything stored for the row, including the pre-watermark original
+// and the worker's renditions, once each
+func (g expiringGeneration) objectKeys() []string {
+	var keys []string
+	if g.ContentURL != "" {
+		keys = append(keys, g.ContentURL)
+		if g.Postprocessed {
+			keys = append(keys, strings.TrimSuffix(g.ContentURL, "-final.png")+".png")
+		}
+	}
+	keys = append(keys, g.PosterKey, g.ThumbnailKey)
+	keys = append(keys, g.RenditionKeys...)
+
+	seen := map[string]bool{"": true}
+	unique := keys[:0]
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, k)
+		}
+	}
+	return unique
+}
+
+// startRetentionJob runs the retention pass on one instance at a time
+func startRetentionJob() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("retention", nil, func() {
+			ctx, release, ok := acquireJobLock(backgroundStorage(context.Background()), retentionLockKey, retentionLockTTL)
+			if !ok {
+				return
+			}
+			defer release()
+			runRetention(ctx)
+		})
+	}
+}
+
+// runRetention is safe to interrupt: progress lives in the rows themselves
+// (expiry_notified_at, status = 'expired'), so the next pass picks up where this one stopped
+func runRetention(ctx context.Context) {
+	throttle := time.NewTicker(time.Second / time.Duration(max(retentionDeletesPerSecond, 1)))
+	defer throttle.Stop()
+
+	for _, t := range allTenants() {
+		for _, l := range allPlanLimits(t.ID) {
+			if l.RetentionSeconds <= 0 {
+				continue
+			}
+			if ctx.Err() != nil {
+				return // the lock was lost; the holder now carries on
+			}
+			warnExpiring(ctx, t.ID, l.Plan, l.retention())
+			expireGenerations(ctx, t.ID, l.Plan, l.retention(), throttle.C)
+		}
+	}
+}
+
+// loadExpiring pages through a tenant's plan's completed media and unclaimed late results created
+// before cutoff, either not yet warned (warnedBefore nil) or warned before warnedBefore.
+// Keyed on (created_at, request_id) so rows that fail don't stall the pass
+func loadExpiring(ctx context.Context, tenantID, plan string, cutoff time.Time, warnedBefore *time.Time,
+	after expiringGeneration) ([]expiringGeneration, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+expiringColumns+`
+		FROM generated_content g
+		JOIN users u ON u.id = g.user_id
+		WHERE u.plan = $1 AND u.tenant_id = $7 AND (g.status = 'completed' OR (g.status = 'timed_out' AND g.late_result))
+		  AND g.content_type IN ('image', 'video')
+		  AND g.created_at < $2
+		  AND CASE WHEN $3::timestamptz IS NULL THEN g.expiry_notified_at IS NULL
+		           ELSE g.expiry_notified_at <= $3 END
+		  AND (g.created_at, g.request_id) > ($4, $5)
+		ORDER BY g.created_at, g.request_id
+		LIMIT $6`, plan, cutoff, warnedBefore, after.CreatedAt, after.RequestID, retentionBatchSize, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []expiringGeneration
+	for rows.Next() {
+		g, err := scanExpiring(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, rows.Err()
+}
+
+// warnExpiring notifies owners retentionWarnAhead before their generations are removed
+func warnExpiring(ctx context.Context, tenantID, plan string, retention time.Duration) {
+	cutoff := time.Now().Add(-retention + retentionWarnAhead)
+	var after expiringGeneration
+	for {
+		batch, err := loadExpiring(ctx, tenantID, plan, cutoff, nil, after)
+		if err != nil {
+			log.Printf("❌ Failed to load expiring %s generations: %v", plan, err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+		for _, g := range batch {
+			after = g
+			if err := notifyExpiring(ctx, g.RequestID, g.CreatedAt.Add(retention)); err != nil {
+				log.Printf("⚠️ Failed to warn about expiring generation %s: %v", g.RequestID, err)
+				retentionResults.WithLabelValues("failed").Inc()
+				continue
+			}
+			db.ExecContext(ctx, `UPDATE generated_content SET expiry_notified_at = now() WHERE request_id = $1`, g.RequestID)
+			retentionResults.WithLabelValues("warned").Inc()
+		}
+	}
+}
+
+// expireGenerations deletes objects before marking rows, so a crash in between only
+// repeats idempotent deletes. Rows are only removed once their owner has had the full
+// warning period, even if that runs past the retention date
+func expireGenerations(ctx context.Context, tenantID, plan string, retention time.Duration, throttle <-chan time.Time) {
+	cutoff := time.Now().Add(-retention)
+	warnedBefore := time.Now().Add(-retentionWarnAhead)
+	var after expiringGeneration
+	for {
+		batch, err := loadExpiring(ctx, tenantID, plan, cutoff, &warnedBefore, after)
+		if err != nil {
+			log.Printf("❌ Failed to load expired %s generations: %v", plan, err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+	rows:
+		for _, g := range batch {
+			after = g
+			for _, key := range g.objectKeys() {
+				<-throttle
+				if err := storage.Delete(ctx, key); err != nil {
+					log.Printf("⚠️ Failed to delete %s for expired generation %s: %v", key, g.RequestID, err)
+					retentionResults.WithLabelValues("failed").Inc()
+					continue rows
+				}
+			}
+			_, err := transitionGeneration(ctx, g.RequestID, generationWrite{
+				Writer: "retention", To: "expired", From: []string{"completed", "timed_out"},
+				Set: "expired_at = now(), content_url = '', poster_key = NULL, thumbnail_key = NULL, late_result = false",
+			})
+			if err == nil {
+				_, err = db.ExecContext(ctx, `DELETE FROM generation_renditions WHERE request_id = $1`, g.RequestID)
+			}
+			if err == nil {
+				err = setStoredBytes(ctx, g.RequestID, 0)
+			}
+			if err != nil {
+				log.Printf("❌ Failed to mark generation %s expired: %v", g.RequestID, err)
+				retentionResults.WithLabelValues("failed").Inc()
+				continue
+			}
+			retentionResults.WithLabelValues("expired").Inc()
+		}
+		log.Printf("🧹 Retention pass expired up to %d %s generations", len(batch), plan)
+	}
+}
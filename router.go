@@ -0,0 +1,255 @@
+// router.go
+// Gin engine with request IDs, access logs, panic recovery and the API routes
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var adminUserIDs = strings.Split(getEnv("ADMIN_USER_IDS", ""), ",")
+
+// setupRouter builds the HTTP engine used by main
+func setupRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(requestIDMiddleware(), tenantMiddleware(), accessLogMiddleware(), recoveryMiddleware(), bodyLimitMiddleware())
+
+	r.GET("/healthz", healthHandler)
+	r.GET("/readyz", readyHandler)
+	r.GET("/status", statusHandler)
+
+	// Worker pull mode (job_pull.go), authenticated by INTERNAL_API_TOKEN rather than a user
+	internal := r.Group("/internal", internalAuth)
+	internal.GET("/jobs/next", nextJobHandler)
+	internal.POST("/jobs/:id/complete", completeJobHandler)
+	internal.POST("/jobs/:id/heartbeat", heartbeatJobHandler)
+
+	// The public API, under /v1, /v2 and unversioned (api_versions.go)
+	registerVersionedRoutes(r, apiRoutes)
+	return r
+}
+
+// apiRoutes registers the public API on one version's group
+func apiRoutes(r *gin.RouterGroup) {
+	// The signed token is the credential, so links open while the app's session refreshes
+	r.POST("/deeplink/resolve", resolveDeepLinkHandler)
+	// Likewise the refresh token, which is what a client with an expired access token has
+	r.POST("/auth/refresh", refreshTokensHandler)
+
+	// Challenge pages are public; entering and voting need an account
+	r.GET("/challenges", listChallengesHandler)
+	r.GET("/challenges/:id", getChallengeHandler)
+	r.GET("/challenges/:id/entries", challengeEntriesHandler)
+
+	api := r.Group("/", authMiddleware, requireActiveAccount)
+	api.POST("/auth/session", createSessionHandler)
+	api.POST("/auth/token", issueTokensHandler)
+	api.POST("/auth/logout", logoutHandler)
+	api.POST("/auth/logout-all", logoutAllHandler)
+	api.POST("/generations", requiresBroker, protectedEndpointWithAsyncGeneration)
+	api.POST("/generations/estimate", estimateGenerationHandler)
+	api.POST("/generations/compare", requiresBroker, compareGenerationsHandler)
+	api.POST("/generations/tags", bulkTagsHandler)
+	api.GET("/generations", listGenerationsHandler)
+	api.GET("/generations/trash", listTrashHandler)
+	api.DELETE("/generations/trash", emptyTrashHandler)
+	api.GET("/generations/:id", getGenerationStatus)
+	api.DELETE("/generations/:id", deleteGenerationHandler)
+	api.POST("/generations/:id/restore", restoreGenerationHandler)
+	api.POST("/generations/:id/cancel", cancelGenerationHandler)
+	api.POST("/generations/:id/claim-late", claimLateResultHandler)
+	api.PATCH("/generations/:id/tags", patchGenerationTagsHandler)
+	api.GET("/generations/:id/similar", similarGenerationsHandler)
+	api.GET("/generations/:id/download", downloadGenerationHandler)
+	api.GET("/comparisons/:id", getComparisonHandler)
+	api.POST("/comparisons/:id/vote", voteComparisonHandler)
+	api.POST("/uploads", uploadInputHandler)
+	api.GET("/uploads/:id", getUploadSessionHandler)
+	api.PUT("/uploads/:id/chunks/:n", putUploadChunkHandler)
+	api.POST("/uploads/:id/complete", completeUploadHandler)
+
+	api.GET("/events", eventsSSEHandler)
+	api.GET("/events/ws", eventsWSHandler)
+	api.GET("/stats", getUserStats)
+	api.GET("/usage", getUsageHandler)
+
+	api.GET("/drafts", listDraftsHandler)
+	api.PUT("/drafts", saveDraftHandler)
+	api.DELETE("/drafts/:id", deleteDraftHandler)
+
+	api.GET("/budget", getBudgetHandler)
+	api.PUT("/budget", putBudgetHandler)
+	api.POST("/budget/thresholds", createBudgetThresholdHandler)
+	api.PATCH("/budget/thresholds/:threshold_id", patchBudgetThresholdHandler)
+	api.DELETE("/budget/thresholds/:threshold_id", deleteBudgetThresholdHandler)
+	api.GET("/models", listModelsHandler)
+	api.GET("/tags", listTagsHandler)
+	api.GET("/prompts/suggest", suggestPromptsHandler)
+
+	api.GET("/conversations", listConversationsHandler)
+	api.GET("/conversations/:id/messages", listConversationMessagesHandler)
+	api.DELETE("/conversations/:id", deleteConversationHandler)
+
+	api.POST("/orgs", createOrgHandler)
+	api.GET("/orgs", listOrgsHandler)
+	api.POST("/orgs/:id/invites", createInviteHandler)
+	api.GET("/orgs/:id/members", listMembersHandler)
+	api.PUT("/orgs/:id/members/:user_id", setMemberRoleHandler)
+	api.DELETE("/orgs/:id/members/:user_id", removeMemberHandler)
+	api.GET("/orgs/:id/usage", orgUsageHandler)
+	api.GET("/orgs/:id/audit", orgAuditHandler)
+	api.GET("/orgs/:id/generations", orgGalleryHandler)
+	api.GET("/orgs/:id/budget", getBudgetHandler)
+	api.PUT("/orgs/:id/budget", putBudgetHandler)
+	api.POST("/orgs/:id/budget/thresholds", createBudgetThresholdHandler)
+	api.PATCH("/orgs/:id/budget/thresholds/:threshold_id", patchBudgetThresholdHandler)
+	api.DELETE("/orgs/:id/budget/thresholds/:threshold_id", deleteBudgetThresholdHandler)
+	api.POST("/invites/:token/accept", acceptInviteHandler)
+
+	api.POST("/templates", createTemplateHandler)
+	api.GET("/templates", listTemplatesHandler)
+	api.GET("/templates/:id", getTemplateHandler)
+	api.PATCH("/templates/:id", updateTemplateHandler)
+	api.DELETE("/templates/:id", deleteTemplateHandler)
+
+	api.PUT("/notifications/channels", upsertNotificationChannelHandler)
+	api.GET("/notifications/channels", listNotificationChannelsHandler)
+	api.DELETE("/notifications/channels/:id", deleteNotificationChannelHandler)
+	api.POST("/notifications/channels/:id/test", testNotificationChannelHandler)
+	api.GET("/notifications/preferences", getNotificationPreferencesHandler)
+	api.PUT("/notifications/preferences", putNotificationPreferencesHandler)
+	api.GET("/referrals", getReferralsHandler)
+	api.GET("/referrals/codes/:code", lookupReferralCodeHandler)
+	api.POST("/referrals/redeem", redeemReferralHandler)
+	api.POST("/challenges/:id/enter", enterChallengeHandler)
+	api.DELETE("/challenges/:id/entry", withdrawChallengeEntryHandler)
+	api.POST("/challenges/:id/vote", voteChallengeHandler)
+
+	// Admins see their own tenant: its stats, users, generations, plans, broadcasts and
+	// challenges. Everything else is deployment-wide, for the default tenant's admins
+	admin := api.Group("/admin", adminOnly)
+	admin.GET("/stats", getAdminStats)
+	admin.GET("/users/:id", requireTenantUser, adminUserHandler)
+	admin.GET("/users/:id/flags", requireTenantUser, getUserFlagsHandler)
+	admin.DELETE("/users/:id/flags", requireTenantUser, clearUserFlagsHandler)
+	admin.POST("/users/:id/disable", requireTenantUser, disableAccountHandler)
+	admin.POST("/users/:id/enable", requireTenantUser, enableAccountHandler)
+	admin.DELETE("/users/:id", requireTenantUser, deleteAccountHandler)
+	admin.GET("/generations/:id/events", requireTenantGeneration, generationEventsHandler)
+	admin.POST("/generations/:id/requeue", requireTenantGeneration, requiresBroker, requeueGenerationHandler)
+	admin.GET("/plans", listPlansHandler)
+	admin.PUT("/plans/:name", putPlanHandler)
+	admin.POST("/plans/reload", reloadPlansHandler)
+	admin.POST("/broadcast", createBroadcastHandler)
+	admin.GET("/broadcasts", listBroadcastsHandler)
+	admin.POST("/broadcasts/:id/revoke", revokeBroadcastHandler)
+	admin.GET("/challenges", adminListChallengesHandler)
+	admin.POST("/challenges", createChallengeHandler)
+	admin.PATCH("/challenges/:id", updateChallengeHandler)
+	admin.DELETE("/challenges/:id", deleteChallengeHandler)
+
+	ops := admin.Group("", operatorOnly)
+	ops.GET("/overview", adminOverviewHandler)
+	ops.GET("/ui", adminUIHandler)
+	ops.GET("/ui/events", adminUIEventsHandler)
+	ops.GET("/ui/requests/:id", adminUIRequestHandler)
+	ops.GET("/queue", adminQueueHandler)
+	ops.GET("/queue/history", queueHistoryHandler)
+	ops.GET("/contracts/compatibility", fieldCompatibilityHandler)
+	ops.GET("/costs", adminCostsHandler)
+	ops.GET("/comparisons", adminComparisonsHandler)
+	ops.GET("/abuse/flags", listFlagsHandler)
+	ops.GET("/abuse/thresholds", getAbuseThresholdsHandler)
+	ops.PUT("/abuse/thresholds", putAbuseThresholdsHandler)
+	ops.GET("/workers", listWorkersHandler)
+	ops.GET("/workers/:id", getWorkerHandler)
+	ops.POST("/workers/:id/drain", drainWorkerHandler)
+	ops.DELETE("/workers/:id/drain", resumeWorkerHandler)
+	ops.GET("/deliveries", listDeliveriesHandler)
+	ops.POST("/deliveries/:id/retry", retryDeliveryHandler)
+	ops.GET("/models/lifecycle", listModelLifecyclesHandler)
+	ops.GET("/models/:model/lifecycle", getModelLifecycleHandler)
+	ops.PUT("/models/:model/lifecycle", putModelLifecycleHandler)
+	ops.POST("/regression-runs", createRegressionRunHandler)
+	ops.GET("/regression-runs/:id", getRegressionRunHandler)
+	ops.PUT("/regression-baselines/:version", putRegressionBaselineHandler)
+	ops.GET("/mode", getModeHandler)
+	ops.PUT("/mode", setModeHandler)
+	ops.GET("/backfills", listBackfillsHandler)
+	ops.GET("/dlq", listDLQHandler)
+	ops.POST("/dlq/replay", bulkReplayDLQHandler)
+	ops.POST("/dlq/:id/replay", replayDLQHandler)
+	ops.POST("/dlq/:id/discard", discardDLQHandler)
+	ops.GET("/orphan-sweeps", listOrphanSweepsHandler)
+	ops.POST("/orphan-sweeps", startOrphanSweepHandler)
+	ops.GET("/backfills/:name", getBackfillHandler)
+	ops.POST("/backfills/:name/start", requiresBroker, startBackfillHandler)
+	ops.POST("/backfills/:name/pause", pauseBackfillHandler)
+}
+
+// requestIDMiddleware propagates or assigns the correlation ID for the request
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = newID()
+		}
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// recoveryMiddleware reports handler panics with request, user and correlation IDs attached
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				if errors.Is(asError(r), http.ErrAbortHandler) {
+					panic(r)
+				}
+				tags := map[string]string{
+					"where":      "http",
+					"method":     c.Request.Method,
+					"route":      c.FullPath(),
+					"request_id": c.GetString("requestID"),
+				}
+				if u, ok := c.Get("currentUser"); ok {
+					if user, ok := u.(*repository.User); ok {
+						tags["user_id"] = user.ID.String()
+					}
+				}
+				errorReporter.Report(panicError(r), tags)
+				respondError(c, codeInternal, "Internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
+
+func asError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// adminOnly lets through the request tenant's admins: ADMIN_USER_IDS for the default
+// tenant, TENANT_<ID>_ADMIN_USER_IDS for the others
+func adminOnly(c *gin.Context) {
+	if isAdmin(c, c.MustGet("currentUser").(*repository.User)) {
+		c.Next()
+		return
+	}
+	respondError(c, codeAdminRequired, "Admin access required")
+}
+
+func isAdmin(c *gin.Context, user *repository.User) bool {
+	return currentTenant(c).isAdmin(user.ID.String())
+}
@@ -0,0 +1,79 @@
+// secrets.go
+// AES-GCM encryption for small secrets stored in the database (webhook URLs)
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+)
+
+var secretsAEAD cipher.AEAD
+
+func init() {
+	raw := getEnv("SECRETS_KEY", "")
+	if raw == "" {
+		log.Println("⚠️ SECRETS_KEY not set; storing notification webhooks is disabled")
+		return
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		log.Fatalf("❌ Invalid SECRETS_KEY: %v", err)
+	}
+	secretsAEAD = aead
+}
+
+// newAEAD builds AES-256-GCM from a base64-encoded 32-byte key
+func newAEAD(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealString returns base64(nonce || ciphertext)
+func sealString(aead cipher.AEAD, plaintext string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+func openString(aead cipher.AEAD, encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("ciphertext too short")
+	}
+	plain, err := aead.Open(nil, sealed[:n], sealed[n:], nil)
+	return string(plain), err
+}
+
+var errSecretsDisabled = errors.New("secrets encryption is not configured")
+
+func encryptSecret(plaintext string) (string, error) {
+	if secretsAEAD == nil {
+		return "", errSecretsDisabled
+	}
+	return sealString(secretsAEAD, plaintext)
+}
+
+func decryptSecret(encoded string) (string, error) {
+	if secretsAEAD == nil {
+		return "", errSecretsDisabled
+	}
+	return openString(secretsAEAD, encoded)
+}
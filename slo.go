@@ -0,0 +1,195 @@
+// slo.go
+// The generation SLO, computed from the completion pipeline: a generation is good when it
+// completes within SLO_LATENCY_THRESHOLD of being published, and bad when it fails or
+// takes longer. Burn rates over 5m (fast) and 1h (slow) are the bad ratio divided by the
+// error budget, 1 - SLO_TARGET. When the fast burn passes SLO_FAST_BURN_ALERT the monitor
+// alerts, and optionally reports the error and broadcasts SLO_ALERT_BROADCAST. Each instance
+// counts the completions it applies, so with several instances each sees its share
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const sloBroadcastKey = "slo:alert:broadcast"
+
+var (
+	sloTarget           = getEnvFloat("SLO_TARGET", 0.99)
+	sloLatencyThreshold = getEnvDuration("SLO_LATENCY_THRESHOLD", 3*time.Minute)
+	sloFastBurnAlert    = getEnvFloat("SLO_FAST_BURN_ALERT", 14.4)
+	// A 5m window with fewer events than this doesn't alert; a handful of failures isn't a trend
+	sloMinEvents      = getEnvInt("SLO_MIN_EVENTS", 20)
+	sloCheckInterval  = getEnvDuration("SLO_CHECK_INTERVAL", 30*time.Second)
+	sloAlertRepeat    = getEnvDuration("SLO_ALERT_REPEAT", 15*time.Minute)
+	sloAlertReport    = getEnvBool("SLO_ALERT_REPORT", false)
+	sloAlertBroadcast = getEnv("SLO_ALERT_BROADCAST", "") // announcement to users; empty sends none
+	// Fast, then slow
+	sloWindows = []time.Duration{5 * time.Minute, time.Hour}
+
+	sloEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_slo_events_total",
+		Help: "Generations counted against the SLO, by outcome (good, slow, failed).",
+	}, []string{"outcome"})
+	sloAttainmentGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_slo_attainment",
+		Help: "Share of generations within the SLO over a rolling window.",
+	}, []string{"window"})
+	sloBurnRateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_slo_burn_rate",
+		Help: "Error budget burn rate over a rolling window; 1 spends the budget exactly.",
+	}, []string{"window"})
+	sloAlerts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mobart_slo_burn_alerts_total",
+		Help: "Times the fast burn rate crossed SLO_FAST_BURN_ALERT.",
+	})
+)
+
+// sloFlow counts good, then total generations
+var sloFlow = &minuteCounts{}
+
+// recordSLOCompletion counts an applied completion, timed from its latest publish
+func recordSLOCompletion(ctx context.Context, requestID string) {
+	var seconds float64
+	err := db.QueryRowContext(ctx, `
+		SELECT extract(epoch FROM now() - coalesce(dispatched_at, created_at)) FROM generated_content
+		WHERE request_id = $1`, requestID).Scan(&seconds)
+	if err != nil {
+		log.Printf("⚠️ Failed to time completion %s for the SLO: %v", requestID, err)
+		return
+	}
+	if seconds <= sloLatencyThreshold.Seconds() {
+		sloEvents.WithLabelValues("good").Inc()
+		sloFlow.add(1, 1)
+	} else {
+		sloEvents.WithLabelValues("slow").Inc()
+		sloFlow.add(0, 1)
+	}
+}
+
+// recordSLOFailure counts an applied failure
+func recordSLOFailure() {
+	sloEvents.WithLabelValues("failed").Inc()
+	sloFlow.add(0, 1)
+}
+
+// SLOWindow is attainment and burn over one rolling window
+type SLOWindow struct {
+	Window     string   `json:"window"`
+	Good       int      `json:"good"`
+	Total      int      `json:"total"`
+	Attainment *float64 `json:"attainment"` // null with no events
+	BurnRate   float64  `json:"burn_rate"`
+}
+
+// SLOStatus is the SLO section of /admin/stats and the status page
+type SLOStatus struct {
+	Target                  float64     `json:"target"`
+	LatencyThresholdSeconds float64     `json:"latency_threshold_seconds"`
+	Windows                 []SLOWindow `json:"windows"`
+	FastBurnAlert           float64     `json:"fast_burn_alert"`
+	Alerting                bool        `json:"alerting"`
+	Alerts                  int64       `json:"alerts"`
+}
+
+var (
+	sloAlert struct {
+		sync.Mutex
+		alerting      bool
+		lastAlertedAt time.Time
+	}
+	sloAlertCount atomic.Int64
+)
+
+// currentSLO computes every window now
+func currentSLO() SLOStatus {
+	s := SLOStatus{Target: sloTarget, LatencyThresholdSeconds: sloLatencyThreshold.Seconds(),
+		FastBurnAlert: sloFastBurnAlert, Alerts: sloAlertCount.Load()}
+	budget := math.Max(1-sloTarget, 1e-9)
+	for _, w := range sloWindows {
+		good, total := sloFlow.sum(w)
+		sw := SLOWindow{Window: w.String(), Good: good, Total: total}
+		if total > 0 {
+			attainment := float64(good) / float64(total)
+			sw.Attainment = &attainment
+			sw.BurnRate = math.Round((1-attainment)/budget*100) / 100
+		}
+		s.Windows = append(s.Windows, sw)
+	}
+	sloAlert.Lock()
+	s.Alerting = sloAlert.alerting
+	sloAlert.Unlock()
+	return s
+}
+
+// startSLOMonitor updates the SLO gauges every SLO_CHECK_INTERVAL, alerting when the fast
+// burn crosses SLO_FAST_BURN_ALERT and every SLO_ALERT_REPEAT while it stays there
+func startSLOMonitor() {
+	ticker := time.NewTicker(sloCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("slo_monitor", nil, func() {
+			s := currentSLO()
+			for _, w := range s.Windows {
+				sloBurnRateGauge.WithLabelValues(w.Window).Set(w.BurnRate)
+				if w.Attainment != nil {
+					sloAttainmentGauge.WithLabelValues(w.Window).Set(*w.Attainment)
+				}
+			}
+
+			fast := s.Windows[0]
+			burning := fast.Total >= sloMinEvents && fast.BurnRate >= sloFastBurnAlert
+			sloAlert.Lock()
+			was := sloAlert.alerting
+			sloAlert.alerting = burning
+			now := clock.Now()
+			alert := burning && (!was || now.Sub(sloAlert.lastAlertedAt) >= sloAlertRepeat)
+			if alert {
+				sloAlert.lastAlertedAt = now
+			}
+			sloAlert.Unlock()
+
+			switch {
+			case alert:
+				alertSLOBurn(s)
+			case was && !burning:
+				log.Printf("✅ SLO burn rate back under the alert: %.2f over %s", fast.BurnRate, fast.Window)
+			}
+		})
+	}
+}
+
+func alertSLOBurn(s SLOStatus) {
+	fast, slow := s.Windows[0], s.Windows[len(s.Windows)-1]
+	sloAlertCount.Add(1)
+	sloAlerts.Inc()
+	log.Printf("🚨 SLO fast burn rate %.2f over the alert (slow %.2f): %d of %d good against a %.4g target",
+		fast.BurnRate, slow.BurnRate, fast.Good, fast.Total, s.Target)
+	if sloAlertReport {
+		errorReporter.Report(errors.New("SLO fast burn rate over the alert"), map[string]string{
+			"where": "slo_monitor", "burn_rate": fmt.Sprint(fast.BurnRate), "slow_burn_rate": fmt.Sprint(slow.BurnRate)})
+	}
+	if sloAlertBroadcast == "" {
+		return
+	}
+	// One announcement for the fleet per repeat interval, whichever instance alerts first
+	ctx := context.Background()
+	if ok, err := rdb.SetNX(ctx, sloBroadcastKey, instanceID, sloAlertRepeat).Result(); err != nil || !ok {
+		return
+	}
+	expires := clock.Now().Add(sloAlertRepeat)
+	if _, err := sendBroadcast(ctx, sloAlertBroadcast, "warning", nil, "slo_monitor", &expires); err != nil {
+		log.Printf("⚠️ Failed to broadcast the SLO alert: %v", err)
+	}
+}
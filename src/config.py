@@ -1,4 +1,5 @@
 import os
+import socket
 from dotenv import load_dotenv
 
 load_dotenv()
@@ -11,8 +12,22 @@ class Config:
     REDIS_PASSWORD = os.getenv("REDIS_PASSWORD", "")
     
     # Redis Channels  
-    GENERATION_REQUEST_CHANNEL = os.getenv("GENERATION_REQUEST_CHANNEL", "image_requests")
-    GENERATION_COMPLETE_CHANNEL = os.getenv("COMPLETION_CHANNEL", "image_completions")
+    GENERATION_REQUEST_CHANNEL = os.getenv("GENERATION_REQUEST_CHANNEL", "image_generation_requests")
+    GENERATION_COMPLETE_CHANNEL = os.getenv("COMPLETION_CHANNEL", "image_generation_complete")
+    
+    WORKER_HEARTBEAT_CHANNEL = os.getenv("WORKER_HEARTBEAT_CHANNEL", "worker_heartbeats")
+    WORKER_CONTROL_CHANNEL = os.getenv("WORKER_CONTROL_CHANNEL", "worker_control")
+    WORKER_ID = os.getenv("WORKER_ID", socket.gethostname())
+    
+    # What the worker heartbeats: its model, how many jobs it runs at once, and how often
+    # (the backend's WORKER_HEARTBEAT_INTERVAL)
+    WORKER_MODEL = os.getenv("WORKER_MODEL", os.getenv("DEFAULT_IMAGE_MODEL", "stable-image-ultra"))
+    WORKER_MAX_CONCURRENT = 1
+    WORKER_HEARTBEAT_INTERVAL = float(os.getenv("WORKER_HEARTBEAT_INTERVAL_SECONDS", "10"))
+    
+    # Capped stream mirroring the completion channel so the Go listener can replay downtime
+    COMPLETION_ARCHIVE_STREAM = os.getenv("COMPLETION_ARCHIVE_STREAM", f"{GENERATION_COMPLETE_CHANNEL}:archive")
+    COMPLETION_ARCHIVE_MAXLEN = int(os.getenv("COMPLETION_ARCHIVE_MAXLEN", "10000"))
     
     # AWS S3 Configuration
     AWS_ACCESS_KEY_ID = os.getenv("AWS_ACCESS_KEY_ID")
@@ -31,6 +46,12 @@ class Config:
     # Go Backend Configuration
     GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
     
+    # Prompts in logs (log_policy.py): hash, prefix, or full outside production
+    APP_ENV = os.getenv("APP_ENV", "development")
+    PROMPT_LOG_MODE = os.getenv("PROMPT_LOG_MODE", "hash")
+    PROMPT_LOG_PREFIX_CHARS = int(os.getenv("PROMPT_LOG_PREFIX_CHARS", "24"))
+    PROMPT_LOG_HASH_KEY = os.getenv("PROMPT_LOG_HASH_KEY", "")
+    
     # Image Processing Configuration
     MAX_IMAGE_SIZE = (1024, 1024)  # Max dimensions
     PIXEL_ART_SIZE = 64  # Target pixel art resolution
@@ -0,0 +1,42 @@
+"""How prompts appear in worker logs; mirrors prompt_logging.go in the Go tree.
+
+PROMPT_LOG_MODE=hash (the default) logs a keyed hash and the length, prefix adds the first
+PROMPT_LOG_PREFIX_CHARS characters, and full logs the prompt itself, outside production only.
+"""
+import hashlib
+import hmac
+import logging
+import os
+
+from .config import config
+
+logger = logging.getLogger(__name__)
+
+# Keyed so a short prompt can't be found by hashing guesses; set it to match the backend's
+# PROMPT_LOG_HASH_KEY and the same prompt gets the same hash on both sides
+_HASH_KEY = (config.PROMPT_LOG_HASH_KEY or "").encode() or os.urandom(32)
+
+
+def _mode() -> str:
+    mode = config.PROMPT_LOG_MODE
+    if mode == "full" and config.APP_ENV == "production":
+        logger.warning("PROMPT_LOG_MODE=full is ignored in production; logging prompt hashes")
+        return "hash"
+    if mode not in ("hash", "prefix", "full"):
+        logger.warning(f"Unknown PROMPT_LOG_MODE {mode!r}; logging prompt hashes")
+        return "hash"
+    return mode
+
+
+MODE = _mode()
+
+
+def prompt_for_log(prompt: str) -> str:
+    """What a log line may say about prompt"""
+    if MODE == "full":
+        return repr(prompt)
+    digest = hmac.new(_HASH_KEY, prompt.encode(), hashlib.sha256).hexdigest()[:12]
+    tag = f"prompt:{digest} ({len(prompt)} chars)"
+    if MODE == "prefix" and prompt:
+        return f"{tag} {prompt[:config.PROMPT_LOG_PREFIX_CHARS]!r}…"
+    return tag
@@ -0,0 +1,109 @@
+"""Messages the worker publishes to the Go backend.
+
+Keys must match the json tags on ImageGenerationCompletion and WorkerHeartbeat in the Go
+tree; testdata/contracts holds a golden copy of each, checked by test_contracts.py.
+"""
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional
+
+
+# error_code values the Go backend maps to user-facing messages and retry behaviour
+# (worker_errors.go); anything else falls back to matching the error text
+ERROR_OOM = "oom"
+ERROR_NSFW_OUTPUT_BLOCKED = "nsfw_output_blocked"
+ERROR_MODEL_LOAD_FAILED = "model_load_failed"
+ERROR_INVALID_PARAMS = "invalid_params"
+ERROR_INPUT_URL_EXPIRED = "input_url_expired"
+ERROR_UNKNOWN = "unknown"
+
+
+def error_code_for(exc: BaseException) -> str:
+    """Best guess at the error_code for an exception raised while generating"""
+    if isinstance(exc, MemoryError) or "out of memory" in str(exc).lower():
+        return ERROR_OOM
+    if isinstance(exc, ValueError):
+        return ERROR_INVALID_PARAMS
+    return ERROR_UNKNOWN
+
+
+def _now() -> str:
+    return datetime.now(timezone.utc).isoformat().replace('+00:00', 'Z')
+
+
+def _with_lease_token(message: Dict[str, Any], lease_token: int) -> Dict[str, Any]:
+    # The request's fencing token, echoed back when it had one (WORKER_LEASES)
+    if lease_token:
+        message["lease_token"] = lease_token
+    return message
+
+
+def completed(request_id: str, user_id: str, s3_key: str, s3_url: str, generation_time: float,
+              gpu_seconds: float, worker_id: str, timestamp: Optional[str] = None,
+              lease_token: int = 0) -> Dict[str, Any]:
+    return _with_lease_token({
+        "request_id": request_id,
+        "user_id": user_id,
+        "status": "completed",
+        "s3_key": s3_key,
+        "s3_url": s3_url,
+        "generation_time_seconds": generation_time,
+        "gpu_seconds": gpu_seconds,
+        "worker_id": worker_id,
+        "timestamp": timestamp or _now(),
+    }, lease_token)
+
+
+def failed(request_id: str, user_id: str, error: str, worker_id: str, error_code: str = "",
+           timestamp: Optional[str] = None, lease_token: int = 0) -> Dict[str, Any]:
+    message = {
+        "request_id": request_id,
+        "user_id": user_id,
+        "status": "failed",
+        "error": error,
+        "worker_id": worker_id,
+        "timestamp": timestamp or _now(),
+    }
+    if error_code:
+        message["error_code"] = error_code
+    return _with_lease_token(message, lease_token)
+
+
+def progress(request_id: str, user_id: str, percent: float, worker_id: str,
+             timestamp: Optional[str] = None, lease_token: int = 0) -> Dict[str, Any]:
+    return _with_lease_token({
+        "request_id": request_id,
+        "user_id": user_id,
+        "status": "progress",
+        "progress": percent,
+        "worker_id": worker_id,
+        "timestamp": timestamp or _now(),
+    }, lease_token)
+
+
+def processing(request_id: str, user_id: str, started_at: str, worker_id: str,
+               timestamp: Optional[str] = None, lease_token: int = 0) -> Dict[str, Any]:
+    """Acknowledges a picked-up job; the backend moves it from queued to processing"""
+    return _with_lease_token({
+        "request_id": request_id,
+        "user_id": user_id,
+        "status": "processing",
+        "started_at": started_at,
+        "worker_id": worker_id,
+        "timestamp": timestamp or _now(),
+    }, lease_token)
+
+
+def heartbeat(worker_id: str, model: str, max_concurrent: int, current_load: int,
+              draining: bool = False, request_ids: Optional[List[str]] = None) -> Dict[str, Any]:
+    message = {
+        "worker_id": worker_id,
+        "model": model,
+        "max_concurrent": max_concurrent,
+        "current_load": current_load,
+    }
+    if draining:
+        message["draining"] = True
+    if request_ids:
+        # The jobs it's running, whose leases this renews
+        message["request_ids"] = list(request_ids)
+    return message
@@ -5,6 +5,7 @@ import base64
 from io import BytesIO
 from typing import Dict, Any, Optional
 from .config import config
+from .log_policy import prompt_for_log
 
 logger = logging.getLogger(__name__)
 
@@ -23,7 +24,7 @@ class StabilityAIClient:
         Returns the image bytes when generation is complete
         """
         try:
-            logger.info(f"Starting image generation for request {request_id}: {prompt}")
+            logger.info(f"Starting image generation for request {request_id}: {prompt_for_log(prompt)}")
             
             # Enhanced prompt for game assets
             enhanced_prompt = f"{prompt}, pixel art style, game asset, clean background, high quality, detailed"
@@ -155,7 +156,7 @@ class MockImageClient:
     """Mock client for testing without actual API calls"""
     
     async def generate_image(self, prompt: str, request_id: str) -> Optional[bytes]:
-        logger.info(f"MOCK: Generating image for '{prompt}' (request: {request_id})")
+        logger.info(f"MOCK: Generating image for {prompt_for_log(prompt)} (request: {request_id})")
         # Simulate processing time
         time.sleep(2)
         
@@ -17,14 +17,27 @@ class RedisClient:
         )
         
     def subscribe_to_requests(self):
-        """Subscribe to image generation requests"""
+        """Subscribe to image generation requests and worker control messages"""
         pubsub = self.redis_client.pubsub()
-        pubsub.subscribe(config.GENERATION_REQUEST_CHANNEL)
-        logger.info(f"Subscribed to {config.GENERATION_REQUEST_CHANNEL}")
+        pubsub.subscribe(config.GENERATION_REQUEST_CHANNEL, config.WORKER_CONTROL_CHANNEL)
+        logger.info(f"Subscribed to {config.GENERATION_REQUEST_CHANNEL} and {config.WORKER_CONTROL_CHANNEL}")
         return pubsub
     
     def publish_completion(self, message: Dict[str, Any]):
-        """Publish completion notification"""
+        """Archive and publish completion notification"""
+        try:
+            # Archive first so the live message can carry its stream ID;
+            # the Go listener uses it to track how far it has applied
+            archive_id = self.redis_client.xadd(
+                config.COMPLETION_ARCHIVE_STREAM,
+                {"payload": json.dumps(message)},
+                maxlen=config.COMPLETION_ARCHIVE_MAXLEN,
+                approximate=True
+            )
+            message = {**message, "archive_id": archive_id}
+        except Exception as e:
+            logger.error(f"Failed to archive completion, publishing anyway: {e}")
+        
         try:
             self.redis_client.publish(
                 config.GENERATION_COMPLETE_CHANNEL,
@@ -34,6 +47,13 @@ class RedisClient:
         except Exception as e:
             logger.error(f"Failed to publish completion: {e}")
     
+    def publish_heartbeat(self, message: Dict[str, Any]):
+        """Publish the worker's heartbeat; a missed one is made up by the next"""
+        try:
+            self.redis_client.publish(config.WORKER_HEARTBEAT_CHANNEL, json.dumps(message))
+        except Exception as e:
+            logger.error(f"Failed to publish heartbeat: {e}")
+    
     def health_check(self) -> bool:
         """Check Redis connection health"""
         try:
@@ -1,15 +1,17 @@
 import asyncio
 import json
 import logging
+import threading
 import uuid
-import requests
-from datetime import datetime
+from datetime import datetime, timezone
 from typing import Dict, Any
 
 from .redis_client import redis_client
 from .midjourney_client import image_client
 from .s3_uploader import s3_uploader
 from .config import config
+from . import messages
+from .log_policy import prompt_for_log
 
 # Setup logging
 logging.basicConfig(
@@ -26,6 +28,11 @@ logger = logging.getLogger(__name__)
 class ImageGenerationWorker:
     def __init__(self):
         self.running = False
+        self.draining = False
+        # Jobs running now, listed in heartbeats so the backend renews their leases
+        self.active = set()
+        self.active_lock = threading.Lock()
+        self.stopped = threading.Event()
     
     async def start(self):
         """Start the worker to consume generation requests"""
@@ -37,6 +44,10 @@ class ImageGenerationWorker:
             logger.error("Health checks failed, stopping worker")
             return
         
+        # The request loop blocks, so heartbeats run on a thread of their own
+        self.stopped.clear()
+        threading.Thread(target=self._heartbeat_loop, daemon=True).start()
+        
         # Subscribe to Redis pub/sub
         pubsub = redis_client.subscribe_to_requests()
         
@@ -47,7 +58,11 @@ class ImageGenerationWorker:
                 if not self.running:
                     break
                 
-                if message['type'] == 'message':
+                if message['type'] != 'message':
+                    continue
+                if message['channel'] == config.WORKER_CONTROL_CHANNEL:
+                    self._handle_control(pubsub, message['data'])
+                elif not self.draining:
                     await self._process_message(message['data'])
                     
         except KeyboardInterrupt:
@@ -57,6 +72,42 @@ class ImageGenerationWorker:
         finally:
             self.stop()
     
+    def _heartbeat(self):
+        """Report capacity, load and the running jobs to the backend"""
+        with self.active_lock:
+            request_ids = sorted(self.active)
+        redis_client.publish_heartbeat(messages.heartbeat(
+            config.WORKER_ID, config.WORKER_MODEL, config.WORKER_MAX_CONCURRENT, len(request_ids),
+            draining=self.draining, request_ids=request_ids,
+        ))
+    
+    def _heartbeat_loop(self):
+        self._heartbeat()
+        while not self.stopped.wait(config.WORKER_HEARTBEAT_INTERVAL):
+            self._heartbeat()
+    
+    def _handle_control(self, pubsub, message_data: str):
+        """Drain stops pulling new requests; jobs already running finish and report as usual"""
+        try:
+            control = json.loads(message_data)
+        except json.JSONDecodeError as e:
+            logger.error(f"Failed to parse control message: {e}")
+            return
+        if control.get('worker_id') != config.WORKER_ID:
+            return
+        
+        action = control.get('action')
+        if action == 'drain' and not self.draining:
+            self.draining = True
+            pubsub.unsubscribe(config.GENERATION_REQUEST_CHANNEL)
+            logger.info(f"Draining: no longer pulling requests ({control.get('reason') or 'no reason given'})")
+            self._heartbeat()
+        elif action == 'resume' and self.draining:
+            self.draining = False
+            pubsub.subscribe(config.GENERATION_REQUEST_CHANNEL)
+            logger.info("Resumed pulling requests")
+            self._heartbeat()
+    
     async def _process_message(self, message_data: str):
         """Process a single generation request message"""
         try:
@@ -67,13 +118,32 @@ class ImageGenerationWorker:
             prompt = request.get('prompt')
             
             if not all([request_id, user_id, prompt]):
-                logger.error(f"Invalid request format: {request}")
+                logger.error(f"Invalid request format: keys {sorted(request)}")
                 return
             
-            logger.info(f"Processing request {request_id} for user {user_id}: {prompt}")
+            # The Go side has already timed out (and refunded) requests past their deadline
+            deadline = request.get('deadline')
+            if deadline and datetime.fromisoformat(deadline.replace('Z', '+00:00')) < datetime.now(timezone.utc):
+                logger.info(f"Skipping request {request_id}: deadline {deadline} has passed")
+                return
             
-            # Generate the image
-            success = await self._generate_and_upload_image(request_id, user_id, prompt)
+            logger.info(f"Processing request {request_id} for user {user_id}: {prompt_for_log(prompt)}")
+            
+            # Acknowledge it, which starts its lease, and list it in heartbeats until it's done
+            lease_token = request.get('lease_token', 0)
+            started_at = datetime.now(timezone.utc).isoformat().replace('+00:00', 'Z')
+            redis_client.publish_completion(messages.processing(
+                request_id, user_id, started_at, config.WORKER_ID, lease_token=lease_token,
+            ))
+            with self.active_lock:
+                self.active.add(request_id)
+            try:
+                # Generate the image
+                success = await self._generate_and_upload_image(request_id, user_id, prompt,
+                                                                request.get('storage_prefix', ''), lease_token)
+            finally:
+                with self.active_lock:
+                    self.active.discard(request_id)
             
             if success:
                 logger.info(f"Successfully completed request {request_id}")
@@ -85,7 +155,8 @@ class ImageGenerationWorker:
         except Exception as e:
             logger.error(f"Error processing message: {e}")
     
-    async def _generate_and_upload_image(self, request_id: str, user_id: str, prompt: str) -> bool:
+    async def _generate_and_upload_image(self, request_id: str, user_id: str, prompt: str,
+                                         storage_prefix: str = '', lease_token: int = 0) -> bool:
         """Generate image, upload to S3, and notify completion"""
         try:
             start_time = datetime.now()
@@ -96,77 +167,46 @@ class ImageGenerationWorker:
             
             if not image_bytes:
                 logger.error(f"Failed to generate image for request {request_id}")
-                self._notify_failure(request_id, user_id, "Image generation failed")
+                self._notify_failure(request_id, user_id, "Image generation failed", messages.ERROR_UNKNOWN,
+                                     lease_token)
                 return False
             
             # Step 2: Upload to S3
-            s3_key = f"generated/{user_id}/{request_id}.png"
+            # A partner tenant's objects stay under its own prefix
+            s3_key = f"{storage_prefix}generated/{user_id}/{request_id}.png"
             s3_url = await s3_uploader.upload_image_bytes(image_bytes, s3_key)
             
             if not s3_url:
                 logger.error(f"Failed to upload image to S3 for request {request_id}")
-                self._notify_failure(request_id, user_id, "S3 upload failed")
+                self._notify_failure(request_id, user_id, "S3 upload failed", messages.ERROR_UNKNOWN, lease_token)
                 return False
             
             # Step 3: Notify completion
             generation_time = (datetime.now() - start_time).total_seconds()
-            self._notify_success(request_id, user_id, s3_key, s3_url, generation_time)
+            self._notify_success(request_id, user_id, s3_key, s3_url, generation_time, lease_token)
             
             return True
             
         except Exception as e:
             logger.error(f"Unexpected error in generation pipeline: {e}")
-            self._notify_failure(request_id, user_id, f"Unexpected error: {str(e)}")
+            self._notify_failure(request_id, user_id, f"Unexpected error: {str(e)}", messages.error_code_for(e),
+                                 lease_token)
             return False
     
-    def _notify_success(self, request_id: str, user_id: str, s3_key: str, s3_url: str, generation_time: float):
-        """Notify Go backend of successful completion via HTTP API"""
-        try:
-            # We'll let the Go backend generate signed URLs when needed
-            # Just provide the S3 key for now
-            payload = {
-                "request_id": request_id,
-                "status": "completed",
-                "content_url": s3_key  # Store S3 key, Go backend will generate signed URLs on demand
-            }
-            
-            response = requests.post(
-                f"{config.GO_BACKEND_URL}/api/internal/update_status",
-                json=payload,
-                timeout=30
-            )
-            
-            if response.status_code == 200:
-                logger.info(f"✅ Successfully notified Go backend for request {request_id}")
-            else:
-                logger.error(f"❌ Failed to notify Go backend: {response.status_code} - {response.text}")
-                
-        except Exception as e:
-            logger.error(f"❌ Error notifying success to Go backend: {e}")
+    def _notify_success(self, request_id: str, user_id: str, s3_key: str, s3_url: str, generation_time: float,
+                        lease_token: int = 0):
+        """Publish a completed message; the Go backend signs URLs from the S3 key on demand"""
+        redis_client.publish_completion(messages.completed(
+            request_id, user_id, s3_key, s3_url, generation_time,
+            gpu_seconds=generation_time, worker_id=config.WORKER_ID, lease_token=lease_token,
+        ))
     
-    def _notify_failure(self, request_id: str, user_id: str, error_message: str):
-        """Notify Go backend of failure via HTTP API"""
-        try:
-            payload = {
-                "request_id": request_id,
-                "status": "failed",
-                "content_url": ""
-            }
-            
-            response = requests.post(
-                f"{config.GO_BACKEND_URL}/api/internal/update_status",
-                json=payload,
-                timeout=30
-            )
-            
-            if response.status_code == 200:
-                logger.info(f"✅ Successfully notified Go backend of failure for request {request_id}")
-            else:
-                logger.error(f"❌ Failed to notify Go backend of failure: {response.status_code} - {response.text}")
-                
-        except Exception as e:
-            logger.error(f"❌ Error notifying failure to Go backend: {e}")
-            
+    def _notify_failure(self, request_id: str, user_id: str, error_message: str, error_code: str,
+                        lease_token: int = 0):
+        """Publish a failed message so the Go backend refunds the request; users see the
+        message for error_code, never error_message"""
+        redis_client.publish_completion(messages.failed(request_id, user_id, error_message, config.WORKER_ID,
+                                                        error_code=error_code, lease_token=lease_token))
         logger.error(f"Request {request_id} failed: {error_message}")
     
     def _health_checks(self) -> bool:
@@ -198,6 +238,7 @@ class ImageGenerationWorker:
         """Stop the worker gracefully"""
         logger.info("Stopping Image Generation Worker...")
         self.running = False
+        self.stopped.set()
 
 # Create global worker instance
 worker = ImageGenerationWorker()
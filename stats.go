@@ -0,0 +1,321 @@
+// stats.go
+// Per-user and system-wide generation statistics, cached in Redis. Per-user stats read raw
+// rows; tenant-wide ones read daily rollups where they exist (analytics.go)
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	statsWindowDays = 30
+	statsCacheTTL   = 10 * time.Minute
+)
+
+// GenerationStats is the shared shape of GET /stats and the aggregate part of /admin/stats
+type GenerationStats struct {
+	WindowDays           int     `json:"window_days"`
+	TotalGenerations     int64   `json:"total_generations"`
+	SuccessRate          float64 `json:"success_rate"`
+	AvgGenerationSeconds float64 `json:"avg_generation_seconds"`
+	P95GenerationSeconds float64 `json:"p95_generation_seconds"`
+	CreditsSpent         int64   `json:"credits_spent"`
+	BusiestDay           string  `json:"busiest_day,omitempty"`
+	MostUsedModel        string  `json:"most_used_model,omitempty"`
+}
+
+// DailyStats is one point of the /admin/stats time series
+type DailyStats struct {
+	Day                  string  `json:"day"`
+	Total                int64   `json:"total"`
+	Completed            int64   `json:"completed"`
+	Failed               int64   `json:"failed"`
+	AvgGenerationSeconds float64 `json:"avg_generation_seconds"`
+}
+
+// AdminStats adds the per-day series to the system-wide aggregates
+type AdminStats struct {
+	GenerationStats
+	ActiveUsers int64        `json:"active_users"`
+	Daily       []DailyStats `json:"daily"`
+
+	ByPlatform  []PlatformStats      `json:"by_platform"`
+	TopVersions []ClientVersionStats `json:"top_versions"` // by volume, see clients.go
+
+	LastOrphanSweep *OrphanSweepReport `json:"last_orphan_sweep,omitempty"`
+	// SLO is this instance's live view (slo.go), never cached
+	SLO SLOStatus `json:"slo"`
+}
+
+// getUserStats handles GET /stats
+func getUserStats(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+
+	var stats GenerationStats
+	err := cachedJSON(c.Request.Context(), "stats:user:"+user.ID.String(), &stats, func() (interface{}, error) {
+		return queryUserStats(c.Request.Context(), user.ID.String())
+	})
+	if err != nil {
+		log.Printf("❌ Failed to compute stats for user %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to load stats")
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// getAdminStats handles GET /admin/stats
+func getAdminStats(c *gin.Context) {
+	var stats AdminStats
+	tenant := currentTenant(c)
+	err := cachedJSON(c.Request.Context(), tenant.key("stats:admin"), &stats, func() (interface{}, error) {
+		return queryAdminStats(c.Request.Context(), tenant.ID)
+	})
+	if err != nil {
+		log.Printf("❌ Failed to compute admin stats: %v", err)
+		respondError(c, codeInternal, "Failed to load stats")
+		return
+	}
+	if tenant.ID == defaultTenantID {
+		stats.SLO = currentSLO()
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// cachedJSON fills dst from Redis, or from compute (caching the result) on a miss.
+// Redis errors degrade to computing every time rather than failing the request.
+func cachedJSON(ctx context.Context, key string, dst interface{}, compute func() (interface{}, error)) error {
+	if cached, err := rdb.Get(ctx, key).Bytes(); err == nil {
+		if json.Unmarshal(cached, dst) == nil {
+			return nil
+		}
+	}
+
+	v, err := compute()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := rdb.Set(ctx, key, data, statsCacheTTL).Err(); err != nil {
+		log.Printf("⚠️ Failed to cache %s: %v", key, err)
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// queryUserStats aggregates userID's last statsWindowDays
+func queryUserStats(ctx context.Context, userID string) (*GenerationStats, error) {
+	where := "created_at > now() - make_interval(days => $1) AND user_id = $2"
+	args := []interface{}{statsWindowDays, userID}
+
+	s := GenerationStats{WindowDays: statsWindowDays}
+	var completed, finished int64
+	err := db.QueryRowContext(ctx, `
+		SELECT count(*),
+		       count(*) FILTER (WHERE status = 'completed'),
+		       count(*) FILTER (WHERE status IN ('completed', 'failed')),
+		       coalesce(avg(generation_time_seconds) FILTER (WHERE status = 'completed'), 0),
+		       coalesce(percentile_cont(0.95) WITHIN GROUP (ORDER BY generation_time_seconds)
+		                FILTER (WHERE status = 'completed'), 0),
+		       coalesce(sum(credits_charged), 0)
+		FROM generated_content WHERE `+where, args...).
+		Scan(&s.TotalGenerations, &completed, &finished, &s.AvgGenerationSeconds, &s.P95GenerationSeconds, &s.CreditsSpent)
+	if err != nil {
+		return nil, err
+	}
+	if finished > 0 {
+		s.SuccessRate = float64(completed) / float64(finished)
+	}
+
+	err = db.QueryRowContext(ctx, `
+		SELECT to_char(date_trunc('day', created_at), 'YYYY-MM-DD') AS day
+		FROM generated_content WHERE `+where+`
+		GROUP BY day ORDER BY count(*) DESC, day DESC LIMIT 1`, args...).Scan(&s.BusiestDay)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	err = db.QueryRowContext(ctx, `
+		SELECT model FROM generated_content WHERE `+where+` AND model <> ''
+		GROUP BY model ORDER BY count(*) DESC, model LIMIT 1`, args...).Scan(&s.MostUsedModel)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// statsCell is one day's, or one day and model's, tenant-wide figures
+type statsCell struct {
+	total, completed, failed, timed int64
+	seconds                         float64
+}
+
+func (c *statsCell) add(o statsCell) {
+	c.total += o.total
+	c.completed += o.completed
+	c.failed += o.failed
+	c.timed += o.timed
+	c.seconds += o.seconds
+}
+
+func (c statsCell) avgSeconds() float64 {
+	if c.timed == 0 {
+		return 0
+	}
+	return c.seconds / float64(c.timed)
+}
+
+// statsWindowStart is the first of the statsWindowDays UTC days tenant-wide stats cover,
+// today included
+func statsWindowStart(now time.Time) time.Time {
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-statsWindowDays)
+}
+
+// queryAdminStats aggregates tenantID's rows but the canary's (canary.go), with active
+// users and a zero-filled per-day series for charting. Days before the rollup line come
+// from daily rollups and the rest from raw rows; p95 is read from the rollups' buckets
+// either way, so both halves merge
+func queryAdminStats(ctx context.Context, tenantID string) (*AdminStats, error) {
+	since := statsWindowStart(clock.Now())
+	line, err := rollupLine(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	sinceDay, lineDay := since.Format(costDayLayout), line.Format(costDayLayout)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD'), coalesce(model, ''), count(*),
+		       count(*) FILTER (WHERE status = 'completed'), count(*) FILTER (WHERE status = 'failed'),
+		       count(generation_time_seconds) FILTER (WHERE status = 'completed'),
+		       coalesce(sum(generation_time_seconds) FILTER (WHERE status = 'completed'), 0),
+		       coalesce(sum(credits_charged), 0)
+		FROM generated_content WHERE tenant_id = $1 AND created_at >= $2 AND user_id::text <> $3
+		GROUP BY 1, 2
+		UNION ALL
+		SELECT to_char(day, 'YYYY-MM-DD'), model, sum(total),
+		       sum(coalesce((status_counts->>'completed')::bigint, 0)),
+		       sum(coalesce((status_counts->>'failed')::bigint, 0)),
+		       sum(timed_count), sum(generation_seconds_sum), sum(credits_charged)
+		FROM daily_generation_stats WHERE tenant_id = $1 AND day >= $4::date AND day < $5::date
+		GROUP BY 1, 2`, tenantID, line, canaryUserID, sinceDay, lineDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := AdminStats{GenerationStats: GenerationStats{WindowDays: statsWindowDays}, Daily: []DailyStats{}}
+	var all statsCell
+	days := map[string]*statsCell{}
+	models := map[string]int64{}
+	for rows.Next() {
+		var day, model string
+		var c statsCell
+		var credits int64
+		if err := rows.Scan(&day, &model, &c.total, &c.completed, &c.failed, &c.timed, &c.seconds, &credits); err != nil {
+			return nil, err
+		}
+		if days[day] == nil {
+			days[day] = &statsCell{}
+		}
+		days[day].add(c)
+		all.add(c)
+		stats.CreditsSpent += credits
+		if model != "" {
+			models[model] += c.total
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.TotalGenerations = all.total
+	if finished := all.completed + all.failed; finished > 0 {
+		stats.SuccessRate = float64(all.completed) / float64(finished)
+	}
+	stats.AvgGenerationSeconds = all.avgSeconds()
+	var busiest int64
+	for i := statsWindowDays - 1; i >= 0; i-- {
+		day := since.AddDate(0, 0, i).Format(costDayLayout)
+		if c := days[day]; c != nil && c.total > busiest {
+			stats.BusiestDay, busiest = day, c.total
+		}
+	}
+	var most int64
+	for model, n := range models {
+		if n > most || (n == most && model < stats.MostUsedModel) {
+			stats.MostUsedModel, most = model, n
+		}
+	}
+	for i := 0; i < statsWindowDays; i++ {
+		day := since.AddDate(0, 0, i).Format(costDayLayout)
+		d := DailyStats{Day: day}
+		if c := days[day]; c != nil {
+			d.Total, d.Completed, d.Failed, d.AvgGenerationSeconds = c.total, c.completed, c.failed, c.avgSeconds()
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+
+	if stats.P95GenerationSeconds, err = queryTenantP95(ctx, tenantID, line, sinceDay, lineDay); err != nil {
+		return nil, err
+	}
+	err = db.QueryRowContext(ctx, `
+		SELECT count(*) FROM (
+			SELECT user_id FROM daily_active_users WHERE tenant_id = $1 AND day >= $2::date AND day < $3::date
+			UNION
+			SELECT user_id FROM generated_content WHERE tenant_id = $1 AND created_at >= $4 AND user_id::text <> $5
+		) u`, tenantID, sinceDay, lineDay, line, canaryUserID).Scan(&stats.ActiveUsers)
+	if err != nil {
+		return nil, err
+	}
+	if stats.ByPlatform, stats.TopVersions, err = queryClientStats(ctx, tenantID); err != nil {
+		return nil, err
+	}
+	if tenantID == defaultTenantID {
+		// The sweep is the deployment's, covering every tenant
+		stats.LastOrphanSweep, err = lastOrphanSweep(ctx)
+	}
+	return &stats, err
+}
+
+// queryTenantP95 merges the generation time buckets of rollups before line with raw rows
+// from it
+func queryTenantP95(ctx context.Context, tenantID string, line time.Time, sinceDay, lineDay string) (float64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT width_bucket(generation_time_seconds, $4::float8[]), count(*)
+		FROM generated_content
+		WHERE tenant_id = $1 AND created_at >= $2 AND user_id::text <> $3
+		  AND status = 'completed' AND generation_time_seconds IS NOT NULL
+		GROUP BY 1
+		UNION ALL
+		SELECT b.i - 1, sum(b.n)
+		FROM daily_generation_stats s, unnest(s.generation_seconds_buckets) WITH ORDINALITY AS b(n, i)
+		WHERE s.tenant_id = $1 AND s.day >= $5::date AND s.day < $6::date
+		GROUP BY 1`, tenantID, line, canaryUserID, pq.Array(analyticsBucketBounds), sinceDay, lineDay)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	counts := make([]int64, len(analyticsBucketBounds)+1)
+	for rows.Next() {
+		var i int
+		var n int64
+		if err := rows.Scan(&i, &n); err != nil {
+			return 0, err
+		}
+		if i >= 0 && i < len(counts) {
+			counts[i] += n
+		}
+	}
+	return bucketQuantile(counts, 0.95), rows.Err()
+}
@@ -0,0 +1,121 @@
+// status_records.go
+// Read-after-write for GET /generations/:id. Every insert and status transition also
+// writes a small record to Redis, stamped with the row version it produced, and the
+// status endpoint lays a record newer than the row it read over that row. A client that
+// polls straight after the 202 or a completion sees the write even when its read hits a
+// lagging replica or lands before the commit is visible
+
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// statusRecordTTL only has to outlast replica lag and commit timing
+var statusRecordTTL = getEnvDuration("STATUS_RECORD_TTL", time.Hour)
+
+func statusRecordKey(requestID string) string {
+	return "generation:status:" + requestID
+}
+
+// statusRecord is what Redis holds for a request. Prompts stay out of it
+type statusRecord struct {
+	RequestID   string
+	UserID      string
+	Status      string
+	ContentType string
+	Model       string
+	ContentURL  string // S3 key, once completed
+	Error       string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Version     int64 // of the row this status was written to
+}
+
+// writeStatusScript merges ARGV[3..] (field/value pairs) into the record unless it already
+// holds a later version, so writes landing out of order keep the newest
+var writeStatusScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], 'version') or '-1')
+if current >= tonumber(ARGV[1]) then
+	return 0
+end
+for i = 3, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('HSET', KEYS[1], 'version', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1`)
+
+// writeStatusRecord stores r. It is best effort: without Redis, reads fall back to the row
+func writeStatusRecord(ctx context.Context, r statusRecord) {
+	args := []interface{}{r.Version, statusRecordTTL.Milliseconds(),
+		"status", r.Status, "updated_at", r.UpdatedAt.UnixMicro(), "content_url", r.ContentURL, "error", r.Error}
+	for field, value := range map[string]string{"user_id": r.UserID, "content_type": r.ContentType, "model": r.Model} {
+		if value != "" {
+			args = append(args, field, value)
+		}
+	}
+	if !r.CreatedAt.IsZero() {
+		args = append(args, "created_at", r.CreatedAt.UnixMicro())
+	}
+	if err := writeStatusScript.Run(ctx, rdb, []string{statusRecordKey(r.RequestID)}, args...).Err(); err != nil {
+		log.Printf("⚠️ Failed to write the status record of request %s: %v", r.RequestID, err)
+	}
+}
+
+// readStatusRecord returns the record for requestID, or nil when there is none or Redis
+// can't be reached
+func readStatusRecord(ctx context.Context, requestID string) *statusRecord {
+	if serviceDegraded() {
+		return nil
+	}
+	fields, err := rdb.HGetAll(ctx, statusRecordKey(requestID)).Result()
+	if err != nil || fields["version"] == "" || fields["status"] == "" {
+		return nil
+	}
+	r := &statusRecord{RequestID: requestID, UserID: fields["user_id"], Status: fields["status"],
+		ContentType: fields["content_type"], Model: fields["model"], ContentURL: fields["content_url"],
+		Error: fields["error"]}
+	if r.Version, err = strconv.ParseInt(fields["version"], 10, 64); err != nil {
+		return nil
+	}
+	micros := func(name string) time.Time {
+		n, _ := strconv.ParseInt(fields[name], 10, 64)
+		return time.UnixMicro(n).UTC()
+	}
+	r.UpdatedAt, r.CreatedAt = micros("updated_at"), micros("created_at")
+	return r
+}
+
+// overlayStatusRecord applies the record of g's request when it is newer than g
+func overlayStatusRecord(ctx context.Context, g *Generation) {
+	r := readStatusRecord(ctx, g.RequestID)
+	if r == nil || r.Version <= g.Version {
+		return
+	}
+	g.Status, g.Error, g.UpdatedAt, g.Version = r.Status, r.Error, r.UpdatedAt, r.Version
+	if r.ContentURL != "" {
+		g.ContentURL = r.ContentURL
+	}
+}
+
+// recordedGeneration stands in for a row the read didn't find yet, from a record written
+// by its insert; prompts are left empty. nil unless userID owns such a record
+func recordedGeneration(ctx context.Context, requestID, userID string) *Generation {
+	r := readStatusRecord(ctx, requestID)
+	if r == nil || r.UserID != userID || r.CreatedAt.Unix() <= 0 {
+		return nil
+	}
+	return &Generation{RequestID: requestID, Status: r.Status, ContentType: r.ContentType, Model: r.Model,
+		ContentURL: r.ContentURL, Error: r.Error, CreatedAt: r.CreatedAt, UpdatedAt: r.UpdatedAt, Version: r.Version}
+}
+
+// dropStatusRecord forgets a deleted row, so the record can't bring it back
+func dropStatusRecord(ctx context.Context, requestID string) {
+	rdb.Del(ctx, statusRecordKey(requestID))
+}
@@ -0,0 +1,144 @@
+// storage.go
+// Object storage access for generated images and videos (S3 by default, same bucket as src/s3_uploader.py)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage is the minimal set of object operations the Go side needs
+type Storage interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// Open streams an object; the caller closes it. size is -1 when unknown
+	Open(ctx context.Context, key string) (body io.ReadCloser, size int64, err error)
+	// Delete succeeds for keys that are already gone
+	Delete(ctx context.Context, key string) error
+	// List returns one page of objects under prefix in key order, starting from cursor
+	// ("" for the first page). next is "" after the last page
+	List(ctx context.Context, prefix, cursor string, limit int) (objects []StoredObject, next string, err error)
+}
+
+// StoredObject is one entry of a List page
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// S3Storage implements Storage on top of a single bucket
+type S3Storage struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+}
+
+var storage Storage
+
+func init() {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(),
+		awsconfig.WithRegion(getEnv("AWS_REGION", "us-west-2")))
+	if err != nil {
+		log.Fatalf("❌ Failed to load AWS config: %v", err)
+	}
+	client := s3.NewFromConfig(cfg)
+	storage = newGovernedStorage(&S3Storage{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  getEnv("S3_BUCKET_NAME", "mobiarty-assets"),
+	}, storageLimitsConfig())
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(-1)
+	if out.ContentLength != nil {
+		size = *out.ContentLength
+	}
+	return out.Body, size, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String(contentType),
+		CacheControl: aws.String("max-age=31536000"),
+	})
+	return err
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix, cursor string, limit int) ([]StoredObject, string, error) {
+	in := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(int32(limit)),
+	}
+	if cursor != "" {
+		in.ContinuationToken = aws.String(cursor)
+	}
+	out, err := s.client.ListObjectsV2(ctx, in)
+	if err != nil {
+		return nil, "", err
+	}
+	objects := make([]StoredObject, 0, len(out.Contents))
+	for _, o := range out.Contents {
+		objects = append(objects, StoredObject{
+			Key:          aws.ToString(o.Key),
+			Size:         aws.ToInt64(o.Size),
+			LastModified: aws.ToTime(o.LastModified),
+		})
+	}
+	if !aws.ToBool(out.IsTruncated) {
+		return objects, "", nil
+	}
+	return objects, aws.ToString(out.NextContinuationToken), nil
+}
+
+func (s *S3Storage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
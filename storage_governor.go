@@ -0,0 +1,311 @@
+// storage_governor.go
+// Rate and concurrency limits on storage API calls, so a spike (or a background sweep)
+// stays under the provider's throttling instead of turning into failed completions.
+// Each operation class (read, write, delete, list) has a token bucket and a cap on calls
+// in flight. Calls wait for both, up to STORAGE_QUEUE_TIMEOUT or their context, and a
+// waiting interactive call always goes before a background one. Background jobs mark
+// their context with backgroundStorage
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	storageRead   = "read" // Get, Open and PresignGet
+	storageWrite  = "write"
+	storageDelete = "delete"
+	storageList   = "list"
+
+	priorityInteractive = 0
+	priorityBackground  = 1
+)
+
+var priorityNames = [...]string{"interactive", "background"}
+
+var storageQueueTimeout = getEnvDuration("STORAGE_QUEUE_TIMEOUT", 10*time.Second)
+
+// errStorageThrottled is returned for a call that waited STORAGE_QUEUE_TIMEOUT for its turn
+var errStorageThrottled = errors.New("storage call throttled")
+
+var (
+	storageGovernorCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_storage_governor_calls_total",
+		Help: "Storage calls through the governor, by class, priority and outcome (immediate, queued, throttled, cancelled).",
+	}, []string{"class", "priority", "outcome"})
+	storageGovernorWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mobart_storage_governor_wait_seconds",
+		Help:    "Time queued storage calls waited for their turn, by class and priority.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10},
+	}, []string{"class", "priority"})
+	storageGovernorQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mobart_storage_governor_queued",
+		Help: "Storage calls waiting for their turn, by class and priority.",
+	}, []string{"class", "priority"})
+)
+
+type storagePriorityKey struct{}
+
+// backgroundStorage marks ctx's storage calls as background work, served after every
+// waiting interactive call
+func backgroundStorage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storagePriorityKey{}, priorityBackground)
+}
+
+func storagePriority(ctx context.Context) int {
+	if p, ok := ctx.Value(storagePriorityKey{}).(int); ok {
+		return p
+	}
+	return priorityInteractive
+}
+
+// storageLimits configures one operation class. Rate below or at 0 turns the bucket off
+type storageLimits struct {
+	Rate        float64 // calls per second
+	Burst       int
+	MaxInFlight int
+}
+
+func storageLimitsFromEnv(class string, rate float64, inFlight int) storageLimits {
+	prefix := "STORAGE_" + strings.ToUpper(class) + "_"
+	l := storageLimits{
+		Rate:        getEnvFloat(prefix+"RPS", rate),
+		MaxInFlight: getEnvInt(prefix+"CONCURRENCY", inFlight),
+	}
+	l.Burst = getEnvInt(prefix+"BURST", max(int(l.Rate/10), 1))
+	return l
+}
+
+// callGate is one class's token bucket and in-flight cap
+type callGate struct {
+	class  string
+	limits storageLimits
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	inFlight int
+	waiting  [len(priorityNames)]int
+	changed  chan struct{} // closed and replaced whenever a slot frees up
+}
+
+func newCallGate(class string, limits storageLimits) *callGate {
+	return &callGate{class: class, limits: limits, tokens: float64(limits.Burst), last: time.Now(),
+		changed: make(chan struct{})}
+}
+
+// refill adds the tokens earned since the last call; g.mu is held
+func (g *callGate) refill(now time.Time) {
+	if g.limits.Rate <= 0 {
+		return
+	}
+	g.tokens = min(float64(g.limits.Burst), g.tokens+now.Sub(g.last).Seconds()*g.limits.Rate)
+	g.last = now
+}
+
+// tryTake takes a token and a slot for priority, or says how long until a token is due.
+// g.mu is held
+func (g *callGate) tryTake(priority int, now time.Time) (ok bool, retryIn time.Duration) {
+	for p := 0; p < priority; p++ {
+		if g.waiting[p] > 0 {
+			return false, 0 // wait for the higher priority to go first
+		}
+	}
+	if g.limits.MaxInFlight > 0 && g.inFlight >= g.limits.MaxInFlight {
+		return false, 0
+	}
+	if g.limits.Rate > 0 {
+		g.refill(now)
+		if g.tokens < 1 {
+			return false, time.Duration((1 - g.tokens) / g.limits.Rate * float64(time.Second))
+		}
+		g.tokens--
+	}
+	g.inFlight++
+	return true, 0
+}
+
+// acquire waits for a turn and returns the func that gives the slot back
+func (g *callGate) acquire(ctx context.Context) (release func(), err error) {
+	priority := storagePriority(ctx)
+	labels := []string{g.class, priorityNames[priority]}
+
+	g.mu.Lock()
+	ok, retryIn := g.tryTake(priority, time.Now())
+	if ok {
+		g.mu.Unlock()
+		storageGovernorCalls.WithLabelValues(g.class, labels[1], "immediate").Inc()
+		return g.release, nil
+	}
+	g.waiting[priority]++
+	g.mu.Unlock()
+	storageGovernorQueued.WithLabelValues(labels...).Inc()
+
+	start := time.Now()
+	timeout := time.NewTimer(storageQueueTimeout)
+	defer func() {
+		timeout.Stop()
+		storageGovernorQueued.WithLabelValues(labels...).Dec()
+		storageGovernorWait.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	}()
+	for {
+		g.mu.Lock()
+		changed := g.changed
+		g.waiting[priority]--
+		ok, retryIn = g.tryTake(priority, time.Now())
+		if ok {
+			g.mu.Unlock()
+			g.wake() // a lower priority may be next
+			storageGovernorCalls.WithLabelValues(g.class, labels[1], "queued").Inc()
+			return g.release, nil
+		}
+		g.waiting[priority]++
+		g.mu.Unlock()
+
+		// A token comes due by itself; a slot or a better-placed waiter going first says so
+		var due <-chan time.Time
+		if retryIn > 0 {
+			due = time.After(retryIn)
+		}
+		select {
+		case <-changed:
+		case <-due:
+		case <-timeout.C:
+			g.leave(priority)
+			storageGovernorCalls.WithLabelValues(g.class, labels[1], "throttled").Inc()
+			return nil, fmt.Errorf("%w: %s call waited %s", errStorageThrottled, g.class, storageQueueTimeout)
+		case <-ctx.Done():
+			g.leave(priority)
+			storageGovernorCalls.WithLabelValues(g.class, labels[1], "cancelled").Inc()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (g *callGate) leave(priority int) {
+	g.mu.Lock()
+	g.waiting[priority]--
+	g.mu.Unlock()
+	g.wake()
+}
+
+func (g *callGate) release() {
+	g.mu.Lock()
+	g.inFlight--
+	g.mu.Unlock()
+	g.wake()
+}
+
+// wake tells every waiter to look again
+func (g *callGate) wake() {
+	g.mu.Lock()
+	close(g.changed)
+	g.changed = make(chan struct{})
+	g.mu.Unlock()
+}
+
+// governedStorage is a Storage whose calls go through a callGate per class
+type governedStorage struct {
+	next  Storage
+	gates map[string]*callGate
+}
+
+func newGovernedStorage(next Storage, limits map[string]storageLimits) *governedStorage {
+	s := &governedStorage{next: next, gates: map[string]*callGate{}}
+	for class, l := range limits {
+		s.gates[class] = newCallGate(class, l)
+	}
+	return s
+}
+
+// storageLimitsConfig is the configured ceiling per class; S3 takes about 5500 reads
+// and 3500 writes or deletes per second per prefix, so the defaults stay well below
+func storageLimitsConfig() map[string]storageLimits {
+	return map[string]storageLimits{
+		storageRead:   storageLimitsFromEnv(storageRead, 1000, 256),
+		storageWrite:  storageLimitsFromEnv(storageWrite, 300, 64),
+		storageDelete: storageLimitsFromEnv(storageDelete, 300, 32),
+		storageList:   storageLimitsFromEnv(storageList, 20, 4),
+	}
+}
+
+func (s *governedStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	release, err := s.gates[storageRead].acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.next.Get(ctx, key)
+}
+
+func (s *governedStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	release, err := s.gates[storageWrite].acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.next.Put(ctx, key, data, contentType)
+}
+
+func (s *governedStorage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	release, err := s.gates[storageRead].acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return s.next.PresignGet(ctx, key, ttl)
+}
+
+// Open holds its slot until the body is closed
+func (s *governedStorage) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	release, err := s.gates[storageRead].acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, size, err := s.next.Open(ctx, key)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &releasingBody{ReadCloser: body, release: release}, size, nil
+}
+
+func (s *governedStorage) Delete(ctx context.Context, key string) error {
+	release, err := s.gates[storageDelete].acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.next.Delete(ctx, key)
+}
+
+func (s *governedStorage) List(ctx context.Context, prefix, cursor string, limit int) ([]StoredObject, string, error) {
+	release, err := s.gates[storageList].acquire(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	return s.next.List(ctx, prefix, cursor, limit)
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
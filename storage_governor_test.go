@@ -0,0 +1,135 @@
+// storage_governor_test.go
+// The governor under load: a background sweep (reads, deletes and lists as fast as it can)
+// alongside interactive presigns, against an in-memory store and the configured limits
+// (STORAGE_<CLASS>_RPS and friends). No class may go over its rate ceiling, burst
+// included, and interactive calls may not wait longer on average than background ones
+
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage answers instantly after latency and counts calls per class, for the stress test
+type countingStorage struct {
+	latency time.Duration
+	calls   map[string]*atomic.Int64
+}
+
+func (s *countingStorage) call(class string) {
+	s.calls[class].Add(1)
+	time.Sleep(s.latency)
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	s.call(storageRead)
+	return nil, nil
+}
+
+func (s *countingStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	s.call(storageWrite)
+	return nil
+}
+
+func (s *countingStorage) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	s.call(storageRead)
+	return "https://example.invalid/" + key, nil
+}
+
+func (s *countingStorage) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	s.call(storageRead)
+	return io.NopCloser(strings.NewReader("")), 0, nil
+}
+
+func (s *countingStorage) Delete(ctx context.Context, key string) error {
+	s.call(storageDelete)
+	return nil
+}
+
+func (s *countingStorage) List(ctx context.Context, prefix, cursor string, limit int) ([]StoredObject, string, error) {
+	s.call(storageList)
+	return nil, "", nil
+}
+
+func TestStorageGovernorUnderBackgroundSweep(t *testing.T) {
+	duration := 5 * time.Second
+	if testing.Short() {
+		duration = time.Second
+	}
+	limits := storageLimitsConfig()
+	backend := &countingStorage{latency: 2 * time.Millisecond, calls: map[string]*atomic.Int64{}}
+	for class := range limits {
+		backend.calls[class] = &atomic.Int64{}
+	}
+	gs := newGovernedStorage(backend, limits)
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	var waited [len(priorityNames)]atomic.Int64 // nanoseconds
+	var served [len(priorityNames)]atomic.Int64
+	run := func(priority int, call func(ctx context.Context) error) {
+		defer wg.Done()
+		callCtx := ctx
+		if priority == priorityBackground {
+			callCtx = backgroundStorage(ctx)
+		}
+		for ctx.Err() == nil {
+			start := time.Now()
+			if err := call(callCtx); err != nil {
+				continue
+			}
+			waited[priority].Add(int64(time.Since(start)))
+			served[priority].Add(1)
+		}
+	}
+
+	// The sweep: more workers than any cap allows, like a reconciliation run
+	for i := 0; i < 64; i++ {
+		wg.Add(3)
+		go run(priorityBackground, func(ctx context.Context) error { _, err := gs.Get(ctx, "bg"); return err })
+		go run(priorityBackground, func(ctx context.Context) error { return gs.Delete(ctx, "bg") })
+		go run(priorityBackground, func(ctx context.Context) error { _, _, err := gs.List(ctx, "", "", 1000); return err })
+	}
+	// Users opening the gallery
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go run(priorityInteractive, func(ctx context.Context) error {
+			time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			_, err := gs.PresignGet(ctx, "user", time.Hour)
+			return err
+		})
+	}
+	started := time.Now()
+	wg.Wait()
+	elapsed := time.Since(started).Seconds()
+
+	for class, l := range limits {
+		calls := backend.calls[class].Load()
+		ceiling := l.Rate*elapsed + float64(l.Burst)
+		t.Logf("%-6s %6d calls in %.1fs (%.0f/s), ceiling %.0f", class, calls, elapsed, float64(calls)/elapsed, ceiling)
+		if l.Rate > 0 && float64(calls) > ceiling {
+			t.Errorf("%s made %d calls, over the ceiling of %.0f", class, calls, ceiling)
+		}
+	}
+	for p, name := range priorityNames {
+		if n := served[p].Load(); n > 0 {
+			t.Logf("%s calls: %d, average wait %s", name, n, time.Duration(waited[p].Load()/n))
+		}
+	}
+	if served[priorityInteractive].Load() == 0 {
+		t.Fatal("no interactive call got through")
+	}
+	if served[priorityBackground].Load() > 0 &&
+		waited[priorityInteractive].Load()/served[priorityInteractive].Load() >
+			waited[priorityBackground].Load()/served[priorityBackground].Load() {
+		t.Error("interactive calls waited longer than background ones")
+	}
+}
@@ -0,0 +1,302 @@
+// tags.go
+// Freeform per-user tags on generations: PATCH /generations/:id/tags, bulk POST
+// /generations/tags, ?tag= filters on the lists and GET /tags for autocomplete
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxTags        = 10
+	maxTagLength   = 32
+	maxBulkTagIDs  = 100
+	tagListDefault = 50
+)
+
+// normalizeTag lowercases and dashes spaces; ok is false for tags that are empty, too long or
+// use anything but letters, digits, '-' and '_'
+func normalizeTag(raw string) (tag string, ok bool) {
+	tag = strings.Join(strings.Fields(strings.ToLower(raw)), "-")
+	if tag == "" || len(tag) > maxTagLength {
+		return "", false
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", false
+		}
+	}
+	return tag, true
+}
+
+// normalizeTags normalizes and dedupes; it writes the field error and returns false on a bad tag.
+// The result is never nil, so it can go straight into a `tags @> $n` filter
+func normalizeTags(c *gin.Context, field string, raw []string) ([]string, bool) {
+	tags := []string{}
+	for _, r := range raw {
+		tag, ok := normalizeTag(r)
+		if !ok {
+			fieldError(c, codeValidationFailed, field, "tags are 1-"+strconv.Itoa(maxTagLength)+
+				" letters, digits, '-' or '_'; "+strconv.Quote(r)+" isn't")
+			return nil, false
+		}
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, true
+}
+
+// tagParams reads the repeatable ?tag= filter; rows must carry every tag given
+func tagParams(c *gin.Context) ([]string, bool) {
+	return normalizeTags(c, "tag", c.QueryArray("tag"))
+}
+
+// retagSQL applies $3 (add) and $4 (remove) to the matching rows. Both the new value and the
+// cap are computed from the row being updated, so concurrent edits can't overshoot maxTags
+const retagSQL = `
+	UPDATE generated_content
+	SET tags = ARRAY(SELECT DISTINCT t FROM unnest(tags || $3::text[]) t WHERE t <> ALL($4::text[]) ORDER BY t)
+	WHERE user_id = $1 AND request_id = ANY($2::text[])
+	  AND cardinality(ARRAY(SELECT DISTINCT t FROM unnest(tags || $3::text[]) t WHERE t <> ALL($4::text[]))) <= $5
+	RETURNING request_id, tags`
+
+// taggedGeneration is one row's tags after an edit
+type taggedGeneration struct {
+	RequestID string   `json:"request_id"`
+	Tags      []string `json:"tags"`
+}
+
+// retagGenerations adds and removes tags on the user's rows among ids (trashed ones included,
+// so tags survive a restore). Rows left out of updated are either not the user's or would
+// end up over maxTags; overLimit lists the latter
+func retagGenerations(ctx context.Context, userID string, ids, add, remove []string) (updated []taggedGeneration, overLimit []string, err error) {
+	rows, err := db.QueryContext(ctx, retagSQL, userID, pq.Array(ids), pq.Array(add), pq.Array(remove), maxTags)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	updated = []taggedGeneration{}
+	done := map[string]bool{}
+	for rows.Next() {
+		var t taggedGeneration
+		if err := rows.Scan(&t.RequestID, pq.Array(&t.Tags)); err != nil {
+			return nil, nil, err
+		}
+		done[t.RequestID] = true
+		updated = append(updated, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(updated) == len(ids) {
+		return updated, nil, nil
+	}
+
+	owned, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content
+		WHERE user_id = $1 AND request_id = ANY($2::text[])`, userID, pq.Array(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range owned {
+		if !done[id] {
+			overLimit = append(overLimit, id)
+		}
+	}
+	return updated, overLimit, nil
+}
+
+// setGenerationTags replaces a row's tags outright
+func setGenerationTags(ctx context.Context, requestID, userID string, tags []string) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE generated_content SET tags = $3
+		WHERE request_id = $1 AND user_id = $2`, requestID, userID, pq.Array(tags))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// tagEdit is the PATCH body: either tags to replace the set, or add/remove to change it
+type tagEdit struct {
+	Tags   *[]string `json:"tags"`
+	Add    []string  `json:"add"`
+	Remove []string  `json:"remove"`
+}
+
+// bindTagEdit parses and normalizes add/remove, or tags when replacing
+func bindTagEdit(c *gin.Context, body interface{}, edit *tagEdit) (add, remove []string, ok bool) {
+	if err := c.ShouldBindJSON(body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid request body")
+		return nil, nil, false
+	}
+	if edit.Tags != nil && (len(edit.Add) > 0 || len(edit.Remove) > 0) {
+		respondError(c, codeValidationFailed, "Send either tags or add/remove, not both")
+		return nil, nil, false
+	}
+	if edit.Tags != nil {
+		if add, ok = normalizeTags(c, "tags", *edit.Tags); !ok {
+			return nil, nil, false
+		}
+		if len(add) > maxTags {
+			fieldError(c, codeValidationFailed, "tags", "at most "+strconv.Itoa(maxTags)+" tags per generation")
+			return nil, nil, false
+		}
+		return add, nil, true
+	}
+	if add, ok = normalizeTags(c, "add", edit.Add); !ok {
+		return nil, nil, false
+	}
+	if remove, ok = normalizeTags(c, "remove", edit.Remove); !ok {
+		return nil, nil, false
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		respondError(c, codeValidationFailed, "Nothing to change; send tags, add or remove")
+		return nil, nil, false
+	}
+	return add, remove, true
+}
+
+// patchGenerationTagsHandler handles PATCH /generations/:id/tags
+func patchGenerationTagsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	var edit tagEdit
+	add, remove, ok := bindTagEdit(c, &edit, &edit)
+	if !ok {
+		return
+	}
+
+	if edit.Tags != nil {
+		err := setGenerationTags(ctx, c.Param("id"), user.ID.String(), add)
+		if err == sql.ErrNoRows {
+			respondError(c, codeNotFound, "Generation not found")
+			return
+		}
+		if err != nil {
+			log.Printf("❌ Failed to tag generation %s: %v", c.Param("id"), err)
+			respondError(c, codeInternal, "Failed to update tags")
+			return
+		}
+		c.JSON(http.StatusOK, taggedGeneration{RequestID: c.Param("id"), Tags: add})
+		return
+	}
+
+	updated, overLimit, err := retagGenerations(ctx, user.ID.String(), []string{c.Param("id")}, add, remove)
+	if err != nil {
+		log.Printf("❌ Failed to tag generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to update tags")
+		return
+	}
+	switch {
+	case len(overLimit) > 0:
+		fieldError(c, codeValidationFailed, "add", "at most "+strconv.Itoa(maxTags)+" tags per generation")
+	case len(updated) == 0:
+		respondError(c, codeNotFound, "Generation not found")
+	default:
+		c.JSON(http.StatusOK, updated[0])
+	}
+}
+
+// bulkTagsHandler handles POST /generations/tags with {"request_ids": [...], "add": [...],
+// "remove": [...]}. Rows that would go over the tag limit are skipped and listed
+func bulkTagsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+
+	var body struct {
+		RequestIDs []string `json:"request_ids"`
+		tagEdit
+	}
+	add, remove, ok := bindTagEdit(c, &body, &body.tagEdit)
+	if !ok {
+		return
+	}
+	if body.Tags != nil {
+		respondError(c, codeValidationFailed, "Bulk tagging takes add and remove")
+		return
+	}
+	if len(body.RequestIDs) == 0 || len(body.RequestIDs) > maxBulkTagIDs {
+		fieldError(c, codeValidationFailed, "request_ids", "send 1-"+strconv.Itoa(maxBulkTagIDs)+" request IDs")
+		return
+	}
+
+	updated, overLimit, err := retagGenerations(c.Request.Context(), user.ID.String(), body.RequestIDs, add, remove)
+	if err != nil {
+		log.Printf("❌ Failed to bulk tag for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to update tags")
+		return
+	}
+
+	notFound := []string{}
+	for _, id := range body.RequestIDs {
+		if !containsString(overLimit, id) && !containsTagged(updated, id) {
+			notFound = append(notFound, id)
+		}
+	}
+	if overLimit == nil {
+		overLimit = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"updated": updated, "over_limit": overLimit, "not_found": notFound})
+}
+
+func containsTagged(list []taggedGeneration, id string) bool {
+	for _, t := range list {
+		if t.RequestID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// listTagsHandler handles GET /tags[?prefix=&limit=]: the user's tags on live generations,
+// most used first
+func listTagsHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(tagListDefault)))
+	if err != nil || limit < 1 || limit > 200 {
+		limit = tagListDefault
+	}
+	prefix := strings.ToLower(strings.TrimSpace(c.Query("prefix")))
+
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT t, count(*) FROM generated_content, unnest(tags) t
+		WHERE user_id = $1 AND trashed_at IS NULL AND starts_with(t, $2)
+		GROUP BY t ORDER BY count(*) DESC, t LIMIT $3`, user.ID.String(), prefix, limit)
+	if err != nil {
+		log.Printf("❌ Failed to list tags for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to list tags")
+		return
+	}
+	defer rows.Close()
+
+	type tagCount struct {
+		Tag   string `json:"tag"`
+		Count int    `json:"count"`
+	}
+	tags := []tagCount{}
+	for rows.Next() {
+		var t tagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			respondError(c, codeInternal, "Failed to list tags")
+			return
+		}
+		tags = append(tags, t)
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
@@ -0,0 +1,402 @@
+// templates.go
+// Prompt templates: a reusable body with {variable} placeholders plus default generation
+// parameters. POST /generations takes template_id and variables instead of text; the
+// prompt is rendered here, so the worker and the row only ever see the final text
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	maxTemplateBody      = getEnvInt("MAX_TEMPLATE_BODY_LENGTH", 2000) // characters, before rendering
+	maxTemplateVariables = getEnvInt("MAX_TEMPLATE_VARIABLES", 20)
+	maxTemplateName      = 100
+	maxTemplatesPerUser  = getEnvInt("MAX_TEMPLATES_PER_USER", 200)
+
+	// A placeholder is {name}; any other brace is literal text
+	templatePlaceholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]{0,63})\}`)
+)
+
+// TemplateDefaults are generation parameters a template fills in when the request leaves
+// them unset; the request's own values always win
+type TemplateDefaults struct {
+	RequestType     string  `json:"request_type,omitempty"`
+	Model           string  `json:"model,omitempty"`
+	Resolution      int     `json:"resolution,omitempty"`
+	Steps           int     `json:"steps,omitempty"`
+	NumImages       int     `json:"num_images,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	FPS             int     `json:"fps,omitempty"`
+}
+
+// PromptTemplate is a stored template. Shared templates (org_id set) are usable by every
+// member of the org but only editable by their author and the org's owners
+type PromptTemplate struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Body      string           `json:"body"`
+	Variables []string         `json:"variables"` // derived from body, in first-use order
+	Defaults  TemplateDefaults `json:"defaults"`
+	OrgID     string           `json:"org_id,omitempty"`
+	OwnerID   string           `json:"owner_id"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+// templateVariables lists body's placeholder names once each, in order of first use
+func templateVariables(body string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(body, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// renderTemplate substitutes vars into body. Every placeholder must be supplied and every
+// supplied variable must be a placeholder. Substitution is a single pass, so a value that
+// itself contains {braces} is inserted as written
+func renderTemplate(body string, vars map[string]string) (string, error) {
+	names := templateVariables(body)
+	var missing, unknown []string
+	for _, name := range names {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	for name := range vars {
+		if !containsString(names, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	switch {
+	case len(missing) > 0:
+		return "", fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	case len(unknown) > 0:
+		return "", fmt.Errorf("unknown %s", strings.Join(unknown, ", "))
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(body, func(m string) string {
+		return vars[m[1:len(m)-1]]
+	}), nil
+}
+
+// validateTemplate checks a name and body against the limits; field names the offender
+func validateTemplate(name, body string) (field, msg string) {
+	if name = strings.TrimSpace(name); name == "" || utf8.RuneCountInString(name) > maxTemplateName {
+		return "name", fmt.Sprintf("must be 1 to %d characters", maxTemplateName)
+	}
+	if !utf8.ValidString(body) || strings.TrimSpace(body) == "" {
+		return "body", "must not be empty"
+	}
+	if n := utf8.RuneCountInString(body); n > maxTemplateBody {
+		return "body", fmt.Sprintf("%d characters, the limit is %d", n, maxTemplateBody)
+	}
+	if n := len(templateVariables(body)); n > maxTemplateVariables {
+		return "body", fmt.Sprintf("%d variables, the limit is %d", n, maxTemplateVariables)
+	}
+	return "", ""
+}
+
+const templateColumns = `id, name, body, defaults, coalesce(org_id::text, ''), user_id, created_at, updated_at`
+
+func scanTemplate(row rowScanner) (*PromptTemplate, error) {
+	var t PromptTemplate
+	var defaults []byte
+	if err := row.Scan(&t.ID, &t.Name, &t.Body, &defaults, &t.OrgID, &t.OwnerID, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(defaults, &t.Defaults); err != nil {
+		return nil, err
+	}
+	t.Variables = templateVariables(t.Body)
+	if t.Variables == nil {
+		t.Variables = []string{}
+	}
+	return &t, nil
+}
+
+// usableTemplate loads id if userID wrote it or belongs to the org it is shared with;
+// sql.ErrNoRows otherwise, so template IDs can't be probed
+func usableTemplate(ctx context.Context, id, userID string) (*PromptTemplate, error) {
+	t, err := scanTemplate(db.QueryRowContext(ctx, `
+		SELECT `+templateColumns+` FROM prompt_templates WHERE id::text = $1`, id))
+	if err != nil || t.OwnerID == userID {
+		return t, err
+	}
+	if t.OrgID != "" {
+		if role, err := orgRole(ctx, t.OrgID, userID); err != nil || role != "" {
+			return t, err
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// applyTemplate renders req's template into req.Text and fills unset parameters from its
+// defaults. Requests without template_id pass through; text alongside one is refused
+func applyTemplate(c *gin.Context, req *RequestPayload) bool {
+	if req.TemplateID == "" {
+		if req.Variables != nil {
+			fieldError(c, codeValidationFailed, "variables", "only allowed with template_id")
+			return false
+		}
+		return true
+	}
+	if req.Text != "" {
+		fieldError(c, codeValidationFailed, "text", "omit text when using template_id")
+		return false
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+	t, err := usableTemplate(c.Request.Context(), req.TemplateID, user.ID.String())
+	if err == sql.ErrNoRows {
+		fieldError(c, codeNotFound, "template_id", "template not found")
+		return false
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load template %s: %v", req.TemplateID, err)
+		respondError(c, codeInternal, "Failed to load template")
+		return false
+	}
+	if req.Text, err = renderTemplate(t.Body, req.Variables); err != nil {
+		fieldError(c, codeValidationFailed, "variables", err.Error())
+		return false
+	}
+	req.TemplateID = t.ID
+
+	d := t.Defaults
+	if req.RequestType == "" {
+		req.RequestType = d.RequestType
+	}
+	if req.Model == "" {
+		req.Model = d.Model
+	}
+	if req.Resolution == 0 {
+		req.Resolution = d.Resolution
+	}
+	if req.Steps == 0 {
+		req.Steps = d.Steps
+	}
+	if req.NumImages == 0 {
+		req.NumImages = d.NumImages
+	}
+	if req.DurationSeconds == 0 {
+		req.DurationSeconds = d.DurationSeconds
+	}
+	if req.FPS == 0 {
+		req.FPS = d.FPS
+	}
+	return true
+}
+
+// templateShareAllowed checks the caller may share to orgID ("" = personal): any member may
+func templateShareAllowed(c *gin.Context, orgID string) bool {
+	if orgID == "" {
+		return true
+	}
+	user := c.MustGet("currentUser").(*repository.User)
+	role, err := orgRole(c.Request.Context(), orgID, user.ID.String())
+	return err == nil && role != ""
+}
+
+// templateBody is the JSON of POST /templates and PATCH /templates/:id; PATCH only
+// changes what it names, and "org_id": "" unshares
+type templateBody struct {
+	Name     *string           `json:"name"`
+	Body     *string           `json:"body"`
+	Defaults *TemplateDefaults `json:"defaults"`
+	OrgID    *string           `json:"org_id"`
+}
+
+// createTemplateHandler handles POST /templates
+func createTemplateHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	var body templateBody
+	if err := c.ShouldBindJSON(&body); err != nil || body.Name == nil || body.Body == nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if field, msg := validateTemplate(*body.Name, *body.Body); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	var orgID string
+	if body.OrgID != nil {
+		orgID = *body.OrgID
+	}
+	if !templateShareAllowed(c, orgID) {
+		respondError(c, codeNotMember, "Not a member of that organization")
+		return
+	}
+	if body.Defaults == nil {
+		body.Defaults = &TemplateDefaults{}
+	}
+	defaults, _ := json.Marshal(body.Defaults)
+
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM prompt_templates WHERE user_id = $1`,
+		user.ID.String()).Scan(&count); err == nil && count >= maxTemplatesPerUser {
+		respondError(c, codeConflict, fmt.Sprintf("Template limit of %d reached", maxTemplatesPerUser))
+		return
+	}
+
+	t, err := scanTemplate(db.QueryRowContext(ctx, `
+		INSERT INTO prompt_templates (user_id, org_id, name, body, defaults)
+		VALUES ($1, nullif($2, '')::uuid, $3, $4, $5)
+		RETURNING `+templateColumns, user.ID.String(), orgID, strings.TrimSpace(*body.Name), *body.Body, defaults))
+	if err != nil {
+		log.Printf("❌ Failed to create template: %v", err)
+		respondError(c, codeInternal, "Failed to create template")
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+// listTemplatesHandler handles GET /templates?org_id=: the caller's own templates plus
+// those shared with their orgs, or only one org's with org_id
+func listTemplatesHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	orgID := c.Query("org_id")
+	if !templateShareAllowed(c, orgID) {
+		respondError(c, codeNotMember, "Not a member of that organization")
+		return
+	}
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+templateColumns+` FROM prompt_templates
+		WHERE CASE WHEN $2 = '' THEN
+		          user_id = $1 OR org_id IN (SELECT org_id FROM organization_members
+		                                     WHERE user_id = $1 AND removed_at IS NULL)
+		      ELSE org_id::text = $2 END
+		ORDER BY lower(name), id LIMIT 500`, user.ID.String(), orgID)
+	if err != nil {
+		log.Printf("❌ Failed to list templates: %v", err)
+		respondError(c, codeInternal, "Failed to list templates")
+		return
+	}
+	defer rows.Close()
+
+	list := []*PromptTemplate{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list templates")
+			return
+		}
+		list = append(list, t)
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+// getTemplateHandler handles GET /templates/:id
+func getTemplateHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	t, err := usableTemplate(c.Request.Context(), c.Param("id"), user.ID.String())
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Template not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load template")
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// findEditableTemplate loads :id if the caller wrote it or owns the org it is shared with;
+// other members of that org get 403, everyone else 404
+func findEditableTemplate(c *gin.Context) (*PromptTemplate, bool) {
+	user := c.MustGet("currentUser").(*repository.User)
+	t, err := usableTemplate(c.Request.Context(), c.Param("id"), user.ID.String())
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Template not found")
+		return nil, false
+	}
+	if err != nil {
+		respondError(c, codeInternal, "Failed to load template")
+		return nil, false
+	}
+	if t.OwnerID != user.ID.String() {
+		if role, _ := orgRole(c.Request.Context(), t.OrgID, user.ID.String()); role != orgRoleOwner {
+			respondError(c, codeNotOwner, "Only the template's author or organization owners can change it")
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+// updateTemplateHandler handles PATCH /templates/:id
+func updateTemplateHandler(c *gin.Context) {
+	t, ok := findEditableTemplate(c)
+	if !ok {
+		return
+	}
+	var body templateBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	if body.Name != nil {
+		t.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Body != nil {
+		t.Body = *body.Body
+	}
+	if body.Defaults != nil {
+		t.Defaults = *body.Defaults
+	}
+	if field, msg := validateTemplate(t.Name, t.Body); field != "" {
+		fieldError(c, codeValidationFailed, field, msg)
+		return
+	}
+	if body.OrgID != nil && *body.OrgID != t.OrgID {
+		if !templateShareAllowed(c, *body.OrgID) {
+			respondError(c, codeNotMember, "Not a member of that organization")
+			return
+		}
+		t.OrgID = *body.OrgID
+	}
+	defaults, _ := json.Marshal(t.Defaults)
+
+	updated, err := scanTemplate(db.QueryRowContext(c.Request.Context(), `
+		UPDATE prompt_templates
+		SET name = $2, body = $3, defaults = $4, org_id = nullif($5, '')::uuid, updated_at = now()
+		WHERE id = $1
+		RETURNING `+templateColumns, t.ID, t.Name, t.Body, defaults, t.OrgID))
+	if err != nil {
+		log.Printf("❌ Failed to update template %s: %v", t.ID, err)
+		respondError(c, codeInternal, "Failed to update template")
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// deleteTemplateHandler handles DELETE /templates/:id. Rows generated from it keep their
+// rendered prompt; their template_id is cleared
+func deleteTemplateHandler(c *gin.Context) {
+	t, ok := findEditableTemplate(c)
+	if !ok {
+		return
+	}
+	if _, err := db.ExecContext(c.Request.Context(), `DELETE FROM prompt_templates WHERE id = $1`, t.ID); err != nil {
+		respondError(c, codeInternal, "Failed to delete template")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
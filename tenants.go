@@ -0,0 +1,271 @@
+// tenants.go
+// Tenants: isolated namespaces for white-label partners within one deployment, picked by
+// Host (X-Tenant-ID on internal routes), each with its own channels, objects, plans and admins
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultTenantID   = "default"
+	tenantHeader      = "X-Tenant-ID"
+	tenantStorageRoot = "tenants/"
+)
+
+// Tenant is one configured namespace
+type Tenant struct {
+	ID     string   `json:"id"`
+	Hosts  []string `json:"hosts,omitempty"`
+	admins []string
+}
+
+var (
+	tenantIDPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+	tenants         = loadTenants()
+	tenantsByHost   = tenantHosts(tenants)
+
+	crossTenantAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_cross_tenant_attempts_total",
+		Help: "Requests and messages refused for reaching another tenant's users, rows or objects, by where.",
+	}, []string{"where"})
+)
+
+// loadTenants reads TENANTS, the tenants besides the default one
+func loadTenants() map[string]*Tenant {
+	all := map[string]*Tenant{defaultTenantID: {ID: defaultTenantID, admins: adminUserIDs}}
+	for _, id := range strings.Split(getEnv("TENANTS", "partner"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || id == defaultTenantID {
+			continue
+		}
+		if !tenantIDPattern.MatchString(id) {
+			panic(fmt.Errorf("TENANTS: %q is not a valid tenant ID", id))
+		}
+		env := "TENANT_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+		t := &Tenant{ID: id, admins: strings.Split(getEnv(env+"_ADMIN_USER_IDS", ""), ",")}
+		for _, host := range strings.Split(getEnv(env+"_HOSTS", ""), ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				t.Hosts = append(t.Hosts, host)
+			}
+		}
+		all[id] = t
+	}
+	return all
+}
+
+func tenantHosts(all map[string]*Tenant) map[string]*Tenant {
+	byHost := map[string]*Tenant{}
+	for _, t := range all {
+		for _, host := range t.Hosts {
+			if other, ok := byHost[host]; ok {
+				panic(fmt.Errorf("host %s is configured for both tenant %s and %s", host, other.ID, t.ID))
+			}
+			byHost[host] = t
+		}
+	}
+	return byHost
+}
+
+// allTenants lists the configured tenants by ID
+func allTenants() []*Tenant {
+	list := make([]*Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func defaultTenant() *Tenant {
+	return tenants[defaultTenantID]
+}
+
+// tenantForHost is the tenant serving host, with or without a port
+func tenantForHost(host string) *Tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := tenantsByHost[strings.ToLower(host)]; ok {
+		return t
+	}
+	return defaultTenant()
+}
+
+// tenantKey namespaces a Redis key or channel: the default tenant's are unprefixed
+func tenantKey(tenantID, name string) string {
+	if tenantID == "" || tenantID == defaultTenantID {
+		return name
+	}
+	return tenantID + ":" + name
+}
+
+func (t *Tenant) key(name string) string {
+	return tenantKey(t.ID, name)
+}
+
+// tenantOfChannel splits a channel published under tenantKey into its tenant and base name
+func tenantOfChannel(channel string) (tenantID, base string) {
+	if id, rest, ok := strings.Cut(channel, ":"); ok && id != defaultTenantID {
+		if _, known := tenants[id]; known {
+			return id, rest
+		}
+	}
+	return defaultTenantID, channel
+}
+
+// tenantStoragePrefix is where the tenant's objects live; empty for the default tenant,
+// whose keys are everything outside tenants/
+func tenantStoragePrefix(tenantID string) string {
+	if tenantID == "" || tenantID == defaultTenantID {
+		return ""
+	}
+	return tenantStorageRoot + tenantID + "/"
+}
+
+// tenantOwnsObject reports whether key is one of the tenant's objects
+func tenantOwnsObject(tenantID, key string) bool {
+	if prefix := tenantStoragePrefix(tenantID); prefix != "" {
+		return strings.HasPrefix(key, prefix)
+	}
+	return !strings.HasPrefix(key, tenantStorageRoot)
+}
+
+func (t *Tenant) isAdmin(userID string) bool {
+	return containsString(t.admins, userID)
+}
+
+// tenantMiddleware resolves the request's tenant from its host
+func tenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("tenant", tenantForHost(c.Request.Host))
+		c.Next()
+	}
+}
+
+// currentTenant is the request's tenant, the default one outside the router
+func currentTenant(c *gin.Context) *Tenant {
+	if v, ok := c.Get("tenant"); ok {
+		return v.(*Tenant)
+	}
+	return defaultTenant()
+}
+
+// internalTenant lets an internal caller act for the tenant named in X-Tenant-ID. Only
+// call it once the caller is authenticated: the header is trusted from nobody else
+func internalTenant(c *gin.Context) bool {
+	id := c.GetHeader(tenantHeader)
+	if id == "" {
+		return true
+	}
+	t, ok := tenants[id]
+	if !ok {
+		respondError(c, codeNotFound, "Not found")
+		return false
+	}
+	c.Set("tenant", t)
+	return true
+}
+
+// respondCrossTenant answers a reach into another tenant exactly as a missing resource
+func respondCrossTenant(c *gin.Context, where, msg string) {
+	crossTenantAttempts.WithLabelValues(where).Inc()
+	respondError(c, codeNotFound, msg)
+}
+
+// operatorOnly keeps deployment-wide admin routes to the default tenant's admins;
+// another tenant's admins get a 404, as if the route didn't exist
+func operatorOnly(c *gin.Context) {
+	if currentTenant(c).ID != defaultTenantID {
+		respondCrossTenant(c, "operator_route", "Not found")
+		return
+	}
+	c.Next()
+}
+
+// requireTenantUser 404s admin routes on a user of another tenant
+func requireTenantUser(c *gin.Context) {
+	if _, err := uuid.Parse(c.Param("id")); err != nil {
+		c.Next() // the handler's own 404
+		return
+	}
+	switch tenant := userTenant(c.Request.Context(), c.Param("id")); tenant {
+	case currentTenant(c).ID:
+		c.Next()
+	case "":
+		respondError(c, codeInternal, "Failed to load user")
+	default:
+		respondCrossTenant(c, "admin_user", "User not found")
+	}
+}
+
+// requireTenantGeneration 404s admin routes on a generation of another tenant; unknown
+// IDs are left to the handler
+func requireTenantGeneration(c *gin.Context) {
+	tenant, err := generationTenant(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		log.Printf("❌ Failed to look up the tenant of %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load generation")
+		return
+	}
+	if tenant != "" && tenant != currentTenant(c).ID {
+		respondCrossTenant(c, "admin_generation", "Generation not found")
+		return
+	}
+	c.Next()
+}
+
+// generationTenant is the tenant of a row, empty when there is none
+func generationTenant(ctx context.Context, requestID string) (string, error) {
+	var tenant string
+	err := db.QueryRowContext(ctx, `SELECT tenant_id FROM generated_content WHERE request_id = $1`, requestID).Scan(&tenant)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return tenant, err
+}
+
+// completionCrossesTenant reports a completion that arrived on one tenant's channels
+// for another's row, or that names an object outside its tenant's prefix. Workers of one
+// tenant can't complete, or point at objects of, another
+func completionCrossesTenant(ctx context.Context, completion ImageGenerationCompletion) bool {
+	tenant, err := generationTenant(ctx, completion.RequestID)
+	if err != nil {
+		// The completion's own writes report it
+		return false
+	}
+	keys := []string{completion.S3Key, completion.PosterKey}
+	for _, r := range completion.Renditions {
+		keys = append(keys, r.S3Key)
+	}
+	crossed := tenant != "" && tenant != tenantOrDefault(completion.Tenant)
+	for _, key := range keys {
+		crossed = crossed || (key != "" && !tenantOwnsObject(completion.Tenant, key))
+	}
+	if crossed {
+		crossTenantAttempts.WithLabelValues("completion").Inc()
+		log.Printf("🚫 Dropping %s completion %s from tenant %s: the row or its objects aren't that tenant's",
+			completion.Status, completion.RequestID, tenantOrDefault(completion.Tenant))
+	}
+	return crossed
+}
+
+func tenantOrDefault(tenantID string) string {
+	if tenantID == "" {
+		return defaultTenantID
+	}
+	return tenantID
+}
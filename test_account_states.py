@@ -0,0 +1,187 @@
+#!/usr/bin/env python3
+"""
+Checks what happens to requests whose owner is disabled or deleted while they are in flight
+(accounts.go).
+
+Run the Go backend with
+
+    ADMIN_USER_IDS=<ACCOUNTS_ADMIN_ID> ACCOUNT_STATE_CACHE_TTL=1s ./mobart
+
+then run this script (needs `pip install psycopg2-binary`). Rows are inserted directly in
+their starting state with credits charged, and completions are published the way a worker
+would. It checks that:
+
+- a request already processing when its owner is disabled still completes, is not
+  refunded, and queues no notification
+- a queued request is cancelled and refunded once by the disable, and a late completion
+  for it neither revives it nor refunds it again
+- a request processing when its owner is deleted is cancelled and refunded once when its
+  completion arrives, and account_audit records the discarded completion
+- a disabled account's API calls are refused, and work again once it is enabled
+"""
+
+import json
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ADMIN_ID = os.getenv("ACCOUNTS_ADMIN_ID", "")
+CREDITS = 5
+
+
+class AccountStateTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        if not ADMIN_ID:
+            logger.error("❌ Set ACCOUNTS_ADMIN_ID to a user listed in the backend's ADMIN_USER_IDS")
+            return False
+
+        self.disable_while_processing()
+        self.disable_while_queued()
+        self.delete_while_processing()
+        self.disable_then_enable()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ disabled and deleted accounts' requests settled as expected")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _insert(self, user_id, status):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+                     status, credits_charged)
+                VALUES (%s, %s, now(), 'image', '', 'account', 'account', 'stable-image-ultra', %s, %s)""",
+                        (request_id, user_id, status, CREDITS))
+        return request_id
+
+    def _status(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT status FROM generated_content WHERE request_id = %s", (request_id,))
+            return cur.fetchone()[0]
+
+    def _refunds(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT count(*) FROM credit_ledger WHERE request_id = %s AND delta > 0", (request_id,))
+            return cur.fetchone()[0]
+
+    def _deliveries(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT count(*) FROM notification_deliveries WHERE dedupe_key LIKE %s",
+                        (request_id + ":%",))
+            return cur.fetchone()[0]
+
+    def _audited(self, user_id, action, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT count(*) FROM account_audit WHERE user_id = %s AND action = %s AND request_id = %s",
+                        (user_id, action, request_id))
+            return cur.fetchone()[0]
+
+    def _add_channel(self, user_id):
+        resp = requests.put(f"{GO_BACKEND_URL}/notifications/channels", headers={"X-User-ID": user_id},
+                            json={"kind": "webhook", "webhook_url": "https://example.com/mobart-hook"})
+        self._expect(resp.status_code in (200, 201), f"add channel: status {resp.status_code}")
+
+    def _set_state(self, user_id, action):
+        headers = {"X-User-ID": ADMIN_ID}
+        if action == "delete":
+            resp = requests.delete(f"{GO_BACKEND_URL}/admin/users/{user_id}", headers=headers)
+        else:
+            resp = requests.post(f"{GO_BACKEND_URL}/admin/users/{user_id}/{action}", headers=headers)
+        self._expect(resp.status_code == 200, f"{action} {user_id}: status {resp.status_code}")
+        return resp.json() if resp.status_code == 200 else {}
+
+    def _complete(self, user_id, request_id):
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+
+    def _wait_settled(self, request_id, seconds=3):
+        """Gives the listener time to apply (or refuse) a completion"""
+        time.sleep(seconds)
+        return self._status(request_id)
+
+    def disable_while_processing(self):
+        user_id = self._create_user()
+        self._add_channel(user_id)
+        request_id = self._insert(user_id, "processing")
+        body = self._set_state(user_id, "disable")
+        self._expect(body.get("cancelled") == 0, f"disable while processing: cancelled {body.get('cancelled')}")
+        self._complete(user_id, request_id)
+        status = self._wait_settled(request_id)
+        self._expect(status == "completed", f"disable while processing: request is {status}")
+        self._expect(self._refunds(request_id) == 0, "disable while processing: request was refunded")
+        self._expect(self._deliveries(request_id) == 0, "disable while processing: a notification was queued")
+
+    def disable_while_queued(self):
+        user_id = self._create_user()
+        request_id = self._insert(user_id, "queued")
+        body = self._set_state(user_id, "disable")
+        self._expect(body.get("cancelled") == 1, f"disable while queued: cancelled {body.get('cancelled')}")
+        self._expect(self._status(request_id) == "cancelled", "disable while queued: request not cancelled")
+        self._expect(self._refunds(request_id) == 1, f"disable while queued: {self._refunds(request_id)} refunds")
+        # The worker had already picked it up
+        self._complete(user_id, request_id)
+        status = self._wait_settled(request_id)
+        self._expect(status == "cancelled", f"disable while queued: late completion left it {status}")
+        self._expect(self._refunds(request_id) == 1,
+                     f"disable while queued: {self._refunds(request_id)} refunds after the completion")
+
+    def delete_while_processing(self):
+        user_id = self._create_user()
+        self._add_channel(user_id)
+        request_id = self._insert(user_id, "processing")
+        self._set_state(user_id, "delete")
+        self._complete(user_id, request_id)
+        status = self._wait_settled(request_id)
+        self._expect(status == "cancelled", f"delete while processing: request is {status}")
+        self._expect(self._refunds(request_id) == 1, f"delete while processing: {self._refunds(request_id)} refunds")
+        self._expect(self._deliveries(request_id) == 0, "delete while processing: a notification was queued")
+        self._expect(self._audited(user_id, "completion_discarded", request_id) == 1,
+                     "delete while processing: discarded completion not audited")
+        resp = requests.post(f"{GO_BACKEND_URL}/admin/users/{user_id}/enable", headers={"X-User-ID": ADMIN_ID})
+        self._expect(resp.status_code == 409, f"enable after delete: status {resp.status_code}")
+
+    def disable_then_enable(self):
+        user_id = self._create_user()
+        self._set_state(user_id, "disable")
+        time.sleep(1.5)  # past ACCOUNT_STATE_CACHE_TTL
+        resp = requests.get(f"{GO_BACKEND_URL}/notifications/channels", headers={"X-User-ID": user_id})
+        self._expect(resp.status_code == 403, f"disabled account: status {resp.status_code}")
+        self._set_state(user_id, "enable")
+        resp = requests.get(f"{GO_BACKEND_URL}/notifications/channels", headers={"X-User-ID": user_id})
+        self._expect(resp.status_code == 200, f"enabled account: status {resp.status_code}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if AccountStateTester().run() else 1)
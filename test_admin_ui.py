@@ -0,0 +1,156 @@
+#!/usr/bin/env python3
+"""
+Checks the operators' status page (admin_ui.go).
+
+Run the Go backend with
+
+    ADMIN_USER_IDS=<UI_ADMIN_ID> ./mobart
+
+then run this script (needs `pip install psycopg2-binary`). A charged processing row is
+inserted directly and failed the way a worker would, while the page's event stream is open.
+It checks that:
+
+- the page and its event stream are refused to non-admins
+- the event stream announces the failure
+- the page lists the failure with its error, linked to the request's history
+- the page's failures are exactly those of GET /admin/overview
+- the history, as HTML and as JSON, has the creation, the failure and the refund
+"""
+
+import json
+import os
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ADMIN_ID = os.getenv("UI_ADMIN_ID", "")
+ERROR = "CUDA out of memory <status page check>"
+
+
+class AdminUITester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        if not ADMIN_ID:
+            logger.error("❌ Set UI_ADMIN_ID to a user listed in the backend's ADMIN_USER_IDS")
+            return False
+        self.user_id = self._create_user()
+
+        self.access()
+        request_id = self.failure_event()
+        self.page(request_id)
+        self.history(request_id)
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ the status page shows what the admin API does")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _get(self, path, user_id=ADMIN_ID, **kwargs):
+        return requests.get(f"{GO_BACKEND_URL}{path}", headers={"X-User-ID": user_id}, **kwargs)
+
+    def access(self):
+        for path in ("/admin/ui", "/admin/ui/events", "/admin/overview"):
+            resp = self._get(path, user_id=self.user_id, timeout=5)
+            self._expect(resp.status_code == 403, f"{path} as a non-admin: status {resp.status_code}")
+
+    def failure_event(self):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+                     status, credits_charged)
+                VALUES (%s, %s, now(), 'image', '', 'status page', 'status page', 'stable-image-ultra', 'processing', 5)""",
+                        (request_id, self.user_id))
+            cur.execute("UPDATE users SET credits = credits - 5 WHERE id = %s", (self.user_id,))
+            cur.execute("""
+                INSERT INTO credit_ledger (user_id, request_id, delta, reason)
+                VALUES (%s, %s, -5, 'generation')""", (self.user_id, request_id))
+
+        seen = threading.Event()
+
+        def listen():
+            try:
+                with self._get("/admin/ui/events", stream=True, timeout=10) as resp:
+                    for line in resp.iter_lines(decode_unicode=True):
+                        if line.startswith("data:") and request_id in line:
+                            seen.set()
+                            return
+            except requests.RequestException:
+                pass
+
+        listener = threading.Thread(target=listen, daemon=True)
+        listener.start()
+        time.sleep(1)
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "failed", "error": ERROR,
+            "error_code": "unknown",
+            "worker_id": "ui-test", "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+        self._expect(seen.wait(8), "the event stream didn't announce the failure")
+        time.sleep(1)
+        return request_id
+
+    def page(self, request_id):
+        resp = self._get("/admin/ui")
+        self._expect(resp.status_code == 200, f"/admin/ui: status {resp.status_code}")
+        self._expect(resp.headers.get("Content-Type", "").startswith("text/html"),
+                     f"/admin/ui: content type {resp.headers.get('Content-Type')}")
+        html = resp.text
+        self._expect(f'href="/admin/ui/requests/{request_id}"' in html, "the failure isn't linked from the page")
+        self._expect("CUDA out of memory &lt;status page check&gt;" in html, "the failure's error isn't on the page")
+        for section in ("Queues", "Workers", "Recent failures", "Dead letters", "Background jobs", "Audit events"):
+            self._expect(f"<h2>{section}" in html, f"no {section} section")
+
+        overview = self._get("/admin/overview").json()
+        want = [f["request_id"] for f in overview.get("recent_failures", [])]
+        got = [line.split('href="/admin/ui/requests/')[1].split('"')[0]
+               for line in html.splitlines() if 'href="/admin/ui/requests/' in line]
+        self._expect(got == want, f"the page lists {got}, the overview {want}")
+        self._expect(not overview.get("errors"), f"overview sections failed: {overview.get('errors')}")
+
+    def history(self, request_id):
+        resp = self._get(f"/admin/generations/{request_id}/events")
+        self._expect(resp.status_code == 200, f"history JSON: status {resp.status_code}")
+        events = resp.json().get("events", []) if resp.status_code == 200 else []
+        kinds = [e["kind"] for e in events]
+        for kind in ("created", "finished", "credits"):
+            self._expect(kind in kinds, f"history has no {kind} event: {kinds}")
+        details = [e.get("detail", "") for e in events]
+        self._expect("refund:failed +5" in details, f"history has no refund: {details}")
+
+        resp = self._get(f"/admin/ui/requests/{request_id}")
+        self._expect(resp.status_code == 200, f"history page: status {resp.status_code}")
+        self._expect("refund:failed +5" in resp.text, "the history page has no refund")
+        resp = self._get(f"/admin/ui/requests/{uuid.uuid4()}")
+        self._expect(resp.status_code == 404, f"unknown request's history: status {resp.status_code}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if AdminUITester().run() else 1)
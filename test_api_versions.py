@@ -0,0 +1,117 @@
+#!/usr/bin/env python3
+"""
+Checks that the API's versions (api_versions.go) answer with their own shapes, built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_api_versions.py --boot
+
+or leave out --boot to use a backend already running at GO_BACKEND_URL. Needs
+`pip install psycopg2-binary`. A completed row with a web and a thumbnail rendition is inserted directly. It checks that:
+
+- an unversioned GET /generations/:id has the same body as /v1's, plus a Sunset header
+  that /v1 and /v2 don't send
+- /v1 has no renditions or timings, and /v2 lists both renditions with a link each, and
+  the timings
+- a missing generation is {"error": "<message>"} on /v1, as before the envelope, and the
+  typed envelope as {"error": {...}} on /v2
+
+The row is removed again at the end. No worker is needed.
+"""
+
+import sys
+import time
+import uuid
+import logging
+from datetime import datetime, timezone
+
+from integration_fixtures import Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+# Presigned links differ on every call, so bodies are compared without them
+LINK_FIELDS = ("url", "thumbnail_url", "poster_url")
+
+
+class VersionTester:
+    def __init__(self, suite):
+        self.suite = suite
+
+    def run(self):
+        s = self.suite
+        self.user_id = s.create_user()
+        try:
+            request_id = self._insert_completed()
+            self.check_generation(request_id)
+            self.check_errors()
+        finally:
+            with s.db.cursor() as cur:
+                cur.execute("DELETE FROM generated_content WHERE user_id = %s", (self.user_id,))
+                cur.execute("DELETE FROM users WHERE id = %s", (self.user_id,))
+
+    def _get(self, path):
+        return self.suite.api("GET", path, self.user_id)
+
+    def _insert_completed(self):
+        s = self.suite
+        request_id = s.insert_generation(self.user_id, prompt="versions", completed_at=datetime.now(timezone.utc))
+        with s.db.cursor() as cur:
+            for kind, side in (("web", 1024), ("thumbnail", 256)):
+                cur.execute("""
+                    INSERT INTO generation_renditions (request_id, kind, s3_key, width, height, bytes)
+                    VALUES (%s, %s, %s, %s, %s, 1000)""", (request_id, kind, f"generated/{request_id}-{kind}.png", side, side))
+        return request_id
+
+    def _without_links(self, body):
+        return {k: v for k, v in body.items() if k not in LINK_FIELDS}
+
+    def check_generation(self, request_id):
+        s = self.suite
+        bodies = {}
+        for prefix in ("", "/v1", "/v2"):
+            resp = self._get(f"{prefix}/generations/{request_id}")
+            if not s.expect(resp.status_code == 200,
+                            f"GET {prefix}/generations/:id: status {resp.status_code} {resp.text}"):
+                return
+            sunset = resp.headers.get("Sunset")
+            s.expect(bool(sunset) == (prefix == ""), f"GET {prefix or '(unversioned)'}: Sunset header {sunset!r}")
+            bodies[prefix] = resp.json()
+
+        s.expect(self._without_links(bodies[""]) == self._without_links(bodies["/v1"]),
+                 "the unversioned body differs from /v1's")
+        s.expect("renditions" not in bodies["/v1"], "/v1 lists renditions")
+        s.expect("timings" not in bodies["/v1"], "/v1 has timings")
+        s.expect(isinstance(bodies["/v2"].get("timings"), dict), f"/v2 timings {bodies['/v2'].get('timings')!r}")
+        renditions = bodies["/v2"].get("renditions") or []
+        kinds = sorted(r.get("kind") for r in renditions)
+        s.expect(kinds == ["thumbnail", "web"], f"/v2 lists renditions {kinds}, want thumbnail and web")
+        s.expect(all(r.get("url") for r in renditions), "a /v2 rendition has no url")
+        v2 = {k: v for k, v in bodies["/v2"].items() if k not in ("renditions", "timings")}
+        s.expect(self._without_links(v2) == self._without_links(bodies["/v1"]),
+                 "/v2 differs from /v1 in more than its renditions and timings")
+
+    def check_errors(self):
+        s = self.suite
+        missing = str(uuid.uuid4())
+        v1 = self._get(f"/v1/generations/{missing}")
+        v2 = self._get(f"/v2/generations/{missing}")
+        s.expect(v1.status_code == 404 and v1.json() == {"error": "Generation not found"},
+                 f"/v1 missing generation: {v1.status_code} {v1.text}")
+        s.expect(v2.status_code == 404 and (v2.json().get("error") or {}).get("code") == "not_found",
+                 f"/v2 missing generation: {v2.status_code} {v2.text}")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot="--boot" in sys.argv)
+        VersionTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("each API version keeps its own shapes")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
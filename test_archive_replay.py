@@ -0,0 +1,129 @@
+#!/usr/bin/env python3
+"""
+Checks the completion archive replay (completion_archive.go) across a crash between
+applying an entry and committing its offset, built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_archive_replay.py --boot
+
+It needs --boot, since it restarts the backend. Needs `pip install psycopg2-binary`. This
+script plays the worker, archiving each completion before publishing it as the Python app
+does. Three images are submitted:
+
+- the first completes live, and its offset is committed
+- the second fails live, and is applied and refunded, but the offset is then put back to
+  the first entry, the state a crash between apply and commit leaves behind
+- the third is only archived while the backend is down
+
+After the restart it checks that the replay applies the third, that re-applying the second
+changes neither its row nor the ledger (one refund), that the first isn't touched, and that
+the stored offset ends at the third entry.
+"""
+
+import sys
+import json
+import time
+import logging
+
+from integration_fixtures import COMPLETION_CHANNEL, RequestWatcher, Suite, utc_timestamp
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+ARCHIVE_STREAM = f"{COMPLETION_CHANNEL}:archive"
+OFFSET_KEY = f"{ARCHIVE_STREAM}:offset"
+
+
+class ArchiveReplayTester:
+    def __init__(self, suite):
+        self.suite = suite
+        self.watcher = RequestWatcher(suite.redis_client)
+
+    def _submit(self, user_id, prompt):
+        s = self.suite
+        resp = s.submit_image(user_id, prompt)
+        if not s.expect(resp.status_code == 202, f"POST /generations: status {resp.status_code} {resp.text}"):
+            return None
+        request_id = resp.json()["generation_request_id"]
+        s.expect(self.watcher.wait_for(request_id) is not None, f"{request_id} was never published")
+        return request_id
+
+    def _archive(self, message, publish):
+        """XADDs the completion as the Python app does, then publishes it with its archive_id"""
+        archive_id = self.suite.redis_client.xadd(ARCHIVE_STREAM, {"payload": json.dumps(message)})
+        if publish:
+            self.suite.redis_client.publish(COMPLETION_CHANNEL, json.dumps({**message, "archive_id": archive_id}))
+        return archive_id
+
+    def _completion(self, request_id, user_id, status):
+        message = {"request_id": request_id, "user_id": user_id, "status": status,
+                   "worker_id": "integration-test", "timestamp": utc_timestamp()}
+        if status == "completed":
+            message.update(s3_key=f"generated/{request_id}.png", generation_time_seconds=1.0)
+        else:
+            message.update(error="invalid resolution 4096", error_code="invalid_params")
+        return message
+
+    def _wait_offset(self, want, timeout=5):
+        deadline = time.time() + timeout
+        offset = self.suite.redis_client.get(OFFSET_KEY)
+        while offset != want and time.time() < deadline:
+            time.sleep(0.1)
+            offset = self.suite.redis_client.get(OFFSET_KEY)
+        return offset
+
+    def run(self):
+        s = self.suite
+        if s.backend is None:
+            s.failures.append("this script restarts the backend, so it needs --boot")
+            return
+        user_id = s.create_user(credits=100)
+        first, second, third = (self._submit(user_id, f"archive replay {n}") for n in range(3))
+        if None in (first, second, third):
+            return
+
+        first_id = self._archive(self._completion(first, user_id, "completed"), publish=True)
+        s.expect_row(first, status="completed")
+        s.expect(self._wait_offset(first_id) == first_id, f"offset {s.redis_client.get(OFFSET_KEY)}, want {first_id}")
+
+        second_id = self._archive(self._completion(second, user_id, "failed"), publish=True)
+        applied = s.expect_row(second, status="failed")
+        self._wait_offset(second_id)
+        ledger = s.ledger(second)
+        s.expect(len(ledger) == 2, f"second: ledger {ledger} before the crash, want a charge and a refund")
+        first_row = s.row(first)
+
+        s.backend.stop()
+        # What a crash between applying the second entry and committing it leaves behind
+        s.redis_client.set(OFFSET_KEY, first_id)
+        third_id = self._archive(self._completion(third, user_id, "completed"), publish=False)
+        s.backend.start()
+
+        s.expect_row(third, status="completed", content_url=f"generated/{third}.png")
+        s.expect(self._wait_offset(third_id) == third_id,
+                 f"offset {s.redis_client.get(OFFSET_KEY)} after the replay, want {third_id}")
+        again = s.row(second)
+        if applied is not None:
+            for column in ("status", "error", "completed_at", "version"):
+                s.expect(again[column] == applied[column],
+                         f"second: replay changed {column}: {applied[column]!r} → {again[column]!r}")
+        s.expect(s.ledger(second) == ledger, f"second: ledger {s.ledger(second)} after the replay, want {ledger}")
+        s.expect(s.row(first) == first_row, "first: the replay touched a row before the offset")
+        charges = sum(-delta for delta, _ in s.ledger(first) + s.ledger(third))
+        s.expect(s.balance(user_id) == 100 - charges,
+                 f"balance {s.balance(user_id)}, want {100 - charges}: the completions charged, the failure refunded")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot="--boot" in sys.argv)
+        ArchiveReplayTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("a crash between apply and commit replays the entry once, without a second effect")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,159 @@
+#!/usr/bin/env python3
+"""
+Checks that each request_type's bucket (buckets.go) is independent of the others, across
+instances, built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run two Go backends against them, e.g.
+
+    ADMIN_USER_IDS=<BUCKETS_ADMIN_ID> ./mobart
+    ADMIN_USER_IDS=<BUCKETS_ADMIN_ID> PORT=8081 METRICS_PORT=9091 ./mobart
+
+and run this script with GO_BACKEND_URL_2=http://localhost:8081. With --boot it starts one
+backend itself, with an admin of its own, and both instances are that one unless
+GO_BACKEND_URL_2 is set. Needs `pip install psycopg2-binary`. It stores a throwaway plan with tiny image and text limits, alternates
+requests between the two instances and checks that:
+
+- image requests past the image window are a 429 naming the image bucket, while text
+  and video requests still go through
+- text requests past the text window are a 429 naming the text bucket, and don't move
+  the image bucket
+- GET /usage on either instance reports each bucket's own count
+- a user out of credits gets a 402 naming the image bucket, and can still chat
+
+The plan is removed again at the end. No worker is needed: queued requests just stay queued.
+"""
+
+import os
+import sys
+import time
+import logging
+
+import requests
+
+from integration_fixtures import GO_BACKEND_URL, Backend, Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL_2 = os.getenv("GO_BACKEND_URL_2", GO_BACKEND_URL)
+PLAN = "bucket_test"
+IMAGE_LIMIT = 2
+TEXT_LIMIT = 3
+
+
+class BucketTester:
+    def __init__(self, suite, admin_id):
+        self.suite = suite
+        self.admin_id = admin_id
+        self.instances = [GO_BACKEND_URL, GO_BACKEND_URL_2]
+        self.sent = 0
+
+    def run(self):
+        s = self.suite
+        if GO_BACKEND_URL_2 == GO_BACKEND_URL:
+            logger.warning("⚠️ GO_BACKEND_URL_2 is unset, so both instances are the same one")
+
+        self._put_plan()
+        try:
+            user_id = s.create_user(plan=PLAN, credits=1000)
+            self.check_image_exhausted(user_id)
+            self.check_text_exhausted(user_id)
+            self.check_usage(user_id)
+            self.check_credits(s.create_user(plan=PLAN, credits=0))
+        finally:
+            self._drop_plan()
+
+    def _next_instance(self):
+        url = self.instances[self.sent % len(self.instances)]
+        self.sent += 1
+        return url
+
+    def _put_plan(self):
+        resp = self.suite.api("PUT", f"/admin/plans/{PLAN}", self.admin_id, json={
+            "rate_limit": IMAGE_LIMIT, "max_in_flight": 10, "admission_mode": "reject", "max_batch": 1,
+            "kinds": {"text": {"rate_limit": TEXT_LIMIT}},
+        })
+        resp.raise_for_status()
+
+    def _drop_plan(self):
+        with self.suite.db.cursor() as cur:
+            cur.execute("DELETE FROM plan_limits WHERE plan = %s", (PLAN,))
+        self.suite.api("POST", "/admin/plans/reload", self.admin_id)
+
+    def _submit(self, user_id, request_type):
+        # On /v2, whose errors carry their details
+        body = {"text": "a lighthouse at dusk", "request_type": request_type}
+        if request_type == "video":
+            body["duration_seconds"] = 2
+        return requests.post(f"{self._next_instance()}/v2/generations", headers={"X-User-ID": user_id},
+                             json=body, timeout=10)
+
+    def _details(self, resp):
+        return ((resp.json().get("error") or {}).get("details") or {}) if resp.content else {}
+
+    def _expect_refused(self, resp, status, bucket, what):
+        details = self._details(resp)
+        self.suite.expect(resp.status_code == status and details.get("bucket") == bucket,
+                          f"{what}: expected {status} naming {bucket}, got {resp.status_code} {details}")
+
+    def check_image_exhausted(self, user_id):
+        s = self.suite
+        for i in range(IMAGE_LIMIT):
+            resp = self._submit(user_id, "image")
+            s.expect(resp.status_code == 202, f"image {i + 1}: status {resp.status_code} {resp.text}")
+        resp = self._submit(user_id, "image")
+        self._expect_refused(resp, 429, "image", "image over its window")
+        s.expect(self._details(resp).get("exhausted") == "rate",
+                 f"image over its window: details {self._details(resp)}")
+
+        resp = self._submit(user_id, "text")
+        s.expect(resp.status_code == 200, f"text after images ran out: status {resp.status_code} {resp.text}")
+        resp = self._submit(user_id, "video")
+        s.expect(resp.status_code == 202, f"video after images ran out: status {resp.status_code} {resp.text}")
+
+    def check_text_exhausted(self, user_id):
+        s = self.suite
+        # One text request was already sent while checking images
+        for i in range(TEXT_LIMIT - 1):
+            resp = self._submit(user_id, "text")
+            s.expect(resp.status_code == 200, f"text {i + 2}: status {resp.status_code} {resp.text}")
+        self._expect_refused(self._submit(user_id, "text"), 429, "text", "text over its window")
+        self._expect_refused(self._submit(user_id, "image"), 429, "image", "image after text ran out")
+
+    def check_usage(self, user_id):
+        s = self.suite
+        want = {"image": (IMAGE_LIMIT, IMAGE_LIMIT), "text": (TEXT_LIMIT, TEXT_LIMIT), "video": (1, IMAGE_LIMIT)}
+        for url in self.instances:
+            resp = requests.get(f"{url}/usage", headers={"X-User-ID": user_id}, timeout=10)
+            if not s.expect(resp.status_code == 200, f"GET /usage on {url}: status {resp.status_code}"):
+                continue
+            buckets = {b["bucket"]: b for b in resp.json().get("buckets", [])}
+            for name, (used, limit) in want.items():
+                b = buckets.get(name, {})
+                s.expect((b.get("used"), b.get("rate_limit")) == (used, limit),
+                         f"GET /usage on {url}: {name} bucket {b}, want used {used} of {limit}")
+
+    def check_credits(self, user_id):
+        self._expect_refused(self._submit(user_id, "image"), 402, "image", "image without credits")
+        resp = self._submit(user_id, "text")
+        self.suite.expect(resp.status_code == 200, f"text without credits: status {resp.status_code} {resp.text}")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            admin_id = suite.create_user()
+            suite.backend = Backend({"ADMIN_USER_IDS": admin_id})
+            suite.backend.start()
+        else:
+            admin_id = os.environ["BUCKETS_ADMIN_ID"]
+        BucketTester(suite, admin_id).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("buckets are independent across instances")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,232 @@
+#!/usr/bin/env python3
+"""
+Checks budget threshold evaluation (budgets.go) around the month boundary and refunds,
+built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_budgets.py --boot
+
+or leave out --boot to use a backend already running at GO_BACKEND_URL. Needs
+`pip install psycopg2-binary`. Budget periods are calendar months in UTC, and the backend
+evaluates against its own clock, so ledger entries are written directly at times around the
+start of the current month and charges go through POST /generations. It checks that:
+
+- percentages round up (80% of 5 is 4), and a percentage threshold without a budget has no level
+- the last second of last month doesn't count toward this month, and the first one does
+- an alert last month doesn't keep a threshold quiet this month
+- a refund this month of a charge made last month lowers this month's spend, never below zero
+- a charge that crosses a threshold alerts once, recorded in budget_alerts for this month
+- a refund that un-crosses a threshold doesn't re-arm it: crossing it again stays quiet
+
+No worker is needed.
+"""
+
+import sys
+import time
+import uuid
+import logging
+from datetime import datetime, timedelta, timezone
+
+from integration_fixtures import Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+MONTHLY = 100
+SETTLE = 2  # seconds for an evaluation that shouldn't alert to have had its chance
+
+
+def period_start(now=None):
+    """budgetPeriod: the start of the UTC month holding now"""
+    now = now or datetime.now(timezone.utc)
+    return now.replace(day=1, hour=0, minute=0, second=0, microsecond=0)
+
+
+class BudgetTester:
+    def __init__(self, suite):
+        self.suite = suite
+        self.cost = None
+
+    def run(self):
+        # The backend's period must not roll over halfway through
+        start = period_start()
+        next_start = (start + timedelta(days=32)).replace(day=1)
+        left = (next_start - datetime.now(timezone.utc)).total_seconds()
+        if left < 60:
+            logger.info(f"⏳ waiting {left:.0f}s for the month to turn over")
+            time.sleep(left + 1)
+        self.start = period_start()
+
+        self.rounding()
+        self.cost = self._calibrate()
+        if not self.suite.expect(self.cost and self.cost < 30,
+                                 f"an image generation charged {self.cost}; the cases need 1 to 29"):
+            return
+        self.period_boundary()
+        self.refund_uncrosses()
+
+    # Setup and reading state
+
+    def _user(self, monthly=MONTHLY, thresholds=()):
+        """A user with a budget and thresholds, returning (user_id, {name: threshold_id})"""
+        s = self.suite
+        user_id = s.create_user(credits=1000)
+        if monthly is not None:
+            resp = s.api("PUT", "/budget", user_id, json={"monthly_credits": monthly})
+            s.expect(resp.status_code == 200, f"PUT /budget: {resp.status_code} {resp.text}")
+        ids = {}
+        for name, body in thresholds:
+            resp = s.api("POST", "/budget/thresholds", user_id, json=body)
+            if not s.expect(resp.status_code == 201, f"POST /budget/thresholds {body}: {resp.status_code} {resp.text}"):
+                continue
+            known = set(ids.values())
+            ids[name] = next(t["id"] for t in resp.json()["thresholds"] if t["id"] not in known)
+        return user_id, ids
+
+    def _ledger(self, user_id, delta, at=None, reason=None):
+        """A ledger entry at at (now by default): a charge when delta is negative, else a refund"""
+        reason = reason or ("generation" if delta < 0 else "refund:failed")
+        with self.suite.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO credit_ledger (user_id, request_id, delta, reason, created_at)
+                VALUES (%s, %s, %s, %s, coalesce(%s, now()))""", (user_id, str(uuid.uuid4()), delta, reason, at))
+
+    def _status(self, user_id):
+        resp = self.suite.api("GET", "/budget", user_id)
+        if not self.suite.expect(resp.status_code == 200, f"GET /budget: {resp.status_code} {resp.text}"):
+            return None
+        status = resp.json()
+        status["by_id"] = {t["id"]: t for t in status["thresholds"]}
+        return status
+
+    def _alerts(self, threshold_id):
+        """budget_alerts for a threshold, as [(period_start, spent, created_at)] oldest first"""
+        with self.suite.db.cursor() as cur:
+            cur.execute("""
+                SELECT period_start, spent, created_at FROM budget_alerts
+                WHERE threshold_id = %s ORDER BY period_start""", (threshold_id,))
+            return cur.fetchall()
+
+    def _charge(self, user_id):
+        """Submits an image generation, which charges it and evaluates its thresholds"""
+        resp = self.suite.submit_image(user_id, "a budget")
+        self.suite.expect(resp.status_code == 202, f"POST /generations: {resp.status_code} {resp.text}")
+        return resp.json().get("generation_request_id") if resp.status_code == 202 else None
+
+    def _wait_alerts(self, threshold_id, count, timeout=5):
+        deadline = time.time() + timeout
+        alerts = self._alerts(threshold_id)
+        while len(alerts) < count and time.time() < deadline:
+            time.sleep(0.1)
+            alerts = self._alerts(threshold_id)
+        return alerts
+
+    def _calibrate(self):
+        """What one image generation costs, on a user with no thresholds"""
+        user_id, _ = self._user(monthly=None)
+        request_id = self._charge(user_id)
+        row = request_id and self.suite.row(request_id)
+        return row["credits_charged"] if row else None
+
+    # Cases
+
+    def rounding(self):
+        s = self.suite
+        for monthly, percent, want in [(5, 80, 4), (100, 80, 80), (10, 33, 4)]:
+            user_id, ids = self._user(monthly, [("t", {"percent": percent})])
+            status = self._status(user_id)
+            got = status and status["by_id"].get(ids.get("t"), {}).get("at_credits")
+            s.expect(got == want, f"{percent}% of {monthly}: at_credits {got}, want {want}")
+
+        user_id, ids = self._user(None, [("pct", {"percent": 80}), ("abs", {"credits": 50})])
+        status = self._status(user_id)
+        if status:
+            pct, flat = status["by_id"].get(ids.get("pct"), {}), status["by_id"].get(ids.get("abs"), {})
+            s.expect(pct.get("at_credits") is None and not pct.get("crossed"),
+                     f"80% without a budget: {pct}, want no at_credits and not crossed")
+            s.expect(flat.get("at_credits") == 50, f"50 credits without a budget: {flat}, want at_credits 50")
+
+    def period_boundary(self):
+        s = self.suite
+        user_id, ids = self._user(thresholds=[("50", {"credits": 50}), ("80%", {"percent": 80})])
+        last_month = period_start(self.start - timedelta(days=1))
+        self._ledger(user_id, -60, at=self.start - timedelta(seconds=1))
+        with s.db.cursor() as cur:
+            cur.execute("INSERT INTO budget_alerts (threshold_id, period_start, spent) VALUES (%s, %s, 60)",
+                        (ids["80%"], last_month.date()))
+        self._ledger(user_id, -20, at=self.start)
+
+        status = self._status(user_id)
+        if not status:
+            return
+        s.expect(datetime.fromisoformat(status["period_start"].replace("Z", "+00:00")) == self.start,
+                 f"period_start {status['period_start']}, want {self.start.isoformat()}")
+        s.expect(status["spent"] == 20,
+                 f"spent {status['spent']} with 60 at the last second of last month and 20 at the first of this one, "
+                 f"want 20")
+        alerted = [t["id"] for t in status["thresholds"] if t.get("alerted_at")]
+        s.expect(not alerted, f"thresholds {alerted} read as alerted this month; last month's alert carried over")
+
+        # Refunding last month's 60 this month takes this month's spend to zero, not below
+        self._ledger(user_id, 60, at=self.start + timedelta(seconds=1))
+        status = self._status(user_id)
+        s.expect(status and status["spent"] == 0, f"spent {status and status['spent']} after the refund, want 0")
+
+        # Entries written directly aren't evaluated, so the next charge crosses both at once.
+        # The ledger nets to +40 this month so far; bring it to -80 with the charge
+        self._ledger(user_id, -(120 - self.cost))
+        self._charge(user_id)
+        for name in ("50", "80%"):
+            alerts = self._wait_alerts(ids[name], 1 if name == "50" else 2)
+            periods = [p for p, _, _ in alerts]
+            want = [self.start.date()] if name == "50" else [last_month.date(), self.start.date()]
+            s.expect(periods == want, f"{name} alerts for periods {periods}, want {want}")
+        status = self._status(user_id)
+        if status:
+            s.expect(status["spent"] == 80, f"spent {status['spent']} after the charge, want 80")
+            quiet = [t["id"] for t in status["thresholds"] if not (t["crossed"] and t.get("alerted_at"))]
+            s.expect(not quiet, f"thresholds {quiet} aren't crossed and alerted after the charge")
+
+    def refund_uncrosses(self):
+        s = self.suite
+        user_id, ids = self._user(thresholds=[("80%", {"percent": 80})])
+        threshold = ids.get("80%")
+        if not threshold:
+            return
+        self._ledger(user_id, -(80 - self.cost))
+        self._charge(user_id)
+        alerts = self._wait_alerts(threshold, 1)
+        if not s.expect(len(alerts) == 1, f"crossing 80%: {len(alerts)} alerts, want 1"):
+            return
+        first = alerts[0]
+
+        self._ledger(user_id, 30)
+        status = self._status(user_id)
+        t = status and status["by_id"][threshold]
+        s.expect(t and not t["crossed"] and t.get("alerted_at"),
+                 f"after a refund to {status and status['spent']}: {t}, want not crossed but still alerted")
+
+        self._ledger(user_id, -(30 - self.cost))
+        self._charge(user_id)
+        time.sleep(SETTLE)
+        status = self._status(user_id)
+        s.expect(status and status["spent"] == 80 and status["by_id"][threshold]["crossed"],
+                 f"after crossing again: {status and status['by_id'][threshold]}, spent "
+                 f"{status and status['spent']}, want crossed at 80")
+        alerts = self._alerts(threshold)
+        s.expect(alerts == [first], f"crossing 80% again after a refund alerted again: {alerts}, want only {first}")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot="--boot" in sys.argv)
+        BudgetTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("budget thresholds alert once a month, across the boundary and refunds")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
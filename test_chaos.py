@@ -0,0 +1,189 @@
+#!/usr/bin/env python3
+"""
+Convergence test for the completion pipeline under injected faults.
+
+Run the Go backend built with the chaos tag and faults enabled, e.g.
+
+    go build -tags chaos -o mobart-chaos .
+    MOBART_CHAOS="drop=0.05,duplicate=0.2,delay=0.2,delay_max=5s,corrupt=0.05,redis_kill=0.02" \
+        DEADLINE_SWEEP_INTERVAL=5s ./mobart-chaos
+
+then run this script (needs `pip install psycopg2-binary`). It plays the worker: it answers
+every generation request with a completion or a failure, then checks that each request
+ends in the right state once the faults have played out:
+
+- rows are completed/failed as answered, or timed_out when their completion was lost
+- each request was charged exactly once, and refunded exactly once only if it failed or
+  timed out (including ones whose completion then arrived late)
+- each (request, status, channel) was queued for notification at most once, counted from
+  the queued payloads rather than their dedupe keys, which are unique by constraint
+
+The throwaway user is inserted with just id, plan and credits; adjust _create_user if the
+users table needs more.
+"""
+
+import json
+import os
+import random
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+REQUESTS = int(os.getenv("CHAOS_REQUESTS", "50"))
+MAX_WAIT_SECONDS = int(os.getenv("CHAOS_MAX_WAIT_SECONDS", "30"))
+FAILURE_RATE = 0.2
+
+
+class ChaosTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.answers = {}  # request_id -> "completed" | "failed"
+        self.lock = threading.Lock()
+
+    def run(self):
+        self._create_user()
+        self._create_channel()
+
+        worker = threading.Thread(target=self._play_worker, daemon=True)
+        worker.start()
+        time.sleep(1)  # let the subscription settle
+
+        request_ids = [self._submit(i) for i in range(REQUESTS)]
+        request_ids = [rid for rid in request_ids if rid]
+        logger.info(f"📤 Submitted {len(request_ids)} generations")
+
+        if not self._wait_for_terminal(request_ids):
+            return False
+        return self._check(request_ids)
+
+    def _create_user(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', %s)",
+                        (self.user_id, REQUESTS * 10))
+
+    def _headers(self):
+        return {"X-User-ID": self.user_id}
+
+    def _create_channel(self):
+        # Deliveries to it fail and retry, which is fine: only the queued rows are checked
+        resp = requests.put(f"{GO_BACKEND_URL}/notifications/channels", headers=self._headers(),
+                            json={"kind": "webhook", "webhook_url": "https://chaos.invalid/hook"})
+        resp.raise_for_status()
+
+    def _submit(self, i):
+        resp = requests.post(f"{GO_BACKEND_URL}/generations", headers=self._headers(), json={
+            "text": f"chaos test image {i}",
+            "request_type": "image",
+            "max_wait_seconds": MAX_WAIT_SECONDS,
+        })
+        if resp.status_code != 202:
+            logger.error(f"❌ Submit {i} returned {resp.status_code}: {resp.text}")
+            return None
+        return resp.json()["generation_request_id"]
+
+    def _play_worker(self):
+        pubsub = self.redis_client.pubsub()
+        pubsub.subscribe("image_generation_requests")
+        for message in pubsub.listen():
+            if message["type"] != "message":
+                continue
+            request = json.loads(message["data"])
+            if request.get("user_id") != self.user_id:
+                continue
+            status = "failed" if random.random() < FAILURE_RATE else "completed"
+            with self.lock:
+                self.answers[request["request_id"]] = status
+            threading.Timer(random.uniform(0, 3), self._complete, (request, status)).start()
+
+    def _complete(self, request, status):
+        completion = {
+            "request_id": request["request_id"],
+            "user_id": request["user_id"],
+            "status": status,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%S"),
+        }
+        if status == "completed":
+            completion["s3_key"] = f"generated/{request['user_id']}/{request['request_id']}.png"
+            completion["generation_time_seconds"] = 1.0
+        else:
+            completion["error"] = "chaos test failure"
+        payload = json.dumps(completion)
+        archive_id = self.redis_client.xadd("image_generation_complete:archive", {"payload": payload},
+                                            maxlen=10000, approximate=True)
+        completion["archive_id"] = archive_id
+        self.redis_client.publish("image_generation_complete", json.dumps(completion))
+
+    def _wait_for_terminal(self, request_ids):
+        deadline = time.time() + MAX_WAIT_SECONDS + 60
+        while time.time() < deadline:
+            with self.db.cursor() as cur:
+                cur.execute("""SELECT count(*) FROM generated_content
+                               WHERE request_id = ANY(%s) AND status IN ('queued', 'processing', 'deferred')""",
+                            (request_ids,))
+                pending = cur.fetchone()[0]
+            if pending == 0:
+                return True
+            logger.info(f"⏳ {pending} generations still in flight...")
+            time.sleep(5)
+        logger.error("❌ Generations never reached a terminal state")
+        return False
+
+    def _check(self, request_ids):
+        problems = []
+        with self.db.cursor() as cur:
+            cur.execute("SELECT request_id, status, late FROM generated_content WHERE request_id = ANY(%s)",
+                        (request_ids,))
+            rows = cur.fetchall()
+            statuses = {rid: status for rid, status, _ in rows}
+            late = {rid for rid, _, is_late in rows if is_late}
+            cur.execute("""SELECT request_id, count(*) FILTER (WHERE delta < 0), count(*) FILTER (WHERE delta > 0)
+                           FROM credit_ledger WHERE request_id = ANY(%s) GROUP BY request_id""",
+                        (request_ids,))
+            ledger = {rid: (charges, refunds) for rid, charges, refunds in cur.fetchall()}
+            # A webhook hears each progress milestone once, so the milestone is part of the key
+            cur.execute("""SELECT payload->>'request_id', payload->>'status', coalesce(payload->>'progress', ''),
+                                  target_type, count(*)
+                           FROM notification_deliveries
+                           WHERE payload->>'request_id' = ANY(%s)
+                           GROUP BY 1, 2, 3, 4 HAVING count(*) > 1""", (request_ids,))
+            duplicates = cur.fetchall()
+
+        for rid in request_ids:
+            status = statuses.get(rid)
+            answer = self.answers.get(rid)
+            if status not in (answer, "timed_out"):
+                problems.append(f"{rid}: status {status}, worker answered {answer}")
+            charges, refunds = ledger.get(rid, (0, 0))
+            if charges != 1:
+                problems.append(f"{rid}: charged {charges} times")
+            if refunds != (1 if status in ("failed", "timed_out") or rid in late else 0):
+                problems.append(f"{rid}: refunded {refunds} times with status {status}")
+        for rid, status, progress, channel, count in duplicates:
+            what = f"{status} {progress}%" if progress else status
+            problems.append(f"{rid}: queued {count} {what} notifications to its {channel} channel")
+
+        timed_out = sum(1 for s in statuses.values() if s == "timed_out")
+        logger.info(f"📊 {len(request_ids)} generations, {timed_out} timed out after lost completions")
+        for p in problems:
+            logger.error(f"❌ {p}")
+        if not problems:
+            logger.info("✅ Pipeline converged")
+        return not problems
+
+
+if __name__ == "__main__":
+    print("🐒 Mobart Chaos Tester")
+    exit(0 if ChaosTester().run() else 1)
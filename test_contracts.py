@@ -0,0 +1,92 @@
+#!/usr/bin/env python3
+"""
+Checks the JSON contract between the worker and the Go backend against testdata/contracts.
+
+The worker's message builders (src/messages.py) must produce exactly the keys of the golden
+messages, and the Go structs must decode every one of those keys into a non-zero field and
+publish requests the worker reads with the keys of generation_request.json. The Go half runs
+as `go test` (contracts_test.go) and is skipped when Go isn't installed; cmd/fakeworker's
+messages are checked the same way. The Go half also compares the API's response structs
+(responses.go) with the golden bodies in testdata/contracts/responses.
+"""
+
+import json
+import os
+import shutil
+import subprocess
+import sys
+import logging
+
+REPO_DIR = os.path.dirname(os.path.abspath(__file__))
+sys.path.insert(0, REPO_DIR)
+
+from src import messages
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+CONTRACTS_DIR = os.path.join(REPO_DIR, "testdata", "contracts")
+
+
+def _golden(name):
+    with open(os.path.join(CONTRACTS_DIR, name)) as f:
+        return json.load(f)
+
+
+def _built(name, golden):
+    """Builds the message a fixture describes from its own values"""
+    if name == "worker_heartbeat.json":
+        return messages.heartbeat(golden["worker_id"], golden["model"], golden["max_concurrent"], golden["current_load"],
+                                  draining=golden["draining"], request_ids=golden["request_ids"])
+    common = dict(request_id=golden["request_id"], user_id=golden["user_id"],
+                  worker_id=golden["worker_id"], timestamp=golden["timestamp"],
+                  lease_token=golden.get("lease_token", 0))
+    if golden["status"] == "completed":
+        return messages.completed(s3_key=golden["s3_key"], s3_url=golden["s3_url"],
+                                  generation_time=golden["generation_time_seconds"],
+                                  gpu_seconds=golden["gpu_seconds"], **common)
+    if golden["status"] == "failed":
+        return messages.failed(error=golden["error"], error_code=golden["error_code"], **common)
+    if golden["status"] == "processing":
+        return messages.processing(started_at=golden["started_at"], **common)
+    return messages.progress(percent=golden["progress"], **common)
+
+
+def check_python_messages():
+    ok = True
+    for name in ("completion_completed.json", "completion_failed.json",
+                 "completion_progress.json", "completion_processing.json", "worker_heartbeat.json"):
+        golden = _golden(name)
+        built = _built(name, golden)
+        if built != golden:
+            ok = False
+            logger.error(f"❌ {name}: worker builds {sorted(built)} but the contract is {sorted(golden)}")
+            for key in sorted(set(built) | set(golden)):
+                if built.get(key) != golden.get(key):
+                    logger.error(f"   {key}: worker={built.get(key)!r} contract={golden.get(key)!r}")
+        else:
+            logger.info(f"✅ {name} matches the worker's builder")
+    return ok
+
+
+def check_go_structs():
+    if shutil.which("go") is None:
+        logger.warning("⚠️ Go not installed, skipping the Go side of the contract")
+        return True
+    result = subprocess.run(["go", "test", "-run", "Contracts|ResponseShapes", "."], cwd=REPO_DIR)
+    return result.returncode == 0
+
+
+def check_fake_worker():
+    if shutil.which("go") is None:
+        logger.warning("⚠️ Go not installed, skipping the fake worker's messages")
+        return True
+    result = subprocess.run(["go", "test", "./cmd/fakeworker"], cwd=REPO_DIR)
+    return result.returncode == 0
+
+
+if __name__ == "__main__":
+    ok = check_python_messages()
+    ok = check_go_structs() and ok
+    ok = check_fake_worker() and ok
+    sys.exit(0 if ok else 1)
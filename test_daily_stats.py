@@ -0,0 +1,309 @@
+#!/usr/bin/env python3
+"""
+Checks that the daily rollups (analytics.go) match direct queries on the raw rows, built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_daily_stats.py --boot
+
+which starts the backend with a quick backfill runner, pruning after 12 months and an admin
+of its own. To use a backend already running at GO_BACKEND_URL instead, start it with e.g.
+
+    ADMIN_USER_IDS=<STATS_ADMIN_ID> BACKFILL_POLL_INTERVAL=1s RAW_PRUNE_AFTER_MONTHS=12 ./mobart
+
+and run this script with the same ID and PRUNE_AFTER_MONTHS. Needs
+`pip install psycopg2-binary`. Rows for two users on two plans are inserted directly under a
+model of their own, over several days more than 48 hours old and today. The daily_stats
+backfill is restarted, so everything is rolled up again. It checks that:
+
+- each rolled-up (day, plan) row of the model has the counts, credits, GPU seconds and
+  generation times of a GROUP BY over its raw rows, and a p95 within one bucket of theirs
+- daily_active_users lists both users on their days
+- GET /admin/stats, whose older days now come from rollups, agrees with the same query the
+  raw rows would answer: totals, success rate, credits, averages, active users, busiest day,
+  the daily series, and p95 within one bucket
+- a row older than PRUNE_AFTER_MONTHS lost its prompts but kept its status and credits,
+  while the recent ones before the 48 hours kept theirs
+
+The rows are removed again at the end. No worker is needed, and nothing else should write
+generations while it runs.
+"""
+
+import os
+import sys
+import time
+import uuid
+import bisect
+import logging
+from datetime import datetime, timedelta, timezone
+
+from integration_fixtures import Backend, Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+CANARY_USER_ID = os.getenv("CANARY_USER_ID", "")
+# analyticsBucketBounds
+BOUNDS = [1, 2, 3, 5, 7.5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600, 1200, 1800, 3600]
+WINDOW_DAYS = 30
+STATUSES = ["completed", "completed", "completed", "failed", "timed_out"]
+
+
+def buckets_around(seconds):
+    """The bounds of the bucket width_bucket puts seconds in, widened by a bucket each way:
+    the exact p95 interpolates between two rows, which may sit in neighbouring buckets"""
+    i = bisect.bisect_right(BOUNDS, seconds)
+    lower = BOUNDS[i - 2] if i > 1 else 0
+    return lower, (BOUNDS[i + 1] if i + 1 < len(BOUNDS) else float("inf"))
+
+
+def near(a, b, tolerance=1e-6):
+    return abs(a - b) <= tolerance * max(1, abs(b))
+
+
+class DailyStatsTester:
+    def __init__(self, suite, admin_id, prune_after_months):
+        self.suite = suite
+        self.admin_id = admin_id
+        self.prune_after_months = prune_after_months
+        self.model = f"stats-test-{uuid.uuid4().hex[:8]}"
+        self.today = datetime.now(timezone.utc).replace(hour=0, minute=0, second=0, microsecond=0)
+        # Entirely older than 48 hours, so rolled up
+        self.days = [self.today - timedelta(days=d) for d in (3, 4, 6)]
+
+    def run(self):
+        self.users = {plan: self.suite.create_user(plan=plan, credits=100) for plan in ("free", "pro")}
+        try:
+            self._seed()
+            if self._roll_up():
+                self.check_rollups()
+                self.check_active_users()
+                self.check_admin_stats()
+                if self.prune_after_months > 0:
+                    self.check_pruning()
+        finally:
+            with self.suite.db.cursor() as cur:
+                for user_id in self.users.values():
+                    cur.execute("DELETE FROM generated_content WHERE user_id = %s", (user_id,))
+                    cur.execute("DELETE FROM daily_active_users WHERE user_id = %s", (user_id,))
+                    cur.execute("DELETE FROM users WHERE id = %s", (user_id,))
+                cur.execute("DELETE FROM daily_generation_stats WHERE model = %s", (self.model,))
+
+    def _insert(self, user_id, created_at, status, seconds, credits, gpu, prompt="daily stats"):
+        self.suite.insert_generation(user_id, status=status, created_at=created_at, model=self.model, prompt=prompt,
+                                     completed_at=created_at + timedelta(seconds=seconds or 0),
+                                     generation_time_seconds=seconds, credits_charged=credits, gpu_seconds=gpu)
+
+    def _seed(self):
+        n = 0
+        for d, day in enumerate(self.days):
+            for plan, user_id in self.users.items():
+                # A different volume per day and plan, so the busiest day is unambiguous
+                for i in range(4 + 3 * d + (2 if plan == "pro" else 0)):
+                    status = STATUSES[n % len(STATUSES)]
+                    seconds = 0.5 + 7.3 * (n % 13) if status == "completed" else None
+                    if status == "completed" and n % 11 == 0:
+                        seconds = None  # completed without a reported time
+                    self._insert(user_id, day + timedelta(hours=1 + i % 22, minutes=n % 60), status,
+                                 seconds, 1 + n % 3, 2.5 * (n % 5))
+                    n += 1
+        # Raw-only: today
+        for i in range(5):
+            self._insert(self.users["pro"], datetime.now(timezone.utc) - timedelta(minutes=5 + i),
+                         "completed", 3.0 + i, 2, 1.0)
+        if self.prune_after_months > 0:
+            old = self.today - timedelta(days=31 * (self.prune_after_months + 1))
+            self._insert(self.users["free"], old + timedelta(hours=2), "completed", 4.0, 3, 1.0,
+                         prompt="ancient prompt")
+
+    def _admin(self, method, path, **kwargs):
+        return self.suite.api(method, path, self.admin_id, **kwargs)
+
+    def _roll_up(self):
+        resp = self._admin("POST", "/admin/backfills/daily_stats/start", json={"restart": True, "concurrency": 4})
+        if resp.status_code != 202:
+            self.suite.failures.append(f"start daily_stats: status {resp.status_code} {resp.text}")
+            return False
+        deadline = time.time() + 300
+        while time.time() < deadline:
+            run = self._admin("GET", "/admin/backfills/daily_stats").json().get("backfill", {})
+            if run.get("status") == "completed":
+                self.suite.expect(run.get("errors") == 0, f"daily_stats finished with {run.get('errors')} errors")
+                return True
+            time.sleep(1)
+        self.suite.failures.append("daily_stats didn't complete within 5 minutes")
+        return False
+
+    def _raw_p95(self, where, args):
+        with self.suite.db.cursor() as cur:
+            cur.execute(f"""
+                SELECT percentile_cont(0.95) WITHIN GROUP (ORDER BY generation_time_seconds)
+                FROM generated_content WHERE status = 'completed' AND generation_time_seconds IS NOT NULL
+                  AND {where}""", args)
+            return cur.fetchone()[0]
+
+    def _within_bucket(self, estimate, exact, what):
+        if exact is None:
+            self.suite.expect(estimate == 0, f"{what}: p95 {estimate} without timed rows")
+            return
+        lower, upper = buckets_around(exact)
+        self.suite.expect(lower - 1e-9 <= estimate <= upper + 1e-9,
+                          f"{what}: p95 {estimate}, want within [{lower}, {upper}] around {exact}")
+
+    def check_rollups(self):
+        for day in self.days:
+            key = day.strftime("%Y-%m-%d")
+            for plan, user_id in self.users.items():
+                with self.suite.db.cursor() as cur:
+                    cur.execute("""
+                        SELECT total, status_counts, credits_charged, gpu_seconds, timed_count,
+                               generation_seconds_sum, generation_seconds_buckets
+                        FROM daily_generation_stats WHERE day = %s AND model = %s AND plan = %s""",
+                                (key, self.model, plan))
+                    rolled = cur.fetchall()
+                    cur.execute("""
+                        SELECT count(*), coalesce(sum(credits_charged), 0), coalesce(sum(gpu_seconds), 0),
+                               count(generation_time_seconds) FILTER (WHERE status = 'completed'),
+                               coalesce(sum(generation_time_seconds) FILTER (WHERE status = 'completed'), 0)
+                        FROM generated_content
+                        WHERE user_id = %s AND created_at >= %s AND created_at < %s""",
+                                (user_id, day, day + timedelta(days=1)))
+                    total, credits, gpu, timed, seconds = cur.fetchone()
+                    cur.execute("""
+                        SELECT status, count(*) FROM generated_content
+                        WHERE user_id = %s AND created_at >= %s AND created_at < %s GROUP BY status""",
+                                (user_id, day, day + timedelta(days=1)))
+                    statuses = dict(cur.fetchall())
+                what = f"{key} {plan}"
+                if len(rolled) != 1:
+                    self.suite.failures.append(f"{what}: {len(rolled)} rollup rows, want 1")
+                    continue
+                r_total, r_statuses, r_credits, r_gpu, r_timed, r_seconds, r_buckets = rolled[0]
+                self.suite.expect(r_total == total, f"{what}: total {r_total}, want {total}")
+                self.suite.expect(r_statuses == statuses, f"{what}: status counts {r_statuses}, want {statuses}")
+                self.suite.expect(r_credits == credits, f"{what}: credits {r_credits}, want {credits}")
+                self.suite.expect(near(r_gpu, float(gpu)), f"{what}: GPU seconds {r_gpu}, want {gpu}")
+                self.suite.expect(r_timed == timed, f"{what}: timed {r_timed}, want {timed}")
+                self.suite.expect(near(r_seconds, float(seconds)), f"{what}: generation seconds {r_seconds}, want {seconds}")
+                self.suite.expect(len(r_buckets) == len(BOUNDS) + 1 and sum(r_buckets) == timed,
+                                  f"{what}: buckets {r_buckets} don't add up to {timed}")
+                self._within_bucket(self._bucket_p95(r_buckets),
+                                    self._raw_p95("user_id = %s AND created_at >= %s AND created_at < %s",
+                                                  (user_id, day, day + timedelta(days=1))), what)
+
+    def _bucket_p95(self, counts):
+        """bucketQuantile's estimate"""
+        total = sum(counts)
+        if total == 0:
+            return 0
+        rank, seen = 0.95 * total, 0
+        for i, n in enumerate(counts):
+            if n == 0 or seen + n < rank:
+                seen += n
+                continue
+            lower = BOUNDS[i - 1] if i > 0 else 0
+            if i >= len(BOUNDS):
+                return lower
+            return lower + (BOUNDS[i] - lower) * (rank - seen) / n
+        return BOUNDS[-1]
+
+    def check_active_users(self):
+        with self.suite.db.cursor() as cur:
+            cur.execute("""
+                SELECT to_char(day, 'YYYY-MM-DD'), user_id::text FROM daily_active_users
+                WHERE user_id::text = ANY(%s)""", (list(self.users.values()),))
+            got = set(cur.fetchall())
+        want = {(d.strftime("%Y-%m-%d"), u) for d in self.days for u in self.users.values()}
+        self.suite.expect(got == want, f"daily_active_users lists {sorted(got)}, want {sorted(want)}")
+
+    def check_admin_stats(self):
+        since = self.today - timedelta(days=WINDOW_DAYS - 1)
+        where = "tenant_id = 'default' AND created_at >= %s AND user_id::text <> %s"
+        args = (since, CANARY_USER_ID)
+        with self.suite.db.cursor() as cur:
+            cur.execute(f"""
+                SELECT count(*), count(*) FILTER (WHERE status = 'completed'),
+                       count(*) FILTER (WHERE status IN ('completed', 'failed')),
+                       coalesce(avg(generation_time_seconds) FILTER (WHERE status = 'completed'), 0),
+                       coalesce(sum(credits_charged), 0), count(DISTINCT user_id)
+                FROM generated_content WHERE {where}""", args)
+            total, completed, finished, avg, credits, active = cur.fetchone()
+            cur.execute(f"""
+                SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*),
+                       count(*) FILTER (WHERE status = 'completed'), count(*) FILTER (WHERE status = 'failed'),
+                       coalesce(avg(generation_time_seconds) FILTER (WHERE status = 'completed'), 0)
+                FROM generated_content WHERE {where} GROUP BY day""", args)
+            daily = {row[0]: row[1:] for row in cur.fetchall()}
+        busiest = max(sorted(daily, reverse=True), key=lambda d: daily[d][0]) if daily else None
+
+        self.suite.redis_client.delete("stats:admin")
+        resp = self._admin("GET", "/admin/stats")
+        if resp.status_code != 200:
+            self.suite.failures.append(f"GET /admin/stats: status {resp.status_code} {resp.text}")
+            return
+        stats = resp.json()
+        self.suite.expect(stats.get("total_generations") == total,
+                          f"/admin/stats total {stats.get('total_generations')}, want {total}")
+        want_rate = completed / finished if finished else 0
+        self.suite.expect(near(stats.get("success_rate", -1), want_rate),
+                          f"/admin/stats success rate {stats.get('success_rate')}, want {want_rate}")
+        self.suite.expect(near(stats.get("avg_generation_seconds", -1), float(avg)),
+                          f"/admin/stats average {stats.get('avg_generation_seconds')}, want {avg}")
+        self.suite.expect(stats.get("credits_spent") == credits,
+                          f"/admin/stats credits {stats.get('credits_spent')}, want {credits}")
+        self.suite.expect(stats.get("active_users") == active,
+                          f"/admin/stats active users {stats.get('active_users')}, want {active}")
+        self.suite.expect(stats.get("busiest_day") == busiest,
+                          f"/admin/stats busiest day {stats.get('busiest_day')}, want {busiest}")
+        self._within_bucket(stats.get("p95_generation_seconds", -1), self._raw_p95(where, args), "/admin/stats")
+
+        series = stats.get("daily") or []
+        self.suite.expect(len(series) == WINDOW_DAYS, f"/admin/stats has {len(series)} days, want {WINDOW_DAYS}")
+        for point in series:
+            want = daily.get(point.get("day"), (0, 0, 0, 0))
+            got = (point.get("total"), point.get("completed"), point.get("failed"))
+            self.suite.expect(got == tuple(want[:3]), f"/admin/stats {point.get('day')}: {got}, want {tuple(want[:3])}")
+            self.suite.expect(near(point.get("avg_generation_seconds", -1), float(want[3])),
+                              f"/admin/stats {point.get('day')}: average {point.get('avg_generation_seconds')}, want {want[3]}")
+
+    def check_pruning(self):
+        with self.suite.db.cursor() as cur:
+            cur.execute("""
+                SELECT prompt, original_prompt, pruned_at IS NOT NULL, status, credits_charged
+                FROM generated_content WHERE user_id = %s AND original_prompt IN ('ancient prompt', '')
+                  AND created_at < now() - make_interval(months => %s)""",
+                        (self.users["free"], self.prune_after_months))
+            old = cur.fetchall()
+            cur.execute("""
+                SELECT count(*) FROM generated_content
+                WHERE user_id = ANY(%s::uuid[]) AND created_at > now() - interval '30 days'
+                  AND (pruned_at IS NOT NULL OR prompt = '')""", (list(self.users.values()),))
+            recent_pruned = cur.fetchone()[0]
+        self.suite.expect(old == [("", "", True, "completed", 3)], f"the old row is {old}, want pruned with its metadata")
+        self.suite.expect(recent_pruned == 0, f"{recent_pruned} recent rows were pruned")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            admin_id, prune_after_months = suite.create_user(), 12
+            suite.backend = Backend({
+                "ADMIN_USER_IDS": admin_id,
+                "BACKFILL_POLL_INTERVAL": "1s",
+                "RAW_PRUNE_AFTER_MONTHS": str(prune_after_months),
+            })
+            suite.backend.start()
+        else:
+            admin_id = os.environ["STATS_ADMIN_ID"]
+            prune_after_months = int(os.getenv("PRUNE_AFTER_MONTHS", "0"))
+        DailyStatsTester(suite, admin_id, prune_after_months).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("rollups match the raw rows")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,208 @@
+#!/usr/bin/env python3
+"""
+Fault-injection test for the completion retries in db_retry.go.
+
+The backend's database connections go through a TCP proxy this script runs, which it cuts
+to simulate a failover. Start the script first, then the backend pointed at the proxy:
+
+    DATABASE_URL="postgres://localhost:6543/mobart?sslmode=disable" \\
+        COMPLETION_RETRY_MAX_BACKOFF=5s ./mobart
+
+(needs `pip install psycopg2-binary`; it talks to Postgres directly through DATABASE_URL).
+Once the backend is up, the script inserts queued rows and publishes their completions in
+three waves: before the outage, while the proxy has dropped every connection and refuses
+new ones, and after it is restored. Then it checks that:
+
+- every row ends up completed, including the ones completed during the outage
+- none of them was dead-lettered
+- the retry buffer has drained
+"""
+
+import json
+import os
+import socket
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+PROXY_PORT = int(os.getenv("FAILOVER_PROXY_PORT", "6543"))
+UPSTREAM = (os.getenv("FAILOVER_PG_HOST", "localhost"), int(os.getenv("FAILOVER_PG_PORT", "5432")))
+OUTAGE_SECONDS = int(os.getenv("FAILOVER_OUTAGE_SECONDS", "30"))
+PER_WAVE = 5
+
+
+class FlakyProxy:
+    """Forwards TCP to Postgres; cut() drops every open connection and refuses new ones."""
+
+    def __init__(self, port, upstream):
+        self.upstream = upstream
+        self.up = True
+        self.conns = []
+        self.lock = threading.Lock()
+        self.listener = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        self.listener.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        self.listener.bind(("127.0.0.1", port))
+        self.listener.listen(64)
+        threading.Thread(target=self._accept, daemon=True).start()
+
+    def _accept(self):
+        while True:
+            client, _ = self.listener.accept()
+            if not self.up:
+                client.close()  # the backend sees the connection reset at once
+                continue
+            try:
+                server = socket.create_connection(self.upstream)
+            except OSError:
+                client.close()
+                continue
+            with self.lock:
+                self.conns += [client, server]
+            for a, b in ((client, server), (server, client)):
+                threading.Thread(target=self._pipe, args=(a, b), daemon=True).start()
+
+    def _pipe(self, src, dst):
+        try:
+            while True:
+                data = src.recv(65536)
+                if not data:
+                    break
+                dst.sendall(data)
+        except OSError:
+            pass
+        finally:
+            for s in (src, dst):
+                try:
+                    s.close()
+                except OSError:
+                    pass
+
+    def cut(self):
+        self.up = False
+        with self.lock:
+            conns, self.conns = self.conns, []
+        for s in conns:
+            try:
+                s.shutdown(socket.SHUT_RDWR)
+                s.close()
+            except OSError:
+                pass
+
+    def restore(self):
+        self.up = True
+
+
+class FailoverTester:
+    def __init__(self):
+        self.proxy = FlakyProxy(PROXY_PORT, UPSTREAM)
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.failures = []
+
+    def run(self):
+        logger.info(f"🔌 Proxy listening on :{PROXY_PORT}; start the backend against it")
+        if not self._wait_for_backend():
+            logger.error("❌ Backend never came up through the proxy")
+            return False
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (self.user_id,))
+
+        before = self._wave()
+        time.sleep(2)
+
+        logger.info(f"✂️ Cutting database connections for {OUTAGE_SECONDS}s")
+        during = [self._insert() for _ in range(PER_WAVE)]  # rows exist; only the backend loses the DB
+        self.proxy.cut()
+        for request_id in during:
+            self._complete(request_id)
+        time.sleep(OUTAGE_SECONDS)
+        self.proxy.restore()
+        logger.info("🔗 Database connections restored")
+
+        after = self._wave()
+        self._check(before + during + after)
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ no completion was lost to the outage")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _wait_for_backend(self):
+        deadline = time.time() + 120
+        while time.time() < deadline:
+            try:
+                if requests.get(f"{GO_BACKEND_URL}/healthz", timeout=2).status_code == 200:
+                    return True
+            except requests.RequestException:
+                pass
+            time.sleep(1)
+        return False
+
+    def _insert(self):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'failover', 'failover', 'stable-image-ultra', 'queued')""",
+                        (request_id, self.user_id))
+        return request_id
+
+    def _complete(self, request_id):
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+
+    def _wave(self):
+        ids = [self._insert() for _ in range(PER_WAVE)]
+        for request_id in ids:
+            self._complete(request_id)
+        return ids
+
+    def _check(self, request_ids):
+        # The buffer backs off up to COMPLETION_RETRY_MAX_BACKOFF after the restore
+        deadline = time.time() + 60
+        statuses = {}
+        while time.time() < deadline:
+            with self.db.cursor() as cur:
+                cur.execute("SELECT request_id::text, status FROM generated_content WHERE request_id = ANY(%s::uuid[])",
+                            (request_ids,))
+                statuses = dict(cur.fetchall())
+            if all(s == "completed" for s in statuses.values()) and len(statuses) == len(request_ids):
+                break
+            time.sleep(1)
+        for request_id in request_ids:
+            self._expect(statuses.get(request_id) == "completed",
+                         f"request {request_id} ended {statuses.get(request_id)}, not completed")
+
+        with self.db.cursor() as cur:
+            cur.execute("SELECT request_id::text, error_class FROM dead_letters WHERE request_id = ANY(%s)",
+                        (request_ids,))
+            for request_id, error_class in cur.fetchall():
+                self.failures.append(f"request {request_id} was dead-lettered ({error_class})")
+
+        depth = self.redis_client.zcard("completion:retry")
+        self._expect(depth == 0, f"{depth} completions still in the retry buffer")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if FailoverTester().run() else 1)
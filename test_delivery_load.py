@@ -0,0 +1,155 @@
+#!/usr/bin/env python3
+"""
+Load test for the notification delivery worker (deliveries.go), built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_delivery_load.py
+
+It needs to boot the backend itself, with a SECRETS_KEY of its own so it can write
+delivery targets, NOTIFY_ALLOW_PRIVATE_TARGETS so webhooks may reach the local receiver
+and no per-webhook spacing. Needs `pip install psycopg2-binary cryptography`. It queues
+DELIVERY_LOAD_COUNT (3000) webhook deliveries at once, spread over 50 endpoints of a local
+receiver, and checks that:
+
+- they are all delivered at DELIVERY_LOAD_MIN_RATE (300) per second or better, from the
+  moment they were queued to the last one received
+- each event arrives once: no claim ran out while its delivery waited for a free worker
+- every row ends delivered, on its first attempt
+
+Rates on a laptop vary; DELIVERY_LOAD_MIN_RATE can be lowered for a slow machine.
+"""
+
+import os
+import json
+import time
+import uuid
+import base64
+import secrets
+import threading
+import logging
+from collections import Counter
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+
+from integration_fixtures import Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+COUNT = int(os.getenv("DELIVERY_LOAD_COUNT", "3000"))
+MIN_RATE = float(os.getenv("DELIVERY_LOAD_MIN_RATE", "300"))
+ENDPOINTS = 50
+
+
+class Receiver:
+    """A local webhook endpoint counting the event_ids it is sent"""
+
+    def __init__(self):
+        self.received = Counter()
+        self.last_at = None
+        self.lock = threading.Condition()
+        receiver = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                body = json.loads(self.rfile.read(int(self.headers["Content-Length"])))
+                with receiver.lock:
+                    receiver.received[body.get("event_id")] += 1
+                    receiver.last_at = time.time()
+                    receiver.lock.notify_all()
+                self.send_response(204)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        self.server = ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+        self.server.daemon_threads = True
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def url(self, path):
+        return f"http://127.0.0.1:{self.server.server_port}{path}"
+
+    def wait_for(self, count, timeout):
+        with self.lock:
+            return self.lock.wait_for(lambda: len(self.received) >= count, timeout)
+
+    def stop(self):
+        self.server.shutdown()
+
+
+def seal(key, plaintext):
+    """sealString in secrets.go: base64(nonce || AES-GCM ciphertext)"""
+    nonce = secrets.token_bytes(12)
+    return base64.b64encode(nonce + AESGCM(key).encrypt(nonce, plaintext.encode(), None)).decode()
+
+
+class DeliveryLoadTester:
+    def __init__(self, suite, secrets_key, receiver):
+        self.suite = suite
+        self.secrets_key = secrets_key
+        self.receiver = receiver
+
+    def run(self):
+        s = self.suite
+        user_id = s.create_user()
+        run = uuid.uuid4().hex[:8]
+        targets = [seal(self.secrets_key, self.receiver.url(f"/hook/{run}/{i}")) for i in range(ENDPOINTS)]
+
+        queued_at = time.time()
+        with s.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO notification_deliveries (target_type, target_enc, payload, dedupe_key)
+                SELECT 'webhook', (%(targets)s::text[])[1 + i %% %(endpoints)s],
+                       jsonb_build_object('request_id', %(run)s || '-' || i, 'user_id', %(user)s,
+                                          'status', 'completed', 'prompt', 'load test',
+                                          'event_id', %(run)s || '-' || i),
+                       'load:' || %(run)s || ':' || i
+                FROM generate_series(0, %(count)s - 1) i""",
+                        {"targets": targets, "endpoints": ENDPOINTS, "run": run, "user": user_id, "count": COUNT})
+        delivered = self.receiver.wait_for(COUNT, timeout=max(60, 4 * COUNT / MIN_RATE))
+        time.sleep(1)  # for any duplicate still in flight
+
+        with self.receiver.lock:
+            received = dict(self.receiver.received)
+            last_at = self.receiver.last_at
+        ours = {k: v for k, v in received.items() if k and k.startswith(run + "-")}
+        if not s.expect(delivered, f"{len(ours)} of {COUNT} deliveries arrived"):
+            return
+        elapsed = last_at - queued_at
+        rate = COUNT / elapsed
+        logger.info(f"📊 {COUNT} deliveries in {elapsed:.1f}s: {rate:.0f}/s")
+        s.expect(rate >= MIN_RATE, f"{rate:.0f} deliveries/s, want at least {MIN_RATE:.0f}")
+
+        twice = [k for k, v in ours.items() if v > 1]
+        s.expect(not twice, f"{len(twice)} events arrived more than once, e.g. {twice[:3]}")
+        with s.db.cursor() as cur:
+            cur.execute("""
+                SELECT status, attempts, count(*) FROM notification_deliveries
+                WHERE dedupe_key LIKE %s GROUP BY status, attempts""", (f"load:{run}:%",))
+            states = {(status, attempts): n for status, attempts, n in cur.fetchall()}
+        s.expect(states == {("delivered", 0): COUNT}, f"rows by (status, attempts) {states}, want all delivered at 0")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    receiver = Receiver()
+    try:
+        key = secrets.token_bytes(32)
+        suite.setup(boot=True, backend_env={
+            "SECRETS_KEY": base64.b64encode(key).decode(),
+            "NOTIFY_ALLOW_PRIVATE_TARGETS": "true",
+            "NOTIFY_MIN_INTERVAL": "0s",
+        })
+        DeliveryLoadTester(suite, key, receiver).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    receiver.stop()
+    ok = suite.finish(f"the delivery worker sustains {MIN_RATE:.0f} deliveries/s without sending any twice")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
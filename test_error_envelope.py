@@ -0,0 +1,175 @@
+#!/usr/bin/env python3
+"""
+Checks that handler error paths answer with the error envelope (apierrors.go), built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_error_envelope.py --boot
+
+or leave out --boot to use a backend already running at GO_BACKEND_URL, skipping the
+queue_full case, which needs the backend started with MAX_QUEUE_DEPTH. Needs `pip install psycopg2-binary`.
+Each case below provokes one error from a different handler or middleware on /v2. For each
+it checks that:
+
+- the body is {"error": {"code", "message", "request_id"}} with an optional "details", and
+  nothing else
+- the code is the expected one, and the status is the one errorCodeStatus registers for it,
+  read from apierrors.go so the two can't drift
+- request_id is the X-Request-ID the request was sent with, and the response echoes it
+
+No worker is needed.
+"""
+
+import os
+import re
+import sys
+import time
+import uuid
+import logging
+
+import requests
+
+from integration_fixtures import GO_BACKEND_URL, REPO_DIR, Backend, Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+MODEL = os.getenv("DEFAULT_IMAGE_MODEL", "stable-image-ultra")
+QUEUE_HEADROOM = 5  # MAX_QUEUE_DEPTH is set this far above what the database already holds
+ENVELOPE_KEYS = {"code", "message", "request_id"}
+
+
+def registered_statuses():
+    """errorCodeStatus from apierrors.go, as {code: status}"""
+    with open(os.path.join(REPO_DIR, "apierrors.go")) as f:
+        source = f.read()
+    names = dict(re.findall(r'^\s*(code\w+)\s*=\s*"(\w+)"', source, re.M))
+    statuses = {"StatusBadRequest": 400, "StatusUnauthorized": 401, "StatusPaymentRequired": 402,
+                "StatusForbidden": 403, "StatusNotFound": 404, "StatusConflict": 409, "StatusGone": 410,
+                "StatusRequestEntityTooLarge": 413, "StatusUnprocessableEntity": 422,
+                "StatusTooManyRequests": 429, "StatusInternalServerError": 500, "StatusBadGateway": 502,
+                "StatusServiceUnavailable": 503}
+    block = source[source.index("var errorCodeStatus"):]
+    block = block[:block.index("\n}")]
+    return {names[n]: statuses[s] for n, s in re.findall(r"(code\w+):\s*http\.(\w+)", block)}
+
+
+def queue_depth(suite):
+    """queueDepth for the default model"""
+    with suite.db.cursor() as cur:
+        cur.execute("SELECT count(*) FROM generated_content WHERE model = %s AND status IN ('queued', 'processing')",
+                    (MODEL,))
+        return cur.fetchone()[0]
+
+
+class ErrorEnvelopeTester:
+    def __init__(self, suite, queue_limit=None):
+        self.suite = suite
+        self.queue_limit = queue_limit
+        self.statuses = registered_statuses()
+
+    def _call(self, method, path, user_id=None, **kwargs):
+        request_id = str(uuid.uuid4())
+        headers = {"X-Request-ID": request_id}
+        if user_id is not None:
+            headers["X-User-ID"] = user_id
+        resp = requests.request(method, f"{GO_BACKEND_URL}/v2{path}", headers=headers, timeout=10, **kwargs)
+        return request_id, resp
+
+    def check(self, what, want_code, method, path, user_id=None, **kwargs):
+        s = self.suite
+        request_id, resp = self._call(method, path, user_id, **kwargs)
+        try:
+            body = resp.json()
+        except ValueError:
+            s.failures.append(f"{what}: {resp.status_code} body isn't JSON: {resp.text[:200]!r}")
+            return None
+        envelope = body.get("error") if isinstance(body, dict) else None
+        if not s.expect(isinstance(envelope, dict) and set(body) == {"error"},
+                        f"{what}: body {body!r}, want {{\"error\": {{...}}}}"):
+            return None
+        keys = set(envelope)
+        s.expect(ENVELOPE_KEYS <= keys <= ENVELOPE_KEYS | {"details"},
+                 f"{what}: envelope keys {sorted(keys)}, want {sorted(ENVELOPE_KEYS)} and maybe details")
+        code = envelope.get("code")
+        s.expect(code == want_code, f"{what}: code {code!r}, want {want_code!r}")
+        s.expect(code in self.statuses, f"{what}: code {code!r} isn't in errorCodeStatus")
+        s.expect(resp.status_code == self.statuses.get(code),
+                 f"{what}: status {resp.status_code}, errorCodeStatus has {self.statuses.get(code)} for {code!r}")
+        s.expect(isinstance(envelope.get("message"), str) and envelope["message"],
+                 f"{what}: message {envelope.get('message')!r}")
+        s.expect(envelope.get("request_id") == request_id,
+                 f"{what}: request_id {envelope.get('request_id')!r}, want the X-Request-ID sent, {request_id}")
+        s.expect(resp.headers.get("X-Request-ID") == request_id,
+                 f"{what}: X-Request-ID header {resp.headers.get('X-Request-ID')!r}, want {request_id}")
+        return envelope
+
+    def run(self):
+        s = self.suite
+        user_id, broke_id = s.create_user(credits=100), s.create_user(credits=0)
+        missing = str(uuid.uuid4())
+        image = {"request_type": "image", "text": "an envelope"}
+
+        cases = [
+            ("no credential", "unauthorized", "GET", "/generations", None),
+            ("malformed X-User-ID", "unauthorized", "GET", "/generations", "not-a-uuid"),
+            ("admin route as a user", "admin_required", "GET", "/admin/stats", user_id),
+            ("unknown generation", "not_found", "GET", f"/generations/{missing}", user_id),
+            ("cancel an unknown generation", "conflict", "POST", f"/generations/{missing}/cancel", user_id),
+            ("edited cursor", "invalid_cursor", "GET", "/generations?cursor=AAAA", user_id),
+            ("conversations cursor", "invalid_cursor", "GET", "/conversations?cursor=AAAA", user_id),
+            ("public challenges, bad before", "invalid_request", "GET", "/challenges?before=yesterday", None),
+            ("unknown conversation", "not_found", "GET", f"/conversations/{missing}/messages", user_id),
+            ("unknown template", "not_found", "DELETE", f"/templates/{missing}", user_id),
+            ("unknown comparison", "not_found", "GET", f"/comparisons/{missing}", user_id),
+            ("unknown upload session", "not_found", "GET", f"/uploads/{missing}", user_id),
+            ("events, unknown type", "invalid_request", "GET", "/events?types=nope", user_id),
+        ]
+        for what, code, method, path, who in cases:
+            self.check(what, code, method, path, who)
+
+        self.check("body isn't JSON", "invalid_request", "POST", "/generations", user_id, data="{not json")
+        self.check("org_id isn't a UUID", "validation_failed", "POST", "/generations", user_id,
+                   json={**image, "org_id": "acme"})
+        self.check("org_id of an org the user isn't in", "not_member", "POST", "/generations", user_id,
+                   json={**image, "org_id": missing})
+        self.check("no credits", "insufficient_credits", "POST", "/generations", broke_id, json=image)
+        self.check("body over the limit", "request_too_large", "POST", "/generations", user_id,
+                   data='{"request_type": "image", "text": "' + "x" * (2 << 20) + '"}')
+        self.queue_full(user_id, image)
+
+    def queue_full(self, user_id, image):
+        s = self.suite
+        if self.queue_limit is None:
+            logger.info("⏭️ queue_full needs --boot, to start the backend with MAX_QUEUE_DEPTH")
+            return
+        filler = [s.insert_generation(user_id, "queued", model=MODEL)
+                  for _ in range(max(self.queue_limit - queue_depth(s), 0))]
+        try:
+            envelope = self.check("queue at MAX_QUEUE_DEPTH", "queue_full", "POST", "/generations", user_id, json=image)
+            if envelope is not None:
+                s.expect((envelope.get("details") or {}).get("max_queue_depth") == self.queue_limit,
+                         f"queue_full: details {envelope.get('details')!r}, want max_queue_depth {self.queue_limit}")
+        finally:
+            with s.db.cursor() as cur:
+                cur.execute("UPDATE generated_content SET status = 'failed' WHERE request_id = ANY(%s)", (filler,))
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        queue_limit = None
+        if "--boot" in sys.argv:
+            # Above what is queued already, so only the queue_full case reaches it
+            queue_limit = queue_depth(suite) + QUEUE_HEADROOM
+            suite.backend = Backend({"MAX_QUEUE_DEPTH": str(queue_limit)})
+            suite.backend.start()
+        ErrorEnvelopeTester(suite, queue_limit).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("every error path answers with the envelope and its registered status")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,143 @@
+#!/usr/bin/env python3
+"""
+Replay of the mobile app's gallery polling against the conditional GETs in caching.go.
+
+Run the Go backend with its defaults, then run this script (needs `pip install
+psycopg2-binary`). It seeds a user with completed rows, then replays the same polling
+session twice: once as today's app does (plain GETs) and once sending back the ETag of
+each previous response. It prints the bytes each replay was served and checks that:
+
+- unchanged gallery pages and detail views come back 304 with no body
+- a write to a row (tags, via PATCH) changes both the detail and the gallery ETag
+- downloads carry an immutable Cache-Control
+"""
+
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ROWS = int(os.getenv("ETAG_ROWS", "40"))
+POLLS = int(os.getenv("ETAG_POLLS", "30"))
+DETAILS_PER_POLL = 3
+
+
+class ETagReplay:
+    def __init__(self):
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.request_ids = []
+        self.failures = []
+
+    def run(self):
+        self._seed()
+
+        plain = self._replay(conditional=False)
+        conditional = self._replay(conditional=True)
+        saved = 100.0 * (1 - conditional["bytes"] / plain["bytes"]) if plain["bytes"] else 0.0
+        logger.info(f"📊 plain: {plain['bytes']} bytes in {plain['requests']} requests")
+        logger.info(f"📊 conditional: {conditional['bytes']} bytes in {conditional['requests']} requests, "
+                    f"{conditional['not_modified']} answered 304 ({saved:.1f}% fewer bytes)")
+        self._expect(conditional["not_modified"] > 0, "no request was answered 304")
+
+        self.check_invalidation()
+        self.check_download_headers()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ conditional GETs behave")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _headers(self, etag=None):
+        headers = {"X-User-ID": self.user_id}
+        if etag:
+            headers["If-None-Match"] = etag
+        return headers
+
+    def _seed(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 0)", (self.user_id,))
+            for i in range(ROWS):
+                request_id = str(uuid.uuid4())
+                cur.execute("""
+                    INSERT INTO generated_content
+                        (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt,
+                         model, status, completed_at)
+                    VALUES (%s, %s, now() - %s * interval '1 minute', 'image', %s, 'etag replay',
+                            'etag replay', 'stable-image-ultra', 'completed', now())""",
+                            (request_id, self.user_id, i, f"generated/{request_id}.png"))
+                self.request_ids.append(request_id)
+
+    def _replay(self, conditional):
+        """One polling session: the first gallery page plus a few detail views per poll"""
+        stats = {"bytes": 0, "requests": 0, "not_modified": 0}
+        etags = {}
+
+        def fetch(url):
+            etag = etags.get(url) if conditional else None
+            r = requests.get(url, headers=self._headers(etag))
+            stats["requests"] += 1
+            stats["bytes"] += len(r.content)
+            if r.status_code == 304:
+                stats["not_modified"] += 1
+            elif r.status_code == 200:
+                etags[url] = r.headers.get("ETag")
+            else:
+                self._expect(False, f"GET {url}: {r.status_code} {r.text}")
+
+        for poll in range(POLLS):
+            fetch(f"{GO_BACKEND_URL}/generations?limit=20")
+            for i in range(DETAILS_PER_POLL):
+                fetch(f"{GO_BACKEND_URL}/generations/{self.request_ids[(poll + i) % len(self.request_ids)]}")
+        return stats
+
+    def _get(self, path, etag=None):
+        return requests.get(f"{GO_BACKEND_URL}{path}", headers=self._headers(etag))
+
+    def check_invalidation(self):
+        request_id = self.request_ids[0]
+        detail = self._get(f"/generations/{request_id}")
+        gallery = self._get("/generations?limit=20")
+        self._expect(self._get(f"/generations/{request_id}", detail.headers.get("ETag")).status_code == 304,
+                     "unchanged detail was not 304")
+        self._expect(self._get("/generations?limit=20", gallery.headers.get("ETag")).status_code == 304,
+                     "unchanged gallery was not 304")
+
+        time.sleep(0.01)  # updated_at has microsecond resolution; make the write land later
+        r = requests.patch(f"{GO_BACKEND_URL}/generations/{request_id}/tags", headers=self._headers(),
+                           json={"add": ["etag-replay"]})
+        self._expect(r.status_code == 200, f"PATCH tags: {r.status_code} {r.text}")
+
+        after = self._get(f"/generations/{request_id}", detail.headers.get("ETag"))
+        self._expect(after.status_code == 200, f"detail after a write was {after.status_code}, not 200")
+        after = self._get("/generations?limit=20", gallery.headers.get("ETag"))
+        self._expect(after.status_code == 200, f"gallery after a write was {after.status_code}, not 200")
+
+    def check_download_headers(self):
+        # The seeded keys have no objects behind them, so only a 304 can be checked without S3
+        r = self._get(f"/generations/{self.request_ids[0]}/download?format=original")
+        etag = r.headers.get("ETag")
+        if r.status_code != 200 or not etag:
+            logger.info(f"ℹ️ download returned {r.status_code}; skipping the asset header checks")
+            return
+        self._expect("immutable" in r.headers.get("Cache-Control", ""), "download is not Cache-Control immutable")
+        again = self._get(f"/generations/{self.request_ids[0]}/download?format=original", etag)
+        self._expect(again.status_code == 304, f"repeated download was {again.status_code}, not 304")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if ETagReplay().run() else 1)
@@ -0,0 +1,133 @@
+#!/usr/bin/env python3
+"""
+Checks the dual read of the renamed completion fields (field_renames.go).
+
+Run the Go backend with
+
+    ADMIN_USER_IDS=<CONTRACTS_ADMIN_ID> ./mobart
+
+then run this script (needs `pip install psycopg2-binary`). Processing rows are inserted
+directly and completed the way a worker would, once per naming: only s3_key/s3_url, only
+object_key/object_url (renditions too), and both with different values. It checks that:
+
+- every naming stores the object key, and with both the new name wins
+- renditions sent under object_key are stored like those under s3_key
+- GET /admin/contracts/compatibility counts the messages, and only the old-names one as
+  legacy, per old field name
+- an out-of-range window is refused
+"""
+
+import json
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ADMIN_ID = os.getenv("CONTRACTS_ADMIN_ID", "")
+
+
+class FieldRenameTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.failures = []
+
+    def run(self):
+        if not ADMIN_ID:
+            logger.error("❌ Set CONTRACTS_ADMIN_ID to a user listed in the backend's ADMIN_USER_IDS")
+            return False
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (self.user_id,))
+
+        before = self._report()
+        self.namings()
+        self.report(before)
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ old and new completion field names both read, and legacy use is reported")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _report(self, window="2h"):
+        resp = requests.get(f"{GO_BACKEND_URL}/admin/contracts/compatibility", params={"window": window},
+                            headers={"X-User-ID": ADMIN_ID})
+        self._expect(resp.status_code == 200, f"compatibility report: status {resp.status_code}")
+        return resp.json() if resp.status_code == 200 else {}
+
+    def _insert(self):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'rename', 'rename', 'stable-image-ultra', 'processing')""",
+                        (request_id, self.user_id))
+        return request_id
+
+    def _complete(self, request_id, fields):
+        message = {
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "generation_time_seconds": 1.0, "worker_id": "rename-test",
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }
+        message.update(fields)
+        self.redis_client.publish("image_generation_complete", json.dumps(message))
+
+    def _stored(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT content_url FROM generated_content WHERE request_id = %s", (request_id,))
+            content_url = cur.fetchone()[0]
+            cur.execute("SELECT kind, s3_key FROM generation_renditions WHERE request_id = %s", (request_id,))
+            return content_url, dict(cur.fetchall())
+
+    def namings(self):
+        old, new, both = self._insert(), self._insert(), self._insert()
+        self._complete(old, {"s3_key": f"generated/{old}.png", "s3_url": f"https://cdn.example.com/{old}.png"})
+        self._complete(new, {
+            "object_key": f"generated/{new}.png", "object_url": f"https://cdn.example.com/{new}.png",
+            "renditions": [{"kind": "original", "object_key": f"generated/{new}.png"},
+                           {"kind": "thumbnail", "object_key": f"thumbs/{new}.webp", "width": 256, "height": 256}],
+        })
+        self._complete(both, {"s3_key": f"stale/{both}.png", "object_key": f"generated/{both}.png"})
+        time.sleep(3)
+
+        for name, request_id in (("old names", old), ("new names", new), ("both names", both)):
+            content_url, _ = self._stored(request_id)
+            self._expect(content_url == f"generated/{request_id}.png", f"{name}: content_url {content_url!r}")
+        _, renditions = self._stored(new)
+        self._expect(renditions.get("thumbnail") == f"thumbs/{new}.webp", f"renditions under object_key: {renditions}")
+
+    def report(self, before):
+        after = self._report()
+        self._expect(after.get("messages", 0) - before.get("messages", 0) == 3,
+                     f"report counted {after.get('messages', 0) - before.get('messages', 0)} messages, want 3")
+        self._expect(after.get("legacy_messages", 0) - before.get("legacy_messages", 0) == 1,
+                     f"report counted {after.get('legacy_messages', 0) - before.get('legacy_messages', 0)} legacy, want 1")
+        for field in ("s3_key", "s3_url"):
+            grew = after.get("legacy_fields", {}).get(field, 0) - before.get("legacy_fields", {}).get(field, 0)
+            self._expect(grew == 1, f"report counted {grew} uses of {field}, want 1")
+        self._expect(0 < after.get("legacy_percent", 0) <= 100, f"legacy_percent {after.get('legacy_percent')}")
+
+        resp = requests.get(f"{GO_BACKEND_URL}/admin/contracts/compatibility", params={"window": "30d"},
+                            headers={"X-User-ID": ADMIN_ID})
+        self._expect(resp.status_code == 400, f"window over 7d: status {resp.status_code}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if FieldRenameTester().run() else 1)
@@ -0,0 +1,175 @@
+#!/usr/bin/env python3
+"""
+Deterministic checks of the versioned status writes in generation_state.go.
+
+Run the Go backend with its defaults, then run this script (needs `pip install
+psycopg2-binary`). Rows are inserted directly in their starting state. For the races, the
+script holds the row lock, waits until the backend's versioned UPDATE is blocked on it
+(pg_stat_activity), commits the competing write, and checks the backend re-reads and
+backs off instead of overwriting:
+
+- a completion arriving after a cancel leaves the request cancelled
+- a cancel landing while a completion is mid-write leaves the request cancelled
+- a cancel blocked while the request completes is refused, and the request stays completed
+
+Each conflict must also show in mobart_generation_write_conflicts_total.
+"""
+
+import json
+import os
+import re
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+METRICS_URL = os.getenv("METRICS_URL", "http://localhost:9090/metrics")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+
+
+class RaceTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.failures = []
+
+    def run(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (self.user_id,))
+
+        self.cancel_then_complete()
+        self.cancel_during_completion()
+        self.completion_during_cancel()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ no write overwrote a terminal state")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _insert(self, status):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'race', 'race', 'stable-image-ultra', %s)""",
+                        (request_id, self.user_id, status))
+        return request_id
+
+    def _status(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT status FROM generated_content WHERE request_id = %s", (request_id,))
+            return cur.fetchone()[0]
+
+    def _conflicts(self, writer, intended, actual):
+        text = requests.get(METRICS_URL).text
+        pattern = (r'mobart_generation_write_conflicts_total\{actual="%s",intended="%s",writer="%s"\} (\S+)'
+                   % (actual, intended, writer))
+        m = re.search(pattern, text)
+        return float(m.group(1)) if m else 0.0
+
+    def _complete(self, request_id):
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+
+    def _cancel(self, request_id):
+        return requests.post(f"{GO_BACKEND_URL}/generations/{request_id}/cancel",
+                             headers={"X-User-ID": self.user_id})
+
+    def _wait_settled(self, request_id, seconds=3):
+        """Gives the listener time to apply (or refuse) a completion"""
+        time.sleep(seconds)
+        return self._status(request_id)
+
+    def _blocked_on(self, locker, request_id):
+        """Waits until another backend's UPDATE of the row queues behind locker's lock"""
+        with locker.cursor() as cur:
+            cur.execute("SELECT pg_backend_pid()")
+            pid = cur.fetchone()[0]
+        deadline = time.time() + 10
+        while time.time() < deadline:
+            with self.db.cursor() as cur:
+                cur.execute("""
+                    SELECT count(*) FROM pg_stat_activity
+                    WHERE %s = ANY(pg_blocking_pids(pid)) AND query ILIKE '%%UPDATE generated_content%%'""", (pid,))
+                if cur.fetchone()[0] > 0:
+                    return True
+            time.sleep(0.05)
+        return False
+
+    def cancel_then_complete(self):
+        request_id = self._insert("deferred")
+        before = self._conflicts("listener", "completed", "cancelled")
+        resp = self._cancel(request_id)
+        self._expect(resp.status_code == 200, f"cancel: status {resp.status_code}")
+        self._complete(request_id)
+        status = self._wait_settled(request_id)
+        self._expect(status == "cancelled", f"cancel then complete: request is {status}")
+        self._expect(self._conflicts("listener", "completed", "cancelled") == before + 1,
+                     "cancel then complete: conflict not counted")
+
+    def cancel_during_completion(self):
+        request_id = self._insert("queued")
+        before = self._conflicts("listener", "completed", "cancelled")
+        locker = psycopg2.connect(DATABASE_URL)
+        with locker.cursor() as cur:
+            cur.execute("SELECT 1 FROM generated_content WHERE request_id = %s FOR UPDATE", (request_id,))
+            self._complete(request_id)
+            if not self._blocked_on(locker, request_id):
+                self._expect(False, "cancel during completion: the completion never reached its UPDATE")
+            # Whatever cancels it lands first; the completion read the old version
+            cur.execute("UPDATE generated_content SET status = 'cancelled', completed_at = now() WHERE request_id = %s",
+                        (request_id,))
+        locker.commit()
+        locker.close()
+        status = self._wait_settled(request_id)
+        self._expect(status == "cancelled", f"cancel during completion: request is {status}")
+        self._expect(self._conflicts("listener", "completed", "cancelled") == before + 1,
+                     "cancel during completion: conflict not counted")
+
+    def completion_during_cancel(self):
+        request_id = self._insert("deferred")
+        before = self._conflicts("cancel", "cancelled", "completed")
+        result = {}
+        locker = psycopg2.connect(DATABASE_URL)
+        with locker.cursor() as cur:
+            cur.execute("SELECT 1 FROM generated_content WHERE request_id = %s FOR UPDATE", (request_id,))
+            thread = threading.Thread(target=lambda: result.setdefault("resp", self._cancel(request_id)))
+            thread.start()
+            if not self._blocked_on(locker, request_id):
+                self._expect(False, "completion during cancel: the cancel never reached its UPDATE")
+            # The scheduler published it and the worker finished before the cancel's write
+            cur.execute("UPDATE generated_content SET status = 'completed', completed_at = now() WHERE request_id = %s",
+                        (request_id,))
+        locker.commit()
+        locker.close()
+        thread.join(10)
+        resp = result.get("resp")
+        self._expect(resp is not None and resp.status_code == 409,
+                     f"completion during cancel: cancel returned {resp.status_code if resp is not None else None}")
+        status = self._status(request_id)
+        self._expect(status == "completed", f"completion during cancel: request is {status}")
+        self._expect(self._conflicts("cancel", "cancelled", "completed") == before + 1,
+                     "completion during cancel: conflict not counted")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if RaceTester().run() else 1)
@@ -0,0 +1,182 @@
+#!/usr/bin/env python3
+"""
+Behavior check for the generation kind registry (kinds.go) against a running backend.
+
+Run the Go backend with its defaults, then run this script (needs `pip install
+psycopg2-binary`). For every kind it checks what POST /generations did before the registry:
+
+- unknown request_type values, typos and differently cased ones included, are a 422
+  listing the supported kinds and counted in mobart_unknown_request_types_total
+- an omitted or empty request_type is text, and every supported kind is accepted as itself
+- estimates price image and video with the default costs, and refuse text
+- image and video requests are published on their own channels with their defaults
+- a video completion stores its poster frame, an image completion its renditions
+
+The throwaway user is inserted with just id, plan and credits, like test_chaos.py.
+"""
+
+import json
+import os
+import re
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+METRICS_URL = os.getenv("METRICS_URL", "http://localhost:9090/metrics")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+CHANNELS = {"image": "image_generation_requests", "video": "video_generation_requests"}
+
+
+class KindTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.published = {}  # request_id -> (channel, request)
+        self.failures = []
+
+    def run(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 1000)", (self.user_id,))
+
+        threading.Thread(target=self._listen, daemon=True).start()
+        time.sleep(1)  # let the subscription settle
+
+        self._check_unknown_type()
+        self._check_default_type()
+        self._check_each_type()
+        self._check_estimates()
+        image_id = self._check_queued("image", {"steps": 30}, {"steps": 30, "num_images": 1})
+        video_id = self._check_queued("video", {}, {"duration_seconds": 2, "fps": 8})
+        if image_id:
+            self._check_completion(image_id, {"renditions": [{"kind": "web", "s3_key": f"generated/{image_id}_web.webp"}]},
+                                   "SELECT count(*) FROM generation_renditions WHERE request_id = %s", 1)
+        if video_id:
+            self._check_completion(video_id, {"poster_key": f"generated/{video_id}_poster.png"},
+                                   "SELECT poster_key FROM generated_content WHERE request_id = %s",
+                                   f"generated/{video_id}_poster.png")
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ every kind behaves as before the registry")
+        return not self.failures
+
+    def _headers(self):
+        return {"X-User-ID": self.user_id}
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _listen(self):
+        pubsub = self.redis_client.pubsub()
+        pubsub.subscribe(*CHANNELS.values())
+        for message in pubsub.listen():
+            if message["type"] == "message":
+                request = json.loads(message["data"])
+                self.published[request["request_id"]] = (message["channel"], request)
+
+    def _unknown_types_counted(self):
+        text = requests.get(METRICS_URL).text
+        m = re.search(r'mobart_unknown_request_types_total\{route="/generations"\} (\S+)', text)
+        return float(m.group(1)) if m else 0.0
+
+    def _check_unknown_type(self):
+        for request_type in ["audio", "imgae", "Image", " video"]:
+            before = self._unknown_types_counted()
+            # On /v2, whose errors carry their details
+            resp = requests.post(f"{GO_BACKEND_URL}/v2/generations", headers=self._headers(),
+                                 json={"text": "a song about rain", "request_type": request_type})
+            body = resp.json()
+            self._expect(resp.status_code == 422, f"type {request_type!r}: status {resp.status_code}")
+            details = (body.get("error") or {}).get("details") or {}
+            self._expect(details.get("field") == "request_type", f"type {request_type!r}: details {details}")
+            supported = details.get("supported", [])
+            self._expect(supported == ["image", "text", "video"], f"type {request_type!r}: supported {supported}")
+            counted = self._unknown_types_counted() - before
+            self._expect(counted == 1, f"type {request_type!r}: counted {counted} unknown types")
+            with self.db.cursor() as cur:
+                cur.execute("SELECT count(*) FROM generated_content WHERE user_id = %s", (self.user_id,))
+                stored = cur.fetchone()[0]
+            self._expect(stored == 0, f"type {request_type!r}: {stored} generations stored")
+
+    def _check_default_type(self):
+        for name, body in [("omitted", {}), ("empty", {"request_type": ""})]:
+            resp = requests.post(f"{GO_BACKEND_URL}/generations", headers=self._headers(),
+                                 json={"text": "hello there", **body})
+            got = resp.json()
+            self._expect(resp.status_code == 200 and got.get("type") == "text",
+                         f"{name} type: {resp.status_code} {got}")
+
+    def _check_each_type(self):
+        # Queued kinds are checked in full by _check_queued
+        resp = requests.post(f"{GO_BACKEND_URL}/generations", headers=self._headers(),
+                             json={"text": "hello again", "request_type": "text"})
+        got = resp.json()
+        self._expect(resp.status_code == 200 and got.get("type") == "text", f"text: {resp.status_code} {got}")
+
+    def _check_estimates(self):
+        for request_type, extra, credits in [("image", {}, 1), ("image", {"resolution": 2048, "steps": 60}, 8),
+                                             ("video", {}, 20), ("video", {"duration_seconds": 4}, 40)]:
+            resp = requests.post(f"{GO_BACKEND_URL}/generations/estimate", headers=self._headers(),
+                                 json={"text": "a lighthouse", "request_type": request_type, **extra})
+            quote = resp.json().get("quote", {})
+            self._expect(resp.status_code == 200 and quote.get("credits") == credits,
+                         f"estimate {request_type} {extra}: {resp.status_code} {quote}")
+        resp = requests.post(f"{GO_BACKEND_URL}/generations/estimate", headers=self._headers(),
+                             json={"text": "hello", "request_type": "text"})
+        self._expect(resp.status_code == 422, f"text estimate: status {resp.status_code}")
+
+    def _check_queued(self, request_type, extra, defaults):
+        resp = requests.post(f"{GO_BACKEND_URL}/generations", headers=self._headers(),
+                             json={"text": "a lighthouse at dusk", "request_type": request_type, **extra})
+        body = resp.json()
+        if resp.status_code != 202:
+            self._expect(False, f"{request_type}: status {resp.status_code} {body}")
+            return None
+        request_id = body["generation_request_id"]
+        self._expect(body.get("type") == request_type and body.get("status") == "queued",
+                     f"{request_type}: response {body}")
+
+        deadline = time.time() + 5
+        while request_id not in self.published and time.time() < deadline:
+            time.sleep(0.1)
+        channel, request = self.published.get(request_id, (None, {}))
+        self._expect(channel == CHANNELS[request_type], f"{request_type}: published on {channel}")
+        for key, value in defaults.items():
+            self._expect(request.get(key) == value, f"{request_type}: {key}={request.get(key)!r}, want {value!r}")
+        return request_id
+
+    def _check_completion(self, request_id, extra, query, want):
+        channel, request = self.published[request_id]
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.5,
+            "worker_id": "kind-tester", "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+            **extra,
+        }))
+        deadline = time.time() + 10
+        got = None
+        while time.time() < deadline:
+            with self.db.cursor() as cur:
+                cur.execute(query, (request_id,))
+                got = cur.fetchone()[0]
+            if got == want:
+                return
+            time.sleep(0.2)
+        self._expect(False, f"{channel} completion: got {got!r}, want {want!r}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if KindTester().run() else 1)
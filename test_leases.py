@@ -0,0 +1,204 @@
+#!/usr/bin/env python3
+"""
+Checks that running jobs stay with a worker that keeps renewing their lease, and only
+lapse once it stops (leases.go), built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_leases.py --boot
+
+which starts the backend with 4s leases, 1s sweeps, an admin and an internal token of its
+own. To use a backend already running at GO_BACKEND_URL instead, start it with e.g.
+
+    ADMIN_USER_IDS=<LEASES_ADMIN_ID> INTERNAL_API_TOKEN=<INTERNAL_API_TOKEN> WORKER_LEASES=true \\
+      WORKER_LEASE_TTL=4s STALE_SWEEP_INTERVAL=1s JOB_CLAIM_SWEEP_INTERVAL=1s ./mobart
+
+and run this script with the same ID, token and LEASE_TTL_SECONDS. Needs
+`pip install psycopg2-binary`. Rows are inserted directly, and the script plays the worker
+on both paths. It checks that:
+
+- a Redis job whose worker lists it in heartbeats is still processing well past the TTL,
+  and GET /admin/queue shows its live lease
+- once the heartbeats stop, the job fails as lost, and a late heartbeat gets an abandon
+  on worker_control
+- an HTTP claim kept alive by POST /internal/jobs/:id/heartbeat outlasts the TTL, goes back
+  to the queue once the heartbeats stop, and a late heartbeat then gets a 409
+- once the same worker claims it again, a result carrying the first claim's lease_token
+  is refused and the job stays processing
+
+No real worker should be subscribed for the test model.
+"""
+
+import os
+import sys
+import json
+import time
+import secrets
+import logging
+
+import requests
+
+from integration_fixtures import COMPLETION_CHANNEL, GO_BACKEND_URL, Backend, Suite, utc_timestamp
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+MODEL = os.getenv("LEASES_MODEL", "stable-image-ultra")
+WORKER = "test-leases-worker"
+
+
+class LeaseTester:
+    def __init__(self, suite, admin_id, internal_token, lease_ttl):
+        self.suite = suite
+        self.admin_id = admin_id
+        self.internal_token = internal_token
+        self.lease_ttl = lease_ttl
+
+    def run(self):
+        s = self.suite
+        self.user_id = s.create_user()
+        try:
+            self.check_redis()
+            self.check_http()
+        finally:
+            with s.db.cursor() as cur:
+                cur.execute("DELETE FROM generated_content WHERE user_id = %s", (self.user_id,))
+                cur.execute("DELETE FROM users WHERE id = %s", (self.user_id,))
+
+    def _insert_queued(self, dispatch):
+        return self.suite.insert_generation(self.user_id, status="queued", model=MODEL, prompt="leases",
+                                            dispatch=dispatch)
+
+    def _status(self, request_id):
+        row = self.suite.row(request_id)
+        return row["status"] if row else None
+
+    def _heartbeat(self, request_ids):
+        self.suite.redis_client.publish("worker_heartbeats", json.dumps({
+            "worker_id": WORKER, "model": MODEL, "max_concurrent": 1, "current_load": len(request_ids),
+            "request_ids": request_ids}))
+
+    def _wait_for(self, request_id, status, seconds):
+        row = self.suite.wait_row(request_id, status, seconds)
+        return row is not None and row["status"] == status
+
+    def _lease(self, request_id):
+        resp = self.suite.api("GET", "/admin/queue", self.admin_id)
+        for job in resp.json().get("running", []):
+            if job.get("request_id") == request_id:
+                return job.get("lease")
+        return None
+
+    def check_redis(self):
+        s = self.suite
+        ttl = self.lease_ttl
+        request_id = self._insert_queued("redis")
+        now = utc_timestamp()
+        s.redis_client.publish(COMPLETION_CHANNEL, json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "processing",
+            "started_at": now, "worker_id": WORKER, "timestamp": now}))
+        if not s.expect(self._wait_for(request_id, "processing", 5),
+                        f"redis job {request_id} never went to processing after its ack"):
+            return
+
+        # Heartbeats at a third of the TTL keep it well past the TTL
+        until = time.time() + ttl * 3
+        while time.time() < until:
+            self._heartbeat([request_id])
+            time.sleep(ttl / 3)
+        s.expect(self._status(request_id) == "processing",
+                 f"redis job {request_id} with a renewed lease is {self._status(request_id)}, want processing")
+        lease = self._lease(request_id)
+        s.expect(lease is not None and lease.get("live") and lease.get("worker_id") == WORKER,
+                 f"GET /admin/queue shows the lease on {request_id} as {lease}")
+
+        pubsub = s.redis_client.pubsub()
+        pubsub.subscribe("worker_control")
+        pubsub.get_message(timeout=1)  # the subscribe confirmation
+        s.expect(self._wait_for(request_id, "failed", ttl + 5),
+                 f"redis job {request_id} without heartbeats is {self._status(request_id)}, want failed")
+        self._heartbeat([request_id])
+        deadline = time.time() + 5
+        while time.time() < deadline:
+            msg = pubsub.get_message(timeout=1)
+            if not msg or msg["type"] != "message":
+                continue
+            control = json.loads(msg["data"])
+            if control.get("action") == "abandon" and control.get("request_id") == request_id:
+                s.expect(control.get("worker_id") == WORKER, f"abandon sent to {control.get('worker_id')}")
+                return
+        s.failures.append(f"a late heartbeat for {request_id} got no abandon on worker_control")
+
+    def _internal(self, method, path, **kwargs):
+        return requests.request(method, f"{GO_BACKEND_URL}{path}", timeout=10,
+                                headers={"Authorization": f"Bearer {self.internal_token}"}, **kwargs)
+
+    def check_http(self):
+        s = self.suite
+        ttl = self.lease_ttl
+        request_id = self._insert_queued(None)
+        resp = self._internal("GET", "/internal/jobs/next", params={"model": MODEL, "worker_id": WORKER})
+        if not s.expect(resp.status_code == 200 and resp.json().get("request_id") == request_id,
+                        f"jobs/next: status {resp.status_code} {resp.text}, want {request_id}"):
+            return
+        s.expect(resp.json().get("lease_expires_at") is not None, "the claim has no lease_expires_at")
+        first_token = resp.json().get("lease_token")
+        s.expect(first_token, f"the claim has lease_token {first_token!r}")
+
+        until = time.time() + ttl * 3
+        while time.time() < until:
+            resp = self._internal("POST", f"/internal/jobs/{request_id}/heartbeat", json={"worker_id": WORKER})
+            s.expect(resp.status_code == 200, f"heartbeat for {request_id}: status {resp.status_code} {resp.text}")
+            time.sleep(ttl / 3)
+        s.expect(self._status(request_id) == "processing",
+                 f"http job {request_id} with a renewed lease is {self._status(request_id)}, want processing")
+
+        # Requeued and republished; with no subscriber it stays queued for pulling
+        s.expect(self._wait_for(request_id, "queued", ttl + 5),
+                 f"http job {request_id} without heartbeats is {self._status(request_id)}, want queued")
+        resp = self._internal("POST", f"/internal/jobs/{request_id}/heartbeat", json={"worker_id": WORKER})
+        s.expect(resp.status_code == 409, f"late heartbeat for {request_id}: status {resp.status_code}, want 409")
+
+        # Claimed again by the same worker: a result from the first claim is fenced by its token
+        resp = self._internal("GET", "/internal/jobs/next", params={"model": MODEL, "worker_id": WORKER})
+        if not s.expect(resp.status_code == 200 and resp.json().get("request_id") == request_id,
+                        f"second jobs/next: status {resp.status_code} {resp.text}, want {request_id}"):
+            return
+        second_token = resp.json().get("lease_token")
+        s.expect(second_token and second_token != first_token,
+                 f"the second claim has lease_token {second_token!r}, want a new one after {first_token!r}")
+        self._internal("POST", f"/internal/jobs/{request_id}/complete", json={
+            "request_id": request_id, "status": "failed", "error": "stale", "worker_id": WORKER,
+            "lease_token": first_token, "timestamp": utc_timestamp()})
+        time.sleep(1)
+        s.expect(self._status(request_id) == "processing",
+                 f"http job {request_id} after a result with the first claim's token is "
+                 f"{self._status(request_id)}, want processing")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            admin_id, internal_token, lease_ttl = suite.create_user(), secrets.token_hex(16), 4.0
+            suite.backend = Backend({
+                "ADMIN_USER_IDS": admin_id,
+                "INTERNAL_API_TOKEN": internal_token,
+                "WORKER_LEASES": "true",
+                "WORKER_LEASE_TTL": "4s",
+                "STALE_SWEEP_INTERVAL": "1s",
+                "JOB_CLAIM_SWEEP_INTERVAL": "1s",
+            })
+            suite.backend.start()
+        else:
+            admin_id, internal_token = os.environ["LEASES_ADMIN_ID"], os.environ["INTERNAL_API_TOKEN"]
+            lease_ttl = float(os.getenv("LEASE_TTL_SECONDS", "4"))
+        LeaseTester(suite, admin_id, internal_token, lease_ttl).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("leases keep live jobs and let lost ones go")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,128 @@
+#!/usr/bin/env python3
+"""
+Checks that the listener watchdog fires when the completion listener stalls.
+
+A stalled listener is one that still hears completions but applies none of them, which is
+what a chaos build dropping every message looks like. Run the backend with
+
+    go build -tags chaos -o mobart-chaos .
+    MOBART_CHAOS="drop=1" LISTENER_WATCHDOG_INTERVAL=2s LISTENER_STALL_AFTER=10s \\
+        ADMIN_USER_IDS=<WATCHDOG_ADMIN_ID> ./mobart-chaos
+
+then run this script (needs `pip install psycopg2-binary`). It submits a few generations,
+answers them like a worker would, and polls GET /admin/queue until the watchdog reports the
+stall. Set WATCHDOG_PLAY_WORKER=0 to stall the other way, with no completions arriving at all.
+"""
+
+import json
+import os
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ADMIN_ID = os.getenv("WATCHDOG_ADMIN_ID", "")
+PLAY_WORKER = os.getenv("WATCHDOG_PLAY_WORKER", "1") == "1"
+# LISTENER_STALL_AFTER plus a few watchdog intervals
+FIRE_WITHIN_SECONDS = int(os.getenv("WATCHDOG_FIRE_WITHIN_SECONDS", "40"))
+REQUESTS = 3
+
+
+class WatchdogTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+
+    def run(self):
+        if not ADMIN_ID:
+            logger.error("❌ Set WATCHDOG_ADMIN_ID to a user listed in the backend's ADMIN_USER_IDS")
+            return False
+        self._create_user()
+        if PLAY_WORKER:
+            threading.Thread(target=self._play_worker, daemon=True).start()
+            time.sleep(1)  # let the subscription settle
+
+        alerts_before = self._listener()["alerts"]
+        submitted = [rid for rid in (self._submit(i) for i in range(REQUESTS)) if rid]
+        if not submitted:
+            return False
+        logger.info(f"📤 Submitted {len(submitted)} generations, waiting for the watchdog...")
+
+        deadline = time.time() + FIRE_WITHIN_SECONDS
+        while time.time() < deadline:
+            listener = self._listener()
+            if listener["stalled"] and listener["alerts"] > alerts_before:
+                logger.info(f"✅ Watchdog fired: {listener['reasons']}")
+                return self._check_applied(submitted)
+            logger.info(f"⏳ in_flight={listener['in_flight']} "
+                        f"last_message_age={listener['last_message_age_seconds']:.0f}s "
+                        f"last_db_update_age={listener['last_db_update_age_seconds']:.0f}s")
+            time.sleep(2)
+        logger.error(f"❌ Watchdog did not fire within {FIRE_WITHIN_SECONDS}s")
+        return False
+
+    def _create_user(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', %s)",
+                        (self.user_id, REQUESTS * 10))
+
+    def _listener(self):
+        resp = requests.get(f"{GO_BACKEND_URL}/admin/queue", headers={"X-User-ID": ADMIN_ID})
+        resp.raise_for_status()
+        return resp.json()["listener"]
+
+    def _submit(self, i):
+        resp = requests.post(f"{GO_BACKEND_URL}/generations", headers={"X-User-ID": self.user_id}, json={
+            "text": f"watchdog test image {i}",
+            "request_type": "image",
+        })
+        if resp.status_code != 202:
+            logger.error(f"❌ Submit {i} returned {resp.status_code}: {resp.text}")
+            return None
+        return resp.json()["generation_request_id"]
+
+    def _play_worker(self):
+        pubsub = self.redis_client.pubsub()
+        pubsub.subscribe("image_generation_requests")
+        for message in pubsub.listen():
+            if message["type"] != "message":
+                continue
+            request = json.loads(message["data"])
+            if request.get("user_id") != self.user_id:
+                continue
+            self.redis_client.publish("image_generation_complete", json.dumps({
+                "request_id": request["request_id"],
+                "user_id": request["user_id"],
+                "status": "completed",
+                "s3_key": f"generated/{request['user_id']}/{request['request_id']}.png",
+                "generation_time_seconds": 1.0,
+                "timestamp": time.strftime("%Y-%m-%dT%H:%M:%S"),
+            }))
+
+    def _check_applied(self, request_ids):
+        # The stall is only real if the answered rows are indeed still waiting
+        with self.db.cursor() as cur:
+            cur.execute("""SELECT count(*) FROM generated_content
+                           WHERE request_id = ANY(%s) AND status IN ('queued', 'processing')""",
+                        (request_ids,))
+            waiting = cur.fetchone()[0]
+        if waiting != len(request_ids):
+            logger.error(f"❌ Only {waiting} of {len(request_ids)} rows still in flight; the listener wasn't stalled")
+            return False
+        return True
+
+
+if __name__ == "__main__":
+    print("🐕 Mobart Listener Watchdog Tester")
+    exit(0 if WatchdogTester().run() else 1)
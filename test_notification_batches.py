@@ -0,0 +1,200 @@
+#!/usr/bin/env python3
+"""
+Checks that batch notifications (notification_batches.go) collapse within their window and
+split across it, built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_notification_batches.py
+
+It boots the backend itself, with a SECRETS_KEY of its own so it can store an email channel,
+and a NOTIFY_BATCH_WINDOW of BATCH_WINDOW (3s) so windows close quickly. Needs
+`pip install psycopg2-binary`. Generations are submitted with a batch_id and completed or
+failed the way a worker would; the email deliveries that come out are read from
+notification_deliveries, nothing is sent anywhere real. It checks that:
+
+- completions and failures of a batch within the window go out as one "batch" notification,
+  counting the failures, with a link to the batch
+- a partial batch straddling the boundary splits in two: what arrives once its group has
+  been released starts a group of its own, and goes out alone
+- a notification joining a group keeps the release time of the one that opened it
+- one without a batch goes out unchanged, no sooner than the window and not much later
+- a batch of failures is summarized as one
+"""
+
+import time
+import uuid
+import base64
+import secrets
+import logging
+
+from integration_fixtures import Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+BATCH_WINDOW = 3.0
+POLL_INTERVAL = 0.5  # NOTIFY_POLL_INTERVAL, how often held deliveries are released
+SLACK = 2.0  # for the completion listener and a loaded machine
+
+
+class NotificationBatchTester:
+    def __init__(self, suite):
+        self.suite = suite
+
+    def run(self):
+        self.straddling_batch()
+        self.unbatched()
+        self.failures_only()
+
+    # Setup and reading state
+
+    def _user(self):
+        """A user with an email channel, returning (user_id, channel_id)"""
+        s = self.suite
+        user_id = s.create_user(credits=100)
+        resp = s.api("PUT", "/notifications/channels", user_id,
+                     json={"kind": "email", "target": f"batch-{user_id[:8]}@example.com"})
+        resp.raise_for_status()
+        return user_id, resp.json()["id"]
+
+    def _submit(self, user_id, prompt, batch_id=None):
+        body = {"request_type": "image", "text": prompt}
+        if batch_id:
+            body["batch_id"] = batch_id
+        resp = self.suite.api("POST", "/generations", user_id, json=body)
+        resp.raise_for_status()
+        return resp.json()["generation_request_id"]
+
+    def _finish(self, user_id, channel_id, request_id, failed=False):
+        """Completes or fails request_id and waits for its held delivery, returning
+        (digest_key, next_attempt_at, created_at), or None if none was queued"""
+        s = self.suite
+        if failed:
+            s.publish_failed(request_id, user_id)
+        else:
+            s.publish_completed(request_id, user_id)
+        key = f"{request_id}:{'failed' if failed else 'completed'}:{channel_id}"
+        deadline = time.time() + 5
+        while time.time() < deadline:
+            with s.db.cursor() as cur:
+                cur.execute("""
+                    SELECT digest_key, next_attempt_at, created_at FROM notification_deliveries
+                    WHERE dedupe_key = %s""", (key,))
+                held = cur.fetchone()
+            if held:
+                return held
+            time.sleep(0.05)
+        s.failures.append(f"{request_id}: no delivery was queued for its {'failure' if failed else 'completion'}")
+        return None
+
+    def _released(self, user_id):
+        """The batch releases for the user's channels so far, as [(payload, created_at)] in order"""
+        with self.suite.db.cursor() as cur:
+            cur.execute("""
+                SELECT payload, created_at FROM notification_deliveries
+                WHERE dedupe_key LIKE %s ORDER BY id""", (f"digest:batch:{user_id}:%",))
+            return cur.fetchall()
+
+    def _wait_released(self, user_id, count, timeout=BATCH_WINDOW + SLACK):
+        deadline = time.time() + timeout
+        released = self._released(user_id)
+        while len(released) < count and time.time() < deadline:
+            time.sleep(0.05)
+            released = self._released(user_id)
+        return released
+
+    # Cases
+
+    def straddling_batch(self):
+        s = self.suite
+        user_id, channel_id = self._user()
+        batch_id = f"straddle-{uuid.uuid4().hex[:8]}"
+        first, second, late = (self._submit(user_id, f"fox {i}", batch_id) for i in range(3))
+
+        opened = self._finish(user_id, channel_id, first)
+        time.sleep(BATCH_WINDOW / 3)
+        joined = self._finish(user_id, channel_id, second, failed=True)
+        if not (opened and joined):
+            return
+        s.expect(joined[0] == opened[0] and joined[1] == opened[1],
+                 f"the second of the batch was held as {joined[:2]}, want the first's group and release {opened[:2]}")
+
+        # The rest of the batch finishes only once the first group is out
+        released = self._wait_released(user_id, 1)
+        if not s.expect(len(released) == 1, f"straddling batch: {len(released)} releases after the window, want 1"):
+            return
+        straggler = self._finish(user_id, channel_id, late)
+        if straggler:
+            s.expect(straggler[1] > opened[1],
+                     f"the straggler was held until {straggler[1]}, want after the first group's {opened[1]}")
+        self._wait_released(user_id, 2)
+        time.sleep(POLL_INTERVAL * 2)
+        released = self._released(user_id)
+        if not s.expect(len(released) == 2, f"straddling batch: {len(released)} releases, want 2"):
+            return
+
+        batch, alone = released[0][0], released[1][0]
+        statuses = sorted(item.get("status") for item in batch.get("batch") or [])
+        s.expect(batch.get("status") == "batch" and statuses == ["completed", "failed"],
+                 f"first release: status {batch.get('status')!r} with items {statuses}, "
+                 f"want a batch of a completion and a failure")
+        s.expect((batch.get("batch_link") or "").endswith(batch_id),
+                 f"first release: batch_link {batch.get('batch_link')!r}, want it to end in {batch_id}")
+        s.expect(alone.get("status") == "completed" and alone.get("request_id") == late and not alone.get("batch"),
+                 f"second release: {alone.get('status')!r} for {alone.get('request_id')}, "
+                 f"want the straggler {late} on its own")
+
+    def unbatched(self):
+        s = self.suite
+        user_id, channel_id = self._user()
+        request_id = self._submit(user_id, "an owl")
+        held = self._finish(user_id, channel_id, request_id)
+        if not held:
+            return
+        released = self._wait_released(user_id, 1)
+        if not s.expect(len(released) == 1, f"unbatched: {len(released)} releases, want 1"):
+            return
+        payload, released_at = released[0]
+        s.expect(payload.get("status") == "completed" and payload.get("request_id") == request_id,
+                 f"unbatched: released {payload.get('status')!r} for {payload.get('request_id')}, want it unchanged")
+        waited = (released_at - held[2]).total_seconds()
+        s.expect(BATCH_WINDOW <= waited <= BATCH_WINDOW + POLL_INTERVAL + SLACK,
+                 f"unbatched: released {waited:.1f}s after it was queued, want {BATCH_WINDOW:.0f}s and not much more")
+
+    def failures_only(self):
+        s = self.suite
+        user_id, channel_id = self._user()
+        batch_id = f"failures-{uuid.uuid4().hex[:8]}"
+        request_ids = [self._submit(user_id, f"cat {i}", batch_id) for i in range(2)]
+        for request_id in request_ids:
+            self._finish(user_id, channel_id, request_id, failed=True)
+        self._wait_released(user_id, 1)
+        time.sleep(POLL_INTERVAL * 2)
+        released = self._released(user_id)
+        if not s.expect(len(released) == 1, f"failures: {len(released)} releases, want 1"):
+            return
+        payload = released[0][0]
+        items = payload.get("batch") or []
+        s.expect(payload.get("status") == "batch" and len(items) == 2
+                 and all(item.get("status") == "failed" for item in items),
+                 f"failures: released {payload.get('status')!r} with {[i.get('status') for i in items]}, "
+                 f"want one batch of two failures")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot=True, backend_env={
+            "SECRETS_KEY": base64.b64encode(secrets.token_bytes(32)).decode(),
+            "NOTIFY_BATCH_WINDOW": f"{BATCH_WINDOW:g}s",
+            "NOTIFY_POLL_INTERVAL": f"{POLL_INTERVAL * 1000:.0f}ms",
+        })
+        NotificationBatchTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("batched notifications collapse within their window and split across it")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
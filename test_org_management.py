@@ -0,0 +1,181 @@
+#!/usr/bin/env python3
+"""
+Checks organization seats, member roles and the usage report (org_management.go).
+
+Run the Go backend with its defaults (the free plan has 3 seats), then run this script
+(needs `pip install psycopg2-binary`). It creates an org through the API, moves it to the
+free plan and checks that:
+
+- invites are accepted until the seats run out, the next one gets a 402
+  seat_limit_reached, and the same invite works once a member is removed
+- owners can promote and demote members, but not demote the org's creator
+- GET /orgs/:id/usage reports generations, credits and storage per member per month,
+  keeps a removed member's usage under their own ID, and exports the same rows as CSV
+- role changes, joins and removals show up in GET /orgs/:id/audit
+"""
+
+import csv
+import io
+import os
+import uuid
+import logging
+
+import psycopg2
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+
+
+class OrgManagementTester:
+    def __init__(self):
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        self.owner = self._create_user()
+        resp = requests.post(f"{GO_BACKEND_URL}/orgs", json={"name": "seat test"}, headers=self._as(self.owner))
+        if resp.status_code != 201:
+            logger.error(f"❌ create org: status {resp.status_code}")
+            return False
+        self.org_id = resp.json()["id"]
+        with self.db.cursor() as cur:
+            cur.execute("UPDATE organizations SET plan = 'free' WHERE id = %s", (self.org_id,))
+
+        self.seats()
+        self.roles()
+        self.usage()
+        self.audit()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ seats, roles and usage reporting behave")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _as(self, user_id):
+        return {"X-User-ID": user_id}
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _invite(self):
+        resp = requests.post(f"{GO_BACKEND_URL}/orgs/{self.org_id}/invites", headers=self._as(self.owner))
+        self._expect(resp.status_code == 201, f"invite: status {resp.status_code}")
+        return resp.json().get("token", "")
+
+    def _accept(self, token, user_id, prefix=""):
+        return requests.post(f"{GO_BACKEND_URL}{prefix}/invites/{token}/accept", headers=self._as(user_id))
+
+    def _seats(self):
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/members", headers=self._as(self.owner))
+        return resp.json().get("seats", {})
+
+    def seats(self):
+        self.members = []
+        for _ in range(2):  # the owner holds the first of 3 seats
+            user_id = self._create_user()
+            resp = self._accept(self._invite(), user_id)
+            self._expect(resp.status_code == 200, f"accept with free seats: status {resp.status_code}")
+            self.members.append(user_id)
+        self._expect(self._seats() == {"used": 3, "max": 3}, f"seats after filling: {self._seats()}")
+
+        waiting = self._create_user()
+        token = self._invite()
+        resp = self._accept(token, waiting, prefix="/v2")  # the error code is /v2's
+        self._expect(resp.status_code == 402 and (resp.json().get("error") or {}).get("code") == "seat_limit_reached",
+                     f"accept when full: {resp.status_code} {resp.text}")
+
+        # Usage from the member about to leave, to check it stays theirs
+        self.leaver = self.members.pop()
+        self._record_usage(self.leaver, credits=6, stored_bytes=2048)
+        resp = requests.delete(f"{GO_BACKEND_URL}/orgs/{self.org_id}/members/{self.leaver}",
+                               headers=self._as(self.owner))
+        self._expect(resp.status_code == 204, f"remove member: status {resp.status_code}")
+        self._expect(self._seats().get("used") == 2, f"seats after removal: {self._seats()}")
+
+        resp = self._accept(token, waiting)
+        self._expect(resp.status_code == 200, f"accept after a seat freed: status {resp.status_code}")
+        self.members.append(waiting)
+
+    def roles(self):
+        member = self.members[0]
+        url = f"{GO_BACKEND_URL}/orgs/{self.org_id}/members/{member}"
+        resp = requests.put(url, json={"role": "owner"}, headers=self._as(self.owner))
+        self._expect(resp.status_code == 200 and resp.json().get("previous_role") == "member",
+                     f"promote: {resp.status_code} {resp.text}")
+        # The promoted owner can now act as one, including demoting themselves
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/usage", headers=self._as(member))
+        self._expect(resp.status_code == 200, f"promoted owner reads usage: status {resp.status_code}")
+        resp = requests.put(url, json={"role": "member"}, headers=self._as(member))
+        self._expect(resp.status_code == 200, f"demote: status {resp.status_code}")
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/usage", headers=self._as(member))
+        self._expect(resp.status_code == 403, f"demoted member reads usage: status {resp.status_code}")
+
+        resp = requests.put(f"{GO_BACKEND_URL}/orgs/{self.org_id}/members/{self.owner}", json={"role": "member"},
+                            headers=self._as(self.owner))
+        self._expect(resp.status_code == 409, f"demote the creator: status {resp.status_code}")
+        resp = requests.put(url, json={"role": "admin"}, headers=self._as(self.owner))
+        self._expect(resp.status_code == 422, f"unknown role: status {resp.status_code}")
+
+    def _record_usage(self, user_id, credits, stored_bytes):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+                     status, org_id, credits_charged, stored_bytes)
+                VALUES (%s, %s, now(), 'image', 'generated/x.png', 'usage', 'usage', 'stable-image-ultra',
+                        'completed', %s, %s, %s)""",
+                        (request_id, user_id, self.org_id, credits, stored_bytes))
+            cur.execute("""
+                INSERT INTO credit_ledger (user_id, org_id, request_id, delta, reason)
+                VALUES (%s, %s, %s, %s, 'generation')""", (user_id, self.org_id, request_id, -credits))
+
+    def usage(self):
+        self._record_usage(self.members[0], credits=4, stored_bytes=1024)
+        self._record_usage(self.members[0], credits=4, stored_bytes=1024)
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/usage", headers=self._as(self.owner))
+        self._expect(resp.status_code == 200, f"usage: status {resp.status_code}")
+        body = resp.json()
+        rows = {r["user_id"]: r for r in body.get("usage", [])}
+
+        member = rows.get(self.members[0], {})
+        self._expect(member.get("generations") == 2 and member.get("credits_spent") == 8
+                     and member.get("storage_bytes") == 2048, f"member's usage: {member}")
+        leaver = rows.get(self.leaver, {})
+        self._expect(leaver.get("removed") is True and leaver.get("credits_spent") == 6,
+                     f"removed member's usage: {leaver}")
+        self._expect(body.get("totals", {}).get("credits_spent") == 14, f"totals: {body.get('totals')}")
+
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/usage?format=csv", headers=self._as(self.owner))
+        self._expect(resp.headers.get("Content-Type", "").startswith("text/csv"), "usage CSV: wrong content type")
+        exported = list(csv.DictReader(io.StringIO(resp.text)))
+        self._expect(len(exported) == len(rows), f"usage CSV: {len(exported)} rows, JSON has {len(rows)}")
+        self._expect(any(r["user_id"] == self.leaver and r["removed"] == "true" for r in exported),
+                     "usage CSV: removed member missing")
+
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/usage?from=2025-13", headers=self._as(self.owner))
+        self._expect(resp.status_code == 400, f"bad month: status {resp.status_code}")
+
+    def audit(self):
+        resp = requests.get(f"{GO_BACKEND_URL}/orgs/{self.org_id}/audit", headers=self._as(self.owner))
+        self._expect(resp.status_code == 200, f"audit: status {resp.status_code}")
+        actions = [h["action"] for h in resp.json().get("history", [])]
+        for action, count in (("member_joined", 3), ("member_removed", 1), ("role_changed", 2)):
+            self._expect(actions.count(action) == count, f"audit: {actions.count(action)} {action}, want {count}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if OrgManagementTester().run() else 1)
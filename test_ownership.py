@@ -0,0 +1,153 @@
+#!/usr/bin/env python3
+"""
+Checks that generations stay with their owner (ownership.go).
+
+Run the Go backend with
+
+    ADMIN_USER_IDS=<OWNERSHIP_ADMIN_ID> BACKFILL_POLL_INTERVAL=1s ./mobart
+
+then run this script (needs `pip install psycopg2-binary`). Rows are inserted directly and
+completed the way a worker would. It checks that:
+
+- a completion naming the wrong user completes the row for its owner, and the mismatch is
+  counted in mobart_owner_mismatches_total
+- the owner gets the realtime completion event and the user the message named doesn't
+- the owner_consistency backfill reports a row whose charge was made by another user, and
+  passes a consistent one
+"""
+
+import json
+import os
+import re
+import threading
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+METRICS_URL = os.getenv("METRICS_URL", "http://localhost:9090/metrics")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+ADMIN_ID = os.getenv("OWNERSHIP_ADMIN_ID", "")
+
+
+class OwnershipTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        if not ADMIN_ID:
+            logger.error("❌ Set OWNERSHIP_ADMIN_ID to a user listed in the backend's ADMIN_USER_IDS")
+            return False
+        self.owner = self._create_user()
+        self.other = self._create_user()
+
+        self.wrong_user_completion()
+        self.consistency_check()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ generations stay with their owner")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _insert(self, user_id, status="processing"):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'ownership', 'ownership', 'stable-image-ultra', %s)""",
+                        (request_id, user_id, status))
+        return request_id
+
+    def _mismatches(self, where):
+        text = requests.get(METRICS_URL).text
+        m = re.search(r'mobart_owner_mismatches_total\{where="' + where + r'"\} (\S+)', text)
+        return float(m.group(1)) if m else 0.0
+
+    def _listen(self, user_id, request_id, seen):
+        def listen():
+            try:
+                with requests.get(f"{GO_BACKEND_URL}/events", params={"request_ids": request_id},
+                                  headers={"X-User-ID": user_id}, stream=True, timeout=8) as resp:
+                    for line in resp.iter_lines(decode_unicode=True):
+                        if line.strip() == "event:completed":
+                            seen.set()
+                            return
+            except requests.RequestException:
+                pass
+        threading.Thread(target=listen, daemon=True).start()
+
+    def wrong_user_completion(self):
+        request_id = self._insert(self.owner)
+        before = self._mismatches("completion")
+        owner_saw, other_saw = threading.Event(), threading.Event()
+        self._listen(self.owner, request_id, owner_saw)
+        self._listen(self.other, request_id, other_saw)
+        time.sleep(1)
+
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.other, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0, "worker_id": "ownership-test",
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+        self._expect(owner_saw.wait(6), "the owner got no completion event")
+        self._expect(not other_saw.is_set(), "the user named in the message got the completion event")
+
+        with self.db.cursor() as cur:
+            cur.execute("SELECT status, user_id::text FROM generated_content WHERE request_id = %s", (request_id,))
+            status, user_id = cur.fetchone()
+        self._expect(status == "completed", f"wrong-user completion: status {status}")
+        self._expect(user_id == self.owner, f"wrong-user completion moved the row to {user_id}")
+        grew = self._mismatches("completion") - before
+        self._expect(grew == 1, f"mobart_owner_mismatches_total{{where=\"completion\"}} grew by {grew}, want 1")
+
+    def consistency_check(self):
+        bad = self._insert(self.owner, status="completed")
+        good = self._insert(self.owner, status="completed")
+        with self.db.cursor() as cur:
+            for request_id, charged_by in ((bad, self.other), (good, self.owner)):
+                cur.execute("""
+                    INSERT INTO credit_ledger (user_id, request_id, delta, reason)
+                    VALUES (%s, %s, -5, 'generation')""", (charged_by, request_id))
+
+        headers = {"X-User-ID": ADMIN_ID}
+        resp = requests.post(f"{GO_BACKEND_URL}/admin/backfills/owner_consistency/start",
+                             json={"restart": True, "concurrency": 4, "rate_per_second": 0}, headers=headers)
+        self._expect(resp.status_code == 202, f"start owner_consistency: status {resp.status_code}")
+
+        report = {}
+        for _ in range(60):
+            time.sleep(1)
+            report = requests.get(f"{GO_BACKEND_URL}/admin/backfills/owner_consistency", headers=headers).json()
+            if report.get("backfill", {}).get("status") == "completed":
+                break
+        self._expect(report.get("backfill", {}).get("status") == "completed",
+                     f"owner_consistency didn't finish: {report.get('backfill')}")
+        flagged = {e["key"] for e in report.get("recent_errors", [])}
+        self._expect(bad in flagged, "the row charged by another user wasn't reported")
+        self._expect(good not in flagged, "a consistent row was reported")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if OwnershipTester().run() else 1)
@@ -0,0 +1,152 @@
+#!/usr/bin/env python3
+"""
+Checks that a completion's side effects fire once however often it's processed
+(processed_effects.go), built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_processed_effects.py --boot
+
+which starts the backend with an admin of its own. To use a backend already running at
+GO_BACKEND_URL instead, set EFFECTS_ADMIN_ID to a user in its ADMIN_USER_IDS. Needs
+`pip install psycopg2-binary`. Rows are inserted directly with
+their charge in credit_ledger, and the user has a webhook channel. Each completion is
+published REPEATS times the way a worker would, then stored as dead letters and replayed
+through the admin API. It checks that:
+
+- a completed request queues one notification and at most one embedding job, and isn't
+  refunded
+- a failed request is refunded once and queues one notification
+- processed_effects holds the result and each effect that fired
+- a replay after the listener already applied the completion reports its effects as
+  skipped and applies none
+"""
+
+import os
+import sys
+import json
+import time
+import logging
+
+from integration_fixtures import COMPLETION_CHANNEL, Backend, Suite, utc_timestamp
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+CREDITS = 5
+REPEATS = 5
+REPLAYS = 2
+
+
+class EffectsTester:
+    def __init__(self, suite, admin_id):
+        self.suite = suite
+        self.admin_id = admin_id
+
+    def run(self):
+        self.check("completed")
+        self.check("failed")
+
+    def _create_user(self):
+        s = self.suite
+        user_id = s.create_user(credits=100)
+        # Deliveries to it fail and retry, which is fine: only the queued rows are checked
+        resp = s.api("PUT", "/notifications/channels", user_id,
+                     json={"kind": "webhook", "webhook_url": "https://effects.invalid/hook"})
+        resp.raise_for_status()
+        return user_id
+
+    def _insert(self, user_id):
+        """Inserts a row as a worker finds it: charged, with the charge in the ledger"""
+        request_id = self.suite.insert_generation(user_id, status="processing", model="stable-image-ultra",
+                                                  prompt="effects", credits_charged=CREDITS)
+        with self.suite.db.cursor() as cur:
+            cur.execute("UPDATE users SET credits = credits - %s WHERE id = %s", (CREDITS, user_id))
+            cur.execute("""
+                INSERT INTO credit_ledger (user_id, request_id, delta, reason)
+                VALUES (%s, %s, %s, 'generation')""", (user_id, request_id, -CREDITS))
+        return request_id
+
+    def _completion(self, user_id, request_id, status):
+        completion = {
+            "request_id": request_id, "user_id": user_id, "status": status,
+            "worker_id": "effects-test", "timestamp": utc_timestamp(),
+        }
+        if status == "completed":
+            completion["s3_key"] = f"generated/{user_id}/{request_id}.png"
+            completion["generation_time_seconds"] = 1.0
+        else:
+            completion["error"] = "effects test failure"
+            completion["error_code"] = "unknown"  # oom would be republished instead of failing
+        return json.dumps(completion)
+
+    def _replay(self, request_id, payload):
+        s = self.suite
+        with s.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO dead_letters (channel, error_class, error, request_id, payload)
+                VALUES (%s, 'apply', 'effects test', %s, %s) RETURNING id""", (COMPLETION_CHANNEL, request_id, payload))
+            dead_letter_id = cur.fetchone()[0]
+        resp = s.api("POST", f"/admin/dlq/{dead_letter_id}/replay", self.admin_id)
+        if not s.expect(resp.status_code == 200, f"replay of {request_id}: status {resp.status_code} {resp.text}"):
+            return None
+        return resp.json().get("effects") or {}
+
+    def _count(self, query, request_id):
+        with self.suite.db.cursor() as cur:
+            cur.execute(query, (request_id,))
+            return cur.fetchone()[0]
+
+    def check(self, status):
+        s = self.suite
+        user_id = self._create_user()
+        request_id = self._insert(user_id)
+        payload = self._completion(user_id, request_id, status)
+        for _ in range(REPEATS):
+            s.redis_client.publish(COMPLETION_CHANNEL, payload)
+        time.sleep(3)
+
+        for i in range(REPLAYS):
+            effects = self._replay(request_id, payload)
+            if effects is None:
+                continue
+            s.expect(effects.get("applied") == [], f"{status} replay {i + 1}: applied {effects.get('applied')}")
+            s.expect("result" in (effects.get("skipped") or []),
+                     f"{status} replay {i + 1}: skipped {effects.get('skipped')}")
+        time.sleep(1)
+
+        s.expect_row(request_id, status=status)
+        with s.db.cursor() as cur:
+            cur.execute("SELECT effect_type FROM processed_effects WHERE request_id = %s", (request_id,))
+            recorded = {r[0] for r in cur.fetchall()}
+        for effect in ("result", "notification", "event") + (("refund",) if status == "failed" else ()):
+            s.expect(effect in recorded, f"{status}: {effect} not in processed_effects {sorted(recorded)}")
+
+        deliveries = self._count("""SELECT count(*) FROM notification_deliveries
+                                    WHERE split_part(dedupe_key, ':', 1) = %s""", request_id)
+        s.expect(deliveries == 1, f"{status}: {deliveries} notifications queued")
+        refunds = sum(1 for delta, _ in s.ledger(request_id) if delta > 0)
+        s.expect(refunds == (1 if status == "failed" else 0), f"{status}: refunded {refunds} times")
+        if status == "completed":
+            jobs = self._count("SELECT count(*) FROM embedding_jobs WHERE request_id = %s", request_id)
+            s.expect(jobs <= 1, f"{status}: {jobs} embedding jobs")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            admin_id = suite.create_user()
+            suite.backend = Backend({"ADMIN_USER_IDS": admin_id})
+            suite.backend.start()
+        else:
+            admin_id = os.environ["EFFECTS_ADMIN_ID"]
+        EffectsTester(suite, admin_id).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("every side effect fired exactly once")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
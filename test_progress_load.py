@@ -0,0 +1,129 @@
+#!/usr/bin/env python3
+"""
+Load test for the progress milestone buffer in progress_milestones.go.
+
+Run the Go backend with its defaults (PROGRESS_FLUSH_INTERVAL=2s), then run this script
+(needs `pip install psycopg2-binary`). It inserts processing rows and publishes progress
+for them the way workers do, in two rounds of the same length: one at a baseline rate, then
+one with ten times the progress events for the same number of jobs. It reads the buffer's
+counters from /metrics and checks that:
+
+- each row ends with the highest milestone its progress reached
+- the rows written per job stay the same (one per milestone crossed), however many events
+- the number of flushes, i.e. UPDATE statements, stays roughly flat as well
+- the buffer has drained once the events stop
+"""
+
+import json
+import os
+import re
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+METRICS_URL = os.getenv("METRICS_URL", "http://localhost:9090/metrics")
+JOBS = int(os.getenv("PROGRESS_LOAD_JOBS", "50"))
+BASE_EVENTS_PER_JOB = int(os.getenv("PROGRESS_LOAD_EVENTS", "20"))
+ROUND_SECONDS = int(os.getenv("PROGRESS_LOAD_SECONDS", "20"))
+# every job crosses 25, 50 and 75; the last event is 99%, short of 100
+MILESTONES_PER_JOB = 3
+
+
+class ProgressLoadTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.failures = []
+
+    def run(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (self.user_id,))
+
+        base = self._round(BASE_EVENTS_PER_JOB)
+        loaded = self._round(BASE_EVENTS_PER_JOB * 10)
+        logger.info(f"📊 {base['events']} events: {base['writes']:.0f} row writes in {base['flushes']:.0f} flushes")
+        logger.info(f"📊 {loaded['events']} events: {loaded['writes']:.0f} row writes in {loaded['flushes']:.0f} flushes")
+
+        for name, r in (("baseline", base), ("10x", loaded)):
+            self._expect(r["writes"] <= JOBS * MILESTONES_PER_JOB,
+                         f"{name}: {r['writes']:.0f} row writes for {JOBS} jobs")
+        self._expect(loaded["writes"] <= base["writes"] * 1.1 + 1,
+                     f"row writes grew from {base['writes']:.0f} to {loaded['writes']:.0f}")
+        # Flushes follow the interval, plus one per full batch; neither tracks the event rate
+        self._expect(loaded["flushes"] <= base["flushes"] * 1.5 + 2,
+                     f"flushes grew from {base['flushes']:.0f} to {loaded['flushes']:.0f}")
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ database writes stayed flat while progress events grew 10x")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _metric(self, name, labels=""):
+        """Sums a counter or gauge over every series matching labels"""
+        text = requests.get(METRICS_URL).text
+        total = 0.0
+        for m in re.finditer(r'^%s(\{[^}]*\})? (\S+)$' % name, text, re.M):
+            if labels in (m.group(1) or ""):
+                total += float(m.group(2))
+        return total
+
+    def _insert(self):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'load', 'load', 'stable-image-ultra', 'processing')""",
+                        (request_id, self.user_id))
+        return request_id
+
+    def _round(self, events_per_job):
+        jobs = [self._insert() for _ in range(JOBS)]
+        writes = self._metric("mobart_progress_milestone_writes_total")
+        flushes = self._metric("mobart_progress_flushes_total", 'result="ok"')
+
+        pause = ROUND_SECONDS / events_per_job
+        for step in range(1, events_per_job + 1):
+            percent = round(99 * step / events_per_job, 1)
+            pipe = self.redis_client.pipeline()
+            for request_id in jobs:
+                pipe.publish("image_generation_complete", json.dumps({
+                    "request_id": request_id, "user_id": self.user_id, "status": "progress",
+                    "progress": percent, "worker_id": "load-test",
+                    "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+                }))
+            pipe.execute()
+            time.sleep(pause)
+        time.sleep(5)  # a couple of flush intervals
+
+        with self.db.cursor() as cur:
+            cur.execute("SELECT count(*) FROM generated_content WHERE request_id = ANY(%s) AND progress_milestone = 75",
+                        (jobs,))
+            at_75 = cur.fetchone()[0]
+        self._expect(at_75 == JOBS, f"{events_per_job} events per job: {at_75} of {JOBS} rows at 75%")
+        self._expect(self._metric("mobart_progress_buffer_depth") == 0, "buffer not drained")
+
+        return {
+            "events": events_per_job * JOBS,
+            "writes": self._metric("mobart_progress_milestone_writes_total") - writes,
+            "flushes": self._metric("mobart_progress_flushes_total", 'result="ok"') - flushes,
+        }
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if ProgressLoadTester().run() else 1)
@@ -0,0 +1,91 @@
+#!/usr/bin/env python3
+"""
+Checks that prompts stay out of the backend's logs under the default PROMPT_LOG_MODE=hash
+(prompt_logging.go), built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`
+(or point REDIS_HOST, REDIS_PORT and DATABASE_URL elsewhere), then run
+
+    python test_prompt_logging.py --boot
+
+--boot is required: the script reads the output of the backend it starts. Needs
+`pip install psycopg2-binary`. It submits a generation with a marker prompt, completes it
+with a message that repeats the prompt in an unknown field (which the contract check
+logs along with the message), fails another one, and checks that:
+
+- the marker appears nowhere in the backend's output, plain or structured
+- log lines still name the prompts, by their "prompt:<hash>" tag
+- the row keeps the full prompt
+
+It takes under a minute.
+"""
+
+import sys
+import time
+import uuid
+import json
+import logging
+
+from integration_fixtures import COMPLETION_CHANNEL, RequestWatcher, Suite, utc_timestamp
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+
+class PromptLoggingTester:
+    def __init__(self, suite):
+        self.suite = suite
+        self.watcher = RequestWatcher(suite.redis_client)
+        self.marker = f"secret lighthouse {uuid.uuid4().hex}"
+
+    def run(self):
+        s = self.suite
+        user_id = s.create_user(credits=100)
+        completed = self._submit(user_id, f"{self.marker}, completed")
+        failed = self._submit(user_id, f"{self.marker}, failed")
+        if completed is None or failed is None:
+            return
+
+        # An unknown field gets the whole message logged; the prompt in it must not be
+        s.redis_client.publish(COMPLETION_CHANNEL, json.dumps({
+            "request_id": completed, "user_id": user_id, "status": "completed",
+            "s3_key": f"generated/{completed}.png", "generation_time_seconds": 1.0,
+            "worker_id": "integration-test", "timestamp": utc_timestamp(),
+            "prompt": f"{self.marker}, completed",
+        }))
+        s.expect_row(completed, status="completed")
+        s.publish_failed(failed, user_id, error=f"invalid resolution 4096 for {self.marker}")
+        s.expect_row(failed, status="failed")
+        row = s.row(completed)
+        s.expect(row is not None and self.marker in row["prompt"], "the row lost its prompt")
+
+        time.sleep(1)  # let the last lines reach the log
+        logs = s.backend.logs()
+        leaks = [line for line in logs.splitlines() if self.marker in line]
+        s.expect(not leaks, "the prompt reached the logs:\n  " + "\n  ".join(leaks[:5]))
+        s.expect("prompt:" in logs, "no log line names a prompt by its hash")
+
+    def _submit(self, user_id, prompt):
+        s = self.suite
+        resp = s.submit_image(user_id, prompt)
+        if not s.expect(resp.status_code == 202, f"POST /generations: status {resp.status_code} {resp.text}"):
+            return None
+        request_id = resp.json()["generation_request_id"]
+        s.expect(self.watcher.wait_for(request_id) is not None, f"{request_id} was never published to the workers")
+        return request_id
+
+
+if __name__ == "__main__":
+    if "--boot" not in sys.argv:
+        logger.error("❌ run with --boot; this script reads the output of the backend it starts")
+        raise SystemExit(2)
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot=True, backend_env={"PROMPT_LOG_MODE": "hash"}, capture_logs=True)
+        PromptLoggingTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("prompts stay out of the logs")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,136 @@
+#!/usr/bin/env python3
+"""
+Checks GET /prompts/suggest (prompt_suggestions.go).
+
+Run the Go backend with its defaults, then run this script (needs
+`pip install psycopg2-binary`). It inserts generations for two users directly and, as the
+first user, checks that:
+
+- prefix, later-word and misspelled queries find the user's completed prompts, the most
+  used first
+- another user's prompts, failed generations and trashed ones never show up
+- curated suggestions fill in behind the user's own
+- a new completion shows up on the next lookup, although the list is cached
+- a cached lookup answers within 50ms
+"""
+
+import json
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+
+
+class PromptSuggestionTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        self.user_id = self._create_user()
+        self.other_id = self._create_user()
+        for _ in range(3):
+            self._insert(self.user_id, "a lighthouse at dusk, pixel art")
+        self._insert(self.user_id, "lighthouse keeper reading by candlelight")
+        self._insert(self.user_id, "lighthouse in a thunderstorm", status="failed")
+        self._insert(self.user_id, "lighthouse made of glass", trashed=True)
+        self._insert(self.other_id, "lighthouse belonging to someone else")
+
+        self.matching()
+        self.isolation()
+        self.refresh()
+        self.latency()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ prompt suggestions come from the user's own successful prompts")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _insert(self, user_id, prompt, status="completed", trashed=False):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+                     status, trashed_at)
+                VALUES (%s, %s, now(), 'image', '', %s, %s, 'stable-image-ultra', %s,
+                        CASE WHEN %s THEN now() END)""",
+                        (request_id, user_id, prompt, prompt, status, trashed))
+        return request_id
+
+    def _suggest(self, q):
+        resp = requests.get(f"{GO_BACKEND_URL}/prompts/suggest", params={"q": q}, headers={"X-User-ID": self.user_id})
+        self._expect(resp.status_code == 200, f"suggest {q!r}: status {resp.status_code}")
+        return resp.json().get("suggestions", []) if resp.status_code == 200 else []
+
+    def _texts(self, q, source="history"):
+        return [s["text"] for s in self._suggest(q) if s["source"] == source]
+
+    def matching(self):
+        got = self._texts("a light")
+        self._expect(got[:1] == ["a lighthouse at dusk, pixel art"], f"prefix: {got}")
+        got = self._texts("keeper")
+        self._expect(got == ["lighthouse keeper reading by candlelight"], f"later word: {got}")
+        got = self._texts("lighthose")
+        self._expect(got[:1] == ["a lighthouse at dusk, pixel art"], f"misspelled, most used first: {got}")
+        suggestions = self._suggest("lighthouse")
+        self._expect(len(suggestions) <= 10, f"{len(suggestions)} suggestions")
+        sources = [s["source"] for s in suggestions]
+        self._expect("curated" in sources and sources.index("curated") >= sources.count("history"),
+                     f"curated suggestions should follow the user's own: {sources}")
+
+    def isolation(self):
+        texts = [s["text"] for s in self._suggest("lighthouse")]
+        for prompt in ("lighthouse belonging to someone else", "lighthouse in a thunderstorm",
+                       "lighthouse made of glass"):
+            self._expect(prompt not in texts, f"{prompt!r} suggested")
+
+    def refresh(self):
+        self._suggest("harbor")  # caches the list
+        request_id = self._insert(self.user_id, "harbor at dawn, watercolor", status="processing")
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+        time.sleep(3)
+        got = self._texts("harbor")
+        self._expect(got == ["harbor at dawn, watercolor"], f"after a new completion: {got}")
+
+    def latency(self):
+        self._suggest("light")
+        timings = []
+        for _ in range(20):
+            start = time.monotonic()
+            self._suggest("light")
+            timings.append(time.monotonic() - start)
+        timings.sort()
+        median = timings[len(timings) // 2]
+        self._expect(median < 0.05, f"cached lookups take {median * 1000:.1f}ms")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if PromptSuggestionTester().run() else 1)
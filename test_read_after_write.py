@@ -0,0 +1,147 @@
+#!/usr/bin/env python3
+"""
+Read-after-write checks for GET /generations/:id and the status records in status_records.go.
+
+Run the Go backend with its defaults, then run this script (needs `pip install
+psycopg2-binary`). Rows are inserted directly. A lagging read is simulated by leaving the
+row one version behind the record in Redis, which is what a replica (or a commit not yet
+visible) shows right after a write:
+
+- publish: a request whose row the read can't find yet is served, queued, from its record
+- completion: a completion on the channel writes a record carrying the row's new version,
+  and a row read a version behind is served completed
+- a record no newer than the row, or another user's, is never applied
+- without a record, the row is served as it is
+"""
+
+import json
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+
+
+class ReadAfterWriteTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.user_id = str(uuid.uuid4())
+        self.failures = []
+
+    def run(self):
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (self.user_id,))
+
+        self.publish_before_row_visible()
+        self.completion_before_row_visible()
+        self.stale_records_ignored()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ status reads see the latest write")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _key(self, request_id):
+        return f"generation:status:{request_id}"
+
+    def _insert(self, status):
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model, status)
+                VALUES (%s, %s, now(), 'image', '', 'raw', 'raw', 'stable-image-ultra', %s)""",
+                        (request_id, self.user_id, status))
+        return request_id
+
+    def _row(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT status, version FROM generated_content WHERE request_id = %s", (request_id,))
+            return cur.fetchone()
+
+    def _get(self, request_id, user_id=None):
+        return requests.get(f"{GO_BACKEND_URL}/generations/{request_id}",
+                            headers={"X-User-ID": user_id or self.user_id})
+
+    def _complete(self, request_id):
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": self.user_id, "status": "completed",
+            "s3_key": f"generated/{request_id}.png", "generation_time_seconds": 1.0,
+            "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+
+    def _record(self, request_id, **fields):
+        now = int(time.time() * 1e6)
+        self.redis_client.hset(self._key(request_id), mapping={"updated_at": now, "content_url": "", "error": "",
+                                                              **fields})
+        self.redis_client.expire(self._key(request_id), 300)
+
+    def publish_before_row_visible(self):
+        # What createGeneration leaves behind, for a row the read doesn't see yet
+        request_id = str(uuid.uuid4())
+        self._record(request_id, status="queued", version=0, user_id=self.user_id, content_type="image",
+                     model="stable-image-ultra", created_at=int(time.time() * 1e6))
+        r = self._get(request_id)
+        self._expect(r.status_code == 200, f"publish: unseen row answered {r.status_code}, not 200")
+        if r.status_code == 200:
+            self._expect(r.json().get("status") == "queued", f"publish: served as {r.json().get('status')}")
+
+        r = self._get(request_id, user_id=str(uuid.uuid4()))
+        self._expect(r.status_code == 404, f"publish: another user's record answered {r.status_code}, not 404")
+
+    def completion_before_row_visible(self):
+        request_id = self._insert("queued")
+        self._complete(request_id)
+        deadline = time.time() + 5
+        while time.time() < deadline and self._row(request_id)[0] != "completed":
+            time.sleep(0.1)
+        status, version = self._row(request_id)
+        self._expect(status == "completed", f"completion: row is {status}")
+
+        record = self.redis_client.hgetall(self._key(request_id))
+        self._expect(record.get("status") == "completed", f"completion: record says {record.get('status')}")
+        self._expect(record.get("version") == str(version),
+                     f"completion: record version {record.get('version')}, row version {version}")
+
+        # A read one version behind: the row still queued, the record already completed
+        stale = self._insert("queued")
+        _, stale_version = self._row(stale)
+        self._record(stale, status="completed", version=stale_version + 1, content_url=f"generated/{stale}.png")
+        r = self._get(stale)
+        body = r.json() if r.status_code == 200 else {}
+        self._expect(body.get("status") == "completed",
+                     f"completion: lagging row served as {body.get('status')}, not completed")
+
+    def stale_records_ignored(self):
+        request_id = self._insert("completed")
+        _, version = self._row(request_id)
+        self._record(request_id, status="queued", version=version)
+        r = self._get(request_id)
+        self._expect(r.json().get("status") == "completed",
+                     f"stale: a record no newer than the row was applied ({r.json().get('status')})")
+
+        plain = self._insert("processing")
+        self.redis_client.delete(self._key(plain))
+        r = self._get(plain)
+        self._expect(r.status_code == 200 and r.json().get("status") == "processing",
+                     f"no record: answered {r.status_code} {r.text}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if ReadAfterWriteTester().run() else 1)
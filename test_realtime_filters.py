@@ -0,0 +1,248 @@
+#!/usr/bin/env python3
+"""
+Checks WebSocket re-subscribes (realtime.go) racing with event delivery, built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_realtime_filters.py --boot
+
+or leave out --boot to use a backend already running at GO_BACKEND_URL. Needs
+`pip install psycopg2-binary websocket-client`. Events are published straight onto the
+relay channel, the way another instance would broadcast them, a few milliseconds apart
+while the client changes its filter. Each event carries a sequence number. It checks that:
+
+- once the subscribe ack arrives, no event the old filter wanted and the new one doesn't
+  follows, and every event for the new filter published after the ack arrives
+- while the filter flips back and forth, each event between two acks matches one of the
+  filters on either side of it, and everything after the last ack matches the last
+- a rejected subscribe (an unknown type) leaves the filter as it was
+- another user's events never arrive, whatever the filter
+
+No worker is needed.
+"""
+
+import sys
+import json
+import time
+import threading
+import uuid
+import logging
+
+import websocket
+
+from integration_fixtures import GO_BACKEND_URL, Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+REALTIME_EVENTS_CHANNEL = "realtime_events"
+WS_URL = GO_BACKEND_URL.replace("http", "ws", 1) + "/events/ws"
+
+
+class EventStream:
+    """Publishes numbered events for a set of (user, request, type) in turn until stopped"""
+
+    def __init__(self, redis_client, sources, interval=0.003):
+        self.redis_client = redis_client
+        self.sources = sources
+        self.interval = interval
+        self.seq = 0
+        self.published = []  # (seq, user_id, request_id, type)
+        self.lock = threading.Lock()
+        self.stopped = threading.Event()
+        self.thread = threading.Thread(target=self._run, daemon=True)
+
+    def start(self):
+        self.thread.start()
+        return self
+
+    def stop(self):
+        self.stopped.set()
+        self.thread.join()
+
+    def current(self):
+        with self.lock:
+            return self.seq
+
+    def _run(self):
+        while not self.stopped.is_set():
+            user_id, request_id, event_type = self.sources[self.seq % len(self.sources)]
+            with self.lock:
+                self.seq += 1
+                seq = self.seq
+                self.published.append((seq, user_id, request_id, event_type))
+            self.redis_client.publish(REALTIME_EVENTS_CHANNEL, json.dumps({
+                "type": event_type, "request_id": request_id, "user_id": user_id,
+                "data": {"seq": seq, "progress": seq % 100}, "timestamp": int(time.time()),
+            }))
+            time.sleep(self.interval)
+
+
+class Connection:
+    """A WebSocket subscription, its messages read into order in the background"""
+
+    def __init__(self, user_id, **query):
+        params = "&".join(f"{k}={','.join(v)}" for k, v in query.items() if v)
+        self.ws = websocket.create_connection(f"{WS_URL}?{params}", header=[f"X-User-ID: {user_id}"], timeout=10)
+        self.messages = []  # (kind, body): kind is "event" or the control reply's type
+        self.lock = threading.Condition()
+        threading.Thread(target=self._run, daemon=True).start()
+
+    def _run(self):
+        while True:
+            try:
+                body = json.loads(self.ws.recv())
+            except (websocket.WebSocketException, OSError, ValueError):
+                return
+            kind = body["type"] if body.get("type") in ("subscribed", "error") else "event"
+            with self.lock:
+                self.messages.append((kind, body))
+                self.lock.notify_all()
+
+    def subscribe(self, types=(), request_ids=()):
+        self.ws.send(json.dumps({"action": "subscribe", "types": list(types), "request_ids": list(request_ids)}))
+
+    def wait_replies(self, count, timeout=5):
+        """Waits for count control replies in all, returning whether they came"""
+        replies = lambda: sum(1 for kind, _ in self.messages if kind != "event")
+        with self.lock:
+            return self.lock.wait_for(lambda: replies() >= count, timeout)
+
+    def close(self):
+        self.ws.close()
+
+
+def matches(types, request_ids, event):
+    """eventFilter.matches: empty sets match everything"""
+    if types and event["type"] not in types:
+        return False
+    if request_ids and event.get("request_id") and event["request_id"] not in request_ids:
+        return False
+    return True
+
+
+class RealtimeFilterTester:
+    def __init__(self, suite):
+        self.suite = suite
+
+    def run(self):
+        self.resubscribe_mid_stream()
+        self.flapping_filters()
+        self.rejected_subscribe()
+
+    def _stream(self, user_id, other_id, request_ids, types=("progress",)):
+        sources = [(user_id, r, t) for r in request_ids for t in types]
+        sources.append((other_id, str(uuid.uuid4()), types[0]))
+        return EventStream(self.suite.redis_client, sources).start()
+
+    def _foreign(self, conn, user_id, stream, what):
+        owners = {seq: owner for seq, owner, _, _ in stream.published}
+        foreign = [body for kind, body in conn.messages
+                   if kind == "event" and owners.get(body["data"]["seq"]) != user_id]
+        self.suite.expect(not foreign, f"{what}: received {len(foreign)} of another user's events")
+
+    def resubscribe_mid_stream(self):
+        s = self.suite
+        user_id, other_id = s.create_user(), s.create_user()
+        a, b = str(uuid.uuid4()), str(uuid.uuid4())
+        conn = Connection(user_id, request_ids=[a])
+        stream = self._stream(user_id, other_id, [a, b])
+        time.sleep(0.3)
+        conn.subscribe(request_ids=[b])
+        acked = conn.wait_replies(1)
+        at_ack = stream.current()
+        time.sleep(0.5)
+        stream.stop()
+        time.sleep(0.3)
+        conn.close()
+        if not s.expect(acked, "resubscribe: no ack for the new filter"):
+            return
+
+        kinds = [kind for kind, _ in conn.messages]
+        ack = kinds.index("subscribed")
+        before, after = conn.messages[:ack], conn.messages[ack + 1:]
+        s.expect(any(body.get("request_id") == a for _, body in before),
+                 "resubscribe: no event for the first filter arrived before the change")
+        stale = [body["data"]["seq"] for _, body in after if body.get("request_id") == a]
+        s.expect(not stale, f"resubscribe: events {stale[:5]} for the old filter arrived after the ack")
+
+        got = {body["data"]["seq"] for _, body in after if body.get("request_id") == b}
+        want = {seq for seq, _, request_id, _ in stream.published if request_id == b and seq > at_ack}
+        missing = sorted(want - got)
+        s.expect(not missing, f"resubscribe: {len(missing)} events for the new filter published after the ack "
+                              f"never arrived, from {missing[:5]}")
+        self._foreign(conn, user_id, stream, "resubscribe")
+
+    def flapping_filters(self):
+        s = self.suite
+        user_id, other_id = s.create_user(), s.create_user()
+        a, b = str(uuid.uuid4()), str(uuid.uuid4())
+        filters = [((), (a,)), (("completed",), ()), ((), (b,)), (("progress",), (a, b)), (("completed",), (b,))]
+        conn = Connection(user_id, request_ids=[a])
+        applied = [filters[0]]
+        stream = self._stream(user_id, other_id, [a, b], types=("progress", "completed"))
+        for i in range(30):
+            types, request_ids = filters[(i + 1) % len(filters)]
+            conn.subscribe(types, request_ids)
+            applied.append((types, request_ids))
+            time.sleep(0.02)
+        acked = conn.wait_replies(30)
+        time.sleep(0.3)
+        stream.stop()
+        time.sleep(0.3)
+        conn.close()
+        if not s.expect(acked, "flapping: fewer than 30 acks"):
+            return
+
+        # Between ack i and ack i+1 the writer may already see filter i+1
+        window, bad = 0, []
+        for kind, body in conn.messages:
+            if kind == "subscribed":
+                window += 1
+                continue
+            allowed = applied[window:window + 2]
+            if not any(matches(types, request_ids, body) for types, request_ids in allowed):
+                bad.append((window, body["type"], body.get("request_id"), body["data"]["seq"]))
+        s.expect(not bad, f"flapping: {len(bad)} events matched neither the filter before nor after them, "
+                          f"first {bad[:3]}")
+        s.expect(window == 30, f"flapping: {window} acks, want 30")
+        self._foreign(conn, user_id, stream, "flapping")
+
+    def rejected_subscribe(self):
+        s = self.suite
+        user_id, other_id = s.create_user(), s.create_user()
+        a, b = str(uuid.uuid4()), str(uuid.uuid4())
+        conn = Connection(user_id, request_ids=[a])
+        stream = self._stream(user_id, other_id, [a, b])
+        time.sleep(0.2)
+        conn.subscribe(types=["no_such_event"], request_ids=[b])
+        replied = conn.wait_replies(1)
+        time.sleep(0.3)
+        stream.stop()
+        time.sleep(0.2)
+        conn.close()
+        replies = [body for kind, body in conn.messages if kind != "event"]
+        if not s.expect(replied and replies[0]["type"] == "error",
+                        f"rejected subscribe: replies {replies}, want an error"):
+            return
+        wrong = [body["data"]["seq"] for kind, body in conn.messages
+                 if kind == "event" and body.get("request_id") != a]
+        s.expect(not wrong, f"rejected subscribe: events {wrong[:5]} outside the original filter arrived")
+        s.expect(any(kind == "event" for kind, _ in conn.messages[conn.messages.index(("error", replies[0])):]),
+                 "rejected subscribe: nothing arrived after the error; the original filter should still hold")
+        self._foreign(conn, user_id, stream, "rejected subscribe")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot="--boot" in sys.argv)
+        RealtimeFilterTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("filter changes take effect at their ack while events are flowing")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
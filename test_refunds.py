@@ -0,0 +1,157 @@
+#!/usr/bin/env python3
+"""
+Checks that every way a request can end badly refunds it exactly once (credits.go).
+
+Run the Go backend with
+
+    DEADLINE_SWEEP_INTERVAL=2s ./mobart
+
+then run this script (needs `pip install psycopg2-binary`). Rows are inserted directly with
+their charge in credit_ledger, and failures are published the way a worker would. It checks
+that:
+
+- a request that times out and then gets a (late) failure completion is refunded once
+- a failed request is refunded once, however often its failure is delivered
+- cancelling a deferred request refunds it once, and cancelling it again doesn't
+- a request that was never charged gets no refund entry
+- each user's balance ends where it started
+"""
+
+import json
+import os
+import time
+import uuid
+import logging
+
+import psycopg2
+import redis
+import requests
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+GO_BACKEND_URL = os.getenv("GO_BACKEND_URL", "http://localhost:8080")
+DATABASE_URL = os.getenv("DATABASE_URL", "postgres://localhost/mobart?sslmode=disable")
+CREDITS = 5
+
+
+class RefundTester:
+    def __init__(self):
+        self.redis_client = redis.Redis(host="localhost", port=6379, decode_responses=True)
+        self.db = psycopg2.connect(DATABASE_URL)
+        self.db.autocommit = True
+        self.failures = []
+
+    def run(self):
+        self.timeout_then_failure()
+        self.repeated_failure()
+        self.cancel()
+        self.never_charged()
+
+        for f in self.failures:
+            logger.error(f"❌ {f}")
+        if not self.failures:
+            logger.info("✅ every request was refunded exactly once")
+        return not self.failures
+
+    def _expect(self, ok, message):
+        if not ok:
+            self.failures.append(message)
+
+    def _create_user(self):
+        user_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("INSERT INTO users (id, plan, credits) VALUES (%s, 'pro', 100)", (user_id,))
+        return user_id
+
+    def _insert(self, user_id, status, charged=CREDITS, deferred_until=None):
+        """Inserts a row as admission leaves it: charged, with the charge in the ledger"""
+        request_id = str(uuid.uuid4())
+        with self.db.cursor() as cur:
+            cur.execute("""
+                INSERT INTO generated_content
+                    (request_id, user_id, created_at, content_type, content_url, original_prompt, prompt, model,
+                     status, credits_charged, deferred_until)
+                VALUES (%s, %s, now(), 'image', '', 'refund', 'refund', 'stable-image-ultra', %s, %s, %s)""",
+                        (request_id, user_id, status, charged, deferred_until))
+            if charged:
+                cur.execute("UPDATE users SET credits = credits - %s WHERE id = %s", (charged, user_id))
+                cur.execute("""
+                    INSERT INTO credit_ledger (user_id, request_id, delta, reason)
+                    VALUES (%s, %s, %s, 'generation')""", (user_id, request_id, -charged))
+        return request_id
+
+    def _fail(self, user_id, request_id):
+        self.redis_client.publish("image_generation_complete", json.dumps({
+            "request_id": request_id, "user_id": user_id, "status": "failed", "error": "CUDA out of memory",
+            "error_code": "unknown",  # oom would be republished instead of failing
+            "worker_id": "refund-test", "timestamp": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }))
+
+    def _status(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT status FROM generated_content WHERE request_id = %s", (request_id,))
+            return cur.fetchone()[0]
+
+    def _refunds(self, request_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT reason FROM credit_ledger WHERE request_id = %s AND delta > 0 ORDER BY id",
+                        (request_id,))
+            return [r[0] for r in cur.fetchall()]
+
+    def _balance(self, user_id):
+        with self.db.cursor() as cur:
+            cur.execute("SELECT credits FROM users WHERE id = %s", (user_id,))
+            return cur.fetchone()[0]
+
+    def timeout_then_failure(self):
+        user_id = self._create_user()
+        request_id = self._insert(user_id, "processing")
+        with self.db.cursor() as cur:
+            cur.execute("UPDATE generated_content SET deadline = now() - interval '1 second' WHERE request_id = %s",
+                        (request_id,))
+        time.sleep(5)  # a couple of sweeps
+        self._expect(self._status(request_id) == "timed_out", f"timeout: status {self._status(request_id)}")
+        self._fail(user_id, request_id)
+        self._fail(user_id, request_id)
+        time.sleep(3)
+        self._expect(self._status(request_id) == "timed_out", f"late failure: status {self._status(request_id)}")
+        refunds = self._refunds(request_id)
+        self._expect(refunds == ["refund:timed_out"], f"timeout then late failure: refunds {refunds}")
+        self._expect(self._balance(user_id) == 100, f"timeout then late failure: balance {self._balance(user_id)}")
+
+    def repeated_failure(self):
+        user_id = self._create_user()
+        request_id = self._insert(user_id, "processing")
+        for _ in range(3):
+            self._fail(user_id, request_id)
+        time.sleep(3)
+        self._expect(self._status(request_id) == "failed", f"failure: status {self._status(request_id)}")
+        refunds = self._refunds(request_id)
+        self._expect(refunds == ["refund:failed"], f"repeated failure: refunds {refunds}")
+        self._expect(self._balance(user_id) == 100, f"repeated failure: balance {self._balance(user_id)}")
+
+    def cancel(self):
+        user_id = self._create_user()
+        request_id = self._insert(user_id, "deferred", deferred_until="2099-01-01T00:00:00Z")
+        url = f"{GO_BACKEND_URL}/generations/{request_id}/cancel"
+        resp = requests.post(url, headers={"X-User-ID": user_id})
+        self._expect(resp.status_code == 200, f"cancel: status {resp.status_code}")
+        resp = requests.post(url, headers={"X-User-ID": user_id})
+        self._expect(resp.status_code == 409, f"second cancel: status {resp.status_code}")
+        refunds = self._refunds(request_id)
+        self._expect(refunds == ["refund:cancelled"], f"cancel: refunds {refunds}")
+        self._expect(self._balance(user_id) == 100, f"cancel: balance {self._balance(user_id)}")
+
+    def never_charged(self):
+        user_id = self._create_user()
+        request_id = self._insert(user_id, "processing", charged=0)
+        self._fail(user_id, request_id)
+        time.sleep(3)
+        self._expect(self._status(request_id) == "failed", f"uncharged failure: status {self._status(request_id)}")
+        self._expect(self._refunds(request_id) == [], f"uncharged failure: refunds {self._refunds(request_id)}")
+        self._expect(self._balance(user_id) == 100, f"uncharged failure: balance {self._balance(user_id)}")
+
+
+if __name__ == "__main__":
+    raise SystemExit(0 if RefundTester().run() else 1)
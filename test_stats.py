@@ -0,0 +1,140 @@
+#!/usr/bin/env python3
+"""
+Checks GET /stats (stats.go) against figures worked out by hand from seeded rows, built on
+integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_stats.py --boot
+
+or leave out --boot to use a backend already running at GO_BACKEND_URL. Needs
+`pip install psycopg2-binary`. One user's rows are inserted directly over three days, with
+a row older than the 30-day window and another user's rows alongside. It checks that:
+
+- the total, success rate (completed over completed and failed), average and p95
+  generation time, credits, busiest day and most-used model are the ones computed here,
+  with the old row, the other user's rows and untimed completions left out where they
+  should be
+- a user with no generations gets zeros and no busiest day or model
+- the answer is cached: a row added afterwards only shows once the cache key is dropped
+
+No worker is needed.
+"""
+
+import sys
+import time
+import logging
+from datetime import datetime, timedelta, timezone
+
+from integration_fixtures import Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+
+def percentile_cont(values, q):
+    """Postgres's percentile_cont: linear interpolation between the closest ranks"""
+    values = sorted(values)
+    pos = q * (len(values) - 1)
+    lower = int(pos)
+    if lower + 1 >= len(values):
+        return values[lower]
+    return values[lower] + (values[lower + 1] - values[lower]) * (pos - lower)
+
+
+class StatsTester:
+    def __init__(self, suite):
+        self.suite = suite
+        # Midday, so the day is the same in any session time zone
+        noon = datetime.now(timezone.utc).replace(hour=12, minute=0, second=0, microsecond=0)
+        self.days = [noon - timedelta(days=d) for d in (1, 2, 5)]
+
+    def run(self):
+        self.seeded_figures()
+        self.empty_user()
+
+    def _stats(self, user_id):
+        resp = self.suite.api("GET", "/stats", user_id)
+        if not self.suite.expect(resp.status_code == 200, f"GET /stats: status {resp.status_code} {resp.text}"):
+            return None
+        return resp.json()
+
+    def _near(self, got, want, what):
+        self.suite.expect(got is not None and abs(got - want) < 1e-6, f"GET /stats {what}: {got}, want {want}")
+
+    def seeded_figures(self):
+        s = self.suite
+        user_id, other_id = s.create_user(), s.create_user()
+        # (day, status, model, seconds, credits)
+        rows = [
+            (0, "completed", "sdxl", 4.0, 2), (0, "completed", "sdxl", 10.0, 2), (0, "failed", "sdxl", None, 0),
+            (1, "completed", "flux", 6.0, 5), (1, "completed", "flux", 30.0, 5), (1, "completed", "sdxl", None, 2),
+            (1, "failed", "flux", None, 0), (1, "queued", "flux", None, 5),
+            (2, "completed", "flux", 8.0, 5), (2, "cancelled", "sdxl", None, 0),
+        ]
+        for day, status, model, seconds, credits in rows:
+            s.insert_generation(user_id, status, self.days[day], model=model, generation_time_seconds=seconds,
+                                credits_charged=credits)
+        # Outside the window, and someone else's: neither counts
+        s.insert_generation(user_id, "completed", self.days[0] - timedelta(days=40), model="sdxl",
+                            generation_time_seconds=500.0, credits_charged=50)
+        for _ in range(3):
+            s.insert_generation(other_id, "failed", self.days[0], model="sdxl", credits_charged=9)
+
+        completed = [r for r in rows if r[1] == "completed"]
+        timed = [r[3] for r in completed if r[3] is not None]
+        finished = [r for r in rows if r[1] in ("completed", "failed")]
+        want = {
+            "window_days": 30,
+            "total_generations": len(rows),
+            "credits_spent": sum(r[4] for r in rows),
+            "busiest_day": self.days[1].strftime("%Y-%m-%d"),
+            # flux 5, sdxl 5: the tie goes to the model that sorts first
+            "most_used_model": "flux",
+        }
+        stats = self._stats(user_id)
+        if stats is None:
+            return
+        for field, value in want.items():
+            s.expect(stats.get(field) == value, f"GET /stats {field}: {stats.get(field)!r}, want {value!r}")
+        self._near(stats.get("success_rate"), len(completed) / len(finished), "success_rate")
+        self._near(stats.get("avg_generation_seconds"), sum(timed) / len(timed), "avg_generation_seconds")
+        self._near(stats.get("p95_generation_seconds"), percentile_cont(timed, 0.95), "p95_generation_seconds")
+
+        # Cached for ten minutes, so a new row waits for the key to go
+        s.insert_generation(user_id, "completed", self.days[2], model="sdxl", generation_time_seconds=2.0,
+                            credits_charged=1)
+        again = self._stats(user_id)
+        if again is not None:
+            s.expect(again.get("total_generations") == len(rows),
+                     f"GET /stats recomputed within the cache TTL: total {again.get('total_generations')}")
+        s.redis_client.delete(f"stats:user:{user_id}")
+        fresh = self._stats(user_id)
+        if fresh is not None:
+            s.expect(fresh.get("total_generations") == len(rows) + 1,
+                     f"GET /stats after the cache key went: total {fresh.get('total_generations')}, want {len(rows) + 1}")
+
+    def empty_user(self):
+        s = self.suite
+        stats = self._stats(s.create_user())
+        if stats is None:
+            return
+        for field in ("total_generations", "success_rate", "avg_generation_seconds", "p95_generation_seconds",
+                      "credits_spent"):
+            s.expect(stats.get(field) == 0, f"GET /stats for a new user: {field} {stats.get(field)!r}, want 0")
+        for field in ("busiest_day", "most_used_model"):
+            s.expect(field not in stats, f"GET /stats for a new user: {field} {stats.get(field)!r}, want none")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup(boot="--boot" in sys.argv)
+        StatsTester(suite).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("per-user stats match the seeded rows")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,209 @@
+#!/usr/bin/env python3
+"""
+Checks that tenants (tenants.go) can't reach each other's users, rows, plans or jobs, built
+on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_tenants.py --boot
+
+which starts the backend with a partner tenant, job pull and admins of its own. To use a
+backend already running at GO_BACKEND_URL instead, start it with e.g.
+
+    ADMIN_USER_IDS=<TENANTS_ADMIN_ID> TENANTS=partner TENANT_PARTNER_HOSTS=partner.localhost \\
+      TENANT_PARTNER_ADMIN_USER_IDS=<PARTNER_ADMIN_ID> INTERNAL_API_TOKEN=<INTERNAL_API_TOKEN> ./mobart
+
+and run this script with the same existing users and token. Needs `pip install
+psycopg2-binary`. The partner's host is sent as the Host header, so no DNS is needed. It
+checks that:
+
+- a partner user is a 404 on the default host, and a default user on the partner's
+- the default tenant's admin gets a 404 for a partner user, and the partner's admin for a
+  default one and for an operator route
+- a plan stored for the partner isn't listed for the default tenant
+- GET /internal/jobs/next with X-Tenant-ID only hands out that tenant's jobs
+- the partner's generations are published on its prefixed channel with its storage_prefix
+
+Plans and rows it creates are removed again at the end. No worker is needed.
+"""
+
+import os
+import sys
+import json
+import time
+import secrets
+import logging
+
+import requests
+
+from integration_fixtures import GO_BACKEND_URL, Backend, Suite
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+PARTNER_HOST = os.getenv("PARTNER_HOST", "partner.localhost")
+PARTNER = "partner"
+PLAN = "tenant_test"
+MODEL = "stable-image-ultra"
+
+
+class TenantTester:
+    def __init__(self, suite, admin_id, partner_admin_id, internal_token):
+        self.suite = suite
+        self.admin_id = admin_id
+        self.partner_admin_id = partner_admin_id
+        self.internal_token = internal_token
+        self.users = []
+
+    def run(self):
+        self._join(self.partner_admin_id, PARTNER)
+        try:
+            default_user = self._create_user("default")
+            partner_user = self._create_user(PARTNER)
+            self.check_hosts(default_user, partner_user)
+            self.check_admins(default_user, partner_user)
+            self.check_plans()
+            self.check_jobs(default_user, partner_user)
+            self.check_publish(partner_user)
+        finally:
+            self._clean_up()
+
+    def _headers(self, user_id, tenant):
+        headers = {"X-User-ID": user_id}
+        if tenant == PARTNER:
+            headers["Host"] = PARTNER_HOST
+        return headers
+
+    def _get(self, path, user_id, tenant):
+        return requests.get(f"{GO_BACKEND_URL}{path}", headers=self._headers(user_id, tenant), timeout=10)
+
+    def _join(self, user_id, tenant):
+        with self.suite.db.cursor() as cur:
+            cur.execute("UPDATE users SET tenant_id = %s WHERE id = %s", (tenant, user_id))
+
+    def _create_user(self, tenant):
+        user_id = self.suite.create_user()
+        self._join(user_id, tenant)
+        self.users.append(user_id)
+        return user_id
+
+    def _clean_up(self):
+        with self.suite.db.cursor() as cur:
+            cur.execute("DELETE FROM plan_limits WHERE plan = %s", (PLAN,))
+            cur.execute("DELETE FROM generated_content WHERE user_id::text = ANY(%s)", (self.users,))
+            cur.execute("DELETE FROM users WHERE id::text = ANY(%s)", (self.users,))
+        for user_id, tenant in ((self.admin_id, "default"), (self.partner_admin_id, PARTNER)):
+            requests.post(f"{GO_BACKEND_URL}/admin/plans/reload", headers=self._headers(user_id, tenant), timeout=10)
+
+    def check_hosts(self, default_user, partner_user):
+        for user_id, tenant, want in ((default_user, "default", 200), (partner_user, PARTNER, 200),
+                                      (partner_user, "default", 404), (default_user, PARTNER, 404)):
+            resp = self._get("/stats", user_id, tenant)
+            self.suite.expect(resp.status_code == want,
+                              f"GET /stats for a user on the {tenant} host: status {resp.status_code}, want {want}")
+
+    def check_admins(self, default_user, partner_user):
+        s = self.suite
+        for admin_id, tenant, user_id, want in ((self.admin_id, "default", default_user, 200),
+                                                (self.admin_id, "default", partner_user, 404),
+                                                (self.partner_admin_id, PARTNER, partner_user, 200),
+                                                (self.partner_admin_id, PARTNER, default_user, 404)):
+            resp = self._get(f"/admin/users/{user_id}", admin_id, tenant)
+            s.expect(resp.status_code == want,
+                     f"{tenant} admin reading user {user_id}: status {resp.status_code}, want {want}")
+        resp = self._get("/admin/queue", self.partner_admin_id, PARTNER)
+        s.expect(resp.status_code == 404, f"partner admin on GET /admin/queue: status {resp.status_code}, want 404")
+
+    def check_plans(self):
+        s = self.suite
+        resp = requests.put(f"{GO_BACKEND_URL}/admin/plans/{PLAN}",
+                            headers=self._headers(self.partner_admin_id, PARTNER), timeout=10,
+                            json={"rate_limit": 5, "max_in_flight": 1, "admission_mode": "reject", "max_batch": 1})
+        s.expect(resp.status_code == 200, f"partner PUT /admin/plans/{PLAN}: status {resp.status_code} {resp.text}")
+        for admin_id, tenant, want in ((self.partner_admin_id, PARTNER, True), (self.admin_id, "default", False)):
+            resp = self._get("/admin/plans", admin_id, tenant)
+            listed = any(p.get("plan") == PLAN for p in resp.json().get("plans", []))
+            s.expect(listed == want, f"{tenant} GET /admin/plans lists {PLAN}: {listed}, want {want}")
+
+    def _claim(self, tenant):
+        headers = {"Authorization": f"Bearer {self.internal_token}"}
+        if tenant is not None:
+            headers["X-Tenant-ID"] = tenant
+        return requests.get(f"{GO_BACKEND_URL}/internal/jobs/next", headers=headers, timeout=10,
+                            params={"model": MODEL, "worker_id": f"test-tenants-{tenant}"})
+
+    def _tenant_of(self, request_id):
+        with self.suite.db.cursor() as cur:
+            cur.execute("SELECT tenant_id FROM generated_content WHERE request_id = %s", (request_id,))
+            row = cur.fetchone()
+        return row[0] if row else None
+
+    def check_jobs(self, default_user, partner_user):
+        s = self.suite
+        mine = {s.insert_generation(partner_user, status="queued", model=MODEL, prompt="tenants"): PARTNER,
+                s.insert_generation(default_user, status="queued", model=MODEL, prompt="tenants"): "default"}
+        for tenant in (PARTNER, None):
+            want = tenant or "default"
+            while True:
+                resp = self._claim(tenant)
+                if resp.status_code != 200:
+                    s.expect(resp.status_code == 204, f"jobs/next for {want}: status {resp.status_code} {resp.text}")
+                    break
+                request_id = resp.json().get("request_id")
+                got = self._tenant_of(request_id)
+                s.expect(got == want, f"jobs/next for {want} handed out {request_id} of tenant {got}")
+                mine.pop(request_id, None)
+        s.expect(not mine, f"jobs/next never handed out {mine}")
+        resp = self._claim("nobody")
+        s.expect(resp.status_code == 404, f"jobs/next for an unknown tenant: status {resp.status_code}, want 404")
+
+    def check_publish(self, partner_user):
+        s = self.suite
+        pubsub = s.redis_client.pubsub()
+        pubsub.subscribe(f"{PARTNER}:image_generation_requests")
+        pubsub.get_message(timeout=1)  # the subscribe confirmation
+        resp = requests.post(f"{GO_BACKEND_URL}/generations", headers=self._headers(partner_user, PARTNER),
+                             json={"text": "a lighthouse at dusk", "request_type": "image"}, timeout=10)
+        if not s.expect(resp.status_code == 202, f"partner POST /generations: status {resp.status_code} {resp.text}"):
+            return
+        request_id = resp.json()["generation_request_id"]
+        deadline = time.time() + 5
+        while time.time() < deadline:
+            msg = pubsub.get_message(timeout=1)
+            if not msg or msg["type"] != "message":
+                continue
+            request = json.loads(msg["data"])
+            if request.get("request_id") != request_id:
+                continue
+            s.expect(request.get("storage_prefix") == f"tenants/{PARTNER}/",
+                     f"partner request published with storage_prefix {request.get('storage_prefix')!r}")
+            return
+        s.failures.append(f"partner request {request_id} wasn't published on {PARTNER}:image_generation_requests")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            admin_id, partner_admin_id = suite.create_user(), suite.create_user()
+            internal_token = secrets.token_hex(16)
+            suite.backend = Backend({
+                "ADMIN_USER_IDS": admin_id,
+                "TENANTS": PARTNER,
+                "TENANT_PARTNER_HOSTS": PARTNER_HOST,
+                "TENANT_PARTNER_ADMIN_USER_IDS": partner_admin_id,
+                "INTERNAL_API_TOKEN": internal_token,
+            })
+            suite.backend.start()
+        else:
+            admin_id, partner_admin_id = os.environ["TENANTS_ADMIN_ID"], os.environ["PARTNER_ADMIN_ID"]
+            internal_token = os.environ["INTERNAL_API_TOKEN"]
+        TenantTester(suite, admin_id, partner_admin_id, internal_token).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("tenants are isolated")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
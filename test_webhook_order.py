@@ -0,0 +1,256 @@
+#!/usr/bin/env python3
+"""
+Checks that webhook events (webhook_events.go) reach an endpoint in order, once each, with
+their prompts encrypted while queued, built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_webhook_order.py
+
+It boots the backend itself, with a SECRETS_KEY and PROMPT_ENCRYPTION_KEYS of its own,
+NOTIFY_ALLOW_PRIVATE_TARGETS so its webhook may reach the local receiver, no per-webhook
+spacing and a quick milestone flush. Needs `pip install psycopg2-binary`. Generations are
+submitted for a user with one webhook channel and driven through their lifecycle the way a
+worker would, with processing acks, progress and completions; the backend's own delivery
+worker sends the events, so only this user's deliveries are touched. It checks that:
+
+- a request's events arrive in sequence, stages never going back, and an event the
+  endpoint turns away is redelivered in its place with the same event_id
+- events published back to back still arrive in order, ending in the completion
+- a milestone reported after its request completed is never sent
+- queued payloads keep the prompt encrypted, processing and progress events included,
+  and the endpoint gets it in plaintext
+
+No worker should be subscribed.
+"""
+
+import json
+import time
+import base64
+import secrets
+import threading
+import logging
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+from integration_fixtures import COMPLETION_CHANNEL, Suite, utc_timestamp
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+FLUSH_INTERVAL = 0.2  # PROGRESS_FLUSH_INTERVAL, how often milestones are written
+PROMPT = "a lighthouse at dusk, in order"
+LIFECYCLE = [("processing", 0), ("progress", 25), ("progress", 50), ("progress", 75), ("completed", 0)]
+
+
+class Receiver:
+    """A local webhook endpoint recording every attempt, turning away the first at each
+    request:status listed in reject"""
+
+    def __init__(self):
+        self.received = {}  # request_id: [body]
+        self.attempts = {}  # event_id: count
+        self.reject = set()
+        self.lock = threading.Condition()
+        receiver = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def do_POST(self):
+                body = json.loads(self.rfile.read(int(self.headers["Content-Length"])))
+                with receiver.lock:
+                    event_id = body.get("event_id")
+                    receiver.attempts[event_id] = receiver.attempts.get(event_id, 0) + 1
+                    first = receiver.attempts[event_id] == 1
+                    receiver.received.setdefault(body.get("request_id"), []).append(body)
+                    receiver.lock.notify_all()
+                    turned_away = first and f"{body.get('request_id')}:{body.get('status')}" in receiver.reject
+                if turned_away:
+                    # A quick Retry-After keeps the run short without bypassing the backoff path
+                    self.send_response(429)
+                    self.send_header("Retry-After", "0.1")
+                else:
+                    self.send_response(204)
+                self.end_headers()
+
+            def log_message(self, *args):
+                pass
+
+        self.server = ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+        self.server.daemon_threads = True
+        threading.Thread(target=self.server.serve_forever, daemon=True).start()
+
+    def url(self):
+        return f"http://127.0.0.1:{self.server.server_port}/hook"
+
+    def events(self, request_id):
+        with self.lock:
+            return list(self.received.get(request_id, []))
+
+    def wait_for(self, request_id, done, timeout=15):
+        """Waits until done(events) holds for request_id's events so far"""
+        with self.lock:
+            return self.lock.wait_for(lambda: done(self.received.get(request_id, [])), timeout)
+
+    def stop(self):
+        self.server.shutdown()
+
+
+def check_order(events):
+    """Sequences never go back, and stages only go forward between distinct events; returns a
+    problem or None"""
+    def stage(e):
+        return {"processing": 1, "progress": 1 + (e.get("progress") or 0)}.get(e.get("status"), 1000)
+
+    for prev, e in zip(events, events[1:]):
+        if e.get("event_id") == prev.get("event_id"):
+            continue
+        if e.get("sequence", 0) <= prev.get("sequence", 0):
+            return f"sequence {e.get('sequence')} arrived after {prev.get('sequence')}"
+        if stage(e) < stage(prev):
+            return f"{e.get('status')} {e.get('progress')} arrived after {prev.get('status')} {prev.get('progress')}"
+    return None
+
+
+def labels(events):
+    return [f"{e.get('status')}:{e.get('progress') or 0}" for e in events]
+
+
+class WebhookOrderTester:
+    def __init__(self, suite, receiver):
+        self.suite = suite
+        self.receiver = receiver
+
+    def run(self):
+        s = self.suite
+        self.user_id = s.create_user(credits=100)
+        resp = s.api("PUT", "/notifications/channels", self.user_id,
+                     json={"kind": "webhook", "target": self.receiver.url()})
+        resp.raise_for_status()
+        self.channel_id = resp.json()["id"]
+
+        self.retried()
+        self.racing()
+        self.late_milestone()
+        self.encrypted_payloads()
+
+    # Playing the worker
+
+    def _submit(self):
+        resp = self.suite.submit_image(self.user_id, PROMPT)
+        resp.raise_for_status()
+        return resp.json()["generation_request_id"]
+
+    def _publish(self, request_id, status, progress=0):
+        message = {"request_id": request_id, "user_id": self.user_id, "status": status,
+                   "worker_id": "webhook-order-test", "timestamp": utc_timestamp()}
+        if status == "processing":
+            message["started_at"] = utc_timestamp()
+        elif status == "progress":
+            message["progress"] = progress
+        elif status == "completed":
+            message.update(s3_key=f"generated/{request_id}.png", generation_time_seconds=1.0)
+        self.suite.redis_client.publish(COMPLETION_CHANNEL, json.dumps(message))
+
+    def _wait_status(self, request_id, status, timeout=5):
+        deadline = time.time() + timeout
+        while time.time() < deadline:
+            row = self.suite.row(request_id)
+            if row and row["status"] == status:
+                return True
+            time.sleep(0.05)
+        self.suite.failures.append(f"{request_id} never reached {status}")
+        return False
+
+    # Cases
+
+    def retried(self):
+        s = self.suite
+        request_id = self._submit()
+        self.receiver.reject.update({f"{request_id}:processing", f"{request_id}:completed"})
+        # Each step lands before the next, so every milestone is its own event
+        self._publish(request_id, "processing")
+        if not self._wait_status(request_id, "processing"):
+            return
+        for progress in (25, 50, 75):
+            self._publish(request_id, "progress", progress)
+            time.sleep(FLUSH_INTERVAL * 3)
+        self._publish(request_id, "completed")
+
+        self.receiver.wait_for(request_id, lambda events: labels(events).count("completed:0") >= 2)
+        time.sleep(1)  # for any duplicate still in flight
+        events = self.receiver.events(request_id)
+        want = ["processing:0", "processing:0", "progress:25", "progress:50", "progress:75",
+                "completed:0", "completed:0"]
+        s.expect(labels(events) == want, f"retried request: received {labels(events)}, want {want}")
+        ids = {e.get("event_id") for e in events}
+        s.expect(len(ids) == len(LIFECYCLE),
+                 f"retried request: {len(ids)} distinct event_ids over {len(LIFECYCLE)} events, "
+                 f"want redeliveries to repeat theirs")
+        problem = check_order(events)
+        s.expect(problem is None, f"retried request: {problem}")
+
+    def racing(self):
+        s = self.suite
+        request_id = self._submit()
+        for status, progress in LIFECYCLE:
+            self._publish(request_id, status, progress)
+        self.receiver.wait_for(request_id, lambda events: any(e.get("status") == "completed" for e in events))
+        time.sleep(FLUSH_INTERVAL * 3 + 1)  # for a milestone flushed after the completion
+        events = self.receiver.events(request_id)
+        problem = check_order(events)
+        s.expect(problem is None, f"racing request: {problem}")
+        s.expect(events and events[-1].get("status") == "completed",
+                 f"racing request: received {labels(events)}, want the completion last")
+        logger.info(f"📨 events published back to back: {len(events)} of {len(LIFECYCLE)} sent")
+
+    def late_milestone(self):
+        s = self.suite
+        request_id = self._submit()
+        self._publish(request_id, "completed")
+        if not self._wait_status(request_id, "completed"):
+            return
+        self._publish(request_id, "progress", 75)
+        self.receiver.wait_for(request_id, lambda events: bool(events))
+        time.sleep(FLUSH_INTERVAL * 3 + 1)
+        events = self.receiver.events(request_id)
+        s.expect(labels(events) == ["completed:0"], f"late milestone: received {labels(events)}, "
+                                                    f"want only the completion")
+
+    def encrypted_payloads(self):
+        s = self.suite
+        with s.db.cursor() as cur:
+            cur.execute("""
+                SELECT payload->>'status', payload->>'prompt' FROM notification_deliveries
+                WHERE order_key LIKE %s""", (f"{self.channel_id}:%",))
+            stored = cur.fetchall()
+        statuses = {status for status, _ in stored}
+        s.expect({"processing", "progress", "completed"} <= statuses,
+                 f"queued webhook events have statuses {sorted(statuses)}, want processing, progress and completed")
+        plain = sorted({status for status, prompt in stored if not (prompt or "").startswith("enc:")})
+        s.expect(not plain, f"queued {plain} events keep their prompt in plaintext")
+        with self.receiver.lock:
+            sent = [e for events in self.receiver.received.values() for e in events]
+        wrong = sorted({e.get("status") for e in sent if e.get("prompt") != PROMPT})
+        s.expect(sent and not wrong, f"{wrong} events reached the endpoint without the plaintext prompt")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    receiver = Receiver()
+    try:
+        suite.setup(boot=True, backend_env={
+            "SECRETS_KEY": base64.b64encode(secrets.token_bytes(32)).decode(),
+            "PROMPT_ENCRYPTION_KEYS": "order:" + base64.b64encode(secrets.token_bytes(32)).decode(),
+            "NOTIFY_ALLOW_PRIVATE_TARGETS": "true",
+            "NOTIFY_MIN_INTERVAL": "0s",
+            "NOTIFY_POLL_INTERVAL": "100ms",
+            "PROGRESS_FLUSH_INTERVAL": f"{FLUSH_INTERVAL * 1000:.0f}ms",
+        })
+        WebhookOrderTester(suite, receiver).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    receiver.stop()
+    ok = suite.finish("webhook events arrive in order, once each, with their prompts encrypted while queued")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
@@ -0,0 +1,188 @@
+#!/usr/bin/env python3
+"""
+Checks per-model capacity (capacity.go) against several simulated workers that change
+their capacity, go quiet and come back, built on integration_fixtures.py.
+
+Start Redis and Postgres with `docker compose -f docker-compose.test.yml up -d --wait`,
+then run
+
+    python test_worker_capacity.py --boot
+
+which starts the backend with a 1s WORKER_HEARTBEAT_INTERVAL and an admin of its own. To
+use a backend already running at GO_BACKEND_URL instead, set CAPACITY_ADMIN_ID to a user in
+its ADMIN_USER_IDS and WORKER_HEARTBEAT_INTERVAL_SECONDS to its interval. Needs
+`pip install psycopg2-binary`. The workers heartbeat a model of their own, built with
+src/messages.py, so no real worker is needed and none is disturbed. It checks, through
+GET /admin/queue and GET /models, that:
+
+- the model's workers, max_concurrent and current_load are the sums of the live reports
+- a capacity change shows on the next heartbeat, and a saturated model reads degraded
+- a worker that goes quiet still counts for up to two intervals, then drops out
+- a draining worker stops counting at once, while still heartbeating
+- with every worker gone the model is unavailable, and a worker coming back restores it
+"""
+
+import os
+import sys
+import json
+import time
+import uuid
+import threading
+import logging
+
+from integration_fixtures import Backend, Suite
+from src import messages
+
+logging.basicConfig(level=logging.INFO)
+logger = logging.getLogger(__name__)
+
+HEARTBEAT_CHANNEL = "worker_heartbeats"
+
+
+class SimulatedWorker:
+    """Heartbeats its current state every interval until stopped"""
+
+    def __init__(self, redis_client, worker_id, model, max_concurrent, interval):
+        self.redis_client = redis_client
+        self.worker_id = worker_id
+        self.model = model
+        self.max_concurrent = max_concurrent
+        self.current_load = 0
+        self.draining = False
+        self.interval = interval
+        self.stopped = threading.Event()
+        self.thread = None
+
+    def start(self):
+        self.stopped.clear()
+        self.beat()
+        self.thread = threading.Thread(target=self._run, daemon=True)
+        self.thread.start()
+        return self
+
+    def stop(self):
+        """Goes quiet, as a worker that died would"""
+        self.stopped.set()
+        self.thread.join()
+
+    def beat(self):
+        self.redis_client.publish(HEARTBEAT_CHANNEL, json.dumps(messages.heartbeat(
+            self.worker_id, self.model, self.max_concurrent, self.current_load, draining=self.draining)))
+
+    def _run(self):
+        while not self.stopped.wait(self.interval):
+            self.beat()
+
+
+class WorkerCapacityTester:
+    def __init__(self, suite, admin_id, interval):
+        self.suite = suite
+        self.admin_id = admin_id
+        self.interval = interval
+        self.model = f"capacity-check-{uuid.uuid4().hex[:8]}"
+        self.workers = {}
+
+    def _worker(self, name, max_concurrent):
+        w = SimulatedWorker(self.suite.redis_client, f"{name}-{self.model}", self.model, max_concurrent,
+                            self.interval)
+        self.workers[name] = w
+        return w.start()
+
+    def _capacity(self):
+        resp = self.suite.api("GET", "/admin/queue", self.admin_id)
+        if resp.status_code != 200:
+            self.suite.failures.append(f"GET /admin/queue: status {resp.status_code} {resp.text}")
+            return None
+        return next((m for m in resp.json()["models"] if m["model"] == self.model), None)
+
+    def _availability(self):
+        resp = self.suite.api("GET", "/models", self.admin_id)
+        if resp.status_code != 200:
+            return None
+        return next((m["availability"] for m in resp.json()["models"] if m["model"] == self.model), None)
+
+    def _wait(self, what, workers, max_concurrent, current_load=0, availability="available", timeout=None):
+        """Polls /admin/queue until the model reads as given, failing with the last reading"""
+        want = {"workers": workers, "max_concurrent": max_concurrent, "current_load": current_load,
+                "availability": availability}
+        deadline = time.time() + (timeout or 3 * self.interval + 2)
+        got = None
+        while time.time() < deadline:
+            mc = self._capacity()
+            got = mc and {k: mc[k] for k in want}
+            if got == want:
+                return True
+            time.sleep(0.1)
+        self.suite.failures.append(f"{what}: {self.model} reads {got}, want {want}")
+        return False
+
+    def run(self):
+        try:
+            self._run()
+        finally:
+            for w in self.workers.values():
+                if not w.stopped.is_set():
+                    w.stop()
+
+    def _run(self):
+        s = self.suite
+        a, b, c = self._worker("a", 4), self._worker("b", 2), self._worker("c", 2)
+        if not self._wait("three workers", 3, 8):
+            return
+        s.expect(self._availability() == "available", f"GET /models: {self._availability()}, want available")
+
+        b.max_concurrent = 6
+        a.current_load, c.current_load = 3, 1
+        self._wait("b raised its capacity", 3, 12, current_load=4)
+
+        a.current_load, b.current_load, c.current_load = 4, 6, 2
+        self._wait("every slot busy", 3, 12, current_load=12, availability="degraded")
+        a.current_load, b.current_load, c.current_load = 1, 0, 0
+
+        # Silence: c still counts until two intervals have passed, then drops out
+        self._wait("loads back down", 3, 12, current_load=1)
+        # c's last heartbeat was at most an interval before it stopped, so half an interval
+        # on it's under two intervals old, and it can't drop out within one
+        c.stop()
+        went_quiet = time.time()
+        time.sleep(self.interval / 2)
+        held = self._capacity()
+        s.expect(held is not None and held["workers"] == 3,
+                 f"c dropped out {time.time() - went_quiet:.1f}s after going quiet, under two intervals")
+        self._wait("c went quiet", 2, 10, current_load=1)
+        s.expect(time.time() - went_quiet >= self.interval,
+                 f"c dropped out {time.time() - went_quiet:.1f}s after going quiet, under two intervals")
+
+        a.draining = True
+        a.beat()
+        self._wait("a is draining", 1, 6, timeout=2)
+
+        a.stop()
+        b.stop()
+        self._wait("every worker gone", 0, 0, availability="unavailable")
+        s.expect(self._availability() == "unavailable", f"GET /models: {self._availability()}, want unavailable")
+
+        c.start()
+        self._wait("c came back", 1, 2)
+        s.expect(self._availability() == "available", f"GET /models after c came back: {self._availability()}")
+
+
+if __name__ == "__main__":
+    started = time.time()
+    suite = Suite()
+    try:
+        suite.setup()
+        if "--boot" in sys.argv:
+            interval = 1.0
+            admin_id = suite.create_user()
+            suite.backend = Backend({"ADMIN_USER_IDS": admin_id, "WORKER_HEARTBEAT_INTERVAL": "1s"})
+            suite.backend.start()
+        else:
+            interval = float(os.getenv("WORKER_HEARTBEAT_INTERVAL_SECONDS", "10"))
+            admin_id = os.environ["CAPACITY_ADMIN_ID"]
+        WorkerCapacityTester(suite, admin_id, interval).run()
+    except Exception as e:
+        suite.failures.append(f"setup failed: {e}")
+    ok = suite.finish("capacity follows the workers as they change, go quiet and come back")
+    logger.info(f"⏱️ {time.time() - started:.1f}s")
+    raise SystemExit(0 if ok else 1)
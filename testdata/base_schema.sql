@@ -0,0 +1,17 @@
+-- testdata/base_schema.sql
+-- Stand-ins for the backend's own users and generated_content tables, so a scratch
+-- database can take the migrations on top. Only the columns they don't add are here
+
+CREATE TABLE IF NOT EXISTS users (
+    id         UUID PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS generated_content (
+    id           BIGSERIAL PRIMARY KEY,
+    request_id   TEXT NOT NULL,
+    user_id      UUID NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    content_type TEXT NOT NULL,
+    content_url  TEXT NOT NULL DEFAULT ''
+);
@@ -0,0 +1,99 @@
+// text.go
+// The text generation kind, answered synchronously with the conversation's history
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Text has a bucket of its own, far roomier than the GPU kinds' and free by default
+var (
+	textRateLimit   = getEnvInt("TEXT_RATE_LIMIT", 300)
+	textMaxInFlight = getEnvInt("TEXT_MAX_IN_FLIGHT", 3)
+	textCreditCost  = getEnvInt("TEXT_CREDIT_COST", 0)
+)
+
+func init() {
+	registerKind(&GenerationKind{Name: "text", Label: "Text", Handle: handleTextGeneration,
+		BaseCredits: func() int { return textCreditCost },
+		Limits:      KindLimits{RateLimit: textRateLimit, MaxInFlight: textMaxInFlight}})
+}
+
+// createTextGeneration stores the reply through genRepo, encrypted like any prompt (it is
+// read back through scanGeneration). genRepo writes whatever it is given, so the request
+// is checked to be the user's before (nothing is written over another user's row) and
+// after (the stored row must be the user's)
+func createTextGeneration(ctx context.Context, userID, reqID uuid.UUID, text string) error {
+	if err := verifyRequestOwner(ctx, db, reqID.String(), userID.String()); err != nil {
+		return err
+	}
+	sealed, err := encryptPrompt(text)
+	if err != nil {
+		return err
+	}
+	if err := genRepo.Create(userID, reqID, time.Now(), sealed, "text", "", false); err != nil {
+		return err
+	}
+	return verifyRequestOwner(ctx, db, reqID.String(), userID.String())
+}
+
+// handleTextGeneration generates the reply inline and stores it with the conversation turns
+func handleTextGeneration(c *gin.Context, user *repository.User, req RequestPayload, reqID uuid.UUID) {
+	ctx := c.Request.Context()
+	conversationID, err := ensureConversation(ctx, user.ID.String(), req.ConversationID, req.Text)
+	if err == errConversationNotFound {
+		fieldError(c, codeNotFound, "conversation_id", "conversation not found")
+		return
+	}
+	if err != nil {
+		respondError(c, codeInternal, "cannot load conversation")
+		return
+	}
+	history, err := conversationHistory(ctx, conversationID, estimateTokens(req.Text))
+	if err != nil {
+		respondError(c, codeInternal, "cannot load conversation")
+		return
+	}
+
+	userTurn := ChatMessage{Role: "user", Content: req.Text}
+	textReq := TextGenerationRequest{
+		RequestID:      reqID.String(),
+		UserID:         user.ID.String(),
+		ConversationID: conversationID,
+		Messages:       append(history, userTurn),
+	}
+	if err := publishTextGenerationRequest(ctx, currentTenant(c).ID, textReq); err != nil {
+		log.Printf("⚠️ Failed to publish text generation request %s: %v", reqID, err)
+	}
+	respText := generateText(textReq)
+
+	// Save to database as before
+	if err := createTextGeneration(ctx, user.ID, reqID, respText); err != nil {
+		log.Printf("❌ Failed to save text generation %s: %v", reqID, err)
+		respondError(c, codeInternal, "cannot save generated content")
+		return
+	}
+	if err := recordGenerationClient(ctx, reqID.String(), requestClient(c)); err != nil {
+		log.Printf("⚠️ Failed to record the client of text generation %s: %v", reqID, err)
+	}
+
+	if err := appendConversationTurns(ctx, conversationID, reqID.String(), userTurn,
+		ChatMessage{Role: "assistant", Content: respText}); err != nil {
+		log.Printf("⚠️ Failed to store conversation turns for %s: %v", conversationID, err)
+	}
+
+	c.JSON(http.StatusOK, CompletedTextResponse{
+		Type:                "text",
+		Status:              "completed",
+		GenerationRequestID: reqID.String(),
+		Data:                respText,
+		ConversationID:      conversationID,
+	})
+}
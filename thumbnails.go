@@ -0,0 +1,99 @@
+// thumbnails.go
+// Small previews of generated images for galleries and lists
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+var thumbnailMaxSide = getEnvInt("THUMBNAIL_MAX_SIDE", 256)
+
+// thumbnailKey sits next to the original; "-final" copies share the original's thumbnail
+func thumbnailKey(contentKey string) string {
+	base := strings.TrimSuffix(strings.TrimSuffix(contentKey, ".png"), "-final")
+	return base + "-thumb.png"
+}
+
+// makeThumbnail scales img so its longer side is thumbnailMaxSide, never upscaling
+func makeThumbnail(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if longest := max(w, h); longest > thumbnailMaxSide {
+		w, h = max(w*thumbnailMaxSide/longest, 1), max(h*thumbnailMaxSide/longest, 1)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// storeThumbnail uploads the thumbnail for a decoded image and records its key
+func storeThumbnail(ctx context.Context, requestID, contentKey string, img image.Image) error {
+	data, err := makeThumbnail(img)
+	if err != nil {
+		return err
+	}
+	key := thumbnailKey(contentKey)
+	if err := storage.Put(ctx, key, data, "image/png"); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `UPDATE generated_content SET thumbnail_key = $1 WHERE request_id = $2`, key, requestID)
+	return err
+}
+
+// backfillThumbnail is the per-row step of the "thumbnails" backfill
+func backfillThumbnail(ctx context.Context, requestID string) error {
+	var contentKey string
+	err := db.QueryRowContext(ctx, `SELECT content_url FROM generated_content WHERE request_id = $1`,
+		requestID).Scan(&contentKey)
+	if err != nil {
+		return err
+	}
+	data, err := storage.Get(ctx, contentKey)
+	if err != nil {
+		return err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := storeThumbnail(ctx, requestID, contentKey, img); err != nil {
+		return err
+	}
+	recordGenerationStorage(ctx, requestID)
+	return nil
+}
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        "thumbnails",
+		Description: "Create thumbnails for completed images that don't have one",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			return queryKeys(ctx, `
+				SELECT request_id FROM generated_content
+				WHERE request_id > $1 AND content_type = 'image' AND status = 'completed'
+				  AND content_url <> '' AND thumbnail_key IS NULL
+				ORDER BY request_id LIMIT $2`, cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			var n int64
+			err := db.QueryRowContext(ctx, `
+				SELECT count(*) FROM generated_content
+				WHERE content_type = 'image' AND status = 'completed'
+				  AND content_url <> '' AND thumbnail_key IS NULL`).Scan(&n)
+			return n, err
+		},
+		Process: backfillThumbnail,
+	})
+}
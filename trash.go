@@ -0,0 +1,249 @@
+// trash.go
+// Soft delete: DELETE /generations/:id moves a row to the trash, where it stays
+// restorable until the purge job removes it (and its objects) for good
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const trashPurgeLockKey = "trash:purge:lock"
+
+var (
+	trashRetention     = getEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+	trashPurgeInterval = getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+)
+
+// purgeGeneration deletes the stored objects, then the row. Objects go first so a
+// failure leaves a row the next purge can retry, never orphaned objects
+func purgeGeneration(ctx context.Context, requestID string) error {
+	g, err := scanExpiring(db.QueryRowContext(ctx, `
+		SELECT `+expiringColumns+`
+		FROM generated_content g WHERE g.request_id = $1`, requestID))
+	if err != nil {
+		return err
+	}
+	for _, key := range g.objectKeys() {
+		if err := storage.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	if err := setStoredBytes(ctx, requestID, 0); err != nil {
+		return err
+	}
+	if _, err = db.ExecContext(ctx, `DELETE FROM generated_content WHERE request_id = $1`, requestID); err != nil {
+		return err
+	}
+	dropStatusRecord(ctx, requestID)
+	return nil
+}
+
+// startTrashPurge permanently removes items trashed longer than TRASH_RETENTION
+func startTrashPurge() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("trash_purge", nil, func() {
+			ctx := backgroundStorage(context.Background())
+			ok, err := rdb.SetNX(ctx, trashPurgeLockKey, "1", trashPurgeInterval).Result()
+			if err != nil || !ok {
+				return
+			}
+			defer rdb.Del(ctx, trashPurgeLockKey)
+			purgeTrash(ctx)
+		})
+	}
+}
+
+func purgeTrash(ctx context.Context) {
+	throttle := time.NewTicker(time.Second / time.Duration(max(retentionDeletesPerSecond, 1)))
+	defer throttle.Stop()
+
+	for {
+		ids, err := queryKeys(ctx, `
+			SELECT request_id FROM generated_content
+			WHERE trashed_at < $1 ORDER BY trashed_at LIMIT 100`, time.Now().Add(-trashRetention))
+		if err != nil {
+			log.Printf("❌ Failed to load trash to purge: %v", err)
+			return
+		}
+		if len(ids) == 0 {
+			return
+		}
+		purged := 0
+		for _, id := range ids {
+			<-throttle.C
+			if err := purgeGeneration(ctx, id); err != nil {
+				log.Printf("⚠️ Failed to purge generation %s: %v", id, err)
+				continue
+			}
+			purged++
+		}
+		log.Printf("🗑️ Purged %d trashed generations", purged)
+		if purged == 0 {
+			return // everything in this batch failed; try again next tick
+		}
+	}
+}
+
+// deleteGenerationHandler handles DELETE /generations/:id[?permanent=true]
+func deleteGenerationHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	g, err := getGeneration(ctx, c.Param("id"), user.ID.String())
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to delete generation")
+		return
+	}
+	switch g.Status {
+	case "queued", "processing", "deferred", generationPendingModeration:
+		respondError(c, codeConflict, "Generation is still in progress; cancel it or wait for it to finish")
+		return
+	}
+
+	if c.Query("permanent") == "true" {
+		if err := purgeGeneration(ctx, g.RequestID); err != nil {
+			log.Printf("❌ Failed to purge generation %s: %v", g.RequestID, err)
+			respondError(c, codeInternal, "Failed to delete generation")
+			return
+		}
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE generated_content SET trashed_at = now()
+		WHERE request_id = $1 AND user_id = $2 AND trashed_at IS NULL`, g.RequestID, user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to trash generation %s: %v", g.RequestID, err)
+		respondError(c, codeInternal, "Failed to delete generation")
+		return
+	}
+	revokeDeepLinks(ctx, g.RequestID)
+	invalidatePromptSuggestions(ctx, user.ID.String())
+	purgeAfter := clock.Now().Add(trashRetention)
+	c.JSON(http.StatusOK, TrashStateResponse{RequestID: g.RequestID, Trashed: true, PurgeAfter: &purgeAfter})
+}
+
+// restoreGenerationHandler handles POST /generations/:id/restore
+func restoreGenerationHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+
+	res, err := db.ExecContext(c.Request.Context(), `
+		UPDATE generated_content SET trashed_at = NULL
+		WHERE request_id = $1 AND user_id = $2 AND trashed_at IS NOT NULL`, c.Param("id"), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to restore generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to restore generation")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "Generation not found in trash")
+		return
+	}
+	invalidatePromptSuggestions(c.Request.Context(), user.ID.String())
+	c.JSON(http.StatusOK, TrashStateResponse{RequestID: c.Param("id"), Trashed: false})
+}
+
+// trashKeyset pages GET /generations/trash, most recently trashed first
+var trashKeyset = keyset{Scope: "trash", Columns: []string{"trashed_at", "request_id"}, Desc: true, Before: true}
+
+// listTrashHandler handles GET /generations/trash[?tag=], most recently trashed first
+func listTrashHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	size, ok := sizeParam(c, renditionThumbnail)
+	if !ok {
+		return
+	}
+	tags, ok := tagParams(c)
+	if !ok {
+		return
+	}
+	filter := user.ID.String() + "|" + strings.Join(tags, ",")
+	keys, limit, ok := cursorParams(c, trashKeyset, filter)
+	if !ok {
+		return
+	}
+
+	after, keyArgs := trashKeyset.where(keys, 4)
+	rows, err := db.QueryContext(c.Request.Context(), `
+		SELECT `+generationColumns+`
+		FROM generated_content
+		WHERE user_id = $1 AND trashed_at IS NOT NULL AND tags @> $3 AND `+after+`
+		ORDER BY `+trashKeyset.orderBy()+` LIMIT $2`,
+		append([]interface{}{user.ID.String(), limit, pq.Array(tags)}, keyArgs...)...)
+	if err != nil {
+		log.Printf("❌ Failed to list trash for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to list trash")
+		return
+	}
+	defer rows.Close()
+
+	list := []*Generation{}
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			respondError(c, codeInternal, "Failed to list trash")
+			return
+		}
+		withGenerationURLs(c.Request.Context(), g, size)
+		list = append(list, g)
+	}
+
+	resp := GenerationListResponse{Generations: list}
+	if len(list) == limit {
+		last := list[len(list)-1]
+		resp.NextCursor = trashKeyset.encode(filter, *last.TrashedAt, last.RequestID)
+		resp.NextBefore = last.TrashedAt.Format(time.RFC3339Nano)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// emptyTrashBatch caps one DELETE /generations/trash; the response says what is left
+const emptyTrashBatch = 200
+
+// emptyTrashHandler handles DELETE /generations/trash, purging the caller's trash now
+// instead of after TRASH_RETENTION. Over-quota errors point here
+func emptyTrashHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+
+	ids, err := queryKeys(ctx, `
+		SELECT request_id FROM generated_content
+		WHERE user_id = $1 AND trashed_at IS NOT NULL ORDER BY trashed_at LIMIT $2`, user.ID.String(), emptyTrashBatch)
+	if err != nil {
+		log.Printf("❌ Failed to load trash for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to empty trash")
+		return
+	}
+	purged, failed := 0, 0
+	for _, id := range ids {
+		if err := purgeGeneration(ctx, id); err != nil {
+			log.Printf("⚠️ Failed to purge generation %s: %v", id, err)
+			failed++
+			continue
+		}
+		purged++
+	}
+
+	var remaining int
+	db.QueryRowContext(ctx, `SELECT count(*) FROM generated_content WHERE user_id = $1 AND trashed_at IS NOT NULL`,
+		user.ID.String()).Scan(&remaining)
+	c.JSON(http.StatusOK, gin.H{"purged": purged, "failed": failed, "remaining": remaining})
+}
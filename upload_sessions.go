@@ -0,0 +1,382 @@
+// upload_sessions.go
+// Resumable uploads for inputs too large to send reliably in one request: the client
+// opens a session, sends numbered chunks (retrying any that fail) and completes it
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	uploadCleanupLockKey = "uploads:cleanup:lock"
+	chunkChecksumHeader  = "X-Chunk-SHA256"
+)
+
+var (
+	uploadChunkMaxBytes   = getEnvInt("UPLOAD_CHUNK_MAX_BYTES", 1<<20)
+	uploadSessionTTL      = getEnvDuration("UPLOAD_SESSION_TTL", time.Hour)
+	uploadMaxSessions     = getEnvInt("UPLOAD_MAX_SESSIONS", 3) // open at once per user
+	uploadCleanupInterval = getEnvDuration("UPLOAD_CLEANUP_INTERVAL", 10*time.Minute)
+)
+
+// UploadSession is the resumable upload state a client polls to pick up where it left off
+type UploadSession struct {
+	ID            string    `json:"id"`
+	Status        string    `json:"status"` // open or completed
+	Size          int64     `json:"size"`
+	ReceivedBytes int64     `json:"received_bytes"`
+	NextChunk     int       `json:"next_chunk"`
+	ChunkMaxBytes int       `json:"chunk_max_bytes"`
+	Key           string    `json:"key,omitempty"`        // the input_key, once completed
+	Moderation    string    `json:"moderation,omitempty"` // the upload's moderation state, once completed
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	checksum string
+}
+
+// chunkKey holds chunk n until the session completes; it's outside every user's uploads/
+// prefix, so a partial upload can never be referenced as an input
+func chunkKey(sessionID string, n int) string {
+	return "upload-chunks/" + sessionID + "/" + strconv.Itoa(n)
+}
+
+// rowQuerier is *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// loadUploadSession reads userID's session, locked FOR UPDATE when lock is set (q a transaction)
+func loadUploadSession(ctx context.Context, q rowQuerier, id, userID string, lock bool) (*UploadSession, error) {
+	query := `
+		SELECT id, status, expected_bytes, received_bytes, next_chunk, coalesce(input_key, ''), expires_at, sha256
+		FROM upload_sessions
+		WHERE id = $1 AND user_id = $2 AND (status = 'completed' OR expires_at > now())`
+	if lock {
+		query += " FOR UPDATE"
+	}
+	s := &UploadSession{ChunkMaxBytes: uploadChunkMaxBytes}
+	err := q.QueryRowContext(ctx, query, id, userID).Scan(&s.ID, &s.Status, &s.Size, &s.ReceivedBytes,
+		&s.NextChunk, &s.Key, &s.ExpiresAt, &s.checksum)
+	return s, err
+}
+
+func validChecksum(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// createUploadSessionHandler handles POST /uploads with {"size", "sha256"} for the whole file
+func createUploadSessionHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	var body struct {
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, codeInvalidRequest, "Invalid JSON format")
+		return
+	}
+	body.SHA256 = strings.ToLower(body.SHA256)
+	if body.Size < 1 || body.Size > int64(uploadMaxBytes) {
+		fieldError(c, codeValidationFailed, "size", "must be between 1 and "+strconv.Itoa(uploadMaxBytes)+" bytes")
+		return
+	}
+	if !validChecksum(body.SHA256) {
+		fieldError(c, codeValidationFailed, "sha256", "must be the hex SHA-256 of the whole file")
+		return
+	}
+	if !checkStorageQuota(c, user.ID.String(), codeUploadOverQuota, body.Size) {
+		return
+	}
+
+	// The session cap is checked by the insert itself so parallel creates can't overshoot it
+	s := &UploadSession{ID: newID(), Status: "open", Size: body.Size, ChunkMaxBytes: uploadChunkMaxBytes}
+	err := db.QueryRowContext(c.Request.Context(), `
+		INSERT INTO upload_sessions (id, user_id, expected_bytes, sha256, expires_at)
+		SELECT $1, $2, $3, $4, now() + $5 * interval '1 second'
+		WHERE (SELECT count(*) FROM upload_sessions
+		       WHERE user_id = $2 AND status = 'open' AND expires_at > now()) < $6
+		RETURNING expires_at`,
+		s.ID, user.ID.String(), body.Size, body.SHA256, int64(uploadSessionTTL/time.Second), uploadMaxSessions).Scan(&s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		respondErrorDetails(c, codeRateLimited, "Too many uploads in progress", gin.H{"max_sessions": uploadMaxSessions})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to create upload session for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to start upload")
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// getUploadSessionHandler handles GET /uploads/:id
+func getUploadSessionHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	s, err := loadUploadSession(c.Request.Context(), db, c.Param("id"), user.ID.String(), false)
+	if err != nil {
+		respondTypedError(c, err, "Failed to load upload")
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// putUploadChunkHandler handles PUT /uploads/:id/chunks/:n. Chunks must arrive in order;
+// resending one already stored with the same checksum is a no-op, so clients can retry blindly
+func putUploadChunkHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil || n < 0 {
+		fieldError(c, codeInvalidRequest, "n", "must be a chunk number from 0")
+		return
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			respondErrorDetails(c, codeRequestTooLarge, "Chunk too large", gin.H{"chunk_max_bytes": uploadChunkMaxBytes})
+			return
+		}
+		respondError(c, codeInvalidRequest, "Unreadable chunk")
+		return
+	}
+	if len(data) == 0 {
+		respondError(c, codeValidationFailed, "Empty chunk")
+		return
+	}
+	checksum := sha256Hex(data)
+	if want := strings.ToLower(c.GetHeader(chunkChecksumHeader)); want != checksum {
+		respondErrorDetails(c, codeValidationFailed, chunkChecksumHeader+" does not match the chunk",
+			gin.H{"field": chunkChecksumHeader})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to store chunk")
+		return
+	}
+	defer tx.Rollback()
+
+	s, err := loadUploadSession(ctx, tx, c.Param("id"), user.ID.String(), true)
+	if err != nil {
+		respondTypedError(c, err, "Failed to store chunk")
+		return
+	}
+	if s.Status != "open" {
+		respondError(c, codeConflict, "Upload already completed")
+		return
+	}
+	if n < s.NextChunk {
+		var stored string
+		if err := tx.QueryRowContext(ctx, `SELECT sha256 FROM upload_chunks WHERE session_id = $1 AND n = $2`,
+			s.ID, n).Scan(&stored); err != nil || stored != checksum {
+			respondErrorDetails(c, codeConflict, "Chunk "+strconv.Itoa(n)+" was already stored with different data",
+				gin.H{"next_chunk": s.NextChunk})
+			return
+		}
+		c.JSON(http.StatusOK, s)
+		return
+	}
+	if n > s.NextChunk {
+		respondErrorDetails(c, codeConflict, "Chunks must be sent in order", gin.H{"next_chunk": s.NextChunk})
+		return
+	}
+	if s.ReceivedBytes+int64(len(data)) > s.Size {
+		respondErrorDetails(c, codeValidationFailed, "Chunk goes past the declared size",
+			gin.H{"size": s.Size, "received_bytes": s.ReceivedBytes})
+		return
+	}
+
+	if err := storage.Put(ctx, chunkKey(s.ID, n), data, "application/octet-stream"); err != nil {
+		log.Printf("❌ Failed to store chunk %d of upload %s: %v", n, s.ID, err)
+		respondError(c, codeUpstreamFailed, "Failed to store chunk")
+		return
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO upload_chunks (session_id, n, bytes, sha256) VALUES ($1, $2, $3, $4)`,
+		s.ID, n, len(data), checksum)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE upload_sessions SET next_chunk = next_chunk + 1, received_bytes = received_bytes + $2
+			WHERE id = $1`, s.ID, len(data))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("❌ Failed to record chunk %d of upload %s: %v", n, s.ID, err)
+		respondError(c, codeInternal, "Failed to store chunk")
+		return
+	}
+	s.NextChunk++
+	s.ReceivedBytes += int64(len(data))
+	c.JSON(http.StatusOK, s)
+}
+
+// completeUploadHandler handles POST /uploads/:id/complete: the chunks are assembled,
+// checked against the session's checksum and stored as an ordinary upload
+func completeUploadHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(c, codeInternal, "Failed to complete upload")
+		return
+	}
+	defer tx.Rollback()
+
+	s, err := loadUploadSession(ctx, tx, c.Param("id"), user.ID.String(), true)
+	if err != nil {
+		respondTypedError(c, err, "Failed to complete upload")
+		return
+	}
+	if s.Status == "completed" {
+		c.JSON(http.StatusOK, s)
+		return
+	}
+	if s.ReceivedBytes != s.Size {
+		respondErrorDetails(c, codeConflict, "Upload is missing chunks",
+			gin.H{"size": s.Size, "received_bytes": s.ReceivedBytes, "next_chunk": s.NextChunk})
+		return
+	}
+
+	var buf bytes.Buffer
+	for n := 0; n < s.NextChunk; n++ {
+		chunk, err := storage.Get(ctx, chunkKey(s.ID, n))
+		if err != nil {
+			log.Printf("❌ Failed to read chunk %d of upload %s: %v", n, s.ID, err)
+			respondError(c, codeUpstreamFailed, "Failed to complete upload")
+			return
+		}
+		buf.Write(chunk)
+	}
+
+	// Every chunk matched its own checksum, so a mismatch here means the client sent the
+	// wrong file; it has to start over. Release the row lock before removing it
+	if sha256Hex(buf.Bytes()) != s.checksum {
+		tx.Rollback()
+		removeUploadSession(ctx, s.ID, s.NextChunk)
+		respondErrorDetails(c, codeValidationFailed, "Assembled upload does not match sha256; start a new upload",
+			gin.H{"field": "sha256"})
+		return
+	}
+	key, _, moderation, err := storeInput(ctx, user.ID.String(), buf.Bytes())
+	if errors.Is(err, errUnsupportedUpload) {
+		tx.Rollback()
+		removeUploadSession(ctx, s.ID, s.NextChunk)
+		respondErrorDetails(c, codeValidationFailed, "upload "+err.Error(), gin.H{"field": "file"})
+		return
+	}
+	var rejection *moderationRejection
+	if errors.As(err, &rejection) {
+		tx.Rollback()
+		removeUploadSession(ctx, s.ID, s.NextChunk)
+		respondRefusedInput(c, err)
+		return
+	}
+	if errors.Is(err, errModerationUnavailable) {
+		tx.Rollback() // the chunks stay, so completing again can retry
+		respondRefusedInput(c, err)
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to store upload %s: %v", s.ID, err)
+		respondError(c, codeUpstreamFailed, "Failed to complete upload")
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE upload_sessions SET status = 'completed', input_key = $2, completed_at = now() WHERE id = $1`,
+		s.ID, key); err != nil || tx.Commit() != nil {
+		respondError(c, codeInternal, "Failed to complete upload")
+		return
+	}
+	deleteChunks(ctx, s.ID, s.NextChunk)
+	s.Status, s.Key, s.Moderation = "completed", key, moderation
+	c.JSON(http.StatusOK, s)
+}
+
+// deleteChunks removes chunk objects 0..next inclusive: next covers a chunk stored just
+// before its transaction failed
+func deleteChunks(ctx context.Context, sessionID string, next int) {
+	for n := 0; n <= next; n++ {
+		if err := storage.Delete(ctx, chunkKey(sessionID, n)); err != nil {
+			log.Printf("⚠️ Failed to delete chunk %d of upload %s: %v", n, sessionID, err)
+		}
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM upload_chunks WHERE session_id = $1`, sessionID); err != nil {
+		log.Printf("⚠️ Failed to forget chunks of upload %s: %v", sessionID, err)
+	}
+}
+
+// removeUploadSession drops a session and everything it stored, even if the client has gone
+func removeUploadSession(ctx context.Context, sessionID string, next int) {
+	ctx = context.WithoutCancel(ctx)
+	deleteChunks(ctx, sessionID, next)
+	if _, err := db.ExecContext(ctx, `DELETE FROM upload_sessions WHERE id = $1`, sessionID); err != nil {
+		log.Printf("⚠️ Failed to remove upload %s: %v", sessionID, err)
+	}
+}
+
+// startUploadCleanup removes sessions past UPLOAD_SESSION_TTL with their partial data.
+// Completed sessions go too; their input stays with the user's other uploads
+func startUploadCleanup() {
+	ticker := time.NewTicker(uploadCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("upload_cleanup", nil, func() {
+			ctx := context.Background()
+			ok, err := rdb.SetNX(ctx, uploadCleanupLockKey, "1", uploadCleanupInterval).Result()
+			if err != nil || !ok {
+				return
+			}
+			defer rdb.Del(ctx, uploadCleanupLockKey)
+
+			rows, err := db.QueryContext(ctx, `
+				SELECT id, next_chunk FROM upload_sessions WHERE expires_at < now() LIMIT 500`)
+			if err != nil {
+				log.Printf("❌ Failed to load expired uploads: %v", err)
+				return
+			}
+			type expired struct {
+				id   string
+				next int
+			}
+			var list []expired
+			for rows.Next() {
+				var e expired
+				if err := rows.Scan(&e.id, &e.next); err == nil {
+					list = append(list, e)
+				}
+			}
+			rows.Close()
+
+			for _, e := range list {
+				removeUploadSession(ctx, e.id, e.next)
+			}
+			if len(list) > 0 {
+				log.Printf("🧹 Removed %d expired upload sessions", len(list))
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+// usage.go
+// Storage accounting per user. Each row records the bytes of its own objects in
+// stored_bytes and storage_usage keeps the per-user total, moved by the difference
+// whenever a row is measured or released. Uploads add their size directly. A nightly
+// reconciliation lists the bucket and corrects whatever drifted
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const storageReconcileKey = "storage_usage:reconciled"
+
+var (
+	storageReconcileInterval = getEnvDuration("STORAGE_RECONCILE_INTERVAL", 24*time.Hour)
+	// Objects under these prefixes belong to the user named by the next path segment
+	userStoragePrefixes = []string{"uploads/"}
+
+	storageCorrections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_storage_usage_corrections_total",
+		Help: "Per-user storage totals corrected by reconciliation, by direction (up, down).",
+	}, []string{"direction"})
+)
+
+// StorageUsage is the storage part of GET /usage. CapBytes 0 means unlimited
+type StorageUsage struct {
+	UsedBytes    int64      `json:"used_bytes"`
+	CapBytes     int64      `json:"cap_bytes"`
+	TrashBytes   int64      `json:"trash_bytes"` // freed by DELETE /generations/trash
+	ReconciledAt *time.Time `json:"reconciled_at,omitempty"`
+}
+
+func (u StorageUsage) over(extra int64) bool {
+	return u.CapBytes > 0 && u.UsedBytes+extra > u.CapBytes
+}
+
+// loadStorageUsage returns userID's total and their plan's cap
+func loadStorageUsage(ctx context.Context, userID string) (StorageUsage, error) {
+	u := StorageUsage{CapBytes: userPlanLimits(ctx, userID).StorageBytes}
+	err := db.QueryRowContext(ctx, `
+		SELECT coalesce((SELECT bytes FROM storage_usage WHERE user_id = $1), 0),
+		       (SELECT reconciled_at FROM storage_usage WHERE user_id = $1),
+		       (SELECT coalesce(sum(stored_bytes), 0) FROM generated_content
+		        WHERE user_id = $1 AND trashed_at IS NOT NULL)`, userID).
+		Scan(&u.UsedBytes, &u.ReconciledAt, &u.TrashBytes)
+	return u, err
+}
+
+// checkStorageQuota refuses with code (402 for generations, 413 for uploads) when extra
+// more bytes would put the user over their plan's cap. Failing to load the total lets
+// the request through; the next reconciliation catches up
+func checkStorageQuota(c *gin.Context, userID, code string, extra int64) bool {
+	u, err := loadStorageUsage(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load storage usage for %s: %v", userID, err)
+		return true
+	}
+	if !u.over(extra) {
+		return true
+	}
+	details := gin.H{"used_bytes": u.UsedBytes, "cap_bytes": u.CapBytes, "trash_bytes": u.TrashBytes}
+	if u.TrashBytes > 0 {
+		// The cheapest way back under the cap is usually already in the trash
+		details["remediation"] = gin.H{"method": http.MethodDelete, "path": "/generations/trash",
+			"frees_bytes": u.TrashBytes}
+	}
+	respondErrorDetails(c, code, "Storage quota exceeded", details)
+	return false
+}
+
+const addStorageSQL = `
+	INSERT INTO storage_usage (user_id, bytes) VALUES ($1, greatest($2, 0))
+	ON CONFLICT (user_id) DO UPDATE SET bytes = greatest(storage_usage.bytes + $2, 0), updated_at = now()`
+
+// addUserStorage moves userID's total by delta, e.g. for an upload
+func addUserStorage(ctx context.Context, userID string, delta int64) {
+	if _, err := db.ExecContext(ctx, addStorageSQL, userID, delta); err != nil {
+		log.Printf("⚠️ Failed to record %d stored bytes for %s: %v", delta, userID, err)
+	}
+}
+
+// setStoredBytes records that the row now holds bytes and moves its owner's total by
+// the change. Setting the same value again is a no-op, so measuring twice is safe
+func setStoredBytes(ctx context.Context, requestID string, bytes int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	var old int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, stored_bytes FROM generated_content WHERE request_id = $1 FOR UPDATE`, requestID).
+		Scan(&userID, &old)
+	if err == sql.ErrNoRows || (err == nil && old == bytes) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE generated_content SET stored_bytes = $2 WHERE request_id = $1`,
+		requestID, bytes); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, addStorageSQL, userID, bytes-old); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// measureGeneration sizes every object the row holds and records the total
+func measureGeneration(ctx context.Context, requestID string) error {
+	g, err := scanExpiring(db.QueryRowContext(ctx, `
+		SELECT `+expiringColumns+` FROM generated_content g WHERE g.request_id = $1`, requestID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, key := range g.objectKeys() {
+		size, err := objectSize(ctx, key)
+		if err != nil {
+			return err
+		}
+		total += size
+	}
+	return setStoredBytes(ctx, requestID, total)
+}
+
+// recordGenerationStorage is measureGeneration for callers that carry on regardless
+func recordGenerationStorage(ctx context.Context, requestID string) {
+	if err := measureGeneration(ctx, requestID); err != nil {
+		log.Printf("⚠️ Failed to measure storage for %s: %v", requestID, err)
+	}
+}
+
+// objectSize is key's size, 0 if it doesn't exist. Storage has no stat, but a one-entry
+// listing from the key itself returns it first when it exists
+func objectSize(ctx context.Context, key string) (int64, error) {
+	page, _, err := storage.List(ctx, key, "", 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(page) == 1 && page[0].Key == key {
+		return page[0].Size, nil
+	}
+	return 0, nil
+}
+
+func init() {
+	registerBackfill(&BackfillJob{
+		Name:        "stored_bytes",
+		Description: "Measure the stored objects of generations from before storage accounting",
+		Next: func(ctx context.Context, cursor string, limit int) ([]string, error) {
+			return queryKeys(ctx, `
+				SELECT request_id FROM generated_content
+				WHERE request_id > $1 AND stored_bytes = 0 AND content_url <> ''
+				ORDER BY request_id LIMIT $2`, cursor, limit)
+		},
+		Count: func(ctx context.Context) (int64, error) {
+			var n int64
+			err := db.QueryRowContext(ctx, `
+				SELECT count(*) FROM generated_content WHERE stored_bytes = 0 AND content_url <> ''`).Scan(&n)
+			return n, err
+		},
+		Process: measureGeneration,
+	})
+}
+
+// startStorageReconciliation checks hourly and reconciles once per interval across all
+// instances: whichever sets the marker first runs, and the marker expires with the interval
+func startStorageReconciliation() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWithRecovery("storage_reconciliation", nil, func() {
+			ctx := backgroundStorage(context.Background())
+			ok, err := rdb.SetNX(ctx, storageReconcileKey, time.Now().Unix(), storageReconcileInterval).Result()
+			if err != nil || !ok {
+				return
+			}
+			reconcileStorage(ctx)
+		})
+	}
+}
+
+// reconcileStorage totals the listed objects per owner and moves each user's total by
+// listed minus what it was when the listing started, so bytes recorded meanwhile stand.
+// Download conversions are a cache and aren't counted; objects no row claims are left
+// to the orphan sweep. A listing error aborts without correcting anything
+func reconcileStorage(ctx context.Context) {
+	started := time.Now()
+	before := map[string]int64{}
+	rows, err := db.QueryContext(ctx, `SELECT user_id, bytes FROM storage_usage`)
+	if err != nil {
+		log.Printf("❌ Failed to load storage totals: %v", err)
+		return
+	}
+	for rows.Next() {
+		var userID string
+		var n int64
+		if rows.Scan(&userID, &n) == nil {
+			before[userID] = n
+		}
+	}
+	rows.Close()
+
+	listed := map[string]int64{}
+	throttle := time.NewTicker(time.Duration(float64(time.Second) / max(orphanPagesPerSecond, 0.1)))
+	defer throttle.Stop()
+	var scanned int64
+	for _, prefix := range storageUsagePrefixes() {
+		cursor := ""
+		for {
+			<-throttle.C
+			page, next, err := storage.List(ctx, prefix, cursor, orphanPageSize)
+			if err != nil {
+				log.Printf("❌ Storage reconciliation aborted listing %s: %v", prefix, err)
+				return
+			}
+			scanned += int64(len(page))
+			if err := attributeObjects(ctx, prefix, page, listed); err != nil {
+				log.Printf("❌ Storage reconciliation aborted attributing %s: %v", prefix, err)
+				return
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	corrected := 0
+	for userID := range before {
+		if _, ok := listed[userID]; !ok {
+			listed[userID] = 0
+		}
+	}
+	for userID, n := range listed {
+		drift := n - before[userID]
+		if drift != 0 {
+			direction := "up"
+			if drift < 0 {
+				direction = "down"
+			}
+			storageCorrections.WithLabelValues(direction).Inc()
+			log.Printf("📐 Storage total for user %s drifted by %d bytes (recorded %d, listed %d)",
+				userID, drift, before[userID], n)
+			corrected++
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO storage_usage (user_id, bytes, reconciled_at) VALUES ($1, $2, now())
+			ON CONFLICT (user_id) DO UPDATE
+			SET bytes = greatest(storage_usage.bytes + $3, 0), reconciled_at = now(), updated_at = now()`,
+			userID, n, drift); err != nil {
+			log.Printf("❌ Failed to correct storage total for %s: %v", userID, err)
+		}
+	}
+	log.Printf("📐 Storage reconciliation: %d objects, %d users, %d corrected in %s",
+		scanned, len(listed), corrected, time.Since(started).Round(time.Second))
+}
+
+// storageUsagePrefixes is the generations prefix and the user prefixes, under every
+// tenant's storage prefix
+func storageUsagePrefixes() []string {
+	prefixes := orphanSweepPrefixes()
+	for _, t := range allTenants() {
+		for _, p := range userStoragePrefixes {
+			prefixes = append(prefixes, tenantStoragePrefix(t.ID)+p)
+		}
+	}
+	return prefixes
+}
+
+// attributeObjects adds each object's size to its owner in totals: by path under a user
+// prefix, otherwise through the row that references it the way unreferencedObjects does
+func attributeObjects(ctx context.Context, prefix string, page []StoredObject, totals map[string]int64) error {
+	if !containsString(orphanSweepPrefixes(), prefix) {
+		for _, o := range page {
+			if userID, _, ok := strings.Cut(strings.TrimPrefix(o.Key, prefix), "/"); ok && userID != "" {
+				totals[userID] += o.Size
+			}
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(page))
+	sizes := make(map[string]int64, len(page))
+	for _, o := range page {
+		if !downloadConversion.MatchString(o.Key) {
+			keys = append(keys, o.Key)
+			sizes[o.Key] = o.Size
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT k, coalesce(
+			(SELECT user_id::text FROM generated_content
+			 WHERE content_url IN (k, regexp_replace(k, '\.png$', '-final.png')) LIMIT 1),
+			(SELECT user_id::text FROM generated_content WHERE thumbnail_key = k LIMIT 1),
+			(SELECT user_id::text FROM generated_content WHERE poster_key = k LIMIT 1),
+			(SELECT g.user_id::text FROM generation_renditions r JOIN generated_content g USING (request_id)
+			 WHERE r.s3_key = k LIMIT 1), '')
+		FROM unnest($1::text[]) k`, pq.Array(keys))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, userID string
+		if err := rows.Scan(&key, &userID); err != nil {
+			return err
+		}
+		if userID != "" {
+			totals[userID] += sizes[key]
+		}
+	}
+	return rows.Err()
+}
+
+// getUsageHandler handles GET /usage
+func getUsageHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+	u, err := loadStorageUsage(c.Request.Context(), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load usage for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to load usage")
+		return
+	}
+	buckets, err := userBuckets(c.Request.Context(), user.ID.String())
+	if err != nil {
+		log.Printf("❌ Failed to load request buckets for %s: %v", user.ID, err)
+		respondError(c, codeInternal, "Failed to load usage")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plan": userPlan(c.Request.Context(), user.ID.String()), "storage": u,
+		"model_blocks": userModelBlocks(c.Request.Context(), user.ID.String()),
+		"budget":       userBudgetStatus(c.Request.Context(), user.ID.String()),
+		"buckets":      buckets})
+}
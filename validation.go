@@ -0,0 +1,73 @@
+// validation.go
+// Prompt and message size limits enforced before anything reaches Redis
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	maxPromptLength     = getEnvInt("MAX_PROMPT_LENGTH", 2000)       // characters, not bytes
+	maxMessageBytes     = getEnvInt("MAX_MESSAGE_BYTES", 32*1024)    // request published to Redis, after compression
+	maxRequestBodyBytes = getEnvInt("MAX_REQUEST_BODY_BYTES", 1<<20) // any HTTP request body
+)
+
+var (
+	ErrPromptTooLarge  = errors.New("prompt too large")
+	ErrPromptInvalid   = errors.New("prompt invalid")
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// sanitizePrompt validates UTF-8, strips control characters (keeping newlines and
+// tabs) and enforces maxPromptLength. Errors wrap ErrPromptTooLarge or ErrPromptInvalid.
+func sanitizePrompt(prompt string) (string, error) {
+	if !utf8.ValidString(prompt) {
+		return "", fmt.Errorf("%w: not valid UTF-8", ErrPromptInvalid)
+	}
+	cleaned := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, prompt))
+
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: must not be empty", ErrPromptInvalid)
+	}
+	if n := utf8.RuneCountInString(cleaned); n > maxPromptLength {
+		return "", fmt.Errorf("%w: %d characters, the limit is %d", ErrPromptTooLarge, n, maxPromptLength)
+	}
+	return cleaned, nil
+}
+
+// routeBodyLimits raises the cap for routes that take files
+var routeBodyLimits = map[string]int{
+	"/uploads":               uploadMaxBytes + 64*1024, // room for the multipart framing
+	"/uploads/:id/chunks/:n": uploadChunkMaxBytes,
+}
+
+// bodyLimitMiddleware caps every request body at maxRequestBodyBytes, or the route's limit
+func bodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, ok := routeBodyLimits[unversionedRoute(c.FullPath())]
+		if !ok {
+			limit = maxRequestBodyBytes
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit))
+		c.Next()
+	}
+}
+
+// isBodyTooLarge reports whether a bind error came from bodyLimitMiddleware
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
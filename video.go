@@ -0,0 +1,263 @@
+// video.go
+// Video (AnimateDiff) requests, progress events and asset delivery shared with images
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	videoGenerationChannel = "video_generation_requests" // separate queue; jobs take minutes
+
+	maxVideoDurationSeconds = 4.0
+	maxVideoFPS             = 24
+)
+
+var (
+	defaultVideoModel    = getEnv("DEFAULT_VIDEO_MODEL", "animatediff")
+	videoCreditCost      = getEnvInt("VIDEO_CREDIT_COST", 20)
+	defaultVideoDuration = getEnvFloat("DEFAULT_VIDEO_DURATION_SECONDS", 2)
+	defaultVideoFPS      = getEnvInt("DEFAULT_VIDEO_FPS", 8)
+
+	imageURLTTL = getEnvDuration("IMAGE_URL_TTL", 15*time.Minute)
+	videoURLTTL = getEnvDuration("VIDEO_URL_TTL", time.Hour) // long enough to finish a large download
+
+	progressTTL = getEnvDuration("GENERATION_PROGRESS_TTL", time.Hour)
+)
+
+// generationSpec is a validated queued request; Kind, Label and Channel come from its GenerationKind
+type generationSpec struct {
+	Kind    string // content_type on the row
+	Label   string // for user-facing messages
+	Channel string
+	Model   string
+
+	DurationSeconds float64
+	FPS             int
+
+	Resolution int // zero for the default; see quoteGeneration
+	Steps      int
+	NumImages  int
+}
+
+func init() {
+	registerKind(&GenerationKind{
+		Name:         "video",
+		Label:        "Video",
+		Channel:      videoGenerationChannel,
+		DefaultModel: defaultVideoModel,
+		Spec:         videoSpec,
+		BaseCredits:  func() int { return videoCreditCost },
+		Cost: func(q *Quote, spec generationSpec, limits PlanLimits) float64 {
+			return spec.DurationSeconds * float64(spec.FPS) / (defaultVideoDuration * float64(defaultVideoFPS))
+		},
+		ApplyCompleted: func(ctx context.Context, completion ImageGenerationCompletion) error {
+			if err := storeRenditions(ctx, completion); err != nil {
+				return err
+			}
+			if completion.PosterKey == "" {
+				return nil
+			}
+			return setPosterKey(ctx, completion.RequestID, completion.PosterKey)
+		},
+	})
+}
+
+// videoSpec validates duration and frame rate, which default when omitted
+func videoSpec(req RequestPayload) (generationSpec, error) {
+	if req.Resolution != 0 || req.Steps != 0 || req.NumImages > 1 {
+		return generationSpec{}, errors.New("resolution, steps and num_images are for image requests")
+	}
+
+	duration := req.DurationSeconds
+	if duration == 0 {
+		duration = defaultVideoDuration
+	}
+	if duration < 0 || duration > maxVideoDurationSeconds {
+		return generationSpec{}, errors.New("duration_seconds must be between 0 and 4")
+	}
+	fps := req.FPS
+	if fps == 0 {
+		fps = defaultVideoFPS
+	}
+	if fps < 1 || fps > maxVideoFPS {
+		return generationSpec{}, errors.New("fps must be between 1 and " + strconv.Itoa(maxVideoFPS))
+	}
+	return generationSpec{DurationSeconds: duration, FPS: fps}, nil
+}
+
+func progressKey(requestID string) string {
+	return "generation:progress:" + requestID
+}
+
+// recordProgress keeps the worker's latest percentage; it's ephemeral, so Redis rather than
+// the row. Crossing a milestone also buffers a write to the row (see progress_milestones.go)
+func recordProgress(ctx context.Context, requestID string, percent float64) {
+	var previous *redis.StringCmd
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		previous = pipe.GetSet(ctx, progressKey(requestID), percent)
+		pipe.Expire(ctx, progressKey(requestID), progressTTL)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Printf("⚠️ Failed to record progress for %s: %v", requestID, err)
+		return
+	}
+	before, _ := previous.Float64()
+	queueProgressMilestone(requestID, before, percent)
+}
+
+func urlTTL(contentType string) time.Duration {
+	if contentType == "video" {
+		return videoURLTTL
+	}
+	return imageURLTTL
+}
+
+// withGenerationURLs presigns the rendition closest to size plus the poster and thumbnail,
+// and overlays progress for rows still running
+func withGenerationURLs(ctx context.Context, g *Generation, size string) {
+	// Progress lives in Redis, which may be what put us in read-only mode; the last
+	// milestone written to the row stands in when it can't be read
+	if g.Status == "queued" || g.Status == "processing" {
+		if p, err := rdb.Get(ctx, progressKey(g.RequestID)).Float64(); err == nil && !serviceDegraded() {
+			g.Progress = &p
+		} else if g.ProgressMilestone > 0 {
+			p := float64(g.ProgressMilestone)
+			g.Progress = &p
+		}
+	}
+	if g.Status != "completed" || g.ContentType == "text" {
+		return
+	}
+
+	ttl := urlTTL(g.ContentType)
+	if r := g.pickRendition(size); r.S3Key != "" {
+		if url, err := storage.PresignGet(ctx, r.S3Key, ttl); err == nil {
+			g.URL, g.Size, g.Width, g.Height = url, r.Kind, r.Width, r.Height
+		} else {
+			log.Printf("⚠️ Failed to presign %s: %v", r.S3Key, err)
+		}
+	}
+	thumb, _ := g.thumbnail()
+	for _, asset := range []struct {
+		key string
+		url *string
+	}{{g.PosterKey, &g.PosterURL}, {thumb.S3Key, &g.ThumbnailURL}} {
+		if asset.key == "" {
+			continue
+		}
+		if url, err := storage.PresignGet(ctx, asset.key, ttl); err == nil {
+			*asset.url = url
+		} else {
+			log.Printf("⚠️ Failed to presign %s: %v", asset.key, err)
+		}
+	}
+	withRenditionLinks(ctx, g, ttl)
+}
+
+// setPosterKey stores the poster frame reported with a video completion
+func setPosterKey(ctx context.Context, requestID, posterKey string) error {
+	_, err := db.ExecContext(ctx, `UPDATE generated_content SET poster_key = $1 WHERE request_id = $2`,
+		posterKey, requestID)
+	return err
+}
+
+// downloadGenerationHandler handles GET /generations/:id/download[?asset=poster][&format=],
+// streaming so multi-megabyte videos never sit in memory. Images are converted to the
+// format negotiated from ?format= or Accept (see formats.go)
+func downloadGenerationHandler(c *gin.Context) {
+	user := c.MustGet("currentUser").(*repository.User)
+
+	g, err := getGeneration(c.Request.Context(), c.Param("id"), user.ID.String())
+	if err == sql.ErrNoRows {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Failed to load generation %s: %v", c.Param("id"), err)
+		respondError(c, codeInternal, "Failed to load generation")
+		return
+	}
+	if g.TrashedAt != nil {
+		respondError(c, codeNotFound, "Generation not found")
+		return
+	}
+	if g.Status != "completed" || g.ContentType == "text" {
+		respondError(c, codeConflict, "Generation has no downloadable asset")
+		return
+	}
+
+	key := g.ContentURL
+	if c.Query("asset") == "poster" {
+		key = g.PosterKey
+	}
+	if key == "" {
+		respondError(c, codeNotFound, "Asset not found")
+		return
+	}
+
+	var format *imageFormat
+	if convertibleSource(key) {
+		var ok bool
+		if format, ok = negotiateFormat(c); !ok {
+			return
+		}
+		c.Header("Vary", "Accept")
+	} else if c.Query("format") != "" {
+		fieldError(c, codeValidationFailed, "format", "only images can be converted")
+		return
+	}
+
+	// The key names the bytes, so a client holding the expected copy needs nothing opened
+	expected := key
+	if format != nil {
+		expected = convertedKey(key, format)
+	}
+	c.Header("Cache-Control", assetCacheControl)
+	if etagMatches(c.GetHeader("If-None-Match"), assetETag(expected)) {
+		c.Header("ETag", assetETag(expected))
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	asset, converted := servedAsset{}, false
+	if format != nil {
+		asset, converted = convertedAsset(c.Request.Context(), key, format)
+	}
+	if !converted {
+		format = nil
+		body, size, err := storage.Open(c.Request.Context(), key)
+		if err != nil {
+			log.Printf("❌ Failed to open %s: %v", key, err)
+			respondError(c, codeUpstreamFailed, "Failed to fetch asset")
+			return
+		}
+		asset = servedAsset{Key: key, ContentType: mime.TypeByExtension(path.Ext(key)), Body: body, Size: size}
+		if asset.ContentType == "" {
+			asset.ContentType = "application/octet-stream"
+		}
+	}
+	defer asset.Body.Close()
+
+	etag := assetETag(asset.Key)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+assetFilename(key, format)+`"`)
+	c.DataFromReader(http.StatusOK, asset.Size, asset.ContentType, asset.Body, nil)
+}
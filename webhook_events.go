@@ -0,0 +1,90 @@
+// webhook_events.go
+// Ordered events for generic webhooks. Besides a request's outcome, its owner's webhook
+// endpoints hear "processing" once a worker picks it up and "progress" at each milestone
+// (progress_milestones.go); other channel kinds only hear the outcome. Every delivery
+// carries an event_id that its redeliveries repeat, so a consumer can drop what it has
+// already seen. A request's events to one endpoint carry increasing sequence numbers and
+// go out one at a time in that order: the delivery worker doesn't claim one while an
+// earlier one is still pending, being sent or held. An event queued after a later stage of
+// its request, such as a milestone written after the completion, is dropped rather than
+// sent out of order. Sequences come from one Postgres sequence, so they have gaps
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// webhookEventStage ranks n among its request's events; one is only queued at or after the
+// furthest stage queued so far
+func webhookEventStage(n Notification) int {
+	switch n.Status {
+	case "processing":
+		return 1
+	case "progress":
+		return 1 + n.Progress
+	}
+	return 1000
+}
+
+// webhookOnlyEvent reports whether status is one only generic webhooks get
+func webhookOnlyEvent(status string) bool {
+	return status == "processing" || status == "progress"
+}
+
+// webhookOrderKey is what a delivery of n to a channel is ordered under, "" for none
+func webhookOrderKey(kind, channelID string, n Notification) string {
+	if kind != "webhook" || n.RequestID == "" {
+		return ""
+	}
+	return channelID + ":" + n.RequestID
+}
+
+// notifyWebhookEvent queues a processing or progress event for requestID's webhooks
+func notifyWebhookEvent(ctx context.Context, requestID, status string, progress int) {
+	n, orgID, err := loadNotification(ctx, requestID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load generation %s for its %s event: %v", requestID, status, err)
+		return
+	}
+	n.Status, n.Progress, n.ImageURL = status, progress, ""
+	fanOutNotification(ctx, db, n, orgID)
+}
+
+// enqueueOrderedDelivery queues n behind the earlier events of orderKey, numbering it in
+// the same statement that checks its stage. Ordered deliveries are held whole for quiet
+// hours, never folded into a digest that would lose their order. A stale or repeated event
+// queues nothing
+func enqueueOrderedDelivery(ctx context.Context, q execer, targetType, target, dedupeKey, orderKey string,
+	n Notification, held heldDelivery) error {
+	enc, err := encryptSecret(target)
+	if err != nil {
+		return err
+	}
+	if n.EventID == "" {
+		n.EventID = newID()
+	}
+	payload, err := marshalDeliveryPayload(n)
+	if err != nil {
+		return err
+	}
+	status, due := deliveryPending, time.Now()
+	if !held.until.IsZero() {
+		status, due = deliveryHeld, held.until
+	}
+	_, err = q.ExecContext(ctx, `
+		WITH stage AS (
+			INSERT INTO webhook_event_stages (order_key, stage) VALUES ($7, $8)
+			ON CONFLICT (order_key) DO UPDATE SET stage = EXCLUDED.stage, updated_at = now()
+			WHERE webhook_event_stages.stage <= EXCLUDED.stage
+			RETURNING nextval('webhook_event_sequence') AS seq
+		)
+		INSERT INTO notification_deliveries (target_type, target_enc, payload, dedupe_key, status, next_attempt_at,
+		                                     order_key, sequence)
+		SELECT $1, $2, jsonb_set($3::jsonb, '{sequence}', to_jsonb(seq)), $4, $5, $6, $7, seq FROM stage
+		ON CONFLICT (dedupe_key) DO NOTHING`, targetType, enc, payload, dedupeKey, status, due, orderKey,
+		webhookEventStage(n))
+	return err
+}
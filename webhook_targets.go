@@ -0,0 +1,109 @@
+// webhook_targets.go
+// Keeps notification webhooks off internal addresses. Every connection the notifier
+// client makes is checked after DNS resolution, against the address actually dialled, so
+// a hostname that resolves (or re-resolves, or redirects) to a private, loopback or
+// link-local address is refused. NOTIFY_ALLOW_PRIVATE_TARGETS turns the check off, for
+// tests delivering to a local receiver
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	notifyAllowPrivateTargets = getEnvBool("NOTIFY_ALLOW_PRIVATE_TARGETS", false)
+
+	errPrivateWebhookTarget = errors.New("webhook target is not a public address")
+
+	// Ranges that aren't private by net.IP's methods but aren't the public internet either
+	nonPublicNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// publicAddress reports whether ip is somewhere a webhook may be sent
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses a connection to anything but a public address
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	if notifyAllowPrivateTargets {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return errPrivateWebhookTarget
+	}
+	return nil
+}
+
+// newNotifyHTTPClient dials through webhookDialControl. It never uses a proxy, which
+// would make the proxy's address the one checked
+func newNotifyHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second, Control: webhookDialControl}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// checkWebhookHost resolves a webhook URL's host when the channel is registered, so a
+// target that resolves to an internal address is refused up front. A name that doesn't
+// resolve yet is let through: the dialer checks every delivery anyway, since the name may
+// resolve elsewhere later
+func checkWebhookHost(ctx context.Context, target string) error {
+	if notifyAllowPrivateTargets {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if !publicAddress(a.IP) {
+			return errPrivateWebhookTarget
+		}
+	}
+	return nil
+}
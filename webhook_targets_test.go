@@ -0,0 +1,48 @@
+// webhook_targets_test.go
+// Which addresses a webhook may be dialled at
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false, // cloud metadata
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := publicAddress(net.ParseIP(addr)); got != want {
+			t.Errorf("publicAddress(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestWebhookDialControl(t *testing.T) {
+	allow := notifyAllowPrivateTargets
+	t.Cleanup(func() { notifyAllowPrivateTargets = allow })
+
+	notifyAllowPrivateTargets = false
+	if err := webhookDialControl("tcp4", "127.0.0.1:443", nil); err != errPrivateWebhookTarget {
+		t.Errorf("dialling loopback: %v, want errPrivateWebhookTarget", err)
+	}
+	if err := webhookDialControl("tcp4", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("dialling a public address: %v", err)
+	}
+	notifyAllowPrivateTargets = true
+	if err := webhookDialControl("tcp4", "127.0.0.1:443", nil); err != nil {
+		t.Errorf("dialling loopback with NOTIFY_ALLOW_PRIVATE_TARGETS: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// worker_errors.go
+// Failure reasons reported by the worker. A failed completion carries error_code, and
+// every known code has a user-facing message (localized like error envelopes) and a retry
+// class that decides whether the request is republished automatically. Rows keep the
+// code, the message in error and the worker's raw text in worker_error, which only
+// admins see. A completion without a recognized code falls back to matching its text
+// against known patterns, counted in mobart_worker_error_codes_unrecognized_total so a
+// code the worker starts sending gets noticed and added here
+
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Completion error codes; errorCodeInputExpired is in inputs.go
+const (
+	errorCodeOOM           = "oom"
+	errorCodeNSFWOutput    = "nsfw_output_blocked"
+	errorCodeModelLoad     = "model_load_failed"
+	errorCodeInvalidParams = "invalid_params"
+	errorCodeUnknown       = "unknown"
+)
+
+// Retry classes
+const (
+	retryTransient  = "transient"   // republished up to WORKER_ERROR_RETRIES times; another attempt may work
+	retryFreshInput = "fresh_input" // republished once with a new input URL (inputs.go)
+	retryNever      = "permanent"   // the same request would fail the same way
+)
+
+// workerError is what a code means to the user and to the retry logic
+type workerError struct {
+	Message string // English; the catalog key for translations
+	Retry   string
+}
+
+var workerErrors = map[string]workerError{
+	errorCodeOOM:           {"The model ran out of memory. Try a lower resolution or fewer images", retryTransient},
+	errorCodeNSFWOutput:    {"The result was blocked by the safety filter. Try a different prompt", retryNever},
+	errorCodeModelLoad:     {"The model couldn't be loaded. Please try again shortly", retryTransient},
+	errorCodeInvalidParams: {"The generation settings were rejected. Check the resolution, steps and image count", retryNever},
+	errorCodeInputExpired:  {"The input image link expired before it could be used. Please try again", retryFreshInput},
+	errorCodeUnknown:       {"Generation failed. Please try again", retryNever},
+}
+
+// workerErrorPatterns classify text from workers that send no code, or one we don't know;
+// first match wins
+var workerErrorPatterns = []struct {
+	re   *regexp.Regexp
+	code string
+}{
+	{regexp.MustCompile(`(?i)out of memory|\boom\b`), errorCodeOOM},
+	{regexp.MustCompile(`(?i)nsfw|safety (checker|filter)`), errorCodeNSFWOutput},
+	{regexp.MustCompile(`(?i)(load(ing)?|find) (the )?(model|checkpoint|weights)|model not found`), errorCodeModelLoad},
+	{regexp.MustCompile(`(?i)invalid (param|argument|value|resolution|steps)`), errorCodeInvalidParams},
+	{regexp.MustCompile(`(?i)input url (has )?expired`), errorCodeInputExpired},
+}
+
+var (
+	// A request is republished at most this many times for transient errors
+	workerErrorRetries = getEnvInt("WORKER_ERROR_RETRIES", 1)
+
+	// Codes are short snake_case; anything else is counted as "invalid" to bound the labels
+	workerErrorCodeLabel = regexp.MustCompile(`^[a-z0-9_]{1,40}$`)
+
+	workerFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_worker_failures_total",
+		Help: "Failed completions, by classified error code.",
+	}, []string{"code"})
+	workerErrorCodesUnrecognized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_worker_error_codes_unrecognized_total",
+		Help: "Failed completions classified from their text, by the code sent (none, invalid or the code) and the code matched.",
+	}, []string{"code", "matched"})
+	workerErrorRepublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mobart_worker_error_retries_total",
+		Help: "Requests republished automatically after a worker failure, by error code.",
+	}, []string{"code"})
+)
+
+// classifyWorkerError returns the known code for a failure: the one sent when we know it,
+// else whatever the text matches, else unknown
+func classifyWorkerError(code, text string) string {
+	if _, ok := workerErrors[code]; ok {
+		workerFailures.WithLabelValues(code).Inc()
+		return code
+	}
+	matched := errorCodeUnknown
+	for _, p := range workerErrorPatterns {
+		if p.re.MatchString(text) {
+			matched = p.code
+			break
+		}
+	}
+	label := code
+	switch {
+	case code == "":
+		label = "none"
+	case !workerErrorCodeLabel.MatchString(code):
+		label = "invalid"
+	}
+	workerErrorCodesUnrecognized.WithLabelValues(label, matched).Inc()
+	workerFailures.WithLabelValues(matched).Inc()
+	return matched
+}
+
+// workerErrorMessage is the English message for a classified code
+func workerErrorMessage(code string) string {
+	if e, ok := workerErrors[code]; ok {
+		return e.Message
+	}
+	return workerErrors[errorCodeUnknown].Message
+}
+
+// republishAfterWorkerError sends a request back to the queue after a transient failure,
+// while it has retries left and time before its deadline
+func republishAfterWorkerError(ctx context.Context, requestID, code string) bool {
+	g, err := scanQueuedGeneration(db.QueryRowContext(ctx, `
+		UPDATE generated_content SET error_retries = error_retries + 1
+		WHERE request_id = $1 AND error_retries < $2
+		  AND status IN ('queued', 'processing') AND (deadline IS NULL OR deadline > now())
+		RETURNING `+queuedColumns, requestID, workerErrorRetries))
+	if err != nil {
+		return false
+	}
+	if err := publishGenerationRequest(g.channel(), g.request()); err != nil {
+		log.Printf("❌ Failed to republish request %s after %s: %v", requestID, code, err)
+		return false
+	}
+	workerErrorRepublished.WithLabelValues(code).Inc()
+	log.Printf("🔁 Republished request %s after a %s failure", requestID, code)
+	return true
+}
+
+// markWorkerFailure records a classified worker failure on a row still in flight, with
+// its refund, claiming both in fx (see processed_effects.go)
+func markWorkerFailure(ctx context.Context, fx *completionEffects, requestID, userID, code, raw string) (applied bool, err error) {
+	return transitionGeneration(ctx, requestID, generationWrite{
+		Writer: "listener", To: "failed", From: []string{"queued", "processing"}, Owner: userID,
+		Set:  "completed_at = now(), error = $4, error_code = $5, worker_error = $6",
+		Args: []interface{}{workerErrorMessage(code), code, raw}, Refund: "failed",
+		Effects: []string{effectResult, effectRefund}, Claimed: fx.note,
+	})
+}
+
+// localizeGenerationError translates a classified failure's message for the request.
+// Older rows and backend-side failures have no code and keep their text
+func localizeGenerationError(c *gin.Context, g *Generation) {
+	if g.ErrorCode != "" && g.Error != "" {
+		g.Error = localizeMessage(requestLocale(c), "error", g.Error, nil)
+	}
+}
@@ -0,0 +1,363 @@
+// workers.go
+// Per-worker attribution and draining: /admin/workers joins heartbeats with the outcomes of
+// the generations each worker completed, and a drained worker is told over worker_control
+// to stop pulling new jobs while the capacity aggregate stops counting it
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	workerControlChannel = "worker_control"
+	workerLastSeenKey    = "worker:last_seen" // worker_id -> unix millis of its last heartbeat
+	workerDrainedKey     = "worker:drained"   // set of worker IDs, mirrored from worker_drains
+)
+
+var (
+	// Window for the success rate and average generation time in /admin/workers
+	workerStatsWindow = getEnvDuration("WORKER_STATS_WINDOW", 24*time.Hour)
+	// Workers silent longer than this drop off /admin/workers unless they are drained
+	workerForgetAfter = getEnvDuration("WORKER_FORGET_AFTER", 7*24*time.Hour)
+)
+
+// WorkerControl is published on worker_control; workers act on messages with their own ID
+type WorkerControl struct {
+	WorkerID  string `json:"worker_id"`
+	Action    string `json:"action"`               // "drain", "resume" or "abandon"
+	RequestID string `json:"request_id,omitempty"` // the job to abandon, its lease lost (see leases.go)
+	Reason    string `json:"reason,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+func publishWorkerControl(ctx context.Context, workerID, action, reason string) error {
+	data, _ := json.Marshal(WorkerControl{WorkerID: workerID, Action: action, Reason: reason,
+		Timestamp: time.Now().UTC().Format(time.RFC3339)})
+	return rdb.Publish(ctx, workerControlChannel, data).Err()
+}
+
+// drainedWorkers is the Redis mirror of worker_drains, read on every capacity check
+func drainedWorkers(ctx context.Context) (map[string]bool, error) {
+	ids, err := rdb.SMembers(ctx, workerDrainedKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	drained := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drained[id] = true
+	}
+	return drained, nil
+}
+
+// syncDrainedWorkers rebuilds the Redis set from the table, which is the source of truth
+func syncDrainedWorkers(ctx context.Context) error {
+	ids, err := queryKeys(ctx, `SELECT worker_id FROM worker_drains`)
+	if err != nil {
+		return err
+	}
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, workerDrainedKey)
+	if len(ids) > 0 {
+		members := make([]interface{}, len(ids))
+		for i, id := range ids {
+			members[i] = id
+		}
+		pipe.SAdd(ctx, workerDrainedKey, members...)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// noteHeartbeat records when the worker was last heard from, renews the leases of the jobs
+// it lists and corrects a worker whose reported draining state disagrees with ours, e.g.
+// after a restart or a missed message. Workers that don't report draining are sent the
+// drain again on every heartbeat
+func noteHeartbeat(ctx context.Context, hb WorkerHeartbeat) {
+	rdb.HSet(ctx, workerLastSeenKey, hb.WorkerID, hb.ReceivedAt)
+	renewHeartbeatLeases(ctx, hb)
+	drained, err := rdb.SIsMember(ctx, workerDrainedKey, hb.WorkerID).Result()
+	if err != nil || drained == hb.Draining {
+		return
+	}
+	action := "resume"
+	if drained {
+		action = "drain"
+	}
+	if err := publishWorkerControl(ctx, hb.WorkerID, action, ""); err != nil {
+		log.Printf("⚠️ Failed to repeat %s to worker %s: %v", action, hb.WorkerID, err)
+	}
+}
+
+func auditWorker(ctx context.Context, workerID, action, actor, reason string) {
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO worker_drain_audit (worker_id, action, actor, reason) VALUES ($1, $2, $3, $4)`,
+		workerID, action, actor, reason); err != nil {
+		log.Printf("⚠️ Failed to audit %s of worker %s: %v", action, workerID, err)
+	}
+}
+
+// WorkerSummary is one row of /admin/workers
+type WorkerSummary struct {
+	WorkerID      string     `json:"worker_id"`
+	Models        []string   `json:"models"` // from live heartbeats
+	Live          bool       `json:"live"`
+	LastSeen      *time.Time `json:"last_seen,omitempty"`
+	CurrentLoad   int        `json:"current_load"`
+	MaxConcurrent int        `json:"max_concurrent"`
+
+	Drained   bool       `json:"drained"`
+	DrainedAt *time.Time `json:"drained_at,omitempty"`
+	DrainedBy string     `json:"drained_by,omitempty"`
+	Reason    string     `json:"drain_reason,omitempty"`
+
+	// Over WORKER_STATS_WINDOW, by completion time
+	Completed            int      `json:"completed"`
+	Failed               int      `json:"failed"`
+	SuccessRate          *float64 `json:"success_rate,omitempty"` // unset with nothing finished
+	AvgGenerationSeconds *float64 `json:"avg_generation_seconds,omitempty"`
+}
+
+// workerSummaries merges heartbeats, drains and recent outcomes into one row per worker
+func workerSummaries(ctx context.Context) ([]*WorkerSummary, error) {
+	byID := map[string]*WorkerSummary{}
+	get := func(id string) *WorkerSummary {
+		if w, ok := byID[id]; ok {
+			return w
+		}
+		w := &WorkerSummary{WorkerID: id, Models: []string{}}
+		byID[id] = w
+		return w
+	}
+
+	seen, err := rdb.HGetAll(ctx, workerLastSeenKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	forgetBefore := time.Now().Add(-workerForgetAfter).UnixMilli()
+	var forgotten []string
+	for id, raw := range seen {
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms < forgetBefore {
+			forgotten = append(forgotten, id)
+			continue
+		}
+		t := time.UnixMilli(ms)
+		get(id).LastSeen = &t
+	}
+	if len(forgotten) > 0 {
+		rdb.HDel(ctx, workerLastSeenKey, forgotten...)
+	}
+
+	// Live reports, the same freshness rule as modelCapacity
+	models, err := rdb.SMembers(ctx, workerModelsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	staleBefore := time.Now().Add(-2 * workerHeartbeatInterval).UnixMilli()
+	for _, m := range models {
+		reports, err := rdb.HGetAll(ctx, workerCapacityKey(m)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for id, raw := range reports {
+			var hb WorkerHeartbeat
+			if json.Unmarshal([]byte(raw), &hb) != nil || hb.ReceivedAt < staleBefore {
+				continue
+			}
+			w := get(id)
+			w.Live = true
+			w.Models = append(w.Models, m)
+			w.CurrentLoad += hb.CurrentLoad
+			w.MaxConcurrent += hb.MaxConcurrent
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT worker_id, drained_at, drained_by, reason FROM worker_drains`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var at time.Time
+		var by, reason string
+		if err := rows.Scan(&id, &at, &by, &reason); err != nil {
+			return nil, err
+		}
+		w := get(id)
+		w.Drained, w.DrainedAt, w.DrainedBy, w.Reason = true, &at, by, reason
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats, err := db.QueryContext(ctx, `
+		SELECT worker_id,
+		       count(*) FILTER (WHERE status = 'completed'),
+		       count(*) FILTER (WHERE status = 'failed'),
+		       avg(generation_time_seconds) FILTER (WHERE status = 'completed')
+		FROM generated_content
+		WHERE worker_id IS NOT NULL AND completed_at > $1
+		GROUP BY worker_id`, time.Now().Add(-workerStatsWindow))
+	if err != nil {
+		return nil, err
+	}
+	defer stats.Close()
+	for stats.Next() {
+		var id string
+		var completed, failed int
+		var avg sql.NullFloat64
+		if err := stats.Scan(&id, &completed, &failed, &avg); err != nil {
+			return nil, err
+		}
+		w := get(id)
+		w.Completed, w.Failed = completed, failed
+		if completed+failed > 0 {
+			rate := float64(completed) / float64(completed+failed)
+			w.SuccessRate = &rate
+		}
+		if avg.Valid {
+			w.AvgGenerationSeconds = &avg.Float64
+		}
+	}
+	if err := stats.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*WorkerSummary, 0, len(byID))
+	for _, w := range byID {
+		sort.Strings(w.Models)
+		list = append(list, w)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].WorkerID < list[j].WorkerID })
+	return list, nil
+}
+
+// listWorkersHandler handles GET /admin/workers
+func listWorkersHandler(c *gin.Context) {
+	list, err := workerSummaries(c.Request.Context())
+	if err != nil {
+		log.Printf("❌ Failed to load workers: %v", err)
+		respondError(c, codeInternal, "Failed to load workers")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"workers": list, "stats_window_seconds": workerStatsWindow.Seconds()})
+}
+
+// getWorkerHandler handles GET /admin/workers/:id with the worker's drain history
+func getWorkerHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	list, err := workerSummaries(ctx)
+	if err != nil {
+		log.Printf("❌ Failed to load workers: %v", err)
+		respondError(c, codeInternal, "Failed to load worker")
+		return
+	}
+	var worker *WorkerSummary
+	for _, w := range list {
+		if w.WorkerID == c.Param("id") {
+			worker = w
+		}
+	}
+	if worker == nil {
+		respondError(c, codeNotFound, "Worker not found")
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT action, actor, reason, created_at FROM worker_drain_audit
+		WHERE worker_id = $1 ORDER BY id DESC LIMIT 100`, worker.WorkerID)
+	if err != nil {
+		log.Printf("❌ Failed to load drain history for worker %s: %v", worker.WorkerID, err)
+		respondError(c, codeInternal, "Failed to load worker")
+		return
+	}
+	defer rows.Close()
+	history := []gin.H{}
+	for rows.Next() {
+		var action, actor, reason string
+		var at time.Time
+		if err := rows.Scan(&action, &actor, &reason, &at); err != nil {
+			respondError(c, codeInternal, "Failed to load worker")
+			return
+		}
+		history = append(history, gin.H{"action": action, "actor": actor, "reason": reason, "at": at})
+	}
+	c.JSON(http.StatusOK, gin.H{"worker": worker, "history": history})
+}
+
+// drainWorkerHandler handles POST /admin/workers/:id/drain [{"reason": "..."}]. The worker
+// finishes what it is running; its completions are applied as usual
+func drainWorkerHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	workerID := c.Param("id")
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			respondError(c, codeInvalidRequest, "Invalid request body")
+			return
+		}
+	}
+
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO worker_drains (worker_id, drained_by, reason) VALUES ($1, $2, $3)
+		ON CONFLICT (worker_id) DO NOTHING`, workerID, admin.ID.String(), body.Reason)
+	if err != nil {
+		log.Printf("❌ Failed to drain worker %s: %v", workerID, err)
+		respondError(c, codeInternal, "Failed to drain worker")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeConflict, "Worker is already drained")
+		return
+	}
+	auditWorker(ctx, workerID, "drain", admin.ID.String(), body.Reason)
+
+	// The heartbeat listener repeats the drain, so a failure here only delays it
+	rdb.SAdd(ctx, workerDrainedKey, workerID)
+	if err := publishWorkerControl(ctx, workerID, "drain", body.Reason); err != nil {
+		log.Printf("⚠️ Failed to publish drain to worker %s: %v", workerID, err)
+	}
+	log.Printf("🚰 Worker %s drained by %s", workerID, admin.ID)
+	c.JSON(http.StatusOK, gin.H{"worker_id": workerID, "drained": true})
+}
+
+// resumeWorkerHandler handles DELETE /admin/workers/:id/drain
+func resumeWorkerHandler(c *gin.Context) {
+	admin := c.MustGet("currentUser").(*repository.User)
+	ctx := c.Request.Context()
+	workerID := c.Param("id")
+
+	res, err := db.ExecContext(ctx, `DELETE FROM worker_drains WHERE worker_id = $1`, workerID)
+	if err != nil {
+		log.Printf("❌ Failed to resume worker %s: %v", workerID, err)
+		respondError(c, codeInternal, "Failed to resume worker")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondError(c, codeNotFound, "Worker is not drained")
+		return
+	}
+	auditWorker(ctx, workerID, "resume", admin.ID.String(), "")
+
+	rdb.SRem(ctx, workerDrainedKey, workerID)
+	if err := publishWorkerControl(ctx, workerID, "resume", ""); err != nil {
+		log.Printf("⚠️ Failed to publish resume to worker %s: %v", workerID, err)
+	}
+	log.Printf("🚰 Worker %s resumed by %s", workerID, admin.ID)
+	c.JSON(http.StatusOK, gin.H{"worker_id": workerID, "drained": false})
+}